@@ -0,0 +1,359 @@
+package slidingsync
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2/handler2"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
+	"github.com/rs/zerolog"
+)
+
+// AdminAPI serves operator-only endpoints under /_syncv3/admin. It performs no authentication
+// so must only be exposed on a trusted interface, see RunAdminServer.
+type AdminAPI struct {
+	h2 *handler2.Handler
+	h3 *handler.SyncLiveHandler
+	// ReloadConfig re-reads the configuration and applies any options which can be changed at runtime,
+	// returning the names of changed options which require a restart. If nil, reloading is unsupported.
+	ReloadConfig func() (restartRequired []string, err error)
+}
+
+// NewAdminAPI creates an AdminAPI for the handlers returned from Setup.
+func NewAdminAPI(h2 *handler2.Handler, h3 http.Handler) *AdminAPI {
+	return &AdminAPI{
+		h2: h2,
+		h3: h3.(*handler.SyncLiveHandler),
+	}
+}
+
+// Router returns the routes served by the admin API.
+func (a *AdminAPI) Router() *mux.Router {
+	r := mux.NewRouter()
+	s := r.PathPrefix("/_syncv3/admin").Subrouter()
+	s.HandleFunc("/log_levels", a.getLogLevels).Methods("GET")
+	s.HandleFunc("/log_levels", a.putLogLevels).Methods("PUT")
+	s.HandleFunc("/stats", a.getStats).Methods("GET")
+	s.HandleFunc("/config/reload", a.postReloadConfig).Methods("POST")
+	s.HandleFunc("/maintenance", a.getMaintenance).Methods("GET")
+	s.HandleFunc("/maintenance", a.postMaintenance).Methods("POST")
+	s.HandleFunc("/users/{userID}/evict", a.postEvictUser).Methods("POST")
+	s.HandleFunc("/users/{userID}/erase", a.postEraseUser).Methods("POST")
+	s.HandleFunc("/users/{userID}/devices/{deviceID}/resync", a.postResyncDevice).Methods("POST")
+	s.HandleFunc("/tokens/invalidate", a.postInvalidateToken).Methods("POST")
+	s.HandleFunc("/rooms/{roomID}/purge", a.postPurgeRoom).Methods("POST")
+	s.HandleFunc("/faults", a.getFaults).Methods("GET")
+	s.HandleFunc("/faults", a.putFaults).Methods("PUT")
+	return r
+}
+
+// RunAdminServer serves the admin API on bindAddr to the clients allowed by ipFilter, which may be
+// nil to allow all clients. Blocks until the listener fails.
+func RunAdminServer(a *AdminAPI, bindAddr string, ipFilter *IPFilter) error {
+	logger.Info().Msgf("admin API listening on %s", bindAddr)
+	return http.ListenAndServe(bindAddr, ipFilter.Middleware(a.Router()))
+}
+
+type logLevelsJSON struct {
+	// Default is the level for all modules without an explicit level.
+	Default string `json:"default,omitempty"`
+	// Modules maps module names to their level. An empty level resets the module to the default.
+	Modules map[string]string `json:"modules,omitempty"`
+	// Available lists all modules which can be configured. Only returned in responses.
+	Available []string `json:"available,omitempty"`
+}
+
+func (a *AdminAPI) getLogLevels(w http.ResponseWriter, req *http.Request) {
+	dft, modules := internal.LogLevels()
+	res := logLevelsJSON{
+		Default:   dft.String(),
+		Modules:   make(map[string]string, len(modules)),
+		Available: internal.LogModules(),
+	}
+	for module, lvl := range modules {
+		res.Modules[module] = lvl.String()
+	}
+	writeJSON(w, 200, res)
+}
+
+func (a *AdminAPI) putLogLevels(w http.ResponseWriter, req *http.Request) {
+	var body logLevelsJSON
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSONError(w, 400, fmt.Errorf("failed to decode request body: %w", err))
+		return
+	}
+	// validate everything before changing anything
+	var dft *zerolog.Level
+	if body.Default != "" {
+		lvl, err := internal.ParseLogLevel(body.Default)
+		if err != nil {
+			writeJSONError(w, 400, err)
+			return
+		}
+		dft = &lvl
+	}
+	modules := make(map[string]*zerolog.Level, len(body.Modules))
+	for module, levelStr := range body.Modules {
+		if levelStr == "" {
+			modules[module] = nil
+			continue
+		}
+		lvl, err := internal.ParseLogLevel(levelStr)
+		if err != nil {
+			writeJSONError(w, 400, fmt.Errorf("module %s: %w", module, err))
+			return
+		}
+		modules[module] = &lvl
+	}
+	if dft != nil {
+		internal.SetDefaultLogLevel(*dft)
+	}
+	for module, lvl := range modules {
+		internal.SetModuleLogLevel(module, lvl)
+	}
+	logger.Info().Str("default", body.Default).Any("modules", body.Modules).Msg("admin: updated log levels")
+	a.getLogLevels(w, req)
+}
+
+func (a *AdminAPI) getStats(w http.ResponseWriter, req *http.Request) {
+	stats, err := gatherStats(a.h2, a.h3)
+	if err != nil {
+		writeJSONError(w, 500, err)
+		return
+	}
+	writeJSON(w, 200, stats)
+}
+
+func (a *AdminAPI) getMaintenance(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, 200, a.h2.Store.Maintenance.Progress())
+}
+
+// postMaintenance starts a maintenance run in the background. Poll getMaintenance for progress.
+func (a *AdminAPI) postMaintenance(w http.ResponseWriter, req *http.Request) {
+	if err := a.h2.Store.Maintenance.Start("admin"); err != nil {
+		code := 500
+		if errors.Is(err, state.ErrMaintenanceRunning) {
+			code = http.StatusConflict
+		}
+		writeJSONError(w, code, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, a.h2.Store.Maintenance.Progress())
+}
+
+type reloadConfigResponse struct {
+	RestartRequired []string `json:"restart_required"`
+}
+
+// postReloadConfig is equivalent to sending SIGHUP to the process.
+func (a *AdminAPI) postReloadConfig(w http.ResponseWriter, req *http.Request) {
+	if a.ReloadConfig == nil {
+		writeJSONError(w, http.StatusNotImplemented, fmt.Errorf("config reloading is not supported"))
+		return
+	}
+	restartRequired, err := a.ReloadConfig()
+	if err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	if restartRequired == nil {
+		restartRequired = []string{}
+	}
+	logger.Info().Strs("restart_required", restartRequired).Msg("admin: reloaded config")
+	writeJSON(w, 200, reloadConfigResponse{
+		RestartRequired: restartRequired,
+	})
+}
+
+type evictRequest struct {
+	// DeviceID restricts the eviction to a single device. If empty, all of the user's devices are evicted.
+	DeviceID string `json:"device_id"`
+	// StopPoller also stops the v2 poller(s), which will restart when the device next syncs.
+	StopPoller bool `json:"stop_poller"`
+}
+
+type evictResponse struct {
+	ConnsDestroyed int `json:"conns_destroyed"`
+	PollersStopped int `json:"pollers_stopped"`
+}
+
+// postEvictUser destroys all conns for a user or device, optionally stopping their pollers too.
+// Clients will receive M_UNKNOWN_POS on their next request.
+func (a *AdminAPI) postEvictUser(w http.ResponseWriter, req *http.Request) {
+	userID := mux.Vars(req)["userID"]
+	var body evictRequest
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeJSONError(w, 400, fmt.Errorf("failed to decode request body: %w", err))
+			return
+		}
+	}
+	var res evictResponse
+	// stop the pollers first, else a new conn could start using the poller before we forget it
+	if body.StopPoller {
+		res.PollersStopped = a.h2.StopPollers(userID, body.DeviceID)
+	}
+	res.ConnsDestroyed = a.h3.EvictConns(userID, body.DeviceID, body.StopPoller)
+	writeJSON(w, 200, res)
+}
+
+type eraseUserResponse struct {
+	RoomsUpdated    int   `json:"rooms_updated"`
+	EventsUpdated   int64 `json:"events_updated"`
+	ReceiptsDeleted int64 `json:"receipts_deleted"`
+}
+
+// postEraseUser strips the user's display name and avatar from their membership events and deletes
+// their receipts, e.g. for a GDPR erasure request. The user's conns are destroyed asynchronously.
+// Erasure cannot be undone: profile data and receipts for the user are discarded from then on.
+func (a *AdminAPI) postEraseUser(w http.ResponseWriter, req *http.Request) {
+	userID := mux.Vars(req)["userID"]
+	res, err := a.h2.EraseUser(req.Context(), userID)
+	if err != nil {
+		writeJSONError(w, 500, err)
+		return
+	}
+	writeJSON(w, 200, eraseUserResponse{
+		RoomsUpdated:    len(res.RoomIDs),
+		EventsUpdated:   res.NumEvents,
+		ReceiptsDeleted: res.NumReceipts,
+	})
+}
+
+type resyncResponse struct {
+	ConnsDestroyed int `json:"conns_destroyed"`
+}
+
+// postResyncDevice wipes the since token and device data for a device and restarts its poller
+// from scratch. The device's conns are destroyed so the client starts afresh with the new data.
+func (a *AdminAPI) postResyncDevice(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	userID, deviceID := vars["userID"], vars["deviceID"]
+	if err := a.h2.ResyncDevice(userID, deviceID); err != nil {
+		code := 500
+		if errors.Is(err, sql.ErrNoRows) {
+			code = 404
+		}
+		writeJSONError(w, code, err)
+		return
+	}
+	writeJSON(w, 200, resyncResponse{
+		ConnsDestroyed: a.h3.EvictConns(userID, deviceID, true),
+	})
+}
+
+type invalidateTokenRequest struct {
+	// Exactly one of these must be set.
+	AccessToken     string `json:"access_token"`
+	AccessTokenHash string `json:"access_token_hash"`
+}
+
+type invalidateTokenResponse struct {
+	UserID         string `json:"user_id"`
+	DeviceID       string `json:"device_id"`
+	ConnsDestroyed int    `json:"conns_destroyed"`
+}
+
+// postInvalidateToken forgets an access token and stops any pollers using it, without waiting for the
+// homeserver to reject the token. The device's conns are destroyed.
+func (a *AdminAPI) postInvalidateToken(w http.ResponseWriter, req *http.Request) {
+	var body invalidateTokenRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSONError(w, 400, fmt.Errorf("failed to decode request body: %w", err))
+		return
+	}
+	if (body.AccessToken == "") == (body.AccessTokenHash == "") {
+		writeJSONError(w, 400, fmt.Errorf("exactly one of access_token or access_token_hash must be set"))
+		return
+	}
+	tokenHash := body.AccessTokenHash
+	if body.AccessToken != "" {
+		// the token may be stored under a previous pepper, so look up the hash which is actually stored
+		token, err := a.h3.V2Store.TokensTable.Token(body.AccessToken)
+		if err != nil {
+			code := 500
+			if errors.Is(err, sql.ErrNoRows) {
+				code = 404
+				err = fmt.Errorf("unknown access token")
+			}
+			writeJSONError(w, code, err)
+			return
+		}
+		tokenHash = token.AccessTokenHash
+	}
+	userID, deviceID, err := a.h2.InvalidateToken(req.Context(), tokenHash)
+	if err != nil {
+		code := 500
+		if errors.Is(err, sql.ErrNoRows) {
+			code = 404
+			err = fmt.Errorf("unknown access token")
+		}
+		writeJSONError(w, code, err)
+		return
+	}
+	writeJSON(w, 200, invalidateTokenResponse{
+		UserID:         userID,
+		DeviceID:       deviceID,
+		ConnsDestroyed: a.h3.EvictConns(userID, deviceID, false),
+	})
+}
+
+type purgeRoomResponse struct {
+	EventsDeleted int64 `json:"events_deleted"`
+}
+
+// postPurgeRoom deletes all data for a room. Conns for users in the room are destroyed asynchronously.
+func (a *AdminAPI) postPurgeRoom(w http.ResponseWriter, req *http.Request) {
+	roomID := mux.Vars(req)["roomID"]
+	numEvents, err := a.h2.PurgeRoom(req.Context(), roomID)
+	if err != nil {
+		writeJSONError(w, 500, err)
+		return
+	}
+	writeJSON(w, 200, purgeRoomResponse{
+		EventsDeleted: numEvents,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, err error) {
+	herr := internal.HandlerError{
+		StatusCode: code,
+		Err:        err,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(herr.JSON())
+}
+
+// getFaults returns the faults which have yet to be injected, see internal.Faults.
+func (a *AdminAPI) getFaults(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, 200, internal.CurrentFaults())
+}
+
+// putFaults replaces the faults to inject. Only available if the proxy was started with
+// fault injection enabled, which is only done by end-to-end tests.
+func (a *AdminAPI) putFaults(w http.ResponseWriter, req *http.Request) {
+	var body internal.Faults
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSONError(w, 400, fmt.Errorf("failed to decode request body: %w", err))
+		return
+	}
+	if err := internal.SetFaults(body); err != nil {
+		writeJSONError(w, http.StatusNotImplemented, err)
+		return
+	}
+	logger.Warn().Any("faults", body).Msg("admin: injecting faults")
+	writeJSON(w, 200, body)
+}
@@ -0,0 +1,232 @@
+// syncv3-inspect prints what the proxy's database says about a user: the rooms they are joined or
+// invited to along with the metadata used to filter and sort them, their unread counts, and the
+// order the rooms would be sorted into for a sliding sync request. It is used to debug reports of
+// rooms missing from a client's room list without having to make requests as that user.
+//
+// It reads the database directly and does not need the proxy to be running, but it does load the
+// metadata of every room like the proxy does on startup, which can take a while on large databases.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
+)
+
+// EnvDB is the same environment variable the proxy reads its database connection string from.
+const EnvDB = "SYNCV3_DB"
+
+func main() {
+	dbURI := flag.String("db", os.Getenv(EnvDB), "The postgres connection string of the proxy's database, defaults to $"+EnvDB)
+	userID := flag.String("user", "", "The user ID to inspect")
+	requestFile := flag.String("request", "", "A file containing the JSON body of a sliding sync request. If set, prints the rooms in each of its lists in sort order.")
+	flag.Parse()
+
+	if *dbURI == "" || *userID == "" {
+		exitf("-db and -user are required")
+	}
+	var req *sync3.Request
+	if *requestFile != "" {
+		var err error
+		req, err = readRequest(*requestFile)
+		if err != nil {
+			exitf("failed to read request: %s", err)
+		}
+	}
+
+	store := state.NewStorage(*dbURI)
+	defer store.Teardown()
+	if err := inspect(context.Background(), os.Stdout, store, *userID, req); err != nil {
+		exitf("%s", err)
+	}
+}
+
+// readRequest reads a sliding sync request body, filling in defaults the same way the proxy does.
+func readRequest(path string) (*sync3.Request, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var req sync3.Request
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, fmt.Errorf("%s is not a valid request: %w", path, err)
+	}
+	if err := req.Validate(); err != nil {
+		return nil, fmt.Errorf("%s is not a valid request: %w", path, err)
+	}
+	var muxedReq *sync3.Request
+	muxedReq, _ = muxedReq.ApplyDelta(&req)
+	return muxedReq, nil
+}
+
+func inspect(ctx context.Context, w io.Writer, store *state.Storage, userID string, req *sync3.Request) error {
+	snapshot, err := store.GlobalSnapshot()
+	if err != nil {
+		return fmt.Errorf("failed to load room metadata: %w", err)
+	}
+	globalCache := caches.NewGlobalCache(store)
+	if err := globalCache.Startup(snapshot.GlobalMetadata); err != nil {
+		return fmt.Errorf("failed to populate global cache: %w", err)
+	}
+	globalCache.SetLatestNID(snapshot.LatestNID)
+	// we never see any events, so there are no transaction IDs to look up or joins to check
+	userCache, err := handler.LoadUserCache(userID, globalCache, store, nil, nil)
+	if err != nil {
+		return err
+	}
+	var requestLists map[string]sync3.RequestList
+	if req != nil {
+		requestLists = req.Lists
+	}
+	pos, rooms, _, err := handler.LoadRoomConnMetadata(ctx, globalCache, userCache, userID, requestLists)
+	if err != nil {
+		return fmt.Errorf("failed to load rooms: %w", err)
+	}
+	lists := sync3.NewInternalRequestLists()
+	lists.RoomIDsWithNameLike = globalCache.RoomNameSearch()
+	for _, r := range rooms {
+		lists.SetRoom(r)
+	}
+
+	printRooms(w, userID, pos, rooms, lists)
+	if err := printUnreadCounts(w, store, userID, lists); err != nil {
+		return fmt.Errorf("failed to load unread counts: %w", err)
+	}
+	if req != nil {
+		printLists(ctx, w, req, lists, len(rooms))
+	}
+	return nil
+}
+
+// printRooms prints every room the user is joined or invited to, most recent first.
+func printRooms(w io.Writer, userID string, pos int64, rooms []sync3.RoomConnMetadata, lists *sync3.InternalRequestLists) {
+	numInvites := 0
+	for _, r := range rooms {
+		if r.IsInvite {
+			numInvites++
+		}
+	}
+	fmt.Fprintf(w, "%s is joined to %d rooms and invited to %d rooms at position %d\n\n", userID, len(rooms)-numInvites, numInvites, pos)
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].LastMessageTimestamp > rooms[j].LastMessageTimestamp
+	})
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "room\tname\tmembership\tdm\tencrypted\ttype\tjoined\tinvited\tjoined at\tlast message\tnotifs\thighlights\ttags\tupgraded to\t")
+	for _, r := range rooms {
+		// SetRoom calculates the room name
+		room := lists.ReadOnlyRoom(r.RoomID)
+		membership := "join"
+		if room.IsInvite {
+			membership = "invite"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%v\t%s\t%d\t%d\t%s\t%s\t%d\t%d\t%s\t%s\t\n",
+			room.RoomID, room.ComputedName, membership, room.IsDM, room.Encrypted, deref(room.RoomType),
+			room.JoinCount, room.InviteCount, formatTimestamp(room.JoinTiming.Timestamp), formatTimestamp(room.LastMessageTimestamp),
+			room.NotificationCount, room.HighlightCount, formatTags(room.Tags), deref(room.UpgradedRoomID),
+		)
+	}
+	tw.Flush()
+}
+
+// printUnreadCounts prints the unread counts stored for the user. Counts for rooms the user is not
+// in are flagged, as those rooms are not in any list.
+func printUnreadCounts(w io.Writer, store *state.Storage, userID string, lists *sync3.InternalRequestLists) error {
+	type unreadCounts struct {
+		roomID                            string
+		highlightCount, notificationCount int
+	}
+	var unreads []unreadCounts
+	err := store.UnreadTable.SelectAllNonZeroCountsForUser(userID, func(roomID string, highlightCount, notificationCount int) {
+		unreads = append(unreads, unreadCounts{roomID, highlightCount, notificationCount})
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n%d rooms have unread notifications\n\n", len(unreads))
+	if len(unreads) == 0 {
+		return nil
+	}
+	sort.Slice(unreads, func(i, j int) bool {
+		return unreads[i].roomID < unreads[j].roomID
+	})
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "room\tnotifs\thighlights\tnote\t")
+	for _, u := range unreads {
+		note := ""
+		if lists.ReadOnlyRoom(u.roomID) == nil {
+			note = "not joined or invited"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t\n", u.roomID, u.notificationCount, u.highlightCount, note)
+	}
+	tw.Flush()
+	return nil
+}
+
+// printLists prints the rooms in each list of the request in the order they would be sent to the
+// client, marking those within the list's ranges.
+func printLists(ctx context.Context, w io.Writer, req *sync3.Request, lists *sync3.InternalRequestLists, numRooms int) {
+	for _, listKey := range req.ListKeys() {
+		reqList := req.Lists[listKey]
+		roomList, _ := lists.AssignList(ctx, listKey, reqList.Filters, reqList.Sort, sync3.Overwrite)
+		filters, _ := json.Marshal(reqList.Filters)
+		fmt.Fprintf(w, "\nList %q has %d of %d rooms, sorted by %s with filters %s\n\n",
+			listKey, roomList.Len(), numRooms, strings.Join(reqList.Sort, ","), filters)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "index\tin range\troom\tname\tbumped at\tnotifs\thighlights\t")
+		for i, roomID := range roomList.RoomIDs() {
+			room := lists.ReadOnlyRoom(roomID)
+			inRange := ""
+			if _, ok := reqList.Ranges.Inside(int64(i)); ok || reqList.ShouldGetAllRooms() {
+				inRange = "yes"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t\n",
+				i, inRange, roomID, room.ComputedName, formatTimestamp(room.LastInterestedEventTimestamps[listKey]),
+				room.NotificationCount, room.HighlightCount,
+			)
+		}
+		tw.Flush()
+	}
+}
+
+func formatTimestamp(ts uint64) string {
+	if ts == 0 {
+		return "-"
+	}
+	return time.UnixMilli(int64(ts)).UTC().Format(time.RFC3339)
+}
+
+func formatTags(tags map[string]float64) string {
+	if len(tags) == 0 {
+		return "-"
+	}
+	names := make([]string, 0, len(tags))
+	for tag := range tags {
+		names = append(names, tag)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func deref(s *string) string {
+	if s == nil || *s == "" {
+		return "-"
+	}
+	return *s
+}
+
+func exitf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
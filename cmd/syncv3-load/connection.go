@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// The kinds of request a connection makes, which are reported separately as they have very
+// different latencies: live requests block until there is an update or they time out.
+const (
+	kindInitial = "initial"
+	kindScroll  = "scroll"
+	kindLive    = "live"
+)
+
+// connection is a single sliding sync connection, which syncs in a loop until the context is done.
+type connection struct {
+	cfg    config
+	client *http.Client
+	token  string
+	rand   *rand.Rand
+	stats  *stats
+
+	pos      string
+	requests int
+	// the number of rooms in each list and the start of each list's window
+	counts  []int64
+	offsets []int64
+}
+
+func (c *connection) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		kind := kindLive
+		var req sync3.Request
+		if c.pos == "" {
+			kind = kindInitial
+			c.counts = make([]int64, c.cfg.lists)
+			c.offsets = make([]int64, c.cfg.lists)
+			req.Lists = c.lists()
+		} else if c.cfg.scroll != scrollNone && c.requests%c.cfg.scrollEvery == 0 {
+			kind = kindScroll
+			c.scroll()
+			req.Lists = c.lists()
+		}
+		c.requests++
+
+		start := time.Now()
+		body, status, err := c.do(ctx, req)
+		took := time.Since(start)
+		if ctx.Err() != nil {
+			return // the request was cut short by the end of the run, so it tells us nothing
+		}
+		if err != nil || status != http.StatusOK {
+			c.stats.recordError(kind, status, err)
+			if status == http.StatusBadRequest {
+				// most likely M_UNKNOWN_POS e.g because the connection expired, so start again
+				c.pos = ""
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		c.stats.record(kind, took, len(body))
+		parsed := gjson.ParseBytes(body)
+		c.pos = parsed.Get("pos").Str
+		for i := range c.counts {
+			if count := parsed.Get("lists." + listKey(i) + ".count"); count.Exists() {
+				c.counts[i] = count.Int()
+			}
+		}
+	}
+}
+
+// lists returns every list, with its current window.
+func (c *connection) lists() map[string]sync3.RequestList {
+	lists := make(map[string]sync3.RequestList, c.cfg.lists)
+	for i := 0; i < c.cfg.lists; i++ {
+		list := sync3.RequestList{
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit: c.cfg.timelineLimit,
+				RequiredState: [][2]string{{"m.room.name", ""}, {"m.room.avatar", ""}},
+			},
+			Ranges: sync3.SliceRanges{{c.offsets[i], c.offsets[i] + c.cfg.windowSize - 1}},
+			Sort:   []string{sync3.SortByRecency},
+		}
+		// the first list has every room, the others alternate between DMs and other rooms
+		if i > 0 {
+			isDM := i%2 == 1
+			list.Filters = &sync3.RequestFilters{IsDM: &isDM}
+		}
+		lists[listKey(i)] = list
+	}
+	return lists
+}
+
+// scroll moves the window of every list according to the scroll pattern.
+func (c *connection) scroll() {
+	for i := range c.offsets {
+		switch c.cfg.scroll {
+		case scrollLinear:
+			c.offsets[i] += c.cfg.windowSize
+			if c.offsets[i] >= c.counts[i] {
+				c.offsets[i] = 0
+			}
+		case scrollRandom:
+			if maxOffset := c.counts[i] - c.cfg.windowSize; maxOffset > 0 {
+				c.offsets[i] = c.rand.Int63n(maxOffset + 1)
+			} else {
+				c.offsets[i] = 0
+			}
+		}
+	}
+}
+
+// do makes the request, returning the body of the response.
+func (c *connection) do(ctx context.Context, req sync3.Request) ([]byte, int, error) {
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	path := "/_matrix/client/unstable/org.matrix.msc3575/sync"
+	if c.cfg.simplified {
+		path = "/_matrix/client/unstable/org.matrix.simplified_msc3575/sync"
+	}
+	qps := url.Values{}
+	qps.Set("timeout", strconv.FormatInt(c.cfg.timeout.Milliseconds(), 10))
+	if c.pos != "" {
+		qps.Set("pos", c.pos)
+	}
+	// allow for the proxy being slow to respond to a long-poll
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.timeout+30*time.Second)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.proxyURL+path+"?"+qps.Encode(), bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, 0, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+c.token)
+	httpReq.Header.Set("Content-Type", "application/json")
+	res, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, res.StatusCode, fmt.Errorf("failed to read response: %w", err)
+	}
+	return body, res.StatusCode, nil
+}
+
+func listKey(i int) string {
+	return "list" + strconv.Itoa(i)
+}
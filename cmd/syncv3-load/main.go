@@ -0,0 +1,152 @@
+// syncv3-load simulates many concurrent sliding sync connections against a running proxy, and
+// reports the latency and size of the responses. It is used to catch performance regressions
+// before a release, e.g by comparing the report of two versions of the proxy on the same dataset.
+//
+// The proxy must already know the users whose access tokens are given, i.e they must have synced
+// through the proxy before, otherwise every connection will be waiting for its initial v2 sync.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type config struct {
+	proxyURL      string
+	tokens        []string
+	conns         int
+	duration      time.Duration
+	rampUp        time.Duration
+	lists         int
+	windowSize    int64
+	timelineLimit int64
+	scroll        string
+	scrollEvery   int
+	timeout       time.Duration
+	simplified    bool
+}
+
+// The ways connections move their windows, see connection.nextRanges.
+const (
+	scrollNone   = "none"
+	scrollLinear = "linear"
+	scrollRandom = "random"
+)
+
+func main() {
+	var cfg config
+	var tokensFile string
+	flag.StringVar(&cfg.proxyURL, "url", "http://localhost:8008", "The base URL of the proxy")
+	flag.StringVar(&tokensFile, "tokens", "", "A file of access tokens, one per line. Connections are shared out between the tokens.")
+	flag.IntVar(&cfg.conns, "conns", 100, "The number of concurrent connections")
+	flag.DurationVar(&cfg.duration, "duration", time.Minute, "How long to run for, after all connections have started")
+	flag.DurationVar(&cfg.rampUp, "ramp-up", 10*time.Second, "How long to spread the start of the connections over")
+	flag.IntVar(&cfg.lists, "lists", 1, "The number of lists in each connection")
+	flag.Int64Var(&cfg.windowSize, "range", 20, "The number of rooms in the window of each list")
+	flag.Int64Var(&cfg.timelineLimit, "timeline-limit", 1, "The timeline_limit of each list")
+	flag.StringVar(&cfg.scroll, "scroll", scrollLinear, "How connections scroll their lists: none, linear (down then back to the top) or random")
+	flag.IntVar(&cfg.scrollEvery, "scroll-every", 5, "Connections scroll every N requests, the others wait for live updates")
+	flag.DurationVar(&cfg.timeout, "timeout", 10*time.Second, "The long-poll timeout of requests which don't scroll")
+	flag.BoolVar(&cfg.simplified, "simplified", false, "Use the simplified sliding sync endpoint (MSC4186)")
+	flag.Parse()
+
+	if tokensFile == "" {
+		exitf("-tokens is required")
+	}
+	tokens, err := readTokens(tokensFile)
+	if err != nil {
+		exitf("failed to read tokens: %s", err)
+	}
+	cfg.tokens = tokens
+	switch cfg.scroll {
+	case scrollNone, scrollLinear, scrollRandom:
+	default:
+		exitf("unknown -scroll %q, must be one of none, linear, random", cfg.scroll)
+	}
+	if cfg.conns < 1 || cfg.lists < 1 || cfg.windowSize < 1 || cfg.scrollEvery < 1 {
+		exitf("-conns, -lists, -range and -scroll-every must be positive")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.rampUp+cfg.duration)
+	defer cancel()
+	// stop early on ctrl-c, but still print the report
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	fmt.Printf("Running %d connections for %v against %s\n", cfg.conns, cfg.rampUp+cfg.duration, cfg.proxyURL)
+	stats := newStats()
+	start := time.Now()
+	run(ctx, cfg, stats)
+	stats.report(os.Stdout, time.Since(start))
+}
+
+// run starts the connections, spread evenly over the ramp up time, and waits for them to finish.
+func run(ctx context.Context, cfg config, stats *stats) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: cfg.conns,
+		},
+	}
+	var wg sync.WaitGroup
+	interval := cfg.rampUp / time.Duration(cfg.conns)
+	for i := 0; i < cfg.conns; i++ {
+		conn := &connection{
+			cfg:    cfg,
+			client: client,
+			token:  cfg.tokens[i%len(cfg.tokens)],
+			rand:   rand.New(rand.NewSource(int64(i))),
+			stats:  stats,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn.run(ctx)
+		}()
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+	}
+	wg.Wait()
+}
+
+func readTokens(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var tokens []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if token := strings.TrimSpace(scanner.Text()); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens in %s", path)
+	}
+	return tokens, nil
+}
+
+func exitf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// stats collects the results of requests from every connection.
+type stats struct {
+	mu    sync.Mutex
+	kinds map[string]*kindStats
+}
+
+type kindStats struct {
+	latencies []time.Duration
+	sizes     []int
+	errors    map[string]int
+}
+
+func newStats() *stats {
+	return &stats{
+		kinds: make(map[string]*kindStats),
+	}
+}
+
+func (s *stats) kind(kind string) *kindStats {
+	ks := s.kinds[kind]
+	if ks == nil {
+		ks = &kindStats{errors: make(map[string]int)}
+		s.kinds[kind] = ks
+	}
+	return ks
+}
+
+func (s *stats) record(kind string, latency time.Duration, size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ks := s.kind(kind)
+	ks.latencies = append(ks.latencies, latency)
+	ks.sizes = append(ks.sizes, size)
+}
+
+func (s *stats) recordError(kind string, status int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reason := fmt.Sprintf("HTTP %d", status)
+	if err != nil {
+		reason = err.Error()
+	}
+	s.kind(kind).errors[reason]++
+}
+
+// report writes the latency percentiles and response sizes of each kind of request.
+func (s *stats) report(w io.Writer, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(w, "\nRan for %v\n", elapsed.Round(time.Millisecond))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "kind\trequests\terrors\treq/s\tp50\tp90\tp99\tmax\tavg size\tmax size\t")
+	var errorLines []string
+	for _, kind := range []string{kindInitial, kindScroll, kindLive} {
+		ks := s.kinds[kind]
+		if ks == nil {
+			continue
+		}
+		numErrors := 0
+		for reason, count := range ks.errors {
+			numErrors += count
+			errorLines = append(errorLines, fmt.Sprintf("  %s: %dx %s", kind, count, reason))
+		}
+		sort.Slice(ks.latencies, func(i, j int) bool { return ks.latencies[i] < ks.latencies[j] })
+		sort.Ints(ks.sizes)
+		totalSize := 0
+		for _, size := range ks.sizes {
+			totalSize += size
+		}
+		avgSize := 0
+		if len(ks.sizes) > 0 {
+			avgSize = totalSize / len(ks.sizes)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%v\t%v\t%v\t%v\t%s\t%s\t\n",
+			kind, len(ks.latencies), numErrors, float64(len(ks.latencies))/elapsed.Seconds(),
+			percentile(ks.latencies, 50), percentile(ks.latencies, 90), percentile(ks.latencies, 99), percentile(ks.latencies, 100),
+			formatBytes(avgSize), formatBytes(percentileInt(ks.sizes, 100)),
+		)
+	}
+	tw.Flush()
+	if len(errorLines) > 0 {
+		sort.Strings(errorLines)
+		fmt.Fprintf(w, "\nErrors:\n%s\n", strings.Join(errorLines, "\n"))
+	}
+}
+
+// percentile returns the p-th percentile of the sorted latencies, using the nearest rank.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[nearestRank(len(sorted), p)].Round(time.Millisecond)
+}
+
+func percentileInt(sorted []int, p int) int {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[nearestRank(len(sorted), p)]
+}
+
+// nearestRank returns the index of the p-th percentile of n sorted values.
+func nearestRank(n, p int) int {
+	rank := (p*n + 99) / 100 // ceil(p/100 * n)
+	if rank < 1 {
+		rank = 1
+	}
+	return rank - 1
+}
+
+func formatBytes(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
@@ -0,0 +1,40 @@
+// syncv3-mockhs runs a mock homeserver which the proxy can be pointed at instead of Synapse, for
+// end-to-end tests of error paths and for local development. Accounts are added and sync v2
+// responses and errors are queued using the control API under /_mockhs, see the mockhs package.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/matrix-org/sliding-sync/testutils/mockhs"
+)
+
+func main() {
+	bindAddr := flag.String("bind", "127.0.0.1:8846", "The address to listen on")
+	maxTimeout := flag.Duration("max-timeout", mockhs.DefaultMaxSyncTimeout, "The longest a /sync request waits for a queued response")
+	var accounts []mockhs.Account
+	flag.Func("account", "An account to add on startup, as user_id,device_id,access_token. May be repeated.", func(s string) error {
+		parts := strings.Split(s, ",")
+		if len(parts) != 3 {
+			return fmt.Errorf("must be user_id,device_id,access_token")
+		}
+		accounts = append(accounts, mockhs.Account{UserID: parts[0], DeviceID: parts[1], AccessToken: parts[2]})
+		return nil
+	})
+	flag.Parse()
+
+	srv := mockhs.NewServer()
+	srv.MaxSyncTimeout = *maxTimeout
+	for _, a := range accounts {
+		srv.AddAccount(a)
+	}
+	fmt.Printf("mock homeserver listening on %s\n", *bindAddr)
+	if err := http.ListenAndServe(*bindAddr, srv); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,165 @@
+// syncv3-replay feeds a recording of the payloads sent from the pollers to the API, made by running
+// the proxy with SYNCV3_PUBSUB_RECORD_FILE set, back into the API. It is used to reproduce bugs where
+// a client's lists diverge from what the proxy should be sending, which usually depend on the exact
+// order updates arrive in and so are hard to reproduce against a live homeserver.
+//
+// The API is started against a snapshot of the proxy's database, taken after the recording stopped so
+// that every event the payloads refer to exists, e.g with `syncv3 export` and `syncv3 import`. Its
+// caches are loaded from the snapshot as on startup, then the recorded payloads are replayed in order
+// through a synchronous pubsub, so each is fully processed before the next. No pollers are started:
+// devices are told their initial sync has completed as soon as they connect. Replaying the same
+// recording against the same snapshot always processes the same payloads in the same order.
+//
+// To watch a client's lists during the replay, set -bind and -wait, point the client at the bound
+// address, then press Enter once it has synced to start replaying.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	syncv3 "github.com/matrix-org/sliding-sync"
+	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
+)
+
+// These are the same environment variables the proxy reads its configuration from.
+const (
+	EnvServer      = "SYNCV3_SERVER"
+	EnvDB          = "SYNCV3_DB"
+	EnvSecret      = "SYNCV3_SECRET"
+	EnvTokenPepper = "SYNCV3_TOKEN_PEPPER"
+)
+
+func main() {
+	dbURI := flag.String("db", os.Getenv(EnvDB), "The postgres connection string of the snapshot database, defaults to $"+EnvDB+". Replaying writes to it, so use a copy.")
+	secret := flag.String("secret", os.Getenv(EnvSecret), "The secret the recorded proxy encrypted access tokens with, defaults to $"+EnvSecret)
+	pepper := flag.String("pepper", os.Getenv(EnvTokenPepper), "The pepper (ID:SECRET) the recorded proxy hashed access tokens with, defaults to $"+EnvTokenPepper)
+	server := flag.String("server", os.Getenv(EnvServer), "The homeserver used to identify access tokens which are not in the snapshot, defaults to $"+EnvServer)
+	recording := flag.String("recording", "", "The recording to replay")
+	bind := flag.String("bind", "", "If set, serve sliding sync requests on this address e.g 127.0.0.1:8008, and keep serving after the replay until interrupted")
+	wait := flag.Bool("wait", false, "Wait for Enter to be pressed before replaying, so clients can connect first")
+	speed := flag.Float64("speed", 0, "Replay with the recorded gaps between payloads, this many times faster. 0 replays as fast as possible.")
+	limit := flag.Int("limit", 0, "Stop after replaying this many payloads. 0 replays them all.")
+	flag.Parse()
+
+	if *dbURI == "" || *secret == "" || *recording == "" {
+		exitf("-db, -secret and -recording are required")
+	}
+	f, err := os.Open(*recording)
+	if err != nil {
+		exitf("failed to open recording: %s", err)
+	}
+	defer f.Close()
+
+	if err := sync2.SetTokenPeppers(*pepper, nil); err != nil {
+		exitf("invalid -pepper: %s", err)
+	}
+	store := state.NewStorage(*dbURI)
+	storev2 := sync2.NewStore(*dbURI, *secret)
+	v2Client := sync2.NewHTTPClient(time.Minute, time.Minute, *server)
+	// a buffer size of 0 makes Notify wait until the payload has been processed
+	ps := pubsub.NewPubSub(0)
+	h3, err := handler.NewSync3Handler(store, storev2, v2Client, *secret, ps, ps, false, 2000, time.Second)
+	if err != nil {
+		exitf("failed to create handler: %s", err)
+	}
+	go pubsub.NewV3Sub(ps, &fakePollers{pub: ps}).Listen()
+
+	fmt.Println("Loading caches from the snapshot...")
+	snapshot, err := store.GlobalSnapshot()
+	if err != nil {
+		exitf("failed to load snapshot: %s", err)
+	}
+	if err = h3.Startup(&snapshot); err != nil {
+		exitf("%s", err)
+	}
+	h3.Listen()
+
+	if *bind != "" {
+		go syncv3.RunSyncV3Server(h3, nil, nil, nil, *bind, *server, nil)
+		fmt.Printf("Serving sliding sync requests on %s\n", *bind)
+	}
+	if *wait {
+		fmt.Println("Press Enter to start replaying")
+		bufio.NewReader(os.Stdin).ReadString('\n')
+	}
+
+	start := time.Now()
+	replayed, skipped, err := replay(context.Background(), f, ps, *speed, *limit)
+	fmt.Printf("Replayed %d payloads in %v, skipping %d sent to the pollers\n", replayed, time.Since(start), skipped)
+	if err != nil {
+		exitf("replay stopped: %s", err)
+	}
+
+	if *bind != "" {
+		fmt.Println("Replay finished, still serving requests. Interrupt to exit.")
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		<-sigs
+	}
+}
+
+// errLimitReached stops ReadRecording once enough payloads have been replayed.
+var errLimitReached = fmt.Errorf("limit reached")
+
+// replay notifies the API of every payload in the recording which the pollers sent. Payloads sent
+// by the API were for the pollers, which are not running, so are skipped.
+func replay(ctx context.Context, f *os.File, pub pubsub.Notifier, speed float64, limit int) (replayed, skipped int, err error) {
+	var prev time.Time
+	err = pubsub.ReadRecording(f, func(rec *pubsub.RecordedPayload, p pubsub.Payload) error {
+		if rec.Chan != pubsub.ChanV2 {
+			skipped++
+			return nil
+		}
+		if limit > 0 && replayed >= limit {
+			return errLimitReached
+		}
+		if speed > 0 && !prev.IsZero() {
+			time.Sleep(time.Duration(float64(rec.Time.Sub(prev)) / speed))
+		}
+		prev = rec.Time
+		if err := pub.Notify(pubsub.ChanV2, p); err != nil {
+			return fmt.Errorf("payload %d (%s): %w", replayed+1, rec.Type, err)
+		}
+		replayed++
+		return ctx.Err()
+	})
+	if err == errLimitReached {
+		err = nil
+	}
+	return
+}
+
+// fakePollers answers the API's requests to the pollers as if they were running, so connections
+// are not left waiting for an initial sync which will never happen.
+type fakePollers struct {
+	pub pubsub.Notifier
+}
+
+func (p *fakePollers) EnsurePolling(pl *pubsub.V3EnsurePolling) {
+	p.pub.Notify(pubsub.ChanV2, &pubsub.V2InitialSyncComplete{
+		UserID:   pl.UserID,
+		DeviceID: pl.DeviceID,
+		Success:  true,
+	})
+}
+
+func (p *fakePollers) OnPing(pl *pubsub.V3Ping) {
+	p.pub.Notify(pubsub.ChanV2, &pubsub.V2Pong{ID: pl.ID})
+}
+
+func (p *fakePollers) OnTokenRefreshed(pl *pubsub.V3TokenRefreshed) {}
+
+func exitf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(2)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// discrepancy is a difference between what the homeserver and the proxy say about a room.
+type discrepancy struct {
+	roomID   string
+	field    string
+	upstream string
+	proxy    string
+}
+
+// compare returns the differences between the rooms in the sync v2 response and the rooms sent by
+// the proxy, sorted by room ID.
+func compare(upstream *sync2.SyncResponse, proxyRooms map[string]sync3.Room) []discrepancy {
+	var discrepancies []discrepancy
+	add := func(roomID, field string, upstream, proxy interface{}) {
+		discrepancies = append(discrepancies, discrepancy{
+			roomID:   roomID,
+			field:    field,
+			upstream: fmt.Sprint(upstream),
+			proxy:    fmt.Sprint(proxy),
+		})
+	}
+	for roomID, joined := range upstream.Rooms.Join {
+		room, ok := proxyRooms[roomID]
+		if !ok {
+			add(roomID, "membership", "join", "-")
+			continue
+		}
+		if len(room.InviteState) > 0 {
+			add(roomID, "membership", "join", "invite")
+			continue
+		}
+		if want, got := lastEventID(joined.Timeline.Events), lastEventID(room.Timeline); want != got {
+			add(roomID, "latest event", want, got)
+		}
+		if want := count(joined.UnreadNotifications.NotificationCount); want != room.NotificationCount {
+			add(roomID, "notification count", want, room.NotificationCount)
+		}
+		if want := count(joined.UnreadNotifications.HighlightCount); want != room.HighlightCount {
+			add(roomID, "highlight count", want, room.HighlightCount)
+		}
+	}
+	for roomID := range upstream.Rooms.Invite {
+		room, ok := proxyRooms[roomID]
+		if !ok {
+			add(roomID, "membership", "invite", "-")
+		} else if len(room.InviteState) == 0 {
+			add(roomID, "membership", "invite", "join")
+		}
+	}
+	for roomID, room := range proxyRooms {
+		_, joined := upstream.Rooms.Join[roomID]
+		_, invited := upstream.Rooms.Invite[roomID]
+		if joined || invited {
+			continue
+		}
+		membership := "join"
+		if len(room.InviteState) > 0 {
+			membership = "invite"
+		}
+		add(roomID, "membership", "-", membership)
+	}
+	sort.Slice(discrepancies, func(i, j int) bool {
+		if discrepancies[i].roomID != discrepancies[j].roomID {
+			return discrepancies[i].roomID < discrepancies[j].roomID
+		}
+		return discrepancies[i].field < discrepancies[j].field
+	})
+	return discrepancies
+}
+
+func lastEventID(events []json.RawMessage) string {
+	if len(events) == 0 {
+		return "-"
+	}
+	return gjson.GetBytes(events[len(events)-1], "event_id").Str
+}
+
+// count returns the unread count, which the homeserver may omit if it is zero.
+func count(c *int) int64 {
+	if c == nil {
+		return 0
+	}
+	return int64(*c)
+}
+
+func report(w io.Writer, numUpstreamRooms, numProxyRooms int, discrepancies []discrepancy) {
+	fmt.Fprintf(w, "The homeserver returned %d rooms and the proxy returned %d rooms\n", numUpstreamRooms, numProxyRooms)
+	if len(discrepancies) == 0 {
+		fmt.Fprintln(w, "No discrepancies found")
+		return
+	}
+	fmt.Fprintf(w, "Found %d discrepancies:\n\n", len(discrepancies))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "room\tfield\thomeserver\tproxy\t")
+	for _, d := range discrepancies {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t\n", d.roomID, d.field, d.upstream, d.proxy)
+	}
+	tw.Flush()
+}
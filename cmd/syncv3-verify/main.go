@@ -0,0 +1,74 @@
+// syncv3-verify checks that the proxy agrees with the upstream homeserver about a user's rooms. It
+// makes an initial sync v2 request to the homeserver and a sliding sync request for all of the
+// user's rooms to the proxy, then reports any rooms which are missing from either, have a different
+// latest event or have different unread counts. It is used to validate the proxy's data after a
+// migration, or when data corruption is suspected.
+//
+// Rooms which receive events while the tool is running may be reported as having a different
+// latest event, so rooms with discrepancies should be checked again before investigating further.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// EnvServer is the same environment variable the proxy reads the upstream homeserver URL from.
+const EnvServer = "SYNCV3_SERVER"
+
+func main() {
+	serverURL := flag.String("server", os.Getenv(EnvServer), "The URL of the upstream homeserver, defaults to $"+EnvServer)
+	proxyURL := flag.String("url", "http://localhost:8008", "The base URL of the proxy")
+	tokenFile := flag.String("token", "", "A file containing the access token of the user to check")
+	windowSize := flag.Int64("window", 100, "The number of rooms to request from the proxy at a time. Must not exceed the proxy's maximum window size.")
+	timeout := flag.Duration("timeout", 5*time.Minute, "How long to wait for each response. Initial syncs for users in many rooms can be slow.")
+	flag.Parse()
+
+	if *serverURL == "" || *tokenFile == "" {
+		exitf("-server and -token are required")
+	}
+	if *windowSize < 1 {
+		exitf("-window must be positive")
+	}
+	token, err := os.ReadFile(*tokenFile)
+	if err != nil {
+		exitf("failed to read token: %s", err)
+	}
+	accessToken := strings.TrimSpace(string(token))
+	ctx := context.Background()
+
+	// ask the proxy first: if it has to wait for its initial v2 sync for this user, the homeserver
+	// response will be closer in time to the proxy's data.
+	proxy := &proxyClient{
+		baseURL:     strings.TrimSuffix(*proxyURL, "/"),
+		accessToken: accessToken,
+		timeout:     *timeout,
+		windowSize:  *windowSize,
+	}
+	proxyRooms, err := proxy.allRooms(ctx)
+	if err != nil {
+		exitf("failed to sync with the proxy: %s", err)
+	}
+	upstream := sync2.NewHTTPClient(*timeout, *timeout, *serverURL)
+	res, _, err := upstream.DoSyncV2(ctx, accessToken, "", true, false)
+	if err != nil {
+		exitf("failed to sync with the homeserver: %s", err)
+	}
+
+	discrepancies := compare(res, proxyRooms)
+	report(os.Stdout, len(res.Rooms.Join)+len(res.Rooms.Invite), len(proxyRooms), discrepancies)
+	if len(discrepancies) > 0 {
+		os.Exit(1)
+	}
+}
+
+func exitf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(2)
+}
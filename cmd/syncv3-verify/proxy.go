@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+const listKey = "all"
+
+// proxyClient fetches every room the user is in from the proxy, a window at a time.
+type proxyClient struct {
+	baseURL     string
+	accessToken string
+	timeout     time.Duration
+	windowSize  int64
+
+	client http.Client
+	pos    string
+}
+
+// allRooms scrolls a single list over all of the user's rooms, returning room_id -> room. Each
+// room is only sent when it first enters the window, with its latest event as its timeline.
+func (c *proxyClient) allRooms(ctx context.Context) (map[string]sync3.Room, error) {
+	rooms := make(map[string]sync3.Room)
+	for start := int64(0); ; start += c.windowSize {
+		res, err := c.do(ctx, sync3.Request{
+			Lists: map[string]sync3.RequestList{
+				listKey: {
+					RoomSubscription: sync3.RoomSubscription{
+						TimelineLimit: 1,
+					},
+					Ranges: sync3.SliceRanges{{start, start + c.windowSize - 1}},
+					Sort:   []string{sync3.SortByRecency},
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for roomID, room := range res.Rooms {
+			// rooms which moved into the window because of a new event are sent again, so prefer the
+			// latest data, but keep the invite state as only the first response has it.
+			if existing, ok := rooms[roomID]; ok && len(room.InviteState) == 0 {
+				room.InviteState = existing.InviteState
+			}
+			rooms[roomID] = room
+		}
+		count, ok := res.Lists[listKey]
+		if !ok {
+			return nil, fmt.Errorf("response did not include list %q", listKey)
+		}
+		if start+c.windowSize >= int64(count.Count) {
+			return rooms, nil
+		}
+	}
+}
+
+func (c *proxyClient) do(ctx context.Context, req sync3.Request) (*sync3.Response, error) {
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	qps := url.Values{}
+	// we only want the data the proxy already has, so never wait for new events
+	qps.Set("timeout", "0")
+	if c.pos != "" {
+		qps.Set("pos", c.pos)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/_matrix/client/unstable/org.matrix.msc3575/sync?"+qps.Encode(), bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+c.accessToken)
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpRes, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpRes.Body.Close()
+	body, err := io.ReadAll(httpRes.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if httpRes.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response returned %s: %s", httpRes.Status, body)
+	}
+	var res sync3.Response
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	c.pos = res.Pos
+	return &res, nil
+}
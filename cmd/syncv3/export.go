@@ -0,0 +1,127 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pressly/goose/v3"
+
+	syncv3 "github.com/matrix-org/sliding-sync"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// executeExport writes the proxy's database to a file, which can be imported into another database
+// with executeImport. Files ending in .gz are compressed. Access tokens stay encrypted with
+// SYNCV3_SECRET, so the new deployment must use the same secret.
+func executeExport() {
+	path := exportPathArg("export")
+	db := openDBForExport("export")
+	defer db.Close()
+
+	schemaVersion, err := goose.GetDBVersion(db.DB)
+	if err != nil {
+		log.Fatalf("export: failed to get schema version: %v\n", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("export: %v\n", err)
+	}
+	var w io.WriteCloser = f
+	if strings.HasSuffix(path, ".gz") {
+		w = gzip.NewWriter(f)
+	}
+	counts, err := state.Export(context.Background(), db, schemaVersion, w)
+	if err == nil && w != f {
+		err = w.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		log.Fatalf("export: %v\n", err)
+	}
+	printRowCounts("export: exported", counts)
+}
+
+// executeImport loads a file written by executeExport into an empty database, creating the proxy's
+// tables first. Clients can carry on syncing from where they were once the proxy is started
+// against the new database.
+func executeImport() {
+	path := exportPathArg("import")
+	db := openDBForExport("import")
+	defer db.Close()
+
+	// create the tables at the latest schema, as the proxy does on startup
+	state.NewStorageWithDB(db, false)
+	sync2.NewStoreWithDB(db, getenv(EnvSecret))
+	goose.SetBaseFS(syncv3.EmbedMigrations)
+	if err := goose.Up(db.DB, "state/migrations", goose.WithAllowMissing()); err != nil {
+		log.Fatalf("import: failed to execute migrations: %v\n", err)
+	}
+	schemaVersion, err := goose.GetDBVersion(db.DB)
+	if err != nil {
+		log.Fatalf("import: failed to get schema version: %v\n", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("import: %v\n", err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		if r, err = gzip.NewReader(f); err != nil {
+			log.Fatalf("import: %v\n", err)
+		}
+	}
+	counts, err := state.Import(context.Background(), db, schemaVersion, r)
+	if err != nil {
+		log.Fatalf("import: %v\n", err)
+	}
+	printRowCounts("import: imported", counts)
+}
+
+func exportPathArg(command string) string {
+	if len(os.Args) != 3 {
+		fmt.Printf("usage: syncv3 %s <file>\n\nFiles ending in .gz are compressed. %s must be set.\n", command, EnvDB)
+		os.Exit(1)
+	}
+	return os.Args[2]
+}
+
+func openDBForExport(command string) *sqlx.DB {
+	dbURI := getenv(EnvDB)
+	if dbURI == "" {
+		fmt.Print(helpMsg)
+		fmt.Printf("\n%s must be set\n", EnvDB)
+		os.Exit(1)
+	}
+	db, err := sqlx.Open("postgres", dbURI)
+	if err != nil {
+		log.Fatalf("%s: failed to open DB: %v\n", command, err)
+	}
+	return db
+}
+
+func printRowCounts(prefix string, counts map[string]int64) {
+	tables := make([]string, 0, len(counts))
+	var total int64
+	for table, count := range counts {
+		tables = append(tables, table)
+		total += count
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		fmt.Printf("  %s: %d rows\n", table, counts[table])
+	}
+	fmt.Printf("%s %d rows from %d tables\n", prefix, total, len(tables))
+}
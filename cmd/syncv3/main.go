@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -9,20 +10,23 @@ import (
 	"os"
 	"os/signal"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/getsentry/sentry-go"
 	sentryhttp "github.com/getsentry/sentry-go/http"
+	"github.com/jmoiron/sqlx"
 	"github.com/pressly/goose/v3"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/rs/zerolog"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 
 	syncv3 "github.com/matrix-org/sliding-sync"
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync2"
 )
 
@@ -52,10 +56,53 @@ const (
 	EnvOTLPPassword           = "SYNCV3_OTLP_PASSWORD"
 	EnvSentryDsn              = "SYNCV3_SENTRY_DSN"
 	EnvLogLevel               = "SYNCV3_LOG_LEVEL"
+	EnvModuleLogLevels        = "SYNCV3_MODULE_LOG_LEVELS"
+	EnvAdminBindAddr          = "SYNCV3_ADMIN_BINDADDR"
+	EnvTrustedProxies         = "SYNCV3_TRUSTED_PROXIES"
+	EnvIPAllowlist            = "SYNCV3_IP_ALLOWLIST"
+	EnvIPDenylist             = "SYNCV3_IP_DENYLIST"
+	EnvAdminIPAllowlist       = "SYNCV3_ADMIN_IP_ALLOWLIST"
+	EnvAdminIPDenylist        = "SYNCV3_ADMIN_IP_DENYLIST"
 	EnvMaxConns               = "SYNCV3_MAX_DB_CONN"
 	EnvIdleTimeoutSecs        = "SYNCV3_DB_IDLE_TIMEOUT_SECS"
 	EnvHTTPTimeoutSecs        = "SYNCV3_HTTP_TIMEOUT_SECS"
 	EnvHTTPInitialTimeoutSecs = "SYNCV3_HTTP_INITIAL_TIMEOUT_SECS"
+	EnvMaintenanceHours       = "SYNCV3_MAINTENANCE_INTERVAL_HOURS"
+	EnvTokenPepper            = "SYNCV3_TOKEN_PEPPER"
+	EnvTokenPepperPrevious    = "SYNCV3_TOKEN_PEPPER_PREVIOUS"
+	EnvConfigFile             = "SYNCV3_CONFIG_FILE"
+	EnvUserCacheTTLHours      = "SYNCV3_USER_CACHE_TTL_HOURS"
+	EnvMaxUserCaches          = "SYNCV3_MAX_USER_CACHES"
+	EnvCacheMemoryBudgetMB    = "SYNCV3_CACHE_MEMORY_BUDGET_MB"
+	EnvWarmUserCacheDevices   = "SYNCV3_WARM_USER_CACHE_DEVICES"
+	EnvMetadataSnapshotMins   = "SYNCV3_METADATA_SNAPSHOT_INTERVAL_MINS"
+	EnvMetadataReconcileRooms = "SYNCV3_METADATA_RECONCILE_ROOMS_PER_MIN"
+	EnvEraseDeactivatedUsers  = "SYNCV3_ERASE_DEACTIVATED_USERS"
+	EnvToDeviceTTLDays        = "SYNCV3_TO_DEVICE_TTL_DAYS"
+	EnvTableStatsHistoryDays  = "SYNCV3_TABLE_STATS_HISTORY_DAYS"
+	EnvArchiveAfterDays       = "SYNCV3_ARCHIVE_AFTER_DAYS"
+	EnvArchiveS3URL           = "SYNCV3_ARCHIVE_S3_URL"
+	EnvArchiveS3Region        = "SYNCV3_ARCHIVE_S3_REGION"
+	EnvArchiveS3AccessKeyID   = "SYNCV3_ARCHIVE_S3_ACCESS_KEY_ID"
+	EnvArchiveS3SecretKey     = "SYNCV3_ARCHIVE_S3_SECRET_ACCESS_KEY"
+	EnvV2Compat               = "SYNCV3_V2_COMPAT"
+	EnvMaxListRanges          = "SYNCV3_MAX_LIST_RANGES"
+	EnvMaxListWindowSize      = "SYNCV3_MAX_LIST_WINDOW_SIZE"
+	EnvMaxRoomSubscriptions   = "SYNCV3_MAX_ROOM_SUBSCRIPTIONS"
+	EnvExtensionsEnabled      = "SYNCV3_EXTENSIONS_DEFAULT_ENABLED"
+	EnvExtensionsDisabled     = "SYNCV3_EXTENSIONS_DISABLED"
+	EnvWellKnownProxyURL      = "SYNCV3_WELL_KNOWN_PROXY_URL"
+	EnvWellKnownHomeserverURL = "SYNCV3_WELL_KNOWN_HOMESERVER_URL"
+	EnvOIDCIntrospectionURL   = "SYNCV3_OIDC_INTROSPECTION_URL"
+	EnvOIDCClientID           = "SYNCV3_OIDC_CLIENT_ID"
+	EnvOIDCClientSecret       = "SYNCV3_OIDC_CLIENT_SECRET"
+	EnvOIDCServerName         = "SYNCV3_OIDC_SERVER_NAME"
+	EnvOIDCCacheSecs          = "SYNCV3_OIDC_INTROSPECTION_CACHE_SECS"
+	EnvACMEDomains            = "SYNCV3_ACME_DOMAINS"
+	EnvACMECacheDir           = "SYNCV3_ACME_CACHE_DIR"
+	EnvACMEEmail              = "SYNCV3_ACME_EMAIL"
+	EnvPubsubRecordFile       = "SYNCV3_PUBSUB_RECORD_FILE"
+	EnvFaultInjection         = "SYNCV3_FAULT_INJECTION"
 )
 
 var helpMsg = fmt.Sprintf(`
@@ -64,7 +111,7 @@ Environment var
 %s         Required. The postgres connection string: https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-CONNSTRING
 %s     Required. A secret to use to encrypt access tokens. Must remain the same for the lifetime of the database.
 %s   Default: 0.0.0.0:8008.  The interface and port to listen on. (Supports unix socket: /path/to/socket)
-%s   Default: unset. Path to a certificate file to serve to HTTPS clients. Specifying this enables TLS on the bound address.
+%s   Default: unset. Path to a certificate file to serve to HTTPS clients. Specifying this enables TLS on the bound address. The certificate and key are reloaded when they change on disk.
 %s    Default: unset. Path to a key file for the certificate. Must be provided along with the certificate file.
 %s      Default: unset. The bind addr for pprof debugging e.g ':6060'. If not set, does not listen.
 %s       Default: unset. The bind addr for Prometheus metrics, which will be accessible at /metrics at this address.
@@ -73,12 +120,62 @@ Environment var
 %s Default: unset. The OTLP password for Basic auth. If unset, does not send an Authorization header.
 %s Default: unset. The Sentry DSN to report events to e.g https://sliding-sync@sentry.example.com/123 - if unset does not send sentry events.
 %s  Default: info. The level of verbosity for messages logged. Available values are trace, debug, info, warn, error and fatal
+%s Default: unset. Comma separated per-module log levels which override SYNCV3_LOG_LEVEL e.g 'poller=debug,conn=trace'.
+%s Default: unset. The bind addr for the admin API e.g '127.0.0.1:8009'. If not set, does not listen. The admin API is unauthenticated so MUST NOT be publicly accessible.
+%s Default: unset. Comma separated IP addresses or CIDR ranges of reverse proxies e.g '10.0.0.0/8,::1', whose X-Forwarded-For headers are used to find the real IP addresses of clients. Requests over a unix socket always use X-Forwarded-For.
+%s Default: unset. Comma separated IP addresses or CIDR ranges of clients which may use the sync endpoints. If unset, all clients which are not denied may.
+%s Default: unset. Comma separated IP addresses or CIDR ranges of clients which may not use the sync endpoints. Takes precedence over SYNCV3_IP_ALLOWLIST.
+%s Default: unset. Comma separated IP addresses or CIDR ranges of clients which may use the admin API. If unset, all clients which are not denied may.
+%s Default: unset. Comma separated IP addresses or CIDR ranges of clients which may not use the admin API. Takes precedence over SYNCV3_ADMIN_IP_ALLOWLIST.
 %s Default: unset. Max database connections to use when communicating with postgres. Unset or 0 means no limit.
 %s Default: 3600. The maximum amount of time a database connection may be idle, in seconds. 0 means no limit.
 %s Default: 300. The timeout in seconds for normal HTTP requests.
 %s Default: 1800. The timeout in seconds for initial sync requests.
+%s Default: 0. How often to run database maintenance (ANALYZE, REINDEX and pruning), in hours. 0 disables scheduled maintenance.
+%s Default: unset. A secret used to hash access tokens before storing them, of the form ID:SECRET e.g '2024-06:<secret>'. The ID labels which pepper each stored hash uses and must not be derived from the secret. Unlike SYNCV3_SECRET this can be rotated: see 'rehash-tokens'.
+%s Default: unset. Comma separated previous values of SYNCV3_TOKEN_PEPPER which are still accepted until tokens are re-hashed. Each ID must be unique.
+%s Default: unset. Path to a file of KEY=VALUE lines which override these environment variables. Re-read on SIGHUP, see 'reloadableEnvVars'.
+%s Default: 0. Evict the in-memory caches of users without connections who have not synced for this many hours. 0 disables.
+%s Default: 0. The max number of users to hold caches in memory for, evicting the least recently active users without connections. 0 means no limit.
+%s Default: 0. The approximate memory budget for in-memory caches, in MB. When exceeded, caches of the least recently active users without connections are evicted. 0 means no limit.
+%s Default: 0. At startup, build caches in the background for the users of this many recently active devices, so their first request is fast. 0 disables.
+%s Default: 15. How often to save room metadata to the database, in minutes, which speeds up startup. 0 disables.
+%s Default: 100. How many rooms to check each minute for in-memory metadata which has drifted from the database, repairing any differences. 0 disables.
+%s Default: unset. If set to '1', erase the display names, avatars and receipts of users who appear to have been deactivated, see POST /_syncv3/admin/users/{userID}/erase.
+%s Default: 30. Delete to-device messages which their device has not collected after this many days. 0 keeps them forever.
+%s Default: 0. Keep hourly samples of the size of each database table for this many days, exporting how quickly each table is growing. Requires SYNCV3_PROM. 0 disables.
+%s Default: 0. Move timeline events older than this many days to compressed objects in SYNCV3_ARCHIVE_S3_URL, fetching them back when clients paginate to them. Requires SYNCV3_ARCHIVE_S3_URL. 0 disables.
+%s Default: unset. An S3-compatible bucket to archive old events to, addressed path-style e.g 'https://s3.example.com/bucket/prefix'. Must stay set once events have been archived.
+%s Default: us-east-1. The region of the archive bucket.
+%s Default: unset. The access key ID for the archive bucket, which must be allowed to get, put and delete objects.
+%s Default: unset. The secret access key for the archive bucket.
+%s Default: unset. If set to '1', serve sync v2 requests (GET /_matrix/client/v3/sync) from the proxy's database, for legacy clients pointed at the proxy.
+%s Default: 100. The max number of ranges in a single list. Requests with more are rejected with a 400. 0 means no limit.
+%s Default: 100000. The max number of rooms covered by all the ranges of a single list. Requests with more are rejected with a 400. 0 means no limit.
+%s Default: 500. The max number of room subscriptions on a connection, including those made by earlier requests. Requests which exceed it are rejected with a 400 listing the rejected rooms. 0 means no limit.
+%s Default: unset. Comma separated extensions e.g 'typing,receipts' which are enabled for clients which do not set 'enabled' on them. Clients can still disable them.
+%s Default: unset. Comma separated extensions e.g 'receipts' which are never enabled, whatever clients ask for.
+%s Default: unset. The public URL of the proxy e.g 'https://slidingsync.example.com'. If set, serve /.well-known/matrix/client advertising it as org.matrix.msc3575.proxy.
+%s Default: unset. The public URL of the homeserver e.g 'https://matrix.example.com'. If set, /.well-known/matrix/client also includes m.homeserver, otherwise it only contains the proxy, for merging into an existing .well-known.
+%s Default: unset. For homeservers which delegate auth to an OIDC provider (MSC3861): the provider's token introspection endpoint. If set, access tokens are identified with it instead of /whoami, and conns survive access tokens being refreshed.
+%s Default: unset. The client ID the proxy uses to authenticate with the token introspection endpoint.
+%s Default: unset. The client secret the proxy uses to authenticate with the token introspection endpoint.
+%s Default: unset. The homeserver's server name e.g 'example.com'. Required if SYNCV3_OIDC_INTROSPECTION_URL is set.
+%s Default: 60. How long to cache token introspection results for, in seconds. Revoked tokens may keep working for this long.
+%s Default: unset. Comma separated domains to get TLS certificates for automatically from Let's Encrypt, enabling TLS on the bound address. The proxy must be reachable on port 443 for these domains. Cannot be used with SYNCV3_TLS_CERT.
+%s Default: acme-cache. The directory to store certificates from Let's Encrypt in.
+%s Default: unset. The contact email address to give Let's Encrypt.
+%s Default: unset. For debugging: a file to append every payload sent between the pollers and the API to, for replaying with syncv3-replay.
 `, EnvServer, EnvDB, EnvSecret, EnvBindAddr, EnvTLSCert, EnvTLSKey, EnvPPROF, EnvPrometheus, EnvOTLP, EnvOTLPUsername, EnvOTLPPassword,
-	EnvSentryDsn, EnvLogLevel, EnvMaxConns, EnvIdleTimeoutSecs, EnvHTTPTimeoutSecs, EnvHTTPInitialTimeoutSecs)
+	EnvSentryDsn, EnvLogLevel, EnvModuleLogLevels, EnvAdminBindAddr,
+	EnvTrustedProxies, EnvIPAllowlist, EnvIPDenylist, EnvAdminIPAllowlist, EnvAdminIPDenylist, EnvMaxConns, EnvIdleTimeoutSecs, EnvHTTPTimeoutSecs, EnvHTTPInitialTimeoutSecs,
+	EnvMaintenanceHours, EnvTokenPepper, EnvTokenPepperPrevious, EnvConfigFile,
+	EnvUserCacheTTLHours, EnvMaxUserCaches, EnvCacheMemoryBudgetMB, EnvWarmUserCacheDevices, EnvMetadataSnapshotMins, EnvMetadataReconcileRooms,
+	EnvEraseDeactivatedUsers, EnvToDeviceTTLDays, EnvTableStatsHistoryDays,
+	EnvArchiveAfterDays, EnvArchiveS3URL, EnvArchiveS3Region, EnvArchiveS3AccessKeyID, EnvArchiveS3SecretKey, EnvV2Compat, EnvMaxListRanges, EnvMaxListWindowSize,
+	EnvMaxRoomSubscriptions, EnvExtensionsEnabled, EnvExtensionsDisabled,
+	EnvWellKnownProxyURL, EnvWellKnownHomeserverURL, EnvOIDCIntrospectionURL, EnvOIDCClientID, EnvOIDCClientSecret,
+	EnvOIDCServerName, EnvOIDCCacheSecs, EnvACMEDomains, EnvACMECacheDir, EnvACMEEmail, EnvPubsubRecordFile)
 
 func defaulting(in, dft string) string {
 	if in == "" {
@@ -87,36 +184,104 @@ func defaulting(in, dft string) string {
 	return in
 }
 
+// readArgs reads all options from the environment and config file, applying defaults.
+func readArgs() map[string]string {
+	return map[string]string{
+		EnvServer:                 getenv(EnvServer),
+		EnvDB:                     getenv(EnvDB),
+		EnvSecret:                 getenv(EnvSecret),
+		EnvBindAddr:               defaulting(getenv(EnvBindAddr), "0.0.0.0:8008"),
+		EnvTLSCert:                getenv(EnvTLSCert),
+		EnvTLSKey:                 getenv(EnvTLSKey),
+		EnvPPROF:                  getenv(EnvPPROF),
+		EnvPrometheus:             getenv(EnvPrometheus),
+		EnvDebug:                  getenv(EnvDebug),
+		EnvOTLP:                   getenv(EnvOTLP),
+		EnvOTLPUsername:           getenv(EnvOTLPUsername),
+		EnvOTLPPassword:           getenv(EnvOTLPPassword),
+		EnvSentryDsn:              getenv(EnvSentryDsn),
+		EnvLogLevel:               getenv(EnvLogLevel),
+		EnvModuleLogLevels:        getenv(EnvModuleLogLevels),
+		EnvAdminBindAddr:          getenv(EnvAdminBindAddr),
+		EnvTrustedProxies:         getenv(EnvTrustedProxies),
+		EnvIPAllowlist:            getenv(EnvIPAllowlist),
+		EnvIPDenylist:             getenv(EnvIPDenylist),
+		EnvAdminIPAllowlist:       getenv(EnvAdminIPAllowlist),
+		EnvAdminIPDenylist:        getenv(EnvAdminIPDenylist),
+		EnvMaxConns:               defaulting(getenv(EnvMaxConns), "0"),
+		EnvIdleTimeoutSecs:        defaulting(getenv(EnvIdleTimeoutSecs), "3600"),
+		EnvHTTPTimeoutSecs:        defaulting(getenv(EnvHTTPTimeoutSecs), "300"),
+		EnvHTTPInitialTimeoutSecs: defaulting(getenv(EnvHTTPInitialTimeoutSecs), "1800"),
+		EnvMaintenanceHours:       defaulting(getenv(EnvMaintenanceHours), "0"),
+		EnvTokenPepper:            getenv(EnvTokenPepper),
+		EnvTokenPepperPrevious:    getenv(EnvTokenPepperPrevious),
+		EnvUserCacheTTLHours:      defaulting(getenv(EnvUserCacheTTLHours), "0"),
+		EnvMaxUserCaches:          defaulting(getenv(EnvMaxUserCaches), "0"),
+		EnvCacheMemoryBudgetMB:    defaulting(getenv(EnvCacheMemoryBudgetMB), "0"),
+		EnvWarmUserCacheDevices:   defaulting(getenv(EnvWarmUserCacheDevices), "0"),
+		EnvMetadataSnapshotMins:   defaulting(getenv(EnvMetadataSnapshotMins), "15"),
+		EnvMetadataReconcileRooms: defaulting(getenv(EnvMetadataReconcileRooms), "100"),
+		EnvEraseDeactivatedUsers:  getenv(EnvEraseDeactivatedUsers),
+		EnvToDeviceTTLDays:        defaulting(getenv(EnvToDeviceTTLDays), "30"),
+		EnvTableStatsHistoryDays:  defaulting(getenv(EnvTableStatsHistoryDays), "0"),
+		EnvArchiveAfterDays:       defaulting(getenv(EnvArchiveAfterDays), "0"),
+		EnvArchiveS3URL:           getenv(EnvArchiveS3URL),
+		EnvArchiveS3Region:        defaulting(getenv(EnvArchiveS3Region), "us-east-1"),
+		EnvArchiveS3AccessKeyID:   getenv(EnvArchiveS3AccessKeyID),
+		EnvArchiveS3SecretKey:     getenv(EnvArchiveS3SecretKey),
+		EnvV2Compat:               getenv(EnvV2Compat),
+		EnvMaxListRanges:          defaulting(getenv(EnvMaxListRanges), "100"),
+		EnvMaxListWindowSize:      defaulting(getenv(EnvMaxListWindowSize), "100000"),
+		EnvMaxRoomSubscriptions:   defaulting(getenv(EnvMaxRoomSubscriptions), "500"),
+		EnvExtensionsEnabled:      getenv(EnvExtensionsEnabled),
+		EnvExtensionsDisabled:     getenv(EnvExtensionsDisabled),
+		EnvWellKnownProxyURL:      getenv(EnvWellKnownProxyURL),
+		EnvWellKnownHomeserverURL: getenv(EnvWellKnownHomeserverURL),
+		EnvOIDCIntrospectionURL:   getenv(EnvOIDCIntrospectionURL),
+		EnvOIDCClientID:           getenv(EnvOIDCClientID),
+		EnvOIDCClientSecret:       getenv(EnvOIDCClientSecret),
+		EnvOIDCServerName:         getenv(EnvOIDCServerName),
+		EnvOIDCCacheSecs:          defaulting(getenv(EnvOIDCCacheSecs), "60"),
+		EnvACMEDomains:            getenv(EnvACMEDomains),
+		EnvACMECacheDir:           defaulting(getenv(EnvACMECacheDir), "acme-cache"),
+		EnvACMEEmail:              getenv(EnvACMEEmail),
+		EnvPubsubRecordFile:       getenv(EnvPubsubRecordFile),
+		EnvFaultInjection:         getenv(EnvFaultInjection),
+	}
+}
+
 func main() {
 	fmt.Printf("Sync v3 [%s] (%s)\n", version, GitCommit)
 	sync2.ProxyVersion = version
 	syncv3.Version = fmt.Sprintf("%s (%s)", version, GitCommit)
 
+	if err := loadConfigFile(os.Getenv(EnvConfigFile)); err != nil {
+		fmt.Printf("failed to load %s: %s\n", EnvConfigFile, err)
+		os.Exit(1)
+	}
+
 	if len(os.Args) > 1 && os.Args[1] == "migrate" {
 		executeMigrations()
 		return
 	}
-
-	args := map[string]string{
-		EnvServer:                 os.Getenv(EnvServer),
-		EnvDB:                     os.Getenv(EnvDB),
-		EnvSecret:                 os.Getenv(EnvSecret),
-		EnvBindAddr:               defaulting(os.Getenv(EnvBindAddr), "0.0.0.0:8008"),
-		EnvTLSCert:                os.Getenv(EnvTLSCert),
-		EnvTLSKey:                 os.Getenv(EnvTLSKey),
-		EnvPPROF:                  os.Getenv(EnvPPROF),
-		EnvPrometheus:             os.Getenv(EnvPrometheus),
-		EnvDebug:                  os.Getenv(EnvDebug),
-		EnvOTLP:                   os.Getenv(EnvOTLP),
-		EnvOTLPUsername:           os.Getenv(EnvOTLPUsername),
-		EnvOTLPPassword:           os.Getenv(EnvOTLPPassword),
-		EnvSentryDsn:              os.Getenv(EnvSentryDsn),
-		EnvLogLevel:               os.Getenv(EnvLogLevel),
-		EnvMaxConns:               defaulting(os.Getenv(EnvMaxConns), "0"),
-		EnvIdleTimeoutSecs:        defaulting(os.Getenv(EnvIdleTimeoutSecs), "3600"),
-		EnvHTTPTimeoutSecs:        defaulting(os.Getenv(EnvHTTPTimeoutSecs), "300"),
-		EnvHTTPInitialTimeoutSecs: defaulting(os.Getenv(EnvHTTPInitialTimeoutSecs), "1800"),
+	if len(os.Args) > 1 && os.Args[1] == "rehash-tokens" {
+		executeRehashTokens()
+		return
 	}
+	if len(os.Args) > 1 && os.Args[1] == "check-nids" {
+		executeCheckNIDs()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		executeExport()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		executeImport()
+		return
+	}
+
+	args := readArgs()
 	requiredEnvVars := []string{EnvServer, EnvDB, EnvSecret, EnvBindAddr}
 	for _, requiredEnvVar := range requiredEnvVars {
 		if args[requiredEnvVar] == "" {
@@ -126,11 +291,26 @@ func main() {
 			os.Exit(1)
 		}
 	}
+	if args[EnvOIDCIntrospectionURL] != "" && args[EnvOIDCServerName] == "" {
+		fmt.Print(helpMsg)
+		fmt.Printf("\n%s must be set when %s is set\n", EnvOIDCServerName, EnvOIDCIntrospectionURL)
+		os.Exit(1)
+	}
+	if args[EnvArchiveAfterDays] != "0" && args[EnvArchiveS3URL] == "" {
+		fmt.Print(helpMsg)
+		fmt.Printf("\n%s must be set when %s is set\n", EnvArchiveS3URL, EnvArchiveAfterDays)
+		os.Exit(1)
+	}
 	if (args[EnvTLSCert] != "" || args[EnvTLSKey] != "") && (args[EnvTLSCert] == "" || args[EnvTLSKey] == "") {
 		fmt.Print(helpMsg)
 		fmt.Printf("\nboth %s and %s must be set together\n", EnvTLSCert, EnvTLSKey)
 		os.Exit(1)
 	}
+	if args[EnvACMEDomains] != "" && args[EnvTLSCert] != "" {
+		fmt.Print(helpMsg)
+		fmt.Printf("\n%s cannot be set with %s\n", EnvACMEDomains, EnvTLSCert)
+		os.Exit(1)
+	}
 	// pprof
 	if args[EnvPPROF] != "" {
 		go func() {
@@ -173,25 +353,13 @@ func main() {
 
 	fmt.Printf("Debug=%v LogLevel=%v MaxConns=%v\n", args[EnvDebug] == "1", args[EnvLogLevel], args[EnvMaxConns])
 
-	if args[EnvDebug] == "1" {
-		zerolog.SetGlobalLevel(zerolog.TraceLevel)
-	} else {
-		switch strings.ToLower(args[EnvLogLevel]) {
-		case "trace":
-			zerolog.SetGlobalLevel(zerolog.TraceLevel)
-		case "debug":
-			zerolog.SetGlobalLevel(zerolog.DebugLevel)
-		case "info":
-			zerolog.SetGlobalLevel(zerolog.InfoLevel)
-		case "warn":
-			zerolog.SetGlobalLevel(zerolog.WarnLevel)
-		case "err", "error":
-			zerolog.SetGlobalLevel(zerolog.ErrorLevel)
-		case "fatal":
-			zerolog.SetGlobalLevel(zerolog.FatalLevel)
-		default:
-			zerolog.SetGlobalLevel(zerolog.InfoLevel)
-		}
+	if err := applyLogLevels(args); err != nil {
+		panic(err)
+	}
+	if args[EnvFaultInjection] == "1" {
+		// only for end-to-end tests, which inject faults via PUT /_syncv3/admin/faults
+		fmt.Printf("WARNING: fault injection is enabled, this must never be used in production\n")
+		internal.EnableFaultInjection()
 	}
 
 	maxConnsInt, err := strconv.Atoi(args[EnvMaxConns])
@@ -210,17 +378,138 @@ func main() {
 	if err != nil {
 		panic("invalid value for " + EnvHTTPInitialTimeoutSecs + ": " + args[EnvHTTPInitialTimeoutSecs])
 	}
+	maintenanceInterval, err := parseMaintenanceInterval(args)
+	if err != nil {
+		panic(err)
+	}
+	userCacheTTLHours, err := strconv.Atoi(args[EnvUserCacheTTLHours])
+	if err != nil {
+		panic("invalid value for " + EnvUserCacheTTLHours + ": " + args[EnvUserCacheTTLHours])
+	}
+	maxUserCaches, err := strconv.Atoi(args[EnvMaxUserCaches])
+	if err != nil {
+		panic("invalid value for " + EnvMaxUserCaches + ": " + args[EnvMaxUserCaches])
+	}
+	cacheMemoryBudgetMB, err := strconv.Atoi(args[EnvCacheMemoryBudgetMB])
+	if err != nil {
+		panic("invalid value for " + EnvCacheMemoryBudgetMB + ": " + args[EnvCacheMemoryBudgetMB])
+	}
+	warmUserCacheDevices, err := strconv.Atoi(args[EnvWarmUserCacheDevices])
+	if err != nil {
+		panic("invalid value for " + EnvWarmUserCacheDevices + ": " + args[EnvWarmUserCacheDevices])
+	}
+	metadataSnapshotMins, err := strconv.Atoi(args[EnvMetadataSnapshotMins])
+	if err != nil {
+		panic("invalid value for " + EnvMetadataSnapshotMins + ": " + args[EnvMetadataSnapshotMins])
+	}
+	metadataReconcileRooms, err := strconv.Atoi(args[EnvMetadataReconcileRooms])
+	if err != nil {
+		panic("invalid value for " + EnvMetadataReconcileRooms + ": " + args[EnvMetadataReconcileRooms])
+	}
+	toDeviceTTL, err := parseRetentionDays(args, EnvToDeviceTTLDays)
+	if err != nil {
+		panic(err)
+	}
+	tableStatsHistory, err := parseRetentionDays(args, EnvTableStatsHistoryDays)
+	if err != nil {
+		panic(err)
+	}
+	archiveAfterDays, err := strconv.Atoi(args[EnvArchiveAfterDays])
+	if err != nil {
+		panic("invalid value for " + EnvArchiveAfterDays + ": " + args[EnvArchiveAfterDays])
+	}
+	maxListRanges, err := strconv.Atoi(args[EnvMaxListRanges])
+	if err != nil {
+		panic("invalid value for " + EnvMaxListRanges + ": " + args[EnvMaxListRanges])
+	}
+	maxListWindowSize, err := strconv.ParseInt(args[EnvMaxListWindowSize], 10, 64)
+	if err != nil {
+		panic("invalid value for " + EnvMaxListWindowSize + ": " + args[EnvMaxListWindowSize])
+	}
+	maxRoomSubscriptions, err := strconv.Atoi(args[EnvMaxRoomSubscriptions])
+	if err != nil {
+		panic("invalid value for " + EnvMaxRoomSubscriptions + ": " + args[EnvMaxRoomSubscriptions])
+	}
+	oidcCacheSecs, err := strconv.Atoi(args[EnvOIDCCacheSecs])
+	if err != nil {
+		panic("invalid value for " + EnvOIDCCacheSecs + ": " + args[EnvOIDCCacheSecs])
+	}
+	var wellKnown *syncv3.WellKnown
+	if args[EnvWellKnownProxyURL] != "" {
+		wellKnown, err = syncv3.NewWellKnown(args[EnvWellKnownProxyURL], args[EnvWellKnownHomeserverURL])
+		if err != nil {
+			panic("invalid .well-known configuration: " + err.Error())
+		}
+	}
+	trustedProxies := splitList(args[EnvTrustedProxies])
+	ipFilter, err := syncv3.NewIPFilter(trustedProxies, splitList(args[EnvIPAllowlist]), splitList(args[EnvIPDenylist]))
+	if err != nil {
+		panic("invalid IP filter configuration: " + err.Error())
+	}
+	adminIPFilter, err := syncv3.NewIPFilter(trustedProxies, splitList(args[EnvAdminIPAllowlist]), splitList(args[EnvAdminIPDenylist]))
+	if err != nil {
+		panic("invalid admin IP filter configuration: " + err.Error())
+	}
 	h2, h3 := syncv3.Setup(args[EnvServer], args[EnvDB], args[EnvSecret], syncv3.Opts{
-		AddPrometheusMetrics:  args[EnvPrometheus] != "",
-		DBMaxConns:            maxConnsInt,
-		DBConnMaxIdleTime:     time.Duration(idleTimeSecs) * time.Second,
-		MaxTransactionIDDelay: time.Second,
-		HTTPTimeout:           time.Duration(httpTimeoutSecs) * time.Second,
-		HTTPLongTimeout:       time.Duration(httpLongTimeoutSecs) * time.Second,
+		AddPrometheusMetrics:           args[EnvPrometheus] != "",
+		DBMaxConns:                     maxConnsInt,
+		DBConnMaxIdleTime:              time.Duration(idleTimeSecs) * time.Second,
+		MaxTransactionIDDelay:          time.Second,
+		HTTPTimeout:                    time.Duration(httpTimeoutSecs) * time.Second,
+		HTTPLongTimeout:                time.Duration(httpLongTimeoutSecs) * time.Second,
+		TokenPepper:                    args[EnvTokenPepper],
+		PreviousTokenPeppers:           splitList(args[EnvTokenPepperPrevious]),
+		UserCacheTTL:                   time.Duration(userCacheTTLHours) * time.Hour,
+		MaxUserCaches:                  maxUserCaches,
+		CacheMemoryBudgetBytes:         int64(cacheMemoryBudgetMB) * 1024 * 1024,
+		WarmUserCacheDevices:           warmUserCacheDevices,
+		MetadataSnapshotInterval:       time.Duration(metadataSnapshotMins) * time.Minute,
+		MetadataReconcileRoomsPerMin:   metadataReconcileRooms,
+		EraseDeactivatedUsers:          args[EnvEraseDeactivatedUsers] == "1",
+		ToDeviceTTL:                    toDeviceTTL,
+		EventArchiveURL:                args[EnvArchiveS3URL],
+		EventArchiveRegion:             args[EnvArchiveS3Region],
+		EventArchiveAccessKeyID:        args[EnvArchiveS3AccessKeyID],
+		EventArchiveSecretAccessKey:    args[EnvArchiveS3SecretKey],
+		ArchiveEventsAfter:             time.Duration(archiveAfterDays) * 24 * time.Hour,
+		EnableV2Compat:                 args[EnvV2Compat] == "1",
+		MaxListRanges:                  maxListRanges,
+		MaxListWindowSize:              maxListWindowSize,
+		MaxRoomSubscriptions:           maxRoomSubscriptions,
+		DefaultEnabledExtensions:       splitList(args[EnvExtensionsEnabled]),
+		DisabledExtensions:             splitList(args[EnvExtensionsDisabled]),
+		TokenIntrospectionURL:          args[EnvOIDCIntrospectionURL],
+		TokenIntrospectionClientID:     args[EnvOIDCClientID],
+		TokenIntrospectionClientSecret: args[EnvOIDCClientSecret],
+		TokenIntrospectionCacheTTL:     time.Duration(oidcCacheSecs) * time.Second,
+		ServerName:                     args[EnvOIDCServerName],
+		PubsubRecordFile:               args[EnvPubsubRecordFile],
 	})
 
+	health := syncv3.NewHealthChecker(h2, h3)
 	go h2.StartV2Pollers()
 	go h2.Store.Cleaner(time.Hour)
+	h2.Store.Maintenance.SetInterval(maintenanceInterval)
+	go h2.Store.Maintenance.Schedule()
+	var statsCollector *syncv3.StatsCollector
+	if args[EnvPrometheus] != "" {
+		statsCollector = syncv3.NewStatsCollector(h2, h3)
+		statsCollector.SetHistoryRetention(tableStatsHistory)
+		go statsCollector.Run(5 * time.Minute)
+	}
+	reload := func() ([]string, error) {
+		return reloadConfig(args, h2, statsCollector)
+	}
+	go reloadOnSIGHUP(reload)
+	if args[EnvAdminBindAddr] != "" {
+		adminAPI := syncv3.NewAdminAPI(h2, h3)
+		adminAPI.ReloadConfig = reload
+		go func() {
+			if err := syncv3.RunAdminServer(adminAPI, args[EnvAdminBindAddr], adminIPFilter); err != nil {
+				panic(err)
+			}
+		}()
+	}
 	if args[EnvOTLP] != "" {
 		h3 = otelhttp.NewHandler(h3, "Sync")
 	}
@@ -233,7 +522,11 @@ func main() {
 		h3 = sentryHandler.Handle(h3)
 	}
 
-	syncv3.RunSyncV3Server(h3, args[EnvBindAddr], args[EnvServer], args[EnvTLSCert], args[EnvTLSKey])
+	tlsConfig, err := syncv3.NewTLSConfig(args[EnvTLSCert], args[EnvTLSKey], splitList(args[EnvACMEDomains]), args[EnvACMECacheDir], args[EnvACMEEmail])
+	if err != nil {
+		panic("invalid TLS configuration: " + err.Error())
+	}
+	syncv3.RunSyncV3Server(h3, health, wellKnown, ipFilter, args[EnvBindAddr], args[EnvServer], tlsConfig)
 	WaitForShutdown(args[EnvSentryDsn] != "")
 }
 
@@ -261,7 +554,7 @@ func WaitForShutdown(sentryInUse bool) {
 
 func executeMigrations() {
 	envArgs := map[string]string{
-		EnvDB: os.Getenv(EnvDB),
+		EnvDB: getenv(EnvDB),
 	}
 	requiredEnvVars := []string{EnvDB}
 	for _, requiredEnvVar := range requiredEnvVars {
@@ -305,6 +598,149 @@ func executeMigrations() {
 	}
 }
 
+// executeRehashTokens re-hashes all stored access tokens with the current pepper. Run this after
+// changing SYNCV3_TOKEN_PEPPER, then remove the old pepper from SYNCV3_TOKEN_PEPPER_PREVIOUS.
+// It is safe to run whilst the proxy is running, provided the proxy has the new pepper configured.
+// With -status, it only reports how many tokens are hashed with each pepper.
+func executeRehashTokens() {
+	envArgs := map[string]string{
+		EnvDB:                  getenv(EnvDB),
+		EnvSecret:              getenv(EnvSecret),
+		EnvTokenPepper:         getenv(EnvTokenPepper),
+		EnvTokenPepperPrevious: getenv(EnvTokenPepperPrevious),
+	}
+	requiredEnvVars := []string{EnvDB, EnvSecret}
+	for _, requiredEnvVar := range requiredEnvVars {
+		if envArgs[requiredEnvVar] == "" {
+			fmt.Print(helpMsg)
+			fmt.Printf("\n%s is not set", requiredEnvVar)
+			fmt.Printf("\n%s must be set\n", strings.Join(requiredEnvVars, ", "))
+			os.Exit(1)
+		}
+	}
+
+	rehashFlags := flag.NewFlagSet("rehash-tokens", flag.ExitOnError)
+	statusOnly := rehashFlags.Bool("status", false, "only report how many tokens are hashed with each pepper")
+	rehashFlags.Parse(os.Args[2:])
+
+	db, err := sqlx.Open("postgres", envArgs[EnvDB])
+	if err != nil {
+		log.Fatalf("rehash-tokens: failed to open DB: %v\n", err)
+	}
+	defer db.Close()
+
+	if err := sync2.SetTokenPeppers(envArgs[EnvTokenPepper], splitList(envArgs[EnvTokenPepperPrevious])); err != nil {
+		log.Fatalf("rehash-tokens: %v\n", err)
+	}
+	tokens := sync2.NewTokensTable(db, envArgs[EnvSecret])
+	if !*statusOnly {
+		numRehashed, err := tokens.Rehash(1000)
+		if err != nil {
+			log.Fatalf("rehash-tokens: re-hashed %d tokens before failing: %v\n", numRehashed, err)
+		}
+		fmt.Printf("rehash-tokens: re-hashed %d tokens\n", numRehashed)
+	}
+	counts, err := tokens.CountByPepper()
+	if err != nil {
+		log.Fatalf("rehash-tokens: failed to count tokens: %v\n", err)
+	}
+	printTokenPepperCounts(counts)
+}
+
+// printTokenPepperCounts prints the number of tokens hashed with each pepper, and whether that
+// pepper is still configured. Rotation is complete when every token uses the current pepper.
+func printTokenPepperCounts(counts map[string]int) {
+	current, previous := sync2.TokenPepperIDs()
+	describe := make(map[string]string, len(previous)+2)
+	describe[""] = "no pepper"
+	if current == "" {
+		describe[""] = "no pepper (current)"
+	} else {
+		describe[current] = current + " (current)"
+	}
+	for _, id := range previous {
+		if _, exists := describe[id]; !exists {
+			describe[id] = id + " (" + EnvTokenPepperPrevious + ")"
+		}
+	}
+	pepperIDs := make([]string, 0, len(counts))
+	for id := range counts {
+		pepperIDs = append(pepperIDs, id)
+	}
+	sort.Strings(pepperIDs)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "pepper\ttokens\t")
+	for _, id := range pepperIDs {
+		desc, configured := describe[id]
+		if !configured {
+			// unpeppered hashes are always accepted, so only peppers can be unknown
+			desc = id + " (not configured, these tokens cannot be used)"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t\n", desc, counts[id])
+	}
+	tw.Flush()
+}
+
+// executeCheckNIDs reports inconsistencies between event NIDs and the snapshots and rooms which
+// refer to them. With -repair, it also fixes them: the proxy must be restarted afterwards.
+func executeCheckNIDs() {
+	envArgs := map[string]string{
+		EnvDB: getenv(EnvDB),
+	}
+	requiredEnvVars := []string{EnvDB}
+	for _, requiredEnvVar := range requiredEnvVars {
+		if envArgs[requiredEnvVar] == "" {
+			fmt.Print(helpMsg)
+			fmt.Printf("\n%s is not set", requiredEnvVar)
+			fmt.Printf("\n%s must be set\n", strings.Join(requiredEnvVars, ", "))
+			os.Exit(1)
+		}
+	}
+	checkFlags := flag.NewFlagSet("check-nids", flag.ExitOnError)
+	repair := checkFlags.Bool("repair", false, "repair the anomalies found. Restart the proxy afterwards.")
+	checkFlags.Parse(os.Args[2:])
+
+	db, err := sqlx.Open("postgres", envArgs[EnvDB])
+	if err != nil {
+		log.Fatalf("check-nids: failed to open DB: %v\n", err)
+	}
+	store := state.NewStorageWithDB(db, false)
+	defer store.Teardown()
+
+	ctx := context.Background()
+	anomalies, err := store.CheckNIDs(ctx)
+	if err != nil {
+		log.Fatalf("check-nids: %v\n", err)
+	}
+	for _, a := range anomalies {
+		fmt.Println(a)
+	}
+	fmt.Printf("check-nids: found %d anomalies\n", len(anomalies))
+	if len(anomalies) == 0 {
+		return
+	}
+	if !*repair {
+		fmt.Println("check-nids: run with -repair to fix them")
+		os.Exit(1)
+	}
+	numRepaired, err := store.RepairNIDs(ctx, anomalies)
+	if err != nil {
+		log.Fatalf("check-nids: repaired %d anomalies before failing: %v\n", numRepaired, err)
+	}
+	fmt.Printf("check-nids: repaired %d anomalies, restart the proxy to pick up the changes\n", numRepaired)
+}
+
+// splitList parses a comma separated list, ignoring empty entries.
+func splitList(in string) []string {
+	var items []string
+	for _, item := range strings.Split(in, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 const gitRevLen = 7 // 7 matches the displayed characters on github.com
 func init() {
 	// Try to get the revision sliding-sync was build from.
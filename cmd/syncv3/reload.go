@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	syncv3 "github.com/matrix-org/sliding-sync"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync2/handler2"
+	"github.com/rs/zerolog"
+)
+
+// reloadableEnvVars can be changed without restarting the process by editing SYNCV3_CONFIG_FILE
+// and sending SIGHUP, or by calling the admin API. Changes to any other option are ignored until
+// the next restart.
+var reloadableEnvVars = map[string]bool{
+	EnvDebug:                 true,
+	EnvLogLevel:              true,
+	EnvModuleLogLevels:       true,
+	EnvMaintenanceHours:      true,
+	EnvToDeviceTTLDays:       true,
+	EnvTableStatsHistoryDays: true,
+}
+
+var (
+	configFileMu sync.Mutex
+	// the contents of SYNCV3_CONFIG_FILE, which take precedence over the environment.
+	configFileValues map[string]string
+)
+
+// getenv returns the value of an option from the config file if it is set there, else from the environment.
+func getenv(key string) string {
+	configFileMu.Lock()
+	defer configFileMu.Unlock()
+	if val, ok := configFileValues[key]; ok {
+		return val
+	}
+	return os.Getenv(key)
+}
+
+// loadConfigFile reads KEY=VALUE lines from the file at path. Blank lines and lines beginning
+// with # are ignored, and values may be wrapped in quotes. An empty path clears any loaded values.
+// On error, the previously loaded values are kept.
+func loadConfigFile(path string) error {
+	values := make(map[string]string)
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		lineNum := 0
+		for scanner.Scan() {
+			lineNum++
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			key, val, ok := strings.Cut(line, "=")
+			if !ok {
+				return fmt.Errorf("%s:%d: expected KEY=VALUE", path, lineNum)
+			}
+			val = strings.TrimSpace(val)
+			if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+				val = val[1 : len(val)-1]
+			}
+			values[strings.TrimSpace(key)] = val
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	configFileMu.Lock()
+	configFileValues = values
+	configFileMu.Unlock()
+	return nil
+}
+
+// applyLogLevels sets the default and per-module log levels. Modules which are not listed are
+// reset to the default level. Nothing is changed if the module levels are invalid.
+func applyLogLevels(args map[string]string) error {
+	moduleLevels, err := internal.ParseModuleLogLevels(args[EnvModuleLogLevels])
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %w", EnvModuleLogLevels, err)
+	}
+	if args[EnvDebug] == "1" {
+		internal.SetDefaultLogLevel(zerolog.TraceLevel)
+	} else {
+		level, err := internal.ParseLogLevel(args[EnvLogLevel])
+		if err != nil {
+			level = zerolog.InfoLevel
+		}
+		internal.SetDefaultLogLevel(level)
+	}
+	_, existing := internal.LogLevels()
+	for module := range existing {
+		if _, ok := moduleLevels[module]; !ok {
+			internal.SetModuleLogLevel(module, nil)
+		}
+	}
+	for module, level := range moduleLevels {
+		level := level
+		internal.SetModuleLogLevel(module, &level)
+	}
+	return nil
+}
+
+func parseMaintenanceInterval(args map[string]string) (time.Duration, error) {
+	maintenanceHours, err := strconv.Atoi(args[EnvMaintenanceHours])
+	if err != nil || maintenanceHours < 0 {
+		return 0, fmt.Errorf("invalid value for %s: %s", EnvMaintenanceHours, args[EnvMaintenanceHours])
+	}
+	return time.Duration(maintenanceHours) * time.Hour, nil
+}
+
+// parseRetentionDays parses an option which is how many days to keep something for.
+func parseRetentionDays(args map[string]string, key string) (time.Duration, error) {
+	days, err := strconv.Atoi(args[key])
+	if err != nil || days < 0 {
+		return 0, fmt.Errorf("invalid value for %s: %s", key, args[key])
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// reloadConfig re-reads the config file and environment and applies the reloadable options.
+// statsCollector is nil if table stats are not being collected. Returns the names of any other
+// options which have changed since startup, which need a restart to take effect. Nothing is
+// changed if any reloadable option is invalid.
+func reloadConfig(startupArgs map[string]string, h2 *handler2.Handler, statsCollector *syncv3.StatsCollector) (restartRequired []string, err error) {
+	if err = loadConfigFile(os.Getenv(EnvConfigFile)); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", EnvConfigFile, err)
+	}
+	args := readArgs()
+	maintenanceInterval, err := parseMaintenanceInterval(args)
+	if err != nil {
+		return nil, err
+	}
+	toDeviceTTL, err := parseRetentionDays(args, EnvToDeviceTTLDays)
+	if err != nil {
+		return nil, err
+	}
+	tableStatsHistory, err := parseRetentionDays(args, EnvTableStatsHistoryDays)
+	if err != nil {
+		return nil, err
+	}
+	if err = applyLogLevels(args); err != nil {
+		return nil, err
+	}
+	h2.Store.Maintenance.SetInterval(maintenanceInterval)
+	h2.SetToDeviceTTL(toDeviceTTL)
+	if statsCollector != nil {
+		statsCollector.SetHistoryRetention(tableStatsHistory)
+	}
+
+	for key, val := range args {
+		if !reloadableEnvVars[key] && val != startupArgs[key] {
+			restartRequired = append(restartRequired, key)
+		}
+	}
+	sort.Strings(restartRequired)
+	return restartRequired, nil
+}
+
+// reloadOnSIGHUP calls reload every time the process receives a SIGHUP.
+func reloadOnSIGHUP(reload func() ([]string, error)) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		restartRequired, err := reload()
+		if err != nil {
+			fmt.Printf("SIGHUP: failed to reload config: %s\n", err)
+			continue
+		}
+		fmt.Printf("SIGHUP: reloaded config\n")
+		if len(restartRequired) > 0 {
+			fmt.Printf("SIGHUP: restart required for changes to %s\n", strings.Join(restartRequired, ", "))
+		}
+	}
+}
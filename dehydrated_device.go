@@ -0,0 +1,47 @@
+package slidingsync
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// DehydratedDevicePathPrefix is the prefix of the dehydrated device (MSC3814) endpoints.
+const DehydratedDevicePathPrefix = "/_matrix/client/unstable/org.matrix.msc3814.v1/dehydrated_device"
+
+// NewDehydratedDeviceProxy creates a handler which passes dehydrated device (MSC3814) requests through
+// to the homeserver, for clients which use the proxy as their homeserver URL.
+//
+// Dehydrated devices never sync, so the proxy does not poll them. Instead, the client fetches the
+// dehydrated device's to-device queue from POST .../dehydrated_device/{device_id}/events when it
+// rehydrates it. Those events are for the dehydrated device and not the requesting device, so they are
+// returned as-is and never stored in the requesting device's to-device queue.
+func NewDehydratedDeviceProxy(destV2Server string) (http.Handler, error) {
+	target, err := url.Parse(internal.GetBaseURL(destV2Server))
+	if err != nil {
+		return nil, fmt.Errorf("invalid homeserver URL: %s", err)
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			// so the homeserver records the client's address against the device, not ours
+			if ip := internal.RequestContextClientIP(r.In.Context()); ip != "" {
+				r.Out.Header.Set("X-Forwarded-For", ip)
+			}
+		},
+		ModifyResponse: func(res *http.Response) error {
+			// allowCORS sets these, so don't duplicate them
+			res.Header.Del("Access-Control-Allow-Origin")
+			res.Header.Del("Access-Control-Allow-Methods")
+			res.Header.Del("Access-Control-Allow-Headers")
+			return nil
+		},
+	}
+	if internal.IsUnixSocket(destV2Server) {
+		proxy.Transport = internal.UnixTransport(destV2Server)
+	}
+	return proxy, nil
+}
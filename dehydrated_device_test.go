@@ -0,0 +1,60 @@
+package slidingsync
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// Test that fetching a dehydrated device's to-device queue is passed through to the homeserver untouched.
+func TestDehydratedDeviceProxy(t *testing.T) {
+	eventsPath := DehydratedDevicePathPrefix + "/DEHYDRATED/events"
+	reqBody := `{"next_batch":"token1"}`
+	resBody := `{"events":[{"type":"m.room.encrypted","sender":"@alice:localhost","content":{"ciphertext":"foo"}}],"next_batch":"token2"}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != eventsPath {
+			t.Errorf("upstream got %s %s want POST %s", req.Method, req.URL.Path, eventsPath)
+		}
+		if got := req.Header.Get("Authorization"); got != "Bearer ALICE_TOKEN" {
+			t.Errorf("upstream got Authorization %q", got)
+		}
+		if got := req.Header.Get("X-Forwarded-For"); got != "10.1.2.3" {
+			t.Errorf("upstream got X-Forwarded-For %q want 10.1.2.3", got)
+		}
+		body, _ := io.ReadAll(req.Body)
+		if string(body) != reqBody {
+			t.Errorf("upstream got body %s want %s", body, reqBody)
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write([]byte(resBody))
+	}))
+	defer upstream.Close()
+
+	proxy, err := NewDehydratedDeviceProxy(upstream.URL)
+	if err != nil {
+		t.Fatalf("NewDehydratedDeviceProxy returned error: %s", err)
+	}
+	var ipFilter *IPFilter
+	h := allowCORS(ipFilter.Middleware(proxy))
+	req := httptest.NewRequest("POST", eventsPath, strings.NewReader(reqBody))
+	req.RemoteAddr = "10.1.2.3:1234"
+	req.Header.Set("Authorization", "Bearer ALICE_TOKEN")
+	req = req.WithContext(internal.RequestContext(req.Context()))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("got status %d want 200", w.Code)
+	}
+	if got := w.Body.String(); got != resBody {
+		t.Errorf("got body %s want %s", got, resBody)
+	}
+	if got := w.Result().Header.Values("Access-Control-Allow-Origin"); len(got) != 1 {
+		t.Errorf("got Access-Control-Allow-Origin %v want exactly one", got)
+	}
+}
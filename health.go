@@ -0,0 +1,72 @@
+package slidingsync
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2/handler2"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
+)
+
+const healthCheckTimeout = 5 * time.Second
+
+// HealthChecker serves liveness and readiness endpoints which check the proxy's dependencies.
+type HealthChecker struct {
+	h2 *handler2.Handler
+	h3 *handler.SyncLiveHandler
+}
+
+// NewHealthChecker creates a HealthChecker for the handlers returned from Setup.
+func NewHealthChecker(h2 *handler2.Handler, h3 http.Handler) *HealthChecker {
+	return &HealthChecker{
+		h2: h2,
+		h3: h3.(*handler.SyncLiveHandler),
+	}
+}
+
+type healthJSON struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// ServeLiveness checks that the dispatcher goroutine is alive, i.e it is still running and is not
+// stuck on a single payload. A failure here will not fix itself, so the process should be restarted.
+// This deliberately does not wait for queued payloads, so a busy proxy is not restarted.
+func (c *HealthChecker) ServeLiveness(w http.ResponseWriter, req *http.Request) {
+	c.serve(w, req, map[string]func(context.Context) error{
+		"dispatcher": c.h3.Alive,
+	})
+}
+
+// ServeReadiness checks everything ServeLiveness does, as well as that pubsub messages make a
+// round-trip between the API and the pollers and database connectivity. A failure here means the
+// proxy cannot currently serve requests promptly, but may recover without a restart.
+func (c *HealthChecker) ServeReadiness(w http.ResponseWriter, req *http.Request) {
+	c.serve(w, req, map[string]func(context.Context) error{
+		"dispatcher": c.h3.Alive,
+		"pubsub":     c.h3.Ping,
+		"database":   c.h2.Store.DB.PingContext,
+	})
+}
+
+func (c *HealthChecker) serve(w http.ResponseWriter, req *http.Request, checks map[string]func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(req.Context(), healthCheckTimeout)
+	defer cancel()
+	res := healthJSON{
+		Status: "ok",
+		Checks: make(map[string]string, len(checks)),
+	}
+	code := 200
+	for name, check := range checks {
+		if err := check(ctx); err != nil {
+			logger.Warn().Err(err).Str("check", name).Msg("health check failed")
+			res.Checks[name] = err.Error()
+			res.Status = "failed"
+			code = http.StatusServiceUnavailable
+			continue
+		}
+		res.Checks[name] = "ok"
+	}
+	writeJSON(w, code, res)
+}
@@ -22,6 +22,7 @@ type data struct {
 	deviceID             string
 	bufferSummary        string
 	connID               string
+	clientIP             string
 	since                int64
 	next                 int64
 	numRooms             int
@@ -47,6 +48,23 @@ func RequestContext(ctx context.Context) context.Context {
 	return context.WithValue(ctx, ctxData, d)
 }
 
+// detachedContext keeps the values of its parent context, but is never cancelled.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (c detachedContext) Done() <-chan struct{}             { return nil }
+func (c detachedContext) Err() error                        { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// DetachContext returns a context with the same values as ctx (e.g the Sentry hub and request
+// logging data) which is not cancelled when ctx is. Use this for work which must finish even if the
+// client goes away, such as processing an update which has already been taken off a queue.
+func DetachContext(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
 // add the user ID to this request context. Need to have called RequestContext first.
 func AssociateUserIDWithRequest(ctx context.Context, userID, deviceID string) context.Context {
 	d := ctx.Value(ctxData)
@@ -77,6 +95,25 @@ func SetConnBufferInfo(ctx context.Context, bufferLen, nextLen, bufferCap int) {
 	da.bufferSummary = fmt.Sprintf("%d/%d/%d", bufferLen, nextLen, bufferCap)
 }
 
+// SetRequestContextClientIP records the real IP address of the client, which may be behind proxies.
+func SetRequestContextClientIP(ctx context.Context, clientIP string) {
+	d := ctx.Value(ctxData)
+	if d == nil {
+		return
+	}
+	da := d.(*data)
+	da.clientIP = clientIP
+}
+
+// RequestContextClientIP returns the IP address set with SetRequestContextClientIP, or "" if unknown.
+func RequestContextClientIP(ctx context.Context) string {
+	d := ctx.Value(ctxData)
+	if d == nil {
+		return ""
+	}
+	return d.(*data).clientIP
+}
+
 func SetRequestContextResponseInfo(
 	ctx context.Context, since, next int64, numRooms int, txnID string, numToDeviceEvents, numGlobalAccountData int,
 	numChangedDevices, numLeftDevices int, connID string, numLists int, roomSubs, roomUnsubs int,
@@ -148,6 +185,9 @@ func DecorateLogger(ctx context.Context, l *zerolog.Event) *zerolog.Event {
 	if da.numLists > 0 {
 		l = l.Int("l", da.numLists)
 	}
+	if da.clientIP != "" {
+		l = l.Str("ip", da.clientIP)
+	}
 	// always log the connection ID so we know when it isn't set
 	l = l.Str("c", da.connID)
 	return l
@@ -0,0 +1,27 @@
+package internal
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDetachContext(t *testing.T) {
+	type key string
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key("k"), "v"))
+	detached := DetachContext(ctx)
+	cancel()
+	if ctx.Err() == nil {
+		t.Fatalf("parent context was not cancelled")
+	}
+	if err := detached.Err(); err != nil {
+		t.Errorf("detached context was cancelled with the parent: %s", err)
+	}
+	select {
+	case <-detached.Done():
+		t.Errorf("detached context Done() fired")
+	default:
+	}
+	if got := detached.Value(key("k")); got != "v" {
+		t.Errorf("detached context value: got %v want v", got)
+	}
+}
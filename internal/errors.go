@@ -8,19 +8,17 @@ import (
 	"runtime"
 
 	"github.com/getsentry/sentry-go"
-
-	"github.com/rs/zerolog"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = NewLogger("internal")
 
 type HandlerError struct {
 	StatusCode int
 	Err        error
 	ErrCode    string
+	// Fields are extra top-level keys to include in the JSON response, so clients can tell
+	// errors apart without parsing the message.
+	Fields map[string]interface{}
 }
 
 func (e *HandlerError) Error() string {
@@ -37,6 +35,18 @@ type jsonError struct {
 }
 
 func (e HandlerError) JSON() []byte {
+	if len(e.Fields) > 0 {
+		je := make(map[string]interface{}, len(e.Fields)+2)
+		for k, v := range e.Fields {
+			je[k] = v
+		}
+		je["error"] = e.Error()
+		if e.ErrCode != "" {
+			je["errcode"] = e.ErrCode
+		}
+		b, _ := json.Marshal(je)
+		return b
+	}
 	je := jsonError{
 		Err:  e.Error(),
 		Code: e.ErrCode,
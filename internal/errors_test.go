@@ -1,7 +1,10 @@
 package internal
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -44,3 +47,26 @@ func try(t *testing.T, shouldPanic bool, fn func()) {
 	}()
 	fn()
 }
+
+func TestHandlerErrorJSONFields(t *testing.T) {
+	herr := HandlerError{
+		StatusCode: 400,
+		Err:        fmt.Errorf("too many"),
+		ErrCode:    "M_INVALID_PARAM",
+		Fields: map[string]interface{}{
+			"limit": "max_ranges",
+		},
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(herr.JSON(), &got); err != nil {
+		t.Fatalf("failed to unmarshal: %s", err)
+	}
+	want := map[string]interface{}{
+		"error":   "HTTP 400 : too many",
+		"errcode": "M_INVALID_PARAM",
+		"limit":   "max_ranges",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
@@ -1,19 +1,125 @@
 package internal
 
-import "github.com/tidwall/gjson"
+import (
+	"encoding/json"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// ParsedEvent holds the fields of an event which are needed when processing it. gjson does not build
+// a tree when parsing, so every Get call rescans the event JSON from the start: parse each event once
+// with ParseEvent and pass this around instead of calling Get on the raw JSON repeatedly.
+type ParsedEvent struct {
+	JSON      json.RawMessage
+	ID        string
+	RoomID    string
+	Type      string
+	StateKey  *string // nil if this is not a state event
+	Sender    string
+	Timestamp uint64
+	Content   gjson.Result
+	Unsigned  gjson.Result
+}
+
+// ParseEvent extracts the top-level fields of the event in a single pass over the JSON.
+func ParseEvent(ev json.RawMessage) ParsedEvent {
+	parsed := ParsedEvent{JSON: ev}
+	gjson.ParseBytes(ev).ForEach(func(key, value gjson.Result) bool {
+		switch key.Str {
+		case "event_id":
+			parsed.ID = value.Str
+		case "room_id":
+			parsed.RoomID = value.Str
+		case "type":
+			parsed.Type = value.Str
+		case "state_key":
+			stateKey := value.Str
+			parsed.StateKey = &stateKey
+		case "sender":
+			parsed.Sender = value.Str
+		case "origin_server_ts":
+			parsed.Timestamp = value.Uint()
+		case "content":
+			parsed.Content = value
+		case "unsigned":
+			parsed.Unsigned = value
+		}
+		return true
+	})
+	return parsed
+}
+
+// Membership returns content.membership, or the empty string if there is no such field.
+func (ev *ParsedEvent) Membership() string {
+	return ev.Content.Get("membership").Str
+}
+
+// TransactionID returns unsigned.transaction_id, or the empty string if there is no such field.
+func (ev *ParsedEvent) TransactionID() string {
+	return ev.Unsigned.Get("transaction_id").Str
+}
+
+// ReplacedEventID returns the ID of the event this event edits, if it is an m.replace, or the
+// empty string otherwise.
+func (ev *ParsedEvent) ReplacedEventID() string {
+	relatesTo := ev.Content.Get(`m\.relates_to`)
+	if relatesTo.Get("rel_type").Str != "m.replace" {
+		return ""
+	}
+	return relatesTo.Get("event_id").Str
+}
+
+// RedactedEventID returns the ID of the event this event redacts, if it is an m.room.redaction, or
+// the empty string otherwise.
+func (ev *ParsedEvent) RedactedEventID() string {
+	if ev.Type != "m.room.redaction" {
+		return ""
+	}
+	// room version 11 moved redacts into the content
+	if redacts := ev.Content.Get("redacts").Str; redacts != "" {
+		return redacts
+	}
+	return gjson.GetBytes(ev.JSON, "redacts").Str
+}
+
+// IsMembershipChange is like the function of the same name, without rescanning the event.
+func (ev *ParsedEvent) IsMembershipChange() bool {
+	return isMembershipChange(ev.Unsigned.Get("prev_content.membership"), ev.Content.Get("membership"))
+}
 
 func IsMembershipChange(eventJSON gjson.Result) bool {
+	return isMembershipChange(eventJSON.Get("unsigned.prev_content.membership"), eventJSON.Get("content.membership"))
+}
+
+func isMembershipChange(pm, cm gjson.Result) bool {
 	// membership event possibly, make sure the membership has changed else
 	// things like display name changes will count as membership events :(
 	prevMembership := "leave"
-	pm := eventJSON.Get("unsigned.prev_content.membership")
 	if pm.Exists() && pm.Str != "" {
 		prevMembership = pm.Str
 	}
 	currMembership := "leave"
-	cm := eventJSON.Get("content.membership")
 	if cm.Exists() && cm.Str != "" {
 		currMembership = cm.Str
 	}
 	return prevMembership != currMembership // membership was changed
 }
+
+// StripTransactionID removes unsigned.transaction_id from the event, along with unsigned itself if
+// nothing else is left in it. Transaction IDs are only meant for the device which sent the event,
+// so must not be stored in the event JSON shared between users.
+func StripTransactionID(ev json.RawMessage) json.RawMessage {
+	if !gjson.GetBytes(ev, "unsigned.transaction_id").Exists() {
+		return ev
+	}
+	path := "unsigned.transaction_id"
+	if len(gjson.GetBytes(ev, "unsigned").Map()) == 1 {
+		path = "unsigned"
+	}
+	stripped, err := sjson.DeleteBytes(ev, path)
+	if err != nil {
+		return ev
+	}
+	return stripped
+}
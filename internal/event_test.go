@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestStripTransactionID(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "no unsigned",
+			in:   `{"event_id":"$a","type":"m.room.message"}`,
+			want: `{"event_id":"$a","type":"m.room.message"}`,
+		},
+		{
+			name: "only a transaction ID",
+			in:   `{"event_id":"$a","type":"m.room.message","unsigned":{"transaction_id":"txn"}}`,
+			want: `{"event_id":"$a","type":"m.room.message"}`,
+		},
+		{
+			name: "other unsigned fields are kept",
+			in:   `{"event_id":"$a","type":"m.room.message","unsigned":{"age":5,"transaction_id":"txn"}}`,
+			want: `{"event_id":"$a","type":"m.room.message","unsigned":{"age":5}}`,
+		},
+	}
+	for _, tc := range testCases {
+		got := StripTransactionID(json.RawMessage(tc.in))
+		if string(got) != tc.want {
+			t.Errorf("%s: got %s want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	ev := ParseEvent(json.RawMessage(`{
+		"event_id": "$a",
+		"room_id": "!r",
+		"type": "m.room.member",
+		"state_key": "@bob:localhost",
+		"sender": "@alice:localhost",
+		"origin_server_ts": 1234,
+		"content": {"membership": "join", "displayname": "Bob"},
+		"unsigned": {"transaction_id": "txn", "prev_content": {"membership": "invite"}}
+	}`))
+	if ev.ID != "$a" || ev.RoomID != "!r" || ev.Type != "m.room.member" || ev.Sender != "@alice:localhost" || ev.Timestamp != 1234 {
+		t.Errorf("ParseEvent: wrong fields: %+v", ev)
+	}
+	if ev.StateKey == nil || *ev.StateKey != "@bob:localhost" {
+		t.Errorf("ParseEvent: wrong state key: %v", ev.StateKey)
+	}
+	if ev.Membership() != "join" || ev.Content.Get("displayname").Str != "Bob" {
+		t.Errorf("ParseEvent: wrong content: %s", ev.Content.Raw)
+	}
+	if ev.TransactionID() != "txn" {
+		t.Errorf("ParseEvent: wrong transaction ID: %s", ev.TransactionID())
+	}
+
+	msg := ParseEvent(json.RawMessage(`{"event_id":"$b","type":"m.room.message","content":{"body":"hi"}}`))
+	if msg.StateKey != nil {
+		t.Errorf("ParseEvent: message event has state key %q", *msg.StateKey)
+	}
+	if msg.Membership() != "" || msg.TransactionID() != "" {
+		t.Errorf("ParseEvent: message event has membership or transaction ID: %+v", msg)
+	}
+}
+
+func TestParsedEventIsMembershipChange(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+		want bool
+	}{
+		{
+			name: "join without prev_content",
+			in:   `{"type":"m.room.member","state_key":"@a","content":{"membership":"join"}}`,
+			want: true,
+		},
+		{
+			name: "display name change",
+			in:   `{"type":"m.room.member","state_key":"@a","content":{"membership":"join","displayname":"A"},"unsigned":{"prev_content":{"membership":"join"}}}`,
+			want: false,
+		},
+		{
+			name: "leave after join",
+			in:   `{"type":"m.room.member","state_key":"@a","content":{"membership":"leave"},"unsigned":{"prev_content":{"membership":"join"}}}`,
+			want: true,
+		},
+		{
+			name: "leave without prev_content",
+			in:   `{"type":"m.room.member","state_key":"@a","content":{"membership":"leave"}}`,
+			want: false,
+		},
+	}
+	for _, tc := range testCases {
+		ev := ParseEvent(json.RawMessage(tc.in))
+		if got := ev.IsMembershipChange(); got != tc.want {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+		if got := IsMembershipChange(gjson.Parse(tc.in)); got != tc.want {
+			t.Errorf("%s: IsMembershipChange got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParsedEventReplacedEventID(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "edit",
+			in:   `{"type":"m.room.message","content":{"body":"* hi","m.relates_to":{"rel_type":"m.replace","event_id":"$orig"}}}`,
+			want: "$orig",
+		},
+		{
+			name: "reaction",
+			in:   `{"type":"m.reaction","content":{"m.relates_to":{"rel_type":"m.annotation","event_id":"$orig","key":"👍"}}}`,
+			want: "",
+		},
+		{
+			name: "no relation",
+			in:   `{"type":"m.room.message","content":{"body":"hi"}}`,
+			want: "",
+		},
+	}
+	for _, tc := range testCases {
+		ev := ParseEvent(json.RawMessage(tc.in))
+		if got := ev.ReplacedEventID(); got != tc.want {
+			t.Errorf("%s: got %q want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParsedEventRedactedEventID(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "redacts at the top level",
+			in:   `{"type":"m.room.redaction","redacts":"$a","content":{}}`,
+			want: "$a",
+		},
+		{
+			name: "redacts in the content",
+			in:   `{"type":"m.room.redaction","content":{"redacts":"$a"}}`,
+			want: "$a",
+		},
+		{
+			name: "not a redaction",
+			in:   `{"type":"m.room.message","redacts":"$a","content":{"redacts":"$a"}}`,
+			want: "",
+		},
+	}
+	for _, tc := range testCases {
+		ev := ParseEvent(json.RawMessage(tc.in))
+		if got := ev.RedactedEventID(); got != tc.want {
+			t.Errorf("%s: got %q want %q", tc.name, got, tc.want)
+		}
+	}
+}
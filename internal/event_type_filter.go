@@ -0,0 +1,110 @@
+package internal
+
+import "sort"
+
+// EventTypeFilter selects events by their type. If Types is not empty, only events of those types
+// match. Events with a type in NotTypes never match. The zero value matches every event.
+type EventTypeFilter struct {
+	Types    []string
+	NotTypes []string
+}
+
+// IsEmpty returns true if the filter matches every event.
+func (f EventTypeFilter) IsEmpty() bool {
+	return len(f.Types) == 0 && len(f.NotTypes) == 0
+}
+
+// Matches returns true if events of this type pass the filter.
+func (f EventTypeFilter) Matches(evType string) bool {
+	for _, t := range f.NotTypes {
+		if t == evType {
+			return false
+		}
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == evType {
+			return true
+		}
+	}
+	return false
+}
+
+// Union returns a filter which matches the events matched by either filter. The result is sorted
+// so that unions are commutative.
+func (f EventTypeFilter) Union(other EventTypeFilter) EventTypeFilter {
+	// A filter either allows a set of types, or allows everything except a set of types.
+	allowF, denyF := f.normalise()
+	allowO, denyO := other.normalise()
+	if allowF != nil && len(allowF) == 0 {
+		return other // f matches nothing
+	}
+	if allowO != nil && len(allowO) == 0 {
+		return f
+	}
+	var result EventTypeFilter
+	switch {
+	case allowF != nil && allowO != nil:
+		result.Types = setToSlice(allowF, allowO)
+	case allowF != nil:
+		result.NotTypes = setToSlice(subtract(denyO, allowF))
+	case allowO != nil:
+		result.NotTypes = setToSlice(subtract(denyF, allowO))
+	default:
+		both := make(map[string]struct{})
+		for t := range denyF {
+			if _, ok := denyO[t]; ok {
+				both[t] = struct{}{}
+			}
+		}
+		result.NotTypes = setToSlice(both)
+	}
+	return result
+}
+
+// normalise returns the set of allowed types, or nil and the set of denied types if every type
+// not denied is allowed.
+func (f EventTypeFilter) normalise() (allow, deny map[string]struct{}) {
+	deny = make(map[string]struct{}, len(f.NotTypes))
+	for _, t := range f.NotTypes {
+		deny[t] = struct{}{}
+	}
+	if len(f.Types) == 0 {
+		return nil, deny
+	}
+	allow = make(map[string]struct{}, len(f.Types))
+	for _, t := range f.Types {
+		if _, denied := deny[t]; !denied {
+			allow[t] = struct{}{}
+		}
+	}
+	return allow, nil
+}
+
+func subtract(set, remove map[string]struct{}) map[string]struct{} {
+	result := make(map[string]struct{}, len(set))
+	for t := range set {
+		if _, ok := remove[t]; !ok {
+			result[t] = struct{}{}
+		}
+	}
+	return result
+}
+
+func setToSlice(sets ...map[string]struct{}) []string {
+	seen := make(map[string]struct{})
+	var result []string
+	for _, set := range sets {
+		for t := range set {
+			if _, ok := seen[t]; ok {
+				continue
+			}
+			seen[t] = struct{}{}
+			result = append(result, t)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
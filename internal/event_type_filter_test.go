@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEventTypeFilterMatches(t *testing.T) {
+	testCases := []struct {
+		name   string
+		filter EventTypeFilter
+		match  []string
+		reject []string
+	}{
+		{
+			name:  "empty filter",
+			match: []string{"m.room.message", "m.reaction"},
+		},
+		{
+			name:   "types",
+			filter: EventTypeFilter{Types: []string{"m.room.message"}},
+			match:  []string{"m.room.message"},
+			reject: []string{"m.reaction"},
+		},
+		{
+			name:   "not types",
+			filter: EventTypeFilter{NotTypes: []string{"m.reaction"}},
+			match:  []string{"m.room.message", "m.room.encrypted"},
+			reject: []string{"m.reaction"},
+		},
+		{
+			name:   "not types win",
+			filter: EventTypeFilter{Types: []string{"m.room.message", "m.reaction"}, NotTypes: []string{"m.reaction"}},
+			match:  []string{"m.room.message"},
+			reject: []string{"m.reaction", "m.room.encrypted"},
+		},
+	}
+	for _, tc := range testCases {
+		for _, evType := range tc.match {
+			if !tc.filter.Matches(evType) {
+				t.Errorf("%s: %s did not match", tc.name, evType)
+			}
+		}
+		for _, evType := range tc.reject {
+			if tc.filter.Matches(evType) {
+				t.Errorf("%s: %s matched", tc.name, evType)
+			}
+		}
+	}
+}
+
+func TestEventTypeFilterUnion(t *testing.T) {
+	testCases := []struct {
+		name string
+		a    EventTypeFilter
+		b    EventTypeFilter
+		want EventTypeFilter
+	}{
+		{
+			name: "empty",
+			a:    EventTypeFilter{Types: []string{"a"}},
+			want: EventTypeFilter{},
+		},
+		{
+			name: "types",
+			a:    EventTypeFilter{Types: []string{"b", "a"}},
+			b:    EventTypeFilter{Types: []string{"c", "a"}},
+			want: EventTypeFilter{Types: []string{"a", "b", "c"}},
+		},
+		{
+			name: "not types",
+			a:    EventTypeFilter{NotTypes: []string{"a", "b"}},
+			b:    EventTypeFilter{NotTypes: []string{"b", "c"}},
+			want: EventTypeFilter{NotTypes: []string{"b"}},
+		},
+		{
+			name: "types and not types",
+			a:    EventTypeFilter{Types: []string{"a"}},
+			b:    EventTypeFilter{NotTypes: []string{"a", "b"}},
+			want: EventTypeFilter{NotTypes: []string{"b"}},
+		},
+		{
+			name: "filter matching nothing",
+			a:    EventTypeFilter{Types: []string{"a"}, NotTypes: []string{"a"}},
+			b:    EventTypeFilter{Types: []string{"b"}},
+			want: EventTypeFilter{Types: []string{"b"}},
+		},
+	}
+	for _, tc := range testCases {
+		if got := tc.a.Union(tc.b); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: a.Union(b) got %+v want %+v", tc.name, got, tc.want)
+		}
+		if got := tc.b.Union(tc.a); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: b.Union(a) got %+v want %+v", tc.name, got, tc.want)
+		}
+	}
+}
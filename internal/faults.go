@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrInjectedFault is returned by operations which failed because of an injected fault.
+var ErrInjectedFault = errors.New("injected fault")
+
+// ErrFaultInjectionDisabled is returned by SetFaults if EnableFaultInjection has not been called.
+var ErrFaultInjectionDisabled = errors.New("fault injection is not enabled")
+
+// Faults are failures which end-to-end tests can inject into a running proxy, to check that it
+// recovers from them. They are only used if EnableFaultInjection has been called, which should
+// never happen in production.
+type Faults struct {
+	// FailPolls is the number of upcoming sync v2 requests which fail without being sent, as if the
+	// homeserver were unreachable. If FailPollsUserID is set, only that user's requests fail.
+	FailPolls       int    `json:"fail_polls"`
+	FailPollsUserID string `json:"fail_polls_user_id,omitempty"`
+	// DropPayloads is the number of upcoming payloads from the pollers to the API which are lost.
+	// If DropPayloadsRoomID is set, only payloads about that room are lost.
+	DropPayloads       int    `json:"drop_payloads"`
+	DropPayloadsRoomID string `json:"drop_payloads_room_id,omitempty"`
+	// DBLatencyMS is added to the start of every database transaction.
+	DBLatencyMS int `json:"db_latency_ms"`
+}
+
+var faults = struct {
+	enabled atomic.Bool
+	mu      sync.Mutex
+	current Faults
+}{}
+
+// EnableFaultInjection allows faults to be set with SetFaults.
+func EnableFaultInjection() {
+	faults.enabled.Store(true)
+}
+
+// SetFaults replaces the faults which are being injected.
+func SetFaults(f Faults) error {
+	if !faults.enabled.Load() {
+		return ErrFaultInjectionDisabled
+	}
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+	faults.current = f
+	return nil
+}
+
+// CurrentFaults returns the faults which have not been injected yet.
+func CurrentFaults() Faults {
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+	return faults.current
+}
+
+// InjectPollFailure returns true if the next sync v2 request for this user should fail.
+func InjectPollFailure(userID string) bool {
+	if !faults.enabled.Load() {
+		return false
+	}
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+	f := &faults.current
+	if f.FailPolls <= 0 || (f.FailPollsUserID != "" && f.FailPollsUserID != userID) {
+		return false
+	}
+	f.FailPolls--
+	return true
+}
+
+// InjectPayloadDrop returns true if the next payload about this room should be dropped. roomID is
+// empty for payloads which are not about a room.
+func InjectPayloadDrop(roomID string) bool {
+	if !faults.enabled.Load() {
+		return false
+	}
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+	f := &faults.current
+	if f.DropPayloads <= 0 || (f.DropPayloadsRoomID != "" && f.DropPayloadsRoomID != roomID) {
+		return false
+	}
+	f.DropPayloads--
+	return true
+}
+
+// InjectDBLatency sleeps for the configured database latency, if any.
+func InjectDBLatency() {
+	if !faults.enabled.Load() {
+		return
+	}
+	faults.mu.Lock()
+	latency := time.Duration(faults.current.DBLatencyMS) * time.Millisecond
+	faults.mu.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+}
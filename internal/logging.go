@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+)
+
+// levelUnset is stored for modules which have no explicit log level, meaning they use the default level.
+const levelUnset = int32(-128)
+
+var logLevels = &moduleLevels{
+	defaultLevel: int32(zerolog.InfoLevel),
+	modules:      make(map[string]*int32),
+}
+
+// moduleLevels tracks the log level for each named module. Levels are read on every log line so are
+// stored atomically; the map itself is only modified when a new module is created.
+type moduleLevels struct {
+	defaultLevel int32
+	mu           sync.Mutex
+	modules      map[string]*int32
+}
+
+func (m *moduleLevels) level(module string) *int32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lvl, ok := m.modules[module]
+	if !ok {
+		lvl = new(int32)
+		*lvl = levelUnset
+		m.modules[module] = lvl
+	}
+	return lvl
+}
+
+// recalculate sets the zerolog global level to the most verbose level in use, as zerolog drops
+// events below the global level before our hooks get a chance to see them. Must hold mu.
+func (m *moduleLevels) recalculate() {
+	lowest := atomic.LoadInt32(&m.defaultLevel)
+	for _, lvl := range m.modules {
+		l := atomic.LoadInt32(lvl)
+		if l != levelUnset && l < lowest {
+			lowest = l
+		}
+	}
+	zerolog.SetGlobalLevel(zerolog.Level(lowest))
+}
+
+// moduleLevelHook discards events which are below the level of the module which logged them.
+type moduleLevelHook struct {
+	level *int32
+}
+
+func (h moduleLevelHook) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	min := atomic.LoadInt32(h.level)
+	if min == levelUnset {
+		min = atomic.LoadInt32(&logLevels.defaultLevel)
+	}
+	// never discard panics or fatals, and NoLevel is used for things like access logs
+	if level >= zerolog.FatalLevel || level == zerolog.NoLevel {
+		return
+	}
+	if int32(level) < min {
+		e.Discard()
+	}
+}
+
+// NewLogger creates a logger for the named module. The verbosity of the logger can be changed
+// at runtime via SetModuleLogLevel.
+func NewLogger(module string) zerolog.Logger {
+	return zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
+		Out:        os.Stderr,
+		TimeFormat: "15:04:05",
+	}).Hook(moduleLevelHook{level: logLevels.level(module)})
+}
+
+// SetDefaultLogLevel sets the log level for all modules which do not have an explicit level set.
+func SetDefaultLogLevel(level zerolog.Level) {
+	logLevels.mu.Lock()
+	defer logLevels.mu.Unlock()
+	atomic.StoreInt32(&logLevels.defaultLevel, int32(level))
+	logLevels.recalculate()
+}
+
+// SetModuleLogLevel sets the log level for a single module. Pass nil to make the module use
+// the default log level again.
+func SetModuleLogLevel(module string, level *zerolog.Level) {
+	lvl := logLevels.level(module)
+	logLevels.mu.Lock()
+	defer logLevels.mu.Unlock()
+	if level == nil {
+		atomic.StoreInt32(lvl, levelUnset)
+	} else {
+		atomic.StoreInt32(lvl, int32(*level))
+	}
+	logLevels.recalculate()
+}
+
+// LogLevels returns the default log level and the levels of all modules which have an explicit level.
+func LogLevels() (defaultLevel zerolog.Level, modules map[string]zerolog.Level) {
+	logLevels.mu.Lock()
+	defer logLevels.mu.Unlock()
+	modules = make(map[string]zerolog.Level)
+	for module, lvl := range logLevels.modules {
+		l := atomic.LoadInt32(lvl)
+		if l != levelUnset {
+			modules[module] = zerolog.Level(l)
+		}
+	}
+	return zerolog.Level(atomic.LoadInt32(&logLevels.defaultLevel)), modules
+}
+
+// LogModules returns the names of all modules which have created a logger, sorted.
+func LogModules() []string {
+	logLevels.mu.Lock()
+	defer logLevels.mu.Unlock()
+	names := make([]string, 0, len(logLevels.modules))
+	for module := range logLevels.modules {
+		names = append(names, module)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseLogLevel parses a log level name. "err" is accepted as an alias for "error".
+func ParseLogLevel(s string) (zerolog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "trace":
+		return zerolog.TraceLevel, nil
+	case "debug":
+		return zerolog.DebugLevel, nil
+	case "info":
+		return zerolog.InfoLevel, nil
+	case "warn":
+		return zerolog.WarnLevel, nil
+	case "err", "error":
+		return zerolog.ErrorLevel, nil
+	case "fatal":
+		return zerolog.FatalLevel, nil
+	}
+	return zerolog.NoLevel, fmt.Errorf("unknown log level '%s'", s)
+}
+
+// ParseModuleLogLevels parses a comma separated list of module=level pairs e.g "poller=debug,conn=trace".
+func ParseModuleLogLevels(s string) (map[string]zerolog.Level, error) {
+	result := make(map[string]zerolog.Level)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		module, levelStr, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(module) == "" {
+			return nil, fmt.Errorf("invalid module log level '%s', expected module=level", pair)
+		}
+		level, err := ParseLogLevel(levelStr)
+		if err != nil {
+			return nil, fmt.Errorf("module %s: %w", module, err)
+		}
+		result[strings.TrimSpace(module)] = level
+	}
+	return result, nil
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestParseModuleLogLevels(t *testing.T) {
+	got, err := ParseModuleLogLevels("poller=debug, conn=TRACE,,state=err")
+	if err != nil {
+		t.Fatalf("ParseModuleLogLevels: %s", err)
+	}
+	want := map[string]zerolog.Level{
+		"poller": zerolog.DebugLevel,
+		"conn":   zerolog.TraceLevel,
+		"state":  zerolog.ErrorLevel,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+	for _, invalid := range []string{"poller", "=debug", "poller=loud"} {
+		if _, err := ParseModuleLogLevels(invalid); err == nil {
+			t.Errorf("ParseModuleLogLevels(%q): expected error", invalid)
+		}
+	}
+}
+
+func TestModuleLogLevels(t *testing.T) {
+	globalLevel := zerolog.GlobalLevel()
+	defaultLevel, _ := LogLevels()
+	t.Cleanup(func() {
+		SetDefaultLogLevel(defaultLevel)
+		SetModuleLogLevel("test_a", nil)
+		SetModuleLogLevel("test_b", nil)
+		zerolog.SetGlobalLevel(globalLevel)
+	})
+	var buf bytes.Buffer
+	loggerA := zerolog.New(&buf).Hook(moduleLevelHook{level: logLevels.level("test_a")})
+	loggerB := zerolog.New(&buf).Hook(moduleLevelHook{level: logLevels.level("test_b")})
+
+	SetDefaultLogLevel(zerolog.InfoLevel)
+	debug := zerolog.DebugLevel
+	SetModuleLogLevel("test_a", &debug)
+	if zerolog.GlobalLevel() != zerolog.DebugLevel {
+		t.Fatalf("global level should be lowered to debug, got %v", zerolog.GlobalLevel())
+	}
+
+	loggerA.Debug().Msg("a_debug")
+	loggerB.Debug().Msg("b_debug")
+	loggerB.Info().Msg("b_info")
+	out := buf.String()
+	if !strings.Contains(out, "a_debug") || !strings.Contains(out, "b_info") {
+		t.Errorf("missing expected log lines: %s", out)
+	}
+	if strings.Contains(out, "b_debug") {
+		t.Errorf("module b logged below its level: %s", out)
+	}
+
+	// resetting the module makes it use the default level again
+	SetModuleLogLevel("test_a", nil)
+	if zerolog.GlobalLevel() != zerolog.InfoLevel {
+		t.Fatalf("global level should be restored to info, got %v", zerolog.GlobalLevel())
+	}
+	buf.Reset()
+	loggerA.Debug().Msg("a_debug")
+	if buf.Len() != 0 {
+		t.Errorf("module a logged below the default level: %s", buf.String())
+	}
+}
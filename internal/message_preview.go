@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// MessagePreviewEventTypes are the types of events which can be previewed.
+var MessagePreviewEventTypes = []string{"m.room.message", "m.sticker"}
+
+// MaxMessagePreviewLength is the maximum number of characters in the body of a MessagePreview.
+const MaxMessagePreviewLength = 200
+
+// MessagePreview is a short plaintext summary of a message, for clients which show the latest
+// message in their room list without loading timelines.
+type MessagePreview struct {
+	EventID   string `json:"event_id"`
+	Sender    string `json:"sender"`
+	Timestamp uint64 `json:"origin_server_ts"`
+	// The msgtype of an m.room.message, or the event type of other messages e.g m.sticker.
+	MsgType string `json:"msgtype"`
+	// The body on a single line, without any reply fallback and truncated to MaxMessagePreviewLength.
+	// For media, this is the caption or file name.
+	Body string `json:"body"`
+	// Edited is true if Body is from the latest edit of the message.
+	Edited bool `json:"edited,omitempty"`
+}
+
+// IsMessagePreviewEventType returns true if events of this type can be previewed.
+func IsMessagePreviewEventType(evType string) bool {
+	for _, t := range MessagePreviewEventTypes {
+		if t == evType {
+			return true
+		}
+	}
+	return false
+}
+
+// NewMessagePreview returns the preview of this message, using the m.new_content of the replacement
+// event if one is given. Returns nil if the event cannot be previewed, e.g because it is redacted.
+func NewMessagePreview(event, replacement json.RawMessage) *MessagePreview {
+	parsed := gjson.ParseBytes(event)
+	evType := parsed.Get("type").Str
+	if !IsMessagePreviewEventType(evType) {
+		return nil
+	}
+	preview := &MessagePreview{
+		EventID:   parsed.Get("event_id").Str,
+		Sender:    parsed.Get("sender").Str,
+		Timestamp: parsed.Get("origin_server_ts").Uint(),
+		MsgType:   evType,
+	}
+	content := parsed.Get("content")
+	if newContent := gjson.GetBytes(replacement, `content.m\.new_content`); newContent.IsObject() {
+		content = newContent
+		preview.Edited = true
+	}
+	if evType == "m.room.message" {
+		preview.MsgType = content.Get("msgtype").Str
+		if preview.MsgType == "" {
+			return nil
+		}
+	}
+	body := content.Get("body").Str
+	// the relation is never part of m.new_content, so check the original event
+	if parsed.Get(`content.m\.relates_to.m\.in_reply_to`).Exists() {
+		body = stripReplyFallback(body)
+	}
+	preview.Body = truncatePreview(strings.Join(strings.Fields(body), " "))
+	return preview
+}
+
+// stripReplyFallback removes the quoted lines at the start of the body of a reply.
+// See https://spec.matrix.org/v1.8/client-server-api/#stripping-the-fallback
+func stripReplyFallback(body string) string {
+	lines := strings.Split(body, "\n")
+	i := 0
+	for i < len(lines) && strings.HasPrefix(lines[i], ">") {
+		i++
+	}
+	if i == 0 {
+		return body
+	}
+	return strings.Join(lines[i:], "\n")
+}
+
+func truncatePreview(body string) string {
+	runes := []rune(body)
+	if len(runes) <= MaxMessagePreviewLength {
+		return body
+	}
+	return strings.TrimSpace(string(runes[:MaxMessagePreviewLength-1])) + "…"
+}
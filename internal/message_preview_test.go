@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewMessagePreview(t *testing.T) {
+	longBody := strings.Repeat("a", MaxMessagePreviewLength+10)
+	testCases := []struct {
+		name        string
+		event       string
+		replacement string
+		want        *MessagePreview
+	}{
+		{
+			name:  "text",
+			event: `{"type":"m.room.message","event_id":"$a","sender":"@alice","origin_server_ts":123,"content":{"msgtype":"m.text","body":"hello\n\n  world "}}`,
+			want:  &MessagePreview{EventID: "$a", Sender: "@alice", Timestamp: 123, MsgType: "m.text", Body: "hello world"},
+		},
+		{
+			name: "reply fallbacks are stripped",
+			event: `{"type":"m.room.message","event_id":"$a","sender":"@alice","origin_server_ts":123,"content":{
+				"msgtype":"m.text","body":"> <@bob> hi\n> there\n\nhello","m.relates_to":{"m.in_reply_to":{"event_id":"$b"}}
+			}}`,
+			want: &MessagePreview{EventID: "$a", Sender: "@alice", Timestamp: 123, MsgType: "m.text", Body: "hello"},
+		},
+		{
+			name:  "quotes are kept if the message isn't a reply",
+			event: `{"type":"m.room.message","event_id":"$a","sender":"@alice","origin_server_ts":123,"content":{"msgtype":"m.text","body":"> quote\n\nhello"}}`,
+			want:  &MessagePreview{EventID: "$a", Sender: "@alice", Timestamp: 123, MsgType: "m.text", Body: "> quote hello"},
+		},
+		{
+			name:  "the latest edit is used",
+			event: `{"type":"m.room.message","event_id":"$a","sender":"@alice","origin_server_ts":123,"content":{"msgtype":"m.text","body":"helo"}}`,
+			replacement: `{"type":"m.room.message","event_id":"$b","sender":"@alice","origin_server_ts":456,"content":{
+				"msgtype":"m.text","body":"* hello","m.new_content":{"msgtype":"m.notice","body":"hello"},"m.relates_to":{"rel_type":"m.replace","event_id":"$a"}
+			}}`,
+			want: &MessagePreview{EventID: "$a", Sender: "@alice", Timestamp: 123, MsgType: "m.notice", Body: "hello", Edited: true},
+		},
+		{
+			name:  "media",
+			event: `{"type":"m.room.message","event_id":"$a","sender":"@alice","origin_server_ts":123,"content":{"msgtype":"m.image","body":"cat.png","url":"mxc://a/b"}}`,
+			want:  &MessagePreview{EventID: "$a", Sender: "@alice", Timestamp: 123, MsgType: "m.image", Body: "cat.png"},
+		},
+		{
+			name:  "stickers",
+			event: `{"type":"m.sticker","event_id":"$a","sender":"@alice","origin_server_ts":123,"content":{"body":"a cat","url":"mxc://a/b"}}`,
+			want:  &MessagePreview{EventID: "$a", Sender: "@alice", Timestamp: 123, MsgType: "m.sticker", Body: "a cat"},
+		},
+		{
+			name:  "long bodies are truncated",
+			event: `{"type":"m.room.message","event_id":"$a","sender":"@alice","origin_server_ts":123,"content":{"msgtype":"m.text","body":"` + longBody + `"}}`,
+			want:  &MessagePreview{EventID: "$a", Sender: "@alice", Timestamp: 123, MsgType: "m.text", Body: longBody[:MaxMessagePreviewLength-1] + "…"},
+		},
+		{
+			name:  "redacted messages",
+			event: `{"type":"m.room.message","event_id":"$a","sender":"@alice","origin_server_ts":123,"content":{},"unsigned":{"redacted_because":{}}}`,
+		},
+		{
+			name:  "not a message",
+			event: `{"type":"m.reaction","event_id":"$a","sender":"@alice","origin_server_ts":123,"content":{"body":"hello"}}`,
+		},
+	}
+	for _, tc := range testCases {
+		var replacement json.RawMessage
+		if tc.replacement != "" {
+			replacement = json.RawMessage(tc.replacement)
+		}
+		got := NewMessagePreview(json.RawMessage(tc.event), replacement)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v want %+v", tc.name, got, tc.want)
+		}
+	}
+}
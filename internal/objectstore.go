@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrObjectNotFound is returned by ObjectStore.Get when there is no object with the given key.
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectStore stores opaque blobs by key.
+type ObjectStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Delete removes the object with the given key. It is not an error if there is no such object.
+	Delete(ctx context.Context, key string) error
+}
+
+// S3ObjectStore is an ObjectStore backed by a bucket in S3 or an S3-compatible service such as
+// MinIO. Objects are addressed path-style, so the base URL is of the form
+// https://s3.example.com/bucket or https://s3.example.com/bucket/prefix.
+type S3ObjectStore struct {
+	client          *http.Client
+	baseURL         *url.URL
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+}
+
+func NewS3ObjectStore(client *http.Client, baseURL, region, accessKeyID, secretAccessKey string) (*S3ObjectStore, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object store URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid object store URL %q: scheme must be http or https", baseURL)
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		return nil, fmt.Errorf("invalid object store URL %q: missing bucket", baseURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawQuery = ""
+	return &S3ObjectStore{
+		client:          client,
+		baseURL:         u,
+		region:          region,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+	}, nil
+}
+
+func (s *S3ObjectStore) Put(ctx context.Context, key string, data []byte) error {
+	res, err := s.do(ctx, "PUT", key, data)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("PUT %s: HTTP %d: %s", key, res.StatusCode, readErrorBody(res.Body))
+	}
+	return nil
+}
+
+func (s *S3ObjectStore) Get(ctx context.Context, key string) ([]byte, error) {
+	res, err := s.do(ctx, "GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, ErrObjectNotFound
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("GET %s: HTTP %d: %s", key, res.StatusCode, readErrorBody(res.Body))
+	}
+	return io.ReadAll(res.Body)
+}
+
+func (s *S3ObjectStore) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, "DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 && res.StatusCode != 204 && res.StatusCode != 404 {
+		return fmt.Errorf("DELETE %s: HTTP %d: %s", key, res.StatusCode, readErrorBody(res.Body))
+	}
+	return nil
+}
+
+func (s *S3ObjectStore) do(ctx context.Context, method, key string, body []byte) (*http.Response, error) {
+	u := *s.baseURL
+	u.Path = s.baseURL.Path + "/" + strings.TrimPrefix(key, "/")
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(sum[:]), s.region, s.accessKeyID, s.secretAccessKey, time.Now())
+	return s.client.Do(req)
+}
+
+func readErrorBody(body io.Reader) string {
+	b, _ := io.ReadAll(io.LimitReader(body, 512))
+	return string(b)
+}
+
+// signV4 signs the request for S3 with AWS Signature Version 4, signing the host and every header
+// already set on the request.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func signV4(req *http.Request, payloadHash, region, accessKeyID, secretAccessKey string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for i := range values {
+			trimmed[i] = strings.TrimSpace(values[i])
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query := req.URL.Query()
+	queryKeys := make([]string, 0, len(query))
+	for k := range query {
+		queryKeys = append(queryKeys, k)
+	}
+	sort.Strings(queryKeys)
+	var queryParts []string
+	for _, k := range queryKeys {
+		for _, v := range query[k] {
+			queryParts = append(queryParts, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, strings.Join(queryParts, "&"), canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s", accessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode percent-encodes everything except unreserved characters, as SigV4 requires.
+func uriEncode(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
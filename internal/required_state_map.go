@@ -62,6 +62,24 @@ func (rsm *RequiredStateMap) Include(evType, stateKey string) bool {
 	return false
 }
 
+// IsExactly returns true if this map includes the state event with this type and state key, and nothing else.
+func (rsm *RequiredStateMap) IsExactly(evType, stateKey string) bool {
+	if rsm.allState || rsm.lazyLoading || len(rsm.stateKeysForWildcardEventType) > 0 ||
+		len(rsm.eventTypesWithWildcardStateKeys) > 0 || len(rsm.eventTypeToStateKeys) != 1 {
+		return false
+	}
+	stateKeys, ok := rsm.eventTypeToStateKeys[evType]
+	if !ok || len(stateKeys) == 0 {
+		return false
+	}
+	for _, sk := range stateKeys {
+		if sk != stateKey {
+			return false
+		}
+	}
+	return true
+}
+
 func (rsm *RequiredStateMap) Empty() bool {
 	return !rsm.allState && !rsm.lazyLoading &&
 		len(rsm.eventTypeToStateKeys) == 0 &&
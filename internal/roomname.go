@@ -50,6 +50,10 @@ type RoomMetadata struct {
 	ChildSpaceRooms map[string]struct{}
 	// The latest m.typing ephemeral event for this room.
 	TypingEvent json.RawMessage
+	// The current m.room.pinned_events state event for this room and its NID, so that it can be
+	// served as required_state without going to the database. Nil if the room has none.
+	PinnedEvent    json.RawMessage
+	PinnedEventNID int64
 }
 
 func NewRoomMetadata(roomID string) *RoomMetadata {
@@ -151,6 +155,10 @@ type Hero struct {
 	Avatar string `json:"avatar_url,omitempty"`
 }
 
+// MaxHeroNamesInRoomName is the maximum number of heroes named in a calculated room name, e.g.
+// "Alice, Bob, Charlie, Doris, Eve and 3 others".
+const MaxHeroNamesInRoomName = 5
+
 // CalculateRoomName calculates the room name. Returns the name and if the name was actually calculated
 // based on room heroes.
 func CalculateRoomName(heroInfo *RoomMetadata, maxNumNamesPerRoom int) (name string, calculated bool) {
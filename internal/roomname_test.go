@@ -293,6 +293,33 @@ func TestCopyHeroes(t *testing.T) {
 	assertSliceIDs(t, "m2.Heroes", m2.Heroes, []string{alice, bob, chris})
 }
 
+func TestCalculateAvatar(t *testing.T) {
+	alice := Hero{ID: "@alice:localhost", Avatar: "mxc://alice"}
+	bob := Hero{ID: "@bob:localhost", Avatar: "mxc://bob"}
+	testCases := []struct {
+		name       string
+		avatar     string
+		heroes     []Hero
+		isDM       bool
+		wantAvatar string
+	}{
+		{name: "room avatar", avatar: "mxc://room", heroes: []Hero{alice}, wantAvatar: "mxc://room"},
+		{name: "room avatar beats DM avatar", avatar: "mxc://room", heroes: []Hero{alice}, isDM: true, wantAvatar: "mxc://room"},
+		{name: "DM falls back to the other user", heroes: []Hero{alice}, isDM: true, wantAvatar: "mxc://alice"},
+		{name: "non-DM does not fall back", heroes: []Hero{alice}},
+		{name: "DM with several other users does not fall back", heroes: []Hero{alice, bob}, isDM: true},
+		{name: "no avatar", isDM: true},
+	}
+	for _, tc := range testCases {
+		m := NewRoomMetadata("!a:localhost")
+		m.AvatarEvent = tc.avatar
+		m.Heroes = tc.heroes
+		if got := CalculateAvatar(m, tc.isDM); got != tc.wantAvatar {
+			t.Errorf("%s: got %q want %q", tc.name, got, tc.wantAvatar)
+		}
+	}
+}
+
 func assertSliceIDs(t *testing.T, desc string, h []Hero, ids []string) {
 	if len(h) != len(ids) {
 		t.Errorf("%s has length %d, expected %d", desc, len(h), len(ids))
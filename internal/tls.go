@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often CertReloader checks whether the certificate files have changed.
+var certReloadCheckInterval = 10 * time.Second
+
+// CertReloader serves a TLS certificate loaded from disk, reloading it when the certificate or key
+// file changes, so renewed certificates are picked up without a restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastChecked time.Time
+}
+
+// NewCertReloader loads the certificate and key. Returns an error if they cannot be loaded.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) reload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat TLS certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to stat TLS key: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	r.cert = &cert
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+	return nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if the files have changed.
+// If reloading fails, e.g because only one of the files has been replaced so far, the previous
+// certificate is used. It is intended to be used as tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.lastChecked) < certReloadCheckInterval {
+		return r.cert, nil
+	}
+	r.lastChecked = time.Now()
+	certInfo, certErr := os.Stat(r.certFile)
+	keyInfo, keyErr := os.Stat(r.keyFile)
+	if certErr != nil || keyErr != nil {
+		return r.cert, nil
+	}
+	if certInfo.ModTime().Equal(r.certModTime) && keyInfo.ModTime().Equal(r.keyModTime) {
+		return r.cert, nil
+	}
+	if err := r.reload(); err != nil {
+		logger.Warn().Err(err).Msg("failed to reload TLS certificate, using the previous one")
+		return r.cert, nil
+	}
+	logger.Info().Str("cert", r.certFile).Msg("reloaded TLS certificate")
+	return r.cert, nil
+}
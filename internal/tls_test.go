@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write certificate: %s", err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("failed to write key: %s", err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err = os.Chtimes(f, modTime, modTime); err != nil {
+			t.Fatalf("failed to set mod time: %s", err)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	oldInterval := certReloadCheckInterval
+	certReloadCheckInterval = 0
+	defer func() {
+		certReloadCheckInterval = oldInterval
+	}()
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Minute)
+	writeTestCert(t, certFile, keyFile, 1, start)
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("NewCertReloader: %s", err)
+	}
+	assertSerial := func(want int64) {
+		t.Helper()
+		cert, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("GetCertificate: %s", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("failed to parse certificate: %s", err)
+		}
+		if leaf.SerialNumber.Int64() != want {
+			t.Errorf("got certificate serial %d want %d", leaf.SerialNumber.Int64(), want)
+		}
+	}
+	assertSerial(1)
+
+	// the certificate is renewed
+	writeTestCert(t, certFile, keyFile, 2, start.Add(time.Second))
+	assertSerial(2)
+
+	// a half-written certificate is ignored until it is valid
+	if err = os.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("failed to write certificate: %s", err)
+	}
+	assertSerial(2)
+	writeTestCert(t, certFile, keyFile, 3, start.Add(2*time.Second))
+	assertSerial(3)
+
+	if _, err = NewCertReloader(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Errorf("NewCertReloader succeeded with a missing certificate")
+	}
+}
@@ -0,0 +1,143 @@
+package slidingsync
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// IPFilter works out the real IP address of clients, and rejects clients whose address is denied.
+//
+// The client's address is the address of the TCP connection, unless that is a trusted proxy, in
+// which case X-Forwarded-For is read from right to left, skipping trusted proxies, and the first
+// untrusted address is used. Addresses added by untrusted hops can be forged by clients, so are
+// never used.
+//
+// A nil *IPFilter trusts no proxies and allows every client.
+type IPFilter struct {
+	trustedProxies []*net.IPNet
+	allow          []*net.IPNet
+	deny           []*net.IPNet
+}
+
+// NewIPFilter creates an IPFilter from lists of IP addresses or CIDR ranges e.g '10.0.0.0/8'. If
+// allow is empty, all clients which are not denied are allowed. Deny takes precedence over allow.
+func NewIPFilter(trustedProxies, allow, deny []string) (*IPFilter, error) {
+	var f IPFilter
+	var err error
+	if f.trustedProxies, err = parseIPNets(trustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy: %s", err)
+	}
+	if f.allow, err = parseIPNets(allow); err != nil {
+		return nil, fmt.Errorf("invalid allowed address: %s", err)
+	}
+	if f.deny, err = parseIPNets(deny); err != nil {
+		return nil, fmt.Errorf("invalid denied address: %s", err)
+	}
+	return &f, nil
+}
+
+func parseIPNets(in []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(in))
+	for _, s := range in {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR range", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", s)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the real IP address of the client which made the request, or nil if it is unknown.
+// Requests over a unix socket have no address, so are treated as coming from a trusted proxy.
+func (f *IPFilter) ClientIP(req *http.Request) net.IP {
+	var ip net.IP
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		ip = net.ParseIP(host)
+	}
+	if ip != nil && !f.trusts(ip) {
+		return ip
+	}
+	// X-Forwarded-For may be split over several headers, which are equivalent to one comma separated header
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// a garbled hop means we can't tell who is further along the chain
+			break
+		}
+		ip = hop
+		if !f.trusts(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (f *IPFilter) trusts(ip net.IP) bool {
+	return f != nil && containsIP(f.trustedProxies, ip)
+}
+
+// Allowed returns true if clients with this IP address may make requests. Unknown addresses are only
+// allowed if there is no allow list.
+func (f *IPFilter) Allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if ip == nil {
+		return len(f.allow) == 0
+	}
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+// Middleware records the client's IP address in the request context for logging, see
+// internal.RequestContextClientIP, and rejects requests from clients which are not allowed with a 403.
+func (f *IPFilter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip := f.ClientIP(req)
+		if ip != nil {
+			internal.SetRequestContextClientIP(req.Context(), ip.String())
+		}
+		if !f.Allowed(ip) {
+			herr := internal.HandlerError{
+				StatusCode: http.StatusForbidden,
+				Err:        fmt.Errorf("requests from this address are not allowed"),
+				ErrCode:    "M_FORBIDDEN",
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(herr.StatusCode)
+			w.Write(herr.JSON())
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,176 @@
+package slidingsync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func TestIPFilterClientIP(t *testing.T) {
+	f, err := NewIPFilter([]string{"10.0.0.0/8", "::1"}, nil, nil)
+	if err != nil {
+		t.Fatalf("NewIPFilter: %s", err)
+	}
+	testCases := []struct {
+		name         string
+		filter       *IPFilter
+		remoteAddr   string
+		forwardedFor []string
+		wantClientIP string
+	}{
+		{
+			name:         "direct",
+			filter:       f,
+			remoteAddr:   "203.0.113.1:1234",
+			wantClientIP: "203.0.113.1",
+		},
+		{
+			name:         "untrusted peer cannot forge X-Forwarded-For",
+			filter:       f,
+			remoteAddr:   "203.0.113.1:1234",
+			forwardedFor: []string{"198.51.100.1"},
+			wantClientIP: "203.0.113.1",
+		},
+		{
+			name:         "trusted proxy",
+			filter:       f,
+			remoteAddr:   "10.1.2.3:1234",
+			forwardedFor: []string{"198.51.100.1"},
+			wantClientIP: "198.51.100.1",
+		},
+		{
+			name:         "chain of trusted proxies",
+			filter:       f,
+			remoteAddr:   "[::1]:1234",
+			forwardedFor: []string{"192.0.2.9, 198.51.100.1, 10.0.0.2", "10.0.0.1"},
+			wantClientIP: "198.51.100.1",
+		},
+		{
+			name:         "trusted proxy without X-Forwarded-For",
+			filter:       f,
+			remoteAddr:   "10.1.2.3:1234",
+			wantClientIP: "10.1.2.3",
+		},
+		{
+			name:         "garbled hop",
+			filter:       f,
+			remoteAddr:   "10.1.2.3:1234",
+			forwardedFor: []string{"198.51.100.1, unknown"},
+			wantClientIP: "10.1.2.3",
+		},
+		{
+			name:         "nil filter trusts no proxies",
+			remoteAddr:   "10.1.2.3:1234",
+			forwardedFor: []string{"198.51.100.1"},
+			wantClientIP: "10.1.2.3",
+		},
+		{
+			name:         "unix socket",
+			remoteAddr:   "@",
+			forwardedFor: []string{"198.51.100.1"},
+			wantClientIP: "198.51.100.1",
+		},
+		{
+			name:       "unix socket without X-Forwarded-For",
+			remoteAddr: "@",
+		},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		for _, xff := range tc.forwardedFor {
+			req.Header.Add("X-Forwarded-For", xff)
+		}
+		got := tc.filter.ClientIP(req)
+		if (got == nil && tc.wantClientIP != "") || (got != nil && got.String() != tc.wantClientIP) {
+			t.Errorf("%s: ClientIP got %v want %q", tc.name, got, tc.wantClientIP)
+		}
+	}
+}
+
+func TestIPFilterAllowed(t *testing.T) {
+	testCases := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		allowed map[string]bool
+	}{
+		{
+			name:    "no lists",
+			allowed: map[string]bool{"203.0.113.1": true, "": true},
+		},
+		{
+			name:    "deny list",
+			deny:    []string{"203.0.113.0/24", "2001:db8::1"},
+			allowed: map[string]bool{"203.0.113.1": false, "198.51.100.1": true, "2001:db8::1": false, "2001:db8::2": true, "": true},
+		},
+		{
+			name:    "allow list",
+			allow:   []string{"10.0.0.0/8", "127.0.0.1"},
+			allowed: map[string]bool{"10.9.9.9": true, "127.0.0.1": true, "::ffff:127.0.0.1": true, "127.0.0.2": false, "": false},
+		},
+		{
+			name:    "deny takes precedence",
+			allow:   []string{"10.0.0.0/8"},
+			deny:    []string{"10.0.0.1"},
+			allowed: map[string]bool{"10.0.0.1": false, "10.0.0.2": true},
+		},
+	}
+	for _, tc := range testCases {
+		f, err := NewIPFilter(nil, tc.allow, tc.deny)
+		if err != nil {
+			t.Fatalf("%s: NewIPFilter: %s", tc.name, err)
+		}
+		for ip, want := range tc.allowed {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = "@"
+			if ip != "" {
+				req.RemoteAddr = "[" + ip + "]:1234"
+			}
+			if got := f.Allowed(f.ClientIP(req)); got != want {
+				t.Errorf("%s: Allowed(%q) got %v want %v", tc.name, ip, got, want)
+			}
+		}
+	}
+}
+
+func TestIPFilterInvalid(t *testing.T) {
+	for _, lists := range [][3][]string{
+		{{"10.0.0.0/33"}, nil, nil},
+		{nil, {"example.com"}, nil},
+		{nil, nil, {""}},
+	} {
+		if _, err := NewIPFilter(lists[0], lists[1], lists[2]); err == nil {
+			t.Errorf("NewIPFilter(%v): wanted an error", lists)
+		}
+	}
+}
+
+func TestIPFilterMiddleware(t *testing.T) {
+	f, err := NewIPFilter([]string{"10.0.0.1"}, nil, []string{"203.0.113.0/24"})
+	if err != nil {
+		t.Fatalf("NewIPFilter: %s", err)
+	}
+	var gotClientIP string
+	h := f.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotClientIP = internal.RequestContextClientIP(req.Context())
+		w.WriteHeader(200)
+	}))
+	for xff, wantCode := range map[string]int{"198.51.100.1": 200, "203.0.113.1": 403} {
+		gotClientIP = ""
+		req := httptest.NewRequest("GET", "/", nil)
+		req = req.WithContext(internal.RequestContext(req.Context()))
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", xff)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != wantCode {
+			t.Errorf("%s: got HTTP %d want %d: %s", xff, w.Code, wantCode, w.Body.String())
+		}
+		if wantCode == 200 && gotClientIP != xff {
+			t.Errorf("%s: request context has client IP %q", xff, gotClientIP)
+		}
+	}
+}
@@ -2,18 +2,14 @@ package pubsub
 
 import (
 	"fmt"
-	"os"
 	"sync"
 	"time"
 
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/rs/zerolog"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger("pubsub")
 
 type Payload interface {
 	// The type of payload; used mostly for logging and prometheus metrics
@@ -33,6 +29,106 @@ func (p *emptyPayload) Type() string { return emptyPayloadType }
 
 const emptyPayloadType = "empty"
 
+// DroppedPayloads is passed to listeners before the next payload on a channel when payloads have
+// been lost, e.g because the listener fell so far behind that notifying timed out. Listeners should
+// reload whatever the lost payloads were about, as they will never see those updates.
+type DroppedPayloads struct {
+	Count   int
+	Types   []string // of the lost payloads, deduplicated
+	RoomIDs []string // which the lost payloads were about, deduplicated
+	UserIDs []string // which the lost payloads were about, deduplicated
+}
+
+func (*DroppedPayloads) Type() string { return "DroppedPayloads" }
+
+func (d *DroppedPayloads) add(p Payload) {
+	d.Count++
+	d.Types = appendUnique(d.Types, p.Type())
+	roomIDs, userIDs := affectedIDs(p)
+	for _, roomID := range roomIDs {
+		d.RoomIDs = appendUnique(d.RoomIDs, roomID)
+	}
+	for _, userID := range userIDs {
+		d.UserIDs = appendUnique(d.UserIDs, userID)
+	}
+}
+
+// affectedIDs returns the rooms and users which a payload is about.
+func affectedIDs(p Payload) (roomIDs, userIDs []string) {
+	switch pl := p.(type) {
+	case *V2Initialise:
+		return []string{pl.RoomID}, nil
+	case *V2Accumulate:
+		return []string{pl.RoomID}, nil
+	case *V2TransactionID:
+		return []string{pl.RoomID}, []string{pl.UserID}
+	case *V2UnreadCounts:
+		return []string{pl.RoomID}, []string{pl.UserID}
+	case *V2AccountData:
+		return []string{pl.RoomID}, []string{pl.UserID}
+	case *V2LeaveRoom:
+		return []string{pl.RoomID}, []string{pl.UserID}
+	case *V2InviteRoom:
+		return []string{pl.RoomID}, []string{pl.UserID}
+	case *V2KnockRoom:
+		return []string{pl.RoomID}, []string{pl.UserID}
+	case *V2InitialSyncComplete:
+		return nil, []string{pl.UserID}
+	case *V2DeviceData:
+		for userID := range pl.UserIDToDeviceIDs {
+			userIDs = append(userIDs, userID)
+		}
+		return nil, userIDs
+	case *V2Typing:
+		return []string{pl.RoomID}, nil
+	case *V2TypingFlush:
+		return []string{pl.RoomID}, nil
+	case *V2Receipt:
+		for _, r := range pl.Receipts {
+			userIDs = append(userIDs, r.UserID)
+		}
+		return []string{pl.RoomID}, userIDs
+	case *V2DeviceMessages:
+		return nil, []string{pl.UserID}
+	case *V2ExpiredToken:
+		return nil, []string{pl.UserID}
+	case *V2StateRedaction:
+		return []string{pl.RoomID}, nil
+	case *V2InvalidateRoom:
+		return []string{pl.RoomID}, nil
+	case *V2StateRewind:
+		return []string{pl.RoomID}, nil
+	case *V2PurgeRoom:
+		return []string{pl.RoomID}, pl.UserIDs
+	case *V2EraseUser:
+		return pl.RoomIDs, []string{pl.UserID}
+	case *V3EnsurePolling:
+		return nil, []string{pl.UserID}
+	case *V3TokenRefreshed:
+		return nil, []string{pl.UserID}
+	}
+	return nil, nil
+}
+
+func firstOrEmpty(list []string) string {
+	if len(list) == 0 {
+		return ""
+	}
+	return list[0]
+}
+
+func appendUnique(list []string, s string) []string {
+	if s == "" {
+		return list
+	}
+	for _, existing := range list {
+		if existing == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
 // Listener represents the common functions required by all subscription listeners
 type Listener interface {
 	// Begin listening on this channel with this callback starting from this position. Blocks until Close() is called.
@@ -51,6 +147,7 @@ type Notifier interface {
 
 type PubSub struct {
 	chans      map[string]chan Payload
+	dropped    map[string]*DroppedPayloads
 	mu         *sync.Mutex
 	closed     bool
 	bufferSize int
@@ -59,6 +156,7 @@ type PubSub struct {
 func NewPubSub(bufferSize int) *PubSub {
 	return &PubSub{
 		chans:      make(map[string]chan Payload),
+		dropped:    make(map[string]*DroppedPayloads),
 		mu:         &sync.Mutex{},
 		bufferSize: bufferSize,
 	}
@@ -75,12 +173,39 @@ func (ps *PubSub) getChan(chanName string) chan Payload {
 	return ch
 }
 
+// drop records that a payload was lost, for the listener to find out about with its next payload.
+func (ps *PubSub) drop(chanName string, p Payload) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	dropped := ps.dropped[chanName]
+	if dropped == nil {
+		dropped = &DroppedPayloads{}
+		ps.dropped[chanName] = dropped
+	}
+	dropped.add(p)
+}
+
+func (ps *PubSub) takeDropped(chanName string) *DroppedPayloads {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	dropped := ps.dropped[chanName]
+	delete(ps.dropped, chanName)
+	return dropped
+}
+
 func (ps *PubSub) Notify(chanName string, p Payload) error {
+	if chanName == ChanV2 {
+		if roomIDs, _ := affectedIDs(p); internal.InjectPayloadDrop(firstOrEmpty(roomIDs)) {
+			ps.drop(chanName, p)
+			return nil
+		}
+	}
 	ch := ps.getChan(chanName)
 	select {
 	case ch <- p:
 		break
 	case <-time.After(5 * time.Second):
+		ps.drop(chanName, p)
 		return fmt.Errorf("notify with payload %v timed out", p.Type())
 	}
 	if ps.bufferSize == 0 {
@@ -109,6 +234,9 @@ func (ps *PubSub) Close() error {
 func (ps *PubSub) Listen(chanName string, fn func(p Payload)) error {
 	ch := ps.getChan(chanName)
 	for payload := range ch {
+		if dropped := ps.takeDropped(chanName); dropped != nil {
+			fn(dropped)
+		}
 		if payload.Type() == emptyPayloadType {
 			continue
 		}
@@ -147,3 +275,124 @@ func NewPromNotifier(n Notifier, subsystem string) Notifier {
 	prometheus.MustRegister(p.msgCounter)
 	return p
 }
+
+// NIDPayload is implemented by payloads which refer to events by their NID.
+type NIDPayload interface {
+	Payload
+	// LatestNID returns the highest event NID referenced by this payload.
+	LatestNID() int64
+}
+
+// LagTracker measures how far the consumer of a channel is behind the producer, in terms
+// of event NIDs. It remembers the latest NID published and the latest NID fully processed
+// for each payload type, and exposes the difference as a Prometheus gauge. Payloads which
+// do not implement NIDPayload are ignored.
+type LagTracker struct {
+	mu        *sync.Mutex
+	published map[string]int64
+	processed map[string]int64
+	lagGauge  *prometheus.GaugeVec
+}
+
+func NewLagTracker(subsystem string) *LagTracker {
+	t := &LagTracker{
+		mu:        &sync.Mutex{},
+		published: make(map[string]int64),
+		processed: make(map[string]int64),
+		lagGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: subsystem,
+			Name:      "nid_lag",
+			Help:      "Difference between the latest event NID published by pollers and the latest event NID processed by the API",
+		}, []string{"payload_type"}),
+	}
+	prometheus.MustRegister(t.lagGauge)
+	return t
+}
+
+// Lag returns the current NID lag for this payload type.
+func (t *LagTracker) Lag(payloadType string) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lag(payloadType)
+}
+
+func (t *LagTracker) lag(payloadType string) int64 {
+	lag := t.published[payloadType] - t.processed[payloadType]
+	if lag < 0 {
+		// the listener may have started consuming before we saw any publications e.g at startup
+		return 0
+	}
+	return lag
+}
+
+func (t *LagTracker) onPublished(p Payload) {
+	t.update(p, t.published)
+}
+
+func (t *LagTracker) onProcessed(p Payload) {
+	t.update(p, t.processed)
+}
+
+func (t *LagTracker) update(p Payload, positions map[string]int64) {
+	np, ok := p.(NIDPayload)
+	if !ok {
+		return
+	}
+	nid := np.LatestNID()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if nid > positions[p.Type()] {
+		positions[p.Type()] = nid
+	}
+	t.lagGauge.WithLabelValues(p.Type()).Set(float64(t.lag(p.Type())))
+}
+
+func (t *LagTracker) close() {
+	prometheus.Unregister(t.lagGauge)
+}
+
+// WrapNotifier returns a Notifier which records the NIDs of published payloads.
+func (t *LagTracker) WrapNotifier(n Notifier) Notifier {
+	return &lagNotifier{Notifier: n, tracker: t}
+}
+
+// WrapListener returns a Listener which records the NIDs of payloads once they have been processed.
+func (t *LagTracker) WrapListener(l Listener) Listener {
+	return &lagListener{Listener: l, tracker: t}
+}
+
+type lagNotifier struct {
+	Notifier
+	tracker *LagTracker
+}
+
+func (n *lagNotifier) Notify(chanName string, p Payload) error {
+	err := n.Notifier.Notify(chanName, p)
+	if err == nil {
+		n.tracker.onPublished(p)
+	}
+	return err
+}
+
+func (n *lagNotifier) Close() error {
+	n.tracker.close()
+	return n.Notifier.Close()
+}
+
+type lagListener struct {
+	Listener
+	tracker *LagTracker
+}
+
+func (l *lagListener) Listen(chanName string, fn func(p Payload)) error {
+	return l.Listener.Listen(chanName, func(p Payload) {
+		fn(p)
+		l.tracker.onProcessed(p)
+	})
+}
+
+func (l *lagListener) Close() error {
+	l.tracker.close()
+	return l.Listener.Close()
+}
@@ -0,0 +1,158 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func TestLagTracker(t *testing.T) {
+	ps := NewPubSub(10)
+	tracker := NewLagTracker("test")
+	pub := tracker.WrapNotifier(ps)
+	sub := tracker.WrapListener(ps)
+	defer pub.Close()
+
+	for _, nids := range [][]int64{{1, 2}, {5, 3}} {
+		if err := pub.Notify(ChanV2, &V2Accumulate{RoomID: "!a", EventNIDs: nids}); err != nil {
+			t.Fatalf("Notify: %s", err)
+		}
+	}
+	// payloads without NIDs are ignored
+	if err := pub.Notify(ChanV2, &V2Typing{RoomID: "!a"}); err != nil {
+		t.Fatalf("Notify: %s", err)
+	}
+	if lag := tracker.Lag("V2Accumulate"); lag != 5 {
+		t.Fatalf("lag before processing: got %d want 5", lag)
+	}
+	if lag := tracker.Lag("V2Typing"); lag != 0 {
+		t.Fatalf("V2Typing lag: got %d want 0", lag)
+	}
+
+	done := make(chan struct{})
+	var seen int
+	go func() {
+		sub.Listen(ChanV2, func(p Payload) {
+			seen++
+			if seen == 1 {
+				if lag := tracker.Lag("V2Accumulate"); lag != 5 {
+					t.Errorf("lag during first payload: got %d want 5", lag)
+				}
+			}
+			if seen == 3 {
+				close(done)
+			}
+		})
+	}()
+	<-done
+	// the 3rd payload was V2Typing so the last V2Accumulate has been fully processed
+	if lag := tracker.Lag("V2Accumulate"); lag != 0 {
+		t.Fatalf("lag after processing: got %d want 0", lag)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	ps := NewPubSub(10)
+	defer ps.Close()
+	var buf bytes.Buffer
+	recorder := NewRecorder(&buf)
+	v2Pub := recorder.WrapNotifier(ps)
+	v3Pub := recorder.WrapNotifier(ps)
+	highlights := 2
+	sent := []struct {
+		chanName string
+		payload  Payload
+	}{
+		{ChanV2, &V2Accumulate{RoomID: "!a", PrevBatch: "p", EventNIDs: []int64{1, 2}, Gappy: true}},
+		{ChanV3, &V3EnsurePolling{UserID: "@a", DeviceID: "A", AccessTokenHash: "hash"}},
+		{ChanV2, &V2UnreadCounts{UserID: "@a", RoomID: "!a", HighlightCount: &highlights}},
+		{ChanV2, &V2Typing{RoomID: "!a", EphemeralEvent: json.RawMessage(`{"type":"m.typing"}`)}},
+	}
+	for _, s := range sent {
+		pub := v2Pub
+		if s.chanName == ChanV3 {
+			pub = v3Pub
+		}
+		if err := pub.Notify(s.chanName, s.payload); err != nil {
+			t.Fatalf("Notify: %s", err)
+		}
+	}
+
+	i := 0
+	err := ReadRecording(&buf, func(rec *RecordedPayload, p Payload) error {
+		if i >= len(sent) {
+			t.Fatalf("recording has more than %d payloads", len(sent))
+		}
+		if rec.Chan != sent[i].chanName {
+			t.Errorf("payload %d: got chan %s want %s", i, rec.Chan, sent[i].chanName)
+		}
+		if rec.Time.IsZero() {
+			t.Errorf("payload %d: no timestamp", i)
+		}
+		if !reflect.DeepEqual(p, sent[i].payload) {
+			t.Errorf("payload %d: got %+v want %+v", i, p, sent[i].payload)
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadRecording: %s", err)
+	}
+	if i != len(sent) {
+		t.Fatalf("got %d payloads want %d", i, len(sent))
+	}
+
+	err = ReadRecording(bytes.NewBufferString(`{"chan":"v2ch","type":"V9Unknown","payload":{}}`+"\n"), func(*RecordedPayload, Payload) error {
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("ReadRecording with an unknown payload type: got no error")
+	}
+}
+
+func TestDroppedPayloads(t *testing.T) {
+	internal.EnableFaultInjection()
+	if err := internal.SetFaults(internal.Faults{DropPayloads: 2, DropPayloadsRoomID: "!b"}); err != nil {
+		t.Fatalf("SetFaults: %s", err)
+	}
+	defer internal.SetFaults(internal.Faults{})
+	// synchronous, so each payload is processed before Notify returns
+	ps := NewPubSub(0)
+	defer ps.Close()
+	var got []Payload
+	go ps.Listen(ChanV2, func(p Payload) {
+		got = append(got, p)
+	})
+
+	sent := []Payload{
+		&V2Accumulate{RoomID: "!a", EventNIDs: []int64{1}},
+		&V2Accumulate{RoomID: "!b", EventNIDs: []int64{2}},
+		&V2UnreadCounts{RoomID: "!b", UserID: "@alice"},
+		&V2Accumulate{RoomID: "!b", EventNIDs: []int64{3}},
+	}
+	for _, p := range sent {
+		if err := ps.Notify(ChanV2, p); err != nil {
+			t.Fatalf("Notify: %s", err)
+		}
+	}
+	// the listener finds out about the dropped payloads when it receives the next one
+	want := []Payload{
+		sent[0],
+		&DroppedPayloads{
+			Count:   2,
+			Types:   []string{"V2Accumulate", "V2UnreadCounts"},
+			RoomIDs: []string{"!b"},
+			UserIDs: []string{"@alice"},
+		},
+		sent[3],
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v want %+v", got, want)
+	}
+	if faults := internal.CurrentFaults(); faults.DropPayloads != 0 {
+		t.Fatalf("DropPayloads after dropping: got %d want 0", faults.DropPayloads)
+	}
+}
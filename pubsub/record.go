@@ -0,0 +1,140 @@
+package pubsub
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// RecordedPayload is a line of a recording made by a Recorder.
+type RecordedPayload struct {
+	Time    time.Time       `json:"ts"`
+	Chan    string          `json:"chan"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// payloadTypes makes an empty payload for each type, so recorded payloads can be decoded.
+var payloadTypes = map[string]func() Payload{
+	(&V2Initialise{}).Type():          func() Payload { return &V2Initialise{} },
+	(&V2Accumulate{}).Type():          func() Payload { return &V2Accumulate{} },
+	(&V2TransactionID{}).Type():       func() Payload { return &V2TransactionID{} },
+	(&V2UnreadCounts{}).Type():        func() Payload { return &V2UnreadCounts{} },
+	(&V2AccountData{}).Type():         func() Payload { return &V2AccountData{} },
+	(&V2LeaveRoom{}).Type():           func() Payload { return &V2LeaveRoom{} },
+	(&V2InviteRoom{}).Type():          func() Payload { return &V2InviteRoom{} },
+	(&V2KnockRoom{}).Type():           func() Payload { return &V2KnockRoom{} },
+	(&V2InitialSyncComplete{}).Type(): func() Payload { return &V2InitialSyncComplete{} },
+	(&V2DeviceData{}).Type():          func() Payload { return &V2DeviceData{} },
+	(&V2Typing{}).Type():              func() Payload { return &V2Typing{} },
+	(&V2TypingFlush{}).Type():         func() Payload { return &V2TypingFlush{} },
+	(&V2Receipt{}).Type():             func() Payload { return &V2Receipt{} },
+	(&V2DeviceMessages{}).Type():      func() Payload { return &V2DeviceMessages{} },
+	(&V2ExpiredToken{}).Type():        func() Payload { return &V2ExpiredToken{} },
+	(&V2StateRedaction{}).Type():      func() Payload { return &V2StateRedaction{} },
+	(&V2InvalidateRoom{}).Type():      func() Payload { return &V2InvalidateRoom{} },
+	(&V2StateRewind{}).Type():         func() Payload { return &V2StateRewind{} },
+	(&V2PurgeRoom{}).Type():           func() Payload { return &V2PurgeRoom{} },
+	(&V2EraseUser{}).Type():           func() Payload { return &V2EraseUser{} },
+	(&V2Pong{}).Type():                func() Payload { return &V2Pong{} },
+	(&V3EnsurePolling{}).Type():       func() Payload { return &V3EnsurePolling{} },
+	(&V3Ping{}).Type():                func() Payload { return &V3Ping{} },
+	(&V3TokenRefreshed{}).Type():      func() Payload { return &V3TokenRefreshed{} },
+}
+
+// Decode returns the recorded payload as its original type.
+func (r *RecordedPayload) Decode() (Payload, error) {
+	newPayload, ok := payloadTypes[r.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown payload type %s", r.Type)
+	}
+	p := newPayload()
+	if err := json.Unmarshal(r.Payload, p); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", r.Type, err)
+	}
+	return p, nil
+}
+
+// Recorder writes every payload sent through the Notifiers it wraps to a file, one JSON object per
+// line, so that it can be replayed later with ReadRecording. Payloads are written in the order they
+// are sent, without buffering, so the recording is complete even if the process crashes.
+type Recorder struct {
+	mu     *sync.Mutex
+	enc    *json.Encoder
+	failed bool
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{
+		mu:  &sync.Mutex{},
+		enc: json.NewEncoder(w),
+	}
+}
+
+// WrapNotifier returns a Notifier which records payloads once they have been sent. Sending is
+// serialised with recording, so the recording has the same order as the channel, at the cost of
+// notifiers no longer sending in parallel.
+func (r *Recorder) WrapNotifier(n Notifier) Notifier {
+	return &recordingNotifier{Notifier: n, recorder: r}
+}
+
+func (r *Recorder) record(chanName string, p Payload) {
+	if r.failed {
+		return
+	}
+	payload, err := json.Marshal(p)
+	if err == nil {
+		err = r.enc.Encode(RecordedPayload{
+			Time:    time.Now(),
+			Chan:    chanName,
+			Type:    p.Type(),
+			Payload: payload,
+		})
+	}
+	if err != nil {
+		// a gap would make the recording misleading, so stop recording entirely
+		logger.Err(err).Str("type", p.Type()).Msg("Recorder: failed to record payload, recording stopped")
+		r.failed = true
+	}
+}
+
+type recordingNotifier struct {
+	Notifier
+	recorder *Recorder
+}
+
+func (n *recordingNotifier) Notify(chanName string, p Payload) error {
+	n.recorder.mu.Lock()
+	defer n.recorder.mu.Unlock()
+	err := n.Notifier.Notify(chanName, p)
+	if err == nil {
+		n.recorder.record(chanName, p)
+	}
+	return err
+}
+
+// ReadRecording calls fn with each payload in a recording made by a Recorder, in the order they
+// were sent. Stops at the first error, including errors returned by fn.
+func ReadRecording(r io.Reader, fn func(rec *RecordedPayload, p Payload) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024) // device data and receipts can be large
+	line := 0
+	for scanner.Scan() {
+		line++
+		var rec RecordedPayload
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		p, err := rec.Decode()
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err = fn(&rec, p); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -16,16 +16,23 @@ type V2Listener interface {
 	OnTransactionID(p *V2TransactionID)
 	OnAccountData(p *V2AccountData)
 	OnInvite(p *V2InviteRoom)
+	OnKnock(p *V2KnockRoom)
 	OnLeftRoom(p *V2LeaveRoom)
 	OnUnreadCounts(p *V2UnreadCounts)
 	OnInitialSyncComplete(p *V2InitialSyncComplete)
 	OnDeviceData(p *V2DeviceData)
 	OnTyping(p *V2Typing)
+	OnTypingFlush(p *V2TypingFlush)
 	OnReceipt(p *V2Receipt)
 	OnDeviceMessages(p *V2DeviceMessages)
 	OnExpiredToken(p *V2ExpiredToken)
 	OnInvalidateRoom(p *V2InvalidateRoom)
+	OnStateRewind(p *V2StateRewind)
 	OnStateRedaction(p *V2StateRedaction)
+	OnPurgeRoom(p *V2PurgeRoom)
+	OnEraseUser(p *V2EraseUser)
+	OnPong(p *V2Pong)
+	OnDroppedPayloads(p *DroppedPayloads)
 }
 
 type V2Initialise struct {
@@ -39,10 +46,22 @@ type V2Accumulate struct {
 	RoomID    string
 	PrevBatch string
 	EventNIDs []int64
+	// Gappy is true if the poller saw a limited timeline whose first event was previously
+	// unknown, so there may be events missing before these ones.
+	Gappy bool
 }
 
 func (*V2Accumulate) Type() string { return "V2Accumulate" }
 
+func (p *V2Accumulate) LatestNID() (nid int64) {
+	for _, n := range p.EventNIDs {
+		if n > nid {
+			nid = n
+		}
+	}
+	return
+}
+
 // V2TransactionID is emitted by a poller when it sees an event with a transaction ID,
 // or when it is certain that no other poller will see a transaction ID for this event
 // (the "all-clear").
@@ -57,6 +76,8 @@ type V2TransactionID struct {
 
 func (*V2TransactionID) Type() string { return "V2TransactionID" }
 
+func (p *V2TransactionID) LatestNID() int64 { return p.NID }
+
 type V2UnreadCounts struct {
 	UserID            string
 	RoomID            string
@@ -89,6 +110,13 @@ type V2InviteRoom struct {
 
 func (*V2InviteRoom) Type() string { return "V2InviteRoom" }
 
+type V2KnockRoom struct {
+	UserID string
+	RoomID string
+}
+
+func (*V2KnockRoom) Type() string { return "V2KnockRoom" }
+
 type V2InitialSyncComplete struct {
 	UserID   string
 	DeviceID string
@@ -110,6 +138,14 @@ type V2Typing struct {
 
 func (*V2Typing) Type() string { return "V2Typing" }
 
+// V2TypingFlush is emitted when a room's typing coalescing window ends, so the coalesced typing
+// notification is published on the same goroutine as every other V2 payload.
+type V2TypingFlush struct {
+	RoomID string
+}
+
+func (*V2TypingFlush) Type() string { return "V2TypingFlush" }
+
 type V2Receipt struct {
 	RoomID   string
 	Receipts []internal.Receipt
@@ -127,6 +163,9 @@ func (*V2DeviceMessages) Type() string { return "V2DeviceMessages" }
 type V2ExpiredToken struct {
 	UserID   string
 	DeviceID string
+	// SoftLogout is set if the device is still logged in and the client is expected to carry on
+	// with a refreshed access token (MSC2918), so its conns should be kept.
+	SoftLogout bool
 }
 
 func (*V2ExpiredToken) Type() string { return "V2ExpiredToken" }
@@ -148,6 +187,40 @@ type V2InvalidateRoom struct {
 
 func (*V2InvalidateRoom) Type() string { return "V2InvalidateRoom" }
 
+// V2StateRewind is emitted when a state block puts older, already known events back in place of
+// the room's current state, e.g. after a state reset. The room's current snapshot has been
+// rewritten, so derived data for the room should be reloaded.
+type V2StateRewind struct {
+	RoomID string
+}
+
+func (*V2StateRewind) Type() string { return "V2StateRewind" }
+
+// V2PurgeRoom is emitted after all data for a room has been deleted from the database.
+type V2PurgeRoom struct {
+	RoomID string
+	// The users who had a membership in the room before it was purged.
+	UserIDs []string
+}
+
+func (*V2PurgeRoom) Type() string { return "V2PurgeRoom" }
+
+// V2EraseUser is emitted after a user's profile data and receipts have been erased from the database.
+type V2EraseUser struct {
+	UserID string
+	// The rooms in which the user's membership events were modified.
+	RoomIDs []string
+}
+
+func (*V2EraseUser) Type() string { return "V2EraseUser" }
+
+// V2Pong is emitted in response to a V3Ping.
+type V2Pong struct {
+	ID int64
+}
+
+func (*V2Pong) Type() string { return "V2Pong" }
+
 type V2Sub struct {
 	listener Listener
 	receiver V2Listener
@@ -178,6 +251,8 @@ func (v *V2Sub) onMessage(p Payload) {
 		v.receiver.OnAccountData(pl)
 	case *V2InviteRoom:
 		v.receiver.OnInvite(pl)
+	case *V2KnockRoom:
+		v.receiver.OnKnock(pl)
 	case *V2LeaveRoom:
 		v.receiver.OnLeftRoom(pl)
 	case *V2UnreadCounts:
@@ -188,14 +263,26 @@ func (v *V2Sub) onMessage(p Payload) {
 		v.receiver.OnDeviceData(pl)
 	case *V2Typing:
 		v.receiver.OnTyping(pl)
+	case *V2TypingFlush:
+		v.receiver.OnTypingFlush(pl)
 	case *V2DeviceMessages:
 		v.receiver.OnDeviceMessages(pl)
 	case *V2ExpiredToken:
 		v.receiver.OnExpiredToken(pl)
 	case *V2InvalidateRoom:
 		v.receiver.OnInvalidateRoom(pl)
+	case *V2StateRewind:
+		v.receiver.OnStateRewind(pl)
 	case *V2StateRedaction:
 		v.receiver.OnStateRedaction(pl)
+	case *V2PurgeRoom:
+		v.receiver.OnPurgeRoom(pl)
+	case *V2EraseUser:
+		v.receiver.OnEraseUser(pl)
+	case *DroppedPayloads:
+		v.receiver.OnDroppedPayloads(pl)
+	case *V2Pong:
+		v.receiver.OnPong(pl)
 	default:
 		logger.Warn().Str("type", p.Type()).Msg("V2Sub: unhandled payload type")
 	}
@@ -6,6 +6,8 @@ const ChanV3 = "v3ch"
 // V3Listener describes the messages that incoming sliding sync requests will publish.
 type V3Listener interface {
 	EnsurePolling(p *V3EnsurePolling)
+	OnPing(p *V3Ping)
+	OnTokenRefreshed(p *V3TokenRefreshed)
 }
 
 type V3EnsurePolling struct {
@@ -18,6 +20,24 @@ type V3EnsurePolling struct {
 
 func (*V3EnsurePolling) Type() string { return "V3EnsurePolling" }
 
+// V3Ping is used by health checks to verify that messages are making a round-trip between the
+// API and the pollers. It should be answered with a V2Pong with the same ID.
+type V3Ping struct {
+	ID int64
+}
+
+func (*V3Ping) Type() string { return "V3Ping" }
+
+// V3TokenRefreshed is sent when a client uses a new access token for a device which already has
+// one, e.g because it refreshed its token. A running poller for the device should switch to it.
+type V3TokenRefreshed struct {
+	UserID          string
+	DeviceID        string
+	AccessTokenHash string
+}
+
+func (*V3TokenRefreshed) Type() string { return "V3TokenRefreshed" }
+
 type V3Sub struct {
 	listener Listener
 	receiver V3Listener
@@ -38,6 +58,13 @@ func (v *V3Sub) onMessage(p Payload) {
 	switch pl := p.(type) {
 	case *V3EnsurePolling:
 		v.receiver.EnsurePolling(pl)
+	case *V3Ping:
+		v.receiver.OnPing(pl)
+	case *V3TokenRefreshed:
+		v.receiver.OnTokenRefreshed(pl)
+	case *DroppedPayloads:
+		// the pollers have no way of knowing what was asked of them, so all we can do is log it
+		logger.Error().Int("count", pl.Count).Strs("types", pl.Types).Strs("users", pl.UserIDs).Msg("V3Sub: payloads were dropped")
 	default:
 		logger.Warn().Str("type", p.Type()).Msg("V3Sub: unhandled payload type")
 	}
@@ -2,25 +2,97 @@ package sqlutil
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
-	"github.com/matrix-org/sliding-sync/internal"
-	"github.com/rs/zerolog"
-	"os"
+	"math/rand"
 	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var logger = internal.NewLogger("sqlutil")
+
+var (
+	queryDurations      *prometheus.HistogramVec
+	registerMetricsOnce sync.Once
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+// RegisterMetrics registers the per-query metrics recorded by the named query helpers, e.g
+// SelectContext. Until this is called, no metrics are recorded. Safe to call multiple times.
+func RegisterMetrics() {
+	registerMetricsOnce.Do(func() {
+		queryDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "db",
+			Name:      "query_duration_secs",
+			Help:      "Time taken in seconds to execute named database queries.",
+			Buckets:   []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		}, []string{"query", "outcome"})
+		prometheus.MustRegister(queryDurations)
+	})
+}
+
+func observeQuery(ctx context.Context, name string, start time.Time, err error) {
+	if queryDurations == nil {
+		return
+	}
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+		if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+			outcome = "cancelled"
+		}
+	}
+	queryDurations.WithLabelValues(name, outcome).Observe(time.Since(start).Seconds())
+}
+
+// SelectContext is sqlx.SelectContext which records the time taken under the given query name.
+// The query is cancelled if the context is cancelled.
+func SelectContext(ctx context.Context, q sqlx.QueryerContext, name string, dest interface{}, query string, args ...interface{}) error {
+	start := time.Now()
+	err := sqlx.SelectContext(ctx, q, dest, query, args...)
+	observeQuery(ctx, name, start, err)
+	return err
+}
+
+// GetContext is sqlx.GetContext which records the time taken under the given query name.
+// The query is cancelled if the context is cancelled.
+func GetContext(ctx context.Context, q sqlx.QueryerContext, name string, dest interface{}, query string, args ...interface{}) error {
+	start := time.Now()
+	err := sqlx.GetContext(ctx, q, dest, query, args...)
+	observeQuery(ctx, name, start, err)
+	return err
+}
+
+// ExecContext is sqlx.ExecerContext.ExecContext which records the time taken under the given query name.
+// The statement is cancelled if the context is cancelled.
+func ExecContext(ctx context.Context, e sqlx.ExecerContext, name string, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	res, err := e.ExecContext(ctx, query, args...)
+	observeQuery(ctx, name, start, err)
+	return res, err
+}
 
 // WithTransaction runs a block of code passing in an SQL transaction
 // If the code returns an error or panics then the transactions is rolled back
 // Otherwise the transaction is committed.
 func WithTransaction(db *sqlx.DB, fn func(txn *sqlx.Tx) error) (err error) {
-	txn, err := db.Beginx()
+	return WithTransactionContext(context.Background(), db, fn)
+}
+
+// WithTransactionContext is WithTransaction, but the transaction is bound to the context. If the
+// context is cancelled, e.g because the client disconnected, the transaction is rolled back and
+// any further queries in it fail.
+func WithTransactionContext(ctx context.Context, db *sqlx.DB, fn func(txn *sqlx.Tx) error) (err error) {
+	internal.InjectDBLatency()
+	txn, err := db.BeginTxx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("WithTransaction.Begin: %w", err)
 	}
@@ -28,8 +100,6 @@ func WithTransaction(db *sqlx.DB, fn func(txn *sqlx.Tx) error) (err error) {
 	defer func() {
 		panicErr := recover()
 		if err == nil && panicErr != nil {
-			// TODO: thread a context through to here?
-			ctx := context.Background()
 			logger.Error().Msg(string(debug.Stack()))
 			internal.GetSentryHubFromContextOrDefault(ctx).RecoverWithContext(ctx, panicErr)
 			err = fmt.Errorf("panic: %v", panicErr)
@@ -49,6 +119,40 @@ func WithTransaction(db *sqlx.DB, fn func(txn *sqlx.Tx) error) (err error) {
 	return
 }
 
+// The maximum number of times WithRetryingTransaction will run a transaction.
+const maxTransactionAttempts = 5
+
+// The backoff before retrying a transaction for the first time. This doubles with each attempt.
+const transactionRetryBackoff = 20 * time.Millisecond
+
+// isTransientError returns true if the error is a serialization failure or deadlock, which
+// postgres expects clients to handle by retrying the transaction.
+func isTransientError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	return pqErr.Code == "40001" || pqErr.Code == "40P01" // serialization_failure, deadlock_detected
+}
+
+// WithRetryingTransaction is like WithTransaction, but reruns the whole transaction if it fails
+// with a serialization failure or deadlock, e.g because concurrent pollers are writing to the same
+// room. fn may be called multiple times, so it must not have side effects outside of the transaction
+// which depend on it being called once.
+func WithRetryingTransaction(db *sqlx.DB, fn func(txn *sqlx.Tx) error) (err error) {
+	backoff := transactionRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err = WithTransaction(db, fn)
+		if err == nil || attempt >= maxTransactionAttempts || !isTransientError(err) {
+			return err
+		}
+		logger.Warn().Err(err).Int("attempt", attempt).Msg("retrying transaction after transient error")
+		// jitter so that the transactions which conflicted don't retry in lockstep
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+		backoff *= 2
+	}
+}
+
 type Chunker interface {
 	Len() int
 	Subslice(i, j int) Chunker
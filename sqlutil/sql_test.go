@@ -0,0 +1,29 @@
+package sqlutil
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestIsTransientError(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want bool
+	}{
+		{err: &pq.Error{Code: "40001"}, want: true},
+		{err: &pq.Error{Code: "40P01"}, want: true},
+		{err: fmt.Errorf("failed to insert events: %w", &pq.Error{Code: "40001"}), want: true},
+		{err: fmt.Errorf("WithTransaction failed to commit/rollback: %w", &pq.Error{Code: "40P01"}), want: true},
+		{err: &pq.Error{Code: "23505"}, want: false}, // unique_violation
+		{err: errors.New("40001"), want: false},
+		{err: nil, want: false},
+	}
+	for _, tc := range testCases {
+		if got := isTransientError(tc.err); got != tc.want {
+			t.Errorf("isTransientError(%v): got %v want %v", tc.err, got, tc.want)
+		}
+	}
+}
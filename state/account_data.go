@@ -88,6 +88,14 @@ func (t *AccountDataTable) SelectMany(txn *sqlx.Tx, userID string, roomIDs ...st
 	return
 }
 
+// SelectSince returns all account data for this user, global and for rooms, which was added or
+// updated after the position `since`, in the order it was last updated.
+func (t *AccountDataTable) SelectSince(txn *sqlx.Tx, userID string, since int64) (datas []AccountData, err error) {
+	err = txn.Select(&datas, `SELECT id, user_id, room_id, type, data FROM syncv3_account_data
+	WHERE user_id=$1 AND id > $2 ORDER BY id`, userID, since)
+	return
+}
+
 type AccountDataChunker []AccountData
 
 func (c AccountDataChunker) Len() int {
@@ -207,6 +207,10 @@ func TestAccountDataIDIncrements(t *testing.T) {
 	gots, err = table.SelectMany(txn, alice, roomA)
 	assertNoError(t, err)
 	assertAccountDatasEqual(t, "SelectMany", gots, []AccountData{data})
+	gots, err = table.SelectSince(txn, alice, data.ID-1)
+	assertNoError(t, err)
+	assertAccountDatasEqual(t, "SelectSince", gots, []AccountData{data})
+	previousID := data.ID
 	// now replace the data, which should update the id
 	data.Data = []byte(`{"foo":"bar2"}`)
 	_, err = table.Insert(txn, []AccountData{
@@ -226,4 +230,11 @@ func TestAccountDataIDIncrements(t *testing.T) {
 	gots, err = table.SelectWithType(txn, alice, eventType)
 	assertNoError(t, err)
 	assertAccountDatasEqual(t, "SelectWithType", gots, []AccountData{data})
+	// only the replaced data is returned since its previous position
+	gots, err = table.SelectSince(txn, alice, previousID)
+	assertNoError(t, err)
+	assertAccountDatasEqual(t, "SelectSince", gots, []AccountData{data})
+	gots, err = table.SelectSince(txn, alice, data.ID)
+	assertNoError(t, err)
+	assertAccountDatasEqual(t, "SelectSince", gots, nil)
 }
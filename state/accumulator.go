@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync2"
@@ -23,24 +24,34 @@ import (
 // Accumulate function for timeline events. v2 sync must be called with a large enough timeline.limit
 // for this to work!
 type Accumulator struct {
-	db            *sqlx.DB
-	roomsTable    *RoomsTable
-	eventsTable   *EventTable
-	snapshotTable *SnapshotTable
-	spacesTable   *SpacesTable
-	invitesTable  *InvitesTable
-	entityName    string
+	db               *sqlx.DB
+	roomsTable       *RoomsTable
+	eventsTable      *EventTable
+	snapshotTable    *SnapshotTable
+	spacesTable      *SpacesTable
+	invitesTable     *InvitesTable
+	knocksTable      *KnocksTable
+	leavesTable      *UserLeavesTable
+	membershipsTable *UserMembershipsTable
+	quarantineTable  *QuarantineTable
+	relationsTable   *RelationsTable
+	entityName       string
 }
 
 func NewAccumulator(db *sqlx.DB) *Accumulator {
 	return &Accumulator{
-		db:            db,
-		roomsTable:    NewRoomsTable(db),
-		eventsTable:   NewEventTable(db),
-		snapshotTable: NewSnapshotsTable(db),
-		spacesTable:   NewSpacesTable(db),
-		invitesTable:  NewInvitesTable(db),
-		entityName:    "server",
+		db:               db,
+		roomsTable:       NewRoomsTable(db),
+		eventsTable:      NewEventTable(db),
+		snapshotTable:    NewSnapshotsTable(db),
+		spacesTable:      NewSpacesTable(db),
+		invitesTable:     NewInvitesTable(db),
+		knocksTable:      NewKnocksTable(db),
+		leavesTable:      NewUserLeavesTable(db),
+		membershipsTable: NewUserMembershipsTable(db),
+		quarantineTable:  NewQuarantineTable(db),
+		relationsTable:   NewRelationsTable(db),
+		entityName:       "server",
 	}
 }
 
@@ -106,6 +117,7 @@ func (a *Accumulator) roomInfoDelta(roomID string, events []Event) RoomInfo {
 	var upgradedRoomID *string
 	var roomType *string
 	var pred *string
+	var name, canonicalAlias *string
 	for _, ev := range events {
 		if ev.Type == "m.room.encryption" && ev.StateKey == "" {
 			isEncrypted = true
@@ -116,6 +128,15 @@ func (a *Accumulator) roomInfoDelta(roomID string, events []Event) RoomInfo {
 				upgradedRoomID = &contentType.Str
 			}
 		}
+		if ev.Type == "m.room.name" && ev.StateKey == "" {
+			// an empty or missing name removes the room name
+			roomName := gjson.GetBytes(ev.JSON, "content.name").Str
+			name = &roomName
+		}
+		if ev.Type == "m.room.canonical_alias" && ev.StateKey == "" {
+			alias := gjson.GetBytes(ev.JSON, "content.alias").Str
+			canonicalAlias = &alias
+		}
 		if ev.Type == "m.room.create" && ev.StateKey == "" {
 			contentType := gjson.GetBytes(ev.JSON, "content.type")
 			if contentType.Exists() && contentType.Type == gjson.String {
@@ -134,6 +155,8 @@ func (a *Accumulator) roomInfoDelta(roomID string, events []Event) RoomInfo {
 		UpgradedRoomID:    upgradedRoomID,
 		Type:              roomType,
 		PredecessorRoomID: pred,
+		Name:              name,
+		CanonicalAlias:    canonicalAlias,
 	}
 }
 
@@ -146,6 +169,11 @@ type InitialiseResult struct {
 	// ReplacedExistingSnapshot is true when we created a new snapshot for the room and
 	// there a pre-existing room snapshot. It has no meaning if AddedEvents is false.
 	ReplacedExistingSnapshot bool
+	// RewoundState is true when the state block only contained events we already knew about,
+	// but at least one of them replaced a newer event in the room's current state, e.g. after a
+	// state reset. A new snapshot with the older events is stored as the room's current state
+	// (SnapshotID), and anything derived from the old snapshot should be reloaded.
+	RewoundState bool
 }
 
 // Initialise processes the state block of a V2 sync response for a particular room. If
@@ -178,6 +206,10 @@ type InitialiseResult struct {
 //
 //  6. Return an "AddedEvents" bool (if true, emit an Initialise payload) and a
 //     "ReplacedSnapshot" bool (if true, emit a cache invalidation payload).
+//
+// If no events were new in (2), we instead check whether the state block puts older events back
+// in place of the room's current state. If it does, steps 3-5 are run with those events and a
+// "RewoundState" bool is returned (if true, emit a state rewind payload).
 
 func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (InitialiseResult, error) {
 	var res InitialiseResult
@@ -187,7 +219,9 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 	if len(state) == 0 {
 		return res, nil
 	}
-	err := sqlutil.WithTransaction(a.db, func(txn *sqlx.Tx) (err error) {
+	err := sqlutil.WithRetryingTransaction(a.db, func(txn *sqlx.Tx) (err error) {
+		// forget anything set by a previous attempt which was rolled back
+		res = InitialiseResult{}
 		// 1. Capture the current snapshot ID, checking for a create event if this is our first snapshot.
 
 		// Attempt to short-circuit. This has to be done inside a transaction to make sure
@@ -205,9 +239,15 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 				IsState: true,
 			}
 		}
-		events = filterAndEnsureFieldsSet(events)
+		events, rejected := filterAndEnsureFieldsSet(events)
+		if err = a.quarantineTable.Insert(txn, rejected); err != nil {
+			return fmt.Errorf("failed to quarantine malformed state events: %w", err)
+		}
 		if len(events) == 0 {
-			return fmt.Errorf("failed to parse state block, all events were filtered out: %w", err)
+			logger.Warn().Str("room_id", roomID).Int("quarantined", len(rejected)).Msg(
+				"Accumulator.Initialise: all events in the state block were malformed, doing nothing",
+			)
+			return nil
 		}
 
 		if startingSnapshotID == 0 {
@@ -222,6 +262,7 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 		if err != nil {
 			return fmt.Errorf("failed to insert events: %w", err)
 		}
+		newEvents := make([]Event, 0, len(newEventIDToNID))
 		if len(newEventIDToNID) == 0 {
 			if startingSnapshotID == 0 {
 				// we don't have a current snapshot for this room but yet no events are new,
@@ -230,14 +271,22 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 				logger.Error().Str("room_id", roomID).Msg(errMsg)
 				sentry.CaptureException(fmt.Errorf(errMsg))
 			}
-			// Note: we otherwise ignore cases where the state has only changed to a
-			// known subset of state events (i.e in the case of state resets, slow
-			// pollers) as it is impossible to then reconcile that state with
-			// any new events, as any "catchup" state will be ignored due to the events
-			// already existing.
-			return nil
+			if startingSnapshotID == 0 {
+				return nil
+			}
+			// The state block only contains events we already know about. Usually this is because
+			// another poller has already told us about them, but if the state block puts an older
+			// event back in place of the current one, the room's state has been rewound (e.g a state
+			// reset) and we need to rewrite the snapshot so it matches.
+			newEvents, err = a.rewoundStateEvents(txn, startingSnapshotID, events)
+			if err != nil {
+				return fmt.Errorf("failed to compare state block to current state: %w", err)
+			}
+			if len(newEvents) == 0 {
+				return nil
+			}
+			res.RewoundState = true
 		}
-		newEvents := make([]Event, 0, len(newEventIDToNID))
 		for _, event := range events {
 			newNid, isNew := newEventIDToNID[event.ID]
 			if isNew {
@@ -275,7 +324,7 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 		if err != nil {
 			return fmt.Errorf("failed to insert snapshot: %w", err)
 		}
-		res.AddedEvents = true
+		res.AddedEvents = !res.RewoundState
 
 		// 5. Any other processing of new state events.
 		latestNID := int64(0)
@@ -293,11 +342,18 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 		if err = a.invitesTable.RemoveSupersededInvites(txn, roomID, events); err != nil {
 			return fmt.Errorf("RemoveSupersededInvites: %w", err)
 		}
+		if err = a.knocksTable.RemoveSupersededKnocks(txn, roomID, events); err != nil {
+			return fmt.Errorf("RemoveSupersededKnocks: %w", err)
+		}
 
 		if err = a.spacesTable.HandleSpaceUpdates(txn, events); err != nil {
 			return fmt.Errorf("HandleSpaceUpdates: %s", err)
 		}
 
+		if err = a.membershipsTable.Update(txn, newEvents); err != nil {
+			return fmt.Errorf("failed to update memberships: %w", err)
+		}
+
 		// check for metadata events
 		info := a.roomInfoDelta(roomID, events)
 
@@ -313,8 +369,10 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 
 		// 6. Tell the caller what happened, so they know what payloads to emit.
 		res.SnapshotID = snapshot.SnapshotID
-		res.AddedEvents = true
-		res.ReplacedExistingSnapshot = startingSnapshotID > 0
+		if !res.RewoundState {
+			res.AddedEvents = true
+			res.ReplacedExistingSnapshot = startingSnapshotID > 0
+		}
 		return nil
 	})
 	return res, err
@@ -330,6 +388,16 @@ type AccumulateResult struct {
 	// IncludesStateRedaction is set to true when we have accumulated a redaction to a
 	// piece of room state.
 	IncludesStateRedaction bool
+	// ChangedState is set to true when new state events or redactions were accumulated,
+	// so previously loaded room state may be out of date.
+	ChangedState bool
+	// NumDuplicates is the number of events which the homeserver sent more than once in the same
+	// timeline. They are dropped. Events the proxy already has are not counted, as every poller for
+	// a room sees the same events.
+	NumDuplicates int
+	// Gappy is set to true when the timeline was limited and its first event was inserted
+	// by this call, i.e. the first event is marked as missing_previous.
+	Gappy bool
 }
 
 // Accumulate internal state from a user's sync response. The timeline order MUST be in the order
@@ -349,14 +417,21 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 	// - there to be no duplicate events
 	// - if there are new events, they are always new.
 	// Both of these assumptions can be false for different reasons
-	incomingEvents := parseAndDeduplicateTimelineEvents(roomID, timeline)
+	incomingEvents, numDuplicates, rejected := parseAndDeduplicateTimelineEvents(roomID, timeline)
+	if err := a.quarantineTable.Insert(txn, rejected); err != nil {
+		return AccumulateResult{}, fmt.Errorf("failed to quarantine malformed timeline events: %w", err)
+	}
 	newEvents, err := a.filterToNewTimelineEvents(txn, incomingEvents)
 	if err != nil {
 		err = fmt.Errorf("filterTimelineEvents: %w", err)
 		return AccumulateResult{}, err
 	}
 	if len(newEvents) == 0 {
-		return AccumulateResult{}, nil // nothing to do
+		// another poller may have stored this user's leave event before this user's poller saw it
+		if err = a.trackOwnMembership(txn, userID, roomID, incomingEvents); err != nil {
+			return AccumulateResult{}, fmt.Errorf("trackOwnMembership: %w", err)
+		}
+		return AccumulateResult{NumDuplicates: numDuplicates}, nil // nothing to do
 	}
 
 	// If this timeline was limited and we don't recognise its first event E, mark it
@@ -366,8 +441,9 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 	// If so, E will be present in the DB and marked as not missing_previous. This will
 	// remain the case as the upsert of E to the events table has ON CONFLICT DO
 	// NOTHING.
+	firstTimelineEventUnknown := false
 	if timeline.Limited {
-		firstTimelineEventUnknown := newEvents[0].ID == incomingEvents[0].ID
+		firstTimelineEventUnknown = newEvents[0].ID == incomingEvents[0].ID
 		incomingEvents[0].MissingPrevious = firstTimelineEventUnknown
 	}
 
@@ -433,7 +509,12 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 	}
 
 	result := AccumulateResult{
-		NumNew: len(eventIDToNID),
+		NumNew:        len(eventIDToNID),
+		NumDuplicates: numDuplicates,
+	}
+	if firstTimelineEventUnknown {
+		// another poller may have inserted the first event since we checked
+		_, result.Gappy = eventIDToNID[incomingEvents[0].ID]
 	}
 
 	var latestNID int64
@@ -472,6 +553,10 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 		}
 	}
 
+	if err = a.relationsTable.Insert(txn, postInsertEvents); err != nil {
+		return AccumulateResult{}, fmt.Errorf("failed to insert relations: %w", err)
+	}
+
 	// if we are going to redact things, we need the room version to know the redaction algorithm
 	// so pull it out once now.
 	var roomVersion string
@@ -491,6 +576,14 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 		if err = a.eventsTable.Redact(txn, roomVersion, redactTheseEventIDs); err != nil {
 			return AccumulateResult{}, err
 		}
+		// redaction strips m.relates_to from the content
+		redactedEventIDs := make([]string, 0, len(redactTheseEventIDs))
+		for eventID := range redactTheseEventIDs {
+			redactedEventIDs = append(redactedEventIDs, eventID)
+		}
+		if err = a.relationsTable.DeleteByEventIDs(txn, redactedEventIDs); err != nil {
+			return AccumulateResult{}, fmt.Errorf("failed to delete relations of redacted events: %w", err)
+		}
 	}
 
 	for _, ev := range postInsertEvents {
@@ -500,6 +593,7 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 		beforeSnapID := snapID
 
 		if ev.IsState {
+			result.ChangedState = true
 			// make a new snapshot and update the snapshot ID
 			var oldStripped StrippedEvents
 			if snapID != 0 {
@@ -530,6 +624,7 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 	}
 
 	if len(redactTheseEventIDs) > 0 {
+		result.ChangedState = true
 		// We need to emit a cache invalidation if we have redacted some state in the
 		// current snapshot ID. Note that we run this _after_ persisting any new snapshots.
 		redactedEventIDs := make([]string, 0, len(redactTheseEventIDs))
@@ -552,23 +647,63 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 	if err = a.invitesTable.RemoveSupersededInvites(txn, roomID, postInsertEvents); err != nil {
 		return AccumulateResult{}, fmt.Errorf("RemoveSupersededInvites: %w", err)
 	}
+	if err = a.knocksTable.RemoveSupersededKnocks(txn, roomID, postInsertEvents); err != nil {
+		return AccumulateResult{}, fmt.Errorf("RemoveSupersededKnocks: %w", err)
+	}
 
 	if err = a.spacesTable.HandleSpaceUpdates(txn, postInsertEvents); err != nil {
 		return AccumulateResult{}, fmt.Errorf("HandleSpaceUpdates: %s", err)
 	}
 
+	if err = a.membershipsTable.Update(txn, postInsertEvents); err != nil {
+		return AccumulateResult{}, fmt.Errorf("failed to update memberships: %w", err)
+	}
+
 	// the last fetched snapshot ID is the current one
 	info := a.roomInfoDelta(roomID, postInsertEvents)
 	if err = a.roomsTable.Upsert(txn, info, snapID, latestNID); err != nil {
 		return AccumulateResult{}, fmt.Errorf("failed to UpdateCurrentSnapshotID to %d: %w", snapID, err)
 	}
+	if err = a.trackOwnMembership(txn, userID, roomID, incomingEvents); err != nil {
+		return AccumulateResult{}, fmt.Errorf("trackOwnMembership: %w", err)
+	}
 	return result, nil
 }
 
-// - parses it and returns Event structs.
+// trackOwnMembership records the NID of the user's leave event if the user's most recent
+// membership event in this timeline is a leave or ban, and forgets any earlier leave otherwise.
+// The events must already be in the database.
+func (a *Accumulator) trackOwnMembership(txn *sqlx.Tx, userID, roomID string, timeline []Event) error {
+	var latest *Event
+	for i := range timeline {
+		if timeline[i].Type == "m.room.member" && timeline[i].StateKey == userID {
+			latest = &timeline[i]
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+	// profile changes are prefixed with _
+	membership := strings.TrimPrefix(latest.Membership, "_")
+	if membership != "leave" && membership != "ban" {
+		return a.leavesTable.Delete(txn, userID, roomID)
+	}
+	nids, err := a.eventsTable.SelectNIDsByIDs(txn, []string{latest.ID})
+	if err != nil {
+		return err
+	}
+	leaveNID, ok := nids[latest.ID]
+	if !ok {
+		// e.g the timeline was skipped as the proxy has no state for this room
+		return nil
+	}
+	return a.leavesTable.Upsert(txn, userID, roomID, leaveNID)
+}
+
+// - parses it and returns Event structs, rejecting malformed events so they can be quarantined.
 // - removes duplicate events: this is just a bug which has been seen on Synapse on matrix.org
-func parseAndDeduplicateTimelineEvents(roomID string, timeline sync2.TimelineResponse) []Event {
-	dedupedEvents := make([]Event, 0, len(timeline.Events))
+func parseAndDeduplicateTimelineEvents(roomID string, timeline sync2.TimelineResponse) (dedupedEvents []Event, numDuplicates int, rejected []QuarantinedEvent) {
+	dedupedEvents = make([]Event, 0, len(timeline.Events))
 	seenEvents := make(map[string]struct{})
 	for i, rawEvent := range timeline.Events {
 		e := Event{
@@ -577,14 +712,16 @@ func parseAndDeduplicateTimelineEvents(roomID string, timeline sync2.TimelineRes
 		}
 		if err := e.ensureFieldsSetOnEvent(); err != nil {
 			logger.Warn().Str("event_id", e.ID).Str("room_id", roomID).Err(err).Msg(
-				"Accumulator.filterToNewTimelineEvents: failed to parse event, ignoring",
+				"Accumulator.filterToNewTimelineEvents: failed to parse event, quarantining",
 			)
+			rejected = append(rejected, QuarantinedEvent{RoomID: roomID, JSON: rawEvent, Reason: err.Error()})
 			continue
 		}
 		if _, ok := seenEvents[e.ID]; ok {
 			logger.Warn().Str("event_id", e.ID).Str("room_id", roomID).Msg(
 				"Accumulator.filterToNewTimelineEvents: seen the same event ID twice, ignoring",
 			)
+			numDuplicates++
 			continue
 		}
 		if i == 0 && timeline.PrevBatch != "" {
@@ -597,16 +734,27 @@ func parseAndDeduplicateTimelineEvents(roomID string, timeline sync2.TimelineRes
 		dedupedEvents = append(dedupedEvents, e)
 		seenEvents[e.ID] = struct{}{}
 	}
-	return dedupedEvents
+	return dedupedEvents, numDuplicates, rejected
 }
 
 // filterToNewTimelineEvents takes a raw timeline array from sync v2 and applies sanity to it:
 // - removes old events: this is an edge case when joining rooms over federation, see https://github.com/matrix-org/sliding-sync/issues/192
 // - check which events are unknown. If all events are known, filter them all out.
 func (a *Accumulator) filterToNewTimelineEvents(txn *sqlx.Tx, dedupedEvents []Event) ([]Event, error) {
+	if len(dedupedEvents) == 0 {
+		return nil, nil
+	}
 	// if we only have a single timeline event we cannot determine if it is old or not, as we rely on already seen events
-	// being after (higher index) than it.
-	if len(dedupedEvents) <= 1 {
+	// being after (higher index) than it. We can tell if the homeserver has resent it though, which would otherwise
+	// be processed as a new event with no NID.
+	if len(dedupedEvents) == 1 {
+		unknownEventIDs, err := a.eventsTable.SelectUnknownEventIDs(txn, []string{dedupedEvents[0].ID})
+		if err != nil {
+			return nil, fmt.Errorf("filterToNewTimelineEvents: failed to SelectUnknownEventIDs: %w", err)
+		}
+		if len(unknownEventIDs) == 0 {
+			return nil, nil
+		}
 		return dedupedEvents, nil
 	}
 
@@ -712,6 +860,47 @@ func (s *stateMap) NIDs() (membershipNIDs, otherNIDs []int64) {
 	return
 }
 
+// rewoundStateEvents returns the already-known events in the state block which replace a newer
+// event for the same (type, state_key) in the given snapshot, with their NIDs set. Known events
+// which are already current, or which have no current event to replace, are not rewinds: the
+// latter happens routinely when another poller has already seen newer state.
+func (a *Accumulator) rewoundStateEvents(txn *sqlx.Tx, snapID int64, events []Event) ([]Event, error) {
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].ID
+	}
+	nids, err := a.eventsTable.SelectNIDsByIDs(txn, eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	current, err := a.stateMapAtSnapshot(txn, snapID)
+	if err != nil {
+		return nil, err
+	}
+	var rewound []Event
+	for _, ev := range events {
+		nid, ok := nids[ev.ID]
+		if !ok {
+			continue
+		}
+		var currentNID int64
+		if ev.Type == "m.room.member" {
+			currentNID = current.Memberships[ev.StateKey]
+		} else {
+			currentNID = current.Other[[2]string{ev.Type, ev.StateKey}]
+		}
+		if currentNID == 0 || nid >= currentNID {
+			continue
+		}
+		logger.Warn().Str("room_id", ev.RoomID).Str("event_id", ev.ID).
+			Int64("nid", nid).Int64("current_nid", currentNID).
+			Msg("Accumulator.Initialise: state block rewinds current state")
+		ev.NID = nid
+		rewound = append(rewound, ev)
+	}
+	return rewound, nil
+}
+
 func (a *Accumulator) stateMapAtSnapshot(txn *sqlx.Tx, snapID int64) (stateMap, error) {
 	snapshot, err := a.snapshotTable.Select(txn, snapID)
 	if err != nil {
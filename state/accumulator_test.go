@@ -105,6 +105,7 @@ func TestAccumulatorInitialise(t *testing.T) {
 	if res.AddedEvents {
 		t.Fatalf("added events when it shouldn't have")
 	}
+	assertValue(t, "res.RewoundState", res.RewoundState, false)
 
 	// Subsequent calls with at least one new event expand or replace existing state.
 	// C, D, E
@@ -127,6 +128,39 @@ func TestAccumulatorInitialise(t *testing.T) {
 	assertNoError(t, err)
 	assertValue(t, "len(row.MembershipEvents)", len(row.MembershipEvents), 1)
 	assertValue(t, "len(row.OtherEvents)", len(row.OtherEvents), 3)
+
+	// Subsequent calls with known events which are current state, or which have no current event
+	// for their (type, state_key), are not a rewind.
+	res, err = accumulator.Initialise(roomID, roomEvents[:2])
+	assertNoError(t, err)
+	assertValue(t, "res.RewoundState", res.RewoundState, false)
+
+	// The user leaves, then a state block puts their older join event back. This is a rewind, and
+	// the current snapshot is rewritten with the older event.
+	res, err = accumulator.Initialise(roomID, []json.RawMessage{
+		[]byte(`{"event_id":"F", "type":"m.room.member", "state_key":"@me:localhost", "content":{"membership":"leave"}}`),
+	})
+	assertNoError(t, err)
+	assertValue(t, "res.AddedEvents", res.AddedEvents, true)
+	snapID3, err := accumulator.roomsTable.CurrentAfterSnapshotID(txn, roomID)
+	assertNoError(t, err)
+
+	res, err = accumulator.Initialise(roomID, roomEvents[:2])
+	assertNoError(t, err)
+	assertValue(t, "res.AddedEvents", res.AddedEvents, false)
+	assertValue(t, "res.ReplacedExistingSnapshot", res.ReplacedExistingSnapshot, false)
+	assertValue(t, "res.RewoundState", res.RewoundState, true)
+	snapID4, err := accumulator.roomsTable.CurrentAfterSnapshotID(txn, roomID)
+	assertNoError(t, err)
+	if snapID4 == snapID3 || snapID4 != res.SnapshotID {
+		t.Errorf("Expected the rewind to create a new current snapshot, got %d (was %d, result %d)", snapID4, snapID3, res.SnapshotID)
+	}
+	row, err = accumulator.snapshotTable.Select(txn, snapID4)
+	assertNoError(t, err)
+	members, err := accumulator.eventsTable.SelectByNIDs(txn, true, row.MembershipEvents)
+	assertNoError(t, err)
+	assertValue(t, "len(members)", len(members), 1)
+	assertValue(t, "members[0].ID", members[0].ID, "B")
 }
 
 // Test that an unknown room shouldn't initialise if given state without a create event.
@@ -404,6 +438,7 @@ func TestAccumulatorMembershipLogs(t *testing.T) {
 	}
 	for _, tc := range testCases {
 		gotEvents, err := accumulator.eventsTable.SelectEventsWithTypeStateKey(
+			context.Background(),
 			"m.room.member", tc.target, tc.startExcl, tc.endIncl,
 		)
 		if err != nil {
@@ -498,6 +533,131 @@ func TestAccumulatorDupeEvents(t *testing.T) {
 	}
 }
 
+func TestAccumulatorDropsResentEvents(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	accumulator := NewAccumulator(db)
+	roomID := "!TestAccumulatorDropsResentEvents:localhost"
+	_, err := accumulator.Initialise(roomID, []json.RawMessage{
+		[]byte(`{"event_id":"$resent-create", "type":"m.room.create", "state_key":"", "content":{"creator":"@me:localhost"}}`),
+		[]byte(`{"event_id":"$resent-join", "type":"m.room.member", "state_key":"@me:localhost", "content":{"membership":"join"}}`),
+	})
+	if err != nil {
+		t.Fatalf("failed to Initialise accumulator: %s", err)
+	}
+	msg := []byte(`{"event_id":"$resent-msg", "type":"m.room.message", "content":{"msgtype":"m.text", "body":"Hello"}}`)
+	join := []byte(`{"event_id":"$resent-bob", "type":"m.room.member", "state_key":"@bob:localhost", "content":{"membership":"join"}}`)
+
+	steps := []struct {
+		desc              string
+		events            []json.RawMessage
+		wantNumNew        int
+		wantNumDuplicates int
+	}{
+		{desc: "new events", events: []json.RawMessage{msg, join}, wantNumNew: 2},
+		// other pollers in the room see the same events, so these aren't duplicates
+		{desc: "a lone join resent", events: []json.RawMessage{join}},
+		{desc: "a lone message resent", events: []json.RawMessage{msg}},
+		{desc: "a known event twice in one timeline", events: []json.RawMessage{join, join}, wantNumDuplicates: 2},
+	}
+	var latestNID int64
+	for _, step := range steps {
+		t.Log(step.desc)
+		err = sqlutil.WithTransaction(accumulator.db, func(txn *sqlx.Tx) error {
+			res, err := accumulator.Accumulate(txn, userID, roomID, sync2.TimelineResponse{Events: step.events})
+			if err != nil {
+				return err
+			}
+			assertValue(t, "NumNew", res.NumNew, step.wantNumNew)
+			assertValue(t, "NumDuplicates", res.NumDuplicates, step.wantNumDuplicates)
+			assertValue(t, "TimelineNIDs", len(res.TimelineNIDs), step.wantNumNew)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to Accumulate: %s", err)
+		}
+		// duplicates must not move the room's latest NID, else the room looks empty
+		err = sqlutil.WithTransaction(accumulator.db, func(txn *sqlx.Tx) error {
+			roomToNIDs, err := accumulator.roomsTable.LatestNIDs(txn, []string{roomID})
+			if latestNID == 0 {
+				latestNID = roomToNIDs[roomID]
+			}
+			assertValue(t, "latest NID", roomToNIDs[roomID], latestNID)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("failed to load latest NIDs: %s", err)
+		}
+	}
+}
+
+func TestAccumulatorQuarantinesMalformedEvents(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	accumulator := NewAccumulator(db)
+	roomID := "!TestAccumulatorQuarantinesMalformedEvents:localhost"
+
+	t.Log("A state block which is entirely malformed is quarantined without failing.")
+	res, err := accumulator.Initialise(roomID, []json.RawMessage{
+		[]byte(`{"event_id":"$quarantine-create", "state_key":"", "content":{"creator":"@me:localhost"}}`),
+	})
+	if err != nil {
+		t.Fatalf("failed to Initialise accumulator: %s", err)
+	}
+	assertValue(t, "SnapshotID", res.SnapshotID, int64(0))
+
+	t.Log("Malformed events in the state block are quarantined, and the rest are stored.")
+	_, err = accumulator.Initialise(roomID, []json.RawMessage{
+		[]byte(`{"event_id":"$quarantine-create", "type":"m.room.create", "state_key":"", "content":{"creator":"@me:localhost"}}`),
+		[]byte(`{"event_id":"$quarantine-join", "type":"m.room.member", "state_key":"@me:localhost", "content":{"membership":"join"}}`),
+		[]byte(`"not an object"`),
+	})
+	if err != nil {
+		t.Fatalf("failed to Initialise accumulator: %s", err)
+	}
+
+	t.Log("Malformed timeline events are quarantined, and the rest of the timeline is stored.")
+	timeline := []json.RawMessage{
+		[]byte(`{"event_id":"$quarantine-msg1", "type":"m.room.message", "content":{"msgtype":"m.text", "body":"Hello"}}`),
+		[]byte(`{"event_id":"$quarantine-notype", "content":{"msgtype":"m.text", "body":"No type"}}`),
+		[]byte(`{"event_id":"$quarantine-truncated", "type":"m.room.mess`),
+		[]byte(`{"event_id":"$quarantine-nomembership", "type":"m.room.member", "state_key":"@bob:localhost", "content":{}}`),
+		[]byte(`{"event_id":"$quarantine-msg2", "type":"m.room.message", "content":{"msgtype":"m.text", "body":"World"}}`),
+	}
+	for i := 0; i < 2; i++ { // the second time checks that resent malformed events are only quarantined once
+		err = sqlutil.WithTransaction(accumulator.db, func(txn *sqlx.Tx) error {
+			res, err := accumulator.Accumulate(txn, userID, roomID, sync2.TimelineResponse{Events: timeline})
+			if err != nil {
+				return err
+			}
+			if i == 0 {
+				assertValue(t, "NumNew", res.NumNew, 2)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to Accumulate: %s", err)
+		}
+	}
+
+	quarantined, err := accumulator.quarantineTable.SelectByRoom(roomID)
+	assertNoError(t, err)
+	wantReasons := []string{
+		"event JSON missing type key",
+		"event JSON is not an object",
+		"event JSON missing type key",
+		"event is not valid JSON",
+		"membership event missing membership key",
+	}
+	if len(quarantined) != len(wantReasons) {
+		t.Fatalf("got %d quarantined events, want %d: %+v", len(quarantined), len(wantReasons), quarantined)
+	}
+	for i, ev := range quarantined {
+		assertValue(t, "quarantined room ID", ev.RoomID, roomID)
+		assertValue(t, "quarantined reason", ev.Reason, wantReasons[i])
+	}
+}
+
 // Regression test for corrupt state snapshots.
 // This seems to have happened in the wild, whereby the snapshot exhibited 2 things:
 //   - A message event having a event_replaces_nid. This should be impossible as messages are not state.
@@ -753,6 +913,8 @@ func TestAccumulatorMissingPreviousMarkers(t *testing.T) {
 		CheckDesc string
 		// NumNew is the expected value of the NumNew field in the AccumulateResult.
 		NumNew int
+		// Gappy is the expected value of the Gappy field in the AccumulateResult.
+		Gappy bool
 		// MissingPrevious is a map from timeline event IDs to the missing_previous bool expected in the DB.
 		MissingPrevious map[string]bool
 	}{
@@ -773,6 +935,7 @@ func TestAccumulatorMissingPreviousMarkers(t *testing.T) {
 			},
 			Limited:         true,
 			NumNew:          1,
+			Gappy:           true,
 			CheckDesc:       "(E) should be marked as missing_previous.",
 			MissingPrevious: map[string]bool{"$msg-E": true},
 		},
@@ -841,6 +1004,7 @@ func TestAccumulatorMissingPreviousMarkers(t *testing.T) {
 			t.Fatalf("failed to Accumulate: %s", err)
 		}
 		assertValue(t, "numNew", accResult.NumNew, step.NumNew)
+		assertValue(t, "gappy", accResult.Gappy, step.Gappy)
 
 		t.Log(step.CheckDesc)
 		checkIDs := make([]string, 0, len(step.MissingPrevious))
@@ -0,0 +1,278 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+// See https://spec.matrix.org/v1.8/client-server-api/#aggregations-of-child-events
+type annotationChunk struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+type referenceChunk struct {
+	EventID string `json:"event_id"`
+}
+
+type threadSummary struct {
+	LatestEvent             json.RawMessage `json:"latest_event"`
+	Count                   int             `json:"count"`
+	CurrentUserParticipated bool            `json:"current_user_participated"`
+	latestNID               int64
+}
+
+type relationCounts struct {
+	RelatesTo    string `db:"relates_to"`
+	RelType      string `db:"rel_type"`
+	Key          string `db:"key"`
+	EventType    string `db:"event_type"`
+	Count        int    `db:"count"`
+	LatestNID    int64  `db:"latest_nid"`
+	Participated bool   `db:"participated"`
+}
+
+// BundledAggregations returns the m.relations to bundle into the unsigned section of each of
+// these events, keyed by event ID. Events without relations are not included. Aggregations are
+// computed from the relations table:
+//   - m.annotation: the number of annotations of each type and key, e.g reaction counts.
+//   - m.replace: the most recent replacement sent by the sender of the original event.
+//   - m.thread: the number of replies, the latest reply and whether userID participated.
+//   - m.reference: the IDs of the referencing events.
+func (s *Storage) BundledAggregations(ctx context.Context, userID string, events []json.RawMessage) (map[string]json.RawMessage, error) {
+	var eventIDs, senders []string
+	eventIDToSender := make(map[string]string, len(events))
+	for _, ev := range events {
+		parsed := gjson.ParseBytes(ev)
+		eventID := parsed.Get("event_id").Str
+		if eventID == "" {
+			continue
+		}
+		eventIDs = append(eventIDs, eventID)
+		senders = append(senders, parsed.Get("sender").Str)
+		eventIDToSender[eventID] = parsed.Get("sender").Str
+	}
+	if len(eventIDs) == 0 {
+		return nil, nil
+	}
+	relations := make(map[string]map[string]interface{})
+	setRelation := func(eventID, relType string, aggregation interface{}) {
+		if relations[eventID] == nil {
+			relations[eventID] = make(map[string]interface{})
+		}
+		relations[eventID][relType] = aggregation
+	}
+	err := sqlutil.WithTransactionContext(ctx, s.DB, func(txn *sqlx.Tx) error {
+		var counts []relationCounts
+		err := sqlutil.SelectContext(ctx, txn, "BundledAggregations.counts", &counts, `
+		SELECT r.relates_to, r.rel_type, r.key, e.event_type, COUNT(*) AS count, MAX(r.event_nid) AS latest_nid,
+			bool_or(r.sender = $2) AS participated
+		FROM syncv3_event_relations r JOIN syncv3_events e ON e.event_nid = r.event_nid
+		WHERE r.relates_to = ANY($1) AND r.rel_type IN ('m.annotation', 'm.thread')
+		GROUP BY r.relates_to, r.rel_type, r.key, e.event_type ORDER BY r.relates_to, count DESC, r.key`,
+			pq.StringArray(eventIDs), userID)
+		if err != nil {
+			return fmt.Errorf("failed to select relation counts: %w", err)
+		}
+		annotations := make(map[string][]annotationChunk)
+		threads := make(map[string]*threadSummary)
+		for _, c := range counts {
+			switch c.RelType {
+			case "m.annotation":
+				annotations[c.RelatesTo] = append(annotations[c.RelatesTo], annotationChunk{
+					Type: c.EventType, Key: c.Key, Count: c.Count,
+				})
+			case "m.thread":
+				// thread replies are grouped by event type, so merge them
+				thread := threads[c.RelatesTo]
+				if thread == nil {
+					thread = &threadSummary{
+						CurrentUserParticipated: eventIDToSender[c.RelatesTo] == userID,
+					}
+					threads[c.RelatesTo] = thread
+				}
+				thread.Count += c.Count
+				thread.CurrentUserParticipated = thread.CurrentUserParticipated || c.Participated
+				if c.LatestNID > thread.latestNID {
+					thread.latestNID = c.LatestNID
+				}
+			}
+		}
+		threadLatestNIDs := make(map[int64]string, len(threads))
+		for eventID, thread := range threads {
+			threadLatestNIDs[thread.latestNID] = eventID
+		}
+		for eventID, chunk := range annotations {
+			setRelation(eventID, "m.annotation", map[string]interface{}{"chunk": chunk})
+		}
+
+		var references []Relation
+		err = sqlutil.SelectContext(ctx, txn, "BundledAggregations.references", &references, `
+		SELECT event_nid, event_id, room_id, sender, relates_to, rel_type, key FROM syncv3_event_relations
+		WHERE relates_to = ANY($1) AND rel_type = 'm.reference' ORDER BY event_nid ASC`, pq.StringArray(eventIDs))
+		if err != nil {
+			return fmt.Errorf("failed to select references: %w", err)
+		}
+		referenceChunks := make(map[string][]referenceChunk)
+		for _, ref := range references {
+			referenceChunks[ref.RelatesTo] = append(referenceChunks[ref.RelatesTo], referenceChunk{EventID: ref.EventID})
+		}
+		for eventID, chunk := range referenceChunks {
+			setRelation(eventID, "m.reference", map[string]interface{}{"chunk": chunk})
+		}
+
+		// Replacements from anyone other than the original sender must be ignored.
+		var replacements []Relation
+		err = sqlutil.SelectContext(ctx, txn, "BundledAggregations.replacements", &replacements, `
+		SELECT DISTINCT ON (r.relates_to) r.event_nid, r.event_id, r.room_id, r.sender, r.relates_to, r.rel_type, r.key
+		FROM syncv3_event_relations r
+		JOIN unnest($1::text[], $2::text[]) AS original(event_id, sender)
+			ON r.relates_to = original.event_id AND r.sender = original.sender
+		WHERE r.rel_type = 'm.replace' ORDER BY r.relates_to, r.event_nid DESC`,
+			pq.StringArray(eventIDs), pq.StringArray(senders))
+		if err != nil {
+			return fmt.Errorf("failed to select replacements: %w", err)
+		}
+		replacementNIDs := make(map[int64]string, len(replacements))
+		for _, rep := range replacements {
+			replacementNIDs[rep.EventNID] = rep.RelatesTo
+		}
+
+		// load the full events which are bundled
+		nids := make([]int64, 0, len(replacementNIDs)+len(threadLatestNIDs))
+		for nid := range replacementNIDs {
+			nids = append(nids, nid)
+		}
+		for nid := range threadLatestNIDs {
+			nids = append(nids, nid)
+		}
+		if len(nids) == 0 {
+			return nil
+		}
+		bundled, err := s.EventsTable.SelectByNIDs(txn, false, nids)
+		if err != nil {
+			return fmt.Errorf("failed to select bundled events: %w", err)
+		}
+		for _, ev := range bundled {
+			if eventID, ok := replacementNIDs[ev.NID]; ok {
+				setRelation(eventID, "m.replace", json.RawMessage(ev.JSON))
+			}
+			if eventID, ok := threadLatestNIDs[ev.NID]; ok {
+				threads[eventID].LatestEvent = ev.JSON
+			}
+		}
+		for eventID, thread := range threads {
+			if len(thread.LatestEvent) == 0 {
+				continue
+			}
+			setRelation(eventID, "m.thread", thread)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]json.RawMessage, len(relations))
+	for eventID, rels := range relations {
+		result[eventID], err = json.Marshal(rels)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal relations of %s: %w", eventID, err)
+		}
+	}
+	return result, nil
+}
+
+// AnnotationCount is the number of annotations of an event with the same type and key, e.g the number
+// of 👍 reactions to a message.
+type AnnotationCount struct {
+	Type  string `json:"type" db:"event_type"`
+	Key   string `json:"key" db:"key"`
+	Count int    `json:"count" db:"count"`
+	// CurrentUserParticipated is true if the requesting user sent one of these annotations.
+	CurrentUserParticipated bool `json:"current_user_participated" db:"participated"`
+}
+
+// AnnotationCounts returns the annotation counts of each of these events, most annotated first,
+// keyed by event ID. Events without annotations are not included.
+func (s *Storage) AnnotationCounts(ctx context.Context, userID string, eventIDs []string) (map[string][]AnnotationCount, error) {
+	if len(eventIDs) == 0 {
+		return nil, nil
+	}
+	var rows []struct {
+		RelatesTo string `db:"relates_to"`
+		AnnotationCount
+	}
+	err := sqlutil.SelectContext(ctx, s.DB, "AnnotationCounts", &rows, `
+	SELECT r.relates_to, e.event_type, r.key, COUNT(*) AS count, bool_or(r.sender = $2) AS participated
+	FROM syncv3_event_relations r JOIN syncv3_events e ON e.event_nid = r.event_nid
+	WHERE r.relates_to = ANY($1) AND r.rel_type = 'm.annotation'
+	GROUP BY r.relates_to, e.event_type, r.key ORDER BY r.relates_to, count DESC, r.key`,
+		pq.StringArray(eventIDs), userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select annotation counts: %w", err)
+	}
+	result := make(map[string][]AnnotationCount)
+	for _, row := range rows {
+		result[row.RelatesTo] = append(result[row.RelatesTo], row.AnnotationCount)
+	}
+	return result, nil
+}
+
+// Annotation is every annotation of an event with the same type and key, e.g all the 👍 reactions to
+// a message. Unlike AnnotationCount it doesn't depend on who is asking, so it can be shared.
+type Annotation struct {
+	Type    string         `db:"event_type"`
+	Key     string         `db:"key"`
+	Senders pq.StringArray `db:"senders"`
+}
+
+// CountFor returns the annotation count as seen by this user.
+func (a Annotation) CountFor(userID string) AnnotationCount {
+	count := AnnotationCount{
+		Type:  a.Type,
+		Key:   a.Key,
+		Count: len(a.Senders),
+	}
+	for _, sender := range a.Senders {
+		if sender == userID {
+			count.CurrentUserParticipated = true
+			break
+		}
+	}
+	return count
+}
+
+// Annotations returns the annotations of each of these events, most annotated first, keyed by event ID.
+// Events without annotations are not included. Use this instead of AnnotationCounts when the counts
+// are needed for many users.
+func (s *Storage) Annotations(ctx context.Context, eventIDs []string) (map[string][]Annotation, error) {
+	if len(eventIDs) == 0 {
+		return nil, nil
+	}
+	var rows []struct {
+		RelatesTo string `db:"relates_to"`
+		Annotation
+	}
+	err := sqlutil.SelectContext(ctx, s.DB, "Annotations", &rows, `
+	SELECT r.relates_to, e.event_type, r.key, array_agg(r.sender) AS senders
+	FROM syncv3_event_relations r JOIN syncv3_events e ON e.event_nid = r.event_nid
+	WHERE r.relates_to = ANY($1) AND r.rel_type = 'm.annotation'
+	GROUP BY r.relates_to, e.event_type, r.key ORDER BY r.relates_to, COUNT(*) DESC, r.key`,
+		pq.StringArray(eventIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to select annotations: %w", err)
+	}
+	result := make(map[string][]Annotation)
+	for _, row := range rows {
+		result[row.RelatesTo] = append(result[row.RelatesTo], row.Annotation)
+	}
+	return result, nil
+}
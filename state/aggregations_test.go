@@ -0,0 +1,107 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestBundledAggregations(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestBundledAggregations:localhost"
+	alice := "@alice_TestBundledAggregations:localhost"
+	bob := "@bob_TestBundledAggregations:localhost"
+	charlie := "@charlie_TestBundledAggregations:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice, "room_version": "10"}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewJoinEvent(t, bob),
+	})
+	assertNoError(t, err)
+	root := testutils.NewMessageEvent(t, alice, "root")
+	rootID := gjson.GetBytes(root, "event_id").Str
+	plain := testutils.NewMessageEvent(t, alice, "no relations")
+	relatesTo := func(relType string, extra map[string]interface{}) map[string]interface{} {
+		rel := map[string]interface{}{"rel_type": relType, "event_id": rootID}
+		for k, v := range extra {
+			rel[k] = v
+		}
+		return rel
+	}
+	reaction := func(sender, key string) json.RawMessage {
+		return testutils.NewEvent(t, "m.reaction", sender, map[string]interface{}{
+			"m.relates_to": relatesTo("m.annotation", map[string]interface{}{"key": key}),
+		})
+	}
+	edit := func(sender, body string) json.RawMessage {
+		return testutils.NewEvent(t, "m.room.message", sender, map[string]interface{}{
+			"body": "* " + body, "m.new_content": map[string]interface{}{"body": body}, "m.relates_to": relatesTo("m.replace", nil),
+		})
+	}
+	reply := func(sender, body string) json.RawMessage {
+		return testutils.NewEvent(t, "m.room.message", sender, map[string]interface{}{
+			"body": body, "m.relates_to": relatesTo("m.thread", nil),
+		})
+	}
+	firstEdit := edit(alice, "first edit")
+	latestEdit := edit(alice, "latest edit")
+	latestReply := reply(bob, "second reply")
+	reference := testutils.NewEvent(t, "m.key.verification.done", bob, map[string]interface{}{
+		"m.relates_to": relatesTo("m.reference", nil),
+	})
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		root, plain,
+		reaction(alice, "👍"), reaction(bob, "👍"), reaction(bob, "🎉"),
+		firstEdit, latestEdit,
+		edit(bob, "not allowed to edit"),
+		reply(bob, "first reply"), latestReply,
+		reference,
+	}})
+	assertNoError(t, err)
+
+	got, err := store.BundledAggregations(context.Background(), charlie, []json.RawMessage{root, plain})
+	assertNoError(t, err)
+	assertValue(t, "num aggregated events", len(got), 1)
+	relations := gjson.ParseBytes(got[rootID])
+	assertValue(t, "annotations", relations.Get("m\\.annotation.chunk").Raw, `[{"type":"m.reaction","key":"👍","count":2},{"type":"m.reaction","key":"🎉","count":1}]`)
+	assertValue(t, "replacement", relations.Get("m\\.replace.event_id").Str, gjson.GetBytes(latestEdit, "event_id").Str)
+	assertValue(t, "thread count", relations.Get("m\\.thread.count").Int(), int64(2))
+	assertValue(t, "thread latest event", relations.Get("m\\.thread.latest_event.event_id").Str, gjson.GetBytes(latestReply, "event_id").Str)
+	assertValue(t, "charlie participated", relations.Get("m\\.thread.current_user_participated").Bool(), false)
+	assertValue(t, "references", relations.Get("m\\.reference.chunk.#.event_id").Raw, `["`+gjson.GetBytes(reference, "event_id").Str+`"]`)
+
+	// the sender of the root and the repliers participated in the thread
+	for _, userID := range []string{alice, bob} {
+		got, err = store.BundledAggregations(context.Background(), userID, []json.RawMessage{root})
+		assertNoError(t, err)
+		assertValue(t, userID+" participated", gjson.GetBytes(got[rootID], "m\\.thread.current_user_participated").Bool(), true)
+	}
+
+	counts, err := store.AnnotationCounts(context.Background(), bob, []string{rootID, gjson.GetBytes(plain, "event_id").Str})
+	assertNoError(t, err)
+	assertValue(t, "num annotated events", len(counts), 1)
+	assertValue(t, "annotation counts", counts[rootID], []AnnotationCount{
+		{Type: "m.reaction", Key: "👍", Count: 2, CurrentUserParticipated: true},
+		{Type: "m.reaction", Key: "🎉", Count: 1, CurrentUserParticipated: true},
+	})
+
+	// the shared annotations give the same counts for each user
+	annotations, err := store.Annotations(context.Background(), []string{rootID, gjson.GetBytes(plain, "event_id").Str})
+	assertNoError(t, err)
+	assertValue(t, "num annotated events", len(annotations), 1)
+	for _, userID := range []string{alice, bob, charlie} {
+		want, err := store.AnnotationCounts(context.Background(), userID, []string{rootID})
+		assertNoError(t, err)
+		var got []AnnotationCount
+		for _, a := range annotations[rootID] {
+			got = append(got, a.CountFor(userID))
+		}
+		assertValue(t, userID+" annotation counts", got, want[rootID])
+	}
+}
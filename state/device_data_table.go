@@ -106,48 +106,61 @@ func (t *DeviceDataTable) Select(userID, deviceID string, swap bool) (result *in
 	return
 }
 
+// Delete removes the OTK counts and fallback key types for this user|device. Device list changes
+// are kept, as they cannot be recovered from an initial sync.
+func (t *DeviceDataTable) Delete(userID, deviceID string) error {
+	_, err := t.db.Exec(`DELETE FROM syncv3_device_data WHERE user_id=$1 AND device_id=$2`, userID, deviceID)
+	return err
+}
+
 // Upsert combines what is in the database for this user|device with the partial entry `dd`
 func (t *DeviceDataTable) Upsert(userID, deviceID string, keys internal.DeviceKeyData, deviceListChanges map[string]int) (err error) {
 	err = sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
-		// Update device lists
-		if err = t.deviceListTable.UpsertTx(txn, userID, deviceID, deviceListChanges); err != nil {
-			return err
-		}
-		// select what already exists
-		var row DeviceDataRow
-		err = txn.Get(&row, `SELECT data FROM syncv3_device_data WHERE user_id=$1 AND device_id=$2 FOR UPDATE`, userID, deviceID)
-		if err != nil && err != sql.ErrNoRows {
-			return err
-		}
-		// unmarshal and combine
-		var keyData internal.DeviceKeyData
-		if len(row.KeyData) > 0 {
-			if err = cbor.Unmarshal(row.KeyData, &keyData); err != nil {
-				return err
-			}
-		}
-		if keys.FallbackKeyTypes != nil {
-			keyData.FallbackKeyTypes = keys.FallbackKeyTypes
-			keyData.SetFallbackKeysChanged()
-		}
-		if keys.OTKCounts != nil {
-			keyData.OTKCounts = keys.OTKCounts
-			keyData.SetOTKCountChanged()
-		}
-
-		data, err := cbor.Marshal(keyData)
-		if err != nil {
-			return err
-		}
-		_, err = txn.Exec(
-			`INSERT INTO syncv3_device_data(user_id, device_id, data) VALUES($1,$2,$3)
-			ON CONFLICT (user_id, device_id) DO UPDATE SET data=$3`,
-			userID, deviceID, data,
-		)
-		return err
+		return t.UpsertTx(txn, userID, deviceID, keys, deviceListChanges)
 	})
 	if err != nil && err != sql.ErrNoRows {
 		sentry.CaptureException(err)
 	}
 	return
 }
+
+// UpsertTx is Upsert in a transaction, so that the device data can be stored atomically with
+// the since token it was derived from.
+func (t *DeviceDataTable) UpsertTx(txn *sqlx.Tx, userID, deviceID string, keys internal.DeviceKeyData, deviceListChanges map[string]int) error {
+	// Update device lists
+	if err := t.deviceListTable.UpsertTx(txn, userID, deviceID, deviceListChanges); err != nil {
+		return err
+	}
+	// select what already exists
+	var row DeviceDataRow
+	err := txn.Get(&row, `SELECT data FROM syncv3_device_data WHERE user_id=$1 AND device_id=$2 FOR UPDATE`, userID, deviceID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	// unmarshal and combine
+	var keyData internal.DeviceKeyData
+	if len(row.KeyData) > 0 {
+		if err = cbor.Unmarshal(row.KeyData, &keyData); err != nil {
+			return err
+		}
+	}
+	if keys.FallbackKeyTypes != nil {
+		keyData.FallbackKeyTypes = keys.FallbackKeyTypes
+		keyData.SetFallbackKeysChanged()
+	}
+	if keys.OTKCounts != nil {
+		keyData.OTKCounts = keys.OTKCounts
+		keyData.SetOTKCountChanged()
+	}
+
+	data, err := cbor.Marshal(keyData)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(
+		`INSERT INTO syncv3_device_data(user_id, device_id, data) VALUES($1,$2,$3)
+		ON CONFLICT (user_id, device_id) DO UPDATE SET data=$3`,
+		userID, deviceID, data,
+	)
+	return err
+}
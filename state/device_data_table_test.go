@@ -193,3 +193,36 @@ func TestDeviceDataTableBitset(t *testing.T) {
 	bothUpdate.SetOTKCountChanged()
 	assertDeviceData(t, *got, bothUpdate)
 }
+
+func TestDeviceDataTableDelete(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewDeviceDataTable(db)
+	userID := "@TestDeviceDataTableDelete"
+	deviceID := "BOB"
+	otherDeviceID := "BOB2"
+	keys := internal.DeviceKeyData{
+		OTKCounts: map[string]int{
+			"foo": 100,
+		},
+	}
+	for _, dID := range []string{deviceID, otherDeviceID} {
+		err := table.Upsert(userID, dID, keys, nil)
+		assertNoError(t, err)
+	}
+
+	err := table.Delete(userID, deviceID)
+	assertNoError(t, err)
+	got, err := table.Select(userID, deviceID, false)
+	assertNoError(t, err)
+	if got != nil {
+		t.Fatalf("Select after Delete returned %+v, want nil", got)
+	}
+	// other devices are unaffected
+	got, err = table.Select(userID, otherDeviceID, false)
+	assertNoError(t, err)
+	if got == nil {
+		t.Fatalf("Select for other device returned nil")
+	}
+	assertVal(t, "OTKCounts", got.OTKCounts, keys.OTKCounts)
+}
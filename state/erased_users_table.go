@@ -0,0 +1,64 @@
+package state
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// profileFields are the paths to profile data in an m.room.member event.
+var profileFields = []string{
+	"content.displayname", "content.avatar_url",
+	"unsigned.prev_content.displayname", "unsigned.prev_content.avatar_url",
+}
+
+// ErasedUsersTable stores the users whose profile data has been erased, so that it can also be
+// stripped from data which arrives for them afterwards.
+type ErasedUsersTable struct {
+	db *sqlx.DB
+}
+
+func NewErasedUsersTable(db *sqlx.DB) *ErasedUsersTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_erased_users (
+		user_id TEXT NOT NULL PRIMARY KEY,
+		erased_ts BIGINT NOT NULL
+	);
+	`)
+	return &ErasedUsersTable{db}
+}
+
+// Insert marks the user as erased. It is not an error to erase a user more than once.
+func (t *ErasedUsersTable) Insert(txn *sqlx.Tx, userID string) error {
+	_, err := txn.Exec(
+		`INSERT INTO syncv3_erased_users(user_id, erased_ts) VALUES($1, $2) ON CONFLICT (user_id) DO NOTHING`,
+		userID, time.Now().UnixMilli(),
+	)
+	return err
+}
+
+// SelectAll returns every erased user.
+func (t *ErasedUsersTable) SelectAll() (userIDs []string, err error) {
+	err = t.db.Select(&userIDs, `SELECT user_id FROM syncv3_erased_users`)
+	return
+}
+
+// StripProfile removes the display name and avatar from an m.room.member event, including from
+// its unsigned.prev_content. Returns whether the event had any profile data.
+func StripProfile(ev json.RawMessage) (stripped json.RawMessage, changed bool) {
+	stripped = ev
+	for _, field := range profileFields {
+		if !gjson.GetBytes(stripped, field).Exists() {
+			continue
+		}
+		if res, err := sjson.DeleteBytes(stripped, field); err == nil {
+			stripped = res
+			changed = true
+		}
+	}
+	return stripped, changed
+}
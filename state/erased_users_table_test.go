@@ -0,0 +1,77 @@
+package state
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/tidwall/gjson"
+)
+
+func TestErasedUsersTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewErasedUsersTable(db)
+	alice := "@TestErasedUsersTable_alice:localhost"
+	// erasing twice is fine
+	for i := 0; i < 2; i++ {
+		err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+			return table.Insert(txn, alice)
+		})
+		assertNoError(t, err)
+	}
+	userIDs, err := table.SelectAll()
+	assertNoError(t, err)
+	found := 0
+	for _, userID := range userIDs {
+		if userID == alice {
+			found++
+		}
+	}
+	assertValue(t, "times alice was erased", found, 1)
+}
+
+func TestStripProfile(t *testing.T) {
+	testCases := []struct {
+		name        string
+		event       string
+		wantContent string
+		wantChanged bool
+	}{
+		{
+			name:        "strips display name and avatar",
+			event:       `{"type":"m.room.member","state_key":"@a:b","content":{"membership":"join","displayname":"Alice","avatar_url":"mxc://a"}}`,
+			wantContent: `{"membership":"join"}`,
+			wantChanged: true,
+		},
+		{
+			name:        "strips prev_content",
+			event:       `{"type":"m.room.member","state_key":"@a:b","content":{"membership":"leave"},"unsigned":{"prev_content":{"membership":"join","displayname":"Alice"}}}`,
+			wantContent: `{"membership":"leave"}`,
+			wantChanged: true,
+		},
+		{
+			name:        "no profile",
+			event:       `{"type":"m.room.member","state_key":"@a:b","content":{"membership":"join"}}`,
+			wantContent: `{"membership":"join"}`,
+			wantChanged: false,
+		},
+	}
+	for _, tc := range testCases {
+		stripped, changed := StripProfile(json.RawMessage(tc.event))
+		if changed != tc.wantChanged {
+			t.Errorf("%s: got changed=%v want %v", tc.name, changed, tc.wantChanged)
+		}
+		var gotContent, wantContent map[string]interface{}
+		assertNoError(t, json.Unmarshal([]byte(gjson.GetBytes(stripped, "content").Raw), &gotContent))
+		assertNoError(t, json.Unmarshal([]byte(tc.wantContent), &wantContent))
+		if !reflect.DeepEqual(gotContent, wantContent) {
+			t.Errorf("%s: got content %v want %v", tc.name, gotContent, wantContent)
+		}
+		if gjson.GetBytes(stripped, "unsigned.prev_content.displayname").Exists() {
+			t.Errorf("%s: prev_content still has a displayname: %s", tc.name, stripped)
+		}
+	}
+}
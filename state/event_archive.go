@@ -0,0 +1,401 @@
+package state
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ReneKroon/ttlcache/v2"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+const (
+	// eventArchiveBatchSize is the max number of events considered at a time when archiving. Each
+	// batch containing archivable events becomes one object in the object store.
+	eventArchiveBatchSize = 2000
+	// eventArchiveCacheSize is the number of decoded objects kept in memory, so that paginating
+	// back through an archived timeline doesn't fetch the same object for every page.
+	eventArchiveCacheSize = 64
+	eventArchiveCacheTTL  = 10 * time.Minute
+)
+
+// EventArchive moves the JSON of old timeline events out of syncv3_events and into gzipped objects
+// in an ObjectStore, keeping a manifest of the objects in syncv3_event_archives. The EventTable
+// loads archived events transparently when they are selected.
+//
+// Only message events which have been superseded by a newer event of the same type in their room
+// are archived. State events, and the latest event of each type, stay in the database as they are
+// read on hot paths e.g to calculate room state and metadata.
+type EventArchive struct {
+	db      *sqlx.DB
+	objects internal.ObjectStore
+	// cache maps archive IDs to map[int64]json.RawMessage of the events in that archive.
+	cache *ttlcache.Cache
+	// mu serialises calls to Archive and guards cursor.
+	mu *sync.Mutex
+	// cursor is the highest event NID which has been considered for archiving, which is persisted
+	// in syncv3_event_archive_cursor. Events which were not archivable when they were considered
+	// are not revisited.
+	cursor int64
+}
+
+func NewEventArchive(db *sqlx.DB, objects internal.ObjectStore) *EventArchive {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE SEQUENCE IF NOT EXISTS syncv3_event_archive_ids_seq;
+	CREATE TABLE IF NOT EXISTS syncv3_event_archives (
+		archive_id BIGINT PRIMARY KEY NOT NULL DEFAULT nextval('syncv3_event_archive_ids_seq'),
+		-- NULL for archives made before each archive only held events from one room.
+		room_id TEXT,
+		object_key TEXT NOT NULL,
+		num_events BIGINT NOT NULL,
+		created_ts BIGINT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS syncv3_event_archives_room_idx ON syncv3_event_archives(room_id);
+	CREATE TABLE IF NOT EXISTS syncv3_event_archive_cursor (
+		lock CHAR(1) NOT NULL DEFAULT 'X' UNIQUE CHECK (lock='X'),
+		event_nid BIGINT NOT NULL
+	);
+	`)
+	var cursor int64
+	err := db.Get(&cursor, `SELECT COALESCE(MAX(event_nid), 0) FROM syncv3_event_archive_cursor`)
+	if err != nil {
+		logger.Panic().Err(err).Msg("failed to select event archive cursor")
+	}
+	cache := ttlcache.NewCache()
+	cache.SetTTL(eventArchiveCacheTTL)
+	cache.SetCacheSizeLimit(eventArchiveCacheSize)
+	return &EventArchive{
+		db:      db,
+		objects: objects,
+		cache:   cache,
+		mu:      &sync.Mutex{},
+		cursor:  cursor,
+	}
+}
+
+// Archive moves events with an origin_server_ts before the given time to the object store.
+// Events are considered in NID order, stopping at the first event which is too recent. Returns the
+// number of events archived.
+func (a *EventArchive) Archive(ctx context.Context, before time.Time) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	total := 0
+	for {
+		numArchived, done, err := a.archiveBatch(ctx, before)
+		total += numArchived
+		if err != nil || done {
+			return total, err
+		}
+	}
+}
+
+func (a *EventArchive) archiveBatch(ctx context.Context, before time.Time) (numArchived int, done bool, err error) {
+	var candidates []struct {
+		NID        int64  `db:"event_nid"`
+		RoomID     string `db:"room_id"`
+		JSON       []byte `db:"event"`
+		Superseded bool   `db:"superseded"`
+	}
+	err = sqlutil.SelectContext(ctx, a.db, "SelectArchivableEvents", &candidates, `
+	SELECT e.event_nid, e.room_id, e.event, EXISTS(
+		SELECT 1 FROM syncv3_events n WHERE n.event_type = e.event_type AND n.room_id = e.room_id AND n.event_nid > e.event_nid
+	) AS superseded
+	FROM syncv3_events e WHERE e.event_nid > $1 AND e.is_state = FALSE AND e.archive_id IS NULL
+	ORDER BY e.event_nid ASC LIMIT $2`, a.cursor, eventArchiveBatchSize)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to select events to archive: %w", err)
+	}
+	done = len(candidates) < eventArchiveBatchSize
+	cursor := a.cursor
+	// Each room's events go in their own object, so that purging a room can delete its objects.
+	archives := make(map[string]map[string]json.RawMessage)
+	var roomIDs []string
+	for _, c := range candidates {
+		if gjson.GetBytes(c.JSON, "origin_server_ts").Int() >= before.UnixMilli() {
+			done = true
+			break
+		}
+		cursor = c.NID
+		if !c.Superseded || gjson.GetBytes(c.JSON, "state_key").Exists() {
+			continue
+		}
+		archive, ok := archives[c.RoomID]
+		if !ok {
+			archive = make(map[string]json.RawMessage)
+			archives[c.RoomID] = archive
+			roomIDs = append(roomIDs, c.RoomID)
+		}
+		archive[strconv.FormatInt(c.NID, 10)] = c.JSON
+	}
+	for _, roomID := range roomIDs {
+		n, err := a.archiveRoomEvents(ctx, roomID, archives[roomID])
+		if err != nil {
+			return numArchived, false, err
+		}
+		numArchived += n
+	}
+	if cursor != a.cursor {
+		_, err = a.db.ExecContext(ctx, `INSERT INTO syncv3_event_archive_cursor(event_nid) VALUES($1)
+		ON CONFLICT (lock) DO UPDATE SET event_nid = $1`, cursor)
+		if err != nil {
+			return numArchived, false, fmt.Errorf("failed to update archive cursor: %w", err)
+		}
+		a.cursor = cursor
+	}
+	return numArchived, done, nil
+}
+
+// archiveRoomEvents uploads the given events from one room, keyed by NID, as a new object and
+// empties them in the database. Returns the number of events archived.
+func (a *EventArchive) archiveRoomEvents(ctx context.Context, roomID string, archive map[string]json.RawMessage) (numArchived int, err error) {
+	nids := make([]int64, 0, len(archive))
+	for nid := range archive {
+		n, _ := strconv.ParseInt(nid, 10, 64)
+		nids = append(nids, n)
+	}
+	data, err := encodeArchive(archive)
+	if err != nil {
+		return 0, err
+	}
+	var archiveID int64
+	if err = a.db.GetContext(ctx, &archiveID, `SELECT nextval('syncv3_event_archive_ids_seq')`); err != nil {
+		return 0, fmt.Errorf("failed to allocate archive ID: %w", err)
+	}
+	objectKey := fmt.Sprintf("events/%d.json.gz", archiveID)
+	// Upload first: if we fail after this, the object is orphaned but no events are lost.
+	if err = a.objects.Put(ctx, objectKey, data); err != nil {
+		return 0, fmt.Errorf("failed to upload %s: %w", objectKey, err)
+	}
+
+	err = sqlutil.WithTransactionContext(ctx, a.db, func(txn *sqlx.Tx) error {
+		// Events may have been redacted or erased since we read them, in which case the archived
+		// copy is stale: leave them where they are.
+		var current []Event
+		err := txn.SelectContext(ctx, &current, `SELECT event_nid, event FROM syncv3_events
+		WHERE event_nid = ANY($1) AND archive_id IS NULL FOR UPDATE`, pq.Int64Array(nids))
+		if err != nil {
+			return fmt.Errorf("failed to lock events: %w", err)
+		}
+		var unchanged []int64
+		for _, ev := range current {
+			if bytes.Equal(ev.JSON, archive[strconv.FormatInt(ev.NID, 10)]) {
+				unchanged = append(unchanged, ev.NID)
+			}
+		}
+		if len(unchanged) == 0 {
+			return nil
+		}
+		_, err = txn.ExecContext(ctx, `INSERT INTO syncv3_event_archives(archive_id, room_id, object_key, num_events, created_ts)
+		VALUES($1, $2, $3, $4, $5)`, archiveID, roomID, objectKey, len(unchanged), time.Now().UnixMilli())
+		if err != nil {
+			return fmt.Errorf("failed to insert archive: %w", err)
+		}
+		_, err = txn.ExecContext(ctx, `UPDATE syncv3_events SET event = '', archive_id = $1 WHERE event_nid = ANY($2)`,
+			archiveID, pq.Int64Array(unchanged))
+		if err != nil {
+			return fmt.Errorf("failed to mark events as archived: %w", err)
+		}
+		numArchived = len(unchanged)
+		return nil
+	})
+	return numArchived, err
+}
+
+// RemoveRoom deletes every archived event in the room from the object store and the manifest.
+// It must be called in the same transaction which deletes the room's events, before they are
+// deleted: if the transaction is rolled back the events will fail to load, but calling it again
+// will finish the job.
+func (a *EventArchive) RemoveRoom(ctx context.Context, txn *sqlx.Tx, roomID string) (numObjects int, err error) {
+	var archives []struct {
+		ArchiveID int64  `db:"archive_id"`
+		ObjectKey string `db:"object_key"`
+	}
+	err = txn.SelectContext(ctx, &archives, `SELECT archive_id, object_key FROM syncv3_event_archives WHERE room_id = $1 FOR UPDATE`, roomID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to select archives: %w", err)
+	}
+	for _, archive := range archives {
+		if err = a.objects.Delete(ctx, archive.ObjectKey); err != nil {
+			return numObjects, fmt.Errorf("failed to delete %s: %w", archive.ObjectKey, err)
+		}
+		a.cache.Remove(strconv.FormatInt(archive.ArchiveID, 10))
+		numObjects++
+	}
+	_, err = txn.ExecContext(ctx, `DELETE FROM syncv3_event_archives WHERE room_id = $1`, roomID)
+	if err != nil {
+		return numObjects, fmt.Errorf("failed to delete archives: %w", err)
+	}
+	// archives made before they were per-room may also contain events from this room
+	var nids []int64
+	err = txn.SelectContext(ctx, &nids, `SELECT event_nid FROM syncv3_events WHERE room_id = $1 AND archive_id IS NOT NULL`, roomID)
+	if err != nil {
+		return numObjects, fmt.Errorf("failed to select archived events: %w", err)
+	}
+	n, err := a.Remove(ctx, txn, nids)
+	return numObjects + n, err
+}
+
+// Remove deletes the given events from the archive, rewriting the objects which contain them.
+// It must be called in the same transaction which deletes or unarchives the events in
+// syncv3_events. Events which are not archived are ignored. Returns the number of objects changed.
+//
+// Objects are rewritten whilst holding a lock on their manifest row, so concurrent removals from
+// the same object don't overwrite each other.
+func (a *EventArchive) Remove(ctx context.Context, txn *sqlx.Tx, nids []int64) (numObjects int, err error) {
+	if len(nids) == 0 {
+		return 0, nil
+	}
+	var rows []struct {
+		NID       int64  `db:"event_nid"`
+		ArchiveID int64  `db:"archive_id"`
+		ObjectKey string `db:"object_key"`
+	}
+	err = txn.SelectContext(ctx, &rows, `SELECT e.event_nid, a.archive_id, a.object_key
+	FROM syncv3_events e JOIN syncv3_event_archives a USING(archive_id) WHERE e.event_nid = ANY($1)
+	FOR UPDATE OF a`, pq.Int64Array(nids))
+	if err != nil {
+		return 0, fmt.Errorf("failed to select archives: %w", err)
+	}
+	removed := make(map[int64][]int64)
+	objectKeys := make(map[int64]string)
+	for _, row := range rows {
+		removed[row.ArchiveID] = append(removed[row.ArchiveID], row.NID)
+		objectKeys[row.ArchiveID] = row.ObjectKey
+	}
+	for archiveID, removedNIDs := range removed {
+		evs, err := a.fetch(ctx, archiveID, objectKeys[archiveID])
+		if err != nil {
+			return numObjects, err
+		}
+		remaining := make(map[string]json.RawMessage, len(evs))
+		for nid, ev := range evs {
+			remaining[strconv.FormatInt(nid, 10)] = ev
+		}
+		for _, nid := range removedNIDs {
+			delete(remaining, strconv.FormatInt(nid, 10))
+		}
+		if len(remaining) == 0 {
+			err = a.objects.Delete(ctx, objectKeys[archiveID])
+			if err == nil {
+				_, err = txn.ExecContext(ctx, `DELETE FROM syncv3_event_archives WHERE archive_id = $1`, archiveID)
+			}
+		} else {
+			var data []byte
+			data, err = encodeArchive(remaining)
+			if err == nil {
+				err = a.objects.Put(ctx, objectKeys[archiveID], data)
+			}
+			if err == nil {
+				_, err = txn.ExecContext(ctx, `UPDATE syncv3_event_archives SET num_events = $1 WHERE archive_id = $2`, len(remaining), archiveID)
+			}
+		}
+		a.cache.Remove(strconv.FormatInt(archiveID, 10))
+		if err != nil {
+			return numObjects, fmt.Errorf("failed to remove events from archive %d: %w", archiveID, err)
+		}
+		numObjects++
+	}
+	return numObjects, nil
+}
+
+// encodeArchive returns the gzipped JSON of an archive object, which maps NIDs to events.
+func encodeArchive(archive map[string]json.RawMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(archive); err != nil {
+		return nil, fmt.Errorf("failed to encode events: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress events: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// load fills in the JSON of any of the given events which have been archived, matching them by NID.
+func (a *EventArchive) load(ctx context.Context, q sqlx.QueryerContext, events []Event) error {
+	var nids []int64
+	for i := range events {
+		if len(events[i].JSON) == 0 {
+			nids = append(nids, events[i].NID)
+		}
+	}
+	if len(nids) == 0 {
+		return nil
+	}
+	var rows []struct {
+		NID       int64  `db:"event_nid"`
+		ArchiveID int64  `db:"archive_id"`
+		ObjectKey string `db:"object_key"`
+	}
+	err := sqlutil.SelectContext(ctx, q, "SelectArchivedEvents", &rows, `SELECT e.event_nid, a.archive_id, a.object_key
+	FROM syncv3_events e JOIN syncv3_event_archives a USING(archive_id) WHERE e.event_nid = ANY($1)`, pq.Int64Array(nids))
+	if err != nil {
+		return fmt.Errorf("failed to select archives: %w", err)
+	}
+	archived := make(map[int64]json.RawMessage, len(rows))
+	for _, row := range rows {
+		evs, err := a.fetch(ctx, row.ArchiveID, row.ObjectKey)
+		if err != nil {
+			return err
+		}
+		ev, ok := evs[row.NID]
+		if !ok {
+			return fmt.Errorf("archive %d is missing event %d", row.ArchiveID, row.NID)
+		}
+		archived[row.NID] = ev
+	}
+	for i := range events {
+		if ev, ok := archived[events[i].NID]; ok {
+			events[i].JSON = ev
+		}
+	}
+	return nil
+}
+
+// fetch returns the events in an archive by NID, from the cache if possible.
+func (a *EventArchive) fetch(ctx context.Context, archiveID int64, objectKey string) (map[int64]json.RawMessage, error) {
+	cacheKey := strconv.FormatInt(archiveID, 10)
+	if cached, err := a.cache.Get(cacheKey); err == nil {
+		return cached.(map[int64]json.RawMessage), nil
+	}
+	data, err := a.objects.Get(ctx, objectKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch archive %d: %w", archiveID, err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress archive %d: %w", archiveID, err)
+	}
+	decompressed, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress archive %d: %w", archiveID, err)
+	}
+	var byNID map[string]json.RawMessage
+	if err = json.Unmarshal(decompressed, &byNID); err != nil {
+		return nil, fmt.Errorf("failed to decode archive %d: %w", archiveID, err)
+	}
+	evs := make(map[int64]json.RawMessage, len(byNID))
+	for nid, ev := range byNID {
+		n, err := strconv.ParseInt(nid, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("archive %d has invalid event NID %q", archiveID, nid)
+		}
+		evs[n] = ev
+	}
+	_ = a.cache.Set(cacheKey, evs)
+	return evs, nil
+}
@@ -0,0 +1,153 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+type memoryObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	gets    int
+}
+
+func (s *memoryObjectStore) Put(ctx context.Context, key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+	return nil
+}
+
+func (s *memoryObjectStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gets++
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, internal.ErrObjectNotFound
+	}
+	return data, nil
+}
+
+func (s *memoryObjectStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func TestEventArchive(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	objects := &memoryObjectStore{objects: make(map[string][]byte)}
+	store.SetEventArchive(objects)
+	// only consider the events made by this test
+	latestNID, err := store.LatestEventNID()
+	assertNoError(t, err)
+	store.EventArchive.cursor = latestNID
+
+	roomID := "!TestEventArchive:localhost"
+	alice := "@alice_TestEventArchive:localhost"
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err = store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}, testutils.WithTimestamp(old)),
+		testutils.NewJoinEvent(t, alice, testutils.WithTimestamp(old)),
+	})
+	assertNoError(t, err)
+	var timeline []json.RawMessage
+	var eventIDs []string
+	for i := 0; i < 5; i++ {
+		ev := testutils.NewMessageEvent(t, alice, "old message", testutils.WithTimestamp(old.Add(time.Duration(i+1)*time.Minute)))
+		timeline = append(timeline, ev)
+		eventIDs = append(eventIDs, gjson.GetBytes(ev, "event_id").Str)
+	}
+	timeline = append(timeline, testutils.NewStateEvent(
+		t, "m.room.topic", "", alice, map[string]interface{}{"topic": "old topic"}, testutils.WithTimestamp(old.Add(10*time.Minute)),
+	))
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: timeline})
+	assertNoError(t, err)
+	before, err := store.EventsTable.SelectByIDs(nil, true, eventIDs)
+	assertNoError(t, err)
+
+	// the latest message and the topic stay in the database
+	numArchived, err := store.EventArchive.Archive(context.Background(), old.Add(24*time.Hour))
+	assertNoError(t, err)
+	assertValue(t, "numArchived", numArchived, 4)
+	var emptied int
+	assertNoError(t, store.DB.Get(&emptied, `SELECT count(*) FROM syncv3_events WHERE room_id = $1 AND event = '' AND archive_id IS NOT NULL`, roomID))
+	assertValue(t, "archived events in the database", emptied, 4)
+	assertValue(t, "objects", len(objects.objects), 1)
+
+	// archived events are loaded transparently, and the object is cached
+	for i := 0; i < 2; i++ {
+		after, err := store.EventsTable.SelectByIDs(nil, true, eventIDs)
+		assertNoError(t, err)
+		for j := range before {
+			assertValue(t, "event JSON", string(after[j].JSON), string(before[j].JSON))
+		}
+	}
+	assertValue(t, "object store gets", objects.gets, 1)
+	err = sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) error {
+		latest, err := store.EventsTable.SelectLatestEventsBetween(context.Background(), txn, roomID, latestNID, EventsEnd, 10)
+		if err != nil {
+			return err
+		}
+		for _, ev := range latest {
+			if len(ev.JSON) == 0 {
+				t.Errorf("SelectLatestEventsBetween: event %d has no JSON", ev.NID)
+			}
+		}
+		return nil
+	})
+	assertNoError(t, err)
+
+	// archiving again does nothing
+	numArchived, err = store.EventArchive.Archive(context.Background(), old.Add(24*time.Hour))
+	assertNoError(t, err)
+	assertValue(t, "numArchived", numArchived, 0)
+
+	// redacting an archived event brings it back into the database
+	err = sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) error {
+		return store.EventsTable.Redact(txn, "10", map[string]*Event{
+			eventIDs[0]: {JSON: testutils.NewEvent(t, "m.room.redaction", alice, map[string]interface{}{"redacts": eventIDs[0]})},
+		})
+	})
+	assertNoError(t, err)
+	var archiveID *int64
+	assertNoError(t, store.DB.Get(&archiveID, `SELECT archive_id FROM syncv3_events WHERE event_id = $1`, eventIDs[0]))
+	if archiveID != nil {
+		t.Errorf("redacted event still has archive ID %d", *archiveID)
+	}
+	redacted, err := store.EventsTable.SelectByIDs(nil, true, eventIDs[:1])
+	assertNoError(t, err)
+	if gjson.GetBytes(redacted[0].JSON, "content.body").Exists() {
+		t.Errorf("redacted event still has a body: %s", redacted[0].JSON)
+	}
+	// ...and removes it from the object store
+	var numEvents int
+	assertNoError(t, store.DB.Get(&numEvents, `SELECT num_events FROM syncv3_event_archives WHERE room_id = $1`, roomID))
+	assertValue(t, "archived events after redaction", numEvents, 3)
+
+	// the cursor survives restarts
+	assertValue(t, "persisted cursor", NewEventArchive(store.DB, objects).cursor, store.EventArchive.cursor)
+
+	// purging the room deletes its archived events from the object store
+	res, err := store.PurgeRoom(roomID)
+	assertNoError(t, err)
+	assertValue(t, "res.NumArchives", res.NumArchives, 1)
+	assertValue(t, "objects after purge", len(objects.objects), 0)
+	var numArchives int
+	assertNoError(t, store.DB.Get(&numArchives, `SELECT count(*) FROM syncv3_event_archives WHERE room_id = $1`, roomID))
+	assertValue(t, "archives after purge", numArchives, 0)
+}
@@ -1,6 +1,7 @@
 package state
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -44,7 +45,13 @@ type Event struct {
 }
 
 func (ev *Event) ensureFieldsSetOnEvent() error {
+	if !gjson.ValidBytes(ev.JSON) {
+		return fmt.Errorf("event is not valid JSON")
+	}
 	evJSON := gjson.ParseBytes(ev.JSON)
+	if !evJSON.IsObject() {
+		return fmt.Errorf("event JSON is not an object")
+	}
 	if ev.RoomID == "" {
 		roomIDResult := evJSON.Get("room_id")
 		if !roomIDResult.Exists() || roomIDResult.Str == "" {
@@ -108,6 +115,8 @@ type membershipEvent struct {
 // EventTable stores events. A unique numeric ID is associated with each event.
 type EventTable struct {
 	db *sqlx.DB
+	// archive loads events which have been archived, if set. See Storage.SetEventArchive.
+	archive *EventArchive
 }
 
 // NewEventTable makes a new EventTable
@@ -130,7 +139,9 @@ func NewEventTable(db *sqlx.DB) *EventTable {
 		event BYTEA NOT NULL,
 		-- True iff this event was seen at the start of the timeline in a limited sync
 		-- (i.e. the preceding timeline event was not known to the proxy).
-		missing_previous BOOLEAN NOT NULL DEFAULT FALSE
+		missing_previous BOOLEAN NOT NULL DEFAULT FALSE,
+		-- Set iff the JSON of this event has been moved to the event archive, in which case event is empty.
+		archive_id BIGINT
 	);
 
 	-- index for querying all joined rooms for a given user
@@ -142,7 +153,7 @@ func NewEventTable(db *sqlx.DB) *EventTable {
 
 	CREATE UNIQUE INDEX IF NOT EXISTS syncv3_events_room_event_nid_type_skey_idx ON syncv3_events(event_nid, event_type, state_key);
 	`)
-	return &EventTable{db}
+	return &EventTable{db: db}
 }
 
 func (t *EventTable) SelectHighestNID() (highest int64, err error) {
@@ -161,7 +172,7 @@ func (t *EventTable) SelectHighestNID() (highest int64, err error) {
 // we insert new events A and B in that order, then NID(A) < NID(B).
 func (t *EventTable) Insert(txn *sqlx.Tx, events []Event, checkFields bool) (map[string]int64, error) {
 	if checkFields {
-		events = filterAndEnsureFieldsSet(events)
+		events, _ = filterAndEnsureFieldsSet(events)
 	}
 	result := make(map[string]int64)
 	for i := range events {
@@ -213,6 +224,17 @@ func (t *EventTable) selectAny(txn *sqlx.Tx, numWanted int, queryStr string, pqA
 	return
 }
 
+// loadArchived fills in the JSON of any events which have been moved to the event archive.
+func (t *EventTable) loadArchived(ctx context.Context, txn *sqlx.Tx, events []Event) error {
+	if t.archive == nil {
+		return nil
+	}
+	if txn != nil {
+		return t.archive.load(ctx, txn, events)
+	}
+	return t.archive.load(ctx, t.db, events)
+}
+
 // SelectByNIDs fetches events from the events table by their nids. The returned events
 // are ordered by ascending nid; the order of the input nids is ignored. If verifyAll
 // is true, we return an error if the number of events returned doesn't match the number
@@ -222,9 +244,13 @@ func (t *EventTable) SelectByNIDs(txn *sqlx.Tx, verifyAll bool, nids []int64) (e
 	if verifyAll {
 		wanted = len(nids)
 	}
-	return t.selectAny(txn, wanted, `
+	events, err = t.selectAny(txn, wanted, `
 	SELECT event_nid, event_id, event, event_type, state_key, room_id, before_state_snapshot_id, membership, event_replaces_nid, missing_previous FROM syncv3_events
 	WHERE event_nid = ANY ($1) ORDER BY event_nid ASC;`, pq.Int64Array(nids))
+	if err != nil {
+		return nil, err
+	}
+	return events, t.loadArchived(context.Background(), txn, events)
 }
 
 // SelectByIDs fetches all events with the given event IDs from the DB as Event structs.
@@ -236,9 +262,13 @@ func (t *EventTable) SelectByIDs(txn *sqlx.Tx, verifyAll bool, ids []string) (ev
 	if verifyAll {
 		wanted = len(ids)
 	}
-	return t.selectAny(txn, wanted, `
+	events, err = t.selectAny(txn, wanted, `
 	SELECT event_nid, event_id, event, event_type, state_key, room_id, before_state_snapshot_id, membership, missing_previous FROM syncv3_events
 	WHERE event_id = ANY ($1) ORDER BY event_nid ASC;`, pq.StringArray(ids))
+	if err != nil {
+		return nil, err
+	}
+	return events, t.loadArchived(context.Background(), txn, events)
 }
 
 // SelectNIDsByIDs does just that. Returns a map from event ID to nid, with a key-value
@@ -345,7 +375,48 @@ FROM room_ids,
 	if err == sql.ErrNoRows {
 		err = nil
 	}
-	return
+	if err != nil {
+		return nil, err
+	}
+	return events, t.loadArchived(context.Background(), txn, events)
+}
+
+// LatestEventInRoomsAtPositions is like LatestEventInRooms, but each room has its own highest event NID.
+func (t *EventTable) LatestEventInRoomsAtPositions(txn *sqlx.Tx, roomToHighestNID map[string]int64) (events []Event, err error) {
+	roomIDs := make([]string, 0, len(roomToHighestNID))
+	highestNIDs := make([]int64, 0, len(roomToHighestNID))
+	for roomID, highestNID := range roomToHighestNID {
+		roomIDs = append(roomIDs, roomID)
+		highestNIDs = append(highestNIDs, highestNID)
+	}
+	err = txn.Select(
+		&events,
+		`
+WITH room_ids AS (
+    select unnest($1::text[]) AS room_id, unnest($2::bigint[]) AS highest_nid
+),
+max_ev_nid AS (
+	SELECT * 
+	FROM room_ids,
+    	LATERAL (
+        	SELECT max(event_nid) FROM syncv3_events e WHERE e.room_id = room_ids.room_id AND event_nid <= room_ids.highest_nid
+            ) AS x)
+SELECT evs.*
+FROM max_ev_nid,
+     LATERAL (
+         SELECT event_nid, room_id, event_replaces_nid, before_state_snapshot_id, event_type, state_key, event
+         FROM syncv3_events e
+         WHERE e.event_nid = max_ev_nid.max AND max_ev_nid.room_id = e.room_id
+         ) AS evs`,
+		pq.StringArray(roomIDs), pq.Int64Array(highestNIDs),
+	)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return events, t.loadArchived(context.Background(), txn, events)
 }
 
 // LatestEventNIDInRooms queries the latest events in each of the room IDs given, using highestNID as the highest event.
@@ -354,10 +425,10 @@ FROM room_ids,
 //
 //  1. Create a list of the passed in roomIDs (`room_ids` CTE)
 //  2. Fetches the latest eventNIDs for each room using the data provided from room_ids (the `evs` LATERAL)
-func (t *EventTable) LatestEventNIDInRooms(txn *sqlx.Tx, roomIDs []string, highestNID int64) (roomToNID map[string]int64, err error) {
+func (t *EventTable) LatestEventNIDInRooms(ctx context.Context, txn *sqlx.Tx, roomIDs []string, highestNID int64) (roomToNID map[string]int64, err error) {
 	var events []Event
-	err = txn.Select(
-		&events,
+	err = sqlutil.SelectContext(
+		ctx, txn, "LatestEventNIDInRooms", &events,
 		`
 WITH room_ids AS (
     select unnest($1::text[]) AS room_id
@@ -397,6 +468,16 @@ func (t *EventTable) Redact(txn *sqlx.Tx, roomVer string, redacteeEventIDToRedac
 			"Redact: GetRoomVersion: unknown room version, defaulting to v1",
 		)
 	}
+	if t.archive != nil {
+		// the unredacted JSON of archived events must not survive in the object store
+		nids := make([]int64, len(eventsToRedact))
+		for i := range eventsToRedact {
+			nids[i] = eventsToRedact[i].NID
+		}
+		if _, err = t.archive.Remove(context.Background(), txn, nids); err != nil {
+			return fmt.Errorf("EventTable.Redact[%v]: %w", eventIDs, err)
+		}
+	}
 	for i := range eventsToRedact {
 		eventsToRedact[i].JSON, err = rv.RedactEventJSON(eventsToRedact[i].JSON)
 		if err != nil {
@@ -409,7 +490,7 @@ func (t *EventTable) Redact(txn *sqlx.Tx, roomVer string, redacteeEventIDToRedac
 		if err != nil {
 			return fmt.Errorf("RedactEventJSON[%s]: setting redacted_because %w", eventsToRedact[i].ID, err)
 		}
-		_, err = txn.Exec(`UPDATE syncv3_events SET event=$1 WHERE event_id=$2`, eventsToRedact[i].JSON, eventsToRedact[i].ID)
+		_, err = txn.Exec(`UPDATE syncv3_events SET event=$1, archive_id=NULL WHERE event_id=$2`, eventsToRedact[i].JSON, eventsToRedact[i].ID)
 		if err != nil {
 			return fmt.Errorf("cannot update event %s: %w", eventsToRedact[i].ID, err)
 		}
@@ -417,15 +498,32 @@ func (t *EventTable) Redact(txn *sqlx.Tx, roomVer string, redacteeEventIDToRedac
 	return nil
 }
 
-func (t *EventTable) SelectLatestEventsBetween(txn *sqlx.Tx, roomID string, lowerExclusive, upperInclusive int64, limit int) ([]Event, error) {
+func (t *EventTable) SelectLatestEventsBetween(ctx context.Context, txn *sqlx.Tx, roomID string, lowerExclusive, upperInclusive int64, limit int) ([]Event, error) {
+	return t.SelectLatestEventsBetweenOfTypes(ctx, txn, roomID, lowerExclusive, upperInclusive, limit, internal.EventTypeFilter{})
+}
+
+// SelectLatestEventsBetweenOfTypes is like SelectLatestEventsBetween but only returns events which
+// match the filter, up to the limit.
+func (t *EventTable) SelectLatestEventsBetweenOfTypes(
+	ctx context.Context, txn *sqlx.Tx, roomID string, lowerExclusive, upperInclusive int64, limit int, filter internal.EventTypeFilter,
+) ([]Event, error) {
 	var events []Event
 	// do not pull in events which were in the v2 state block
-	err := txn.Select(&events, `SELECT event_nid, event, missing_previous FROM syncv3_events WHERE event_nid > $1 AND event_nid <= $2 AND room_id = $3 AND is_state=FALSE ORDER BY event_nid DESC LIMIT $4`,
-		lowerExclusive, upperInclusive, roomID, limit,
-	)
+	query := `SELECT event_nid, event_type, event, missing_previous FROM syncv3_events WHERE event_nid > $1 AND event_nid <= $2 AND room_id = $3 AND is_state=FALSE`
+	args := []interface{}{lowerExclusive, upperInclusive, roomID, limit}
+	if !filter.IsEmpty() {
+		// Events after a gap are always selected, even if they don't match, so the timeline is
+		// still cut short at the gap below. They are removed afterwards.
+		query += ` AND (missing_previous OR ((cardinality($5::text[]) = 0 OR event_type = ANY($5)) AND event_type <> ALL($6)))`
+		args = append(args, pq.StringArray(append([]string{}, filter.Types...)), pq.StringArray(append([]string{}, filter.NotTypes...)))
+	}
+	err := sqlutil.SelectContext(ctx, txn, "SelectLatestEventsBetween", &events, query+` ORDER BY event_nid DESC LIMIT $4`, args...)
 	if err != nil {
 		return nil, err
 	}
+	if err = t.loadArchived(ctx, txn, events); err != nil {
+		return nil, err
+	}
 
 	// Look to see if there is an event missing its predecessor in the timeline.
 	// Note: events[0] is the newest event, as the query is ORDERed BY event_nid DESC.
@@ -435,10 +533,24 @@ func (t *EventTable) SelectLatestEventsBetween(txn *sqlx.Tx, roomID string, lowe
 			break
 		}
 	}
+	if !filter.IsEmpty() {
+		matching := events[:0]
+		for _, ev := range events {
+			if filter.Matches(ev.Type) {
+				matching = append(matching, ev)
+			}
+		}
+		events = matching
+	}
 
 	return events, err
 }
 
+// bumpingEventClause matches the events in syncv3_events e which count towards the recency of their
+// room. Edits and redacted events don't: they change or remove existing messages.
+const bumpingEventClause = `NOT EXISTS (SELECT 1 FROM syncv3_event_relations r WHERE r.event_nid = e.event_nid AND r.rel_type = 'm.replace')
+	AND position('"redacted_because"'::bytea IN e.event) = 0`
+
 func (t *EventTable) selectLatestEventByTypeInAllRooms(txn *sqlx.Tx) ([]Event, error) {
 	result := []Event{}
 	// What the following query does:
@@ -460,7 +572,8 @@ WITH event_types AS (
     SELECT DISTINCT room_id FROM syncv3_rooms
 ), max_by_ev_type AS (
     SELECT m.max FROM event_types, room_ids,
-    LATERAL ( SELECT max(event_nid) as max FROM syncv3_events e WHERE e.room_id = room_ids.room_id AND e.event_type = event_types.event_type ) AS m
+    LATERAL ( SELECT max(event_nid) as max FROM syncv3_events e WHERE e.room_id = room_ids.room_id AND e.event_type = event_types.event_type
+        AND ` + bumpingEventClause + ` ) AS m
 )
 SELECT room_id, event_nid, event FROM syncv3_events, max_by_ev_type WHERE event_nid = max_by_ev_type.max
 `,
@@ -476,20 +589,74 @@ SELECT room_id, event_nid, event FROM syncv3_events, max_by_ev_type WHERE event_
 		}
 		result = append(result, ev)
 	}
-	return result, nil
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, t.loadArchived(context.Background(), txn, result)
+}
+
+// selectLatestEventByTypeInRooms is like selectLatestEventByTypeInAllRooms but only for the given rooms.
+// Reads every event in these rooms, so should only be used for a small number of rooms.
+func (t *EventTable) selectLatestEventByTypeInRooms(txn *sqlx.Tx, roomIDs []string) ([]Event, error) {
+	var result []Event
+	err := txn.Select(&result, `SELECT DISTINCT ON (room_id, event_type) room_id, event_nid, event FROM syncv3_events e
+	WHERE room_id = ANY($1) AND `+bumpingEventClause+`
+	ORDER BY room_id, event_type, event_nid DESC`, pq.StringArray(roomIDs))
+	if err != nil {
+		return nil, err
+	}
+	return result, t.loadArchived(context.Background(), txn, result)
+}
+
+// selectLatestEventOfTypeInRoom returns the latest event of this type in the room which counts
+// towards its recency, or nil if there is no such event.
+func (t *EventTable) selectLatestEventOfTypeInRoom(txn *sqlx.Tx, roomID, evType string) (*Event, error) {
+	var result []Event
+	err := txn.Select(&result, `SELECT room_id, event_nid, event FROM syncv3_events e
+	WHERE room_id = $1 AND event_type = $2 AND `+bumpingEventClause+`
+	ORDER BY event_nid DESC LIMIT 1`, roomID, evType)
+	if err != nil || len(result) == 0 {
+		return nil, err
+	}
+	return &result[0], t.loadArchived(context.Background(), txn, result)
+}
+
+// SelectLatestEventsOfTypesAtPositions returns the latest event of one of these types in each room
+// at or before the room's position, skipping events which don't count towards the recency of the room.
+// Rooms without such an event are not included.
+func (t *EventTable) SelectLatestEventsOfTypesAtPositions(ctx context.Context, txn *sqlx.Tx, roomToPos map[string]int64, evTypes []string) ([]Event, error) {
+	roomIDs := make([]string, 0, len(roomToPos))
+	positions := make([]int64, 0, len(roomToPos))
+	for roomID, pos := range roomToPos {
+		roomIDs = append(roomIDs, roomID)
+		positions = append(positions, pos)
+	}
+	var result []Event
+	err := sqlutil.SelectContext(ctx, txn, "SelectLatestEventsOfTypesAtPositions", &result, `
+	SELECT DISTINCT ON (e.room_id) e.room_id, e.event_nid, e.event_id, e.event_type, e.event FROM syncv3_events e
+	JOIN unnest($1::text[], $2::bigint[]) AS pos(room_id, event_nid) ON e.room_id = pos.room_id AND e.event_nid <= pos.event_nid
+	WHERE e.event_type = ANY($3) AND `+bumpingEventClause+`
+	ORDER BY e.room_id, e.event_nid DESC`, pq.StringArray(roomIDs), pq.Int64Array(positions), pq.StringArray(evTypes))
+	if err != nil {
+		return nil, err
+	}
+	return result, t.loadArchived(ctx, txn, result)
 }
 
 // Select all events between the bounds matching the type, state_key given.
 // Used to work out which rooms the user was joined to at a given point in time.
-func (t *EventTable) SelectEventsWithTypeStateKey(eventType, stateKey string, lowerExclusive, upperInclusive int64) ([]Event, error) {
+func (t *EventTable) SelectEventsWithTypeStateKey(ctx context.Context, eventType, stateKey string, lowerExclusive, upperInclusive int64) ([]Event, error) {
 	var events []Event
-	err := t.db.Select(&events,
+	err := sqlutil.SelectContext(ctx, t.db, "SelectEventsWithTypeStateKey", &events,
 		`SELECT event_nid, room_id, event FROM syncv3_events
 		WHERE event_nid > $1 AND event_nid <= $2 AND event_type = $3 AND state_key = $4
 		ORDER BY event_nid ASC`,
 		lowerExclusive, upperInclusive, eventType, stateKey,
 	)
-	return events, err
+	if err != nil {
+		return nil, err
+	}
+	return events, t.loadArchived(ctx, nil, events)
 }
 
 // Select all events between the bounds matching the type, state_key given, in the rooms specified only.
@@ -508,7 +675,36 @@ func (t *EventTable) SelectEventsWithTypeStateKeyInRooms(roomIDs []string, event
 	err = t.db.Select(&events,
 		t.db.Rebind(query), args...,
 	)
-	return events, err
+	if err != nil {
+		return nil, err
+	}
+	return events, t.loadArchived(context.Background(), nil, events)
+}
+
+// SelectLatestLeaveNIDs returns the NID of the user's latest membership change in each of the given
+// rooms, if it was a leave or ban. Rooms the user is in, or has no membership events in, are not in the map.
+func (t *EventTable) SelectLatestLeaveNIDs(ctx context.Context, userID string, roomIDs []string) (map[string]int64, error) {
+	var rows []struct {
+		RoomID     string `db:"room_id"`
+		EventNID   int64  `db:"event_nid"`
+		Membership string `db:"membership"`
+	}
+	// profile changes have a _ prefixed membership, so are skipped
+	err := sqlutil.SelectContext(ctx, t.db, "SelectLatestLeaveNIDs", &rows,
+		`SELECT DISTINCT ON (room_id) room_id, event_nid, membership FROM syncv3_events
+		WHERE event_type = 'm.room.member' AND state_key = $1 AND room_id = ANY($2)
+		AND membership IN ('join', 'invite', 'knock', 'leave', 'ban')
+		ORDER BY room_id, event_nid DESC`, userID, pq.StringArray(roomIDs))
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		if row.Membership == "leave" || row.Membership == "ban" {
+			result[row.RoomID] = row.EventNID
+		}
+	}
+	return result, nil
 }
 
 // Select all events matching the given event type in a room. Used to implement the room member stream (paginated room lists)
@@ -548,8 +744,14 @@ func (t *EventTable) SelectClosestPrevBatch(txn *sqlx.Tx, roomID string, eventNI
 func (t *EventTable) SelectCreateEvent(txn *sqlx.Tx, roomID string) (json.RawMessage, error) {
 	var evJSON []byte
 	// there is only 1 create event
-	err := txn.QueryRow(`SELECT event FROM syncv3_events WHERE room_id=$1 AND event_type='m.room.create' AND state_key=''`, roomID).Scan(&evJSON)
-	return evJSON, err
+	var nid int64
+	err := txn.QueryRow(`SELECT event_nid, event FROM syncv3_events WHERE room_id=$1 AND event_type='m.room.create' AND state_key=''`, roomID).Scan(&nid, &evJSON)
+	if err != nil {
+		return nil, err
+	}
+	events := []Event{{NID: nid, JSON: evJSON}}
+	err = t.loadArchived(context.Background(), txn, events)
+	return events[0].JSON, err
 }
 
 type EventChunker []Event
@@ -561,18 +763,20 @@ func (c EventChunker) Subslice(i, j int) sqlutil.Chunker {
 	return c[i:j]
 }
 
-func filterAndEnsureFieldsSet(events []Event) []Event {
-	result := make([]Event, 0, len(events))
+// filterAndEnsureFieldsSet returns the events which have all the required fields, and the rest for quarantining.
+func filterAndEnsureFieldsSet(events []Event) (result []Event, rejected []QuarantinedEvent) {
+	result = make([]Event, 0, len(events))
 	// ensure fields are set
 	for i := range events {
 		ev := &events[i]
 		if err := ev.ensureFieldsSetOnEvent(); err != nil {
-			logger.Warn().Str("event_id", ev.ID).Err(err).Msg(
-				"filterAndEnsureFieldsSet: failed to parse event, ignoring",
+			logger.Warn().Str("event_id", ev.ID).Str("room_id", ev.RoomID).Err(err).Msg(
+				"filterAndEnsureFieldsSet: failed to parse event, quarantining",
 			)
+			rejected = append(rejected, QuarantinedEvent{RoomID: ev.RoomID, JSON: ev.JSON, Reason: err.Error()})
 			continue
 		}
 		result = append(result, *ev)
 	}
-	return result
+	return result, rejected
 }
@@ -2,6 +2,7 @@ package state
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/tidwall/gjson"
 
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sqlutil"
 	"github.com/matrix-org/sliding-sync/testutils"
 )
@@ -472,7 +474,7 @@ func TestEventTableSelectEventsWithTypeStateKey(t *testing.T) {
 		t.Fatalf("failed to select highest nid: %s", err)
 	}
 
-	gotEvents, err := table.SelectEventsWithTypeStateKey("m.room.member", userID, 0, latest)
+	gotEvents, err := table.SelectEventsWithTypeStateKey(context.Background(), "m.room.member", userID, 0, latest)
 	if err != nil {
 		t.Fatalf("SelectEventsWithTypeStateKey: %s", err)
 	}
@@ -835,7 +837,7 @@ func TestLatestEventNIDInRooms(t *testing.T) {
 	for _, tc := range testCases {
 		var gotRoomToNID map[string]int64
 		err = sqlutil.WithTransaction(table.db, func(txn *sqlx.Tx) error {
-			gotRoomToNID, err = table.LatestEventNIDInRooms(txn, tc.roomIDs, int64(tc.highestNID))
+			gotRoomToNID, err = table.LatestEventNIDInRooms(context.Background(), txn, tc.roomIDs, int64(tc.highestNID))
 			return err
 		})
 		assertNoError(t, err)
@@ -1218,7 +1220,7 @@ func TestEventTable_SelectLatestEventsBetween_MissingPrevious(t *testing.T) {
 		// We're using the notation (X, Y] for a half-open interval excluding X but including Y.
 		idRange := fmt.Sprintf("(%s, %s]", tc.FromIDExclusive, tc.ToIDInclusive)
 		t.Log(idRange + " " + tc.Desc)
-		fetched, err := table.SelectLatestEventsBetween(txn, roomID, nids[prefix+tc.FromIDExclusive], nids[prefix+tc.ToIDInclusive], 10)
+		fetched, err := table.SelectLatestEventsBetween(context.Background(), txn, roomID, nids[prefix+tc.FromIDExclusive], nids[prefix+tc.ToIDInclusive], 10)
 		assertNoError(t, err)
 		fetchedIDs := make([]string, 0, len(fetched))
 		for _, ev := range fetched {
@@ -1227,3 +1229,79 @@ func TestEventTable_SelectLatestEventsBetween_MissingPrevious(t *testing.T) {
 		assertValue(t, "fetchedIDs "+idRange+" limit 10", fetchedIDs, tc.ExpectIDs)
 	}
 }
+
+func TestEventTable_SelectLatestEventsBetweenOfTypes(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewEventTable(db)
+	txn, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start txn: %s", err)
+	}
+	defer txn.Rollback()
+	roomID := fmt.Sprintf("!%s", t.Name())
+	// Event IDs ending with `-gap` have MissingPrevious: true.
+	events := []Event{
+		{ID: "msg1", Type: "m.room.message"},
+		{ID: "msg2", Type: "m.room.message"},
+		{ID: "reaction1", Type: "m.reaction"},
+		{ID: "reaction2-gap", Type: "m.reaction", MissingPrevious: true},
+		{ID: "msg3", Type: "m.room.message"},
+		{ID: "reaction3", Type: "m.reaction"},
+		{ID: "reaction4", Type: "m.reaction"},
+		{ID: "msg4", Type: "m.room.message"},
+	}
+	prefix := "$" + t.Name() + "-"
+	for i := range events {
+		events[i].JSON = []byte(fmt.Sprintf(`{"event_id": "%s", "type": "%s"}`, events[i].ID, events[i].Type))
+		events[i].ID = prefix + events[i].ID
+		events[i].RoomID = roomID
+	}
+	nids, err := table.Insert(txn, events, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := nids[prefix+"msg1"] - 1
+	to := nids[prefix+"msg4"]
+
+	testcases := []struct {
+		Desc   string
+		Filter internal.EventTypeFilter
+		Limit  int
+		// newest to oldest, like SelectLatestEventsBetween
+		ExpectIDs []string
+	}{
+		{
+			Desc:      "no filter",
+			Limit:     3,
+			ExpectIDs: []string{"msg4", "reaction4", "reaction3"},
+		},
+		{
+			Desc:      "the limit counts matching events only",
+			Filter:    internal.EventTypeFilter{NotTypes: []string{"m.reaction"}},
+			Limit:     2,
+			ExpectIDs: []string{"msg4", "msg3"},
+		},
+		{
+			Desc:      "the timeline stops at a gap, even if the event after the gap does not match",
+			Filter:    internal.EventTypeFilter{Types: []string{"m.room.message"}},
+			Limit:     10,
+			ExpectIDs: []string{"msg4", "msg3"},
+		},
+		{
+			Desc:      "only reactions",
+			Filter:    internal.EventTypeFilter{Types: []string{"m.reaction"}},
+			Limit:     10,
+			ExpectIDs: []string{"reaction4", "reaction3", "reaction2-gap"},
+		},
+	}
+	for _, tc := range testcases {
+		fetched, err := table.SelectLatestEventsBetweenOfTypes(context.Background(), txn, roomID, from, to, tc.Limit, tc.Filter)
+		assertNoError(t, err)
+		fetchedIDs := make([]string, 0, len(fetched))
+		for _, ev := range fetched {
+			fetchedIDs = append(fetchedIDs, gjson.GetBytes(ev.JSON, "event_id").Str)
+		}
+		assertValue(t, tc.Desc, fetchedIDs, tc.ExpectIDs)
+	}
+}
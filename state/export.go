@@ -0,0 +1,221 @@
+package state
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+// ExportFormat identifies the first line of an export.
+const ExportFormat = "syncv3-export-v1"
+
+// importBatchSize is the number of rows inserted by each statement during an import.
+const importBatchSize = 500
+
+// ExportHeader is the first line of an export. Every following line is an exportRow, with the rows
+// of each table together.
+type ExportHeader struct {
+	Format string `json:"format"`
+	// SchemaVersion is the latest migration applied to the exported database. Exports can only be
+	// imported into a database with the same schema.
+	SchemaVersion int64                     `json:"schema_version"`
+	ExportedAt    time.Time                 `json:"exported_at"`
+	Tables        []string                  `json:"tables"`
+	Sequences     map[string]ExportSequence `json:"sequences"`
+}
+
+// ExportSequence is the state of a sequence, so that event NIDs, to-device positions etc carry on
+// from where they were rather than being reused.
+type ExportSequence struct {
+	LastValue int64 `json:"last_value"`
+	IsCalled  bool  `json:"is_called"`
+}
+
+type exportRow struct {
+	Table string          `json:"table"`
+	Row   json.RawMessage `json:"row"`
+}
+
+// Export writes every row of every proxy table to w, one JSON object per line. The rows are read
+// in a single transaction, so the export is consistent even if the proxy is running, though anything
+// written after the export started is not included. Returns the number of rows exported from each
+// table.
+func Export(ctx context.Context, db *sqlx.DB, schemaVersion int64, w io.Writer) (map[string]int64, error) {
+	txn, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	header := ExportHeader{
+		Format:        ExportFormat,
+		SchemaVersion: schemaVersion,
+		ExportedAt:    time.Now().UTC(),
+		Sequences:     make(map[string]ExportSequence),
+	}
+	if header.Tables, err = proxyTables(ctx, txn); err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	var sequences []string
+	err = txn.SelectContext(ctx, &sequences, `SELECT sequence_name FROM information_schema.sequences
+	WHERE sequence_schema = current_schema() AND sequence_name LIKE 'syncv3\_%' ORDER BY sequence_name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sequences: %w", err)
+	}
+	for _, name := range sequences {
+		var seq ExportSequence
+		err = txn.QueryRowContext(ctx, `SELECT last_value, is_called FROM `+pq.QuoteIdentifier(name)).Scan(&seq.LastValue, &seq.IsCalled)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sequence %s: %w", name, err)
+		}
+		header.Sequences[name] = seq
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err = enc.Encode(header); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(header.Tables))
+	for _, table := range header.Tables {
+		rows, err := txn.QueryContext(ctx, `SELECT row_to_json(t)::text FROM `+pq.QuoteIdentifier(table)+` t`)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export %s: %w", table, err)
+		}
+		for rows.Next() {
+			var row []byte
+			if err = rows.Scan(&row); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to export %s: %w", table, err)
+			}
+			if err = enc.Encode(exportRow{Table: table, Row: row}); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			counts[table]++
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to export %s: %w", table, err)
+		}
+	}
+	return counts, bw.Flush()
+}
+
+// Import reads an export from r into the database, which must have the same schema version as the
+// exported database and no rows in any of the exported tables, e.g because it was created by
+// starting the same version of the proxy against an empty database. The import happens in a
+// single transaction, so the database is left untouched if it fails. Returns the number of rows
+// imported into each table.
+func Import(ctx context.Context, db *sqlx.DB, schemaVersion int64, r io.Reader) (map[string]int64, error) {
+	br := bufio.NewReader(r)
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	var header ExportHeader
+	if err = json.Unmarshal(line, &header); err != nil || header.Format != ExportFormat {
+		return nil, fmt.Errorf("not a %s export", ExportFormat)
+	}
+	if header.SchemaVersion != schemaVersion {
+		return nil, fmt.Errorf(
+			"export has schema version %d but the database has %d: import with the same version of the proxy that exported it",
+			header.SchemaVersion, schemaVersion,
+		)
+	}
+
+	counts := make(map[string]int64, len(header.Tables))
+	err = sqlutil.WithTransactionContext(ctx, db, func(txn *sqlx.Tx) error {
+		tables, err := proxyTables(ctx, txn)
+		if err != nil {
+			return fmt.Errorf("failed to list tables: %w", err)
+		}
+		existing := make(map[string]bool, len(tables))
+		for _, table := range tables {
+			existing[table] = true
+		}
+		for _, table := range header.Tables {
+			if !existing[table] {
+				return fmt.Errorf("table %s does not exist", table)
+			}
+			var hasRows bool
+			if err = txn.GetContext(ctx, &hasRows, `SELECT EXISTS(SELECT 1 FROM `+pq.QuoteIdentifier(table)+`)`); err != nil {
+				return err
+			}
+			if hasRows {
+				return fmt.Errorf("table %s is not empty: imports must be into an empty database", table)
+			}
+		}
+
+		var batch []json.RawMessage
+		var batchTable string
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			rows, err := json.Marshal(batch)
+			if err != nil {
+				return err
+			}
+			quoted := pq.QuoteIdentifier(batchTable)
+			_, err = txn.ExecContext(ctx, `INSERT INTO `+quoted+` SELECT * FROM json_populate_recordset(NULL::`+quoted+`, $1)`, string(rows))
+			if err != nil {
+				return fmt.Errorf("failed to import %s: %w", batchTable, err)
+			}
+			counts[batchTable] += int64(len(batch))
+			batch = batch[:0]
+			return nil
+		}
+		for {
+			line, err := br.ReadBytes('\n')
+			if errors.Is(err, io.EOF) && len(line) == 0 {
+				break
+			} else if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			var row exportRow
+			if err = json.Unmarshal(line, &row); err != nil {
+				return fmt.Errorf("malformed row after %d rows of %s: %w", counts[batchTable]+int64(len(batch)), batchTable, err)
+			}
+			if !existing[row.Table] {
+				return fmt.Errorf("row for unknown table %s", row.Table)
+			}
+			if row.Table != batchTable || len(batch) >= importBatchSize {
+				if err = flush(); err != nil {
+					return err
+				}
+				batchTable = row.Table
+			}
+			batch = append(batch, row.Row)
+		}
+		if err = flush(); err != nil {
+			return err
+		}
+
+		for name, seq := range header.Sequences {
+			if _, err = txn.ExecContext(ctx, `SELECT setval($1, $2, $3)`, name, seq.LastValue, seq.IsCalled); err != nil {
+				return fmt.Errorf("failed to set sequence %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// proxyTables returns the names of the proxy's tables in the current schema.
+func proxyTables(ctx context.Context, txn *sqlx.Tx) ([]string, error) {
+	var tables []string
+	err := txn.SelectContext(ctx, &tables, `SELECT table_name FROM information_schema.tables
+	WHERE table_schema = current_schema() AND table_type = 'BASE TABLE' AND table_name LIKE 'syncv3\_%' ORDER BY table_name`)
+	return tables, err
+}
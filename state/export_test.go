@@ -0,0 +1,77 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestExportImport:localhost"
+	alice := "@alice_export:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	assertNoError(t, err)
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		testutils.NewMessageEvent(t, alice, "hello"),
+	}})
+	assertNoError(t, err)
+
+	var exported bytes.Buffer
+	exportCounts, err := Export(ctx, store.DB, 42, &exported)
+	assertNoError(t, err)
+	if exportCounts["syncv3_events"] < 3 {
+		t.Fatalf("exported %d events, want at least 3", exportCounts["syncv3_events"])
+	}
+
+	// import into an empty schema, created the same way the proxy creates its tables
+	const schema = "syncv3_export_test"
+	_, err = store.DB.Exec(`DROP SCHEMA IF EXISTS ` + schema + ` CASCADE; CREATE SCHEMA ` + schema)
+	assertNoError(t, err)
+	defer store.DB.Exec(`DROP SCHEMA IF EXISTS ` + schema + ` CASCADE`)
+	target, err := sqlx.Open("postgres", postgresConnectionString+" search_path="+schema)
+	assertNoError(t, err)
+	defer target.Close()
+	NewStorageWithDB(target, false)
+	sync2.NewStoreWithDB(target, "secret")
+
+	_, err = Import(ctx, target, 41, bytes.NewReader(exported.Bytes()))
+	if err == nil || !strings.Contains(err.Error(), "schema version") {
+		t.Fatalf("Import with a different schema version: got %v want schema version error", err)
+	}
+	importCounts, err := Import(ctx, target, 42, bytes.NewReader(exported.Bytes()))
+	assertNoError(t, err)
+	for table, count := range exportCounts {
+		assertValue(t, "imported rows in "+table, importCounts[table], count)
+	}
+
+	// the sequences carry on from where they were, so NIDs are not reused
+	var sourceMaxNID, targetNextNID int64
+	assertNoError(t, store.DB.Get(&sourceMaxNID, `SELECT MAX(event_nid) FROM syncv3_events`))
+	assertNoError(t, target.Get(&targetNextNID, `SELECT nextval('syncv3_event_nids_seq')`))
+	if targetNextNID <= sourceMaxNID {
+		t.Errorf("next event NID after import is %d, want > %d", targetNextNID, sourceMaxNID)
+	}
+	var eventID string
+	assertNoError(t, target.Get(&eventID, `SELECT event_id FROM syncv3_events WHERE room_id=$1 ORDER BY event_nid DESC LIMIT 1`, roomID))
+	if eventID == "" {
+		t.Errorf("imported room has no events")
+	}
+
+	_, err = Import(ctx, target, 42, bytes.NewReader(exported.Bytes()))
+	if err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Fatalf("Import into a non-empty database: got %v want not empty error", err)
+	}
+}
@@ -0,0 +1,42 @@
+package state
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// ExpectedIndexes are the indexes which hot queries rely on. An index which failed to build is left
+// behind as an invalid index, so they are checked at startup.
+var ExpectedIndexes = []string{
+	// membership lookups
+	"syncv3_events_type_sk_idx",
+	// selecting the latest events in a room by NID
+	"syncv3_nid_room_state_idx",
+	"syncv3_to_device_messages_created_at_idx",
+	"syncv3_to_device_messages_content_hash_idx",
+	"syncv3_rooms_name_trgm_idx",
+	"syncv3_rooms_canonical_alias_trgm_idx",
+}
+
+// MissingIndexes returns the ExpectedIndexes which do not exist in the current schema, or which
+// exist but are invalid and so cannot be used by queries.
+func MissingIndexes(db *sqlx.DB) ([]string, error) {
+	var valid []string
+	err := db.Select(&valid, `SELECT c.relname FROM pg_class c JOIN pg_index i ON i.indexrelid = c.oid
+	WHERE c.relname = ANY($1) AND c.relnamespace = current_schema()::regnamespace AND i.indisvalid`,
+		pq.StringArray(ExpectedIndexes))
+	if err != nil {
+		return nil, err
+	}
+	validSet := make(map[string]struct{}, len(valid))
+	for _, name := range valid {
+		validSet[name] = struct{}{}
+	}
+	var missing []string
+	for _, name := range ExpectedIndexes {
+		if _, ok := validSet[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,29 @@
+package state
+
+import (
+	"testing"
+)
+
+func TestMissingIndexes(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	// make sure the tables exist
+	NewStorageWithDB(db, false)
+	db.MustExec(`DROP INDEX IF EXISTS syncv3_to_device_messages_created_at_idx`)
+	defer db.MustExec(`CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_created_at_idx ON syncv3_to_device_messages(created_at)`)
+
+	missing, err := MissingIndexes(db)
+	if err != nil {
+		t.Fatalf("MissingIndexes: %s", err)
+	}
+	missingSet := make(map[string]bool)
+	for _, name := range missing {
+		missingSet[name] = true
+	}
+	if missingSet["syncv3_events_type_sk_idx"] {
+		t.Errorf("MissingIndexes reported an existing index as missing: %v", missing)
+	}
+	if !missingSet["syncv3_to_device_messages_created_at_idx"] {
+		t.Errorf("MissingIndexes did not report a missing index: %v", missing)
+	}
+}
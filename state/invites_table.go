@@ -35,7 +35,10 @@ type InvitesTable struct {
 func NewInvitesTable(db *sqlx.DB) *InvitesTable {
 	// make sure tables are made
 	db.MustExec(`
+	CREATE SEQUENCE IF NOT EXISTS syncv3_invites_seq;
 	CREATE TABLE IF NOT EXISTS syncv3_invites (
+		-- bumped whenever the invite is updated
+		id BIGINT NOT NULL DEFAULT nextval('syncv3_invites_seq'),
 		room_id TEXT NOT NULL,
 		user_id TEXT NOT NULL,
 		-- JSON array. The contents of 'rooms.invite.$room_id.invite_state.events'
@@ -96,7 +99,7 @@ func (t *InvitesTable) InsertInvite(userID, roomID string, inviteRoomState []jso
 	}
 	_, err = t.db.Exec(
 		`INSERT INTO syncv3_invites(user_id, room_id, invite_state) VALUES($1,$2,$3)
-		ON CONFLICT (user_id, room_id) DO UPDATE SET invite_state = $3`,
+		ON CONFLICT (user_id, room_id) DO UPDATE SET invite_state = $3, id = nextval('syncv3_invites_seq')`,
 		userID, roomID, blob,
 	)
 	return err
@@ -138,3 +141,33 @@ func (t *InvitesTable) SelectAllInvitesForUser(userID string) (map[string][]json
 	}
 	return result, nil
 }
+
+// SelectInvitesForUserSince returns the invites for this user which were added or updated after the
+// position `since`, as a map of room ID to invite_state (json array), along with the latest position
+// returned, or `since` if there are none.
+func (t *InvitesTable) SelectInvitesForUserSince(userID string, since int64) (map[string][]json.RawMessage, int64, error) {
+	rows, err := t.db.Query(`SELECT id, room_id, invite_state FROM syncv3_invites WHERE user_id = $1 AND id > $2`, userID, since)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	result := make(map[string][]json.RawMessage)
+	latest := since
+	var id int64
+	var roomID string
+	var blob json.RawMessage
+	for rows.Next() {
+		if err := rows.Scan(&id, &roomID, &blob); err != nil {
+			return nil, 0, err
+		}
+		var inviteState []json.RawMessage
+		if err := json.Unmarshal(blob, &inviteState); err != nil {
+			return nil, 0, err
+		}
+		result[roomID] = inviteState
+		if id > latest {
+			latest = id
+		}
+	}
+	return result, latest, rows.Err()
+}
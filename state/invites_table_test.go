@@ -73,6 +73,22 @@ func TestInviteTable(t *testing.T) {
 		t.Fatalf("got %d invites, want 0", len(invites))
 	}
 
+	// Assert alice's invites since the start, and since the latest invite
+	invites, pos, err := table.SelectInvitesForUserSince(alice, 0)
+	if err != nil {
+		t.Fatalf("failed to SelectInvitesForUserSince: %s", err)
+	}
+	if len(invites) != 2 || pos == 0 {
+		t.Fatalf("got %d invites at position %d, want 2 at a non-zero position", len(invites), pos)
+	}
+	invites, latestPos, err := table.SelectInvitesForUserSince(alice, pos)
+	if err != nil {
+		t.Fatalf("failed to SelectInvitesForUserSince: %s", err)
+	}
+	if len(invites) != 0 || latestPos != pos {
+		t.Fatalf("got %d invites at position %d, want 0 at %d", len(invites), latestPos, pos)
+	}
+
 	// Update alice's invite, clobber and re-query (inviteState A -> B)
 	if err := table.InsertInvite(alice, roomA, inviteStateB); err != nil {
 		t.Fatalf("failed to InsertInvite: %s", err)
@@ -84,6 +100,14 @@ func TestInviteTable(t *testing.T) {
 	if !reflect.DeepEqual(invites[roomA], inviteStateB) {
 		t.Errorf("room %s got %s want %s", roomA, jsonArrStr(invites[roomA]), jsonArrStr(inviteStateB))
 	}
+	// the updated invite is returned after the previous position
+	invites, latestPos, err = table.SelectInvitesForUserSince(alice, pos)
+	if err != nil {
+		t.Fatalf("failed to SelectInvitesForUserSince: %s", err)
+	}
+	if len(invites) != 1 || !reflect.DeepEqual(invites[roomA], inviteStateB) || latestPos <= pos {
+		t.Errorf("got invites %v at position %d, want room %s after %d", invites, latestPos, roomA, pos)
+	}
 
 	// Retire one of Alice's invites and re-query
 	if err = table.RemoveInvite(alice, roomA); err != nil {
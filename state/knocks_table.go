@@ -0,0 +1,118 @@
+package state
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// KnocksTable stores the knock_state for rooms each user has knocked on, so the room can be shown
+// (e.g with its name and avatar) while the knock is waiting to be approved. Like invites, knocks
+// are kept separate from the normal event flow as the user cannot see the room's events yet.
+//
+// A knock is removed when the user's membership in the room changes to anything other than
+// "knock", e.g when the knock is accepted (join), rejected or rescinded (leave).
+type KnocksTable struct {
+	db *sqlx.DB
+}
+
+func NewKnocksTable(db *sqlx.DB) *KnocksTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_knocks (
+		room_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		-- JSON array. The contents of 'rooms.knock.$room_id.knock_state.events'
+		knock_state BYTEA NOT NULL,
+		UNIQUE(user_id, room_id)
+	);
+	`)
+	return &KnocksTable{db}
+}
+
+func (t *KnocksTable) RemoveKnock(userID, roomID string) error {
+	_, err := t.db.Exec(`DELETE FROM syncv3_knocks WHERE user_id = $1 AND room_id = $2`, userID, roomID)
+	return err
+}
+
+// RemoveSupersededKnocks removes knocks for users whose final membership in newEvents is not
+// "knock". See InvitesTable.RemoveSupersededInvites for the ordering requirements on newEvents.
+func (t *KnocksTable) RemoveSupersededKnocks(txn *sqlx.Tx, roomID string, newEvents []Event) error {
+	memberships := map[string]string{} // user ID -> memberships
+	for _, ev := range newEvents {
+		if ev.Type != "m.room.member" {
+			continue
+		}
+		memberships[ev.StateKey] = ev.Membership
+	}
+
+	var usersToRemove []string
+	for userID, membership := range memberships {
+		if membership != "knock" && membership != "_knock" {
+			usersToRemove = append(usersToRemove, userID)
+		}
+	}
+
+	if len(usersToRemove) == 0 {
+		return nil
+	}
+
+	_, err := txn.Exec(`
+		DELETE FROM syncv3_knocks
+		WHERE user_id = ANY($1) AND room_id = $2
+	`, pq.StringArray(usersToRemove), roomID)
+
+	return err
+}
+
+func (t *KnocksTable) InsertKnock(userID, roomID string, knockRoomState []json.RawMessage) error {
+	blob, err := json.Marshal(knockRoomState)
+	if err != nil {
+		return err
+	}
+	_, err = t.db.Exec(
+		`INSERT INTO syncv3_knocks(user_id, room_id, knock_state) VALUES($1,$2,$3)
+		ON CONFLICT (user_id, room_id) DO UPDATE SET knock_state = $3`,
+		userID, roomID, blob,
+	)
+	return err
+}
+
+func (t *KnocksTable) SelectKnockState(userID, roomID string) (knockState []json.RawMessage, err error) {
+	var blob json.RawMessage
+	if err := t.db.QueryRow(`SELECT knock_state FROM syncv3_knocks WHERE user_id=$1 AND room_id=$2`, userID, roomID).Scan(&blob); err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if blob == nil {
+		return
+	}
+	if err := json.Unmarshal(blob, &knockState); err != nil {
+		return nil, err
+	}
+	return knockState, nil
+}
+
+// Select all knocks for this user. Returns a map of room ID to knock_state (json array).
+func (t *KnocksTable) SelectAllKnocksForUser(userID string) (map[string][]json.RawMessage, error) {
+	rows, err := t.db.Query(`SELECT room_id, knock_state FROM syncv3_knocks WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string][]json.RawMessage)
+	var roomID string
+	var blob json.RawMessage
+	for rows.Next() {
+		if err := rows.Scan(&roomID, &blob); err != nil {
+			return nil, err
+		}
+		var knockState []json.RawMessage
+		if err := json.Unmarshal(blob, &knockState); err != nil {
+			return nil, err
+		}
+		result[roomID] = knockState
+	}
+	return result, nil
+}
@@ -0,0 +1,77 @@
+package state
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+func TestKnocksTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewKnocksTable(db)
+	alice := "@alice_knocks:localhost"
+	bob := "@bob_knocks:localhost"
+	roomA := "!a_knocks:localhost"
+	roomB := "!b_knocks:localhost"
+	knockStateA := []json.RawMessage{[]byte(`{"type":"m.room.name","state_key":"","content":{"name":"A"}}`)}
+	knockStateB := []json.RawMessage{[]byte(`{"type":"m.room.avatar","state_key":"","content":{"url":"mxc://b"}}`)}
+
+	for _, knock := range []struct {
+		userID     string
+		roomID     string
+		knockState []json.RawMessage
+	}{
+		{alice, roomA, knockStateA},
+		{alice, roomB, knockStateB},
+		{bob, roomA, knockStateA},
+	} {
+		if err := table.InsertKnock(knock.userID, knock.roomID, knock.knockState); err != nil {
+			t.Fatalf("failed to InsertKnock: %s", err)
+		}
+	}
+	assertKnocks(t, table, alice, map[string][]json.RawMessage{roomA: knockStateA, roomB: knockStateB})
+	assertKnocks(t, table, bob, map[string][]json.RawMessage{roomA: knockStateA})
+
+	knockState, err := table.SelectKnockState(alice, roomB)
+	if err != nil {
+		t.Fatalf("failed to SelectKnockState: %s", err)
+	}
+	if !reflect.DeepEqual(knockState, knockStateB) {
+		t.Errorf("SelectKnockState: got %s want %s", jsonArrStr(knockState), jsonArrStr(knockStateB))
+	}
+
+	// Alice's knock on room A is accepted, Bob knocks again which should not remove his knock.
+	newEvents := []Event{
+		{Type: "m.room.member", StateKey: alice, Membership: "join", RoomID: roomA},
+		{Type: "m.room.member", StateKey: bob, Membership: "knock", RoomID: roomA},
+	}
+	err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		return table.RemoveSupersededKnocks(txn, roomA, newEvents)
+	})
+	if err != nil {
+		t.Fatalf("failed to RemoveSupersededKnocks: %s", err)
+	}
+	assertKnocks(t, table, alice, map[string][]json.RawMessage{roomB: knockStateB})
+	assertKnocks(t, table, bob, map[string][]json.RawMessage{roomA: knockStateA})
+
+	// Alice rescinds her knock on room B.
+	if err = table.RemoveKnock(alice, roomB); err != nil {
+		t.Fatalf("failed to RemoveKnock: %s", err)
+	}
+	assertKnocks(t, table, alice, map[string][]json.RawMessage{})
+}
+
+func assertKnocks(t *testing.T, table *KnocksTable, user string, expected map[string][]json.RawMessage) {
+	t.Helper()
+	knocks, err := table.SelectAllKnocksForUser(user)
+	if err != nil {
+		t.Fatalf("failed to SelectAllKnocksForUser: %s", err)
+	}
+	if !reflect.DeepEqual(knocks, expected) {
+		t.Fatalf("got %v knocks, want %v", knocks, expected)
+	}
+}
@@ -0,0 +1,87 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+// LatestMessage is the latest message in a room.
+type LatestMessage struct {
+	Event json.RawMessage
+	// The most recent m.replace of Event by its sender, or nil if it hasn't been edited.
+	Replacement json.RawMessage
+}
+
+// LatestMessages returns the latest event of one of these types in each room at or before the room's
+// position, along with its latest edit at that position. Edits and redacted events are never the
+// latest message. Rooms without any messages are not included.
+func (s *Storage) LatestMessages(ctx context.Context, roomToPos map[string]int64, eventTypes []string) (map[string]LatestMessage, error) {
+	if len(roomToPos) == 0 {
+		return nil, nil
+	}
+	result := make(map[string]LatestMessage, len(roomToPos))
+	err := sqlutil.WithTransactionContext(ctx, s.DB, func(txn *sqlx.Tx) error {
+		messages, err := s.EventsTable.SelectLatestEventsOfTypesAtPositions(ctx, txn, roomToPos, eventTypes)
+		if err != nil {
+			return fmt.Errorf("failed to select latest messages: %w", err)
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+		eventIDs := make([]string, 0, len(messages))
+		senders := make([]string, 0, len(messages))
+		positions := make([]int64, 0, len(messages))
+		eventIDToRoomID := make(map[string]string, len(messages))
+		for _, ev := range messages {
+			result[ev.RoomID] = LatestMessage{Event: ev.JSON}
+			eventIDs = append(eventIDs, ev.ID)
+			senders = append(senders, gjson.GetBytes(ev.JSON, "sender").Str)
+			positions = append(positions, roomToPos[ev.RoomID])
+			eventIDToRoomID[ev.ID] = ev.RoomID
+		}
+
+		// Replacements from anyone other than the original sender must be ignored.
+		var replacements []Relation
+		err = sqlutil.SelectContext(ctx, txn, "LatestMessages.replacements", &replacements, `
+		SELECT DISTINCT ON (r.relates_to) r.event_nid, r.event_id, r.room_id, r.sender, r.relates_to, r.rel_type, r.key
+		FROM syncv3_event_relations r
+		JOIN unnest($1::text[], $2::text[], $3::bigint[]) AS original(event_id, sender, pos)
+			ON r.relates_to = original.event_id AND r.sender = original.sender AND r.event_nid <= original.pos
+		WHERE r.rel_type = 'm.replace' ORDER BY r.relates_to, r.event_nid DESC`,
+			pq.StringArray(eventIDs), pq.StringArray(senders), pq.Int64Array(positions))
+		if err != nil {
+			return fmt.Errorf("failed to select replacements: %w", err)
+		}
+		if len(replacements) == 0 {
+			return nil
+		}
+		nids := make([]int64, 0, len(replacements))
+		replacementNIDs := make(map[int64]string, len(replacements))
+		for _, rep := range replacements {
+			nids = append(nids, rep.EventNID)
+			replacementNIDs[rep.EventNID] = rep.RelatesTo
+		}
+		events, err := s.EventsTable.SelectByNIDs(txn, false, nids)
+		if err != nil {
+			return fmt.Errorf("failed to select replacements: %w", err)
+		}
+		for _, ev := range events {
+			roomID := eventIDToRoomID[replacementNIDs[ev.NID]]
+			msg := result[roomID]
+			msg.Replacement = ev.JSON
+			result[roomID] = msg
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
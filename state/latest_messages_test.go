@@ -0,0 +1,78 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestLatestMessages(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestLatestMessages:localhost"
+	emptyRoomID := "!TestLatestMessages_empty:localhost"
+	alice := "@alice_TestLatestMessages:localhost"
+	bob := "@bob_TestLatestMessages:localhost"
+	for _, id := range []string{roomID, emptyRoomID} {
+		_, err := store.Initialise(id, []json.RawMessage{
+			testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice, "room_version": "10"}),
+			testutils.NewJoinEvent(t, alice),
+			testutils.NewJoinEvent(t, bob),
+		})
+		assertNoError(t, err)
+	}
+	first := testutils.NewMessageEvent(t, alice, "first")
+	firstID := gjson.GetBytes(first, "event_id").Str
+	edit := func(sender, body string) json.RawMessage {
+		return testutils.NewEvent(t, "m.room.message", sender, map[string]interface{}{
+			"body": "* " + body, "m.new_content": map[string]interface{}{"body": body},
+			"m.relates_to": map[string]interface{}{"rel_type": "m.replace", "event_id": firstID},
+		})
+	}
+	firstEdit := edit(alice, "first edited")
+	second := testutils.NewMessageEvent(t, bob, "second")
+	res, err := store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		first,
+		firstEdit,
+		// only the sender can edit their message
+		edit(bob, "edited by someone else"),
+		testutils.NewEvent(t, "m.reaction", bob, map[string]interface{}{
+			"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": firstID, "key": "👍"},
+		}),
+		second,
+		edit(alice, "edited after the second message"),
+	}})
+	assertNoError(t, err)
+	nids := res.TimelineNIDs
+
+	testCases := []struct {
+		name            string
+		pos             int64
+		wantEvent       json.RawMessage
+		wantReplacement json.RawMessage
+	}{
+		{name: "before any messages", pos: nids[0] - 1},
+		{name: "unedited message", pos: nids[0], wantEvent: first},
+		{name: "edits and reactions are not messages", pos: nids[3], wantEvent: first, wantReplacement: firstEdit},
+		{name: "latest message", pos: nids[5], wantEvent: second},
+	}
+	for _, tc := range testCases {
+		got, err := store.LatestMessages(context.Background(), map[string]int64{roomID: tc.pos, emptyRoomID: tc.pos}, []string{"m.room.message"})
+		assertNoError(t, err)
+		if _, ok := got[emptyRoomID]; ok {
+			t.Errorf("%s: got a message for a room without any", tc.name)
+		}
+		msg, ok := got[roomID]
+		if tc.wantEvent == nil {
+			assertValue(t, tc.name+": has message", ok, false)
+			continue
+		}
+		assertValue(t, tc.name+": event ID", gjson.GetBytes(msg.Event, "event_id").Str, gjson.GetBytes(tc.wantEvent, "event_id").Str)
+		assertValue(t, tc.name+": replacement ID", gjson.GetBytes(msg.Replacement, "event_id").Str, gjson.GetBytes(tc.wantReplacement, "event_id").Str)
+	}
+}
@@ -0,0 +1,209 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/lib/pq"
+)
+
+// ErrMaintenanceRunning is returned when starting a maintenance run while one is in progress.
+var ErrMaintenanceRunning = errors.New("maintenance is already running")
+
+// Indexes on tables with lots of inserts and deletes, which bloat over time.
+var hotIndexes = []string{
+	"syncv3_to_device_messages_device_idx",
+	"syncv3_to_device_messages_ukey_idx",
+	"syncv3_to_device_messages_pos_device_idx",
+	"syncv3_device_list_updates_bucket_idx",
+	"syncv3_receipts_by_event_idx",
+	"syncv3_receipts_by_user_idx",
+}
+
+// Statuses of a maintenance step.
+const (
+	MaintenanceStepPending = "pending"
+	MaintenanceStepRunning = "running"
+	MaintenanceStepDone    = "done"
+	MaintenanceStepFailed  = "failed"
+)
+
+type MaintenanceStep struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// MaintenanceProgress describes the current, or most recent, maintenance run.
+type MaintenanceProgress struct {
+	Running    bool              `json:"running"`
+	Trigger    string            `json:"trigger,omitempty"`
+	StartedAt  time.Time         `json:"started_at,omitempty"`
+	FinishedAt time.Time         `json:"finished_at,omitempty"`
+	Steps      []MaintenanceStep `json:"steps,omitempty"`
+}
+
+// Maintenance runs database housekeeping: the retention pruners, ANALYZE on all tables and
+// REINDEX on indexes which are prone to bloat. Only one run can happen at a time.
+type Maintenance struct {
+	store *Storage
+	// mu guards progress and interval.
+	mu       *sync.Mutex
+	progress MaintenanceProgress
+	interval time.Duration
+	// rescheduleCh wakes up Schedule when the interval changes.
+	rescheduleCh chan struct{}
+}
+
+func NewMaintenance(store *Storage) *Maintenance {
+	return &Maintenance{
+		store:        store,
+		mu:           &sync.Mutex{},
+		rescheduleCh: make(chan struct{}, 1),
+	}
+}
+
+// Progress returns a copy of the current or most recent run.
+func (m *Maintenance) Progress() MaintenanceProgress {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.progress
+	p.Steps = append([]MaintenanceStep(nil), m.progress.Steps...)
+	return p
+}
+
+// Start begins a maintenance run in the background. Returns ErrMaintenanceRunning if a run is
+// already in progress. The trigger is recorded in the progress for informational purposes.
+func (m *Maintenance) Start(trigger string) error {
+	steps, err := m.begin(trigger)
+	if err != nil {
+		return err
+	}
+	go m.run(steps)
+	return nil
+}
+
+// SetInterval changes how often Schedule runs maintenance. An interval of 0 disables scheduled
+// maintenance. The new interval takes effect immediately, restarting the countdown to the next run.
+func (m *Maintenance) SetInterval(interval time.Duration) {
+	m.mu.Lock()
+	m.interval = interval
+	m.mu.Unlock()
+	logger.Info().Dur("interval", interval).Msg("Maintenance: set schedule interval")
+	select {
+	case m.rescheduleCh <- struct{}{}:
+	default: // a reschedule is already pending
+	}
+}
+
+// Schedule runs maintenance every interval, as set by SetInterval, until the storage is torn down.
+func (m *Maintenance) Schedule() {
+	for {
+		m.mu.Lock()
+		interval := m.interval
+		m.mu.Unlock()
+		var next <-chan time.Time // nil channels block forever, so a 0 interval never fires
+		if interval > 0 {
+			next = time.After(interval)
+		}
+		select {
+		case <-next:
+			if err := m.Start("schedule"); err != nil {
+				logger.Warn().Err(err).Msg("Maintenance: skipping scheduled run")
+			}
+		case <-m.rescheduleCh:
+		case <-m.store.shutdownCh:
+			return
+		}
+	}
+}
+
+type maintenanceFn struct {
+	name string
+	fn   func() error
+}
+
+func (m *Maintenance) begin(trigger string) ([]maintenanceFn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.progress.Running {
+		return nil, ErrMaintenanceRunning
+	}
+	steps := []maintenanceFn{
+		{name: "prune", fn: func() error {
+			return m.store.Prune(time.Now().Add(-time.Hour))
+		}},
+		{name: "analyze", fn: m.analyze},
+	}
+	for _, index := range hotIndexes {
+		index := index
+		steps = append(steps, maintenanceFn{name: "reindex " + index, fn: func() error {
+			_, err := m.store.DB.Exec(`REINDEX INDEX CONCURRENTLY ` + pq.QuoteIdentifier(index))
+			return err
+		}})
+	}
+	m.progress = MaintenanceProgress{
+		Running:   true,
+		Trigger:   trigger,
+		StartedAt: time.Now(),
+		Steps:     make([]MaintenanceStep, len(steps)),
+	}
+	for i := range steps {
+		m.progress.Steps[i] = MaintenanceStep{
+			Name:   steps[i].name,
+			Status: MaintenanceStepPending,
+		}
+	}
+	return steps, nil
+}
+
+func (m *Maintenance) run(steps []maintenanceFn) {
+	logger.Info().Str("trigger", m.Progress().Trigger).Int("steps", len(steps)).Msg("Maintenance: starting")
+	numFailed := 0
+	for i, step := range steps {
+		m.setStep(i, MaintenanceStepRunning, nil, 0)
+		start := time.Now()
+		err := step.fn()
+		if err != nil {
+			numFailed++
+			logger.Warn().Err(err).Str("step", step.name).Msg("Maintenance: step failed")
+			sentry.CaptureException(fmt.Errorf("maintenance step %s: %w", step.name, err))
+			m.setStep(i, MaintenanceStepFailed, err, time.Since(start))
+			continue
+		}
+		m.setStep(i, MaintenanceStepDone, nil, time.Since(start))
+	}
+	m.mu.Lock()
+	m.progress.Running = false
+	m.progress.FinishedAt = time.Now()
+	dur := m.progress.FinishedAt.Sub(m.progress.StartedAt)
+	m.mu.Unlock()
+	logger.Info().Dur("duration", dur).Int("failed", numFailed).Msg("Maintenance: finished")
+}
+
+func (m *Maintenance) setStep(i int, status string, err error, dur time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.progress.Steps[i].Status = status
+	m.progress.Steps[i].DurationMS = dur.Milliseconds()
+	if err != nil {
+		m.progress.Steps[i].Error = err.Error()
+	}
+}
+
+func (m *Maintenance) analyze() error {
+	tables, err := m.store.TableStats()
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		if _, err = m.store.DB.Exec(`ANALYZE ` + pq.QuoteIdentifier(t.Name)); err != nil {
+			return fmt.Errorf("ANALYZE %s: %w", t.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenance(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	m := store.Maintenance
+
+	if err := m.Start("test"); err != nil {
+		t.Fatalf("Start returned error: %s", err)
+	}
+	if err := m.Start("test"); err != ErrMaintenanceRunning && m.Progress().Running {
+		t.Fatalf("Start while running: got %v want ErrMaintenanceRunning", err)
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for m.Progress().Running {
+		if time.Now().After(deadline) {
+			t.Fatalf("maintenance did not finish: %+v", m.Progress())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	progress := m.Progress()
+	assertValue(t, "trigger", progress.Trigger, "test")
+	if progress.FinishedAt.Before(progress.StartedAt) {
+		t.Errorf("finished at %v before started at %v", progress.FinishedAt, progress.StartedAt)
+	}
+	assertValue(t, "num steps", len(progress.Steps), 2+len(hotIndexes))
+	for _, step := range progress.Steps {
+		if step.Status != MaintenanceStepDone {
+			t.Errorf("step %s: got status %s (%s) want done", step.Name, step.Status, step.Error)
+		}
+	}
+}
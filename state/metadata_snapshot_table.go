@@ -0,0 +1,101 @@
+package state
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// MetadataSnapshot is a copy of the parts of the global room metadata which are expensive to
+// calculate from events at startup. It is accurate as of LatestNID: rooms with events after
+// LatestNID must have their metadata recalculated.
+type MetadataSnapshot struct {
+	Version   int                             `json:"version"`
+	LatestNID int64                           `json:"latest_nid"`
+	Rooms     map[string]SnapshotRoomMetadata `json:"rooms"`
+}
+
+// MetadataSnapshotVersion is bumped whenever fields are added to SnapshotRoomMetadata. Snapshots
+// from older versions are missing those fields, so are ignored.
+const MetadataSnapshotVersion = 1
+
+// SnapshotRoomMetadata is the subset of internal.RoomMetadata held in a MetadataSnapshot.
+// Everything else is cheap to load at startup so is always loaded fresh.
+type SnapshotRoomMetadata struct {
+	NameEvent            string                            `json:"name,omitempty"`
+	AvatarEvent          string                            `json:"avatar,omitempty"`
+	CanonicalAlias       string                            `json:"alias,omitempty"`
+	LastMessageTimestamp uint64                            `json:"ts"`
+	LatestEventsByType   map[string]internal.EventMetadata `json:"latest"`
+	PinnedEvent          json.RawMessage                   `json:"pinned,omitempty"`
+	PinnedEventNID       int64                             `json:"pinned_nid,omitempty"`
+}
+
+// MetadataSnapshotTable stores the most recent MetadataSnapshot.
+type MetadataSnapshotTable struct {
+	db *sqlx.DB
+}
+
+func NewMetadataSnapshotTable(db *sqlx.DB) *MetadataSnapshotTable {
+	// there is only ever one snapshot, which is overwritten each time.
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_metadata_snapshots (
+		id SMALLINT PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+		latest_nid BIGINT NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		snapshot BYTEA NOT NULL -- gzipped JSON MetadataSnapshot
+	);
+	`)
+	return &MetadataSnapshotTable{db}
+}
+
+// Upsert replaces the stored snapshot.
+func (t *MetadataSnapshotTable) Upsert(snapshot *MetadataSnapshot) error {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+		return fmt.Errorf("failed to encode metadata snapshot: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to compress metadata snapshot: %w", err)
+	}
+	_, err := t.db.Exec(
+		`INSERT INTO syncv3_metadata_snapshots(latest_nid, created_at, snapshot) VALUES($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET latest_nid = $1, created_at = $2, snapshot = $3`,
+		snapshot.LatestNID, time.Now(), buf.Bytes(),
+	)
+	return err
+}
+
+// Select returns the stored snapshot, or nil if there is no snapshot. Snapshots which cannot be
+// decoded or are from another version are logged and ignored, as everything in them can be recalculated.
+func (t *MetadataSnapshotTable) Select(txn *sqlx.Tx) (*MetadataSnapshot, error) {
+	var compressed []byte
+	err := txn.QueryRow(`SELECT snapshot FROM syncv3_metadata_snapshots`).Scan(&compressed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot MetadataSnapshot
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err == nil {
+		err = json.NewDecoder(r).Decode(&snapshot)
+	}
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to decode metadata snapshot, ignoring it")
+		return nil, nil
+	}
+	if snapshot.Version != MetadataSnapshotVersion {
+		logger.Info().Int("version", snapshot.Version).Msg("ignoring metadata snapshot from an older version")
+		return nil, nil
+	}
+	return &snapshot, nil
+}
@@ -5,15 +5,11 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/pressly/goose/v3"
-	"github.com/rs/zerolog"
-	"os"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger("migrations")
 
 func init() {
 	goose.AddMigrationContext(upBogusSnapshotCleanup, downBogusSnapshotCleanup)
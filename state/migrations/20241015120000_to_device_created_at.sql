@@ -0,0 +1,9 @@
+-- +goose Up
+ALTER TABLE IF EXISTS syncv3_to_device_messages
+    ADD COLUMN IF NOT EXISTS created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now();
+CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_created_at_idx ON syncv3_to_device_messages(created_at);
+
+-- +goose Down
+DROP INDEX IF EXISTS syncv3_to_device_messages_created_at_idx;
+ALTER TABLE IF EXISTS syncv3_to_device_messages
+    DROP COLUMN IF EXISTS created_at;
@@ -0,0 +1,9 @@
+-- +goose Up
+ALTER TABLE IF EXISTS syncv3_to_device_messages
+    ADD COLUMN IF NOT EXISTS content_hash TEXT;
+CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_content_hash_idx ON syncv3_to_device_messages(user_id, device_id, content_hash);
+
+-- +goose Down
+DROP INDEX IF EXISTS syncv3_to_device_messages_content_hash_idx;
+ALTER TABLE IF EXISTS syncv3_to_device_messages
+    DROP COLUMN IF EXISTS content_hash;
@@ -0,0 +1,115 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pressly/goose/v3"
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	goose.AddMigrationContext(upUserMemberships, downUserMemberships)
+}
+
+// upUserMemberships populates the memberships index used to work out joined rooms, by replaying the
+// membership events already in the database. See state.UserMembershipsTable.
+func upUserMemberships(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS syncv3_user_memberships (
+		user_id TEXT NOT NULL,
+		room_id TEXT NOT NULL,
+		membership_nid BIGINT NOT NULL,
+		join_nid BIGINT NOT NULL,
+		join_ts BIGINT NOT NULL,
+		UNIQUE(user_id, room_id)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// For each user and room, find the latest join, leave or ban, and the first join after the
+	// latest leave or ban, if any.
+	_, err = tx.ExecContext(ctx, `
+	DECLARE user_memberships_migration_cursor CURSOR FOR
+	WITH latest AS (
+		SELECT state_key AS user_id, room_id, max(event_nid) AS membership_nid,
+			max(event_nid) FILTER (WHERE membership IN ('leave', '_leave', 'ban', '_ban')) AS leave_nid
+		FROM syncv3_events
+		WHERE event_type = 'm.room.member' AND membership IN ('join', '_join', 'leave', '_leave', 'ban', '_ban')
+		GROUP BY state_key, room_id
+	)
+	SELECT latest.user_id, latest.room_id, latest.membership_nid, COALESCE(joins.event_nid, 0), joins.event
+	FROM latest LEFT JOIN LATERAL (
+		SELECT event_nid, event FROM syncv3_events
+		WHERE event_type = 'm.room.member' AND state_key = latest.user_id AND room_id = latest.room_id
+			AND event_nid > COALESCE(latest.leave_nid, 0) AND membership IN ('join', '_join')
+		ORDER BY event_nid ASC LIMIT 1
+	) AS joins ON TRUE`)
+	if err != nil {
+		return err
+	}
+	defer tx.Exec("CLOSE user_memberships_migration_cursor")
+
+	// every N seconds log an update
+	updateFrequency := time.Second * 2
+	lastUpdate := time.Now()
+	total := 0
+	for {
+		userIDs, roomIDs, membershipNIDs, joinNIDs, joinTimestamps, err := fetchUserMemberships(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if len(userIDs) == 0 {
+			break
+		}
+		_, err = tx.ExecContext(ctx, `
+		INSERT INTO syncv3_user_memberships(user_id, room_id, membership_nid, join_nid, join_ts)
+		SELECT * FROM unnest($1::text[], $2::text[], $3::bigint[], $4::bigint[], $5::bigint[])
+		ON CONFLICT (user_id, room_id) DO NOTHING`,
+			pq.StringArray(userIDs), pq.StringArray(roomIDs), pq.Int64Array(membershipNIDs),
+			pq.Int64Array(joinNIDs), pq.Int64Array(joinTimestamps),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert memberships: %w", err)
+		}
+		total += len(userIDs)
+		if time.Since(lastUpdate) > updateFrequency {
+			logger.Info().Msgf("%d memberships indexed", total)
+			lastUpdate = time.Now()
+		}
+	}
+	logger.Info().Int("count", total).Msg("indexed memberships")
+	return nil
+}
+
+func fetchUserMemberships(ctx context.Context, tx *sql.Tx) (userIDs, roomIDs []string, membershipNIDs, joinNIDs, joinTimestamps []int64, err error) {
+	rows, err := tx.QueryContext(ctx, `FETCH 1000 FROM user_memberships_migration_cursor`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID, roomID string
+		var membershipNID, joinNID int64
+		var joinEvent []byte
+		if err = rows.Scan(&userID, &roomID, &membershipNID, &joinNID, &joinEvent); err != nil {
+			return
+		}
+		userIDs = append(userIDs, userID)
+		roomIDs = append(roomIDs, roomID)
+		membershipNIDs = append(membershipNIDs, membershipNID)
+		joinNIDs = append(joinNIDs, joinNID)
+		joinTimestamps = append(joinTimestamps, int64(gjson.GetBytes(joinEvent, "origin_server_ts").Uint()))
+	}
+	err = rows.Err()
+	return
+}
+
+func downUserMemberships(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `DROP TABLE IF EXISTS syncv3_user_memberships`)
+	return err
+}
@@ -0,0 +1,80 @@
+package migrations
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestUserMembershipsMigration(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	store := state.NewStorageWithDB(db, false)
+
+	alice := "@TestUserMembershipsMigration_alice:localhost"
+	bob := "@TestUserMembershipsMigration_bob:localhost"
+	roomA := "!TestUserMembershipsMigration_a:localhost"
+	roomB := "!TestUserMembershipsMigration_b:localhost"
+	for _, roomID := range []string{roomA, roomB} {
+		_, err := store.Initialise(roomID, []json.RawMessage{
+			testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+			testutils.NewJoinEvent(t, alice),
+		})
+		if err != nil {
+			t.Fatalf("Initialise: %s", err)
+		}
+	}
+	// alice changes her name, leaves and rejoins room A. Bob joins and is banned.
+	_, err := store.Accumulate(alice, roomA, sync2.TimelineResponse{Events: []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{"membership": "join", "displayname": "Alice"}),
+		testutils.NewJoinEvent(t, bob),
+		testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{"membership": "leave"}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewStateEvent(t, "m.room.member", bob, alice, map[string]interface{}{"membership": "ban"}),
+	}})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+
+	selectRows := func() []state.UserMembershipRow {
+		t.Helper()
+		var rows []state.UserMembershipRow
+		err := db.Select(&rows, `SELECT user_id, room_id, membership_nid, join_nid, join_ts FROM syncv3_user_memberships
+		WHERE user_id = ANY(ARRAY[$1, $2])`, alice, bob)
+		if err != nil {
+			t.Fatalf("failed to select memberships: %s", err)
+		}
+		sort.Slice(rows, func(i, j int) bool {
+			return rows[i].UserID+rows[i].RoomID < rows[j].UserID+rows[j].RoomID
+		})
+		return rows
+	}
+	want := selectRows()
+	if len(want) != 3 {
+		t.Fatalf("accumulator indexed %d memberships, want 3: %+v", len(want), want)
+	}
+
+	// the migration rebuilds the same index from the events
+	if _, err = db.Exec(`DELETE FROM syncv3_user_memberships WHERE user_id = ANY(ARRAY[$1, $2])`, alice, bob); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = upUserMemberships(context.Background(), tx.Tx); err != nil {
+		t.Fatalf("upUserMemberships: %s", err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := selectRows(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("migrated memberships\ngot  %+v\nwant %+v", got, want)
+	}
+}
@@ -0,0 +1,123 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pressly/goose/v3"
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	goose.AddMigrationContext(upRoomNames, downRoomNames)
+}
+
+// upRoomNames stores the current name and canonical alias of each room in syncv3_rooms, and indexes
+// them with trigrams so room name filters can be answered by the database. See
+// state.RoomsTable.SelectRoomIDsWithNameLike.
+func upRoomNames(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+	ALTER TABLE IF EXISTS syncv3_rooms
+		ADD COLUMN IF NOT EXISTS name TEXT,
+		ADD COLUMN IF NOT EXISTS canonical_alias TEXT;`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	DECLARE room_names_migration_cursor CURSOR FOR
+	SELECT e.room_id, e.event_type, e.event
+	FROM syncv3_rooms r
+		JOIN syncv3_snapshots s ON s.snapshot_id = r.current_snapshot_id
+		JOIN syncv3_events e ON e.event_nid = ANY(s.events)
+	WHERE e.event_type IN ('m.room.name', 'm.room.canonical_alias') AND e.state_key = ''`)
+	if err != nil {
+		return err
+	}
+	defer tx.Exec("CLOSE room_names_migration_cursor")
+
+	// every N seconds log an update
+	updateFrequency := time.Second * 2
+	lastUpdate := time.Now()
+	total := 0
+	for {
+		roomIDs, columns, values, err := fetchRoomNames(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if len(roomIDs) == 0 {
+			break
+		}
+		for _, column := range []string{"name", "canonical_alias"} {
+			_, err = tx.ExecContext(ctx, `
+			UPDATE syncv3_rooms SET `+column+` = v.value
+			FROM unnest($1::text[], $2::text[], $3::text[]) AS v(room_id, col, value)
+			WHERE syncv3_rooms.room_id = v.room_id AND v.col = $4`,
+				pq.StringArray(roomIDs), pq.StringArray(columns), pq.StringArray(values), column,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to update room %s: %w", column, err)
+			}
+		}
+		total += len(roomIDs)
+		if time.Since(lastUpdate) > updateFrequency {
+			logger.Info().Msgf("%d room names and aliases stored", total)
+			lastUpdate = time.Now()
+		}
+	}
+	logger.Info().Int("count", total).Msg("stored room names and aliases")
+
+	// pg_trgm is a trusted extension, so can be created by the database owner, but may still be
+	// unavailable. Filters work without the indexes, so don't fail the migration if it is missing:
+	// the missing indexes are reported at startup.
+	if _, err = tx.ExecContext(ctx, `SAVEPOINT room_names_trgm`); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `CREATE EXTENSION IF NOT EXISTS pg_trgm`); err != nil {
+		logger.Warn().Err(err).Msg("failed to create pg_trgm extension, room name filters will not be indexed")
+		_, err = tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT room_names_trgm`)
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+	CREATE INDEX IF NOT EXISTS syncv3_rooms_name_trgm_idx ON syncv3_rooms USING GIN (lower(name) gin_trgm_ops);
+	CREATE INDEX IF NOT EXISTS syncv3_rooms_canonical_alias_trgm_idx ON syncv3_rooms USING GIN (lower(canonical_alias) gin_trgm_ops);`)
+	return err
+}
+
+func fetchRoomNames(ctx context.Context, tx *sql.Tx) (roomIDs, columns, values []string, err error) {
+	rows, err := tx.QueryContext(ctx, `FETCH 1000 FROM room_names_migration_cursor`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var roomID, eventType string
+		var event []byte
+		if err = rows.Scan(&roomID, &eventType, &event); err != nil {
+			return
+		}
+		roomIDs = append(roomIDs, roomID)
+		if eventType == "m.room.name" {
+			columns = append(columns, "name")
+			values = append(values, gjson.GetBytes(event, "content.name").Str)
+		} else {
+			columns = append(columns, "canonical_alias")
+			values = append(values, gjson.GetBytes(event, "content.alias").Str)
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+func downRoomNames(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+	DROP INDEX IF EXISTS syncv3_rooms_canonical_alias_trgm_idx;
+	DROP INDEX IF EXISTS syncv3_rooms_name_trgm_idx;
+	ALTER TABLE IF EXISTS syncv3_rooms
+		DROP COLUMN IF EXISTS canonical_alias,
+		DROP COLUMN IF EXISTS name;`)
+	return err
+}
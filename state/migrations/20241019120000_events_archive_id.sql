@@ -0,0 +1,8 @@
+-- +goose Up
+ALTER TABLE IF EXISTS syncv3_events
+    ADD COLUMN IF NOT EXISTS archive_id BIGINT;
+
+-- +goose Down
+-- The JSON of archived events is not restored: they will be empty after migrating down.
+ALTER TABLE IF EXISTS syncv3_events
+    DROP COLUMN IF EXISTS archive_id;
@@ -0,0 +1,117 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pressly/goose/v3"
+
+	"github.com/matrix-org/sliding-sync/state"
+)
+
+func init() {
+	goose.AddMigrationContext(upEventRelations, downEventRelations)
+}
+
+// upEventRelations indexes the relations of the events already in the database. See
+// state.RelationsTable. Archived events are not indexed.
+func upEventRelations(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS syncv3_event_relations (
+		event_nid BIGINT NOT NULL PRIMARY KEY,
+		event_id TEXT NOT NULL,
+		room_id TEXT NOT NULL,
+		relates_to TEXT NOT NULL,
+		rel_type TEXT NOT NULL,
+		key TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS syncv3_event_relations_relates_to_idx ON syncv3_event_relations(relates_to, rel_type, event_nid);
+	CREATE INDEX IF NOT EXISTS syncv3_event_relations_event_id_idx ON syncv3_event_relations(event_id);`)
+	if err != nil {
+		return err
+	}
+
+	// Relations are only in timeline events. Checking for the key cheaply skips most events
+	// without having to parse them.
+	_, err = tx.ExecContext(ctx, `
+	DECLARE event_relations_migration_cursor CURSOR FOR
+	SELECT event_nid, event_id, room_id, event FROM syncv3_events
+	WHERE is_state = FALSE AND position('"m.relates_to"'::bytea IN event) > 0`)
+	if err != nil {
+		return err
+	}
+	defer tx.Exec("CLOSE event_relations_migration_cursor")
+
+	// every N seconds log an update
+	updateFrequency := time.Second * 2
+	lastUpdate := time.Now()
+	total := 0
+	for {
+		events, err := fetchRelationEvents(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			break
+		}
+		var nids []int64
+		var eventIDs, roomIDs, relatesTo, relTypes, keys []string
+		for _, ev := range events {
+			rel, ok := state.ParseRelation(ev)
+			if !ok {
+				continue
+			}
+			nids = append(nids, rel.EventNID)
+			eventIDs = append(eventIDs, rel.EventID)
+			roomIDs = append(roomIDs, rel.RoomID)
+			relatesTo = append(relatesTo, rel.RelatesTo)
+			relTypes = append(relTypes, rel.RelType)
+			keys = append(keys, rel.Key)
+		}
+		if len(nids) == 0 {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, `
+		INSERT INTO syncv3_event_relations(event_nid, event_id, room_id, relates_to, rel_type, key)
+		SELECT * FROM unnest($1::bigint[], $2::text[], $3::text[], $4::text[], $5::text[], $6::text[])
+		ON CONFLICT (event_nid) DO NOTHING`,
+			pq.Int64Array(nids), pq.StringArray(eventIDs), pq.StringArray(roomIDs),
+			pq.StringArray(relatesTo), pq.StringArray(relTypes), pq.StringArray(keys),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert relations: %w", err)
+		}
+		total += len(nids)
+		if time.Since(lastUpdate) > updateFrequency {
+			logger.Info().Msgf("%d relations indexed", total)
+			lastUpdate = time.Now()
+		}
+	}
+	logger.Info().Int("count", total).Msg("indexed relations")
+	return nil
+}
+
+func fetchRelationEvents(ctx context.Context, tx *sql.Tx) (events []state.Event, err error) {
+	rows, err := tx.QueryContext(ctx, `FETCH 1000 FROM event_relations_migration_cursor`)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ev state.Event
+		if err = rows.Scan(&ev.NID, &ev.ID, &ev.RoomID, &ev.JSON); err != nil {
+			return
+		}
+		events = append(events, ev)
+	}
+	err = rows.Err()
+	return
+}
+
+func downEventRelations(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `DROP TABLE IF EXISTS syncv3_event_relations`)
+	return err
+}
@@ -0,0 +1,80 @@
+package migrations
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestEventRelationsMigration(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	store := state.NewStorageWithDB(db, false)
+
+	alice := "@TestEventRelationsMigration_alice:localhost"
+	roomID := "!TestEventRelationsMigration:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	if err != nil {
+		t.Fatalf("Initialise: %s", err)
+	}
+	root := testutils.NewMessageEvent(t, alice, "root")
+	rootID := gjson.GetBytes(root, "event_id").Str
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		root,
+		testutils.NewEvent(t, "m.reaction", alice, map[string]interface{}{
+			"m.relates_to": map[string]interface{}{"rel_type": "m.annotation", "event_id": rootID, "key": "👍"},
+		}),
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{
+			"body": "reply", "m.relates_to": map[string]interface{}{"m.in_reply_to": map[string]interface{}{"event_id": rootID}},
+		}),
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{
+			"body": "in thread", "m.relates_to": map[string]interface{}{"rel_type": "m.thread", "event_id": rootID},
+		}),
+	}})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+
+	selectRows := func() []state.Relation {
+		t.Helper()
+		var rows []state.Relation
+		err := db.Select(&rows, `SELECT event_nid, event_id, room_id, relates_to, rel_type, key FROM syncv3_event_relations
+		WHERE room_id = $1 ORDER BY event_nid`, roomID)
+		if err != nil {
+			t.Fatalf("failed to select relations: %s", err)
+		}
+		return rows
+	}
+	want := selectRows()
+	if len(want) != 2 {
+		t.Fatalf("accumulator indexed %d relations, want 2: %+v", len(want), want)
+	}
+
+	// the migration rebuilds the same index from the events
+	if _, err = db.Exec(`DELETE FROM syncv3_event_relations WHERE room_id = $1`, roomID); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = upEventRelations(context.Background(), tx.Tx); err != nil {
+		t.Fatalf("upEventRelations: %s", err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := selectRows(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("migrated relations\ngot  %+v\nwant %+v", got, want)
+	}
+}
@@ -0,0 +1,10 @@
+-- +goose Up
+ALTER TABLE IF EXISTS syncv3_event_relations
+    ADD COLUMN IF NOT EXISTS sender TEXT NOT NULL DEFAULT '';
+-- the senders of archived events are unknown, so they are left empty
+UPDATE syncv3_event_relations r SET sender = COALESCE(convert_from(e.event, 'UTF8')::jsonb->>'sender', '')
+    FROM syncv3_events e WHERE e.event_nid = r.event_nid AND e.archive_id IS NULL AND r.sender = '';
+
+-- +goose Down
+ALTER TABLE IF EXISTS syncv3_event_relations
+    DROP COLUMN IF EXISTS sender;
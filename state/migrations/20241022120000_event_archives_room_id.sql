@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+-- syncv3_event_archives is only created once an event archive is configured.
+DO $$
+BEGIN
+    IF to_regclass('syncv3_event_archives') IS NOT NULL THEN
+        ALTER TABLE syncv3_event_archives ADD COLUMN IF NOT EXISTS room_id TEXT;
+        -- Archives which only hold events from one room can be deleted when the room is purged.
+        UPDATE syncv3_event_archives SET room_id = archived.room_id
+        FROM (
+            SELECT archive_id, MIN(room_id) AS room_id FROM syncv3_events
+            WHERE archive_id IS NOT NULL
+            GROUP BY archive_id HAVING COUNT(DISTINCT room_id) = 1
+        ) AS archived
+        WHERE syncv3_event_archives.archive_id = archived.archive_id;
+    END IF;
+END $$;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE IF EXISTS syncv3_event_archives DROP COLUMN IF EXISTS room_id;
+-- +goose StatementEnd
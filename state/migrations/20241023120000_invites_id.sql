@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE SEQUENCE IF NOT EXISTS syncv3_invites_seq;
+-- existing invites are numbered in an arbitrary order, which only matters to sync v2 clients
+ALTER TABLE IF EXISTS syncv3_invites
+    ADD COLUMN IF NOT EXISTS id BIGINT NOT NULL DEFAULT nextval('syncv3_invites_seq');
+
+-- +goose Down
+ALTER TABLE IF EXISTS syncv3_invites
+    DROP COLUMN IF EXISTS id;
+DROP SEQUENCE IF EXISTS syncv3_invites_seq;
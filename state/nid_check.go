@@ -0,0 +1,306 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+// nidCheckBatchSize is the number of rooms whose current snapshots are checked at a time.
+const nidCheckBatchSize = 500
+
+// Kinds of NIDAnomaly.
+const (
+	// NIDAnomalySequenceBehind means the event NID sequence will hand out NIDs which are already in use.
+	NIDAnomalySequenceBehind = "sequence_behind"
+	// NIDAnomalyLatestNIDAhead means a room's latest_nid is after the room's newest event.
+	NIDAnomalyLatestNIDAhead = "latest_nid_ahead"
+	// NIDAnomalyMissingSnapshot means a room's current snapshot does not exist, or belongs to another room.
+	NIDAnomalyMissingSnapshot = "missing_snapshot"
+	// NIDAnomalyDanglingNID means a current snapshot references an event which does not exist, or
+	// which is in another room.
+	NIDAnomalyDanglingNID = "dangling_nid"
+	// NIDAnomalyDuplicateState means a current snapshot references the same event twice, or more
+	// than one event with the same type and state key.
+	NIDAnomalyDuplicateState = "duplicate_state"
+	// NIDAnomalyMisfiledNID means a current snapshot has a membership event in its other events, or
+	// vice versa.
+	NIDAnomalyMisfiledNID = "misfiled_nid"
+)
+
+// NIDAnomaly is an inconsistency between event NIDs and the tables which refer to them, which can
+// make queries for events after a position silently miss or repeat events. They are typically
+// caused by crashes or restoring partial backups.
+type NIDAnomaly struct {
+	// RoomID is empty for anomalies which affect all rooms.
+	RoomID string  `json:"room_id,omitempty"`
+	Kind   string  `json:"kind"`
+	NIDs   []int64 `json:"nids,omitempty"`
+	Detail string  `json:"detail,omitempty"`
+}
+
+func (a NIDAnomaly) String() string {
+	s := a.Kind
+	if a.RoomID != "" {
+		s += " in " + a.RoomID
+	}
+	if len(a.NIDs) > 0 {
+		s += fmt.Sprintf(" NIDs %v", a.NIDs)
+	}
+	if a.Detail != "" {
+		s += ": " + a.Detail
+	}
+	return s
+}
+
+// CheckNIDs scans the database for NID anomalies. It only reads, so is safe to run whilst the
+// proxy is running, though anomalies may be reported for rooms which are being written to.
+func (s *Storage) CheckNIDs(ctx context.Context) ([]NIDAnomaly, error) {
+	var anomalies []NIDAnomaly
+	var seq struct {
+		LastValue  int64 `db:"last_value"`
+		HighestNID int64 `db:"highest_nid"`
+	}
+	err := sqlutil.GetContext(ctx, s.DB, "CheckNIDSequence", &seq, `SELECT
+		(SELECT last_value FROM syncv3_event_nids_seq) AS last_value,
+		(SELECT COALESCE(MAX(event_nid), 0) FROM syncv3_events) AS highest_nid`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check event NID sequence: %w", err)
+	}
+	if seq.LastValue < seq.HighestNID {
+		anomalies = append(anomalies, NIDAnomaly{
+			Kind:   NIDAnomalySequenceBehind,
+			Detail: fmt.Sprintf("sequence is at %d but the highest event NID is %d", seq.LastValue, seq.HighestNID),
+		})
+	}
+
+	var ahead []struct {
+		RoomID     string `db:"room_id"`
+		LatestNID  int64  `db:"latest_nid"`
+		HighestNID int64  `db:"highest_nid"`
+	}
+	err = sqlutil.SelectContext(ctx, s.DB, "CheckLatestNIDs", &ahead, `SELECT * FROM (
+		SELECT r.room_id, r.latest_nid, COALESCE((SELECT MAX(event_nid) FROM syncv3_events e WHERE e.room_id = r.room_id), 0) AS highest_nid
+		FROM syncv3_rooms r
+	) AS x WHERE latest_nid > highest_nid ORDER BY room_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check latest NIDs: %w", err)
+	}
+	for _, a := range ahead {
+		anomalies = append(anomalies, NIDAnomaly{
+			RoomID: a.RoomID,
+			Kind:   NIDAnomalyLatestNIDAhead,
+			NIDs:   []int64{a.LatestNID},
+			Detail: fmt.Sprintf("the newest event in the room is %d", a.HighestNID),
+		})
+	}
+
+	var roomIDs []string
+	err = sqlutil.SelectContext(ctx, s.DB, "CheckSnapshotRooms", &roomIDs, `SELECT room_id FROM syncv3_rooms ORDER BY room_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select rooms: %w", err)
+	}
+	for i := 0; i < len(roomIDs); i += nidCheckBatchSize {
+		end := i + nidCheckBatchSize
+		if end > len(roomIDs) {
+			end = len(roomIDs)
+		}
+		batch, err := s.checkSnapshotNIDs(ctx, roomIDs[i:end])
+		if err != nil {
+			return nil, err
+		}
+		anomalies = append(anomalies, batch...)
+	}
+	return anomalies, nil
+}
+
+// snapshotNID is an event referenced by a room's current snapshot.
+type snapshotNID struct {
+	RoomID       string `db:"room_id"`
+	NID          int64  `db:"nid"`
+	IsMembership bool   `db:"is_membership"`
+	Exists       bool   `db:"event_exists"`
+	EventRoomID  string `db:"event_room_id"`
+	Type         string `db:"event_type"`
+	StateKey     string `db:"state_key"`
+}
+
+func selectCurrentSnapshotNIDs(ctx context.Context, q sqlx.QueryerContext, roomIDs []string) ([]snapshotNID, error) {
+	var rows []snapshotNID
+	err := sqlutil.SelectContext(ctx, q, "SelectCurrentSnapshotNIDs", &rows, `
+	WITH snapshots AS (
+		SELECT r.room_id, s.events, s.membership_events FROM syncv3_rooms r
+		JOIN syncv3_snapshots s ON s.snapshot_id = r.current_snapshot_id AND s.room_id = r.room_id
+		WHERE r.room_id = ANY($1)
+	), nids AS (
+		SELECT room_id, unnest(events) AS nid, FALSE AS is_membership FROM snapshots
+		UNION ALL
+		SELECT room_id, unnest(membership_events) AS nid, TRUE AS is_membership FROM snapshots
+	)
+	SELECT n.room_id, n.nid, n.is_membership, e.event_nid IS NOT NULL AS event_exists,
+		COALESCE(e.room_id, '') AS event_room_id, COALESCE(e.event_type, '') AS event_type, COALESCE(e.state_key, '') AS state_key
+	FROM nids n LEFT JOIN syncv3_events e ON e.event_nid = n.nid
+	ORDER BY n.room_id, n.nid`, pq.StringArray(roomIDs))
+	return rows, err
+}
+
+func (s *Storage) checkSnapshotNIDs(ctx context.Context, roomIDs []string) ([]NIDAnomaly, error) {
+	var missing []string
+	err := sqlutil.SelectContext(ctx, s.DB, "CheckMissingSnapshots", &missing, `SELECT r.room_id FROM syncv3_rooms r
+	LEFT JOIN syncv3_snapshots s ON s.snapshot_id = r.current_snapshot_id AND s.room_id = r.room_id
+	WHERE r.room_id = ANY($1) AND s.snapshot_id IS NULL ORDER BY r.room_id`, pq.StringArray(roomIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for missing snapshots: %w", err)
+	}
+	var anomalies []NIDAnomaly
+	for _, roomID := range missing {
+		anomalies = append(anomalies, NIDAnomaly{RoomID: roomID, Kind: NIDAnomalyMissingSnapshot})
+	}
+
+	rows, err := selectCurrentSnapshotNIDs(ctx, s.DB, roomIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select current snapshots: %w", err)
+	}
+	byRoom := make(map[string][]snapshotNID)
+	for _, row := range rows {
+		byRoom[row.RoomID] = append(byRoom[row.RoomID], row)
+	}
+	for _, roomID := range roomIDs {
+		var dangling, duplicate, misfiled []int64
+		seenNIDs := make(map[int64]bool)
+		seenTuples := make(map[[2]string]int64)
+		for _, row := range byRoom[roomID] {
+			if !row.Exists || row.EventRoomID != roomID {
+				dangling = append(dangling, row.NID)
+				continue
+			}
+			if row.IsMembership != (row.Type == "m.room.member") {
+				misfiled = append(misfiled, row.NID)
+			}
+			if seenNIDs[row.NID] {
+				duplicate = append(duplicate, row.NID)
+				continue
+			}
+			seenNIDs[row.NID] = true
+			tuple := [2]string{row.Type, row.StateKey}
+			if other, ok := seenTuples[tuple]; ok {
+				duplicate = append(duplicate, other, row.NID)
+			}
+			seenTuples[tuple] = row.NID
+		}
+		if len(dangling) > 0 {
+			anomalies = append(anomalies, NIDAnomaly{RoomID: roomID, Kind: NIDAnomalyDanglingNID, NIDs: dedupeNIDs(dangling)})
+		}
+		if len(duplicate) > 0 {
+			anomalies = append(anomalies, NIDAnomaly{RoomID: roomID, Kind: NIDAnomalyDuplicateState, NIDs: dedupeNIDs(duplicate)})
+		}
+		if len(misfiled) > 0 {
+			anomalies = append(anomalies, NIDAnomaly{RoomID: roomID, Kind: NIDAnomalyMisfiledNID, NIDs: dedupeNIDs(misfiled)})
+		}
+	}
+	return anomalies, nil
+}
+
+func dedupeNIDs(nids []int64) []int64 {
+	sort.Slice(nids, func(i, j int) bool { return nids[i] < nids[j] })
+	result := nids[:0]
+	for i, nid := range nids {
+		if i == 0 || nid != nids[i-1] {
+			result = append(result, nid)
+		}
+	}
+	return result
+}
+
+// RepairNIDs fixes the given anomalies, as returned by CheckNIDs:
+//   - the event NID sequence is moved past the highest event NID.
+//   - latest_nid is set to the newest event in the room.
+//   - rooms with broken current snapshots get a new current snapshot. This is made from the events in
+//     the old snapshot which exist in the room, keeping the newest event for each type and state key.
+//     If there is no old snapshot, it is made from the newest state event for each type and state key.
+//
+// Old snapshots are left alone. The proxy caches room state in memory, so it must be restarted
+// after repairing. Returns the number of anomalies repaired.
+func (s *Storage) RepairNIDs(ctx context.Context, anomalies []NIDAnomaly) (int, error) {
+	numRepaired := 0
+	rebuilt := make(map[string]bool)
+	for _, a := range anomalies {
+		var err error
+		switch a.Kind {
+		case NIDAnomalySequenceBehind:
+			_, err = sqlutil.ExecContext(ctx, s.DB, "RepairNIDSequence",
+				`SELECT setval('syncv3_event_nids_seq', (SELECT MAX(event_nid) FROM syncv3_events))`)
+		case NIDAnomalyLatestNIDAhead:
+			_, err = sqlutil.ExecContext(ctx, s.DB, "RepairLatestNID", `UPDATE syncv3_rooms
+			SET latest_nid = COALESCE((SELECT MAX(event_nid) FROM syncv3_events WHERE room_id = $1), 0) WHERE room_id = $1`, a.RoomID)
+		case NIDAnomalyMissingSnapshot, NIDAnomalyDanglingNID, NIDAnomalyDuplicateState, NIDAnomalyMisfiledNID:
+			if !rebuilt[a.RoomID] {
+				err = s.rebuildCurrentSnapshot(ctx, a.RoomID)
+				rebuilt[a.RoomID] = err == nil
+			}
+		default:
+			err = fmt.Errorf("unknown anomaly")
+		}
+		if err != nil {
+			return numRepaired, fmt.Errorf("failed to repair %s: %w", a, err)
+		}
+		numRepaired++
+	}
+	return numRepaired, nil
+}
+
+func (s *Storage) rebuildCurrentSnapshot(ctx context.Context, roomID string) error {
+	return sqlutil.WithTransactionContext(ctx, s.DB, func(txn *sqlx.Tx) error {
+		rows, err := selectCurrentSnapshotNIDs(ctx, txn, []string{roomID})
+		if err != nil {
+			return fmt.Errorf("failed to select current snapshot: %w", err)
+		}
+		if len(rows) == 0 {
+			// Either the snapshot is missing or empty: use the newest state events instead.
+			err = sqlutil.SelectContext(ctx, txn, "SelectNewestStateEvents", &rows, `
+			SELECT DISTINCT ON (event_type, state_key) room_id, event_nid AS nid, TRUE AS event_exists,
+				room_id AS event_room_id, event_type, state_key
+			FROM syncv3_events WHERE room_id = $1 AND (
+				is_state OR CASE WHEN archive_id IS NULL THEN convert_from(event, 'UTF8')::jsonb ? 'state_key' ELSE FALSE END
+			) ORDER BY event_type, state_key, event_nid DESC`, roomID)
+			if err != nil {
+				return fmt.Errorf("failed to select state events: %w", err)
+			}
+		}
+		newest := make(map[[2]string]int64)
+		for _, row := range rows {
+			if !row.Exists || row.EventRoomID != roomID {
+				continue
+			}
+			tuple := [2]string{row.Type, row.StateKey}
+			if row.NID > newest[tuple] {
+				newest[tuple] = row.NID
+			}
+		}
+		snapshot := &SnapshotRow{RoomID: roomID}
+		for tuple, nid := range newest {
+			if tuple[0] == "m.room.member" {
+				snapshot.MembershipEvents = append(snapshot.MembershipEvents, nid)
+			} else {
+				snapshot.OtherEvents = append(snapshot.OtherEvents, nid)
+			}
+		}
+		sort.Slice(snapshot.MembershipEvents, func(i, j int) bool { return snapshot.MembershipEvents[i] < snapshot.MembershipEvents[j] })
+		sort.Slice(snapshot.OtherEvents, func(i, j int) bool { return snapshot.OtherEvents[i] < snapshot.OtherEvents[j] })
+		if err = s.Accumulator.snapshotTable.Insert(txn, snapshot); err != nil {
+			return fmt.Errorf("failed to insert snapshot: %w", err)
+		}
+		_, err = txn.ExecContext(ctx, `UPDATE syncv3_rooms SET current_snapshot_id = $1 WHERE room_id = $2`, snapshot.SnapshotID, roomID)
+		if err != nil {
+			return fmt.Errorf("failed to update current snapshot: %w", err)
+		}
+		logger.Info().Str("room", roomID).Int64("snapshot", snapshot.SnapshotID).
+			Int("state_events", len(snapshot.OtherEvents)+len(snapshot.MembershipEvents)).Msg("rebuilt current snapshot")
+		return nil
+	})
+}
@@ -0,0 +1,102 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/lib/pq"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestCheckAndRepairNIDs(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	ctx := context.Background()
+	roomID := "!TestCheckAndRepairNIDs:localhost"
+	alice := "@alice_TestCheckAndRepairNIDs:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	assertNoError(t, err)
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "first"}),
+		testutils.NewMessageEvent(t, alice, "hello"),
+		testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "second"}),
+	}})
+	assertNoError(t, err)
+
+	roomAnomalies := func() map[string][]int64 {
+		t.Helper()
+		anomalies, err := store.CheckNIDs(ctx)
+		assertNoError(t, err)
+		got := make(map[string][]int64)
+		for _, a := range anomalies {
+			if a.RoomID == roomID {
+				got[a.Kind] = a.NIDs
+			}
+		}
+		return got
+	}
+	if got := roomAnomalies(); len(got) > 0 {
+		t.Fatalf("CheckNIDs: got anomalies %v for a healthy room", got)
+	}
+
+	var snapshot SnapshotRow
+	assertNoError(t, store.DB.Get(&snapshot, `SELECT snapshot_id, room_id, events, membership_events FROM syncv3_snapshots
+	WHERE snapshot_id = (SELECT current_snapshot_id FROM syncv3_rooms WHERE room_id = $1)`, roomID))
+	var oldName, createNID, highestNID int64
+	assertNoError(t, store.DB.Get(&createNID, `SELECT event_nid FROM syncv3_events WHERE room_id = $1 AND event_type = 'm.room.create'`, roomID))
+	assertNoError(t, store.DB.Get(&oldName, `SELECT MIN(event_nid) FROM syncv3_events WHERE room_id = $1 AND event_type = 'm.room.name'`, roomID))
+	assertNoError(t, store.DB.Get(&highestNID, `SELECT MAX(event_nid) FROM syncv3_events`))
+
+	// corrupt the room: reference a missing event, an older name event, the create event twice
+	// and file the create event as a membership event.
+	missingNID := highestNID + 1000000
+	_, err = store.DB.Exec(`UPDATE syncv3_snapshots SET events = events || $1::bigint[], membership_events = membership_events || $2::bigint[]
+	WHERE snapshot_id = $3`, pq.Int64Array{missingNID, oldName, createNID}, pq.Int64Array{createNID}, snapshot.SnapshotID)
+	assertNoError(t, err)
+	_, err = store.DB.Exec(`UPDATE syncv3_rooms SET latest_nid = $1 WHERE room_id = $2`, missingNID, roomID)
+	assertNoError(t, err)
+
+	got := roomAnomalies()
+	assertValue(t, "dangling", got[NIDAnomalyDanglingNID], []int64{missingNID})
+	assertValue(t, "latest_nid ahead", got[NIDAnomalyLatestNIDAhead], []int64{missingNID})
+	assertValue(t, "misfiled", got[NIDAnomalyMisfiledNID], []int64{createNID})
+	if len(got[NIDAnomalyDuplicateState]) == 0 {
+		t.Errorf("CheckNIDs: missing duplicate state anomaly, got %v", got)
+	}
+
+	anomalies, err := store.CheckNIDs(ctx)
+	assertNoError(t, err)
+	var ours []NIDAnomaly
+	for _, a := range anomalies {
+		if a.RoomID == roomID {
+			ours = append(ours, a)
+		}
+	}
+	numRepaired, err := store.RepairNIDs(ctx, ours)
+	assertNoError(t, err)
+	assertValue(t, "numRepaired", numRepaired, len(ours))
+	if got := roomAnomalies(); len(got) > 0 {
+		t.Fatalf("CheckNIDs: got anomalies %v after repairing", got)
+	}
+
+	// the rebuilt snapshot has the same state as before it was corrupted
+	var rebuilt SnapshotRow
+	assertNoError(t, store.DB.Get(&rebuilt, `SELECT snapshot_id, room_id, events, membership_events FROM syncv3_snapshots
+	WHERE snapshot_id = (SELECT current_snapshot_id FROM syncv3_rooms WHERE room_id = $1)`, roomID))
+	if rebuilt.SnapshotID == snapshot.SnapshotID {
+		t.Errorf("current snapshot was not replaced")
+	}
+	for _, row := range []*SnapshotRow{&snapshot, &rebuilt} {
+		sort.Slice(row.OtherEvents, func(i, j int) bool { return row.OtherEvents[i] < row.OtherEvents[j] })
+		sort.Slice(row.MembershipEvents, func(i, j int) bool { return row.MembershipEvents[i] < row.MembershipEvents[j] })
+	}
+	assertValue(t, "rebuilt events", rebuilt.OtherEvents, snapshot.OtherEvents)
+	assertValue(t, "rebuilt membership events", rebuilt.MembershipEvents, snapshot.MembershipEvents)
+}
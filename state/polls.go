@@ -0,0 +1,232 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+// PollResultsKey is the key in the unsigned section of poll start events which holds the results
+// of the poll. See PollResults.
+const PollResultsKey = "org.matrix.sliding_sync.poll_results"
+
+// The event types and content fields of polls, both stable and unstable (MSC3381).
+type pollFormat struct {
+	startType    string
+	responseType string
+	endType      string
+	// path to the poll in the start event
+	poll string
+	// path to the ID of an answer in the poll, relative to the answer
+	answerID string
+	// path to the chosen answer IDs in a response event
+	selections string
+}
+
+var pollFormats = []pollFormat{
+	{
+		startType:    "m.poll.start",
+		responseType: "m.poll.response",
+		endType:      "m.poll.end",
+		poll:         `content.m\.poll`,
+		answerID:     `m\.id`,
+		selections:   `content.m\.selections`,
+	},
+	{
+		startType:    "org.matrix.msc3381.poll.start",
+		responseType: "org.matrix.msc3381.poll.response",
+		endType:      "org.matrix.msc3381.poll.end",
+		poll:         `content.org\.matrix\.msc3381\.poll\.start`,
+		answerID:     "id",
+		selections:   `content.org\.matrix\.msc3381\.poll\.response.answers`,
+	},
+}
+
+// PollResult is the tally of a poll.
+type PollResult struct {
+	// the number of votes for each answer ID, including answers without any votes
+	Answers map[string]int `json:"answers"`
+	// the number of users with a valid vote
+	TotalVoters int  `json:"total_voters"`
+	Ended       bool `json:"ended"`
+	// the answer IDs the requesting user voted for, if any
+	UserSelections []string `json:"user_selections,omitempty"`
+}
+
+type pollVote struct {
+	ts         uint64
+	selections []string
+}
+
+type poll struct {
+	format        pollFormat
+	sender        string
+	maxSelections int
+	answerIDs     []string
+	validAnswers  map[string]struct{}
+	// the timestamp of the poll's end event, or 0 if the poll hasn't ended
+	endTs uint64
+	votes map[string]pollVote
+}
+
+func parsePoll(ev gjson.Result) *poll {
+	evType := ev.Get("type").Str
+	for _, format := range pollFormats {
+		if evType != format.startType {
+			continue
+		}
+		content := ev.Get(format.poll)
+		p := &poll{
+			format:        format,
+			sender:        ev.Get("sender").Str,
+			maxSelections: 1,
+			validAnswers:  make(map[string]struct{}),
+			votes:         make(map[string]pollVote),
+		}
+		if max := content.Get("max_selections"); max.Exists() && max.Int() > 0 {
+			p.maxSelections = int(max.Int())
+		}
+		for _, answer := range content.Get("answers").Array() {
+			id := answer.Get(format.answerID).Str
+			if _, dupe := p.validAnswers[id]; id == "" || dupe {
+				continue
+			}
+			p.answerIDs = append(p.answerIDs, id)
+			p.validAnswers[id] = struct{}{}
+		}
+		return p
+	}
+	return nil
+}
+
+// vote records the response from the sender, replacing any earlier response from them. Responses
+// after the end of the poll are ignored.
+func (p *poll) vote(sender string, ts uint64, selections []gjson.Result) {
+	if p.endTs != 0 && ts > p.endTs {
+		return
+	}
+	if prev, ok := p.votes[sender]; ok && prev.ts > ts {
+		return
+	}
+	vote := pollVote{ts: ts}
+	seen := make(map[string]struct{}, len(selections))
+	for _, s := range selections {
+		if _, valid := p.validAnswers[s.Str]; !valid {
+			continue
+		}
+		if _, dupe := seen[s.Str]; dupe {
+			continue
+		}
+		seen[s.Str] = struct{}{}
+		// only the first max_selections answers count
+		if len(vote.selections) == p.maxSelections {
+			break
+		}
+		vote.selections = append(vote.selections, s.Str)
+	}
+	// an empty or invalid selection still replaces the previous vote
+	p.votes[sender] = vote
+}
+
+func (p *poll) result(userID string) PollResult {
+	result := PollResult{
+		Answers: make(map[string]int, len(p.answerIDs)),
+		Ended:   p.endTs != 0,
+	}
+	for _, id := range p.answerIDs {
+		result.Answers[id] = 0
+	}
+	for sender, vote := range p.votes {
+		if len(vote.selections) == 0 {
+			continue
+		}
+		result.TotalVoters++
+		for _, id := range vote.selections {
+			result.Answers[id]++
+		}
+		if sender == userID {
+			result.UserSelections = vote.selections
+		}
+	}
+	return result
+}
+
+// PollResults tallies the responses to the polls in these events, keyed by the event ID of the
+// poll start event. Events which aren't polls are ignored. Responses are m.reference relations
+// to the poll: only the latest response from each user counts, up to the poll's max_selections
+// valid answers. Once the creator of the poll ends it, later responses are ignored.
+func (s *Storage) PollResults(ctx context.Context, userID string, events []json.RawMessage) (map[string]json.RawMessage, error) {
+	polls := make(map[string]*poll)
+	var pollIDs []string
+	for _, ev := range events {
+		parsed := gjson.ParseBytes(ev)
+		p := parsePoll(parsed)
+		if p == nil {
+			continue
+		}
+		eventID := parsed.Get("event_id").Str
+		polls[eventID] = p
+		pollIDs = append(pollIDs, eventID)
+	}
+	if len(pollIDs) == 0 {
+		return nil, nil
+	}
+	var responseTypes []string
+	for _, format := range pollFormats {
+		responseTypes = append(responseTypes, format.responseType, format.endType)
+	}
+	err := sqlutil.WithTransactionContext(ctx, s.DB, func(txn *sqlx.Tx) error {
+		var nids []int64
+		err := sqlutil.SelectContext(ctx, txn, "PollResults", &nids, `
+		SELECT r.event_nid FROM syncv3_event_relations r JOIN syncv3_events e ON e.event_nid = r.event_nid
+		WHERE r.relates_to = ANY($1) AND r.rel_type = 'm.reference' AND e.event_type = ANY($2)
+		ORDER BY r.event_nid ASC`, pq.StringArray(pollIDs), pq.StringArray(responseTypes))
+		if err != nil {
+			return fmt.Errorf("failed to select poll responses: %w", err)
+		}
+		if len(nids) == 0 {
+			return nil
+		}
+		responses, err := s.EventsTable.SelectByNIDs(txn, false, nids)
+		if err != nil {
+			return fmt.Errorf("failed to select poll responses: %w", err)
+		}
+		// find when each poll ended first, as responses may be older than the end event but arrive later
+		for _, ev := range responses {
+			parsed := gjson.ParseBytes(ev.JSON)
+			p := polls[parsed.Get(`content.m\.relates_to.event_id`).Str]
+			if p == nil || ev.Type != p.format.endType || parsed.Get("sender").Str != p.sender {
+				continue
+			}
+			if ts := parsed.Get("origin_server_ts").Uint(); p.endTs == 0 || ts < p.endTs {
+				p.endTs = ts
+			}
+		}
+		for _, ev := range responses {
+			parsed := gjson.ParseBytes(ev.JSON)
+			p := polls[parsed.Get(`content.m\.relates_to.event_id`).Str]
+			if p == nil || ev.Type != p.format.responseType {
+				continue
+			}
+			p.vote(parsed.Get("sender").Str, parsed.Get("origin_server_ts").Uint(), parsed.Get(p.format.selections).Array())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]json.RawMessage, len(polls))
+	for eventID, p := range polls {
+		result[eventID], err = json.Marshal(p.result(userID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal poll results of %s: %w", eventID, err)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,124 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestPollTally(t *testing.T) {
+	start := gjson.Parse(`{"type":"m.poll.start","sender":"@creator","content":{"m.poll":{
+		"max_selections":2,
+		"answers":[{"m.id":"a"},{"m.id":"b"},{"m.id":"c"},{"m.id":"a"}]
+	}}}`)
+	selections := func(ids ...string) []gjson.Result {
+		b, _ := json.Marshal(ids)
+		return gjson.ParseBytes(b).Array()
+	}
+	testCases := []struct {
+		name  string
+		votes func(p *poll)
+		endTs uint64
+		want  PollResult
+	}{
+		{
+			name:  "no votes",
+			votes: func(p *poll) {},
+			want:  PollResult{Answers: map[string]int{"a": 0, "b": 0, "c": 0}},
+		},
+		{
+			name: "the latest vote from each user counts",
+			votes: func(p *poll) {
+				p.vote("@alice", 1, selections("a"))
+				p.vote("@alice", 3, selections("b"))
+				p.vote("@alice", 2, selections("c"))
+				p.vote("@bob", 1, selections("b"))
+			},
+			want: PollResult{Answers: map[string]int{"a": 0, "b": 2, "c": 0}, TotalVoters: 2, UserSelections: []string{"b"}},
+		},
+		{
+			name: "invalid and duplicate answers are ignored and selections are truncated",
+			votes: func(p *poll) {
+				p.vote("@alice", 1, selections("z", "a", "a", "b", "c"))
+			},
+			want: PollResult{Answers: map[string]int{"a": 1, "b": 1, "c": 0}, TotalVoters: 1, UserSelections: []string{"a", "b"}},
+		},
+		{
+			name: "an empty vote withdraws the earlier one",
+			votes: func(p *poll) {
+				p.vote("@alice", 1, selections("a"))
+				p.vote("@alice", 2, selections())
+			},
+			want: PollResult{Answers: map[string]int{"a": 0, "b": 0, "c": 0}},
+		},
+		{
+			name: "votes after the end are ignored",
+			votes: func(p *poll) {
+				p.vote("@alice", 1, selections("a"))
+				p.vote("@alice", 6, selections("b"))
+				p.vote("@bob", 6, selections("b"))
+			},
+			endTs: 5,
+			want:  PollResult{Answers: map[string]int{"a": 1, "b": 0, "c": 0}, TotalVoters: 1, Ended: true, UserSelections: []string{"a"}},
+		},
+	}
+	for _, tc := range testCases {
+		p := parsePoll(start)
+		p.endTs = tc.endTs
+		tc.votes(p)
+		if got := p.result("@alice"); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPollResults(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestPollResults:localhost"
+	alice := "@alice_TestPollResults:localhost"
+	bob := "@bob_TestPollResults:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice, "room_version": "10"}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewJoinEvent(t, bob),
+	})
+	assertNoError(t, err)
+	start := testutils.NewEvent(t, "org.matrix.msc3381.poll.start", alice, map[string]interface{}{
+		"org.matrix.msc3381.poll.start": map[string]interface{}{
+			"question": map[string]interface{}{"org.matrix.msc1767.text": "Lunch?"},
+			"answers": []map[string]interface{}{
+				{"id": "pizza", "org.matrix.msc1767.text": "Pizza"},
+				{"id": "salad", "org.matrix.msc1767.text": "Salad"},
+			},
+		},
+	})
+	startID := gjson.GetBytes(start, "event_id").Str
+	reference := map[string]interface{}{"rel_type": "m.reference", "event_id": startID}
+	response := func(sender string, answers ...string) json.RawMessage {
+		return testutils.NewEvent(t, "org.matrix.msc3381.poll.response", sender, map[string]interface{}{
+			"m.relates_to":                     reference,
+			"org.matrix.msc3381.poll.response": map[string]interface{}{"answers": answers},
+		})
+	}
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		start,
+		response(alice, "pizza"),
+		response(bob, "salad"),
+		// ending the poll is only allowed by its creator
+		testutils.NewEvent(t, "org.matrix.msc3381.poll.end", bob, map[string]interface{}{"m.relates_to": reference}),
+		response(bob, "pizza"),
+	}})
+	assertNoError(t, err)
+
+	results, err := store.PollResults(context.Background(), bob, []json.RawMessage{start, testutils.NewMessageEvent(t, alice, "not a poll")})
+	assertNoError(t, err)
+	assertValue(t, "num polls", len(results), 1)
+	assertValue(t, "results", string(results[startID]), `{"answers":{"pizza":2,"salad":0},"total_voters":2,"ended":false,"user_selections":["pizza"]}`)
+}
@@ -0,0 +1,56 @@
+package state
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// QuarantinedEvent is an event sent by the upstream homeserver which could not be accumulated.
+type QuarantinedEvent struct {
+	RoomID string `db:"room_id"`
+	JSON   []byte `db:"event"`
+	Reason string `db:"reason"`
+}
+
+// QuarantineTable is a dead-letter table for malformed events, e.g. events which are not valid JSON
+// or which lack an event ID or type. These events are skipped so that the rest of the response can
+// be processed, and kept here so that operators can see what the homeserver sent.
+type QuarantineTable struct {
+	db *sqlx.DB
+}
+
+func NewQuarantineTable(db *sqlx.DB) *QuarantineTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_quarantined_events (
+		id BIGSERIAL PRIMARY KEY,
+		room_id TEXT NOT NULL,
+		event BYTEA NOT NULL, -- not JSONB as it may not be valid JSON
+		reason TEXT NOT NULL,
+		quarantined_at TIMESTAMP WITH TIME ZONE NOT NULL
+	);
+	-- the same response may be retried, so only keep one copy of each event
+	CREATE UNIQUE INDEX IF NOT EXISTS syncv3_quarantined_events_room_event_idx ON syncv3_quarantined_events(room_id, md5(event));
+	`)
+	return &QuarantineTable{db}
+}
+
+// Insert quarantines the given events, ignoring events which are already quarantined.
+func (t *QuarantineTable) Insert(txn *sqlx.Tx, events []QuarantinedEvent) error {
+	now := time.Now()
+	for _, ev := range events {
+		_, err := txn.Exec(`INSERT INTO syncv3_quarantined_events(room_id, event, reason, quarantined_at) VALUES($1, $2, $3, $4)
+		ON CONFLICT (room_id, md5(event)) DO NOTHING`, ev.RoomID, ev.JSON, ev.Reason, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SelectByRoom returns the quarantined events for this room, oldest first.
+func (t *QuarantineTable) SelectByRoom(roomID string) (events []QuarantinedEvent, err error) {
+	err = t.db.Select(&events, `SELECT room_id, event, reason FROM syncv3_quarantined_events WHERE room_id = $1 ORDER BY id ASC`, roomID)
+	return
+}
@@ -67,12 +67,13 @@ func (t *ReceiptTable) Insert(roomID string, ephEvent json.RawMessage) (receipts
 	if len(readReceipts) == 0 && len(privateReceipts) == 0 {
 		return nil, nil
 	}
-	err = sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
-		readReceipts, err = t.bulkInsert("syncv3_receipts", txn, readReceipts)
+	var newReadReceipts, newPrivateReceipts []internal.Receipt
+	err = sqlutil.WithRetryingTransaction(t.db, func(txn *sqlx.Tx) error {
+		newReadReceipts, err = t.bulkInsert("syncv3_receipts", txn, readReceipts)
 		if err != nil {
 			return err
 		}
-		privateReceipts, err = t.bulkInsert("syncv3_receipts_private", txn, privateReceipts)
+		newPrivateReceipts, err = t.bulkInsert("syncv3_receipts_private", txn, privateReceipts)
 		if err != nil {
 			return err
 		}
@@ -82,11 +83,11 @@ func (t *ReceiptTable) Insert(roomID string, ephEvent json.RawMessage) (receipts
 		return nil, fmt.Errorf("failed to insert receipts: %s", err)
 	}
 	// no new receipts
-	if len(readReceipts) == 0 && len(privateReceipts) == 0 {
+	if len(newReadReceipts) == 0 && len(newPrivateReceipts) == 0 {
 		return nil, nil
 	}
 	// combine together new receipts
-	return append(readReceipts, privateReceipts...), nil
+	return append(newReadReceipts, newPrivateReceipts...), nil
 }
 
 // Select all non-private receipts for the event IDs given. Events must be in the room ID given.
@@ -98,6 +99,13 @@ func (t *ReceiptTable) SelectReceiptsForEvents(roomID string, eventIDs []string)
 	return
 }
 
+// Select all non-private receipts in the room which are not in a thread.
+func (t *ReceiptTable) SelectUnthreadedReceiptsForRoom(roomID string) (receipts []internal.Receipt, err error) {
+	err = t.db.Select(&receipts, `SELECT room_id, event_id, user_id, ts, thread_id FROM syncv3_receipts
+		WHERE room_id=$1 AND thread_id IN ('', 'main')`, roomID)
+	return
+}
+
 // Select all (including private) receipts for this user in these rooms.
 func (t *ReceiptTable) SelectReceiptsForUser(roomIDs []string, userID string) (receiptsByRoom map[string][]internal.Receipt, err error) {
 	var receipts []internal.Receipt
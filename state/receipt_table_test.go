@@ -368,6 +368,26 @@ func TestReceiptTable(t *testing.T) {
 		},
 	})
 
+	// selecting the room's unthreaded receipts -> ignores threaded and private receipts
+	got, err = table.SelectUnthreadedReceiptsForRoom(roomA)
+	assertNoError(t, err)
+	parsedReceiptsEqual(t, got, []internal.Receipt{
+		{
+			RoomID:   roomA,
+			EventID:  "$aaaaaaaa:matrix.org",
+			UserID:   "@rikj:jki.re",
+			TS:       1436499990453,
+			ThreadID: "",
+		},
+		{
+			RoomID:   roomA,
+			EventID:  "$aaaaaaaa:matrix.org",
+			UserID:   "@bob:bar",
+			TS:       5555,
+			ThreadID: "",
+		},
+	})
+
 	gotMap, err := table.SelectReceiptsForUser([]string{roomA}, "@self:example.org")
 	assertNoError(t, err)
 	parsedReceiptsEqual(t, gotMap[roomA], []internal.Receipt{
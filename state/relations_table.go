@@ -0,0 +1,113 @@
+package state
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/tidwall/gjson"
+)
+
+// Relation is the m.relates_to of an event, e.g an edit, reaction or thread reply.
+// See https://spec.matrix.org/v1.8/client-server-api/#forming-relationships-between-events
+type Relation struct {
+	EventNID  int64  `db:"event_nid"`
+	EventID   string `db:"event_id"`
+	RoomID    string `db:"room_id"`
+	Sender    string `db:"sender"`
+	RelatesTo string `db:"relates_to"`
+	RelType   string `db:"rel_type"`
+	// Key is the key of an m.annotation e.g the emoji of a reaction, or empty for other relations.
+	Key string `db:"key"`
+}
+
+// ParseRelation returns the relation of the event, if it has one. Replies which only have an
+// m.in_reply_to are not relations. The event must have a NID, ID and room ID.
+func ParseRelation(ev Event) (Relation, bool) {
+	relatesTo := gjson.GetBytes(ev.JSON, `content.m\.relates_to`)
+	relType := relatesTo.Get("rel_type").Str
+	eventID := relatesTo.Get("event_id").Str
+	if relType == "" || eventID == "" {
+		return Relation{}, false
+	}
+	rel := Relation{
+		EventNID:  ev.NID,
+		EventID:   ev.ID,
+		RoomID:    ev.RoomID,
+		Sender:    gjson.GetBytes(ev.JSON, "sender").Str,
+		RelatesTo: eventID,
+		RelType:   relType,
+	}
+	if relType == "m.annotation" {
+		rel.Key = relatesTo.Get("key").Str
+	}
+	return rel, true
+}
+
+// RelationsTable indexes the relations between events, for aggregating them e.g to bundle edits,
+// count reactions and summarise threads. It is updated in the same transaction as the events are
+// inserted, and relations are removed when their event is redacted.
+type RelationsTable struct {
+	db *sqlx.DB
+}
+
+func NewRelationsTable(db *sqlx.DB) *RelationsTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_event_relations (
+		event_nid BIGINT NOT NULL PRIMARY KEY,
+		event_id TEXT NOT NULL,
+		room_id TEXT NOT NULL,
+		sender TEXT NOT NULL DEFAULT '',
+		relates_to TEXT NOT NULL,
+		rel_type TEXT NOT NULL,
+		key TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS syncv3_event_relations_relates_to_idx ON syncv3_event_relations(relates_to, rel_type, event_nid);
+	CREATE INDEX IF NOT EXISTS syncv3_event_relations_event_id_idx ON syncv3_event_relations(event_id);
+	`)
+	return &RelationsTable{db}
+}
+
+// Insert the relations of these newly inserted events, which must have NIDs. Events without
+// relations are ignored.
+func (t *RelationsTable) Insert(txn *sqlx.Tx, events []Event) error {
+	var nids []int64
+	var eventIDs, roomIDs, senders, relatesTo, relTypes, keys []string
+	for _, ev := range events {
+		rel, ok := ParseRelation(ev)
+		if !ok {
+			continue
+		}
+		nids = append(nids, rel.EventNID)
+		eventIDs = append(eventIDs, rel.EventID)
+		roomIDs = append(roomIDs, rel.RoomID)
+		senders = append(senders, rel.Sender)
+		relatesTo = append(relatesTo, rel.RelatesTo)
+		relTypes = append(relTypes, rel.RelType)
+		keys = append(keys, rel.Key)
+	}
+	if len(nids) == 0 {
+		return nil
+	}
+	_, err := txn.Exec(`
+	INSERT INTO syncv3_event_relations(event_nid, event_id, room_id, sender, relates_to, rel_type, key)
+	SELECT * FROM unnest($1::bigint[], $2::text[], $3::text[], $4::text[], $5::text[], $6::text[], $7::text[])
+	ON CONFLICT (event_nid) DO NOTHING`,
+		pq.Int64Array(nids), pq.StringArray(eventIDs), pq.StringArray(roomIDs), pq.StringArray(senders),
+		pq.StringArray(relatesTo), pq.StringArray(relTypes), pq.StringArray(keys),
+	)
+	return err
+}
+
+// DeleteByEventIDs removes the relations of these events, e.g because they have been redacted.
+func (t *RelationsTable) DeleteByEventIDs(txn *sqlx.Tx, eventIDs []string) error {
+	_, err := txn.Exec(`DELETE FROM syncv3_event_relations WHERE event_id = ANY($1)`, pq.StringArray(eventIDs))
+	return err
+}
+
+// SelectRelatesTo returns the relations to any of the given events, ordered by NID. If relType is
+// not empty, only relations of that type are returned.
+func (t *RelationsTable) SelectRelatesTo(txn *sqlx.Tx, eventIDs []string, relType string) (relations []Relation, err error) {
+	err = txn.Select(&relations, `SELECT event_nid, event_id, room_id, sender, relates_to, rel_type, key FROM syncv3_event_relations
+	WHERE relates_to = ANY($1) AND ($2 = '' OR rel_type = $2) ORDER BY event_nid ASC`, pq.StringArray(eventIDs), relType)
+	return
+}
@@ -0,0 +1,116 @@
+package state
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestParseRelation(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+		want    *Relation
+	}{
+		{name: "no relation", content: `{"body":"hi"}`},
+		{name: "reply", content: `{"body":"hi","m.relates_to":{"m.in_reply_to":{"event_id":"$a"}}}`},
+		{name: "missing event ID", content: `{"m.relates_to":{"rel_type":"m.replace"}}`},
+		{
+			name:    "edit",
+			content: `{"m.new_content":{"body":"hi"},"m.relates_to":{"rel_type":"m.replace","event_id":"$a"}}`,
+			want:    &Relation{RelatesTo: "$a", RelType: "m.replace"},
+		},
+		{
+			name:    "reaction",
+			content: `{"m.relates_to":{"rel_type":"m.annotation","event_id":"$a","key":"👍"}}`,
+			want:    &Relation{RelatesTo: "$a", RelType: "m.annotation", Key: "👍"},
+		},
+		{
+			name:    "thread reply",
+			content: `{"body":"hi","m.relates_to":{"rel_type":"m.thread","event_id":"$root","is_falling_back":true,"m.in_reply_to":{"event_id":"$b"}}}`,
+			want:    &Relation{RelatesTo: "$root", RelType: "m.thread"},
+		},
+		{
+			name:    "key is ignored for other relations",
+			content: `{"m.relates_to":{"rel_type":"m.reference","event_id":"$a","key":"x"}}`,
+			want:    &Relation{RelatesTo: "$a", RelType: "m.reference"},
+		},
+	}
+	for _, tc := range testCases {
+		ev := Event{NID: 5, ID: "$ev", RoomID: "!room", JSON: []byte(`{"type":"m.room.message","content":` + tc.content + `}`)}
+		got, ok := ParseRelation(ev)
+		if tc.want == nil {
+			if ok {
+				t.Errorf("%s: got relation %+v, want none", tc.name, got)
+			}
+			continue
+		}
+		want := *tc.want
+		want.EventNID, want.EventID, want.RoomID = 5, "$ev", "!room"
+		if !ok || got != want {
+			t.Errorf("%s: got %+v (%v) want %+v", tc.name, got, ok, want)
+		}
+	}
+}
+
+func TestRelationsTableAccumulate(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestRelationsTableAccumulate:localhost"
+	alice := "@alice_TestRelationsTableAccumulate:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice, "room_version": "10"}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	assertNoError(t, err)
+	root := testutils.NewMessageEvent(t, alice, "root")
+	rootID := gjson.GetBytes(root, "event_id").Str
+	relatesTo := func(relType string, extra map[string]interface{}) map[string]interface{} {
+		rel := map[string]interface{}{"rel_type": relType, "event_id": rootID}
+		for k, v := range extra {
+			rel[k] = v
+		}
+		return rel
+	}
+	reaction := testutils.NewEvent(t, "m.reaction", alice, map[string]interface{}{
+		"m.relates_to": relatesTo("m.annotation", map[string]interface{}{"key": "👍"}),
+	})
+	edit := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{
+		"body": "* edited", "m.new_content": map[string]interface{}{"body": "edited"}, "m.relates_to": relatesTo("m.replace", nil),
+	})
+	thread := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{
+		"body": "in thread", "m.relates_to": relatesTo("m.thread", nil),
+	})
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{root, reaction, edit, thread}})
+	assertNoError(t, err)
+
+	selectRelTypes := func(relType string) []string {
+		t.Helper()
+		var relTypes []string
+		err := sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) error {
+			relations, err := store.RelationsTable.SelectRelatesTo(txn, []string{rootID}, relType)
+			for _, rel := range relations {
+				assertValue(t, "room ID", rel.RoomID, roomID)
+				relTypes = append(relTypes, rel.RelType)
+			}
+			return err
+		})
+		assertNoError(t, err)
+		return relTypes
+	}
+	assertValue(t, "relations", selectRelTypes(""), []string{"m.annotation", "m.replace", "m.thread"})
+	assertValue(t, "edits", selectRelTypes("m.replace"), []string{"m.replace"})
+
+	// redacting the reaction removes its relation
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		testutils.NewEvent(t, "m.room.redaction", alice, map[string]interface{}{"redacts": gjson.GetBytes(reaction, "event_id").Str}),
+	}})
+	assertNoError(t, err)
+	assertValue(t, "relations after redaction", selectRelTypes(""), []string{"m.replace", "m.thread"})
+}
@@ -0,0 +1,176 @@
+package state
+
+import (
+	"container/list"
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// The default estimated size in bytes of the results held by the room state cache. Results for
+// large rooms can contain many thousands of events, so the cache is bounded by size rather than by
+// the number of results.
+const defaultRoomStateCacheBytes = 64 * 1024 * 1024
+
+// The number of invalidated rooms remembered by the room state cache, see roomStateCache.generations.
+const maxInvalidatedRooms = 10000
+
+// Rough per-entry overheads used when estimating the size of cached results.
+const (
+	roomStateCacheEntryOverhead = int64(unsafe.Sizeof(roomStateCacheEntry{})) + 128 // list element and map entries
+	roomStateCacheEventSize     = int64(unsafe.Sizeof(Event{}))
+)
+
+// roomStateCacheKey identifies the result of a room state query. The state after an event is
+// determined by the snapshot before it, plus the event itself if it is a state event.
+type roomStateCacheKey struct {
+	roomID     string
+	snapshotID int64
+	stateNID   int64 // the NID of the state event applied to the snapshot, or 0
+	filter     string
+}
+
+type roomStateCacheEntry struct {
+	key    roomStateCacheKey
+	events []Event
+	size   int64
+}
+
+func estimateRoomStateCacheEntrySize(key roomStateCacheKey, events []Event) int64 {
+	size := roomStateCacheEntryOverhead + int64(len(key.roomID)+len(key.filter))
+	for i := range events {
+		ev := &events[i]
+		size += roomStateCacheEventSize + int64(len(ev.Type)+len(ev.StateKey)+len(ev.Membership)+len(ev.ID)+len(ev.RoomID)+len(ev.PrevBatch.String)+len(ev.JSON))
+	}
+	return size
+}
+
+// roomStateCache is an LRU cache of room state query results. Snapshots never change, so
+// results only need invalidating when events are modified in place, e.g by redactions. Rooms are
+// also invalidated when their state changes, as results for older snapshots are then unlikely to
+// be requested again.
+type roomStateCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	ll       *list.List
+	entries  map[roomStateCacheKey]*list.Element
+	roomKeys map[string]map[roomStateCacheKey]struct{}
+	// The generation is bumped whenever a room is invalidated, and generations records the
+	// generation at which each room was last invalidated, so that results loaded before the
+	// invalidation are not added afterwards. Once generations holds maxInvalidatedRooms rooms, it
+	// is cleared and minGeneration raised, which rejects every result loaded before then.
+	generation    uint64
+	minGeneration uint64
+	generations   map[string]uint64
+}
+
+func newRoomStateCache(maxBytes int64) *roomStateCache {
+	return &roomStateCache{
+		maxBytes:    maxBytes,
+		ll:          list.New(),
+		entries:     make(map[roomStateCacheKey]*list.Element),
+		roomKeys:    make(map[string]map[roomStateCacheKey]struct{}),
+		generations: make(map[string]uint64),
+	}
+}
+
+// normaliseStateFilter returns a string which is the same for equivalent event type to state key maps.
+func normaliseStateFilter(eventTypesToStateKeys map[string][]string) string {
+	filters := make([]string, 0, len(eventTypesToStateKeys))
+	for evType, stateKeys := range eventTypesToStateKeys {
+		sortedKeys := append([]string{evType}, stateKeys...)
+		sort.Strings(sortedKeys[1:])
+		filters = append(filters, strings.Join(sortedKeys, "\x00"))
+	}
+	sort.Strings(filters)
+	return strings.Join(filters, "\x01")
+}
+
+// currentGeneration returns the invalidation generation, to pass to add.
+func (c *roomStateCache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// get returns a copy of the cached events for this key.
+func (c *roomStateCache) get(key roomStateCacheKey) ([]Event, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	events := elem.Value.(*roomStateCacheEntry).events
+	return append([]Event(nil), events...), true
+}
+
+// add caches the events for this key, unless the room was invalidated after generation was read.
+func (c *roomStateCache) add(key roomStateCacheKey, generation uint64, events []Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation < c.minGeneration || c.generations[key.roomID] > generation {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.ll.MoveToFront(elem)
+		return
+	}
+	size := estimateRoomStateCacheEntrySize(key, events)
+	if size > c.maxBytes {
+		return
+	}
+	c.entries[key] = c.ll.PushFront(&roomStateCacheEntry{
+		key:    key,
+		events: append([]Event(nil), events...),
+		size:   size,
+	})
+	c.size += size
+	keys := c.roomKeys[key.roomID]
+	if keys == nil {
+		keys = make(map[roomStateCacheKey]struct{})
+		c.roomKeys[key.roomID] = keys
+	}
+	keys[key] = struct{}{}
+	for c.size > c.maxBytes {
+		c.remove(c.ll.Back())
+	}
+}
+
+// invalidate removes all cached results for these rooms.
+func (c *roomStateCache) invalidate(roomIDs ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, roomID := range roomIDs {
+		c.generations[roomID] = c.generation
+		for key := range c.roomKeys[roomID] {
+			c.remove(c.entries[key])
+		}
+	}
+	if len(c.generations) >= maxInvalidatedRooms {
+		c.minGeneration = c.generation
+		c.generations = make(map[string]uint64)
+	}
+}
+
+func (c *roomStateCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *roomStateCache) remove(elem *list.Element) {
+	entry := c.ll.Remove(elem).(*roomStateCacheEntry)
+	key := entry.key
+	c.size -= entry.size
+	delete(c.entries, key)
+	keys := c.roomKeys[key.roomID]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(c.roomKeys, key.roomID)
+	}
+}
@@ -0,0 +1,88 @@
+package state
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNormaliseStateFilter(t *testing.T) {
+	a := normaliseStateFilter(map[string][]string{
+		"m.room.member": {"@b:localhost", "@a:localhost"},
+		"m.room.name":   {""},
+	})
+	b := normaliseStateFilter(map[string][]string{
+		"m.room.name":   {""},
+		"m.room.member": {"@a:localhost", "@b:localhost"},
+	})
+	assertValue(t, "equivalent filters", a, b)
+	if normaliseStateFilter(map[string][]string{"m.room.name": nil}) == normaliseStateFilter(map[string][]string{"m.room.name": {""}}) {
+		t.Errorf("all state keys and the empty state key normalised to the same filter")
+	}
+	assertValue(t, "no filter", normaliseStateFilter(nil), "")
+}
+
+func TestRoomStateCache(t *testing.T) {
+	keyA := roomStateCacheKey{roomID: "!a", snapshotID: 1}
+	keyA2 := roomStateCacheKey{roomID: "!a", snapshotID: 2}
+	keyB := roomStateCacheKey{roomID: "!b", snapshotID: 3}
+	events := []Event{{NID: 1, RoomID: "!a"}}
+	// room for two results without events
+	cache := newRoomStateCache(2*estimateRoomStateCacheEntrySize(keyA, nil) + 1)
+
+	cache.add(keyA, cache.currentGeneration(), events)
+	assertValue(t, "size", cache.size, estimateRoomStateCacheEntrySize(keyA, events))
+	got, ok := cache.get(keyA)
+	if !ok || len(got) != 1 || got[0].NID != 1 {
+		t.Fatalf("get: got %v %v", got, ok)
+	}
+	got[0].NID = 99 // callers get a copy
+	got, _ = cache.get(keyA)
+	assertValue(t, "cached NID", got[0].NID, int64(1))
+
+	// the least recently used entry is evicted once the cache is too large
+	cache.invalidate("!a")
+	cache.add(keyA, cache.currentGeneration(), nil)
+	cache.add(keyB, cache.currentGeneration(), nil)
+	cache.get(keyA)
+	cache.add(keyA2, cache.currentGeneration(), nil)
+	assertValue(t, "len", cache.len(), 2)
+	if _, ok := cache.get(keyB); ok {
+		t.Errorf("least recently used entry was not evicted")
+	}
+
+	// invalidating a room removes all of its entries
+	cache.invalidate("!a")
+	assertValue(t, "len after invalidating", cache.len(), 0)
+	if _, ok := cache.get(keyA); ok {
+		t.Errorf("entry was not invalidated")
+	}
+
+	// results loaded before an invalidation are not cached
+	generation := cache.currentGeneration()
+	cache.invalidate("!b")
+	cache.add(keyB, generation, nil)
+	if _, ok := cache.get(keyB); ok {
+		t.Errorf("stale result was cached")
+	}
+
+	// results too large for the cache are not added
+	cache.add(keyB, cache.currentGeneration(), []Event{{NID: 2, RoomID: "!b", JSON: make([]byte, cache.maxBytes)}})
+	if _, ok := cache.get(keyB); ok {
+		t.Errorf("result larger than the cache was cached")
+	}
+
+	// invalidated rooms are forgotten once there are too many, rejecting all earlier results
+	generation = cache.currentGeneration()
+	for i := len(cache.generations); i < maxInvalidatedRooms; i++ {
+		cache.invalidate(fmt.Sprintf("!room%d", i))
+	}
+	assertValue(t, "invalidated rooms", len(cache.generations), 0)
+	cache.add(keyB, generation, nil)
+	if _, ok := cache.get(keyB); ok {
+		t.Errorf("result loaded before the invalidated rooms were forgotten was cached")
+	}
+	cache.add(keyB, cache.currentGeneration(), nil)
+	if _, ok := cache.get(keyB); !ok {
+		t.Errorf("result loaded after the invalidated rooms were forgotten was not cached")
+	}
+}
@@ -3,6 +3,7 @@ package state
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -14,6 +15,8 @@ type RoomInfo struct {
 	UpgradedRoomID    *string `db:"upgraded_room_id"`    // from the most recent valid tombstone event, or NULL
 	PredecessorRoomID *string `db:"predecessor_room_id"` // from the create event
 	Type              *string `db:"type"`
+	Name              *string `db:"name"`            // from the most recent m.room.name event, or NULL
+	CanonicalAlias    *string `db:"canonical_alias"` // from the most recent m.room.canonical_alias event, or NULL
 }
 
 // RoomsTable stores the current snapshot for a room.
@@ -29,7 +32,10 @@ func NewRoomsTable(db *sqlx.DB) *RoomsTable {
 		upgraded_room_id TEXT,
 		predecessor_room_id TEXT,
 		latest_nid BIGINT NOT NULL DEFAULT 0,
-		type TEXT -- nullable
+		type TEXT, -- nullable
+		-- trigram indexes over these are created in a migration, for room name filters
+		name TEXT,
+		canonical_alias TEXT
 	);
 	`)
 	return &RoomsTable{}
@@ -73,6 +79,18 @@ func (t *RoomsTable) Upsert(txn *sqlx.Tx, info RoomInfo, snapshotID, latestNID i
 		doUpdate += fmt.Sprintf(", predecessor_room_id = $%d", n)
 		n++
 	}
+	if info.Name != nil {
+		cols += ", name"
+		vals += fmt.Sprintf(", $%d", n)
+		doUpdate += fmt.Sprintf(", name = $%d", n)
+		n++
+	}
+	if info.CanonicalAlias != nil {
+		cols += ", canonical_alias"
+		vals += fmt.Sprintf(", $%d", n)
+		doUpdate += fmt.Sprintf(", canonical_alias = $%d", n)
+		n++
+	}
 	insertQuery := fmt.Sprintf(`INSERT INTO syncv3_rooms(%s) VALUES(%s) %s`, cols, vals, doUpdate)
 	args := []interface{}{
 		info.ID, snapshotID, latestNID,
@@ -86,10 +104,31 @@ func (t *RoomsTable) Upsert(txn *sqlx.Tx, info RoomInfo, snapshotID, latestNID i
 	if info.PredecessorRoomID != nil {
 		args = append(args, *info.PredecessorRoomID)
 	}
+	if info.Name != nil {
+		args = append(args, *info.Name)
+	}
+	if info.CanonicalAlias != nil {
+		args = append(args, *info.CanonicalAlias)
+	}
 	_, err = txn.Exec(insertQuery, args...)
 	return err
 }
 
+// likePattern returns a case-insensitive LIKE pattern which matches strings containing substring.
+func likePattern(substring string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(substring))
+	return "%" + escaped + "%"
+}
+
+// SelectRoomIDsWithNameLike returns the rooms in roomIDs whose name or canonical alias contains the
+// substring, ignoring case. Rooms without a name or canonical alias are never returned, as their
+// name is calculated from heroes, which differ for each user.
+func (t *RoomsTable) SelectRoomIDsWithNameLike(txn *sqlx.Tx, roomIDs []string, substring string) (matches []string, err error) {
+	err = txn.Select(&matches, `SELECT room_id FROM syncv3_rooms WHERE room_id = ANY($1) AND (lower(name) LIKE $2 OR lower(canonical_alias) LIKE $2)`,
+		pq.StringArray(roomIDs), likePattern(substring))
+	return
+}
+
 func (t *RoomsTable) LatestNIDs(txn *sqlx.Tx, roomIDs []string) (nids map[string]int64, err error) {
 	nids = make(map[string]int64, len(roomIDs))
 	rows, err := txn.Query(`SELECT room_id, latest_nid FROM syncv3_rooms WHERE room_id = ANY($1)`, pq.StringArray(roomIDs))
@@ -108,6 +147,26 @@ func (t *RoomsTable) LatestNIDs(txn *sqlx.Tx, roomIDs []string) (nids map[string
 	return
 }
 
+// CurrentAfterSnapshotIDs is like CurrentAfterSnapshotID for many rooms at once. Rooms without a
+// snapshot are not included in the map.
+func (t *RoomsTable) CurrentAfterSnapshotIDs(txn *sqlx.Tx, roomIDs []string) (snapshotIDs map[string]int64, err error) {
+	snapshotIDs = make(map[string]int64, len(roomIDs))
+	rows, err := txn.Query(`SELECT room_id, current_snapshot_id FROM syncv3_rooms WHERE room_id = ANY($1)`, pq.StringArray(roomIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var roomID string
+	var snapshotID int64
+	for rows.Next() {
+		if err = rows.Scan(&roomID, &snapshotID); err != nil {
+			return nil, err
+		}
+		snapshotIDs[roomID] = snapshotID
+	}
+	return snapshotIDs, rows.Err()
+}
+
 // Return the snapshot for this room AFTER the latest event has been applied.
 func (t *RoomsTable) CurrentAfterSnapshotID(txn *sqlx.Tx, roomID string) (snapshotID int64, err error) {
 	err = txn.QueryRow(`SELECT current_snapshot_id FROM syncv3_rooms WHERE room_id=$1`, roomID).Scan(&snapshotID)
@@ -1,6 +1,8 @@
 package state
 
 import (
+	"reflect"
+	"sort"
 	"testing"
 
 	"github.com/jmoiron/sqlx"
@@ -225,3 +227,57 @@ func getRoomInfo(t *testing.T, txn *sqlx.Tx, table *RoomsTable, roomID string) R
 	t.Fatalf("failed to find RoomInfo for room ID: %s", roomID)
 	return RoomInfo{}
 }
+
+func TestRoomsTableSelectRoomIDsWithNameLike(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	txn, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start txn: %s", err)
+	}
+	defer txn.Rollback()
+	table := NewRoomsTable(db)
+	str := func(s string) *string { return &s }
+	rooms := []RoomInfo{
+		{ID: "!name:TestRoomsTableSelectRoomIDsWithNameLike", Name: str("My Room Name")},
+		{ID: "!alias:TestRoomsTableSelectRoomIDsWithNameLike", CanonicalAlias: str("#my-room:localhost")},
+		{ID: "!percent:TestRoomsTableSelectRoomIDsWithNameLike", Name: str("100% room")},
+		{ID: "!unnamed:TestRoomsTableSelectRoomIDsWithNameLike"},
+	}
+	roomIDs := make([]string, len(rooms))
+	for i, info := range rooms {
+		roomIDs[i] = info.ID
+		if err = table.Upsert(txn, info, 1, 1); err != nil {
+			t.Fatalf("Upsert: %s", err)
+		}
+	}
+	// renaming the room updates the name, other updates leave it alone
+	if err = table.Upsert(txn, RoomInfo{ID: rooms[0].ID, Name: str("My Renamed Room")}, 2, 2); err != nil {
+		t.Fatalf("Upsert: %s", err)
+	}
+	if err = table.Upsert(txn, RoomInfo{ID: rooms[0].ID}, 3, 3); err != nil {
+		t.Fatalf("Upsert: %s", err)
+	}
+
+	testCases := []struct {
+		substring string
+		want      []string
+	}{
+		{substring: "my", want: []string{rooms[1].ID, rooms[0].ID}}, // sorted
+		{substring: "RENAMED", want: []string{rooms[0].ID}},
+		{substring: "room name", want: nil},
+		{substring: "#my-room", want: []string{rooms[1].ID}},
+		{substring: "%", want: []string{rooms[2].ID}},
+		{substring: "_", want: nil},
+	}
+	for _, tc := range testCases {
+		got, err := table.SelectRoomIDsWithNameLike(txn, roomIDs, tc.substring)
+		if err != nil {
+			t.Fatalf("SelectRoomIDsWithNameLike: %s", err)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("SelectRoomIDsWithNameLike(%q): got %v want %v", tc.substring, got, tc.want)
+		}
+	}
+}
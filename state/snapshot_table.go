@@ -66,6 +66,20 @@ func (s *SnapshotTable) Select(txn *sqlx.Tx, snapshotID int64) (row SnapshotRow,
 	return
 }
 
+// SelectMany returns the rows for the given snapshot IDs, keyed by snapshot ID.
+func (s *SnapshotTable) SelectMany(txn *sqlx.Tx, snapshotIDs []int64) (map[int64]SnapshotRow, error) {
+	var rows []SnapshotRow
+	err := txn.Select(&rows, `SELECT * FROM syncv3_snapshots WHERE snapshot_id = ANY($1)`, pq.Int64Array(snapshotIDs))
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[int64]SnapshotRow, len(rows))
+	for _, row := range rows {
+		result[row.SnapshotID] = row
+	}
+	return result, nil
+}
+
 // Insert the row. Modifies SnapshotID to be the inserted primary key.
 func (s *SnapshotTable) Insert(txn *sqlx.Tx, row *SnapshotRow) error {
 	var id int64
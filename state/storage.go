@@ -2,9 +2,10 @@ package state
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
 	"strings"
 	"time"
 
@@ -18,14 +19,10 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sqlutil"
-	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger("state")
 
 // Max number of parameters in a single SQL command
 const MaxPostgresParameters = 65535
@@ -34,12 +31,17 @@ const MaxPostgresParameters = 65535
 type StartupSnapshot struct {
 	GlobalMetadata   map[string]internal.RoomMetadata // room_id -> metadata
 	AllJoinedMembers map[string][]string              // room_id -> [user_id]
+	LatestNID        int64                            // the highest event NID included in the snapshot
 }
 
 type LatestEvents struct {
 	Timeline  []json.RawMessage
 	PrevBatch string
 	LatestNID int64
+	// Limited is true if there were more events than the limit. Only set by TimelinesBetween.
+	Limited bool
+	// EarliestNID is the NID of the first event in Timeline. Only set by TimelinesBetween.
+	EarliestNID int64
 }
 
 // DiscardIgnoredMessages modifies the struct in-place, replacing the Timeline with
@@ -59,19 +61,27 @@ func (e *LatestEvents) DiscardIgnoredMessages(shouldIgnore func(sender string) b
 }
 
 type Storage struct {
-	Accumulator       *Accumulator
-	EventsTable       *EventTable
-	ToDeviceTable     *ToDeviceTable
-	UnreadTable       *UnreadTable
-	AccountDataTable  *AccountDataTable
-	InvitesTable      *InvitesTable
-	TransactionsTable *TransactionsTable
-	DeviceDataTable   *DeviceDataTable
-	ReceiptTable      *ReceiptTable
-	DB                *sqlx.DB
-	MaxTimelineLimit  int
-	shutdownCh        chan struct{}
-	shutdown          bool
+	Accumulator           *Accumulator
+	EventsTable           *EventTable
+	ToDeviceTable         *ToDeviceTable
+	UnreadTable           *UnreadTable
+	AccountDataTable      *AccountDataTable
+	InvitesTable          *InvitesTable
+	KnocksTable           *KnocksTable
+	TransactionsTable     *TransactionsTable
+	DeviceDataTable       *DeviceDataTable
+	ReceiptTable          *ReceiptTable
+	MetadataSnapshotTable *MetadataSnapshotTable
+	ErasedUsersTable      *ErasedUsersTable
+	TableStatsTable       *TableStatsTable
+	RelationsTable        *RelationsTable
+	EventArchive          *EventArchive
+	Maintenance           *Maintenance
+	DB                    *sqlx.DB
+	MaxTimelineLimit      int
+	roomStateCache        *roomStateCache
+	shutdownCh            chan struct{}
+	shutdown              bool
 }
 
 func NewStorage(postgresURI string) *Storage {
@@ -86,29 +96,45 @@ func NewStorage(postgresURI string) *Storage {
 
 func NewStorageWithDB(db *sqlx.DB, addPrometheusMetrics bool) *Storage {
 	acc := &Accumulator{
-		db:            db,
-		roomsTable:    NewRoomsTable(db),
-		eventsTable:   NewEventTable(db),
-		snapshotTable: NewSnapshotsTable(db),
-		spacesTable:   NewSpacesTable(db),
-		invitesTable:  NewInvitesTable(db),
-		entityName:    "server",
-	}
-
-	return &Storage{
-		Accumulator:       acc,
-		ToDeviceTable:     NewToDeviceTable(db),
-		UnreadTable:       NewUnreadTable(db),
-		EventsTable:       acc.eventsTable,
-		AccountDataTable:  NewAccountDataTable(db),
-		InvitesTable:      acc.invitesTable,
-		TransactionsTable: NewTransactionsTable(db),
-		DeviceDataTable:   NewDeviceDataTable(db),
-		ReceiptTable:      NewReceiptTable(db),
-		DB:                db,
-		MaxTimelineLimit:  50,
-		shutdownCh:        make(chan struct{}),
+		db:               db,
+		roomsTable:       NewRoomsTable(db),
+		eventsTable:      NewEventTable(db),
+		snapshotTable:    NewSnapshotsTable(db),
+		spacesTable:      NewSpacesTable(db),
+		invitesTable:     NewInvitesTable(db),
+		knocksTable:      NewKnocksTable(db),
+		leavesTable:      NewUserLeavesTable(db),
+		membershipsTable: NewUserMembershipsTable(db),
+		quarantineTable:  NewQuarantineTable(db),
+		relationsTable:   NewRelationsTable(db),
+		entityName:       "server",
 	}
+
+	if addPrometheusMetrics {
+		sqlutil.RegisterMetrics()
+	}
+	s := &Storage{
+		Accumulator:           acc,
+		ToDeviceTable:         NewToDeviceTable(db),
+		UnreadTable:           NewUnreadTable(db),
+		EventsTable:           acc.eventsTable,
+		AccountDataTable:      NewAccountDataTable(db),
+		InvitesTable:          acc.invitesTable,
+		KnocksTable:           acc.knocksTable,
+		TransactionsTable:     NewTransactionsTable(db),
+		DeviceDataTable:       NewDeviceDataTable(db),
+		ReceiptTable:          NewReceiptTable(db),
+		MetadataSnapshotTable: NewMetadataSnapshotTable(db),
+		ErasedUsersTable:      NewErasedUsersTable(db),
+		TableStatsTable:       NewTableStatsTable(db),
+		RelationsTable:        acc.relationsTable,
+		DB:                    db,
+		MaxTimelineLimit:      50,
+		roomStateCache:        newRoomStateCache(defaultRoomStateCacheBytes),
+		shutdownCh:            make(chan struct{}),
+	}
+	s.Maintenance = NewMaintenance(s)
+	return s
 }
 
 func (s *Storage) LatestEventNID() (int64, error) {
@@ -133,14 +159,24 @@ func (s *Storage) RoomAccountDatasWithType(userID, eventType string) (data []Acc
 
 // Pull out all account data for this user. If roomIDs is empty, global account data is returned.
 // If roomIDs is non-empty, all account data for these rooms are extracted.
-func (s *Storage) AccountDatas(userID string, roomIDs ...string) (datas []AccountData, err error) {
-	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+func (s *Storage) AccountDatas(ctx context.Context, userID string, roomIDs ...string) (datas []AccountData, err error) {
+	err = sqlutil.WithTransactionContext(ctx, s.Accumulator.db, func(txn *sqlx.Tx) error {
 		datas, err = s.AccountDataTable.SelectMany(txn, userID, roomIDs...)
 		return err
 	})
 	return
 }
 
+// AccountDatasSince returns all account data for this user which was added or updated after the
+// position `since`. The position of the last returned item is its ID.
+func (s *Storage) AccountDatasSince(ctx context.Context, userID string, since int64) (datas []AccountData, err error) {
+	err = sqlutil.WithTransactionContext(ctx, s.Accumulator.db, func(txn *sqlx.Tx) error {
+		datas, err = s.AccountDataTable.SelectSince(txn, userID, since)
+		return err
+	})
+	return
+}
+
 func (s *Storage) InsertAccountData(userID, roomID string, events []json.RawMessage) (data []AccountData, err error) {
 	data = make([]AccountData, len(events))
 	for i := range events {
@@ -178,6 +214,13 @@ func (s *Storage) PrepareSnapshot(txn *sqlx.Tx) (tableName string, err error) {
 // a sliding sync instance. It will atomically grab metadata for all rooms and all joined members
 // in a single transaction.
 func (s *Storage) GlobalSnapshot() (ss StartupSnapshot, err error) {
+	// The queries must all see the same data, so they run one after another in the same
+	// transaction. Log how long each takes, as this can take minutes for large databases.
+	phaseStart := time.Now()
+	loaded := func(phase string) {
+		logger.Info().Str("phase", phase).Dur("duration", time.Since(phaseStart)).Msg("GlobalSnapshot: loaded")
+		phaseStart = time.Now()
+	}
 	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
 		tempTableName, err := s.PrepareSnapshot(txn)
 		if err != nil {
@@ -185,6 +228,7 @@ func (s *Storage) GlobalSnapshot() (ss StartupSnapshot, err error) {
 			sentry.CaptureException(err)
 			return err
 		}
+		loaded("current_snapshots")
 		var metadata map[string]internal.RoomMetadata
 		ss.AllJoinedMembers, metadata, err = s.AllJoinedMembers(txn, tempTableName)
 		if err != nil {
@@ -192,48 +236,149 @@ func (s *Storage) GlobalSnapshot() (ss StartupSnapshot, err error) {
 			sentry.CaptureException(err)
 			return err
 		}
-		err = s.MetadataForAllRooms(txn, tempTableName, metadata)
+		loaded("joined_members")
+		if err = txn.QueryRow(`SELECT COALESCE(MAX(event_nid), 0) FROM syncv3_events`).Scan(&ss.LatestNID); err != nil {
+			err = fmt.Errorf("GlobalSnapshot: failed to select latest NID: %w", err)
+			sentry.CaptureException(err)
+			return err
+		}
+		metadataSnapshot, err := s.MetadataSnapshotTable.Select(txn)
+		if err != nil {
+			err = fmt.Errorf("GlobalSnapshot: failed to select metadata snapshot: %w", err)
+			sentry.CaptureException(err)
+			return err
+		}
+		loaded("metadata_snapshot")
+		if metadataSnapshot != nil {
+			err = s.MetadataFromSnapshot(txn, metadataSnapshot, metadata)
+		} else {
+			err = s.MetadataForAllRooms(txn, tempTableName, metadata)
+		}
 		if err != nil {
-			err = fmt.Errorf("GlobalSnapshot: failed to call MetadataForAllRooms: %w", err)
+			err = fmt.Errorf("GlobalSnapshot: failed to load metadata: %w", err)
 			sentry.CaptureException(err)
 			return err
 		}
+		loaded("metadata")
 		ss.GlobalMetadata = metadata
 		return err
 	})
 	return
 }
 
-// Extract hero info for all rooms. Requires a prepared snapshot in order to be called.
-func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result map[string]internal.RoomMetadata) error {
-	loadMetadata := func(roomID string) internal.RoomMetadata {
+// MetadataFromSnapshot is like MetadataForAllRooms but uses a MetadataSnapshot for the expensive
+// parts of the metadata. They are recalculated from the database for rooms which have had events
+// since the snapshot, and for rooms which are missing from it.
+func (s *Storage) MetadataFromSnapshot(txn *sqlx.Tx, snapshot *MetadataSnapshot, result map[string]internal.RoomMetadata) error {
+	var changedRoomIDs []string
+	err := txn.Select(&changedRoomIDs, `SELECT DISTINCT room_id FROM syncv3_events WHERE event_nid > $1`, snapshot.LatestNID)
+	if err != nil {
+		return fmt.Errorf("failed to select rooms changed since the snapshot: %s", err)
+	}
+	changed := make(map[string]struct{}, len(changedRoomIDs))
+	for _, roomID := range changedRoomIDs {
+		changed[roomID] = struct{}{}
+	}
+	var existingRoomIDs []string
+	if err = txn.Select(&existingRoomIDs, `SELECT room_id FROM syncv3_rooms`); err != nil {
+		return fmt.Errorf("failed to select rooms: %s", err)
+	}
+	numFromSnapshot := 0
+	for _, roomID := range existingRoomIDs {
+		if _, isChanged := changed[roomID]; isChanged {
+			continue
+		}
+		snapshotted, ok := snapshot.Rooms[roomID]
+		if !ok {
+			// e.g the room was not in the cache when the snapshot was taken
+			changed[roomID] = struct{}{}
+			changedRoomIDs = append(changedRoomIDs, roomID)
+			continue
+		}
 		metadata, ok := result[roomID]
 		if !ok {
 			metadata = *internal.NewRoomMetadata(roomID)
 		}
-		return metadata
+		metadata.NameEvent = snapshotted.NameEvent
+		metadata.AvatarEvent = snapshotted.AvatarEvent
+		metadata.CanonicalAlias = snapshotted.CanonicalAlias
+		metadata.LastMessageTimestamp = snapshotted.LastMessageTimestamp
+		metadata.PinnedEvent = snapshotted.PinnedEvent
+		metadata.PinnedEventNID = snapshotted.PinnedEventNID
+		for evType, eventMetadata := range snapshotted.LatestEventsByType {
+			metadata.LatestEventsByType[evType] = eventMetadata
+		}
+		result[roomID] = metadata
+		numFromSnapshot++
 	}
+	logger.Info().Int64("snapshot_nid", snapshot.LatestNID).Int("from_snapshot", numFromSnapshot).
+		Int("recalculated", len(changedRoomIDs)).Msg("loading room metadata from snapshot")
 
+	if len(changedRoomIDs) > 0 {
+		events, err := s.Accumulator.eventsTable.selectLatestEventByTypeInRooms(txn, changedRoomIDs)
+		if err != nil {
+			return err
+		}
+		applyLatestEvents(result, events)
+		roomIDToStateEvents, err := s.currentNotMembershipStateEventsInRooms(txn, metadataStateEventTypes, changedRoomIDs)
+		if err != nil {
+			return fmt.Errorf("failed to load state events for changed rooms: %s", err)
+		}
+		applyMetadataStateEvents(result, roomIDToStateEvents)
+	}
+	return s.applyRoomInfos(txn, result)
+}
+
+// the state events which are held in internal.RoomMetadata, other than memberships.
+var metadataStateEventTypes = []string{"m.room.name", "m.room.canonical_alias", "m.room.avatar", "m.room.pinned_events"}
+
+// Extract hero info for all rooms. Requires a prepared snapshot in order to be called.
+func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result map[string]internal.RoomMetadata) error {
 	// work out latest timestamps
 	events, err := s.Accumulator.eventsTable.selectLatestEventByTypeInAllRooms(txn)
 	if err != nil {
 		return err
 	}
+	applyLatestEvents(result, events)
+
+	// Select the name / canonical alias for all rooms
+	roomIDToStateEvents, err := s.currentNotMembershipStateEventsInAllRooms(txn, metadataStateEventTypes)
+	if err != nil {
+		return fmt.Errorf("failed to load state events for all rooms: %s", err)
+	}
+	applyMetadataStateEvents(result, roomIDToStateEvents)
+
+	return s.applyRoomInfos(txn, result)
+}
+
+func loadMetadata(result map[string]internal.RoomMetadata, roomID string) internal.RoomMetadata {
+	metadata, ok := result[roomID]
+	if !ok {
+		metadata = *internal.NewRoomMetadata(roomID)
+	}
+	return metadata
+}
+
+// applyLatestEvents sets the latest timestamps from the latest event of each type in each room.
+// The events exclude edits and redacted events, so an edited message keeps its original timestamp
+// and a redacted message no longer counts. Redactions don't change the last message timestamp.
+func applyLatestEvents(result map[string]internal.RoomMetadata, events []Event) {
 	for _, ev := range events {
-		metadata := loadMetadata(ev.RoomID)
+		metadata := loadMetadata(result, ev.RoomID)
 
 		// For a given room, we'll see many events (one for each event type in the
 		// room's state). We need to pick the largest of these events' timestamps here.
-		ts := gjson.ParseBytes(ev.JSON).Get("origin_server_ts").Uint()
-		if ts > metadata.LastMessageTimestamp {
+		parsed := gjson.ParseBytes(ev.JSON)
+		evType := parsed.Get("type").Str
+		ts := parsed.Get("origin_server_ts").Uint()
+		if ts > metadata.LastMessageTimestamp && evType != "m.room.redaction" {
 			metadata.LastMessageTimestamp = ts
 		}
-		parsed := gjson.ParseBytes(ev.JSON)
 		eventMetadata := internal.EventMetadata{
 			NID:       ev.NID,
-			Timestamp: parsed.Get("origin_server_ts").Uint(),
+			Timestamp: ts,
 		}
-		metadata.LatestEventsByType[parsed.Get("type").Str] = eventMetadata
+		metadata.LatestEventsByType[evType] = eventMetadata
 		// it's possible the latest event is a brand new room not caught by the first SELECT for joined
 		// rooms e.g when you're invited to a room so we need to make sure to set the metadata again here
 		// TODO: is the comment above now that we explicitly call NewRoomMetadata above
@@ -241,16 +386,12 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 		metadata.RoomID = ev.RoomID
 		result[ev.RoomID] = metadata
 	}
+}
 
-	// Select the name / canonical alias for all rooms
-	roomIDToStateEvents, err := s.currentNotMembershipStateEventsInAllRooms(txn, []string{
-		"m.room.name", "m.room.canonical_alias", "m.room.avatar",
-	})
-	if err != nil {
-		return fmt.Errorf("failed to load state events for all rooms: %s", err)
-	}
+// applyMetadataStateEvents sets the name, avatar, canonical alias and pinned events from the current state events.
+func applyMetadataStateEvents(result map[string]internal.RoomMetadata, roomIDToStateEvents map[string][]Event) {
 	for roomID, stateEvents := range roomIDToStateEvents {
-		metadata := loadMetadata(roomID)
+		metadata := loadMetadata(result, roomID)
 		for _, ev := range stateEvents {
 			if ev.Type == "m.room.name" && ev.StateKey == "" {
 				metadata.NameEvent = gjson.ParseBytes(ev.JSON).Get("content.name").Str
@@ -258,18 +399,24 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 				metadata.CanonicalAlias = gjson.ParseBytes(ev.JSON).Get("content.alias").Str
 			} else if ev.Type == "m.room.avatar" && ev.StateKey == "" {
 				metadata.AvatarEvent = gjson.ParseBytes(ev.JSON).Get("content.url").Str
+			} else if ev.Type == "m.room.pinned_events" && ev.StateKey == "" {
+				metadata.PinnedEvent = ev.JSON
+				metadata.PinnedEventNID = ev.NID
 			}
 		}
 		result[roomID] = metadata
 	}
+}
 
+// applyRoomInfos sets the room infos and space children for all rooms.
+func (s *Storage) applyRoomInfos(txn *sqlx.Tx, result map[string]internal.RoomMetadata) error {
 	roomInfos, err := s.Accumulator.roomsTable.SelectRoomInfos(txn)
 	if err != nil {
 		return fmt.Errorf("failed to select room infos: %s", err)
 	}
 	var spaceRoomIDs []string
 	for _, info := range roomInfos {
-		metadata := loadMetadata(info.ID)
+		metadata := loadMetadata(result, info.ID)
 		metadata.Encrypted = info.IsEncrypted
 		metadata.UpgradedRoomID = info.UpgradedRoomID
 		metadata.PredecessorRoomID = info.PredecessorRoomID
@@ -292,7 +439,7 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 			// we don't want to have a stub metadata with just the space children, so skip it.
 			continue
 		}
-		metadata := loadMetadata(roomID)
+		metadata := loadMetadata(result, roomID)
 		metadata.ChildSpaceRooms = make(map[string]struct{}, len(relations))
 		for _, r := range relations {
 			// For now we only honour child state events, but we store all the mappings just in case.
@@ -305,6 +452,48 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 	return nil
 }
 
+// RecalculateLatestEventsAfterRedaction updates the given metadata in-place if the redacted event
+// was the latest event of its type, so that redacted messages stop bumping the room. The redaction
+// must already have been applied to the database. This is only safe to call from the subscriber
+// goroutine, like ResetMetadataState.
+func (s *Storage) RecalculateLatestEventsAfterRedaction(metadata *internal.RoomMetadata, redactedEventID string) error {
+	return sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		var redacted Event
+		err := txn.Get(&redacted, `SELECT event_nid, event_type FROM syncv3_events WHERE event_id = $1 AND room_id = $2`,
+			redactedEventID, metadata.RoomID)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("RecalculateLatestEventsAfterRedaction[%s]: %w", redactedEventID, err)
+		}
+		if latest, ok := metadata.LatestEventsByType[redacted.Type]; !ok || latest.NID != redacted.NID {
+			return nil // an older event was redacted, so nothing changes
+		}
+		ev, err := s.EventsTable.selectLatestEventOfTypeInRoom(txn, metadata.RoomID, redacted.Type)
+		if err != nil {
+			return fmt.Errorf("RecalculateLatestEventsAfterRedaction[%s]: %w", redactedEventID, err)
+		}
+		if ev == nil {
+			delete(metadata.LatestEventsByType, redacted.Type)
+		} else {
+			metadata.LatestEventsByType[redacted.Type] = internal.EventMetadata{
+				NID:       ev.NID,
+				Timestamp: gjson.GetBytes(ev.JSON, "origin_server_ts").Uint(),
+			}
+		}
+		var lastMessageTimestamp uint64
+		for evType, latest := range metadata.LatestEventsByType {
+			if evType != "m.room.redaction" && latest.Timestamp > lastMessageTimestamp {
+				lastMessageTimestamp = latest.Timestamp
+			}
+		}
+		if lastMessageTimestamp > 0 {
+			metadata.LastMessageTimestamp = lastMessageTimestamp
+		}
+		return nil
+	})
+}
+
 // ResetMetadataState updates the given metadata in-place to reflect the current state
 // of the room. This is only safe to call from the subscriber goroutine; it is not safe
 // to call from the connection goroutines.
@@ -318,14 +507,18 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
             JOIN syncv3_rooms ON snapshot_id = current_snapshot_id
         WHERE syncv3_rooms.room_id = $1
     )
-	SELECT event_id, event_type, state_key, event, membership
+	SELECT event_nid, event_id, event_type, state_key, event, membership
 	FROM syncv3_events JOIN snapshot ON (
 		event_nid = ANY (ARRAY_CAT(events, membership_events))
 	)
-	WHERE (event_type IN ('m.room.name', 'm.room.avatar', 'm.room.canonical_alias', 'm.room.encryption') AND state_key = '')
+	WHERE (event_type IN ('m.room.name', 'm.room.avatar', 'm.room.canonical_alias', 'm.room.encryption', 'm.room.pinned_events') AND state_key = '')
 	   OR (event_type = 'm.room.member' AND membership IN ('join', '_join', 'invite', '_invite'))
+	   OR event_type = 'm.space.child'
 	ORDER BY event_nid ASC
 	;`, metadata.RoomID)
+	if err == nil {
+		err = s.EventsTable.loadArchived(context.Background(), nil, events)
+	}
 	if err != nil {
 		return fmt.Errorf("ResetMetadataState[%s]: %w", metadata.RoomID, err)
 	}
@@ -334,6 +527,8 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
 	metadata.JoinCount = 0
 	metadata.InviteCount = 0
 	metadata.ChildSpaceRooms = make(map[string]struct{})
+	metadata.PinnedEvent = nil
+	metadata.PinnedEventNID = 0
 
 	for i, ev := range events {
 		switch ev.Type {
@@ -345,6 +540,9 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
 			metadata.CanonicalAlias = gjson.GetBytes(ev.JSON, "content.alias").Str
 		case "m.room.encryption":
 			metadata.Encrypted = true
+		case "m.room.pinned_events":
+			metadata.PinnedEvent = ev.JSON
+			metadata.PinnedEventNID = ev.NID
 		case "m.room.member":
 			heroMemberships.append(&events[i])
 			switch ev.Membership {
@@ -358,7 +556,9 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
 				metadata.InviteCount++
 			}
 		case "m.space.child":
-			metadata.ChildSpaceRooms[ev.StateKey] = struct{}{}
+			if gjson.GetBytes(ev.JSON, "content.via").IsArray() {
+				metadata.ChildSpaceRooms[ev.StateKey] = struct{}{}
+			}
 		}
 	}
 
@@ -380,6 +580,175 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
 	return nil
 }
 
+// LatestEventNIDInRoom returns the highest event NID stored for this room, or 0 if there are none.
+func (s *Storage) LatestEventNIDInRoom(roomID string) (nid int64, err error) {
+	err = s.DB.QueryRow(`SELECT COALESCE(MAX(event_nid), 0) FROM syncv3_events WHERE room_id = $1`, roomID).Scan(&nid)
+	return
+}
+
+// TableStats describes the size of a database table.
+type TableStats struct {
+	Name string `db:"name"`
+	// EstimatedRows is Postgres' estimate of the number of rows, which is updated by VACUUM and ANALYZE.
+	EstimatedRows int64 `db:"estimated_rows"`
+	// Bytes is the size of the table including indexes and TOAST data.
+	Bytes int64 `db:"bytes"`
+}
+
+// TableStats returns size information for all of the proxy's tables. Row counts are estimates, as
+// counting large tables exactly is too slow to do routinely.
+func (s *Storage) TableStats() (stats []TableStats, err error) {
+	err = s.DB.Select(&stats, `
+	SELECT relname AS name, GREATEST(reltuples, 0)::BIGINT AS estimated_rows, pg_total_relation_size(c.oid) AS bytes
+	FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE c.relkind = 'r' AND n.nspname = current_schema() AND relname LIKE 'syncv3\_%'
+	ORDER BY relname`)
+	return
+}
+
+// NumRooms returns the number of rooms the proxy knows about.
+func (s *Storage) NumRooms() (count int, err error) {
+	err = s.DB.QueryRow(`SELECT COUNT(*) FROM syncv3_rooms`).Scan(&count)
+	return
+}
+
+// PurgeRoomResult is returned from PurgeRoom.
+type PurgeRoomResult struct {
+	// UserIDs is every user with a membership event or invite in the room prior to the purge.
+	UserIDs []string
+	// NumEvents is the number of events deleted.
+	NumEvents int64
+	// NumArchives is the number of objects in the event archive which were deleted or rewritten.
+	NumArchives int
+}
+
+// PurgeRoom deletes all events, snapshots, receipts, unread counts, invites, knocks, typing notifications,
+// room account data, space relations, event relations and metadata for the given room in a single transaction.
+// Archived events are deleted from the object store before the transaction commits.
+// If pollers are still receiving data for this room, it will reappear.
+func (s *Storage) PurgeRoom(roomID string) (result PurgeRoomResult, err error) {
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		err := txn.Select(&result.UserIDs, `
+		SELECT state_key FROM syncv3_events WHERE room_id = $1 AND event_type = 'm.room.member'
+		UNION SELECT user_id FROM syncv3_invites WHERE room_id = $1
+		UNION SELECT user_id FROM syncv3_knocks WHERE room_id = $1`, roomID)
+		if err != nil {
+			return fmt.Errorf("failed to select users: %w", err)
+		}
+		if s.EventArchive != nil {
+			result.NumArchives, err = s.EventArchive.RemoveRoom(context.Background(), txn, roomID)
+			if err != nil {
+				return fmt.Errorf("failed to delete archived events: %w", err)
+			}
+		}
+		// txn IDs are keyed by event ID, so must be deleted before the events.
+		_, err = txn.Exec(`DELETE FROM syncv3_txns WHERE event_id IN (SELECT event_id FROM syncv3_events WHERE room_id = $1)`, roomID)
+		if err != nil {
+			return fmt.Errorf("failed to delete txns: %w", err)
+		}
+		res, err := txn.Exec(`DELETE FROM syncv3_events WHERE room_id = $1`, roomID)
+		if err != nil {
+			return fmt.Errorf("failed to delete events: %w", err)
+		}
+		if result.NumEvents, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		for _, table := range []string{
+			"syncv3_snapshots", "syncv3_rooms", "syncv3_receipts", "syncv3_receipts_private",
+			"syncv3_unread", "syncv3_invites", "syncv3_knocks", "syncv3_typing", "syncv3_account_data", "syncv3_user_leaves", "syncv3_user_memberships",
+			"syncv3_quarantined_events", "syncv3_event_relations",
+		} {
+			if _, err = txn.Exec(`DELETE FROM `+table+` WHERE room_id = $1`, roomID); err != nil {
+				return fmt.Errorf("failed to delete from %s: %w", table, err)
+			}
+		}
+		_, err = txn.Exec(`DELETE FROM syncv3_spaces WHERE parent = $1 OR child = $1`, roomID)
+		if err != nil {
+			return fmt.Errorf("failed to delete space relations: %w", err)
+		}
+		return nil
+	})
+	if err == nil {
+		s.roomStateCache.invalidate(roomID)
+	}
+	return
+}
+
+// EraseUserResult is returned from EraseUser.
+type EraseUserResult struct {
+	// RoomIDs are the rooms in which the user's membership events were stripped of profile data.
+	RoomIDs []string
+	// NumEvents is the number of membership events which were modified.
+	NumEvents int64
+	// NumReceipts is the number of public and private receipts deleted.
+	NumReceipts int64
+}
+
+// EraseUser marks the user as erased, strips their display name and avatar from all of their
+// membership events (including archived ones) and deletes their receipts, in a single transaction. Callers must strip
+// profile data from events for this user which are accumulated afterwards, see StripProfile.
+func (s *Storage) EraseUser(userID string) (result EraseUserResult, err error) {
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		if err := s.ErasedUsersTable.Insert(txn, userID); err != nil {
+			return fmt.Errorf("failed to mark user as erased: %w", err)
+		}
+		var events []Event
+		err := txn.Select(&events, `SELECT event_nid, room_id, event FROM syncv3_events
+		WHERE event_type = 'm.room.member' AND state_key = $1`, userID)
+		if err == nil {
+			err = s.EventsTable.loadArchived(context.Background(), txn, events)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to select membership events: %w", err)
+		}
+		rooms := make(map[string]struct{})
+		var changedNIDs []int64
+		for _, ev := range events {
+			if _, changed := StripProfile(ev.JSON); changed {
+				changedNIDs = append(changedNIDs, ev.NID)
+			}
+		}
+		if s.EventArchive != nil {
+			// the stripped events are moved back into the database, so the profile data does not
+			// survive in the object store
+			if _, err = s.EventArchive.Remove(context.Background(), txn, changedNIDs); err != nil {
+				return fmt.Errorf("failed to remove archived events: %w", err)
+			}
+		}
+		for _, ev := range events {
+			stripped, changed := StripProfile(ev.JSON)
+			if !changed {
+				continue
+			}
+			if _, err = txn.Exec(`UPDATE syncv3_events SET event = $1, archive_id = NULL WHERE event_nid = $2`, []byte(stripped), ev.NID); err != nil {
+				return fmt.Errorf("failed to update event %d: %w", ev.NID, err)
+			}
+			result.NumEvents++
+			if _, ok := rooms[ev.RoomID]; !ok {
+				rooms[ev.RoomID] = struct{}{}
+				result.RoomIDs = append(result.RoomIDs, ev.RoomID)
+			}
+		}
+		for _, table := range []string{"syncv3_receipts", "syncv3_receipts_private"} {
+			res, err := txn.Exec(`DELETE FROM `+table+` WHERE user_id = $1`, userID)
+			if err != nil {
+				return fmt.Errorf("failed to delete from %s: %w", table, err)
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			result.NumReceipts += n
+		}
+		return nil
+	})
+	if err == nil {
+		// membership events were modified in place
+		s.roomStateCache.invalidate(result.RoomIDs...)
+	}
+	return
+}
+
 // FetchMemberships looks up the latest snapshot for the given room and determines the
 // latest membership events in the room. Returns
 //   - the list of joined members,
@@ -431,11 +800,30 @@ func (s *Storage) FetchMemberships(roomID string) (joins, invites, leaves []stri
 	return
 }
 
+// currentNotMembershipStateEventsInRooms is like currentNotMembershipStateEventsInAllRooms but only
+// for the given rooms.
+func (s *Storage) currentNotMembershipStateEventsInRooms(txn *sqlx.Tx, eventTypes, roomIDs []string) (map[string][]Event, error) {
+	query, args, err := sqlx.In(
+		`SELECT syncv3_events.event_nid, syncv3_events.room_id, syncv3_events.event_type, syncv3_events.state_key, syncv3_events.event FROM syncv3_events
+		WHERE syncv3_events.event_type IN (?)
+		AND syncv3_events.event_nid IN (
+			SELECT UNNEST(events) FROM syncv3_snapshots WHERE syncv3_snapshots.snapshot_id IN (
+				SELECT current_snapshot_id FROM syncv3_rooms WHERE room_id IN (?)
+			)
+		)`,
+		eventTypes, roomIDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return s.selectStateEventsByRoom(txn, txn.Rebind(query), args...)
+}
+
 // Returns all current NOT MEMBERSHIP state events matching the event types given in all rooms. Returns a map of
 // room ID to events in that room.
 func (s *Storage) currentNotMembershipStateEventsInAllRooms(txn *sqlx.Tx, eventTypes []string) (map[string][]Event, error) {
 	query, args, err := sqlx.In(
-		`SELECT syncv3_events.room_id, syncv3_events.event_type, syncv3_events.state_key, syncv3_events.event FROM syncv3_events
+		`SELECT syncv3_events.event_nid, syncv3_events.room_id, syncv3_events.event_type, syncv3_events.state_key, syncv3_events.event FROM syncv3_events
 		WHERE syncv3_events.event_type IN (?)
 		AND syncv3_events.event_nid IN (
 			SELECT UNNEST(events) FROM syncv3_snapshots WHERE syncv3_snapshots.snapshot_id IN (SELECT current_snapshot_id FROM syncv3_rooms)
@@ -445,7 +833,12 @@ func (s *Storage) currentNotMembershipStateEventsInAllRooms(txn *sqlx.Tx, eventT
 	if err != nil {
 		return nil, err
 	}
-	rows, err := txn.Query(txn.Rebind(query), args...)
+	return s.selectStateEventsByRoom(txn, txn.Rebind(query), args...)
+}
+
+// selectStateEventsByRoom runs a query which selects event_nid, room_id, event_type, state_key, event.
+func (s *Storage) selectStateEventsByRoom(txn *sqlx.Tx, query string, args ...interface{}) (map[string][]Event, error) {
+	rows, err := txn.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -453,11 +846,20 @@ func (s *Storage) currentNotMembershipStateEventsInAllRooms(txn *sqlx.Tx, eventT
 	result := make(map[string][]Event)
 	for rows.Next() {
 		var ev Event
-		if err := rows.Scan(&ev.RoomID, &ev.Type, &ev.StateKey, &ev.JSON); err != nil {
+		if err := rows.Scan(&ev.NID, &ev.RoomID, &ev.Type, &ev.StateKey, &ev.JSON); err != nil {
 			return nil, err
 		}
 		result[ev.RoomID] = append(result[ev.RoomID], ev)
 	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	for roomID := range result {
+		if err = s.EventsTable.loadArchived(context.Background(), txn, result[roomID]); err != nil {
+			return nil, err
+		}
+	}
 	return result, nil
 }
 
@@ -465,15 +867,22 @@ func (s *Storage) Accumulate(userID, roomID string, timeline sync2.TimelineRespo
 	if len(timeline.Events) == 0 {
 		return AccumulateResult{}, nil
 	}
-	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+	err = sqlutil.WithRetryingTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
 		result, err = s.Accumulator.Accumulate(txn, userID, roomID, timeline)
 		return err
 	})
+	if err == nil && result.ChangedState {
+		s.roomStateCache.invalidate(roomID)
+	}
 	return result, err
 }
 
 func (s *Storage) Initialise(roomID string, state []json.RawMessage) (InitialiseResult, error) {
-	return s.Accumulator.Initialise(roomID, state)
+	res, err := s.Accumulator.Initialise(roomID, state)
+	if err == nil && (res.AddedEvents || res.RewoundState) {
+		s.roomStateCache.invalidate(roomID)
+	}
+	return res, err
 }
 
 // EventNIDs fetches the raw JSON form of events given a slice of eventNIDs. The events
@@ -515,11 +924,26 @@ func (s *Storage) StateSnapshot(snapID int64) (state []json.RawMessage, err erro
 // If the list of state keys is empty then all events matching that event type will be returned. If the map is empty entirely, then all room state
 // will be returned.
 func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []string, pos int64, eventTypesToStateKeys map[string][]string) (roomToEvents map[string][]Event, err error) {
-	_, span := internal.StartSpan(ctx, "RoomStateAfterEventPosition")
+	roomToPos := make(map[string]int64, len(roomIDs))
+	for _, roomID := range roomIDs {
+		roomToPos[roomID] = pos
+	}
+	return s.RoomStateAfterEventPositions(ctx, roomToPos, eventTypesToStateKeys)
+}
+
+// RoomStateAfterEventPositions is like RoomStateAfterEventPosition, but each room is loaded at its own position,
+// e.g the position the user left the room. All rooms are loaded with a fixed number of queries.
+func (s *Storage) RoomStateAfterEventPositions(ctx context.Context, roomToPos map[string]int64, eventTypesToStateKeys map[string][]string) (roomToEvents map[string][]Event, err error) {
+	_, span := internal.StartSpan(ctx, "RoomStateAfterEventPositions")
 	defer span.End()
+	roomIDs := internal.Keys(roomToPos)
 	roomToEvents = make(map[string][]Event, len(roomIDs))
 	roomIndex := make(map[string]int, len(roomIDs))
-	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+	// read before loading anything, so results are not cached if the room changes meanwhile
+	generation := s.roomStateCache.currentGeneration()
+	filter := normaliseStateFilter(eventTypesToStateKeys)
+	var missedKeys []roomStateCacheKey
+	err = sqlutil.WithTransactionContext(ctx, s.Accumulator.db, func(txn *sqlx.Tx) error {
 		// we have 2 ways to pull the latest events:
 		//  - superfast rooms table (which races as it can be updated before the new state hits the dispatcher)
 		//  - slower events table query
@@ -532,10 +956,10 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 			return err
 		}
 		fastNIDs := make([]int64, 0, len(roomToLatestNIDs))
-		var slowRooms []string
+		slowRooms := make(map[string]int64)
 		for roomID, latestNID := range roomToLatestNIDs {
-			if latestNID > pos {
-				slowRooms = append(slowRooms, roomID)
+			if pos := roomToPos[roomID]; latestNID > pos {
+				slowRooms[roomID] = pos
 			} else {
 				fastNIDs = append(fastNIDs, latestNID)
 			}
@@ -545,32 +969,74 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 			return fmt.Errorf("failed to select latest nids in rooms %v: %s", roomIDs, err)
 		}
 		if len(slowRooms) > 0 {
-			logger.Warn().Int("slow_rooms", len(slowRooms)).Msg("RoomStateAfterEventPosition: pos value provided is far behind the database copy, performance degraded")
-			latestSlowEvents, err := s.Accumulator.eventsTable.LatestEventInRooms(txn, slowRooms, pos)
+			logger.Warn().Int("slow_rooms", len(slowRooms)).Msg("RoomStateAfterEventPositions: pos value provided is far behind the database copy, performance degraded")
+			latestSlowEvents, err := s.Accumulator.eventsTable.LatestEventInRoomsAtPositions(txn, slowRooms)
 			if err != nil {
 				return err
 			}
 			latestEvents = append(latestEvents, latestSlowEvents...)
 		}
+		// if there is no before snapshot then the last event NID is _part of_ the initial state,
+		// ergo the state after it == the current state and we can safely ignore the lastEventNID
+		var initialStateRoomIDs []string
 		for i, ev := range latestEvents {
 			roomIndex[ev.RoomID] = i
 			if ev.BeforeStateSnapshotID == 0 {
-				// if there is no before snapshot then this last event NID is _part of_ the initial state,
-				// ergo the state after this == the current state and we can safely ignore the lastEventNID
-				ev.BeforeStateSnapshotID = 0
-				ev.BeforeStateSnapshotID, err = s.Accumulator.roomsTable.CurrentAfterSnapshotID(txn, ev.RoomID)
-				if err != nil {
-					return err
-				}
-				latestEvents[i] = ev
+				initialStateRoomIDs = append(initialStateRoomIDs, ev.RoomID)
+			}
+		}
+		if len(initialStateRoomIDs) > 0 {
+			currentSnapshotIDs, err := s.Accumulator.roomsTable.CurrentAfterSnapshotIDs(txn, initialStateRoomIDs)
+			if err != nil {
+				return err
+			}
+			for _, roomID := range initialStateRoomIDs {
+				latestEvents[roomIndex[roomID]].BeforeStateSnapshotID = currentSnapshotIDs[roomID]
 			}
 		}
 
+		// many clients request the same state for the same rooms, so check the cache before
+		// loading the snapshots.
+		missedEvents := latestEvents[:0]
+		for _, ev := range latestEvents {
+			key := roomStateCacheKey{
+				roomID:     ev.RoomID,
+				snapshotID: ev.BeforeStateSnapshotID,
+				filter:     filter,
+			}
+			if gjson.GetBytes(ev.JSON, "state_key").Exists() {
+				key.stateNID = ev.NID
+			}
+			if events, ok := s.roomStateCache.get(key); ok {
+				roomToEvents[ev.RoomID] = events
+				continue
+			}
+			missedEvents = append(missedEvents, ev)
+			missedKeys = append(missedKeys, key)
+		}
+		latestEvents = missedEvents
+		if len(latestEvents) == 0 {
+			return nil
+		}
+		roomIndex = make(map[string]int, len(latestEvents))
+		for i, ev := range latestEvents {
+			roomIndex[ev.RoomID] = i
+		}
+
 		if len(eventTypesToStateKeys) == 0 {
+			snapIDs := make([]int64, len(latestEvents))
+			for i := range latestEvents {
+				snapIDs[i] = latestEvents[i].BeforeStateSnapshotID
+			}
+			snapshotRows, err := s.Accumulator.snapshotTable.SelectMany(txn, snapIDs)
+			if err != nil {
+				return err
+			}
+			var allNIDs []int64
 			for _, ev := range latestEvents {
-				snapshotRow, err := s.Accumulator.snapshotTable.Select(txn, ev.BeforeStateSnapshotID)
-				if err != nil {
-					return err
+				snapshotRow, ok := snapshotRows[ev.BeforeStateSnapshotID]
+				if !ok {
+					return fmt.Errorf("missing state snapshot %v for room %v", ev.BeforeStateSnapshotID, ev.RoomID)
 				}
 				allStateEventNIDs := append(snapshotRow.MembershipEvents, snapshotRow.OtherEvents...)
 				// we need to roll forward if this event is state
@@ -599,11 +1065,14 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 						}
 					}
 				}
-				events, err := s.Accumulator.eventsTable.SelectByNIDs(txn, true, allStateEventNIDs)
-				if err != nil {
-					return fmt.Errorf("failed to select state snapshot %v for room %v: %s", ev.BeforeStateSnapshotID, ev.RoomID, err)
-				}
-				roomToEvents[ev.RoomID] = events
+				allNIDs = append(allNIDs, allStateEventNIDs...)
+			}
+			events, err := s.Accumulator.eventsTable.SelectByNIDs(txn, true, allNIDs)
+			if err != nil {
+				return fmt.Errorf("failed to select state snapshots %v: %s", snapIDs, err)
+			}
+			for _, ev := range events {
+				roomToEvents[ev.RoomID] = append(roomToEvents[ev.RoomID], ev)
 			}
 		} else {
 			// do an optimised query to pull out only the event types and state keys we care about.
@@ -702,17 +1171,34 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 				}
 			}
 		}
+		for roomID := range roomToEvents {
+			if err = s.EventsTable.loadArchived(ctx, txn, roomToEvents[roomID]); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
+	if err == nil {
+		s.cacheRoomState(roomToEvents, missedKeys, generation)
+	}
 	return
 }
 
+// cacheRoomState adds the results for the rooms which missed the cache.
+func (s *Storage) cacheRoomState(roomToEvents map[string][]Event, keys []roomStateCacheKey, generation uint64) {
+	for _, key := range keys {
+		s.roomStateCache.add(key, generation, roomToEvents[key.roomID])
+	}
+}
+
 // LatestEventsInRooms returns the most recent events
 // - in the given rooms
 // - that the user has permission to see
 // - with NIDs <= `to`.
 // Up to `limit` events are chosen per room. This limit be itself be limited according to MaxTimelineLimit.
-func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string]*LatestEvents, error) {
+// LatestEventsInRooms returns the most recent events the user can see in each room, up to and
+// including `to`, which match the filter. The queries are aborted if the context is cancelled.
+func (s *Storage) LatestEventsInRooms(ctx context.Context, userID string, roomIDs []string, to int64, limit int, filter internal.EventTypeFilter) (map[string]*LatestEvents, error) {
 	roomIDToRange, err := s.visibleEventNIDsBetweenForRooms(userID, roomIDs, 0, to)
 	if err != nil {
 		return nil, err
@@ -721,13 +1207,13 @@ func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64,
 		limit = s.MaxTimelineLimit
 	}
 	result := make(map[string]*LatestEvents, len(roomIDs))
-	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+	err = sqlutil.WithTransactionContext(ctx, s.Accumulator.db, func(txn *sqlx.Tx) error {
 		for roomID, r := range roomIDToRange {
 			var earliestEventNID int64
 			var latestEventNID int64
 			var roomEvents []json.RawMessage
 			// the most recent event will be first
-			events, err := s.EventsTable.SelectLatestEventsBetween(txn, roomID, r[0]-1, r[1], limit)
+			events, err := s.EventsTable.SelectLatestEventsBetweenOfTypes(ctx, txn, roomID, r[0]-1, r[1], limit, filter)
 			if err != nil {
 				return fmt.Errorf("room %s failed to SelectEventsBetween: %s", roomID, err)
 			}
@@ -762,11 +1248,65 @@ func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64,
 	return result, err
 }
 
+// TimelinesBetween returns the most recent events
+// - in every room the user has permission to see events in
+// - with NIDs > `from` and <= `to`.
+// Up to `limit` events are chosen per room, and rooms without any such events are omitted.
+func (s *Storage) TimelinesBetween(ctx context.Context, userID string, from, to int64, limit int) (map[string]*LatestEvents, error) {
+	roomIDToRange, err := s.VisibleEventNIDsBetween(ctx, userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if s.MaxTimelineLimit != 0 && limit > s.MaxTimelineLimit {
+		limit = s.MaxTimelineLimit
+	}
+	result := make(map[string]*LatestEvents, len(roomIDToRange))
+	err = sqlutil.WithTransactionContext(ctx, s.Accumulator.db, func(txn *sqlx.Tx) error {
+		for roomID, r := range roomIDToRange {
+			lower := r[0] - 1
+			if lower < from {
+				lower = from
+			}
+			// fetch one more than we need so we know if the timeline is limited
+			events, err := s.EventsTable.SelectLatestEventsBetween(ctx, txn, roomID, lower, r[1], limit+1)
+			if err != nil {
+				return fmt.Errorf("room %s failed to SelectLatestEventsBetween: %s", roomID, err)
+			}
+			if len(events) == 0 {
+				continue
+			}
+			latestEvents := LatestEvents{
+				LatestNID: events[0].NID,
+				Limited:   len(events) > limit || events[len(events)-1].MissingPrevious,
+			}
+			if len(events) > limit {
+				events = events[:limit]
+			}
+			// the most recent event is first, so add them in reverse
+			latestEvents.Timeline = make([]json.RawMessage, 0, len(events))
+			for i := len(events) - 1; i >= 0; i-- {
+				latestEvents.Timeline = append(latestEvents.Timeline, events[i].JSON)
+			}
+			// the oldest event needs a prev batch token, so find one now
+			earliestEventNID := events[len(events)-1].NID
+			latestEvents.EarliestNID = earliestEventNID
+			latestEvents.PrevBatch, err = s.EventsTable.SelectClosestPrevBatch(txn, roomID, earliestEventNID)
+			if err != nil {
+				return fmt.Errorf("failed to select prev_batch for room %s : %s", roomID, err)
+			}
+			result[roomID] = &latestEvents
+		}
+		return nil
+	})
+	return result, err
+}
+
 // Remove state snapshots which cannot be accessed by clients. The latest MaxTimelineEvents
 // snapshots must be kept, +1 for the current state. This handles the worst case where all
 // MaxTimelineEvents are state events and hence each event makes a new snapshot. We can safely
 // delete all snapshots older than this, as it's not possible to reach this snapshot as the proxy
-// does not handle historical state (deferring to the homeserver for that).
+// does not handle historical state (deferring to the homeserver for that). The exception is the
+// state at which users left rooms, see UserLeavesTable.
 func (s *Storage) RemoveInaccessibleStateSnapshots() error {
 	numToKeep := s.MaxTimelineLimit + 1
 	// Create a CTE which ranks each snapshot so we can figure out which snapshots to delete
@@ -793,7 +1333,11 @@ func (s *Storage) RemoveInaccessibleStateSnapshots() error {
 	  )
 	  DELETE FROM syncv3_snapshots USING ranked_snapshots
 	  WHERE syncv3_snapshots.snapshot_id = ranked_snapshots.snapshot_id
-	  AND ranked_snapshots.row_num > %d;`, numToKeep)
+	  AND ranked_snapshots.row_num > %d
+	  AND syncv3_snapshots.snapshot_id NOT IN (
+		SELECT syncv3_events.before_state_snapshot_id FROM syncv3_user_leaves
+		JOIN syncv3_events ON syncv3_events.event_nid = syncv3_user_leaves.leave_nid
+	  );`, numToKeep)
 
 	result, err := s.DB.Exec(awfulQuery)
 	if err != nil {
@@ -806,6 +1350,44 @@ func (s *Storage) RemoveInaccessibleStateSnapshots() error {
 	return nil
 }
 
+// RoomIDsWithNameLike returns the rooms in roomIDs whose name or canonical alias contains the
+// substring, ignoring case. See RoomsTable.SelectRoomIDsWithNameLike.
+func (s *Storage) RoomIDsWithNameLike(roomIDs []string, substring string) (matches []string, err error) {
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		matches, err = s.Accumulator.roomsTable.SelectRoomIDsWithNameLike(txn, roomIDs, substring)
+		return err
+	})
+	return
+}
+
+// LeaveNIDs returns the NID of the user's leave event for each of the given rooms which they have
+// left. The state after this NID is the state of the room as the user last saw it. Leaves which were
+// not recorded, e.g from before leaves were recorded, fall back to the user's latest leave or ban event
+// in the room.
+func (s *Storage) LeaveNIDs(ctx context.Context, userID string, roomIDs []string) (map[string]int64, error) {
+	leaveNIDs, err := s.Accumulator.leavesTable.SelectLeaveNIDs(ctx, userID, roomIDs)
+	if err != nil {
+		return nil, err
+	}
+	var unknown []string
+	for _, roomID := range roomIDs {
+		if _, ok := leaveNIDs[roomID]; !ok {
+			unknown = append(unknown, roomID)
+		}
+	}
+	if len(unknown) == 0 {
+		return leaveNIDs, nil
+	}
+	eventLeaveNIDs, err := s.Accumulator.eventsTable.SelectLatestLeaveNIDs(ctx, userID, unknown)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select latest leave NIDs: %w", err)
+	}
+	for roomID, nid := range eventLeaveNIDs {
+		leaveNIDs[roomID] = nid
+	}
+	return leaveNIDs, nil
+}
+
 func (s *Storage) GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch string) {
 	var err error
 	sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
@@ -872,15 +1454,15 @@ func (s *Storage) visibleEventNIDsBetweenForRooms(userID string, roomIDs []strin
 //
 //	- For Room D: from=1, to=15 returns { RoomD: [ 8,10 ] } (tests multi-join/leave)
 //	- For Room E: from=1, to=15 returns { RoomE: [ 13,15 ] } (tests invites)
-func (s *Storage) VisibleEventNIDsBetween(userID string, from, to int64) (map[string][2]int64, error) {
+func (s *Storage) VisibleEventNIDsBetween(ctx context.Context, userID string, from, to int64) (map[string][2]int64, error) {
 	// load *ALL* joined rooms for this user at from (inclusive)
-	joinTimingsAtFromByRoomID, err := s.JoinedRoomsAfterPosition(userID, from)
+	joinTimingsAtFromByRoomID, err := s.JoinedRoomsAfterPosition(ctx, userID, from)
 	if err != nil {
 		return nil, fmt.Errorf("failed to work out joined rooms for %s at pos %d: %s", userID, from, err)
 	}
 
 	// load *ALL* membership deltas for all rooms for this user
-	membershipEvents, err := s.Accumulator.eventsTable.SelectEventsWithTypeStateKey("m.room.member", userID, from, to)
+	membershipEvents, err := s.Accumulator.eventsTable.SelectEventsWithTypeStateKey(ctx, "m.room.member", userID, from, to)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load membership events: %s", err)
 	}
@@ -1083,26 +1665,66 @@ Loop:
 				boundaryTime = now.Add(-1 * time.Hour)
 			}
 			logger.Info().Time("boundaryTime", boundaryTime).Msg("Cleaner running")
-			err := s.TransactionsTable.Clean(boundaryTime)
-			if err != nil {
-				logger.Warn().Err(err).Msg("failed to clean txn ID table")
+			if err := s.Prune(boundaryTime); err != nil {
 				sentry.CaptureException(err)
 			}
-			// we also want to clean up stale state snapshots which are inaccessible, to
-			// keep the size of the syncv3_snapshots table low.
-			if err = s.RemoveInaccessibleStateSnapshots(); err != nil {
-				logger.Warn().Err(err).Msg("failed to remove inaccessible state snapshots")
+		case <-s.shutdownCh:
+			break Loop
+		}
+	}
+}
+
+// SetEventArchive stores archived events in the given object store, and loads them from it when
+// they are selected. Must be called before the storage is used if any events have been archived.
+func (s *Storage) SetEventArchive(objects internal.ObjectStore) {
+	s.EventArchive = NewEventArchive(s.DB, objects)
+	s.EventsTable.archive = s.EventArchive
+}
+
+// ArchiveEvents moves events older than `after` to the event archive every hour, until the storage
+// is shut down. Does nothing if SetEventArchive has not been called.
+func (s *Storage) ArchiveEvents(after time.Duration) {
+	if s.EventArchive == nil {
+		return
+	}
+	for {
+		select {
+		case <-time.After(time.Hour):
+			start := time.Now()
+			numArchived, err := s.EventArchive.Archive(context.Background(), start.Add(-after))
+			if err != nil {
+				logger.Warn().Err(err).Msg("failed to archive events")
 				sentry.CaptureException(err)
 			}
+			if numArchived > 0 {
+				logger.Info().Int("events", numArchived).Dur("took", time.Since(start)).Msg("archived events")
+			}
 		case <-s.shutdownCh:
-			break Loop
+			return
 		}
 	}
 }
 
-func (s *Storage) LatestEventNIDInRooms(roomIDs []string, highestNID int64) (roomToNID map[string]int64, err error) {
+// Prune runs the retention pruners: removing transaction IDs older than boundaryTime and
+// inaccessible state snapshots. Both pruners are run even if the first fails.
+func (s *Storage) Prune(boundaryTime time.Time) error {
+	var errs []error
+	if err := s.TransactionsTable.Clean(boundaryTime); err != nil {
+		logger.Warn().Err(err).Msg("failed to clean txn ID table")
+		errs = append(errs, err)
+	}
+	// we also want to clean up stale state snapshots which are inaccessible, to
+	// keep the size of the syncv3_snapshots table low.
+	if err := s.RemoveInaccessibleStateSnapshots(); err != nil {
+		logger.Warn().Err(err).Msg("failed to remove inaccessible state snapshots")
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Storage) LatestEventNIDInRooms(ctx context.Context, roomIDs []string, highestNID int64) (roomToNID map[string]int64, err error) {
 	roomToNID = make(map[string]int64)
-	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+	err = sqlutil.WithTransactionContext(ctx, s.Accumulator.db, func(txn *sqlx.Tx) error {
 		// Pull out the latest nids for all the rooms. If they are < highestNID then use them, else we need to query the
 		// events table (slow) for the latest nid in this room which is < highestNID.
 		fastRoomToLatestNIDs, err := s.Accumulator.roomsTable.LatestNIDs(txn, roomIDs)
@@ -1125,7 +1747,7 @@ func (s *Storage) LatestEventNIDInRooms(roomIDs []string, highestNID int64) (roo
 		}
 		logger.Warn().Int("slow_rooms", len(slowRooms)).Msg("LatestEventNIDInRooms: pos value provided is far behind the database copy, performance degraded")
 
-		slowRoomToLatestNIDs, err := s.EventsTable.LatestEventNIDInRooms(txn, slowRooms, highestNID)
+		slowRoomToLatestNIDs, err := s.EventsTable.LatestEventNIDInRooms(ctx, txn, slowRooms, highestNID)
 		if err != nil {
 			return err
 		}
@@ -1139,11 +1761,37 @@ func (s *Storage) LatestEventNIDInRooms(roomIDs []string, highestNID int64) (roo
 
 // Returns a map from joined room IDs to EventMetadata, which is nil iff a non-nil error
 // is returned.
-func (s *Storage) JoinedRoomsAfterPosition(userID string, pos int64) (
+func (s *Storage) JoinedRoomsAfterPosition(ctx context.Context, userID string, pos int64) (
+	joinTimingByRoomID map[string]internal.EventMetadata, err error,
+) {
+	// The memberships index holds the latest membership in each room, so it can be used as long
+	// as none of the user's memberships changed after pos, which is the common case.
+	memberships, err := s.Accumulator.membershipsTable.SelectByUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("JoinedRoomsAfterPosition.SelectByUser: %s", err)
+	}
+	joinTimingByRoomID = make(map[string]internal.EventMetadata, len(memberships))
+	for _, m := range memberships {
+		if m.MembershipNID > pos {
+			return s.joinedRoomsAfterPositionFromEvents(ctx, userID, pos)
+		}
+		if m.JoinNID > 0 {
+			joinTimingByRoomID[m.RoomID] = internal.EventMetadata{
+				NID:       m.JoinNID,
+				Timestamp: m.JoinTimestamp,
+			}
+		}
+	}
+	return joinTimingByRoomID, nil
+}
+
+// joinedRoomsAfterPositionFromEvents is JoinedRoomsAfterPosition without the memberships index,
+// replaying all of the user's membership events.
+func (s *Storage) joinedRoomsAfterPositionFromEvents(ctx context.Context, userID string, pos int64) (
 	joinTimingByRoomID map[string]internal.EventMetadata, err error,
 ) {
 	// fetch all the membership events up to and including pos
-	membershipEvents, err := s.Accumulator.eventsTable.SelectEventsWithTypeStateKey("m.room.member", userID, 0, pos)
+	membershipEvents, err := s.Accumulator.eventsTable.SelectEventsWithTypeStateKey(ctx, "m.room.member", userID, 0, pos)
 	if err != nil {
 		return nil, fmt.Errorf("JoinedRoomsAfterPosition.SelectEventsWithTypeStateKey: %s", err)
 	}
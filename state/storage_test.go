@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -20,6 +21,7 @@ import (
 	"github.com/matrix-org/sliding-sync/sqlutil"
 	"github.com/matrix-org/sliding-sync/testutils"
 	"github.com/tidwall/gjson"
+	"golang.org/x/exp/slices"
 )
 
 func TestStorageRoomStateBeforeAndAfterEventPosition(t *testing.T) {
@@ -170,7 +172,7 @@ func TestStorageJoinedRoomsAfterPosition(t *testing.T) {
 		}
 		latestPos = accResult.TimelineNIDs[len(accResult.TimelineNIDs)-1]
 	}
-	aliceJoinTimingsByRoomID, err := store.JoinedRoomsAfterPosition(alice, latestPos)
+	aliceJoinTimingsByRoomID, err := store.JoinedRoomsAfterPosition(context.Background(), alice, latestPos)
 	if err != nil {
 		t.Fatalf("failed to JoinedRoomsAfterPosition: %s", err)
 	}
@@ -182,7 +184,7 @@ func TestStorageJoinedRoomsAfterPosition(t *testing.T) {
 			t.Fatalf("JoinedRoomsAfterPosition at %v for %s got %v want %v", latestPos, alice, gotRoomID, joinedRoomID)
 		}
 	}
-	bobJoinTimingsByRoomID, err := store.JoinedRoomsAfterPosition(bob, latestPos)
+	bobJoinTimingsByRoomID, err := store.JoinedRoomsAfterPosition(context.Background(), bob, latestPos)
 	if err != nil {
 		t.Fatalf("failed to JoinedRoomsAfterPosition: %s", err)
 	}
@@ -365,7 +367,7 @@ func TestVisibleEventNIDsBetween(t *testing.T) {
 		t.Fatalf("LatestEventNID: %s", err)
 	}
 	t.Logf("ABC Start=%d Latest=%d", startPos, latestPos)
-	roomIDToVisibleRange, err := store.VisibleEventNIDsBetween(alice, startPos, latestPos)
+	roomIDToVisibleRange, err := store.VisibleEventNIDsBetween(context.Background(), alice, startPos, latestPos)
 	if err != nil {
 		t.Fatalf("VisibleEventNIDsBetween to %d: %s", latestPos, err)
 	}
@@ -466,7 +468,7 @@ func TestVisibleEventNIDsBetween(t *testing.T) {
 		t.Fatalf("LatestEventNID: %s", err)
 	}
 	t.Logf("DE Start=%d Latest=%d", startPos, latestPos)
-	roomIDToVisibleRange, err = store.VisibleEventNIDsBetween(alice, startPos, latestPos)
+	roomIDToVisibleRange, err = store.VisibleEventNIDsBetween(context.Background(), alice, startPos, latestPos)
 	if err != nil {
 		t.Fatalf("VisibleEventNIDsBetween to %d: %s", latestPos, err)
 	}
@@ -686,6 +688,60 @@ func TestGlobalSnapshot(t *testing.T) {
 	}
 }
 
+func TestGlobalSnapshotUsesMetadataSnapshot(t *testing.T) {
+	alice := "@TestGlobalSnapshotUsesMetadataSnapshot_alice:localhost"
+	roomUnchanged := "!unchanged"
+	roomChanged := "!changed"
+	roomMissing := "!missing"
+	if err := cleanDB(t); err != nil {
+		t.Fatalf("failed to wipe DB: %s", err)
+	}
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	for roomID, name := range map[string]string{roomUnchanged: "Unchanged", roomChanged: "Changed", roomMissing: "Missing"} {
+		_, err := store.Initialise(roomID, []json.RawMessage{
+			testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+			testutils.NewJoinEvent(t, alice),
+			testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": name}),
+		})
+		assertNoError(t, err)
+	}
+	ss, err := store.GlobalSnapshot()
+	assertNoError(t, err)
+
+	t.Log("Persist a metadata snapshot, with a different name for each room so we can tell it was used.")
+	metadataSnapshot := &MetadataSnapshot{
+		Version:   MetadataSnapshotVersion,
+		LatestNID: ss.LatestNID,
+		Rooms:     make(map[string]SnapshotRoomMetadata),
+	}
+	for roomID, metadata := range ss.GlobalMetadata {
+		if roomID == roomMissing {
+			continue
+		}
+		metadataSnapshot.Rooms[roomID] = SnapshotRoomMetadata{
+			NameEvent:            "Snapshot " + metadata.NameEvent,
+			LastMessageTimestamp: metadata.LastMessageTimestamp,
+			LatestEventsByType:   metadata.LatestEventsByType,
+		}
+	}
+	assertNoError(t, store.MetadataSnapshotTable.Upsert(metadataSnapshot))
+
+	t.Log("Rename one of the rooms after the snapshot.")
+	renameEvent := testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "Renamed"}, testutils.WithTimestamp(time.Now().Add(time.Hour)))
+	mustAccumulate(t, store, roomChanged, []json.RawMessage{renameEvent})
+
+	t.Log("The unchanged room should use the snapshot, and the changed and missing rooms should be recalculated.")
+	ss, err = store.GlobalSnapshot()
+	assertNoError(t, err)
+	assertValue(t, "unchanged room NameEvent", ss.GlobalMetadata[roomUnchanged].NameEvent, "Snapshot Unchanged")
+	assertValue(t, "unchanged room JoinCount", ss.GlobalMetadata[roomUnchanged].JoinCount, 1)
+	assertValue(t, "changed room NameEvent", ss.GlobalMetadata[roomChanged].NameEvent, "Renamed")
+	assertValue(t, "changed room LastMessageTimestamp", ss.GlobalMetadata[roomChanged].LastMessageTimestamp, gjson.GetBytes(renameEvent, "origin_server_ts").Uint())
+	assertValue(t, "changed room JoinCount", ss.GlobalMetadata[roomChanged].JoinCount, 1)
+	assertValue(t, "missing room NameEvent", ss.GlobalMetadata[roomMissing].NameEvent, "Missing")
+}
+
 func TestAllJoinedMembers(t *testing.T) {
 	assertNoError(t, cleanDB(t))
 	store := NewStorage(postgresConnectionString)
@@ -915,6 +971,142 @@ func TestStorage_FetchMemberships(t *testing.T) {
 	assertValue(t, "joins", leaves, []string{"@chris:test", "@david:test", "@glory:test", "@helen:test"})
 }
 
+func TestStorage_PurgeRoom(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+
+	roomToPurge := "!TestStorage_PurgeRoom_purged:localhost"
+	roomToKeep := "!TestStorage_PurgeRoom_kept:localhost"
+	for _, roomID := range []string{roomToPurge, roomToKeep} {
+		mustPersistEvents(t, roomID, store, persistOpts{
+			withInitialEvents: true,
+			numTimelineEvents: 5,
+			ofWhichNumState:   2,
+		})
+		_, err := store.InsertAccountData(userID, roomID, []json.RawMessage{
+			json.RawMessage(`{"type":"m.fully_read","content":{"event_id":"$unimportant"}}`),
+		})
+		assertNoError(t, err)
+	}
+
+	res, err := store.PurgeRoom(roomToPurge)
+	assertNoError(t, err)
+	assertValue(t, "user IDs", res.UserIDs, []string{userID})
+	// 4 initial events + 5 timeline events
+	assertValue(t, "num events", res.NumEvents, int64(9))
+
+	for _, tc := range []struct {
+		roomID     string
+		wantEvents int
+		wantRows   int
+	}{
+		{roomID: roomToPurge, wantEvents: 0, wantRows: 0},
+		{roomID: roomToKeep, wantEvents: 9, wantRows: 1},
+	} {
+		var numEvents, numRooms int
+		assertNoError(t, store.DB.QueryRow(`SELECT count(*) FROM syncv3_events WHERE room_id=$1`, tc.roomID).Scan(&numEvents))
+		assertNoError(t, store.DB.QueryRow(`SELECT count(*) FROM syncv3_rooms WHERE room_id=$1`, tc.roomID).Scan(&numRooms))
+		assertValue(t, tc.roomID+" events", numEvents, tc.wantEvents)
+		assertValue(t, tc.roomID+" rooms", numRooms, tc.wantRows)
+		data, err := store.AccountDatas(context.Background(), userID, tc.roomID)
+		assertNoError(t, err)
+		assertValue(t, tc.roomID+" account data", len(data), tc.wantRows)
+	}
+	mustHaveNumSnapshots(t, store.DB, roomToPurge, 0)
+}
+
+func TestStorage_EraseUser(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+
+	roomID := "!TestStorage_EraseUser:localhost"
+	erased := "@TestStorage_EraseUser_erased:localhost"
+	kept := "@TestStorage_EraseUser_kept:localhost"
+	events := createInitialEvents(t, kept)
+	events = append(events,
+		testutils.NewStateEvent(t, "m.room.member", erased, erased, map[string]interface{}{
+			"membership": "join", "displayname": "Erased",
+		}),
+		testutils.NewStateEvent(t, "m.room.member", erased, erased, map[string]interface{}{
+			"membership": "join", "displayname": "Erased 2", "avatar_url": "mxc://erased",
+		}),
+		testutils.NewStateEvent(t, "m.room.member", kept, kept, map[string]interface{}{
+			"membership": "join", "displayname": "Kept",
+		}),
+	)
+	mustAccumulate(t, store, roomID, events)
+	_, err := store.ReceiptTable.Insert(roomID, json.RawMessage(`{"type":"m.receipt","content":{"$event":{
+		"m.read":{"`+erased+`":{"ts":1},"`+kept+`":{"ts":2}},
+		"m.read.private":{"`+erased+`":{"ts":3}}
+	}}}`))
+	assertNoError(t, err)
+
+	res, err := store.EraseUser(erased)
+	assertNoError(t, err)
+	assertValue(t, "room IDs", res.RoomIDs, []string{roomID})
+	assertValue(t, "num events", res.NumEvents, int64(2))
+	assertValue(t, "num receipts", res.NumReceipts, int64(2))
+
+	var memberEvents []Event
+	assertNoError(t, store.DB.Select(&memberEvents, `SELECT state_key, event FROM syncv3_events
+	WHERE room_id = $1 AND event_type = 'm.room.member' ORDER BY event_nid`, roomID))
+	var displayNames []string
+	for _, ev := range memberEvents {
+		if gjson.GetBytes(ev.JSON, "content.avatar_url").Exists() {
+			t.Errorf("membership event still has an avatar: %s", ev.JSON)
+		}
+		displayNames = append(displayNames, ev.StateKey+"="+gjson.GetBytes(ev.JSON, "content.displayname").Str)
+	}
+	assertValue(t, "display names", displayNames, []string{
+		kept + "=", erased + "=", erased + "=", kept + "=Kept",
+	})
+
+	receipts, err := store.ReceiptTable.SelectReceiptsForUser([]string{roomID}, kept)
+	assertNoError(t, err)
+	assertValue(t, "kept user's receipts", len(receipts[roomID]), 1)
+	receipts, err = store.ReceiptTable.SelectReceiptsForUser([]string{roomID}, erased)
+	assertNoError(t, err)
+	assertValue(t, "erased user's receipts", len(receipts[roomID]), 0)
+
+	userIDs, err := store.ErasedUsersTable.SelectAll()
+	assertNoError(t, err)
+	if !slices.Contains(userIDs, erased) {
+		t.Errorf("user not marked as erased: %v", userIDs)
+	}
+}
+
+func TestStorage_TableStats(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	mustPersistEvents(t, "!TestStorage_TableStats:localhost", store, persistOpts{
+		withInitialEvents: true,
+	})
+
+	stats, err := store.TableStats()
+	assertNoError(t, err)
+	var foundEvents bool
+	for _, table := range stats {
+		if !strings.HasPrefix(table.Name, "syncv3_") {
+			t.Errorf("TableStats returned non-proxy table %s", table.Name)
+		}
+		if table.Name == "syncv3_events" {
+			foundEvents = true
+			if table.Bytes <= 0 {
+				t.Errorf("syncv3_events has %d bytes, want > 0", table.Bytes)
+			}
+		}
+	}
+	if !foundEvents {
+		t.Errorf("TableStats did not include syncv3_events: %+v", stats)
+	}
+
+	numRooms, err := store.NumRooms()
+	assertNoError(t, err)
+	if numRooms < 1 {
+		t.Errorf("NumRooms: got %d want at least 1", numRooms)
+	}
+}
+
 type persistOpts struct {
 	withInitialEvents bool
 	numTimelineEvents int
@@ -945,6 +1137,157 @@ func mustPersistEvents(t *testing.T, roomID string, store *Storage, opts persist
 	mustAccumulate(t, store, roomID, events)
 }
 
+func TestStorage_LeaveNIDs(t *testing.T) {
+	ctx := context.Background()
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+
+	roomID := "!TestStorage_LeaveNIDs:localhost"
+	leaver := "@TestStorage_LeaveNIDs_leaver:localhost"
+	mustAccumulate(t, store, roomID, createInitialEvents(t, userID))
+	accumulateAs := func(accUserID string, events ...json.RawMessage) {
+		t.Helper()
+		_, err := store.Accumulate(accUserID, roomID, sync2.TimelineResponse{Events: events})
+		assertNoError(t, err)
+	}
+	assertRoomName := func(pos int64, want string) {
+		t.Helper()
+		roomToEvents, err := store.RoomStateAfterEventPosition(ctx, []string{roomID}, pos, map[string][]string{
+			"m.room.name": {""},
+		})
+		assertNoError(t, err)
+		assertValue(t, "room state", len(roomToEvents[roomID]), 1)
+		assertValue(t, "room name", gjson.GetBytes(roomToEvents[roomID][0].JSON, "content.name").Str, want)
+	}
+
+	accumulateAs(leaver,
+		testutils.NewJoinEvent(t, leaver),
+		testutils.NewStateEvent(t, "m.room.name", "", userID, map[string]interface{}{"name": "before"}),
+	)
+	leaveNIDs, err := store.LeaveNIDs(context.Background(), leaver, []string{roomID})
+	assertNoError(t, err)
+	assertValue(t, "leave NIDs while joined", len(leaveNIDs), 0)
+
+	// the leave is seen by another poller first, then by the leaver's poller
+	leaveEvent := testutils.NewStateEvent(t, "m.room.member", leaver, leaver, map[string]interface{}{"membership": "leave"})
+	accumulateAs(userID, leaveEvent)
+	leaveNIDs, err = store.LeaveNIDs(context.Background(), leaver, []string{roomID})
+	assertNoError(t, err)
+	// the leave isn't recorded for the leaver yet, so the leave event is used
+	unrecordedLeaveNID, ok := leaveNIDs[roomID]
+	if !ok {
+		t.Fatalf("leave NID not found from the leave event: %v", leaveNIDs)
+	}
+	accumulateAs(leaver, leaveEvent)
+	leaveNIDs, err = store.LeaveNIDs(context.Background(), leaver, []string{roomID})
+	assertNoError(t, err)
+	leaveNID, ok := leaveNIDs[roomID]
+	if !ok {
+		t.Fatalf("leave NID not recorded: %v", leaveNIDs)
+	}
+	assertValue(t, "recorded leave NID", leaveNID, unrecordedLeaveNID)
+
+	// the room carries on without the leaver for long enough that its old snapshots are pruned,
+	// but the state at the leave is kept
+	store.MaxTimelineLimit = 50
+	var renames []json.RawMessage
+	for i := 0; i <= store.MaxTimelineLimit+1; i++ {
+		renames = append(renames, testutils.NewStateEvent(t, "m.room.name", "", userID, map[string]interface{}{"name": fmt.Sprintf("after %d", i)}))
+	}
+	accumulateAs(userID, renames...)
+	assertNoError(t, store.RemoveInaccessibleStateSnapshots())
+	latestNID, err := store.LatestEventNID()
+	assertNoError(t, err)
+	assertRoomName(latestNID, fmt.Sprintf("after %d", store.MaxTimelineLimit+1))
+	assertRoomName(leaveNID, "before")
+
+	// rejoining forgets the leave
+	accumulateAs(leaver, testutils.NewJoinEvent(t, leaver))
+	leaveNIDs, err = store.LeaveNIDs(context.Background(), leaver, []string{roomID})
+	assertNoError(t, err)
+	assertValue(t, "leave NIDs after rejoining", len(leaveNIDs), 0)
+}
+
+func TestStorageRoomStateAfterEventPositions(t *testing.T) {
+	ctx := context.Background()
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+
+	roomA := "!TestStorageRoomStateAfterEventPositions_a:localhost"
+	roomB := "!TestStorageRoomStateAfterEventPositions_b:localhost"
+	nameEvent := func(name string) json.RawMessage {
+		return testutils.NewStateEvent(t, "m.room.name", "", userID, map[string]interface{}{"name": name})
+	}
+	mustAccumulate(t, store, roomA, createInitialEvents(t, userID))
+	mustAccumulate(t, store, roomA, []json.RawMessage{nameEvent("a before")})
+	posA, err := store.LatestEventNID()
+	assertNoError(t, err)
+	mustAccumulate(t, store, roomB, createInitialEvents(t, userID))
+	mustAccumulate(t, store, roomB, []json.RawMessage{nameEvent("b before")})
+	mustAccumulate(t, store, roomA, []json.RawMessage{nameEvent("a after")})
+	mustAccumulate(t, store, roomB, []json.RawMessage{nameEvent("b after")})
+	posB, err := store.LatestEventNID()
+	assertNoError(t, err)
+
+	roomToPos := map[string]int64{
+		roomA: posA,
+		roomB: posB,
+	}
+	for _, filter := range []map[string][]string{nil, {"m.room.name": {""}}} {
+		roomToEvents, err := store.RoomStateAfterEventPositions(ctx, roomToPos, filter)
+		assertNoError(t, err)
+		for roomID, wantName := range map[string]string{roomA: "a before", roomB: "b after"} {
+			var gotName string
+			for _, ev := range roomToEvents[roomID] {
+				if ev.Type == "m.room.name" {
+					gotName = gjson.GetBytes(ev.JSON, "content.name").Str
+				}
+			}
+			assertValue(t, fmt.Sprintf("room name in %s with filter %v", roomID, filter), gotName, wantName)
+		}
+	}
+}
+
+func TestStorageRoomStateCache(t *testing.T) {
+	ctx := context.Background()
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+
+	roomID := "!TestStorageRoomStateCache:localhost"
+	mustAccumulate(t, store, roomID, createInitialEvents(t, userID))
+	nameFilter := map[string][]string{"m.room.name": {""}}
+	assertRoomName := func(want string) {
+		t.Helper()
+		pos, err := store.LatestEventNID()
+		assertNoError(t, err)
+		roomToEvents, err := store.RoomStateAfterEventPosition(ctx, []string{roomID}, pos, nameFilter)
+		assertNoError(t, err)
+		assertValue(t, "room state", len(roomToEvents[roomID]), 1)
+		assertValue(t, "room name", gjson.GetBytes(roomToEvents[roomID][0].JSON, "content.name").Str, want)
+	}
+	mustAccumulate(t, store, roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.name", "", userID, map[string]interface{}{"name": "first"}),
+		testutils.NewMessageEvent(t, userID, "hello"),
+	})
+	assertRoomName("first")
+	numCached := store.roomStateCache.len()
+	if numCached == 0 {
+		t.Fatalf("room state was not cached")
+	}
+
+	// messages don't change the state, so the cached result is used
+	mustAccumulate(t, store, roomID, []json.RawMessage{testutils.NewMessageEvent(t, userID, "world")})
+	assertRoomName("first")
+	assertValue(t, "cached results", store.roomStateCache.len(), numCached)
+
+	// a new name invalidates the room
+	mustAccumulate(t, store, roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.name", "", userID, map[string]interface{}{"name": "second"}),
+	})
+	assertValue(t, "cached results after a state change", store.roomStateCache.len(), numCached-1)
+	assertRoomName("second")
+}
+
 func mustAccumulate(t *testing.T, store *Storage, roomID string, events []json.RawMessage) {
 	t.Helper()
 	_, err := store.Accumulate(userID, roomID, sync2.TimelineResponse{
@@ -1090,7 +1433,8 @@ func cleanDB(t *testing.T) error {
 	DROP TABLE IF EXISTS syncv3_rooms;
 	DROP TABLE IF EXISTS syncv3_invites;
 	DROP TABLE IF EXISTS syncv3_snapshots;
-	DROP TABLE IF EXISTS syncv3_spaces;`)
+	DROP TABLE IF EXISTS syncv3_spaces;
+	DROP TABLE IF EXISTS syncv3_metadata_snapshots;`)
 	close()
 	return err
 }
@@ -0,0 +1,104 @@
+package state
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// TableGrowth is how quickly a table grew between its oldest and newest samples in the history.
+type TableGrowth struct {
+	Name        string  `json:"name"`
+	BytesPerDay float64 `json:"bytes_per_day"`
+	RowsPerDay  float64 `json:"rows_per_day"`
+	// Days is the length of time the growth was measured over.
+	Days float64 `json:"days"`
+}
+
+// TableStatsTable stores periodic samples of TableStats, so operators can see which tables are
+// growing and how quickly, e.g to decide when retention settings need tuning.
+type TableStatsTable struct {
+	db *sqlx.DB
+}
+
+func NewTableStatsTable(db *sqlx.DB) *TableStatsTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_table_stats (
+		name TEXT NOT NULL,
+		sampled_ts BIGINT NOT NULL,
+		estimated_rows BIGINT NOT NULL,
+		bytes BIGINT NOT NULL,
+		PRIMARY KEY (name, sampled_ts)
+	);
+	`)
+	return &TableStatsTable{db}
+}
+
+// Insert records the size of each table at sampledAt.
+func (t *TableStatsTable) Insert(sampledAt time.Time, stats []TableStats) error {
+	if len(stats) == 0 {
+		return nil
+	}
+	names := make([]string, len(stats))
+	rows := make([]int64, len(stats))
+	bytes := make([]int64, len(stats))
+	for i := range stats {
+		names[i] = stats[i].Name
+		rows[i] = stats[i].EstimatedRows
+		bytes[i] = stats[i].Bytes
+	}
+	_, err := t.db.Exec(`
+	INSERT INTO syncv3_table_stats(name, sampled_ts, estimated_rows, bytes)
+	SELECT name, $1, estimated_rows, bytes FROM unnest($2::text[], $3::bigint[], $4::bigint[]) AS s(name, estimated_rows, bytes)
+	ON CONFLICT (name, sampled_ts) DO NOTHING`,
+		sampledAt.UnixMilli(), pq.StringArray(names), pq.Int64Array(rows), pq.Int64Array(bytes),
+	)
+	return err
+}
+
+// DeleteBefore removes samples taken before the given time. Returns the number of samples removed.
+func (t *TableStatsTable) DeleteBefore(before time.Time) (int64, error) {
+	res, err := t.db.Exec(`DELETE FROM syncv3_table_stats WHERE sampled_ts < $1`, before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Growth returns the growth of each table between its oldest sample taken at or after since and
+// its newest sample. Tables with fewer than two samples in that period are omitted.
+func (t *TableStatsTable) Growth(since time.Time) ([]TableGrowth, error) {
+	var rows []struct {
+		Name       string `db:"name"`
+		Millis     int64  `db:"millis"`
+		BytesDelta int64  `db:"bytes_delta"`
+		RowsDelta  int64  `db:"rows_delta"`
+	}
+	err := t.db.Select(&rows, `
+	WITH bounds AS (
+		SELECT name, MIN(sampled_ts) AS first_ts, MAX(sampled_ts) AS last_ts FROM syncv3_table_stats
+		WHERE sampled_ts >= $1 GROUP BY name HAVING MIN(sampled_ts) < MAX(sampled_ts)
+	)
+	SELECT b.name, b.last_ts - b.first_ts AS millis,
+		l.bytes - f.bytes AS bytes_delta, l.estimated_rows - f.estimated_rows AS rows_delta
+	FROM bounds b
+		JOIN syncv3_table_stats f ON f.name = b.name AND f.sampled_ts = b.first_ts
+		JOIN syncv3_table_stats l ON l.name = b.name AND l.sampled_ts = b.last_ts
+	ORDER BY b.name`, since.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	growth := make([]TableGrowth, len(rows))
+	for i, r := range rows {
+		days := float64(r.Millis) / float64((24 * time.Hour).Milliseconds())
+		growth[i] = TableGrowth{
+			Name:        r.Name,
+			BytesPerDay: float64(r.BytesDelta) / days,
+			RowsPerDay:  float64(r.RowsDelta) / days,
+			Days:        days,
+		}
+	}
+	return growth, nil
+}
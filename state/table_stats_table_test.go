@@ -0,0 +1,70 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTableStatsTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewTableStatsTable(db)
+	growing := "TestTableStatsTable_growing"
+	static := "TestTableStatsTable_static"
+	once := "TestTableStatsTable_once"
+	start := time.UnixMilli(1700000000000)
+	day := 24 * time.Hour
+
+	assertNoError(t, table.Insert(start, []TableStats{
+		{Name: growing, EstimatedRows: 100, Bytes: 1000},
+		{Name: static, EstimatedRows: 5, Bytes: 50},
+	}))
+	assertNoError(t, table.Insert(start.Add(day), []TableStats{
+		{Name: growing, EstimatedRows: 150, Bytes: 2000},
+		{Name: static, EstimatedRows: 5, Bytes: 50},
+	}))
+	assertNoError(t, table.Insert(start.Add(2*day), []TableStats{
+		{Name: growing, EstimatedRows: 300, Bytes: 5000},
+		{Name: static, EstimatedRows: 5, Bytes: 50},
+		{Name: once, EstimatedRows: 1, Bytes: 10},
+	}))
+
+	assertGrowth := func(since time.Time, want map[string]TableGrowth) {
+		t.Helper()
+		growth, err := table.Growth(since)
+		assertNoError(t, err)
+		got := make(map[string]TableGrowth)
+		for _, g := range growth {
+			if g.Name == growing || g.Name == static || g.Name == once {
+				got[g.Name] = g
+			}
+		}
+		if len(got) != len(want) {
+			t.Fatalf("Growth(%v): got %+v want %+v", since, got, want)
+		}
+		for name, w := range want {
+			if got[name] != w {
+				t.Errorf("Growth(%v) for %s: got %+v want %+v", since, name, got[name], w)
+			}
+		}
+	}
+	// the table only sampled once has no growth
+	assertGrowth(start, map[string]TableGrowth{
+		growing: {Name: growing, BytesPerDay: 2000, RowsPerDay: 100, Days: 2},
+		static:  {Name: static, BytesPerDay: 0, RowsPerDay: 0, Days: 2},
+	})
+	assertGrowth(start.Add(day), map[string]TableGrowth{
+		growing: {Name: growing, BytesPerDay: 3000, RowsPerDay: 150, Days: 1},
+		static:  {Name: static, BytesPerDay: 0, RowsPerDay: 0, Days: 1},
+	})
+
+	deleted, err := table.DeleteBefore(start.Add(day))
+	assertNoError(t, err)
+	if deleted != 2 {
+		t.Errorf("DeleteBefore: deleted %d samples, want 2", deleted)
+	}
+	assertGrowth(start, map[string]TableGrowth{
+		growing: {Name: growing, BytesPerDay: 3000, RowsPerDay: 150, Days: 1},
+		static:  {Name: static, BytesPerDay: 0, RowsPerDay: 0, Days: 1},
+	})
+}
@@ -1,9 +1,12 @@
 package state
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -16,20 +19,26 @@ const (
 	ActionCancel  = 2
 )
 
+// ToDeviceDedupeWindow is how far back InsertMessages looks for an identical message to the same
+// device before inserting a message. Pollers can retry a v2 request after a timeout, at which point
+// the homeserver may send to-device messages we already have, which we must not deliver twice.
+const ToDeviceDedupeWindow = 10 * time.Minute
+
 // ToDeviceTable stores to_device messages for devices.
 type ToDeviceTable struct {
 	db *sqlx.DB
 }
 
 type ToDeviceRow struct {
-	Position  int64   `db:"position"`
-	UserID    string  `db:"user_id"`
-	DeviceID  string  `db:"device_id"`
-	Message   string  `db:"message"`
-	Type      string  `db:"event_type"`
-	Sender    string  `db:"sender"`
-	UniqueKey *string `db:"unique_key"`
-	Action    int     `db:"action"`
+	Position    int64   `db:"position"`
+	UserID      string  `db:"user_id"`
+	DeviceID    string  `db:"device_id"`
+	Message     string  `db:"message"`
+	Type        string  `db:"event_type"`
+	Sender      string  `db:"sender"`
+	UniqueKey   *string `db:"unique_key"`
+	Action      int     `db:"action"`
+	ContentHash string  `db:"content_hash"`
 }
 
 type ToDeviceRowChunker []ToDeviceRow
@@ -54,7 +63,9 @@ func NewToDeviceTable(db *sqlx.DB) *ToDeviceTable {
 		message TEXT NOT NULL,
 		-- nullable as these fields are not on all to-device events
 		unique_key TEXT,
-		action SMALLINT DEFAULT 0 -- 0 means unknown
+		action SMALLINT DEFAULT 0, -- 0 means unknown
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(), -- indexed in a migration, for expiry
+		content_hash TEXT -- indexed in a migration, for deduplication
 	);
 	CREATE TABLE IF NOT EXISTS syncv3_to_device_ack_pos (
 		user_id TEXT NOT NULL,
@@ -69,17 +80,52 @@ func NewToDeviceTable(db *sqlx.DB) *ToDeviceTable {
 	return &ToDeviceTable{db}
 }
 
+// SetUnackedPosition remembers that the device has been sent to-device messages up to and including
+// this position. The position never goes backwards, so it is the highest position ever sent to the
+// device, and is persisted so it survives connections expiring and the proxy restarting.
 func (t *ToDeviceTable) SetUnackedPosition(userID, deviceID string, pos int64) error {
 	_, err := t.db.Exec(`INSERT INTO syncv3_to_device_ack_pos(user_id, device_id, unack_pos) VALUES($1,$2,$3) ON CONFLICT (user_id, device_id)
-	DO UPDATE SET unack_pos=excluded.unack_pos`, userID, deviceID, pos)
+	DO UPDATE SET unack_pos=GREATEST(syncv3_to_device_ack_pos.unack_pos, excluded.unack_pos)`, userID, deviceID, pos)
 	return err
 }
 
+// UnackedPosition returns the highest position of the to-device messages sent to this device, or 0
+// if none have been sent.
+func (t *ToDeviceTable) UnackedPosition(userID, deviceID string) (pos int64, err error) {
+	err = t.db.QueryRow(`SELECT unack_pos FROM syncv3_to_device_ack_pos WHERE user_id=$1 AND device_id=$2`, userID, deviceID).Scan(&pos)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
 func (t *ToDeviceTable) DeleteMessagesUpToAndIncluding(userID, deviceID string, toIncl int64) error {
 	_, err := t.db.Exec(`DELETE FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2 AND position <= $3`, userID, deviceID, toIncl)
 	return err
 }
 
+// DeleteMessagesOlderThan deletes to-device messages stored before the boundary time which were
+// sent to their device but never acknowledged, along with those which were never sent to a device
+// which has not been seen since the boundary time, e.g because its poller has expired and its
+// tokens have been deleted. Unsent messages for devices which are still in use are kept, as losing
+// them breaks E2EE. Returns the number of messages deleted.
+func (t *ToDeviceTable) DeleteMessagesOlderThan(boundaryTime time.Time) (int64, error) {
+	res, err := t.db.Exec(`DELETE FROM syncv3_to_device_messages m
+	WHERE m.created_at < $1 AND (
+		EXISTS (
+			SELECT 1 FROM syncv3_to_device_ack_pos a
+			WHERE a.user_id = m.user_id AND a.device_id = m.device_id AND m.position <= a.unack_pos
+		) OR NOT EXISTS (
+			SELECT 1 FROM syncv3_sync2_tokens tok
+			WHERE tok.user_id = m.user_id AND tok.device_id = m.device_id AND tok.last_seen >= $1
+		)
+	)`, boundaryTime)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func (t *ToDeviceTable) DeleteAllMessagesForDevice(userID, deviceID string) error {
 	// TODO: should these deletes take place in a transaction?
 	_, err := t.db.Exec(`DELETE FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2`, userID, deviceID)
@@ -135,11 +181,12 @@ func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawM
 		for i := range msgs {
 			m := gjson.ParseBytes(msgs[i])
 			rows[i] = ToDeviceRow{
-				UserID:   userID,
-				DeviceID: deviceID,
-				Message:  string(msgs[i]),
-				Type:     m.Get("type").Str,
-				Sender:   m.Get("sender").Str,
+				UserID:      userID,
+				DeviceID:    deviceID,
+				Message:     string(msgs[i]),
+				Type:        m.Get("type").Str,
+				Sender:      m.Get("sender").Str,
+				ContentHash: toDeviceContentHash(msgs[i]),
 			}
 			msgId := m.Get(`content.org\.matrix\.msgid`).Str
 			if msgId != "" {
@@ -196,15 +243,19 @@ func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawM
 			}
 			rows = newRows
 		}
-		// we may have nothing to do if the entire set of events were cancellations
+		rows, err = t.dedupeRows(txn, userID, deviceID, rows)
+		if err != nil {
+			return fmt.Errorf("failed to dedupe messages: %s", err)
+		}
+		// we may have nothing to do if the entire set of events were cancellations or duplicates
 		if len(rows) == 0 {
 			return nil
 		}
 
-		chunks := sqlutil.Chunkify(7, MaxPostgresParameters, ToDeviceRowChunker(rows))
+		chunks := sqlutil.Chunkify(8, MaxPostgresParameters, ToDeviceRowChunker(rows))
 		for _, chunk := range chunks {
-			result, err := txn.NamedQuery(`INSERT INTO syncv3_to_device_messages (user_id, device_id, message, event_type, sender, action, unique_key)
-        VALUES (:user_id, :device_id, :message, :event_type, :sender, :action, :unique_key) RETURNING position`, chunk)
+			result, err := txn.NamedQuery(`INSERT INTO syncv3_to_device_messages (user_id, device_id, message, event_type, sender, action, unique_key, content_hash)
+        VALUES (:user_id, :device_id, :message, :event_type, :sender, :action, :unique_key, :content_hash) RETURNING position`, chunk)
 			if err != nil {
 				return err
 			}
@@ -220,3 +271,43 @@ func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawM
 	})
 	return lastPos, err
 }
+
+// dedupeRows removes rows which are identical to a message already stored for this device within the
+// last ToDeviceDedupeWindow. Identical messages within the same batch are kept, as the homeserver sent
+// them as distinct messages.
+func (t *ToDeviceTable) dedupeRows(txn *sqlx.Tx, userID, deviceID string, rows []ToDeviceRow) ([]ToDeviceRow, error) {
+	hashes := make([]string, len(rows))
+	for i := range rows {
+		hashes[i] = rows[i].ContentHash
+	}
+	var existing []string
+	err := txn.Select(&existing, `SELECT DISTINCT content_hash FROM syncv3_to_device_messages
+	WHERE user_id = $1 AND device_id = $2 AND content_hash = ANY($3) AND created_at > $4`,
+		userID, deviceID, pq.StringArray(hashes), time.Now().Add(-ToDeviceDedupeWindow))
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) == 0 {
+		return rows, nil
+	}
+	existingSet := make(map[string]struct{}, len(existing))
+	for _, h := range existing {
+		existingSet[h] = struct{}{}
+	}
+	newRows := make([]ToDeviceRow, 0, len(rows))
+	for i := range rows {
+		if _, exists := existingSet[rows[i].ContentHash]; exists {
+			continue
+		}
+		newRows = append(newRows, rows[i])
+	}
+	logger.Info().Str("user", userID).Str("device", deviceID).Int("dropped", len(rows)-len(newRows)).Msg(
+		"ToDeviceTable.InsertMessages: dropped duplicate to-device messages",
+	)
+	return newRows, nil
+}
+
+func toDeviceContentHash(msg json.RawMessage) string {
+	sum := sha256.Sum256(msg)
+	return hex.EncodeToString(sum[:])
+}
@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"testing"
+	"time"
 
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/tidwall/gjson"
 )
 
@@ -237,6 +241,156 @@ func TestToDeviceTableNoDeleteUnacks(t *testing.T) {
 	bytesEqual(t, gotMsgs[1], cancelEv)
 }
 
+// Test that the unacked position is persisted per device and never goes backwards.
+func TestToDeviceTableUnackedPosition(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewToDeviceTable(db)
+	alice := "@TestToDeviceTableUnackedPosition_alice:localhost"
+	assertPos := func(deviceID string, want int64) {
+		t.Helper()
+		got, err := table.UnackedPosition(alice, deviceID)
+		assertNoError(t, err)
+		if got != want {
+			t.Fatalf("UnackedPosition(%s): got %d want %d", deviceID, got, want)
+		}
+	}
+	assertPos("A", 0)
+	assertNoError(t, table.SetUnackedPosition(alice, "A", 10))
+	assertPos("A", 10)
+	assertNoError(t, table.SetUnackedPosition(alice, "A", 5))
+	assertPos("A", 10)
+	assertNoError(t, table.SetUnackedPosition(alice, "A", 15))
+	assertPos("A", 15)
+	assertPos("B", 0)
+	// forgetting the device resets its position
+	assertNoError(t, table.DeleteAllMessagesForDevice(alice, "A"))
+	assertPos("A", 0)
+}
+
+func TestToDeviceTableDeleteMessagesOlderThan(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	userID := "@TestToDeviceTableDeleteMessagesOlderThan:localhost"
+	oldDevice := "OLD_DEVICE"
+	newDevice := "NEW_DEVICE"
+	table := NewToDeviceTable(db)
+	tokens := sync2.NewTokensTable(db, "secret")
+	msgs := []json.RawMessage{
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"1"}}`),
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"2"}}`),
+	}
+	_, err := table.InsertMessages(userID, oldDevice, msgs)
+	assertNoError(t, err)
+	_, err = table.InsertMessages(userID, newDevice, msgs)
+	assertNoError(t, err)
+	// the old device is still in use
+	assertNoError(t, sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		_, err := tokens.Insert(txn, "old_device_token", userID, oldDevice, time.Now())
+		return err
+	}))
+	// pretend the old device's messages were stored a long time ago, and only the first was sent to it
+	_, err = db.Exec(`UPDATE syncv3_to_device_messages SET created_at = $1 WHERE user_id = $2 AND device_id = $3`,
+		time.Now().Add(-31*24*time.Hour), userID, oldDevice)
+	assertNoError(t, err)
+	_, firstPos, err := table.Messages(userID, oldDevice, 0, 1)
+	assertNoError(t, err)
+	assertNoError(t, table.SetUnackedPosition(userID, oldDevice, firstPos))
+
+	// the message which was never sent is kept
+	numDeleted, err := table.DeleteMessagesOlderThan(time.Now().Add(-30 * 24 * time.Hour))
+	assertNoError(t, err)
+	assertValue(t, "numDeleted", numDeleted, int64(1))
+	gotMsgs, _, err := table.Messages(userID, oldDevice, 0, 10)
+	assertNoError(t, err)
+	assertValue(t, "old device msgs", len(gotMsgs), 1)
+	assertValue(t, "old device msg", string(gotMsgs[0]), string(msgs[1]))
+	gotMsgs, _, err = table.Messages(userID, newDevice, 0, 10)
+	assertNoError(t, err)
+	assertValue(t, "new device msgs", len(gotMsgs), 2)
+}
+
+// Test that messages which were never sent are deleted once they are old enough if their device
+// has not been seen since, as it may never connect to collect them.
+func TestToDeviceTableDeleteMessagesOlderThanUnseenDevice(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	userID := "@TestToDeviceTableDeleteMessagesOlderThanUnseenDevice:localhost"
+	neverConnected := "NEVER_CONNECTED"
+	inactive := "INACTIVE"
+	active := "ACTIVE"
+	table := NewToDeviceTable(db)
+	tokens := sync2.NewTokensTable(db, "secret")
+	msgs := []json.RawMessage{
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"1"}}`),
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"2"}}`),
+	}
+	for _, deviceID := range []string{neverConnected, inactive, active} {
+		_, err := table.InsertMessages(userID, deviceID, msgs)
+		assertNoError(t, err)
+	}
+	_, err := db.Exec(`UPDATE syncv3_to_device_messages SET created_at = $1 WHERE user_id = $2`,
+		time.Now().Add(-31*24*time.Hour), userID)
+	assertNoError(t, err)
+	assertNoError(t, sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		if _, err := tokens.Insert(txn, "inactive_token", userID, inactive, time.Now().Add(-31*24*time.Hour)); err != nil {
+			return err
+		}
+		_, err := tokens.Insert(txn, "active_token", userID, active, time.Now())
+		return err
+	}))
+
+	numDeleted, err := table.DeleteMessagesOlderThan(time.Now().Add(-30 * 24 * time.Hour))
+	assertNoError(t, err)
+	assertValue(t, "numDeleted", numDeleted, int64(4))
+	for deviceID, wantMsgs := range map[string]int{neverConnected: 0, inactive: 0, active: 2} {
+		gotMsgs, _, err := table.Messages(userID, deviceID, 0, 10)
+		assertNoError(t, err)
+		assertValue(t, deviceID+" msgs", len(gotMsgs), wantMsgs)
+	}
+}
+
+func TestToDeviceTableDedupesRetriedMessages(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	userID := "@TestToDeviceTableDedupesRetriedMessages:localhost"
+	deviceID := "DEVICE"
+	table := NewToDeviceTable(db)
+	msgs := []json.RawMessage{
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"1"}}`),
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"2"}}`),
+	}
+	pos, err := table.InsertMessages(userID, deviceID, msgs)
+	assertNoError(t, err)
+
+	// the homeserver resends the same messages along with a new one
+	newMsg := json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"3"}}`)
+	_, err = table.InsertMessages(userID, deviceID, append(msgs, newMsg))
+	assertNoError(t, err)
+	gotMsgs, _, err := table.Messages(userID, deviceID, 0, 10)
+	assertNoError(t, err)
+	assertValue(t, "msgs", len(gotMsgs), 3)
+	bytesEqual(t, gotMsgs[2], newMsg)
+
+	// the same messages to a different device are not duplicates
+	_, err = table.InsertMessages(userID, "OTHER_DEVICE", msgs)
+	assertNoError(t, err)
+	gotMsgs, _, err = table.Messages(userID, "OTHER_DEVICE", 0, 10)
+	assertNoError(t, err)
+	assertValue(t, "other device msgs", len(gotMsgs), 2)
+
+	// once the dedupe window has passed, the same message is stored again
+	_, err = db.Exec(`UPDATE syncv3_to_device_messages SET created_at = $1 WHERE user_id = $2 AND device_id = $3`,
+		time.Now().Add(-2*ToDeviceDedupeWindow), userID, deviceID)
+	assertNoError(t, err)
+	_, err = table.InsertMessages(userID, deviceID, msgs[:1])
+	assertNoError(t, err)
+	gotMsgs, _, err = table.Messages(userID, deviceID, pos, 10)
+	assertNoError(t, err)
+	assertValue(t, "msgs after window", len(gotMsgs), 2)
+	bytesEqual(t, gotMsgs[1], msgs[0])
+}
+
 // Guard against possible message truncation?
 func TestToDeviceTableBytesInEqualBytesOut(t *testing.T) {
 	db, close := connectToDB(t)
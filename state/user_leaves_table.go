@@ -0,0 +1,66 @@
+package state
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+// UserLeavesTable stores the most recent leave event for each user in each room they have left.
+// The proxy keeps accumulating state for rooms after a user leaves them as long as someone else
+// is still joined, so the current state of the room is not what the user last saw. The state
+// after the leave event is, which is why the snapshots before these events are never pruned.
+//
+// Only leaves seen by the user's own poller are recorded, so that the table does not grow with
+// the membership churn of large rooms. Rejoining or being invited to the room clears the row.
+type UserLeavesTable struct {
+	db *sqlx.DB
+}
+
+func NewUserLeavesTable(db *sqlx.DB) *UserLeavesTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_user_leaves (
+		user_id TEXT NOT NULL,
+		room_id TEXT NOT NULL,
+		leave_nid BIGINT NOT NULL,
+		UNIQUE(user_id, room_id)
+	);
+	`)
+	return &UserLeavesTable{db}
+}
+
+// Upsert records that the user left the room at the event with this NID.
+func (t *UserLeavesTable) Upsert(txn *sqlx.Tx, userID, roomID string, leaveNID int64) error {
+	_, err := txn.Exec(`INSERT INTO syncv3_user_leaves(user_id, room_id, leave_nid) VALUES($1, $2, $3)
+	ON CONFLICT (user_id, room_id) DO UPDATE SET leave_nid = GREATEST(syncv3_user_leaves.leave_nid, EXCLUDED.leave_nid)`,
+		userID, roomID, leaveNID)
+	return err
+}
+
+// Delete forgets the user's leave for this room, e.g because they have rejoined it.
+func (t *UserLeavesTable) Delete(txn *sqlx.Tx, userID, roomID string) error {
+	_, err := txn.Exec(`DELETE FROM syncv3_user_leaves WHERE user_id = $1 AND room_id = $2`, userID, roomID)
+	return err
+}
+
+// SelectLeaveNIDs returns the leave event NID for each of the given rooms which the user has left.
+// Rooms without a recorded leave are not in the map.
+func (t *UserLeavesTable) SelectLeaveNIDs(ctx context.Context, userID string, roomIDs []string) (map[string]int64, error) {
+	var rows []struct {
+		RoomID   string `db:"room_id"`
+		LeaveNID int64  `db:"leave_nid"`
+	}
+	err := sqlutil.SelectContext(ctx, t.db, "SelectLeaveNIDs", &rows, `SELECT room_id, leave_nid FROM syncv3_user_leaves WHERE user_id = $1 AND room_id = ANY($2)`,
+		userID, pq.StringArray(roomIDs))
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		result[row.RoomID] = row.LeaveNID
+	}
+	return result, nil
+}
@@ -0,0 +1,143 @@
+package state
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/tidwall/gjson"
+)
+
+// UserMembershipsTable is an index of the latest join, leave or ban of every user in every room,
+// so the rooms a user is joined to can be read without replaying all of their membership events.
+// It is updated in the same transaction as the membership events are inserted, and mirrors the
+// rules in determineJoinedRoomsFromMemberships: invites and knocks are ignored, and the join NID is
+// the first join after the most recent leave or ban.
+//
+// Events are applied in NID order per transaction. If a transaction commits after another which
+// inserted a later membership event for the same user and room, its events are ignored.
+type UserMembershipsTable struct {
+	db *sqlx.DB
+}
+
+type UserMembershipRow struct {
+	UserID string `db:"user_id"`
+	RoomID string `db:"room_id"`
+	// The NID of the latest join, leave or ban event.
+	MembershipNID int64 `db:"membership_nid"`
+	// The NID and timestamp of the event the user joined at, or 0 if they are not joined.
+	JoinNID       int64  `db:"join_nid"`
+	JoinTimestamp uint64 `db:"join_ts"`
+}
+
+func NewUserMembershipsTable(db *sqlx.DB) *UserMembershipsTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_user_memberships (
+		user_id TEXT NOT NULL,
+		room_id TEXT NOT NULL,
+		membership_nid BIGINT NOT NULL,
+		join_nid BIGINT NOT NULL,
+		join_ts BIGINT NOT NULL,
+		UNIQUE(user_id, room_id)
+	);
+	`)
+	return &UserMembershipsTable{db}
+}
+
+// Update applies the membership events in these newly inserted events, which must all be in the
+// same room and have NIDs.
+func (t *UserMembershipsTable) Update(txn *sqlx.Tx, events []Event) error {
+	var memberships []Event
+	for _, ev := range events {
+		if ev.Type != "m.room.member" || ev.StateKey == "" {
+			continue
+		}
+		switch strings.TrimPrefix(ev.Membership, "_") {
+		case "join", "leave", "ban":
+			memberships = append(memberships, ev)
+		}
+	}
+	if len(memberships) == 0 {
+		return nil
+	}
+	sort.Slice(memberships, func(i, j int) bool {
+		return memberships[i].NID < memberships[j].NID
+	})
+
+	// Work out each user's membership after these events. If the events include a leave, they
+	// fully determine the join NID. If not, an existing join takes precedence.
+	rows := make(map[string]*UserMembershipRow)
+	leftInBatch := make(map[string]bool)
+	var userIDs []string
+	for _, ev := range memberships {
+		row, ok := rows[ev.StateKey]
+		if !ok {
+			row = &UserMembershipRow{UserID: ev.StateKey, RoomID: ev.RoomID}
+			rows[ev.StateKey] = row
+			userIDs = append(userIDs, ev.StateKey)
+		}
+		row.MembershipNID = ev.NID
+		if strings.TrimPrefix(ev.Membership, "_") != "join" {
+			row.JoinNID = 0
+			row.JoinTimestamp = 0
+			leftInBatch[ev.StateKey] = true
+		} else if row.JoinNID == 0 {
+			row.JoinNID = ev.NID
+			row.JoinTimestamp = gjson.GetBytes(ev.JSON, "origin_server_ts").Uint()
+		}
+	}
+	var replace, join []UserMembershipRow
+	for _, userID := range userIDs {
+		if leftInBatch[userID] {
+			replace = append(replace, *rows[userID])
+		} else {
+			join = append(join, *rows[userID])
+		}
+	}
+	if err := t.upsert(txn, replace, `
+		join_nid = EXCLUDED.join_nid,
+		join_ts = EXCLUDED.join_ts`); err != nil {
+		return err
+	}
+	return t.upsert(txn, join, `
+		join_nid = CASE WHEN syncv3_user_memberships.join_nid = 0 THEN EXCLUDED.join_nid ELSE syncv3_user_memberships.join_nid END,
+		join_ts = CASE WHEN syncv3_user_memberships.join_nid = 0 THEN EXCLUDED.join_ts ELSE syncv3_user_memberships.join_ts END`)
+}
+
+func (t *UserMembershipsTable) upsert(txn *sqlx.Tx, rows []UserMembershipRow, setJoin string) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	userIDs := make([]string, len(rows))
+	roomIDs := make([]string, len(rows))
+	membershipNIDs := make([]int64, len(rows))
+	joinNIDs := make([]int64, len(rows))
+	joinTimestamps := make([]int64, len(rows))
+	for i, row := range rows {
+		userIDs[i] = row.UserID
+		roomIDs[i] = row.RoomID
+		membershipNIDs[i] = row.MembershipNID
+		joinNIDs[i] = row.JoinNID
+		joinTimestamps[i] = int64(row.JoinTimestamp)
+	}
+	_, err := txn.Exec(`
+	INSERT INTO syncv3_user_memberships(user_id, room_id, membership_nid, join_nid, join_ts)
+	SELECT * FROM unnest($1::text[], $2::text[], $3::bigint[], $4::bigint[], $5::bigint[])
+	ON CONFLICT (user_id, room_id) DO UPDATE SET
+		membership_nid = EXCLUDED.membership_nid,`+setJoin+`
+	WHERE syncv3_user_memberships.membership_nid < EXCLUDED.membership_nid`,
+		pq.StringArray(userIDs), pq.StringArray(roomIDs), pq.Int64Array(membershipNIDs),
+		pq.Int64Array(joinNIDs), pq.Int64Array(joinTimestamps),
+	)
+	return err
+}
+
+// SelectByUser returns the latest membership of the user in every room they have joined, left or
+// been banned from.
+func (t *UserMembershipsTable) SelectByUser(userID string) (rows []UserMembershipRow, err error) {
+	err = t.db.Select(&rows, `SELECT user_id, room_id, membership_nid, join_nid, join_ts
+	FROM syncv3_user_memberships WHERE user_id = $1`, userID)
+	return
+}
@@ -0,0 +1,174 @@
+package slidingsync
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2/handler2"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stats are aggregate numbers describing how much the proxy is tracking.
+type Stats struct {
+	Users   int `json:"users"`
+	Devices int `json:"devices"`
+	Rooms   int `json:"rooms"`
+	// Events is estimated from the syncv3_events table statistics.
+	Events      int64              `json:"events"`
+	ActiveConns int                `json:"active_conns"`
+	Pollers     int                `json:"pollers"`
+	Tables      []state.TableStats `json:"tables"`
+	// Growth is only available if the StatsCollector is keeping a history of table sizes.
+	Growth []state.TableGrowth `json:"growth,omitempty"`
+}
+
+// tableStatsHistoryInterval is how often table sizes are added to the history. Growth is measured
+// over days, so sampling more often would just make the history bigger.
+const tableStatsHistoryInterval = time.Hour
+
+func gatherStats(h2 *handler2.Handler, h3 *handler.SyncLiveHandler) (*Stats, error) {
+	var s Stats
+	var err error
+	s.Users, s.Devices, err = h3.V2Store.DevicesTable.Count()
+	if err != nil {
+		return nil, fmt.Errorf("failed to count devices: %w", err)
+	}
+	s.Rooms, err = h3.Storage.NumRooms()
+	if err != nil {
+		return nil, fmt.Errorf("failed to count rooms: %w", err)
+	}
+	s.Tables, err = h3.Storage.TableStats()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load table stats: %w", err)
+	}
+	for _, t := range s.Tables {
+		if t.Name == "syncv3_events" {
+			s.Events = t.EstimatedRows
+		}
+	}
+	// the history is pruned by the StatsCollector, so this is the growth over the retention period
+	s.Growth, err = h3.Storage.TableStatsTable.Growth(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load table growth: %w", err)
+	}
+	s.ActiveConns = h3.ConnMap.Len()
+	s.Pollers = h2.NumPollers()
+	return &s, nil
+}
+
+// StatsCollector periodically exports Stats as Prometheus gauges. Active conns and pollers are
+// not exported as they already have their own gauges.
+type StatsCollector struct {
+	h2 *handler2.Handler
+	h3 *handler.SyncLiveHandler
+
+	// historyRetention is how long to keep a history of table sizes in the database, which is used
+	// to work out how quickly each table is growing. 0 disables the history. See SetHistoryRetention.
+	historyRetention  atomic.Int64
+	lastHistorySample time.Time
+
+	counts      *prometheus.GaugeVec
+	tableBytes  *prometheus.GaugeVec
+	tableRows   *prometheus.GaugeVec
+	tableGrowth *prometheus.GaugeVec
+}
+
+// NewStatsCollector creates and registers the stats gauges for the handlers returned from Setup.
+func NewStatsCollector(h2 *handler2.Handler, h3 http.Handler) *StatsCollector {
+	c := &StatsCollector{
+		h2: h2,
+		h3: h3.(*handler.SyncLiveHandler),
+		counts: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "stats",
+			Name:      "tracked",
+			Help:      "Number of users, devices, rooms and (estimated) events being tracked.",
+		}, []string{"kind"}),
+		tableBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "stats",
+			Name:      "table_size_bytes",
+			Help:      "Size of each database table including indexes.",
+		}, []string{"table"}),
+		tableRows: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "stats",
+			Name:      "table_rows_estimate",
+			Help:      "Estimated number of rows in each database table.",
+		}, []string{"table"}),
+		tableGrowth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "stats",
+			Name:      "table_growth_bytes_per_day",
+			Help:      "How quickly each database table grew over the table size history, if it is kept.",
+		}, []string{"table"}),
+	}
+	prometheus.MustRegister(c.counts)
+	prometheus.MustRegister(c.tableBytes)
+	prometheus.MustRegister(c.tableRows)
+	prometheus.MustRegister(c.tableGrowth)
+	return c
+}
+
+// SetHistoryRetention changes how long the history of table sizes is kept for. 0 disables the
+// history. Safe to call whilst Run is running.
+func (c *StatsCollector) SetHistoryRetention(retention time.Duration) {
+	c.historyRetention.Store(int64(retention))
+}
+
+// Run updates the gauges every interval. Blocks forever.
+func (c *StatsCollector) Run(interval time.Duration) {
+	for {
+		c.update()
+		time.Sleep(interval)
+	}
+}
+
+func (c *StatsCollector) update() {
+	s, err := gatherStats(c.h2, c.h3)
+	if err != nil {
+		logger.Warn().Err(err).Msg("StatsCollector: failed to gather stats")
+		return
+	}
+	c.counts.WithLabelValues("users").Set(float64(s.Users))
+	c.counts.WithLabelValues("devices").Set(float64(s.Devices))
+	c.counts.WithLabelValues("rooms").Set(float64(s.Rooms))
+	c.counts.WithLabelValues("events").Set(float64(s.Events))
+	for _, t := range s.Tables {
+		c.tableBytes.WithLabelValues(t.Name).Set(float64(t.Bytes))
+		c.tableRows.WithLabelValues(t.Name).Set(float64(t.EstimatedRows))
+	}
+	if retention := time.Duration(c.historyRetention.Load()); retention > 0 {
+		c.updateHistory(s.Tables, retention)
+	}
+}
+
+// updateHistory adds the table sizes to the history, at most once per tableStatsHistoryInterval,
+// removes samples older than retention and updates the growth gauges.
+func (c *StatsCollector) updateHistory(tables []state.TableStats, retention time.Duration) {
+	now := time.Now()
+	if now.Sub(c.lastHistorySample) < tableStatsHistoryInterval {
+		return
+	}
+	history := c.h3.Storage.TableStatsTable
+	if err := history.Insert(now, tables); err != nil {
+		logger.Warn().Err(err).Msg("StatsCollector: failed to store table stats history")
+		return
+	}
+	c.lastHistorySample = now
+	if _, err := history.DeleteBefore(now.Add(-retention)); err != nil {
+		logger.Warn().Err(err).Msg("StatsCollector: failed to prune table stats history")
+	}
+	growth, err := history.Growth(time.Time{})
+	if err != nil {
+		logger.Warn().Err(err).Msg("StatsCollector: failed to load table growth")
+		return
+	}
+	for _, g := range growth {
+		c.tableGrowth.WithLabelValues(g.Name).Set(g.BytesPerDay)
+	}
+}
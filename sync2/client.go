@@ -20,6 +20,14 @@ const AccountDataGlobalRoom = ""
 var ProxyVersion = ""
 var HTTP401 error = fmt.Errorf("HTTP 401")
 
+// ErrUserDeactivated is wrapped by errors from DoSyncV2 when the homeserver reports that the
+// user's account has been deactivated.
+var ErrUserDeactivated = fmt.Errorf("user deactivated")
+
+// ErrSoftLogout is wrapped by errors from DoSyncV2 when the homeserver reports that the access
+// token has expired but the device is still logged in, so the client can refresh its token (MSC2918).
+var ErrSoftLogout = fmt.Errorf("soft logout")
+
 type Client interface {
 	// Versions fetches and parses the list of Matrix versions that the homeserver
 	// advertises itself as supporting.
@@ -140,6 +148,13 @@ func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, is
 		}
 		return &svr, 200, nil
 	default:
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		if gjson.GetBytes(body, "errcode").Str == "M_USER_DEACTIVATED" {
+			return nil, res.StatusCode, fmt.Errorf("DoSyncV2: response returned %s: %w", res.Status, ErrUserDeactivated)
+		}
+		if gjson.GetBytes(body, "soft_logout").Bool() {
+			return nil, res.StatusCode, fmt.Errorf("DoSyncV2: response returned %s: %w", res.Status, ErrSoftLogout)
+		}
 		return nil, res.StatusCode, fmt.Errorf("DoSyncV2: response returned %s", res.Status)
 	}
 }
@@ -205,6 +220,7 @@ type SyncResponse struct {
 type SyncRoomsResponse struct {
 	Join   map[string]SyncV2JoinResponse   `json:"join"`
 	Invite map[string]SyncV2InviteResponse `json:"invite"`
+	Knock  map[string]SyncV2KnockResponse  `json:"knock"`
 	Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
 }
 
@@ -237,6 +253,11 @@ type SyncV2InviteResponse struct {
 	InviteState EventsResponse `json:"invite_state"`
 }
 
+// KnockResponse represents a /sync response for a room which is under the 'knock' key.
+type SyncV2KnockResponse struct {
+	KnockState EventsResponse `json:"knock_state"`
+}
+
 // LeaveResponse represents a /sync response for a room which is under the 'leave' key.
 type SyncV2LeaveResponse struct {
 	State struct {
@@ -47,6 +47,19 @@ func (t *DevicesTable) UpdateDeviceSince(userID, deviceID, since string) error {
 	return err
 }
 
+// UpdateDeviceSinceTx is UpdateDeviceSince in a transaction, so that the since token can be stored
+// atomically with the data it was derived from.
+func (t *DevicesTable) UpdateDeviceSinceTx(txn *sqlx.Tx, userID, deviceID, since string) error {
+	_, err := txn.Exec(`UPDATE syncv3_sync2_devices SET since = $1 WHERE user_id = $2 AND device_id = $3`, since, userID, deviceID)
+	return err
+}
+
+// Count returns the number of distinct users and the total number of devices being tracked.
+func (t *DevicesTable) Count() (numUsers, numDevices int, err error) {
+	err = t.db.QueryRow(`SELECT COUNT(DISTINCT user_id), COUNT(*) FROM syncv3_sync2_devices`).Scan(&numUsers, &numDevices)
+	return
+}
+
 // FindOldDevices fetches the user_id and device_id of all devices which haven't /synced
 // for at least as long as the given inactivityPeriod. Such devices are returned in
 // no particular order.
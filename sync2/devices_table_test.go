@@ -1,6 +1,7 @@
 package sync2
 
 import (
+	"database/sql"
 	"fmt"
 	"github.com/jmoiron/sqlx"
 	"github.com/matrix-org/sliding-sync/sqlutil"
@@ -187,6 +188,79 @@ func TestTokenForEachDevice(t *testing.T) {
 	}
 }
 
+func TestTokenForDevice(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	tokens := NewTokensTable(db, "my_secret")
+	devices := NewDevicesTable(db)
+
+	alice := "@TestTokenForDevice_alice:localhost"
+	aliceDevice := "alice_phone"
+	now := time.Now()
+
+	var aliceToken2 *Token
+	_ = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) (err error) {
+		t.Log("Add a device for Alice with two tokens.")
+		if err = devices.InsertDevice(txn, alice, aliceDevice); err != nil {
+			t.Fatalf("InsertDevice returned error: %s", err)
+		}
+		if _, err = tokens.Insert(txn, "TestTokenForDevice_secret1", alice, aliceDevice, now); err != nil {
+			t.Fatalf("Failed to Insert token: %s", err)
+		}
+		aliceToken2, err = tokens.Insert(txn, "TestTokenForDevice_secret2", alice, aliceDevice, now.Add(time.Minute))
+		if err != nil {
+			t.Fatalf("Failed to Insert token: %s", err)
+		}
+		return nil
+	})
+	if err := devices.UpdateDeviceSince(alice, aliceDevice, "s-1-2-3"); err != nil {
+		t.Fatalf("UpdateDeviceSince returned error: %s", err)
+	}
+
+	t.Log("The most recently seen token should be returned.")
+	got, err := tokens.TokenForDevice(alice, aliceDevice)
+	if err != nil {
+		t.Fatalf("TokenForDevice returned error: %s", err)
+	}
+	assertEqualTokens(t, tokens, got.Token, aliceToken2.AccessToken, alice, aliceDevice, aliceToken2.LastSeen)
+	assertEqual(t, got.Since, "s-1-2-3", "Device.Since mismatch")
+
+	t.Log("Unknown devices should return sql.ErrNoRows.")
+	_, err = tokens.TokenForDevice(alice, "unknown_device")
+	if err != sql.ErrNoRows {
+		t.Fatalf("TokenForDevice: got error %v want sql.ErrNoRows", err)
+	}
+}
+
+func TestDevicesTableCount(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+
+	// HACK: discard rows inserted by other tests, as this counts the entire table.
+	db.Exec("TRUNCATE syncv3_sync2_devices, syncv3_sync2_tokens;")
+	devices := NewDevicesTable(db)
+
+	_ = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		for _, d := range []Device{
+			{UserID: "alice", DeviceID: "alice_phone"},
+			{UserID: "alice", DeviceID: "alice_laptop"},
+			{UserID: "bob", DeviceID: "bob_phone"},
+		} {
+			if err := devices.InsertDevice(txn, d.UserID, d.DeviceID); err != nil {
+				t.Fatalf("InsertDevice returned error: %s", err)
+			}
+		}
+		return nil
+	})
+	numUsers, numDevices, err := devices.Count()
+	if err != nil {
+		t.Fatalf("Count returned error: %s", err)
+	}
+	if numUsers != 2 || numDevices != 3 {
+		t.Fatalf("Count: got %d users %d devices, want 2 users 3 devices", numUsers, numDevices)
+	}
+}
+
 func TestDevicesTable_FindOldDevices(t *testing.T) {
 	db, close := connectToDB(t)
 	defer close()
@@ -0,0 +1,212 @@
+package handler2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/tidwall/gjson"
+)
+
+// Homeservers deactivate accounts by making the user leave every room in quick succession. If a
+// user leaves this many rooms within the window and is left with no joined rooms, they are
+// assumed to be deactivated.
+const (
+	leaveFloodThreshold = 10
+	leaveFloodWindow    = 5 * time.Minute
+)
+
+// erasedUsers is the set of users whose profile data has been erased.
+type erasedUsers struct {
+	mu    sync.RWMutex
+	users map[string]struct{}
+}
+
+func (e *erasedUsers) add(userID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.users[userID] = struct{}{}
+}
+
+func (e *erasedUsers) isErased(userID string) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	_, ok := e.users[userID]
+	return ok
+}
+
+func (e *erasedUsers) empty() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return len(e.users) == 0
+}
+
+// selfLeaveTracker counts the rooms each user has recently left of their own accord.
+type selfLeaveTracker struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	leaves    map[string]*selfLeaves
+	lastPrune time.Time
+}
+
+type selfLeaves struct {
+	since time.Time
+	rooms map[string]struct{}
+}
+
+func newSelfLeaveTracker(threshold int, window time.Duration) *selfLeaveTracker {
+	return &selfLeaveTracker{
+		threshold: threshold,
+		window:    window,
+		leaves:    make(map[string]*selfLeaves),
+	}
+}
+
+// track records that the user left the room, returning true the first time the user has left
+// threshold rooms within the window. Leaves seen by several pollers are only counted once.
+func (t *selfLeaveTracker) track(userID, roomID string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.lastPrune) > t.window {
+		for u, l := range t.leaves {
+			if now.Sub(l.since) > t.window {
+				delete(t.leaves, u)
+			}
+		}
+		t.lastPrune = now
+	}
+	l := t.leaves[userID]
+	if l == nil || now.Sub(l.since) > t.window {
+		l = &selfLeaves{
+			since: now,
+			rooms: make(map[string]struct{}),
+		}
+		t.leaves[userID] = l
+	}
+	if _, ok := l.rooms[roomID]; ok {
+		return false
+	}
+	l.rooms[roomID] = struct{}{}
+	return len(l.rooms) == t.threshold
+}
+
+// EraseUser strips the user's display name and avatar from the database and deletes their
+// receipts, then tells the API process to reload the affected rooms. Profile data and receipts
+// for the user which arrive from pollers afterwards are discarded.
+func (h *Handler) EraseUser(ctx context.Context, userID string) (state.EraseUserResult, error) {
+	// start stripping new data before erasing, so nothing slips in between
+	h.erased.add(userID)
+	res, err := h.Store.EraseUser(userID)
+	if err != nil {
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return res, fmt.Errorf("EraseUser: %w", err)
+	}
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2EraseUser{
+		UserID:  userID,
+		RoomIDs: res.RoomIDs,
+	})
+	logger.Info().Str("user", userID).Int("rooms", len(res.RoomIDs)).Int64("events", res.NumEvents).
+		Int64("receipts", res.NumReceipts).Msg("erased user")
+	return res, nil
+}
+
+func (h *Handler) OnUserDeactivated(ctx context.Context, userID, deviceID string) {
+	h.onDeactivationDetected(ctx, userID, "M_USER_DEACTIVATED")
+}
+
+func (h *Handler) onDeactivationDetected(ctx context.Context, userID, reason string) {
+	if h.erased.isErased(userID) {
+		return
+	}
+	if !h.EraseDeactivatedUsers {
+		logger.Info().Str("user", userID).Str("reason", reason).Msg("user appears to be deactivated, not erasing")
+		return
+	}
+	logger.Info().Str("user", userID).Str("reason", reason).Msg("user appears to be deactivated, erasing")
+	if _, err := h.EraseUser(ctx, userID); err != nil {
+		logger.Err(err).Str("user", userID).Msg("failed to erase deactivated user")
+	}
+}
+
+// checkLeaveFloods tracks users leaving rooms in this timeline, and treats users who have just
+// left many rooms and are no longer joined to any as deactivated.
+func (h *Handler) checkLeaveFloods(ctx context.Context, roomID string, timeline []json.RawMessage) {
+	now := time.Now()
+	for _, ev := range timeline {
+		parsed := gjson.ParseBytes(ev)
+		if parsed.Get("type").Str != "m.room.member" || parsed.Get("content.membership").Str != "leave" {
+			continue
+		}
+		userID := parsed.Get("state_key").Str
+		if userID != parsed.Get("sender").Str || !h.selfLeaves.track(userID, roomID, now) {
+			continue
+		}
+		latestNID, err := h.Store.LatestEventNID()
+		if err != nil {
+			logger.Err(err).Str("user", userID).Msg("checkLeaveFloods: failed to load latest NID")
+			continue
+		}
+		joined, err := h.Store.JoinedRoomsAfterPosition(ctx, userID, latestNID)
+		if err != nil {
+			logger.Err(err).Str("user", userID).Msg("checkLeaveFloods: failed to load joined rooms")
+			continue
+		}
+		if len(joined) == 0 {
+			h.onDeactivationDetected(ctx, userID, "left all rooms")
+		}
+	}
+}
+
+// stripErasedProfiles removes profile data from membership events for erased users, in place.
+func (h *Handler) stripErasedProfiles(events []json.RawMessage) {
+	if h.erased.empty() {
+		return
+	}
+	for i := range events {
+		parsed := gjson.ParseBytes(events[i])
+		if parsed.Get("type").Str != "m.room.member" || !h.erased.isErased(parsed.Get("state_key").Str) {
+			continue
+		}
+		events[i], _ = state.StripProfile(events[i])
+	}
+}
+
+// stripErasedReceipts removes receipts sent by erased users from a receipt EDU.
+func (h *Handler) stripErasedReceipts(ephEvent json.RawMessage) json.RawMessage {
+	if h.erased.empty() {
+		return ephEvent
+	}
+	var edu struct {
+		Type string `json:"type"`
+		// event ID -> receipt type -> user ID -> receipt
+		Content map[string]map[string]map[string]json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(ephEvent, &edu); err != nil {
+		return ephEvent
+	}
+	changed := false
+	for _, receiptTypes := range edu.Content {
+		for _, users := range receiptTypes {
+			for userID := range users {
+				if h.erased.isErased(userID) {
+					delete(users, userID)
+					changed = true
+				}
+			}
+		}
+	}
+	if !changed {
+		return ephEvent
+	}
+	stripped, err := json.Marshal(edu)
+	if err != nil {
+		return ephEvent
+	}
+	return stripped
+}
@@ -0,0 +1,83 @@
+package handler2
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestSelfLeaveTracker(t *testing.T) {
+	start := time.Now()
+	tracker := newSelfLeaveTracker(3, time.Minute)
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	testCases := []struct {
+		name   string
+		userID string
+		roomID string
+		offset time.Duration
+		want   bool
+	}{
+		{name: "first leave", userID: alice, roomID: "!a", want: false},
+		{name: "second leave", userID: alice, roomID: "!b", offset: time.Second, want: false},
+		{name: "same room seen by another poller", userID: alice, roomID: "!b", offset: 2 * time.Second, want: false},
+		{name: "other user", userID: bob, roomID: "!c", offset: 3 * time.Second, want: false},
+		{name: "third leave is a flood", userID: alice, roomID: "!c", offset: 4 * time.Second, want: true},
+		{name: "only reported once", userID: alice, roomID: "!d", offset: 5 * time.Second, want: false},
+		{name: "window restarts", userID: bob, roomID: "!d", offset: 2 * time.Minute, want: false},
+		{name: "old leaves are forgotten", userID: bob, roomID: "!e", offset: 2*time.Minute + time.Second, want: false},
+	}
+	for _, tc := range testCases {
+		if got := tracker.track(tc.userID, tc.roomID, start.Add(tc.offset)); got != tc.want {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestStripErased(t *testing.T) {
+	erased := "@erased:localhost"
+	kept := "@kept:localhost"
+	h := &Handler{
+		erased: &erasedUsers{
+			users: map[string]struct{}{erased: {}},
+		},
+	}
+	member := func(userID string) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(
+			`{"type":"m.room.member","state_key":"%s","sender":"%s","content":{"membership":"join","displayname":"Name","avatar_url":"mxc://a"}}`,
+			userID, userID,
+		))
+	}
+	events := []json.RawMessage{member(erased), member(kept)}
+	h.stripErasedProfiles(events)
+	var displayNames []string
+	for _, ev := range events {
+		displayNames = append(displayNames, gjson.GetBytes(ev, "content.displayname").Str)
+	}
+	if want := []string{"", "Name"}; !reflect.DeepEqual(displayNames, want) {
+		t.Errorf("got display names %v want %v", displayNames, want)
+	}
+
+	edu := json.RawMessage(fmt.Sprintf(
+		`{"type":"m.receipt","content":{"$event":{"m.read":{"%s":{"ts":1},"%s":{"ts":2}},"m.read.private":{"%s":{"ts":3}}}}}`,
+		erased, kept, erased,
+	))
+	stripped := h.stripErasedReceipts(edu)
+	var got map[string]map[string]map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(gjson.GetBytes(stripped, "content").Raw), &got); err != nil {
+		t.Fatalf("failed to unmarshal stripped EDU: %s", err)
+	}
+	if len(got["$event"]["m.read"]) != 1 || got["$event"]["m.read"][kept] == nil {
+		t.Errorf("stripped public receipts incorrectly: %s", stripped)
+	}
+	if len(got["$event"]["m.read.private"]) != 0 {
+		t.Errorf("did not strip private receipts: %s", stripped)
+	}
+	if gjson.GetBytes(stripped, "type").Str != "m.receipt" {
+		t.Errorf("lost EDU type: %s", stripped)
+	}
+}
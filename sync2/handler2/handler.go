@@ -2,11 +2,12 @@ package handler2
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"hash/fnv"
-	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -24,10 +25,10 @@ import (
 	"github.com/tidwall/sjson"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger("handler2")
+
+// Devices whose tokens have not been used for this long have their pollers expired.
+const pollerExpiryPeriod = 30 * 24 * time.Hour
 
 // Handler is responsible for starting v2 pollers at startup;
 // processing v2 data (as a sync2.V2DataReceiver) and publishing updates (pubsub.Payload to V2Listeners);
@@ -49,12 +50,24 @@ type Handler struct {
 	typingMu      *sync.Mutex
 	PendingTxnIDs *sync2.PendingTransactionIDs
 
-	deviceDataTicker   *sync2.DeviceDataTicker
-	pollerExpiryTicker *time.Ticker
-	e2eeWorkerPool     *internal.WorkerPool
-
-	numPollers prometheus.Gauge
-	subSystem  string
+	deviceDataTicker *sync2.DeviceDataTicker
+	expiryTicker     *time.Ticker
+	e2eeWorkerPool   *internal.WorkerPool
+
+	// EraseDeactivatedUsers erases the profile data of users who appear to have been deactivated,
+	// see EraseUser. If false, deactivations are only logged.
+	EraseDeactivatedUsers bool
+	erased                *erasedUsers
+	selfLeaves            *selfLeaveTracker
+	// toDeviceTTL is how long to keep to-device messages which were sent to their device but not
+	// acknowledged, e.g. because it never reconnected. 0 keeps them forever. See SetToDeviceTTL.
+	toDeviceTTL atomic.Int64
+
+	numPollers      prometheus.Gauge
+	duplicateEvents prometheus.Counter
+	// Number of to-device messages deleted because they were older than the to-device TTL.
+	expiredToDeviceMessages prometheus.Counter
+	subSystem               string
 }
 
 func NewHandler(
@@ -76,6 +89,17 @@ func NewHandler(
 		PendingTxnIDs:    sync2.NewPendingTransactionIDs(pMap.DeviceIDs),
 		deviceDataTicker: sync2.NewDeviceDataTicker(deviceDataUpdateDuration),
 		e2eeWorkerPool:   internal.NewWorkerPool(500), // TODO: assign as fraction of db max conns, not hardcoded
+		selfLeaves:       newSelfLeaveTracker(leaveFloodThreshold, leaveFloodWindow),
+	}
+	erasedUserIDs, err := store.ErasedUsersTable.SelectAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load erased users: %w", err)
+	}
+	h.erased = &erasedUsers{
+		users: make(map[string]struct{}, len(erasedUserIDs)),
+	}
+	for _, userID := range erasedUserIDs {
+		h.erased.add(userID)
 	}
 
 	if enablePrometheus {
@@ -113,12 +137,18 @@ func (h *Handler) Teardown() {
 	h.v2Store.Teardown()
 	h.pMap.Terminate()
 	h.deviceDataTicker.Stop()
-	if h.pollerExpiryTicker != nil {
-		h.pollerExpiryTicker.Stop()
+	if h.expiryTicker != nil {
+		h.expiryTicker.Stop()
 	}
 	if h.numPollers != nil {
 		prometheus.Unregister(h.numPollers)
 	}
+	if h.duplicateEvents != nil {
+		prometheus.Unregister(h.duplicateEvents)
+	}
+	if h.expiredToDeviceMessages != nil {
+		prometheus.Unregister(h.expiredToDeviceMessages)
+	}
 }
 
 func (h *Handler) StartV2Pollers() {
@@ -173,7 +203,12 @@ func (h *Handler) StartV2Pollers() {
 	}
 	wg.Wait()
 	logger.Info().Msg("StartV2Pollers finished")
-	h.startPollerExpiryTicker()
+	h.startExpiryTicker()
+}
+
+// NumPollers returns the number of running pollers.
+func (h *Handler) NumPollers() int {
+	return h.pMap.NumPollers()
 }
 
 func (h *Handler) updateMetrics() {
@@ -196,15 +231,42 @@ func (h *Handler) OnTerminated(ctx context.Context, pollerID sync2.PollerID) {
 }
 
 func (h *Handler) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string) {
+	h.expireToken(ctx, accessTokenHash, userID, deviceID, false)
+}
+
+// OnSoftLogout is like OnExpiredToken, but tells the API process that the device is still logged
+// in, so it can keep the device's conns for when the client returns with a refreshed token.
+func (h *Handler) OnSoftLogout(ctx context.Context, accessTokenHash, userID, deviceID string) {
+	h.expireToken(ctx, accessTokenHash, userID, deviceID, true)
+}
+
+func (h *Handler) expireToken(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool) {
 	err := h.v2Store.TokensTable.Delete(accessTokenHash)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("device", deviceID).Str("access_token_hash", accessTokenHash).Msg("V2: failed to expire token")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 	}
+	// Clients can briefly hold two valid tokens for one device, e.g while refreshing. Only expire
+	// the device once it has no other recently used token, otherwise carry on polling with that.
+	next, err := h.v2Store.TokensTable.TokenForDevice(userID, deviceID)
+	if err == nil && time.Since(next.LastSeen) < pollerExpiryPeriod {
+		log := logger.With().Str("user_id", userID).Str("device_id", deviceID).Logger()
+		pid := sync2.PollerID{UserID: userID, DeviceID: deviceID}
+		if h.pMap.UpdateAccessToken(pid, next.AccessToken) {
+			log.Info().Msg("access token expired, poller switched to another token for this device")
+		} else {
+			log.Info().Msg("access token expired, starting poller with another token for this device")
+			go h.startPoller(pid, next.AccessToken, next.Since, log)
+		}
+		return
+	} else if err != nil && err != sql.ErrNoRows {
+		logger.Warn().Err(err).Str("user", userID).Str("device", deviceID).Msg("V2: failed to look for other tokens for device")
+	}
 	// Notify v3 side so it can remove the connection from ConnMap
 	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2ExpiredToken{
-		UserID:   userID,
-		DeviceID: deviceID,
+		UserID:     userID,
+		DeviceID:   deviceID,
+		SoftLogout: softLogout,
 	})
 }
 
@@ -215,7 +277,21 @@ func (h *Handler) addPrometheusMetrics() {
 		Name:      "num_pollers",
 		Help:      "Number of active sync v2 pollers.",
 	})
+	h.duplicateEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: h.subSystem,
+		Name:      "duplicate_events",
+		Help:      "Number of timeline events sent more than once in the same timeline by the homeserver, which were dropped as duplicates.",
+	})
+	h.expiredToDeviceMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: h.subSystem,
+		Name:      "expired_to_device_messages",
+		Help:      "Number of to-device messages deleted because their device did not acknowledge them in time.",
+	})
 	prometheus.MustRegister(h.numPollers)
+	prometheus.MustRegister(h.duplicateEvents)
+	prometheus.MustRegister(h.expiredToDeviceMessages)
 }
 
 // Emits nothing as no downstream components need it.
@@ -227,17 +303,24 @@ func (h *Handler) UpdateDeviceSince(ctx context.Context, userID, deviceID, since
 	}
 }
 
-func (h *Handler) OnE2EEData(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) (retErr error) {
+// Stores the device data and since token in one transaction, so a restart cannot see one without the other.
+func (h *Handler) OnE2EEData(ctx context.Context, userID, deviceID, since string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) (retErr error) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	h.e2eeWorkerPool.Queue(func() {
 		defer wg.Done()
-		err := h.Store.DeviceDataTable.Upsert(userID, deviceID, internal.DeviceKeyData{
-			OTKCounts:        otkCounts,
-			FallbackKeyTypes: fallbackKeyTypes,
-		}, deviceListChanges)
+		err := sqlutil.WithTransaction(h.Store.DB, func(txn *sqlx.Tx) error {
+			err := h.Store.DeviceDataTable.UpsertTx(txn, userID, deviceID, internal.DeviceKeyData{
+				OTKCounts:        otkCounts,
+				FallbackKeyTypes: fallbackKeyTypes,
+			}, deviceListChanges)
+			if err != nil {
+				return fmt.Errorf("failed to upsert device data: %w", err)
+			}
+			return h.v2Store.DevicesTable.UpdateDeviceSinceTx(txn, userID, deviceID, since)
+		})
 		if err != nil {
-			logger.Err(err).Str("user", userID).Msg("failed to upsert device data")
+			logger.Err(err).Str("user", userID).Str("device", deviceID).Str("since", since).Msg("failed to store device data")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 			retErr = err
 			return
@@ -269,19 +352,22 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID strin
 		timeline.Events[i], _ = sjson.DeleteBytes(timeline.Events[i], "unsigned.membership")
 		// escape .'s in the key name
 		timeline.Events[i], _ = sjson.DeleteBytes(timeline.Events[i], `unsigned.io\.element\.msc4115\.membership`)
-		parsed := gjson.ParseBytes(timeline.Events[i])
-		eventID := parsed.Get("event_id").Str
+		parsed := internal.ParseEvent(timeline.Events[i])
+		eventID := parsed.ID
 
-		if txnID := parsed.Get("unsigned.transaction_id"); txnID.Exists() {
+		if txnID := parsed.Unsigned.Get("transaction_id"); txnID.Exists() {
 			eventIDsWithTxns = append(eventIDsWithTxns, eventID)
 			eventIDToTxnID[eventID] = txnID.Str
+			// the event is shared with other users, so the txn ID is only stored in the txns table
+			timeline.Events[i] = internal.StripTransactionID(timeline.Events[i])
 			continue
 		}
 
-		if sender := parsed.Get("sender"); sender.Str == userID {
+		if parsed.Sender == userID {
 			eventIDsLackingTxns = append(eventIDsLackingTxns, eventID)
 		}
 	}
+	h.stripErasedProfiles(timeline.Events)
 
 	if len(eventIDToTxnID) > 0 {
 		// persist the txn IDs
@@ -300,6 +386,10 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID strin
 		return err
 	}
 
+	if accResult.NumDuplicates > 0 && h.duplicateEvents != nil {
+		h.duplicateEvents.Add(float64(accResult.NumDuplicates))
+	}
+
 	// Consumers should reload state content before processing new timeline events.
 	if accResult.IncludesStateRedaction {
 		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2StateRedaction{
@@ -313,7 +403,9 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID strin
 			RoomID:    roomID,
 			PrevBatch: timeline.PrevBatch,
 			EventNIDs: accResult.TimelineNIDs,
+			Gappy:     accResult.Gappy,
 		})
+		h.checkLeaveFloods(ctx, roomID, timeline.Events)
 	}
 
 	if len(eventIDToTxnID) > 0 || len(eventIDsLackingTxns) > 0 {
@@ -374,6 +466,7 @@ func (h *Handler) Initialise(ctx context.Context, roomID string, state []json.Ra
 		// escape .'s in the key name
 		state[i], _ = sjson.DeleteBytes(state[i], `unsigned.io\.element\.msc4115\.membership`)
 	}
+	h.stripErasedProfiles(state)
 	res, err := h.Store.Initialise(roomID, state)
 	if err != nil {
 		logger.Err(err).Int("state", len(state)).Str("room", roomID).Msg("V2: failed to initialise room")
@@ -389,6 +482,10 @@ func (h *Handler) Initialise(ctx context.Context, roomID string, state []json.Ra
 			RoomID:      roomID,
 			SnapshotNID: res.SnapshotID,
 		})
+	} else if res.RewoundState {
+		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2StateRewind{
+			RoomID: roomID,
+		})
 	}
 	return nil
 }
@@ -418,6 +515,7 @@ func (h *Handler) SetTyping(ctx context.Context, pollerID sync2.PollerID, roomID
 func (h *Handler) OnReceipt(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage) {
 	// update our records - we make an artifically new RR event if there are genuine changes
 	// else it returns nil
+	ephEvent = h.stripErasedReceipts(ephEvent)
 	newReceipts, err := h.Store.ReceiptTable.Insert(roomID, ephEvent)
 	if err != nil {
 		logger.Err(err).Str("room", roomID).Msg("failed to store receipts")
@@ -525,6 +623,7 @@ func (h *Handler) OnAccountData(ctx context.Context, userID, roomID string, even
 }
 
 func (h *Handler) OnInvite(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error {
+	h.stripErasedProfiles(inviteState)
 	err := h.Store.InvitesTable.InsertInvite(userID, roomID, inviteState)
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to insert invite")
@@ -538,6 +637,21 @@ func (h *Handler) OnInvite(ctx context.Context, userID, roomID string, inviteSta
 	return nil
 }
 
+func (h *Handler) OnKnock(ctx context.Context, userID, roomID string, knockState []json.RawMessage) error {
+	h.stripErasedProfiles(knockState)
+	err := h.Store.KnocksTable.InsertKnock(userID, roomID, knockState)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to insert knock")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return err
+	}
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2KnockRoom{
+		UserID: userID,
+		RoomID: roomID,
+	})
+	return nil
+}
+
 func (h *Handler) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEv json.RawMessage) error {
 	// remove any invites for this user if they are rejecting an invite
 	err := h.Store.InvitesTable.RemoveInvite(userID, roomID)
@@ -546,6 +660,13 @@ func (h *Handler) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEv
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return err
 	}
+	// likewise for knocks which have been rejected or rescinded
+	err = h.Store.KnocksTable.RemoveKnock(userID, roomID)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to retire knock")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return err
+	}
 
 	// Remove room from the typing deviceHandler map, this ensures we always
 	// have a device handling typing notifications for a given room.
@@ -574,45 +695,143 @@ func (h *Handler) EnsurePolling(p *pubsub.V3EnsurePolling) {
 		return
 	}
 	// don't block us from consuming more pubsub messages just because someone wants to sync
-	go func() {
-		// blocks until an initial sync is done
-		pid := sync2.PollerID{
-			UserID:   p.UserID,
-			DeviceID: p.DeviceID,
-		}
-		_, err = h.pMap.EnsurePolling(
-			pid, accessToken, since, false, log,
-		)
-		if err != nil {
-			log.Err(err).Msg("Failed to start poller")
-		}
-		h.updateMetrics()
-		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2InitialSyncComplete{
-			UserID:   p.UserID,
-			DeviceID: p.DeviceID,
-			Success:  err == nil,
-		})
-	}()
+	go h.startPoller(sync2.PollerID{UserID: p.UserID, DeviceID: p.DeviceID}, accessToken, since, log)
 }
 
-func (h *Handler) startPollerExpiryTicker() {
-	if h.pollerExpiryTicker != nil {
+// startPoller blocks until the poller for this device has done an initial sync, then notifies
+// the API process.
+func (h *Handler) startPoller(pid sync2.PollerID, accessToken, since string, log zerolog.Logger) {
+	_, err := h.pMap.EnsurePolling(
+		pid, accessToken, since, false, log,
+	)
+	if err != nil {
+		log.Err(err).Msg("Failed to start poller")
+	}
+	h.updateMetrics()
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2InitialSyncComplete{
+		UserID:   pid.UserID,
+		DeviceID: pid.DeviceID,
+		Success:  err == nil,
+	})
+}
+
+// OnTokenRefreshed switches the device's poller to its new access token, so it keeps polling
+// after the old token expires instead of being restarted.
+func (h *Handler) OnTokenRefreshed(p *pubsub.V3TokenRefreshed) {
+	log := logger.With().Str("user_id", p.UserID).Str("device_id", p.DeviceID).Logger()
+	accessToken, _, err := h.v2Store.TokensTable.GetTokenAndSince(p.UserID, p.DeviceID, p.AccessTokenHash)
+	if err != nil {
+		log.Err(err).Msg("V3Sub: OnTokenRefreshed unknown token")
+		sentry.CaptureException(err)
+		return
+	}
+	if h.pMap.UpdateAccessToken(sync2.PollerID{UserID: p.UserID, DeviceID: p.DeviceID}, accessToken) {
+		log.Info().Msg("OnTokenRefreshed: poller switched to refreshed access token")
+	}
+}
+
+func (h *Handler) OnPing(p *pubsub.V3Ping) {
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2Pong{
+		ID: p.ID,
+	})
+}
+
+func (h *Handler) startExpiryTicker() {
+	if h.expiryTicker != nil {
 		return
 	}
-	h.pollerExpiryTicker = time.NewTicker(time.Hour)
+	h.expiryTicker = time.NewTicker(time.Hour)
 	go func() {
-		for range h.pollerExpiryTicker.C {
+		for range h.expiryTicker.C {
 			h.ExpireOldPollers()
+			h.ExpireToDeviceMessages()
 		}
 	}()
 }
 
+// StopPollers terminates the pollers for the given user's devices without expiring their access
+// tokens. If deviceID is empty, all of the user's pollers are stopped. Pollers will be recreated
+// when the device next makes a sliding sync request, or when the proxy restarts. Returns the
+// number of pollers which were stopped.
+func (h *Handler) StopPollers(userID, deviceID string) int {
+	deviceIDs := []string{deviceID}
+	if deviceID == "" {
+		deviceIDs = h.pMap.DeviceIDs(userID)
+	}
+	pids := make([]sync2.PollerID, len(deviceIDs))
+	for i := range deviceIDs {
+		pids[i] = sync2.PollerID{UserID: userID, DeviceID: deviceIDs[i]}
+	}
+	numStopped := h.pMap.TerminatePollers(pids)
+	h.updateMetrics()
+	logger.Info().Str("user", userID).Str("device", deviceID).Int("stopped", numStopped).Msg("stopped pollers")
+	return numStopped
+}
+
+// ResyncDevice discards the since token and E2EE device data for this device, then restarts its
+// poller with a fresh initial sync. This is used to recover a single device from corrupted state.
+// The poller is restarted asynchronously. Returns an error if the device has no access token, in
+// which case nothing is changed.
+func (h *Handler) ResyncDevice(userID, deviceID string) error {
+	log := logger.With().Str("user_id", userID).Str("device_id", deviceID).Logger()
+	token, err := h.v2Store.TokensTable.TokenForDevice(userID, deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to load token for device: %w", err)
+	}
+	// Stop the poller first so it doesn't overwrite the since token we are about to reset.
+	// A poller which is mid-request may still persist one more since token after this point, but
+	// this is harmless as the new poller starts from scratch and will overwrite it.
+	h.StopPollers(userID, deviceID)
+	if err = h.v2Store.DevicesTable.UpdateDeviceSince(userID, deviceID, ""); err != nil {
+		return fmt.Errorf("failed to reset since token: %w", err)
+	}
+	if err = h.Store.DeviceDataTable.Delete(userID, deviceID); err != nil {
+		return fmt.Errorf("failed to delete device data: %w", err)
+	}
+	log.Info().Msg("ResyncDevice: restarting poller from scratch")
+	go h.startPoller(sync2.PollerID{UserID: userID, DeviceID: deviceID}, token.AccessToken, "", log)
+	return nil
+}
+
+// InvalidateToken deletes the access token with this hash and stops any pollers using it. The API
+// process is told the token has expired, which destroys the device's conns, unless the device has
+// another recently used token, in which case it carries on polling with that. Clients presenting the
+// token again will be re-authenticated against the homeserver, so the token should also be revoked
+// there. Returns the user and device the token belonged to, or sql.ErrNoRows if it is unknown.
+func (h *Handler) InvalidateToken(ctx context.Context, accessTokenHash string) (userID, deviceID string, err error) {
+	token, err := h.v2Store.TokensTable.TokenByHash(accessTokenHash)
+	if err != nil {
+		return "", "", err
+	}
+	numStopped := h.pMap.TerminatePollersWithToken(accessTokenHash)
+	h.updateMetrics()
+	h.OnExpiredToken(ctx, accessTokenHash, token.UserID, token.DeviceID)
+	logger.Info().Str("user", token.UserID).Str("device", token.DeviceID).Int("stopped", numStopped).Msg("invalidated access token")
+	return token.UserID, token.DeviceID, nil
+}
+
+// PurgeRoom deletes all data for the room from the database and tells the API process to forget
+// the room. Returns the number of events deleted.
+func (h *Handler) PurgeRoom(ctx context.Context, roomID string) (int64, error) {
+	res, err := h.Store.PurgeRoom(roomID)
+	if err != nil {
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return 0, fmt.Errorf("PurgeRoom: %w", err)
+	}
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2PurgeRoom{
+		RoomID:  roomID,
+		UserIDs: res.UserIDs,
+	})
+	logger.Info().Str("room", roomID).Int64("events", res.NumEvents).Int("users", len(res.UserIDs)).Int("archives", res.NumArchives).Msg("purged room")
+	return res.NumEvents, nil
+}
+
 // ExpireOldPollers looks for pollers whose devices have not made a sliding sync query
 // in the last 30 days, and asks the poller map to expire their corresponding pollers.
 // This function does not normally need to be called manually (StartV2Pollers queues it
 // up to run hourly); we expose it publicly only for testing purposes.
 func (h *Handler) ExpireOldPollers() {
-	devices, err := h.v2Store.DevicesTable.FindOldDevices(30 * 24 * time.Hour)
+	devices, err := h.v2Store.DevicesTable.FindOldDevices(pollerExpiryPeriod)
 	if err != nil {
 		logger.Err(err).Msg("Error fetching old devices")
 		sentry.CaptureException(err)
@@ -629,6 +848,35 @@ func (h *Handler) ExpireOldPollers() {
 	}
 }
 
+// SetToDeviceTTL changes how long to-device messages which were never acknowledged are kept for.
+// 0 keeps them forever. Takes effect the next time ExpireToDeviceMessages runs.
+func (h *Handler) SetToDeviceTTL(ttl time.Duration) {
+	h.toDeviceTTL.Store(int64(ttl))
+}
+
+// ExpireToDeviceMessages deletes to-device messages older than the to-device TTL which were sent to
+// their device but never acknowledged, or which were never sent to a device which has not been seen
+// within the TTL. These would otherwise accumulate forever for devices which never reconnect. Like
+// ExpireOldPollers, StartV2Pollers queues this up to run hourly.
+func (h *Handler) ExpireToDeviceMessages() {
+	ttl := time.Duration(h.toDeviceTTL.Load())
+	if ttl <= 0 {
+		return
+	}
+	numExpired, err := h.Store.ToDeviceTable.DeleteMessagesOlderThan(time.Now().Add(-ttl))
+	if err != nil {
+		logger.Err(err).Msg("Error expiring old to-device messages")
+		sentry.CaptureException(err)
+		return
+	}
+	if h.expiredToDeviceMessages != nil {
+		h.expiredToDeviceMessages.Add(float64(numExpired))
+	}
+	if numExpired > 0 {
+		logger.Info().Int64("expired", numExpired).Dur("ttl", ttl).Msg("expired old to-device messages")
+	}
+}
+
 func fnvHash(event json.RawMessage) uint64 {
 	h := fnv.New64a()
 	h.Write(event)
@@ -52,6 +52,16 @@ func (p *mockPollerMap) ExpirePollers([]sync2.PollerID) int {
 	return 0
 }
 
+func (p *mockPollerMap) TerminatePollersWithToken(string) int {
+	return 0
+}
+func (p *mockPollerMap) TerminatePollers([]sync2.PollerID) int {
+	return 0
+}
+func (p *mockPollerMap) UpdateAccessToken(sync2.PollerID, string) bool {
+	return false
+}
+
 func (p *mockPollerMap) EnsurePolling(pid sync2.PollerID, accessToken, v2since string, isStartup bool, logger zerolog.Logger) (bool, error) {
 	p.calls = append(p.calls, pollInfo{
 		pid:         pid,
@@ -0,0 +1,166 @@
+package sync2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scopes granted to Matrix clients by an OIDC provider, see MSC2967. Both the unstable and stable
+// prefixes are accepted.
+var (
+	introspectionAPIScopes    = []string{"urn:matrix:org.matrix.msc2967.client:api:*", "urn:matrix:client:api:*"}
+	introspectionDeviceScopes = []string{"urn:matrix:org.matrix.msc2967.client:device:", "urn:matrix:client:device:"}
+)
+
+// The max number of introspection results to cache. When full, expired results are dropped, and if
+// that isn't enough the cache is emptied.
+const maxCachedIntrospections = 10000
+
+// TokenIntrospector identifies access tokens using the OAuth 2.0 token introspection endpoint
+// (RFC 7662) of the OIDC provider which the homeserver delegates auth to (MSC3861), rather than
+// asking the homeserver via /whoami. Results are cached for a short time, so tokens can be checked
+// on every request, and revoked tokens stop working within CacheTTL.
+type TokenIntrospector struct {
+	Client       *http.Client
+	Endpoint     string
+	ClientID     string
+	ClientSecret string
+	// The homeserver's server name, used to make user IDs from the introspected username.
+	ServerName string
+	CacheTTL   time.Duration
+
+	mu    *sync.Mutex
+	cache map[string]introspectionResult // keyed by token hash
+}
+
+type introspectionResult struct {
+	userID   string
+	deviceID string
+	active   bool
+	expires  time.Time
+}
+
+func NewTokenIntrospector(client *http.Client, endpoint, clientID, clientSecret, serverName string, cacheTTL time.Duration) *TokenIntrospector {
+	return &TokenIntrospector{
+		Client:       client,
+		Endpoint:     endpoint,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		ServerName:   serverName,
+		CacheTTL:     cacheTTL,
+		mu:           &sync.Mutex{},
+		cache:        make(map[string]introspectionResult),
+	}
+}
+
+// Introspect returns the user and device which the access token belongs to. Returns HTTP401 if the
+// token is not active.
+func (t *TokenIntrospector) Introspect(ctx context.Context, accessToken string) (userID, deviceID string, err error) {
+	tokenHash := HashToken(accessToken)
+	now := time.Now()
+	t.mu.Lock()
+	res, ok := t.cache[tokenHash]
+	t.mu.Unlock()
+	if !ok || now.After(res.expires) {
+		res, err = t.introspect(ctx, accessToken)
+		if err != nil {
+			return "", "", err
+		}
+		t.mu.Lock()
+		if len(t.cache) >= maxCachedIntrospections {
+			for hash, cached := range t.cache {
+				if now.After(cached.expires) {
+					delete(t.cache, hash)
+				}
+			}
+			if len(t.cache) >= maxCachedIntrospections {
+				t.cache = make(map[string]introspectionResult)
+			}
+		}
+		t.cache[tokenHash] = res
+		t.mu.Unlock()
+	}
+	if !res.active {
+		return "", "", HTTP401
+	}
+	return res.userID, res.deviceID, nil
+}
+
+func (t *TokenIntrospector) introspect(ctx context.Context, accessToken string) (introspectionResult, error) {
+	form := url.Values{}
+	form.Set("token", accessToken)
+	form.Set("token_type_hint", "access_token")
+	req, err := http.NewRequestWithContext(ctx, "POST", t.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return introspectionResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
+	if t.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(t.ClientID), url.QueryEscape(t.ClientSecret))
+	}
+	res, err := t.Client.Do(req)
+	if err != nil {
+		return introspectionResult{}, fmt.Errorf("token introspection request failed: %w", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return introspectionResult{}, fmt.Errorf("failed to read token introspection response: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return introspectionResult{}, fmt.Errorf("token introspection returned HTTP %d: %s", res.StatusCode, string(body))
+	}
+	return t.parseIntrospection(body, time.Now())
+}
+
+func (t *TokenIntrospector) parseIntrospection(body []byte, now time.Time) (introspectionResult, error) {
+	var parsed struct {
+		Active   bool   `json:"active"`
+		Scope    string `json:"scope"`
+		Username string `json:"username"`
+		Exp      int64  `json:"exp"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return introspectionResult{}, fmt.Errorf("failed to parse token introspection response: %w", err)
+	}
+	result := introspectionResult{
+		expires: now.Add(t.CacheTTL),
+	}
+	if parsed.Exp > 0 {
+		if exp := time.Unix(parsed.Exp, 0); exp.Before(result.expires) {
+			result.expires = exp
+		}
+	}
+	if !parsed.Active || parsed.Username == "" {
+		return result, nil
+	}
+	hasAPIScope := false
+	for _, scope := range strings.Fields(parsed.Scope) {
+		for _, apiScope := range introspectionAPIScopes {
+			if scope == apiScope {
+				hasAPIScope = true
+			}
+		}
+		for _, prefix := range introspectionDeviceScopes {
+			if strings.HasPrefix(scope, prefix) {
+				result.deviceID = strings.TrimPrefix(scope, prefix)
+			}
+		}
+	}
+	// tokens without API access or a device can't be used to sync
+	if !hasAPIScope || result.deviceID == "" {
+		return result, nil
+	}
+	result.active = true
+	result.userID = "@" + parsed.Username + ":" + t.ServerName
+	return result, nil
+}
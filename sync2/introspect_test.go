@@ -0,0 +1,85 @@
+package sync2
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenIntrospector(t *testing.T) {
+	numCalls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		numCalls++
+		clientID, clientSecret, _ := req.BasicAuth()
+		if clientID != "proxy" || clientSecret != "secret" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch req.FormValue("token") {
+		case "valid":
+			w.Write([]byte(`{"active":true,"username":"alice","scope":"openid urn:matrix:org.matrix.msc2967.client:api:* urn:matrix:org.matrix.msc2967.client:device:ABCDEF"}`))
+		case "stable":
+			w.Write([]byte(`{"active":true,"username":"bob","scope":"urn:matrix:client:api:* urn:matrix:client:device:GHIJKL"}`))
+		case "no_device":
+			w.Write([]byte(`{"active":true,"username":"alice","scope":"urn:matrix:org.matrix.msc2967.client:api:*"}`))
+		case "no_api":
+			w.Write([]byte(`{"active":true,"username":"alice","scope":"urn:matrix:org.matrix.msc2967.client:device:ABCDEF"}`))
+		case "expiring":
+			w.Write([]byte(fmt.Sprintf(`{"active":true,"username":"alice","exp":%d,"scope":"urn:matrix:org.matrix.msc2967.client:api:* urn:matrix:org.matrix.msc2967.client:device:ABCDEF"}`, time.Now().Unix()-1)))
+		default:
+			w.Write([]byte(`{"active":false}`))
+		}
+	}))
+	defer srv.Close()
+	introspector := NewTokenIntrospector(srv.Client(), srv.URL, "proxy", "secret", "example.com", time.Minute)
+	ctx := context.Background()
+
+	testCases := []struct {
+		token      string
+		wantUserID string
+		wantDevice string
+		wantErr    error
+	}{
+		{token: "valid", wantUserID: "@alice:example.com", wantDevice: "ABCDEF"},
+		{token: "stable", wantUserID: "@bob:example.com", wantDevice: "GHIJKL"},
+		{token: "no_device", wantErr: HTTP401},
+		{token: "no_api", wantErr: HTTP401},
+		{token: "revoked", wantErr: HTTP401},
+	}
+	for _, tc := range testCases {
+		userID, deviceID, err := introspector.Introspect(ctx, tc.token)
+		if err != tc.wantErr {
+			t.Errorf("%s: got error %v want %v", tc.token, err, tc.wantErr)
+		}
+		if userID != tc.wantUserID || deviceID != tc.wantDevice {
+			t.Errorf("%s: got %s/%s want %s/%s", tc.token, userID, deviceID, tc.wantUserID, tc.wantDevice)
+		}
+	}
+
+	// results are cached, including for inactive tokens
+	numCallsBefore := numCalls
+	for _, tc := range testCases {
+		introspector.Introspect(ctx, tc.token)
+	}
+	if numCalls != numCallsBefore {
+		t.Errorf("introspection results were not cached: made %d more calls", numCalls-numCallsBefore)
+	}
+
+	// results are not cached beyond the token's expiry
+	introspector.Introspect(ctx, "expiring")
+	numCallsBefore = numCalls
+	introspector.Introspect(ctx, "expiring")
+	if numCalls != numCallsBefore+1 {
+		t.Errorf("expired token was served from the cache")
+	}
+
+	// errors from the introspection endpoint are not treated as inactive tokens
+	badIntrospector := NewTokenIntrospector(srv.Client(), srv.URL, "proxy", "wrong", "example.com", time.Minute)
+	if _, _, err := badIntrospector.Introspect(ctx, "valid"); err == nil || err == HTTP401 {
+		t.Errorf("got error %v want a non-401 error", err)
+	}
+}
@@ -58,15 +58,25 @@ type V2DataReceiver interface {
 	// Sent when there is a room in the `invite` section of the v2 response.
 	// Return an error to stop the since token advancing.
 	OnInvite(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error // invitestate in db
+	// Sent when there is a room in the `knock` section of the v2 response.
+	// Return an error to stop the since token advancing.
+	OnKnock(ctx context.Context, userID, roomID string, knockState []json.RawMessage) error
 	// Sent when there is a room in the `leave` section of the v2 response.
 	// Return an error to stop the since token advancing.
 	OnLeftRoom(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) error
-	// Sent when there is a _change_ in E2EE data, not all the time
-	OnE2EEData(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error
+	// Sent when there is a _change_ in E2EE data, not all the time. Called AFTER all other data in the sync
+	// response has been processed, with the since token to store atomically with the changes, instead of
+	// UpdateDeviceSince. If this returns an error, the changes are sent again with the next since token.
+	OnE2EEData(ctx context.Context, userID, deviceID, since string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error
 	// Sent when the poll loop terminates
 	OnTerminated(ctx context.Context, pollerID PollerID)
 	// Sent when the token gets a 401 response
 	OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string)
+	// Sent when the homeserver reports that the user has been deactivated, before OnExpiredToken
+	OnUserDeactivated(ctx context.Context, userID, deviceID string)
+	// Sent instead of OnExpiredToken when the token gets a 401 response but the device is still
+	// logged in (soft logout), so the client will carry on with a refreshed token.
+	OnSoftLogout(ctx context.Context, accessTokenHash, userID, deviceID string)
 }
 
 type IPollerMap interface {
@@ -77,6 +87,16 @@ type IPollerMap interface {
 	// ExpirePollers requests that the given pollers are terminated as if their access
 	// tokens had expired. Returns the number of pollers successfully terminated.
 	ExpirePollers(ids []PollerID) int
+	// TerminatePollers stops the given pollers without touching their access tokens, so
+	// they will be recreated on the next call to EnsurePolling. Returns the number of
+	// pollers successfully terminated.
+	TerminatePollers(ids []PollerID) int
+	// TerminatePollersWithToken stops any pollers which are using the access token with this
+	// hash. Returns the number of pollers successfully terminated.
+	TerminatePollersWithToken(accessTokenHash string) int
+	// UpdateAccessToken makes a running poller use a new access token for the same device, e.g
+	// after the client refreshed its token. Returns false if the device has no running poller.
+	UpdateAccessToken(pid PollerID, accessToken string) bool
 }
 
 // PollerMap is a map of device ID to Poller
@@ -239,13 +259,53 @@ func (h *PollerMap) ExpirePollers(pids []PollerID) int {
 		p.Terminate()
 		// Ensure that we won't recreate this poller on startup. If it reappears later,
 		// we'll make another EnsurePolling call which will recreate the poller.
-		h.callbacks.OnExpiredToken(context.Background(), hashToken(p.accessToken), p.userID, p.deviceID)
+		h.callbacks.OnExpiredToken(context.Background(), HashToken(p.AccessToken()), p.userID, p.deviceID)
 		numTerminated++
 	}
 
 	return numTerminated
 }
 
+func (h *PollerMap) TerminatePollers(pids []PollerID) int {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	numTerminated := 0
+	for _, pid := range pids {
+		p, ok := h.Pollers[pid]
+		if !ok || p.terminated.Load() {
+			continue
+		}
+		p.Terminate()
+		numTerminated++
+	}
+	return numTerminated
+}
+
+func (h *PollerMap) TerminatePollersWithToken(accessTokenHash string) int {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	numTerminated := 0
+	for _, p := range h.Pollers {
+		if p.terminated.Load() || !TokenHashMatches(p.AccessToken(), accessTokenHash) {
+			continue
+		}
+		p.Terminate()
+		numTerminated++
+	}
+	return numTerminated
+}
+
+func (h *PollerMap) UpdateAccessToken(pid PollerID, accessToken string) bool {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	p, ok := h.Pollers[pid]
+	if !ok || p.terminated.Load() {
+		return false
+	}
+	p.accessToken.Store(&accessToken)
+	return true
+}
+
 // EnsurePolling makes sure there is a poller for this device, making one if need be.
 // Blocks until at least 1 sync is done if and only if the poller was just created.
 // This ensures that calls to the database will return data.
@@ -262,7 +322,7 @@ func (h *PollerMap) EnsurePolling(pid PollerID, accessToken, v2since string, isS
 	poller, ok := h.Pollers[pid]
 	// a poller exists and hasn't been terminated so we don't need to do anything
 	if ok && !poller.terminated.Load() {
-		if poller.accessToken != accessToken {
+		if poller.AccessToken() != accessToken {
 			logger.Warn().Msg("PollerMap.EnsurePolling: poller already running with different access token")
 		}
 		h.pollerMu.Unlock()
@@ -358,6 +418,17 @@ func (h *PollerMap) OnInvite(ctx context.Context, userID, roomID string, inviteS
 	return
 }
 
+func (h *PollerMap) OnKnock(ctx context.Context, userID, roomID string, knockState []json.RawMessage) (err error) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.executor <- func() {
+		err = h.callbacks.OnKnock(ctx, userID, roomID, knockState)
+		wg.Done()
+	}
+	wg.Wait()
+	return
+}
+
 func (h *PollerMap) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) (err error) {
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -383,6 +454,14 @@ func (h *PollerMap) OnExpiredToken(ctx context.Context, accessTokenHash, userID,
 	h.callbacks.OnExpiredToken(ctx, accessTokenHash, userID, deviceID)
 }
 
+func (h *PollerMap) OnUserDeactivated(ctx context.Context, userID, deviceID string) {
+	h.callbacks.OnUserDeactivated(ctx, userID, deviceID)
+}
+
+func (h *PollerMap) OnSoftLogout(ctx context.Context, accessTokenHash, userID, deviceID string) {
+	h.callbacks.OnSoftLogout(ctx, accessTokenHash, userID, deviceID)
+}
+
 func (h *PollerMap) UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int) {
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -414,19 +493,20 @@ func (h *PollerMap) OnReceipt(ctx context.Context, userID, roomID, ephEventType
 	wg.Wait()
 }
 
-func (h *PollerMap) OnE2EEData(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error {
+func (h *PollerMap) OnE2EEData(ctx context.Context, userID, deviceID, since string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error {
 	// This is device-scoped data and will never race with another poller. Therefore we
 	// do not need to queue this up in the executor. However: the poller does need to
-	// wait for this to complete before advancing the since token, or else we risk
+	// wait for this to complete before storing the since token elsewhere, or else we risk
 	// losing device list changes.
-	return h.callbacks.OnE2EEData(ctx, userID, deviceID, otkCounts, fallbackKeyTypes, deviceListChanges)
+	return h.callbacks.OnE2EEData(ctx, userID, deviceID, since, otkCounts, fallbackKeyTypes, deviceListChanges)
 }
 
 // Poller can automatically poll the sync v2 endpoint and accumulate the responses in storage
 type poller struct {
-	userID      string
-	deviceID    string
-	accessToken string
+	userID   string
+	deviceID string
+	// swapped when the client refreshes its access token, see PollerMap.UpdateAccessToken
+	accessToken *atomic.Pointer[string]
 	client      Client
 	receiver    V2DataReceiver
 	logger      zerolog.Logger
@@ -436,6 +516,8 @@ type poller struct {
 	// E2EE fields: we keep them so we only send callbacks on deltas not all the time
 	fallbackKeyTypes []string
 	otkCounts        map[string]int
+	// E2EE changes which have not yet been stored, along with a since token which includes them.
+	pendingE2EE *e2eeChanges
 
 	// flag set to true when poll() returns due to expired access tokens
 	terminated *atomic.Bool
@@ -464,10 +546,12 @@ type poller struct {
 func newPoller(pid PollerID, accessToken string, client Client, receiver V2DataReceiver, logger zerolog.Logger, initialToDeviceOnly bool) *poller {
 	var wg sync.WaitGroup
 	wg.Add(1)
+	token := &atomic.Pointer[string]{}
+	token.Store(&accessToken)
 	return &poller{
 		userID:              pid.UserID,
 		deviceID:            pid.DeviceID,
-		accessToken:         accessToken,
+		accessToken:         token,
 		client:              client,
 		receiver:            receiver,
 		terminated:          &atomic.Bool{},
@@ -477,6 +561,11 @@ func newPoller(pid PollerID, accessToken string, client Client, receiver V2DataR
 	}
 }
 
+// AccessToken returns the access token this poller is currently using.
+func (p *poller) AccessToken() string {
+	return *p.accessToken.Load()
+}
+
 // Blocks until the initial sync has been done on this poller.
 func (p *poller) WaitUntilInitialSync() {
 	p.wg.Wait()
@@ -486,6 +575,29 @@ func (p *poller) Terminate() {
 	p.terminated.CompareAndSwap(false, true)
 }
 
+// e2eeChanges are changes to a device's E2EE data, in the form expected by V2DataReceiver.OnE2EEData.
+type e2eeChanges struct {
+	otkCounts         map[string]int // nil == don't set
+	fallbackKeyTypes  []string       // nil slice == don't set, empty slice = no fallback key
+	deviceListChanges map[string]int
+}
+
+// merge applies later changes on top of these ones.
+func (c *e2eeChanges) merge(otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) {
+	if otkCounts != nil {
+		c.otkCounts = otkCounts
+	}
+	if fallbackKeyTypes != nil {
+		c.fallbackKeyTypes = fallbackKeyTypes
+	}
+	if deviceListChanges != nil && c.deviceListChanges == nil {
+		c.deviceListChanges = make(map[string]int, len(deviceListChanges))
+	}
+	for userID, change := range deviceListChanges {
+		c.deviceListChanges[userID] = change
+	}
+}
+
 type pollLoopState struct {
 	firstTime       bool
 	failCount       int
@@ -555,7 +667,7 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 			// 3s * 1000 = 3000s = 50 minutes
 			errMsg := "poller: access token has failed >1000 times to /sync, terminating loop"
 			p.logger.Warn().Msg(errMsg)
-			p.receiver.OnExpiredToken(ctx, hashToken(p.accessToken), p.userID, p.deviceID)
+			p.receiver.OnExpiredToken(ctx, HashToken(p.AccessToken()), p.userID, p.deviceID)
 			p.Terminate()
 			return fmt.Errorf(errMsg)
 		}
@@ -574,7 +686,15 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 	if p.numOutstandingSyncReqs != nil {
 		p.numOutstandingSyncReqs.Inc()
 	}
-	resp, statusCode, err := p.client.DoSyncV2(spanCtx, p.accessToken, s.since, s.firstTime, p.initialToDeviceOnly)
+	accessToken := p.AccessToken()
+	var resp *SyncResponse
+	var statusCode int
+	var err error
+	if internal.InjectPollFailure(p.userID) {
+		err = fmt.Errorf("DoSyncV2: %w", internal.ErrInjectedFault)
+	} else {
+		resp, statusCode, err = p.client.DoSyncV2(spanCtx, accessToken, s.since, s.firstTime, p.initialToDeviceOnly)
+	}
 	if p.numOutstandingSyncReqs != nil {
 		p.numOutstandingSyncReqs.Dec()
 	}
@@ -586,6 +706,11 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 	if err != nil {
 		// check if temporary
 		isFatal := statusCode == 401 || statusCode == 403
+		if isFatal && accessToken != p.AccessToken() {
+			// the client refreshed its access token while this request was in flight: retry with the new one
+			p.logger.Info().Int("code", statusCode).Msg("Poller: access token was refreshed, retrying")
+			return nil
+		}
 		if !isFatal {
 			p.logger.Warn().Int("code", statusCode).Err(err).Msg("Poller: sync v2 poll returned temporary error")
 			s.failCount += 1
@@ -593,7 +718,19 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 		} else {
 			errMsg := "poller: access token has been invalidated, terminating loop"
 			p.logger.Warn().Msg(errMsg)
-			p.receiver.OnExpiredToken(ctx, hashToken(p.accessToken), p.userID, p.deviceID)
+			if errors.Is(err, ErrUserDeactivated) {
+				p.receiver.OnUserDeactivated(ctx, p.userID, p.deviceID)
+			}
+			if errors.Is(err, ErrSoftLogout) {
+				p.receiver.OnSoftLogout(ctx, HashToken(accessToken), p.userID, p.deviceID)
+			} else {
+				p.receiver.OnExpiredToken(ctx, HashToken(accessToken), p.userID, p.deviceID)
+			}
+			if p.AccessToken() != accessToken {
+				// the device has another valid token, which the receiver switched us to
+				p.logger.Info().Msg("Poller: continuing with another access token for this device")
+				return nil
+			}
 			p.Terminate()
 			return fmt.Errorf(errMsg)
 		}
@@ -605,15 +742,12 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 	start = time.Now()
 	s.failCount = 0
 
+	// E2EE changes are stored with the since token once everything else has been processed.
+	p.parseE2EEData(ctx, resp)
+
 	// If any of these sections return an error, we will NOT increment the since token and so
 	// retry processing the same response after a brief period
-	retryErr := p.parseE2EEData(ctx, resp)
-	if shouldRetry(retryErr) {
-		p.logger.Err(retryErr).Msg("Poller: parseE2EEData returned an error")
-		s.failCount += 1
-		return nil
-	}
-	retryErr = p.parseGlobalAccountData(ctx, resp)
+	retryErr := p.parseGlobalAccountData(ctx, resp)
 	if shouldRetry(retryErr) {
 		p.logger.Err(retryErr).Msg("Poller: parseGlobalAccountData returned an error")
 		s.failCount += 1
@@ -642,9 +776,24 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 	wasFirst := s.firstTime
 
 	s.since = resp.NextBatch
-	// Persist the since token if it either was more than one minute ago since we
-	// last stored it OR the response contains to-device messages
-	if timeSince(s.lastStoredSince) > time.Minute || len(resp.ToDevice.Events) > 0 {
+	if p.pendingE2EE != nil {
+		// Store E2EE changes in the same transaction as the since token, so that we never resume
+		// from a since token beyond changes we failed to store, nor store changes without the token.
+		// If this fails we do not retry the response, as to-device messages have already been stored;
+		// instead, the changes are sent again with the next response's since token.
+		err := p.receiver.OnE2EEData(
+			ctx, p.userID, p.deviceID, s.since,
+			p.pendingE2EE.otkCounts, p.pendingE2EE.fallbackKeyTypes, p.pendingE2EE.deviceListChanges,
+		)
+		if err != nil {
+			p.logger.Err(err).Str("since", s.since).Msg("Poller: failed to store E2EE data, will retry with the next response")
+		} else {
+			p.pendingE2EE = nil
+			s.lastStoredSince = time.Now()
+		}
+	} else if timeSince(s.lastStoredSince) > time.Minute || len(resp.ToDevice.Events) > 0 {
+		// Persist the since token if it either was more than one minute ago since we
+		// last stored it OR the response contains to-device messages
 		p.receiver.UpdateDeviceSince(ctx, p.userID, p.deviceID, s.since)
 		s.lastStoredSince = time.Now()
 	}
@@ -706,8 +855,9 @@ func (p *poller) parseToDeviceMessages(ctx context.Context, res *SyncResponse) e
 	return p.receiver.AddToDeviceMessages(ctx, p.userID, p.deviceID, res.ToDevice.Events)
 }
 
-func (p *poller) parseE2EEData(ctx context.Context, res *SyncResponse) error {
-	ctx, task := internal.StartTask(ctx, "parseE2EEData")
+// parseE2EEData remembers any changes to E2EE data in this response, to be stored with the since token.
+func (p *poller) parseE2EEData(ctx context.Context, res *SyncResponse) {
+	_, task := internal.StartTask(ctx, "parseE2EEData")
 	defer task.End()
 	var changedOTKCounts map[string]int
 	shouldSetOTKs := false
@@ -755,20 +905,18 @@ func (p *poller) parseE2EEData(ctx context.Context, res *SyncResponse) error {
 	if deviceListChanges != nil || changedFallbackTypes != nil || changedOTKCounts != nil {
 		p.totalChangedDeviceLists += len(res.DeviceLists.Changed)
 		p.totalLeftDeviceLists += len(res.DeviceLists.Left)
-		err := p.receiver.OnE2EEData(ctx, p.userID, p.deviceID, changedOTKCounts, changedFallbackTypes, deviceListChanges)
-		if err != nil {
-			return err
+		if p.pendingE2EE == nil {
+			p.pendingE2EE = &e2eeChanges{}
 		}
+		p.pendingE2EE.merge(changedOTKCounts, changedFallbackTypes, deviceListChanges)
 	}
-	// we should only update our internal state if OnE2EEData returns no error. Otherwise, we would fail to re-process the
-	// retried response as there would be no diff between internal state and the response received.
+	// the changes are pending until stored, so a retried response needs no diff against them.
 	if shouldSetOTKs {
 		p.otkCounts = res.DeviceListsOTKCount
 	}
 	if shouldSetFallbackKeys {
 		p.fallbackKeyTypes = res.DeviceUnusedFallbackKeyTypes
 	}
-	return nil
 }
 
 func (p *poller) parseGlobalAccountData(ctx context.Context, res *SyncResponse) error {
@@ -810,8 +958,8 @@ func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) erro
 					// so check if that is the case here. See https://github.com/matrix-org/complement/pull/690
 					var createEvent json.RawMessage
 					for i, ev := range roomData.Timeline.Events {
-						evv := gjson.ParseBytes(ev)
-						if evv.Get("type").Str == "m.room.create" && evv.Get("state_key").Exists() && evv.Get("state_key").Str == "" {
+						evv := internal.ParseEvent(ev)
+						if evv.Type == "m.room.create" && evv.StateKey != nil && *evv.StateKey == "" {
 							createEvent = roomData.Timeline.Events[i]
 							// remove the create event from the timeline so we don't double process it
 							roomData.Timeline.Events = append(roomData.Timeline.Events[:i], roomData.Timeline.Events[i+1:]...)
@@ -899,8 +1047,8 @@ func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) erro
 		// the case where a user rejects an invite (there will be no room state, but the user still expects to see the leave event).
 		var leaveEvent json.RawMessage
 		for _, ev := range roomData.Timeline.Events {
-			leaveEv := gjson.ParseBytes(ev)
-			if leaveEv.Get("content.membership").Str == "leave" && leaveEv.Get("state_key").Str == p.userID {
+			leaveEv := internal.ParseEvent(ev)
+			if leaveEv.Membership() == "leave" && leaveEv.StateKey != nil && *leaveEv.StateKey == p.userID {
 				leaveEvent = ev
 				break
 			}
@@ -919,6 +1067,12 @@ func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) erro
 			lastErrs = append(lastErrs, fmt.Errorf("OnInvite[%s]: %w", roomID, err))
 		}
 	}
+	for roomID, roomData := range res.Rooms.Knock {
+		err := p.receiver.OnKnock(ctx, p.userID, roomID, roomData.KnockState.Events)
+		if err != nil {
+			lastErrs = append(lastErrs, fmt.Errorf("OnKnock[%s]: %w", roomID, err))
+		}
+	}
 
 	p.totalReceipts += receiptCalls
 	p.totalStateCalls += stateCalls
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"reflect"
 	"strconv"
 	"sync"
 	"testing"
@@ -77,11 +78,7 @@ func TestPollerMapEnsurePolling(t *testing.T) {
 	}
 	initialResponse := &SyncResponse{
 		NextBatch: nextSince,
-		Rooms: struct {
-			Join   map[string]SyncV2JoinResponse   `json:"join"`
-			Invite map[string]SyncV2InviteResponse `json:"invite"`
-			Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-		}{
+		Rooms: SyncRoomsResponse{
 			Join: map[string]SyncV2JoinResponse{
 				roomID: {
 					State: EventsResponse{
@@ -160,11 +157,7 @@ func TestPollerMapEnsurePollingIdempotent(t *testing.T) {
 	}
 	initialResponse := &SyncResponse{
 		NextBatch: nextSince,
-		Rooms: struct {
-			Join   map[string]SyncV2JoinResponse   `json:"join"`
-			Invite map[string]SyncV2InviteResponse `json:"invite"`
-			Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-		}{
+		Rooms: SyncRoomsResponse{
 			Join: map[string]SyncV2JoinResponse{
 				roomID: {
 					State: EventsResponse{
@@ -355,11 +348,7 @@ func TestPollerPollFromNothing(t *testing.T) {
 			joinResp.State.Events = roomState
 			return &SyncResponse{
 				NextBatch: nextSince,
-				Rooms: struct {
-					Join   map[string]SyncV2JoinResponse   `json:"join"`
-					Invite map[string]SyncV2InviteResponse `json:"invite"`
-					Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-				}{
+				Rooms: SyncRoomsResponse{
 					Join: map[string]SyncV2JoinResponse{
 						roomID: joinResp,
 					},
@@ -395,6 +384,138 @@ func TestPollerPollFromNothing(t *testing.T) {
 	}
 }
 
+// Check that a 401 due to deactivation is reported before the token is expired.
+func TestPollerReportsDeactivatedUsers(t *testing.T) {
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		return nil, 401, fmt.Errorf("terminated: %w", ErrUserDeactivated)
+	})
+	var calls []string
+	accumulator.onUserDeactivated = func(ctx context.Context, userID, deviceID string) {
+		calls = append(calls, "deactivated:"+userID+"|"+deviceID)
+	}
+	accumulator.onExpiredToken = func(ctx context.Context, accessTokenHash, userID, deviceID string) {
+		calls = append(calls, "expired:"+userID+"|"+deviceID)
+	}
+	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	poller.Poll("")
+	want := []string{"deactivated:@alice:localhost|FOOBAR", "expired:@alice:localhost|FOOBAR"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("got callbacks %v want %v", calls, want)
+	}
+}
+
+// Check that pollers switch to a refreshed access token, even if a request with the old token is
+// in flight, rather than treating the old token expiring as the device logging out.
+func TestPollerMapUpdateAccessToken(t *testing.T) {
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+	swapped := make(chan struct{})
+	sawNewToken := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	var once sync.Once
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		switch authHeader {
+		case "old_token":
+			if since == "" {
+				return &SyncResponse{NextBatch: "1"}, 200, nil
+			}
+			// the token is refreshed while this request is in flight, then the old token expires
+			<-swapped
+			return nil, 401, fmt.Errorf("old token expired")
+		case "new_token":
+			once.Do(func() { close(sawNewToken) })
+			<-done
+			return nil, 0, fmt.Errorf("test finished")
+		}
+		return nil, 401, fmt.Errorf("unknown token %s", authHeader)
+	})
+	accumulator.onExpiredToken = func(ctx context.Context, accessTokenHash, userID, deviceID string) {
+		t.Errorf("OnExpiredToken called for %s|%s", userID, deviceID)
+	}
+	pm := NewPollerMap(client, false)
+	pm.SetCallbacks(accumulator)
+	defer pm.Terminate()
+	if _, err := pm.EnsurePolling(pid, "old_token", "", false, zerolog.New(os.Stderr)); err != nil {
+		t.Fatalf("EnsurePolling: %s", err)
+	}
+	if !pm.UpdateAccessToken(pid, "new_token") {
+		t.Fatalf("UpdateAccessToken returned false for a running poller")
+	}
+	close(swapped)
+	select {
+	case <-sawNewToken:
+	case <-time.After(time.Second):
+		t.Fatalf("poller did not use the new access token")
+	}
+	if pm.UpdateAccessToken(PollerID{UserID: "@bob:localhost", DeviceID: "FOOBAR"}, "new_token") {
+		t.Errorf("UpdateAccessToken returned true for a device without a poller")
+	}
+}
+
+// Check that pollers carry on with another token for the device if the receiver switches them to
+// one when their token expires, rather than terminating.
+func TestPollerContinuesWithAnotherToken(t *testing.T) {
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+	sawOtherToken := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	var once sync.Once
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		switch authHeader {
+		case "token_a":
+			if since == "" {
+				return &SyncResponse{NextBatch: "1"}, 200, nil
+			}
+			return nil, 401, fmt.Errorf("token_a expired")
+		case "token_b":
+			once.Do(func() { close(sawOtherToken) })
+			<-done
+			return nil, 0, fmt.Errorf("test finished")
+		}
+		return nil, 401, fmt.Errorf("unknown token %s", authHeader)
+	})
+	pm := NewPollerMap(client, false)
+	accumulator.onExpiredToken = func(ctx context.Context, accessTokenHash, userID, deviceID string) {
+		if !pm.UpdateAccessToken(pid, "token_b") {
+			t.Errorf("UpdateAccessToken returned false for the expiring poller")
+		}
+	}
+	pm.SetCallbacks(accumulator)
+	defer pm.Terminate()
+	if _, err := pm.EnsurePolling(pid, "token_a", "", false, zerolog.New(os.Stderr)); err != nil {
+		t.Fatalf("EnsurePolling: %s", err)
+	}
+	select {
+	case <-sawOtherToken:
+	case <-time.After(time.Second):
+		t.Fatalf("poller did not use the other access token")
+	}
+	if pm.NumPollers() != 1 {
+		t.Errorf("got %d pollers, want 1", pm.NumPollers())
+	}
+}
+
+func TestPollerReportsSoftLogout(t *testing.T) {
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		return nil, 401, fmt.Errorf("token expired: %w", ErrSoftLogout)
+	})
+	var calls []string
+	accumulator.onSoftLogout = func(ctx context.Context, accessTokenHash, userID, deviceID string) {
+		calls = append(calls, "soft_logout:"+userID+"|"+deviceID)
+	}
+	accumulator.onExpiredToken = func(ctx context.Context, accessTokenHash, userID, deviceID string) {
+		calls = append(calls, "expired:"+userID+"|"+deviceID)
+	}
+	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	poller.Poll("")
+	want := []string{"soft_logout:@alice:localhost|FOOBAR"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("got callbacks %v want %v", calls, want)
+	}
+}
+
 // Check that a call to Poll starts polling with an existing since token and accumulates timeline entries
 func TestPollerPollFromExisting(t *testing.T) {
 	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
@@ -446,11 +567,7 @@ func TestPollerPollFromExisting(t *testing.T) {
 			// ToDevice messages in the response)
 			ToDevice:  EventsResponse{Events: toDeviceResponses[sinceInt]},
 			NextBatch: fmt.Sprintf("%d", sinceInt+1),
-			Rooms: struct {
-				Join   map[string]SyncV2JoinResponse   `json:"join"`
-				Invite map[string]SyncV2InviteResponse `json:"invite"`
-				Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-			}{
+			Rooms: SyncRoomsResponse{
 				Join: map[string]SyncV2JoinResponse{
 					roomID: joinResp,
 				},
@@ -775,59 +892,6 @@ func TestPollerResendsOnCallbackError(t *testing.T) {
 				}
 			},
 		},
-		{
-			name: "OnE2EEData,OTKCount",
-			// generate a response which will trigger the right callback
-			syncResponse: &SyncResponse{
-				DeviceListsOTKCount: map[string]int{
-					"foo": 5,
-				},
-			},
-			// generate a receiver which errors for the right callback
-			generateReceiver: func() V2DataReceiver {
-				return &overrideDataReceiver{
-					onE2EEData: func(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error {
-						return fmt.Errorf("onE2EEData error")
-					},
-				}
-			},
-		},
-		{
-			name: "OnE2EEData,FallbackKeys",
-			// generate a response which will trigger the right callback
-			syncResponse: &SyncResponse{
-				DeviceUnusedFallbackKeyTypes: []string{"foo", "bar"},
-			},
-			// generate a receiver which errors for the right callback
-			generateReceiver: func() V2DataReceiver {
-				return &overrideDataReceiver{
-					onE2EEData: func(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error {
-						return fmt.Errorf("onE2EEData error")
-					},
-				}
-			},
-		},
-		{
-			name: "OnE2EEData,DeviceListChanges",
-			// generate a response which will trigger the right callback
-			syncResponse: &SyncResponse{
-				DeviceLists: struct {
-					Changed []string `json:"changed,omitempty"`
-					Left    []string `json:"left,omitempty"`
-				}{
-					Changed: []string{"alice"},
-					Left:    []string{"bob"},
-				},
-			},
-			// generate a receiver which errors for the right callback
-			generateReceiver: func() V2DataReceiver {
-				return &overrideDataReceiver{
-					onE2EEData: func(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error {
-						return fmt.Errorf("onE2EEData error")
-					},
-				}
-			},
-		},
 		{
 			name: "Initialise",
 			// generate a response which will trigger the right callback
@@ -947,6 +1011,31 @@ func TestPollerResendsOnCallbackError(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "OnKnock",
+			// generate a response which will trigger the right callback
+			syncResponse: &SyncResponse{
+				Rooms: SyncRoomsResponse{
+					Knock: map[string]SyncV2KnockResponse{
+						"!foo:bar": {
+							KnockState: EventsResponse{
+								Events: []json.RawMessage{
+									[]byte(`{"type":"foo_room","content":{"bar":53}}`),
+								},
+							},
+						},
+					},
+				},
+			},
+			// generate a receiver which errors for the right callback
+			generateReceiver: func() V2DataReceiver {
+				return &overrideDataReceiver{
+					onKnock: func(ctx context.Context, userID, roomID string, knockState []json.RawMessage) error {
+						return fmt.Errorf("onKnock error")
+					},
+				}
+			},
+		},
 		{
 			name: "OnLeftRoom",
 			// generate a response which will trigger the right callback
@@ -1022,6 +1111,112 @@ func TestPollerResendsOnCallbackError(t *testing.T) {
 	}
 }
 
+// Test that E2EE data is stored with the since token of the response it came from, and that if
+// storing it fails, the changes are stored with a later since token rather than being lost.
+func TestPollerStoresE2EEDataWithSinceToken(t *testing.T) {
+	pid := PollerID{UserID: "@TestPollerStoresE2EEDataWithSinceToken:localhost", DeviceID: "FOOBAR"}
+	type e2eeCall struct {
+		since             string
+		otkCounts         map[string]int
+		fallbackKeyTypes  []string
+		deviceListChanges map[string]int
+	}
+	var mu sync.Mutex
+	var calls []e2eeCall
+	var sinceUpdates []string
+	receiver := &overrideDataReceiver{
+		onE2EEData: func(ctx context.Context, userID, deviceID, since string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error {
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, e2eeCall{since, otkCounts, fallbackKeyTypes, deviceListChanges})
+			if since == "2" {
+				return fmt.Errorf("onE2EEData error")
+			}
+			return nil
+		},
+		updateDeviceSince: func(ctx context.Context, userID, deviceID, since string) {
+			mu.Lock()
+			defer mu.Unlock()
+			sinceUpdates = append(sinceUpdates, since)
+		},
+	}
+	responses := map[string]*SyncResponse{
+		initialSinceToken: {NextBatch: "1"},
+		"1": { // stored with since "2", which fails
+			NextBatch:           "2",
+			DeviceListsOTKCount: map[string]int{"signed_curve25519": 5},
+			DeviceLists: struct {
+				Changed []string `json:"changed,omitempty"`
+				Left    []string `json:"left,omitempty"`
+			}{Changed: []string{"@alice:localhost"}, Left: []string{"@bob:localhost"}},
+		},
+		"2": { // no E2EE changes, but the pending changes must be stored with since "3"
+			NextBatch: "3",
+			ToDevice:  EventsResponse{Events: []json.RawMessage{[]byte(`{"type":"device","content":{}}`)}},
+		},
+		"3": { // stored with since "4"
+			NextBatch:                    "4",
+			DeviceListsOTKCount:          map[string]int{"signed_curve25519": 5},
+			DeviceUnusedFallbackKeyTypes: []string{"signed_curve25519"},
+			DeviceLists: struct {
+				Changed []string `json:"changed,omitempty"`
+				Left    []string `json:"left,omitempty"`
+			}{Changed: []string{"@bob:localhost"}},
+		},
+	}
+	done := make(chan struct{})
+	var stopOnce sync.Once
+	client := &mockClient{
+		fn: func(authHeader, since string) (*SyncResponse, int, error) {
+			if since == "4" {
+				stopOnce.Do(func() { close(done) })
+				return nil, 0, fmt.Errorf("stop polling")
+			}
+			res, ok := responses[since]
+			if !ok {
+				t.Errorf("bad since token: %v", since)
+				return nil, 0, fmt.Errorf("bad since token: %v", since)
+			}
+			return res, 200, nil
+		},
+	}
+	poller := newPoller(pid, "Authorization: hello world", client, receiver, zerolog.New(os.Stderr), false)
+	defer poller.Terminate()
+	go poller.Poll(initialSinceToken)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for poller")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	wantCalls := []e2eeCall{
+		{
+			since:             "2",
+			otkCounts:         map[string]int{"signed_curve25519": 5},
+			deviceListChanges: map[string]int{"@alice:localhost": internal.DeviceListChanged, "@bob:localhost": internal.DeviceListLeft},
+		},
+		{
+			since:             "3",
+			otkCounts:         map[string]int{"signed_curve25519": 5},
+			deviceListChanges: map[string]int{"@alice:localhost": internal.DeviceListChanged, "@bob:localhost": internal.DeviceListLeft},
+		},
+		{
+			since:             "4",
+			fallbackKeyTypes:  []string{"signed_curve25519"},
+			deviceListChanges: map[string]int{"@bob:localhost": internal.DeviceListChanged},
+		},
+	}
+	if !reflect.DeepEqual(calls, wantCalls) {
+		t.Errorf("OnE2EEData calls:\ngot  %+v\nwant %+v", calls, wantCalls)
+	}
+	// the since token is only stored separately for the initial sync, as the rest were stored with E2EE data.
+	if !reflect.DeepEqual(sinceUpdates, []string{"1"}) {
+		t.Errorf("UpdateDeviceSince calls: got %v want [1]", sinceUpdates)
+	}
+}
+
 // The purpose of this test is to make sure *internal.DataError errors do NOT cause the since token
 // to be retried.
 func TestPollerDoesNotResendOnDataError(t *testing.T) {
@@ -1321,10 +1516,13 @@ type overrideDataReceiver struct {
 	onAccountData       func(ctx context.Context, userID, roomID string, events []json.RawMessage) error
 	onReceipt           func(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage)
 	onInvite            func(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error
+	onKnock             func(ctx context.Context, userID, roomID string, knockState []json.RawMessage) error
 	onLeftRoom          func(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) error
-	onE2EEData          func(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error
+	onE2EEData          func(ctx context.Context, userID, deviceID, since string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error
 	onTerminated        func(ctx context.Context, pollerID PollerID)
 	onExpiredToken      func(ctx context.Context, accessTokenHash, userID, deviceID string)
+	onUserDeactivated   func(ctx context.Context, userID, deviceID string)
+	onSoftLogout        func(ctx context.Context, accessTokenHash, userID, deviceID string)
 }
 
 func (s *overrideDataReceiver) Accumulate(ctx context.Context, userID, deviceID, roomID string, timeline TimelineResponse) error {
@@ -1381,17 +1579,23 @@ func (s *overrideDataReceiver) OnInvite(ctx context.Context, userID, roomID stri
 	}
 	return s.onInvite(ctx, userID, roomID, inviteState)
 }
+func (s *overrideDataReceiver) OnKnock(ctx context.Context, userID, roomID string, knockState []json.RawMessage) error {
+	if s.onKnock == nil {
+		return nil
+	}
+	return s.onKnock(ctx, userID, roomID, knockState)
+}
 func (s *overrideDataReceiver) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) error {
 	if s.onLeftRoom == nil {
 		return nil
 	}
 	return s.onLeftRoom(ctx, userID, roomID, leaveEvent)
 }
-func (s *overrideDataReceiver) OnE2EEData(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error {
+func (s *overrideDataReceiver) OnE2EEData(ctx context.Context, userID, deviceID, since string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error {
 	if s.onE2EEData == nil {
 		return nil
 	}
-	return s.onE2EEData(ctx, userID, deviceID, otkCounts, fallbackKeyTypes, deviceListChanges)
+	return s.onE2EEData(ctx, userID, deviceID, since, otkCounts, fallbackKeyTypes, deviceListChanges)
 }
 func (s *overrideDataReceiver) OnTerminated(ctx context.Context, pollerID PollerID) {
 	if s.onTerminated == nil {
@@ -1405,6 +1609,18 @@ func (s *overrideDataReceiver) OnExpiredToken(ctx context.Context, accessTokenHa
 	}
 	s.onExpiredToken(ctx, accessTokenHash, userID, deviceID)
 }
+func (s *overrideDataReceiver) OnUserDeactivated(ctx context.Context, userID, deviceID string) {
+	if s.onUserDeactivated == nil {
+		return
+	}
+	s.onUserDeactivated(ctx, userID, deviceID)
+}
+func (s *overrideDataReceiver) OnSoftLogout(ctx context.Context, accessTokenHash, userID, deviceID string) {
+	if s.onSoftLogout == nil {
+		return
+	}
+	s.onSoftLogout(ctx, accessTokenHash, userID, deviceID)
+}
 
 func newMocks(doSyncV2 func(authHeader, since string) (*SyncResponse, int, error)) (*mockDataReceiver, *mockClient) {
 	client := &mockClient{
@@ -1,17 +1,13 @@
 package sync2
 
 import (
-	"os"
+	"github.com/matrix-org/sliding-sync/internal"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/jmoiron/sqlx"
-	"github.com/rs/zerolog"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger("poller")
 
 type Storage struct {
 	DevicesTable *DevicesTable
@@ -0,0 +1,153 @@
+package sync2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// tokenHashVersion prefixes all peppered token hashes. Unpeppered hashes have no prefix, for
+// compatibility with rows written before peppers were supported.
+const tokenHashVersion = "v1"
+
+// tokenPepper is a secret used to hash access tokens, along with the operator-chosen ID which
+// identifies it in the hashes. The zero value means tokens are hashed without a pepper.
+type tokenPepper struct {
+	id     string
+	secret string
+}
+
+var (
+	peppersMu sync.RWMutex
+	// the pepper used to hash new tokens.
+	currentPepper tokenPepper
+	// peppers which tokens may still be hashed with, most recent first.
+	previousPeppers []tokenPepper
+)
+
+// parseTokenPepper parses a pepper configured as ID:SECRET. The ID appears in token hashes so
+// operators can see which pepper each token uses: it must not be derived from the secret, as anyone
+// with a copy of the database could then check guesses of the secret against it.
+func parseTokenPepper(s string) (tokenPepper, error) {
+	id, secret, ok := strings.Cut(s, ":")
+	if !ok || id == "" || secret == "" {
+		return tokenPepper{}, fmt.Errorf("token pepper must be of the form ID:SECRET")
+	}
+	return tokenPepper{id: id, secret: secret}, nil
+}
+
+// SetTokenPeppers configures the secret peppers used when hashing access tokens. Peppered hashes
+// live in the database but the pepper does not, so a leaked database cannot be used to check
+// whether a given access token is known to the proxy. Each pepper is of the form ID:SECRET, where
+// ID is a label of the operator's choosing e.g '2024-06', which must be unique.
+//
+// New tokens are hashed with `current`. Tokens hashed with any of the `previous` peppers, or without
+// a pepper, are still accepted and are re-hashed with the current pepper when next used. An empty
+// `current` pepper disables peppering. Nothing is changed if any pepper is invalid.
+func SetTokenPeppers(current string, previous []string) error {
+	var cur tokenPepper
+	ids := make(map[string]bool, len(previous)+1)
+	if current != "" {
+		var err error
+		if cur, err = parseTokenPepper(current); err != nil {
+			return err
+		}
+		ids[cur.id] = true
+	}
+	prev := make([]tokenPepper, 0, len(previous))
+	for _, p := range previous {
+		pepper, err := parseTokenPepper(p)
+		if err != nil {
+			return fmt.Errorf("previous %s", err)
+		}
+		if ids[pepper.id] {
+			return fmt.Errorf("token pepper ID %q is used more than once", pepper.id)
+		}
+		ids[pepper.id] = true
+		prev = append(prev, pepper)
+	}
+	peppersMu.Lock()
+	defer peppersMu.Unlock()
+	currentPepper = cur
+	previousPeppers = prev
+	return nil
+}
+
+// HashToken returns the hash of the access token as stored in the tokens table, using the current pepper.
+func HashToken(accessToken string) string {
+	peppersMu.RLock()
+	pepper := currentPepper
+	peppersMu.RUnlock()
+	return hashTokenWithPepper(accessToken, pepper)
+}
+
+// TokenHashMatches returns true if tokenHash is the hash of accessToken under the current pepper,
+// any previous pepper or the unpeppered scheme.
+func TokenHashMatches(accessToken, tokenHash string) bool {
+	for _, candidate := range tokenHashCandidates(accessToken) {
+		if hmac.Equal([]byte(candidate), []byte(tokenHash)) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenHashCandidates returns every hash this access token may be stored under. The first element
+// is always the hash under the current pepper.
+func tokenHashCandidates(accessToken string) []string {
+	peppersMu.RLock()
+	peppers := make([]tokenPepper, 0, len(previousPeppers)+2)
+	peppers = append(peppers, currentPepper)
+	peppers = append(peppers, previousPeppers...)
+	peppersMu.RUnlock()
+	peppers = append(peppers, tokenPepper{}) // unpeppered
+
+	candidates := make([]string, 0, len(peppers))
+	seen := make(map[tokenPepper]bool, len(peppers))
+	for _, pepper := range peppers {
+		if seen[pepper] {
+			continue
+		}
+		seen[pepper] = true
+		candidates = append(candidates, hashTokenWithPepper(accessToken, pepper))
+	}
+	return candidates
+}
+
+func hashTokenWithPepper(accessToken string, pepper tokenPepper) string {
+	// important that this is a cryptographically secure hash function to prevent
+	// preimage attacks where Eve can use a fake token to hash to an existing device ID
+	// on the server.
+	if pepper.secret == "" {
+		hash := sha256.New()
+		hash.Write([]byte(accessToken))
+		return hex.EncodeToString(hash.Sum(nil))
+	}
+	mac := hmac.New(sha256.New, []byte(pepper.secret))
+	mac.Write([]byte(accessToken))
+	return tokenHashVersion + ":" + pepper.id + ":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// TokenHashPepperID returns the ID of the pepper the token hash was made with, or "" if the token
+// was hashed without a pepper.
+func TokenHashPepperID(tokenHash string) string {
+	parts := strings.SplitN(tokenHash, ":", 3)
+	if len(parts) != 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+// TokenPepperIDs returns the IDs of the configured peppers, as they appear in token hashes. The
+// current ID is "" if peppering is disabled.
+func TokenPepperIDs() (current string, previous []string) {
+	peppersMu.RLock()
+	defer peppersMu.RUnlock()
+	for _, pepper := range previousPeppers {
+		previous = append(previous, pepper.id)
+	}
+	return currentPepper.id, previous
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"io"
 	"strings"
 	"time"
@@ -15,7 +16,7 @@ import (
 
 type Token struct {
 	AccessToken          string
-	AccessTokenHash      string
+	AccessTokenHash      string    `db:"token_hash"`
 	AccessTokenEncrypted string    `db:"token_encrypted"`
 	UserID               string    `db:"user_id"`
 	DeviceID             string    `db:"device_id"`
@@ -37,7 +38,7 @@ type TokensTable struct {
 func NewTokensTable(db *sqlx.DB, secret string) *TokensTable {
 	db.MustExec(`
 	CREATE TABLE IF NOT EXISTS syncv3_sync2_tokens (
-		token_hash TEXT NOT NULL PRIMARY KEY, -- SHA256(access token)
+		token_hash TEXT NOT NULL PRIMARY KEY, -- SHA256(access token), or a peppered HMAC: see HashToken
 		token_encrypted TEXT NOT NULL,
 		-- TODO: FK constraints to devices table?
 		user_id TEXT NOT NULL,
@@ -102,20 +103,30 @@ func decrypt(nonceAndEncToken string, key []byte) (string, error) {
 	return string(token), nil
 }
 
-func hashToken(accessToken string) string {
-	// important that this is a cryptographically secure hash function to prevent
-	// preimage attacks where Eve can use a fake token to hash to an existing device ID
-	// on the server.
-	hash := sha256.New()
-	hash.Write([]byte(accessToken))
-	return hex.EncodeToString(hash.Sum(nil))
-}
-
 // Token retrieves a tokens row from the database if it exists.
 // Errors with sql.NoRowsError if the token does not exist.
 // Errors with an unspecified error otherwise.
+// If the token is stored under an old hash scheme, it is re-hashed with the current pepper.
 func (t *TokensTable) Token(plaintextToken string) (*Token, error) {
-	tokenHash := hashToken(plaintextToken)
+	candidates := tokenHashCandidates(plaintextToken)
+	var token Token
+	err := t.db.Get(
+		&token,
+		`SELECT token_hash, token_encrypted, user_id, device_id, last_seen FROM syncv3_sync2_tokens
+		WHERE token_hash = ANY($1) ORDER BY token_hash = $2 DESC LIMIT 1`,
+		pq.StringArray(candidates), candidates[0],
+	)
+	if err != nil {
+		return nil, err
+	}
+	token.AccessToken = plaintextToken
+	t.maybeRehash(&token)
+	return &token, nil
+}
+
+// TokenByHash retrieves a tokens row from the database by the hash of the access token.
+// The plaintext AccessToken is not populated. Errors with sql.ErrNoRows if the token does not exist.
+func (t *TokensTable) TokenByHash(tokenHash string) (*Token, error) {
 	var token Token
 	err := t.db.Get(
 		&token,
@@ -125,7 +136,6 @@ func (t *TokensTable) Token(plaintextToken string) (*Token, error) {
 	if err != nil {
 		return nil, err
 	}
-	token.AccessToken = plaintextToken
 	token.AccessTokenHash = tokenHash
 	return &token, nil
 }
@@ -152,7 +162,7 @@ func (t *TokensTable) TokenForEachDevice(txn *sqlx.Tx) (tokens []TokenForPoller,
 	err = sqlx.Select(
 		db,
 		&tokens,
-		`SELECT DISTINCT ON (user_id, device_id) token_encrypted, user_id, device_id, last_seen, since
+		`SELECT DISTINCT ON (user_id, device_id) token_hash, token_encrypted, user_id, device_id, last_seen, since
 		FROM syncv3_sync2_tokens JOIN syncv3_sync2_devices USING (user_id, device_id)
 		ORDER BY user_id, device_id, last_seen DESC
 	`)
@@ -165,14 +175,131 @@ func (t *TokensTable) TokenForEachDevice(txn *sqlx.Tx) (tokens []TokenForPoller,
 			// Ignore decryption failure.
 			continue
 		}
-		token.AccessTokenHash = hashToken(token.AccessToken)
+		t.maybeRehash(token.Token)
 	}
 	return
 }
 
+// TokenForDevice loads the most recently used token for this device. Returns sql.ErrNoRows if
+// the device has no tokens.
+func (t *TokensTable) TokenForDevice(userID, deviceID string) (*TokenForPoller, error) {
+	var token TokenForPoller
+	err := t.db.Get(
+		&token,
+		`SELECT token_hash, token_encrypted, user_id, device_id, last_seen, since
+		FROM syncv3_sync2_tokens JOIN syncv3_sync2_devices USING (user_id, device_id)
+		WHERE user_id = $1 AND device_id = $2
+		ORDER BY last_seen DESC LIMIT 1`,
+		userID, deviceID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	token.AccessToken, err = t.decrypt(token.AccessTokenEncrypted)
+	if err != nil {
+		return nil, err
+	}
+	t.maybeRehash(token.Token)
+	return &token, nil
+}
+
+// maybeRehash moves the token to the hash under the current pepper, if it isn't already. The
+// token's AccessToken must be populated. Failures are logged and leave the token on its old hash.
+func (t *TokensTable) maybeRehash(token *Token) {
+	newHash := HashToken(token.AccessToken)
+	if token.AccessTokenHash == newHash {
+		return
+	}
+	if err := t.rehash(token.AccessTokenHash, newHash); err != nil {
+		logger.Warn().Err(err).Str("user", token.UserID).Str("device", token.DeviceID).Msg("failed to rehash token")
+		return
+	}
+	token.AccessTokenHash = newHash
+}
+
+// rehash moves the row stored under oldHash to newHash. If a row already exists under newHash then
+// the same token was inserted again after a pepper change, so the old row is a duplicate and is deleted.
+func (t *TokensTable) rehash(oldHash, newHash string) error {
+	_, err := t.db.Exec(
+		`UPDATE syncv3_sync2_tokens SET token_hash = $1 WHERE token_hash = $2
+		AND NOT EXISTS (SELECT 1 FROM syncv3_sync2_tokens WHERE token_hash = $1)`,
+		newHash, oldHash,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = t.db.Exec(`DELETE FROM syncv3_sync2_tokens WHERE token_hash = $1`, oldHash)
+	return err
+}
+
+// Rehash re-hashes every token which is not stored under the current pepper, batchSize rows at a
+// time. It is safe to run whilst the proxy is running. Once it completes, previous peppers can be
+// removed from the configuration. Tokens which cannot be decrypted are skipped. Returns the number
+// of tokens which were re-hashed.
+func (t *TokensTable) Rehash(batchSize int) (numRehashed int, err error) {
+	after := ""
+	for {
+		var rows []struct {
+			TokenHash      string `db:"token_hash"`
+			TokenEncrypted string `db:"token_encrypted"`
+		}
+		err = t.db.Select(
+			&rows,
+			`SELECT token_hash, token_encrypted FROM syncv3_sync2_tokens
+			WHERE token_hash > $1 ORDER BY token_hash LIMIT $2`,
+			after, batchSize,
+		)
+		if err != nil {
+			return numRehashed, err
+		}
+		if len(rows) == 0 {
+			return numRehashed, nil
+		}
+		after = rows[len(rows)-1].TokenHash
+		for _, row := range rows {
+			accessToken, err := t.decrypt(row.TokenEncrypted)
+			if err != nil {
+				logger.Warn().Err(err).Str("token_hash", row.TokenHash).Msg("Rehash: failed to decrypt token, skipping")
+				continue
+			}
+			newHash := HashToken(accessToken)
+			if newHash == row.TokenHash {
+				continue
+			}
+			if err = t.rehash(row.TokenHash, newHash); err != nil {
+				return numRehashed, fmt.Errorf("failed to rehash token %s: %w", row.TokenHash, err)
+			}
+			numRehashed++
+		}
+	}
+}
+
+// CountByPepper returns the number of tokens hashed with each pepper, keyed by the pepper ID in the
+// hash (see TokenHashPepperID). Tokens hashed without a pepper are counted under "".
+func (t *TokensTable) CountByPepper() (map[string]int, error) {
+	var rows []struct {
+		PepperID string `db:"pepper_id"`
+		Count    int    `db:"count"`
+	}
+	// peppered hashes are version:pepper_id:hash, and unpeppered hashes have no colons
+	err := t.db.Select(
+		&rows,
+		`SELECT split_part(token_hash, ':', 2) AS pepper_id, COUNT(*) AS count
+		FROM syncv3_sync2_tokens GROUP BY pepper_id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.PepperID] = row.Count
+	}
+	return counts, nil
+}
+
 // Insert a new token into the table.
 func (t *TokensTable) Insert(txn *sqlx.Tx, plaintextToken, userID, deviceID string, lastSeen time.Time) (*Token, error) {
-	hashedToken := hashToken(plaintextToken)
+	hashedToken := HashToken(plaintextToken)
 	encToken := t.encrypt(plaintextToken)
 	_, err := txn.Exec(
 		`INSERT INTO syncv3_sync2_tokens(token_hash, token_encrypted, user_id, device_id, last_seen)
@@ -218,6 +345,21 @@ func (t *TokensTable) MaybeUpdateLastSeen(token *Token, newLastSeen time.Time) e
 	return nil
 }
 
+// RecentlyActiveUsers returns the users who own the numDevices most recently seen devices, most
+// recently seen first. Note that last_seen is only updated daily, see MaybeUpdateLastSeen.
+func (t *TokensTable) RecentlyActiveUsers(numDevices int) (userIDs []string, err error) {
+	err = t.db.Select(&userIDs, `
+	SELECT user_id FROM (
+		SELECT user_id, MAX(last_seen) AS last_seen FROM syncv3_sync2_tokens
+		GROUP BY user_id, device_id
+		ORDER BY last_seen DESC
+		LIMIT $1
+	) AS devices
+	GROUP BY user_id
+	ORDER BY MAX(last_seen) DESC`, numDevices)
+	return
+}
+
 func (t *TokensTable) GetTokenAndSince(userID, deviceID, tokenHash string) (accessToken, since string, err error) {
 	var encToken, gotUserID, gotDeviceID string
 	query := `SELECT token_encrypted, since, user_id, device_id
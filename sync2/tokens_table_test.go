@@ -3,6 +3,8 @@ package sync2
 import (
 	"github.com/jmoiron/sqlx"
 	"github.com/matrix-org/sliding-sync/sqlutil"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -11,13 +13,85 @@ import (
 func TestHash(t *testing.T) {
 	token1 := "ABCD"
 	token2 := "EFGH"
-	hash1 := hashToken(token1)
-	hash2 := hashToken(token2)
+	hash1 := HashToken(token1)
+	hash2 := HashToken(token2)
 	if hash1 == hash2 {
 		t.Fatalf("HashedTokenFromRequest: %s and %s have the same hash", token1, token2)
 	}
 }
 
+func setTokenPeppers(t *testing.T, current string, previous []string) {
+	t.Helper()
+	if err := SetTokenPeppers(current, previous); err != nil {
+		t.Fatalf("SetTokenPeppers: %s", err)
+	}
+}
+
+func TestHashPeppers(t *testing.T) {
+	defer SetTokenPeppers("", nil)
+	token := "ABCD"
+	unpeppered := HashToken(token)
+
+	setTokenPeppers(t, "p1:pepper1", nil)
+	peppered1 := HashToken(token)
+	if peppered1 == unpeppered {
+		t.Fatalf("peppered hash %s is the same as the unpeppered hash", peppered1)
+	}
+	if !strings.HasPrefix(peppered1, tokenHashVersion+":p1:") {
+		t.Fatalf("peppered hash %s is not versioned and labelled with the pepper ID", peppered1)
+	}
+
+	setTokenPeppers(t, "p2:pepper2", []string{"p1:pepper1"})
+	peppered2 := HashToken(token)
+	if peppered2 == peppered1 {
+		t.Fatalf("changing the pepper did not change the hash")
+	}
+	for _, hash := range []string{peppered2, peppered1, unpeppered} {
+		if !TokenHashMatches(token, hash) {
+			t.Errorf("TokenHashMatches(%s) returned false", hash)
+		}
+	}
+	if TokenHashMatches("EFGH", peppered2) {
+		t.Errorf("TokenHashMatches returned true for a different token")
+	}
+
+	current, previous := TokenPepperIDs()
+	if current != "p2" || len(previous) != 1 || previous[0] != "p1" {
+		t.Errorf("TokenPepperIDs: got %s %v, want p2 [p1]", current, previous)
+	}
+	if TokenHashPepperID(peppered2) != "p2" || TokenHashPepperID(peppered1) != "p1" || TokenHashPepperID(unpeppered) != "" {
+		t.Errorf("TokenHashPepperID should return the configured IDs, and be empty for unpeppered hashes")
+	}
+	// the secret cannot be checked against the hash's pepper ID
+	if strings.Contains(peppered2, "pepper2") {
+		t.Errorf("hash %s contains the pepper", peppered2)
+	}
+
+	setTokenPeppers(t, "p2:pepper2", nil)
+	if TokenHashMatches(token, peppered1) {
+		t.Errorf("TokenHashMatches returned true for a pepper which was removed")
+	}
+
+	// invalid peppers are rejected without changing the configuration
+	for _, tc := range []struct {
+		current  string
+		previous []string
+	}{
+		{current: "pepper3"},
+		{current: ":pepper3"},
+		{current: "p3:"},
+		{current: "p3:pepper3", previous: []string{"pepper2"}},
+		{current: "p3:pepper3", previous: []string{"p3:pepper2"}},
+	} {
+		if err := SetTokenPeppers(tc.current, tc.previous); err == nil {
+			t.Errorf("SetTokenPeppers(%q, %v) succeeded, want an error", tc.current, tc.previous)
+		}
+	}
+	if HashToken(token) != peppered2 {
+		t.Errorf("an invalid SetTokenPeppers changed the pepper")
+	}
+}
+
 func TestTokensTable(t *testing.T) {
 	db, close := connectToDB(t)
 	defer close()
@@ -118,6 +192,14 @@ func TestDeletingTokens(t *testing.T) {
 		t.Fatalf("Failed to fetch token: %s", err)
 	}
 
+	t.Log("We should be able to fetch this token by its hash.")
+	byHash, err := tokens.TokenByHash(token.AccessTokenHash)
+	if err != nil {
+		t.Fatalf("Failed to fetch token by hash: %s", err)
+	}
+	assertEqual(t, byHash.UserID, "@bob:builders.com", "Token.UserID mismatch")
+	assertEqual(t, byHash.DeviceID, "device", "Token.DeviceID mismatch")
+
 	t.Log("Delete the token")
 	err = tokens.Delete(token.AccessTokenHash)
 
@@ -130,12 +212,103 @@ func TestDeletingTokens(t *testing.T) {
 	if token != nil || err == nil {
 		t.Fatalf("Fetching token after deletion did not fail: got %s, %s", token, err)
 	}
+	byHash, err = tokens.TokenByHash(HashToken(accessToken))
+	if byHash != nil || err == nil {
+		t.Fatalf("Fetching token by hash after deletion did not fail: got %v, %s", byHash, err)
+	}
+}
+
+func TestTokensRehash(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	defer SetTokenPeppers("", nil)
+	tokens := NewTokensTable(db, "my_secret")
+
+	t.Log("Insert tokens without a pepper.")
+	accessTokens := []string{"rehash_token1", "rehash_token2", "rehash_token3"}
+	err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		for _, accessToken := range accessTokens {
+			if _, err := tokens.Insert(txn, accessToken, "@rehash:localhost", "device", time.Now()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to Insert tokens: %s", err)
+	}
+	unpepperedHash := HashToken(accessTokens[0])
+
+	t.Log("Configure a pepper. The tokens should still be found, and be re-hashed on lookup.")
+	setTokenPeppers(t, "rehash:pepper", nil)
+	pepperID, _ := TokenPepperIDs()
+	token, err := tokens.Token(accessTokens[0])
+	if err != nil {
+		t.Fatalf("Failed to fetch token after adding a pepper: %s", err)
+	}
+	assertEqual(t, token.AccessTokenHash, HashToken(accessTokens[0]), "Token.AccessTokenHash mismatch")
+	if _, err = tokens.TokenByHash(unpepperedHash); err == nil {
+		t.Fatalf("Token still exists under the unpeppered hash")
+	}
+
+	assertPepperCounts(t, tokens, map[string]int{"": len(accessTokens) - 1, pepperID: 1})
+
+	t.Log("Rehash should only re-hash the tokens which were not looked up.")
+	numRehashed, err := tokens.Rehash(1)
+	if err != nil {
+		t.Fatalf("Rehash failed: %s", err)
+	}
+	if numRehashed != len(accessTokens)-1 {
+		t.Fatalf("Rehash: got %d tokens re-hashed, want %d", numRehashed, len(accessTokens)-1)
+	}
+	for _, accessToken := range accessTokens {
+		if _, err = tokens.TokenByHash(HashToken(accessToken)); err != nil {
+			t.Fatalf("Token %s not found under the peppered hash: %s", accessToken, err)
+		}
+	}
+
+	assertPepperCounts(t, tokens, map[string]int{pepperID: len(accessTokens)})
+
+	t.Log("Running Rehash again should be a no-op.")
+	numRehashed, err = tokens.Rehash(1)
+	if err != nil {
+		t.Fatalf("Rehash failed: %s", err)
+	}
+	if numRehashed != 0 {
+		t.Fatalf("Rehash: got %d tokens re-hashed, want 0", numRehashed)
+	}
+}
+
+// assertPepperCounts checks the number of tokens hashed with each pepper. The table may contain
+// tokens from other tests, so only rows for this test's user are counted.
+func assertPepperCounts(t *testing.T, table *TokensTable, want map[string]int) {
+	t.Helper()
+	var hashes []string
+	if err := table.db.Select(&hashes, `SELECT token_hash FROM syncv3_sync2_tokens WHERE user_id = '@rehash:localhost'`); err != nil {
+		t.Fatalf("failed to select token hashes: %s", err)
+	}
+	got := make(map[string]int)
+	for _, hash := range hashes {
+		got[TokenHashPepperID(hash)]++
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("tokens per pepper: got %v want %v", got, want)
+	}
+	counts, err := table.CountByPepper()
+	if err != nil {
+		t.Fatalf("CountByPepper: %s", err)
+	}
+	for pepperID, n := range want {
+		if counts[pepperID] < n {
+			t.Errorf("CountByPepper: got %d tokens for pepper %q, want at least %d", counts[pepperID], pepperID, n)
+		}
+	}
 }
 
 func assertEqualTokens(t *testing.T, table *TokensTable, got *Token, accessToken, userID, deviceID string, lastSeen time.Time) {
 	t.Helper()
 	assertEqual(t, got.AccessToken, accessToken, "Token.AccessToken mismatch")
-	assertEqual(t, got.AccessTokenHash, hashToken(accessToken), "Token.AccessTokenHashed mismatch")
+	assertEqual(t, got.AccessTokenHash, HashToken(accessToken), "Token.AccessTokenHashed mismatch")
 	// We don't care what the encrypted token is here. The fact that we store encrypted values is an
 	// implementation detail; the rest of the program doesn't care.
 	assertEqual(t, got.UserID, userID, "Token.UserID mismatch")
@@ -161,3 +334,44 @@ func assertEqualTimes(t *testing.T, got, want time.Time, msg string) {
 }
 
 // see devices_table_test.go for tests which join the tokens and devices tables.
+
+func TestRecentlyActiveUsers(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	tokens := NewTokensTable(db, "my_secret")
+
+	// use timestamps in the future so that tokens from other tests are less recently seen.
+	now := time.Now().Add(24 * 365 * time.Hour)
+	inserts := []struct {
+		token    string
+		userID   string
+		deviceID string
+		lastSeen time.Time
+	}{
+		{"recent_alice_1", "@recent_alice:localhost", "A1", now.Add(-3 * time.Hour)},
+		{"recent_alice_2", "@recent_alice:localhost", "A2", now.Add(-1 * time.Hour)},
+		{"recent_bob", "@recent_bob:localhost", "B", now.Add(-2 * time.Hour)},
+		{"recent_charlie", "@recent_charlie:localhost", "C", now.Add(-4 * time.Hour)},
+	}
+	err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		for _, in := range inserts {
+			if _, err := tokens.Insert(txn, in.token, in.userID, in.deviceID, in.lastSeen); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to insert tokens: %s", err)
+	}
+
+	// the 3 most recent devices are A2, B, A1, which belong to alice and bob.
+	userIDs, err := tokens.RecentlyActiveUsers(3)
+	if err != nil {
+		t.Fatalf("RecentlyActiveUsers: %s", err)
+	}
+	want := []string{"@recent_alice:localhost", "@recent_bob:localhost"}
+	if !reflect.DeepEqual(userIDs, want) {
+		t.Fatalf("RecentlyActiveUsers: got %v want %v", userIDs, want)
+	}
+}
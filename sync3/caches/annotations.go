@@ -0,0 +1,55 @@
+package caches
+
+import (
+	"context"
+	"sync"
+
+	"github.com/matrix-org/sliding-sync/state"
+)
+
+// EventAnnotations loads the annotations of events at most once, however many connections are sent
+// the event which changed them. It is attached to reactions and redactions by the GlobalCache, and
+// shared by every connection which is sent the update. Safe for concurrent use.
+type EventAnnotations struct {
+	load func(ctx context.Context, eventIDs []string) (map[string][]state.Annotation, error)
+	mu   sync.Mutex
+	// event_id -> annotations, or nil if the event has no annotations
+	loaded map[string][]state.Annotation
+}
+
+func newEventAnnotations(load func(ctx context.Context, eventIDs []string) (map[string][]state.Annotation, error)) *EventAnnotations {
+	return &EventAnnotations{
+		load:   load,
+		loaded: make(map[string][]state.Annotation),
+	}
+}
+
+// Counts returns the annotation counts of each of these events as seen by this user, keyed by event
+// ID. Events without annotations are not included. Only events which haven't been asked about before
+// are loaded from the database.
+func (a *EventAnnotations) Counts(ctx context.Context, userID string, eventIDs []string) (map[string][]state.AnnotationCount, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var unloaded []string
+	for _, eventID := range eventIDs {
+		if _, ok := a.loaded[eventID]; !ok {
+			unloaded = append(unloaded, eventID)
+		}
+	}
+	if len(unloaded) > 0 {
+		annotations, err := a.load(ctx, unloaded)
+		if err != nil {
+			return nil, err
+		}
+		for _, eventID := range unloaded {
+			a.loaded[eventID] = annotations[eventID]
+		}
+	}
+	counts := make(map[string][]state.AnnotationCount)
+	for _, eventID := range eventIDs {
+		for _, annotation := range a.loaded[eventID] {
+			counts[eventID] = append(counts[eventID], annotation.CountFor(userID))
+		}
+	}
+	return counts, nil
+}
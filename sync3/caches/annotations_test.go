@@ -0,0 +1,54 @@
+package caches
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/state"
+)
+
+// Test that annotations are only loaded once per event, and that counts are worked out for each user.
+func TestEventAnnotations(t *testing.T) {
+	var loaded [][]string
+	a := newEventAnnotations(func(ctx context.Context, eventIDs []string) (map[string][]state.Annotation, error) {
+		loaded = append(loaded, eventIDs)
+		return map[string][]state.Annotation{
+			"$a": {
+				{Type: "m.reaction", Key: "👍", Senders: []string{"@alice", "@bob"}},
+				{Type: "m.reaction", Key: "🎉", Senders: []string{"@bob"}},
+			},
+		}, nil
+	})
+	got, err := a.Counts(context.Background(), "@alice", []string{"$a", "$b"})
+	if err != nil {
+		t.Fatalf("Counts: %s", err)
+	}
+	want := map[string][]state.AnnotationCount{
+		"$a": {
+			{Type: "m.reaction", Key: "👍", Count: 2, CurrentUserParticipated: true},
+			{Type: "m.reaction", Key: "🎉", Count: 1},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("alice: got %+v want %+v", got, want)
+	}
+
+	got, err = a.Counts(context.Background(), "@bob", []string{"$a", "$b", "$c"})
+	if err != nil {
+		t.Fatalf("Counts: %s", err)
+	}
+	want = map[string][]state.AnnotationCount{
+		"$a": {
+			{Type: "m.reaction", Key: "👍", Count: 2, CurrentUserParticipated: true},
+			{Type: "m.reaction", Key: "🎉", Count: 1, CurrentUserParticipated: true},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bob: got %+v want %+v", got, want)
+	}
+	// only $c was loaded the second time
+	if !reflect.DeepEqual(loaded, [][]string{{"$a", "$b"}, {"$c"}}) {
+		t.Errorf("got loads %v", loaded)
+	}
+}
@@ -3,13 +3,11 @@ package caches
 import (
 	"context"
 	"encoding/json"
-	"os"
 	"sort"
-	"sync"
+	"sync/atomic"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
-	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
 )
 
@@ -24,12 +22,28 @@ type EventData struct {
 	// TransactionID is the unsigned.transaction_id field in the event as stored in the
 	// syncv3_events table, or the empty string if there is no such field.
 	//
-	// We may see the event on poller A without a transaction_id, and then later on
-	// poller B with a transaction_id. If this happens, we make a temporary note of the
-	// transaction_id in the syncv3_txns table, but do not edit the persisted event.
-	// This means that this field is not authoritative; we only include it here as a
-	// hint to avoid unnecessary waits for V2TransactionID payloads.
+	// Transaction IDs are stripped from events before they are persisted and kept in the
+	// syncv3_txns table instead, as they are only meant for the sending device. This field
+	// is therefore only set for events stored by older versions, and is not authoritative;
+	// it is a hint to avoid unnecessary waits for V2TransactionID payloads.
 	TransactionID string
+	// Membership is content.membership for m.room.member events, and MembershipChange is true if
+	// the event changes the membership rather than e.g the display name. Both are worked out when
+	// the event is first parsed by the dispatcher, so consumers don't rescan the event JSON.
+	Membership       string
+	MembershipChange bool
+	// ReplacedEventID is the ID of the event this event edits, if it is an m.replace. Edits update
+	// the content of an existing message, so they don't change the room's recency.
+	ReplacedEventID string
+	// RedactedEventID is the ID of the event this event redacts, if it is an m.room.redaction.
+	// Neither redactions nor redacted events count towards the room's recency.
+	RedactedEventID string
+	// Annotations is set by the GlobalCache on annotations and redactions, which change the annotation
+	// counts of other events, so the counts are loaded once for every connection sent this event.
+	Annotations *EventAnnotations
+	// Preview is set by the GlobalCache on edits and redactions, which may change the room's message
+	// preview, so the preview is loaded once for every connection sent this event.
+	Preview *EventPreview
 
 	// the number of joined users in this room. Use this value and don't try to work it out as you
 	// may get it wrong due to Synapse sending duplicate join events(!) This value has them de-duped
@@ -55,10 +69,7 @@ type EventData struct {
 	ForceInitial bool
 }
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger("caches")
 
 // The purpose of global cache is to store global-level information about all rooms the server is aware of.
 // Global-level information is represented as internal.RoomMetadata and includes things like Heroes, join/invite
@@ -71,36 +82,78 @@ type GlobalCache struct {
 
 	// inserts are done by v2 poll loops, selects are done by v3 request threads
 	// there are lots of overlapping keys as many users (threads) can be joined to the same room (key)
-	// hence you must lock this with `mu` before r/w
-	roomIDToMetadata   map[string]*internal.RoomMetadata
-	roomIDToMetadataMu *sync.RWMutex
+	// hence you must lock the room's shard before r/w
+	roomIDToMetadata *roomShards
+	// the highest event NID reflected in roomIDToMetadata. Only updated whilst holding the lock
+	// for the room the event is in, after the room has been updated.
+	latestNID atomic.Int64
 
 	// for loading room state not held in-memory TODO: remove to another struct along with associated functions
 	store *state.Storage
+
+	// public unthreaded read receipts for rooms which have needed them
+	receipts *receiptCache
+
+	metrics *CacheMetrics
 }
 
 func NewGlobalCache(store *state.Storage) *GlobalCache {
 	return &GlobalCache{
-		roomIDToMetadataMu: &sync.RWMutex{},
-		store:              store,
-		roomIDToMetadata:   make(map[string]*internal.RoomMetadata),
+		store:            store,
+		roomIDToMetadata: newRoomShards(),
+		receipts: newReceiptCache(func(roomID string) ([]internal.Receipt, error) {
+			if store == nil {
+				return nil, nil
+			}
+			return store.ReceiptTable.SelectUnthreadedReceiptsForRoom(roomID)
+		}),
+	}
+}
+
+// SetMetrics makes this cache record lookups and sizes to the given metrics. Metrics are also
+// recorded for UserCaches which use this GlobalCache.
+func (c *GlobalCache) SetMetrics(m *CacheMetrics) {
+	c.metrics = m
+	c.metrics.SetEntries(CacheGlobalRooms, c.roomIDToMetadata.len())
+}
+
+// Metrics returns the metrics set via SetMetrics, or nil if metrics are disabled.
+func (c *GlobalCache) Metrics() *CacheMetrics {
+	if c == nil {
+		return nil
 	}
+	return c.metrics
 }
 
 func (c *GlobalCache) OnRegistered(_ context.Context) error {
 	return nil
 }
 
+// RoomNameSearch returns a function which returns the rooms in roomIDs whose name or canonical alias
+// contains the substring, ignoring case, using the database rather than the cached metadata.
+// Returns nil if there is no database.
+func (c *GlobalCache) RoomNameSearch() func(roomIDs []string, substring string) ([]string, error) {
+	if c.store == nil {
+		return nil
+	}
+	return c.store.RoomIDsWithNameLike
+}
+
 // LoadRooms loads the current room metadata for the given room IDs. Races unless you call this in a dispatcher loop.
 // Always returns copies of the room metadata so ownership can be passed to other threads.
 func (c *GlobalCache) LoadRooms(ctx context.Context, roomIDs ...string) map[string]*internal.RoomMetadata {
-	c.roomIDToMetadataMu.RLock()
-	defer c.roomIDToMetadataMu.RUnlock()
 	result := make(map[string]*internal.RoomMetadata, len(roomIDs))
+	misses := 0
 	for i := range roomIDs {
 		roomID := roomIDs[i]
-		result[roomID] = c.copyRoom(roomID)
+		var ok bool
+		result[roomID], ok = c.copyRoom(roomID)
+		if !ok {
+			misses++
+		}
 	}
+	c.metrics.Hit(CacheGlobalRooms, len(roomIDs)-misses)
+	c.metrics.Miss(CacheGlobalRooms, misses)
 	return result
 }
 
@@ -108,26 +161,33 @@ func (c *GlobalCache) LoadRooms(ctx context.Context, roomIDs ...string) map[stri
 // and returns rooms in a map. The output map is non-nil and contains exactly the same
 // set of keys as the input map. The values in the input map are completely ignored.
 func (c *GlobalCache) LoadRoomsFromMap(ctx context.Context, joinTimingsByRoomID map[string]internal.EventMetadata) map[string]*internal.RoomMetadata {
-	c.roomIDToMetadataMu.RLock()
-	defer c.roomIDToMetadataMu.RUnlock()
 	result := make(map[string]*internal.RoomMetadata, len(joinTimingsByRoomID))
+	misses := 0
 	for roomID, _ := range joinTimingsByRoomID {
-		result[roomID] = c.copyRoom(roomID)
+		var ok bool
+		result[roomID], ok = c.copyRoom(roomID)
+		if !ok {
+			misses++
+		}
 	}
+	c.metrics.Hit(CacheGlobalRooms, len(joinTimingsByRoomID)-misses)
+	c.metrics.Miss(CacheGlobalRooms, misses)
 	return result
 }
 
 // copyRoom returns a copy of the internal.RoomMetadata stored for this room.
 // This is an internal implementation detail of LoadRooms and LoadRoomsFromMap.
-// If the room is not present in the global cache, returns a stub metadata entry.
-// The caller MUST acquire a read lock on roomIDToMetadataMu before calling this.
-func (c *GlobalCache) copyRoom(roomID string) *internal.RoomMetadata {
-	sr := c.roomIDToMetadata[roomID]
+// If the room is not present in the global cache, returns a stub metadata entry and false.
+func (c *GlobalCache) copyRoom(roomID string) (*internal.RoomMetadata, bool) {
+	shard := c.roomIDToMetadata.shard(roomID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	sr := shard.rooms[roomID]
 	if sr == nil {
 		logger.Warn().Str("room", roomID).Msg("GlobalCache.LoadRoom: no metadata for this room, returning stub")
-		return internal.NewRoomMetadata(roomID)
+		return internal.NewRoomMetadata(roomID), false
 	}
-	return sr.DeepCopy()
+	return sr.DeepCopy(), true
 }
 
 // LoadJoinedRooms loads all current joined room metadata for the user given, together
@@ -150,7 +210,7 @@ func (c *GlobalCache) LoadJoinedRooms(ctx context.Context, userID string) (
 	if err != nil {
 		return 0, nil, nil, nil, err
 	}
-	joinTimingByRoomID, err = c.store.JoinedRoomsAfterPosition(userID, initialLoadPosition)
+	joinTimingByRoomID, err = c.store.JoinedRoomsAfterPosition(ctx, userID, initialLoadPosition)
 	if err != nil {
 		return 0, nil, nil, nil, err
 	}
@@ -161,7 +221,7 @@ func (c *GlobalCache) LoadJoinedRooms(ctx context.Context, userID string) (
 		i++
 	}
 
-	latestNIDs, err = c.store.LatestEventNIDInRooms(roomIDs, initialLoadPosition)
+	latestNIDs, err = c.store.LatestEventNIDInRooms(ctx, roomIDs, initialLoadPosition)
 	if err != nil {
 		return 0, nil, nil, nil, err
 	}
@@ -172,6 +232,7 @@ func (c *GlobalCache) LoadJoinedRooms(ctx context.Context, userID string) (
 }
 
 func (c *GlobalCache) LoadStateEvent(ctx context.Context, roomID string, loadPosition int64, evType, stateKey string) json.RawMessage {
+	c.metrics.DBFallback(CacheGlobalState, 1)
 	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(ctx, []string{roomID}, loadPosition, map[string][]string{
 		evType: {stateKey},
 	})
@@ -189,16 +250,37 @@ func (c *GlobalCache) LoadStateEvent(ctx context.Context, roomID string, loadPos
 
 // TODO: remove? Doesn't touch global cache fields
 func (c *GlobalCache) LoadRoomState(ctx context.Context, roomIDs []string, loadPosition int64, requiredStateMap *internal.RequiredStateMap, roomToUsersInTimeline map[string][]string) map[string][]json.RawMessage {
+	roomToPos := make(map[string]int64, len(roomIDs))
+	for _, roomID := range roomIDs {
+		roomToPos[roomID] = loadPosition
+	}
+	return c.LoadRoomStateAtPositions(ctx, roomToPos, requiredStateMap, roomToUsersInTimeline)
+}
+
+// LoadRoomStateAtPositions is like LoadRoomState, but loads each room at its own position. All rooms are
+// loaded together, rather than making a round trip to the database per position.
+func (c *GlobalCache) LoadRoomStateAtPositions(ctx context.Context, roomToPos map[string]int64, requiredStateMap *internal.RequiredStateMap, roomToUsersInTimeline map[string][]string) map[string][]json.RawMessage {
 	if c.store == nil {
 		return nil
 	}
 	if requiredStateMap.Empty() {
 		return nil
 	}
-	resultMap := make(map[string][]json.RawMessage, len(roomIDs))
-	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(ctx, roomIDs, loadPosition, requiredStateMap.QueryStateMap())
+	resultMap := make(map[string][]json.RawMessage, len(roomToPos))
+	if requiredStateMap.IsExactly("m.room.pinned_events", "") {
+		// many clients ask for just the pinned events for every visible room, which we hold in memory.
+		roomToPos = c.loadPinnedEvents(roomToPos, resultMap)
+		if len(roomToPos) == 0 {
+			return resultMap
+		}
+	}
+	c.metrics.DBFallback(CacheGlobalState, len(roomToPos))
+	roomIDToStateEvents, err := c.store.RoomStateAfterEventPositions(ctx, roomToPos, requiredStateMap.QueryStateMap())
 	if err != nil {
-		logger.Err(err).Strs("rooms", roomIDs).Int64("pos", loadPosition).Msg("failed to load room state")
+		if ctx.Err() != nil {
+			return nil // the client went away, the caller will abort the request
+		}
+		logger.Err(err).Strs("rooms", internal.Keys(roomToPos)).Msg("failed to load room state")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return nil
 	}
@@ -222,6 +304,60 @@ func (c *GlobalCache) LoadRoomState(ctx context.Context, roomIDs []string, loadP
 	return resultMap
 }
 
+// LoadMessagePreviews returns a preview of the latest message in each room at or before the room's
+// position. Rooms without any messages which can be previewed are not included.
+func (c *GlobalCache) LoadMessagePreviews(ctx context.Context, roomToPos map[string]int64) map[string]*internal.MessagePreview {
+	if c.store == nil || len(roomToPos) == 0 {
+		return nil
+	}
+	messages, err := c.store.LatestMessages(ctx, roomToPos, internal.MessagePreviewEventTypes)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil // the client went away, the caller will abort the request
+		}
+		logger.Err(err).Strs("rooms", internal.Keys(roomToPos)).Msg("failed to load message previews")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return nil
+	}
+	result := make(map[string]*internal.MessagePreview, len(messages))
+	for roomID, msg := range messages {
+		if preview := internal.NewMessagePreview(msg.Event, msg.Replacement); preview != nil {
+			result[roomID] = preview
+		}
+	}
+	return result
+}
+
+// loadPinnedEvents adds the m.room.pinned_events state at each room's load position to resultMap for
+// the rooms whose current pinned events were already in place at that position. Returns the rooms
+// which could not be served from the cache, e.g. because their pinned events changed after the load
+// position.
+func (c *GlobalCache) loadPinnedEvents(roomToPos map[string]int64, resultMap map[string][]json.RawMessage) (uncached map[string]int64) {
+	uncached = make(map[string]int64)
+	for roomID, loadPosition := range roomToPos {
+		shard := c.roomIDToMetadata.shard(roomID)
+		shard.mu.RLock()
+		metadata, ok := shard.rooms[roomID]
+		cached := ok && metadata.PinnedEventNID <= loadPosition
+		var pinnedEvent json.RawMessage
+		if cached {
+			pinnedEvent = metadata.PinnedEvent
+		}
+		shard.mu.RUnlock()
+		if !cached {
+			uncached[roomID] = loadPosition
+			continue
+		}
+		if pinnedEvent == nil {
+			resultMap[roomID] = nil
+		} else {
+			resultMap[roomID] = []json.RawMessage{pinnedEvent}
+		}
+	}
+	c.metrics.Hit(CacheGlobalState, len(roomToPos)-len(uncached))
+	return uncached
+}
+
 // Startup will populate the cache with the provided metadata.
 // Must be called prior to starting any v2 pollers else this operation can race. Consider:
 //   - V2 poll loop started early
@@ -230,8 +366,6 @@ func (c *GlobalCache) LoadRoomState(ctx context.Context, roomIDs []string, loadP
 //   - OnNewEvents is called with the join event
 //   - join event is processed twice.
 func (c *GlobalCache) Startup(roomIDToMetadata map[string]internal.RoomMetadata) error {
-	c.roomIDToMetadataMu.Lock()
-	defer c.roomIDToMetadataMu.Unlock()
 	// sort room IDs for ease of debugging and for determinism
 	roomIDs := make([]string, len(roomIDToMetadata))
 	i := 0
@@ -249,44 +383,91 @@ func (c *GlobalCache) Startup(roomIDToMetadata map[string]internal.RoomMetadata)
 		}
 		internal.Assert("room ID is set", metadata.RoomID != "", debugContext)
 		internal.Assert("last message timestamp exists", metadata.LastMessageTimestamp > 1, debugContext)
-		c.roomIDToMetadata[roomID] = &metadata
+		shard := c.roomIDToMetadata.shard(roomID)
+		shard.mu.Lock()
+		shard.rooms[roomID] = &metadata
+		shard.mu.Unlock()
 	}
+	c.metrics.SetEntries(CacheGlobalRooms, c.roomIDToMetadata.len())
 	return nil
 }
 
+// SetLatestNID records the highest event NID which was included in the metadata passed to Startup.
+func (c *GlobalCache) SetLatestNID(nid int64) {
+	c.latestNID.Store(nid)
+}
+
+// MetadataSnapshot copies the parts of the room metadata which are expensive to calculate at startup,
+// for persisting via state.MetadataSnapshotTable.
+func (c *GlobalCache) MetadataSnapshot() *state.MetadataSnapshot {
+	// Load the NID first: rooms may be updated whilst we copy them, but any room which is changed
+	// after this point has an event after LatestNID, so will be recalculated when loading the snapshot.
+	snapshot := &state.MetadataSnapshot{
+		Version:   state.MetadataSnapshotVersion,
+		LatestNID: c.latestNID.Load(),
+		Rooms:     make(map[string]state.SnapshotRoomMetadata),
+	}
+	c.roomIDToMetadata.forEach(func(roomID string, metadata *internal.RoomMetadata) {
+		latestEventsByType := make(map[string]internal.EventMetadata, len(metadata.LatestEventsByType))
+		for evType, eventMetadata := range metadata.LatestEventsByType {
+			latestEventsByType[evType] = eventMetadata
+		}
+		snapshot.Rooms[roomID] = state.SnapshotRoomMetadata{
+			NameEvent:            metadata.NameEvent,
+			AvatarEvent:          metadata.AvatarEvent,
+			CanonicalAlias:       metadata.CanonicalAlias,
+			LastMessageTimestamp: metadata.LastMessageTimestamp,
+			LatestEventsByType:   latestEventsByType,
+			PinnedEvent:          metadata.PinnedEvent,
+			PinnedEventNID:       metadata.PinnedEventNID,
+		}
+	})
+	return snapshot
+}
+
 // =================================================
 // Listener function called by dispatcher below
 // =================================================
 
 func (c *GlobalCache) OnEphemeralEvent(ctx context.Context, roomID string, ephEvent json.RawMessage) {
 	evType := gjson.ParseBytes(ephEvent).Get("type").Str
-	c.roomIDToMetadataMu.Lock()
-	defer c.roomIDToMetadataMu.Unlock()
-	metadata := c.roomIDToMetadata[roomID]
+	shard := c.roomIDToMetadata.shard(roomID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	metadata := shard.rooms[roomID]
 	if metadata == nil {
 		metadata = internal.NewRoomMetadata(roomID)
+		c.metrics.AddEntries(CacheGlobalRooms, 1)
 	}
 
 	switch evType {
 	case "m.typing":
 		metadata.TypingEvent = ephEvent
 	}
-	c.roomIDToMetadata[roomID] = metadata
+	shard.rooms[roomID] = metadata
+}
+
+// LoadReadReceipts returns the public read receipts in the room which are not in a thread, from memory
+// if possible. The returned slice belongs to the caller.
+func (c *GlobalCache) LoadReadReceipts(roomID string) ([]internal.Receipt, error) {
+	return c.receipts.Load(roomID)
 }
 
 func (c *GlobalCache) OnReceipt(ctx context.Context, receipt internal.Receipt) {
-	// nothing to do but we need it because the Dispatcher demands it.
+	c.receipts.OnReceipt(receipt)
 }
 
 func (c *GlobalCache) OnNewEvent(
 	ctx context.Context, ed *EventData,
 ) {
 	// update global state
-	c.roomIDToMetadataMu.Lock()
-	defer c.roomIDToMetadataMu.Unlock()
-	metadata := c.roomIDToMetadata[ed.RoomID]
+	shard := c.roomIDToMetadata.shard(ed.RoomID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	metadata := shard.rooms[ed.RoomID]
 	if metadata == nil {
 		metadata = internal.NewRoomMetadata(ed.RoomID)
+		c.metrics.AddEntries(CacheGlobalRooms, 1)
 	}
 	switch ed.EventType {
 	case "m.room.name":
@@ -314,6 +495,11 @@ func (c *GlobalCache) OnNewEvent(
 		if ed.StateKey != nil && *ed.StateKey == "" {
 			metadata.CanonicalAlias = ed.Content.Get("alias").Str
 		}
+	case "m.room.pinned_events":
+		if ed.StateKey != nil && *ed.StateKey == "" {
+			metadata.PinnedEvent = ed.Event
+			metadata.PinnedEventNID = ed.NID
+		}
 	case "m.room.create":
 		if ed.StateKey != nil && *ed.StateKey == "" {
 			roomType := ed.Content.Get("type")
@@ -336,9 +522,8 @@ func (c *GlobalCache) OnNewEvent(
 		}
 	case "m.room.member":
 		if ed.StateKey != nil {
-			membership := ed.Content.Get("membership").Str
-			eventJSON := gjson.ParseBytes(ed.Event)
-			if internal.IsMembershipChange(eventJSON) {
+			membership := ed.Membership
+			if ed.MembershipChange {
 				metadata.JoinCount = ed.JoinCount
 				metadata.InviteCount = ed.InviteCount
 				if membership == "leave" || membership == "ban" {
@@ -369,19 +554,61 @@ func (c *GlobalCache) OnNewEvent(
 	}
 	// Note: this means the LastMessageTimestamp and values in LatestEventsByType can
 	// _decrease_; these timestamps are not monotonic.
-	metadata.LastMessageTimestamp = ed.Timestamp
-	metadata.LatestEventsByType[ed.EventType] = internal.EventMetadata{
-		NID:       ed.NID,
-		Timestamp: ed.Timestamp,
+	// Edits keep the timestamp of the message they replace, see state.applyLatestEvents.
+	if ed.ReplacedEventID == "" {
+		if ed.RedactedEventID == "" {
+			metadata.LastMessageTimestamp = ed.Timestamp
+		}
+		metadata.LatestEventsByType[ed.EventType] = internal.EventMetadata{
+			NID:       ed.NID,
+			Timestamp: ed.Timestamp,
+		}
+	}
+	if ed.RedactedEventID != "" && c.store != nil {
+		// the redacted event may have been the latest message in the room
+		if err := c.store.RecalculateLatestEventsAfterRedaction(metadata, ed.RedactedEventID); err != nil {
+			logger.Err(err).Str("room", ed.RoomID).Msg("OnNewEvent: failed to recalculate latest events after redaction")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		}
+	}
+	if c.store != nil && (ed.RedactedEventID != "" || ed.Content.Get(`m\.relates_to.rel_type`).Str == "m.annotation") {
+		ed.Annotations = newEventAnnotations(c.store.Annotations)
+	}
+	if ed.ReplacedEventID != "" || ed.RedactedEventID != "" {
+		roomID, nid := ed.RoomID, ed.NID
+		ed.Preview = newEventPreview(func(ctx context.Context) *internal.MessagePreview {
+			return c.LoadMessagePreviews(ctx, map[string]int64{roomID: nid})[roomID]
+		})
+	}
+	shard.rooms[ed.RoomID] = metadata
+	for {
+		latestNID := c.latestNID.Load()
+		if ed.NID <= latestNID || c.latestNID.CompareAndSwap(latestNID, ed.NID) {
+			break
+		}
+	}
+}
+
+// OnPurgeRoom removes the room from the cache. The room must no longer exist in the database.
+func (c *GlobalCache) OnPurgeRoom(ctx context.Context, roomID string) {
+	c.receipts.Forget(roomID)
+	shard := c.roomIDToMetadata.shard(roomID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if _, ok := shard.rooms[roomID]; !ok {
+		return
 	}
-	c.roomIDToMetadata[ed.RoomID] = metadata
+	delete(shard.rooms, roomID)
+	c.metrics.AddEntries(CacheGlobalRooms, -1)
 }
 
 func (c *GlobalCache) OnInvalidateRoom(ctx context.Context, roomID string) {
-	c.roomIDToMetadataMu.Lock()
-	defer c.roomIDToMetadataMu.Unlock()
+	c.receipts.Forget(roomID)
+	shard := c.roomIDToMetadata.shard(roomID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	metadata, ok := c.roomIDToMetadata[roomID]
+	metadata, ok := shard.rooms[roomID]
 	if !ok {
 		logger.Warn().Str("room_id", roomID).Msg("OnInvalidateRoom: room not in global cache")
 		return
@@ -6,7 +6,11 @@ import (
 	"encoding/json"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"testing"
+	"time"
 
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
@@ -234,3 +238,212 @@ func TestGlobalCacheLoadState(t *testing.T) {
 		})
 	}
 }
+
+func TestGlobalCacheLoadPinnedEventsFromCache(t *testing.T) {
+	ctx := context.Background()
+	store := state.NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestGlobalCacheLoadPinnedEventsFromCache:localhost"
+	unpinnedRoomID := "!TestGlobalCacheLoadPinnedEventsFromCache2:localhost"
+	alice := "@alice:localhost"
+	pinned := testutils.NewStateEvent(t, "m.room.pinned_events", "", alice, map[string]interface{}{"pinned": []string{"$a"}})
+	accResult, err := store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		pinned,
+	}})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	pinnedNID := accResult.TimelineNIDs[len(accResult.TimelineNIDs)-1]
+	_, err = store.Accumulate(alice, unpinnedRoomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	}})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	snapshot, err := store.GlobalSnapshot()
+	if err != nil {
+		t.Fatalf("GlobalSnapshot: %s", err)
+	}
+	globalCache := caches.NewGlobalCache(store)
+	if err = globalCache.Startup(snapshot.GlobalMetadata); err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	rs := sync3.RoomSubscription{
+		RequiredState: [][2]string{{"m.room.pinned_events", ""}},
+	}
+
+	t.Log("The pinned events loaded at startup are returned, and rooms without any return nothing.")
+	gotMap := globalCache.LoadRoomState(ctx, []string{roomID, unpinnedRoomID}, pinnedNID, rs.RequiredStateMap(alice), nil)
+	if got := gotMap[roomID]; len(got) != 1 || !bytes.Equal(got[0], pinned) {
+		t.Errorf("got %s want %s", got, pinned)
+	}
+	if got := gotMap[unpinnedRoomID]; len(got) != 0 {
+		t.Errorf("got %s want no events", got)
+	}
+
+	t.Log("Pinned events which only the cache knows about must have been served from the cache.")
+	repinned := testutils.NewStateEvent(t, "m.room.pinned_events", "", alice, map[string]interface{}{"pinned": []string{"$a", "$b"}})
+	stateKey := ""
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		Event:     repinned,
+		RoomID:    roomID,
+		EventType: "m.room.pinned_events",
+		StateKey:  &stateKey,
+		NID:       pinnedNID + 1000,
+	})
+	gotMap = globalCache.LoadRoomState(ctx, []string{roomID}, pinnedNID+1000, rs.RequiredStateMap(alice), nil)
+	if got := gotMap[roomID]; len(got) != 1 || !bytes.Equal(got[0], repinned) {
+		t.Errorf("got %s want %s", got, repinned)
+	}
+
+	t.Log("Loading from before the pinned events changed falls back to the database.")
+	gotMap = globalCache.LoadRoomState(ctx, []string{roomID}, pinnedNID, rs.RequiredStateMap(alice), nil)
+	if got := gotMap[roomID]; len(got) != 1 || !bytes.Equal(got[0], pinned) {
+		t.Errorf("got %s want %s", got, pinned)
+	}
+}
+
+func TestGlobalCacheEditsDoNotBumpRooms(t *testing.T) {
+	ctx := context.Background()
+	store := state.NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestGlobalCacheEditsDoNotBumpRooms:localhost"
+	alice := "@alice:localhost"
+	start := time.Now().Add(-time.Hour)
+	message := testutils.NewMessageEvent(t, alice, "hello", testutils.WithTimestamp(start.Add(time.Minute)))
+	editOf := func(body string, ts time.Time) json.RawMessage {
+		return testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{
+			"body":          "* " + body,
+			"m.new_content": map[string]interface{}{"body": body},
+			"m.relates_to":  map[string]interface{}{"rel_type": "m.replace", "event_id": gjson.GetBytes(message, "event_id").Str},
+		}, testutils.WithTimestamp(ts))
+	}
+	accResult, err := store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}, testutils.WithTimestamp(start)),
+		testutils.NewJoinEvent(t, alice, testutils.WithTimestamp(start)),
+		message,
+		editOf("hello!", start.Add(2*time.Minute)),
+	}})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	snapshot, err := store.GlobalSnapshot()
+	if err != nil {
+		t.Fatalf("GlobalSnapshot: %s", err)
+	}
+	globalCache := caches.NewGlobalCache(store)
+	if err = globalCache.Startup(snapshot.GlobalMetadata); err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	wantTs := uint64(start.Add(time.Minute).UnixMilli())
+
+	t.Log("Edits in the database don't count towards the room's recency.")
+	metadata := globalCache.LoadRooms(ctx, roomID)[roomID]
+	if metadata.LastMessageTimestamp != wantTs {
+		t.Errorf("LastMessageTimestamp: got %d want %d", metadata.LastMessageTimestamp, wantTs)
+	}
+	if got := metadata.LatestEventsByType["m.room.message"].Timestamp; got != wantTs {
+		t.Errorf("latest m.room.message timestamp: got %d want %d", got, wantTs)
+	}
+
+	t.Log("Nor do live edits.")
+	liveEdit := editOf("hello!!", start.Add(3*time.Minute))
+	liveEditData := &caches.EventData{
+		Event:           liveEdit,
+		RoomID:          roomID,
+		EventType:       "m.room.message",
+		Timestamp:       uint64(start.Add(3 * time.Minute).UnixMilli()),
+		NID:             accResult.TimelineNIDs[len(accResult.TimelineNIDs)-1] + 1000,
+		ReplacedEventID: gjson.GetBytes(message, "event_id").Str,
+	}
+	globalCache.OnNewEvent(ctx, liveEditData)
+	if liveEditData.Preview == nil {
+		t.Errorf("live edit has no preview to reload")
+	}
+	metadata = globalCache.LoadRooms(ctx, roomID)[roomID]
+	if metadata.LastMessageTimestamp != wantTs {
+		t.Errorf("LastMessageTimestamp after live edit: got %d want %d", metadata.LastMessageTimestamp, wantTs)
+	}
+}
+
+func TestGlobalCacheRedactionsDoNotBumpRooms(t *testing.T) {
+	ctx := context.Background()
+	store := state.NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestGlobalCacheRedactionsDoNotBumpRooms:localhost"
+	alice := "@alice:localhost"
+	start := time.Now().Add(-time.Hour)
+	at := func(minutes int) time.Time {
+		return start.Add(time.Duration(minutes) * time.Minute)
+	}
+	redactionOf := func(ev json.RawMessage, ts time.Time) json.RawMessage {
+		return testutils.NewEvent(t, "m.room.redaction", alice, map[string]interface{}{
+			"redacts": gjson.GetBytes(ev, "event_id").Str,
+		}, testutils.WithTimestamp(ts))
+	}
+	first := testutils.NewMessageEvent(t, alice, "first", testutils.WithTimestamp(at(1)))
+	second := testutils.NewMessageEvent(t, alice, "second", testutils.WithTimestamp(at(2)))
+	_, err := store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}, testutils.WithTimestamp(start)),
+		testutils.NewJoinEvent(t, alice, testutils.WithTimestamp(start)),
+		first,
+		second,
+		redactionOf(second, at(3)),
+	}})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	snapshot, err := store.GlobalSnapshot()
+	if err != nil {
+		t.Fatalf("GlobalSnapshot: %s", err)
+	}
+	globalCache := caches.NewGlobalCache(store)
+	if err = globalCache.Startup(snapshot.GlobalMetadata); err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	assertLastMessage := func(msg string, want time.Time) {
+		t.Helper()
+		metadata := globalCache.LoadRooms(ctx, roomID)[roomID]
+		wantTs := uint64(want.UnixMilli())
+		if metadata.LastMessageTimestamp != wantTs {
+			t.Errorf("%s: LastMessageTimestamp got %d want %d", msg, metadata.LastMessageTimestamp, wantTs)
+		}
+		if got := metadata.LatestEventsByType["m.room.message"].Timestamp; got != wantTs {
+			t.Errorf("%s: latest m.room.message timestamp got %d want %d", msg, got, wantTs)
+		}
+	}
+	assertLastMessage("Redactions and redacted events in the database don't count towards the room's recency", at(1))
+
+	// feed live events to the cache as the dispatcher would
+	onNewEvents := func(events ...json.RawMessage) {
+		t.Helper()
+		accResult, err := store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: events})
+		if err != nil {
+			t.Fatalf("Accumulate: %s", err)
+		}
+		for i, ev := range events {
+			parsed := internal.ParseEvent(ev)
+			globalCache.OnNewEvent(ctx, &caches.EventData{
+				Event:           ev,
+				RoomID:          roomID,
+				EventType:       parsed.Type,
+				Timestamp:       parsed.Timestamp,
+				NID:             accResult.TimelineNIDs[i],
+				RedactedEventID: parsed.RedactedEventID(),
+			})
+		}
+	}
+	third := testutils.NewMessageEvent(t, alice, "third", testutils.WithTimestamp(at(4)))
+	onNewEvents(third)
+	assertLastMessage("New messages bump the room", at(4))
+	onNewEvents(redactionOf(third, at(5)))
+	assertLastMessage("Redacting the latest message falls back to the previous one", at(1))
+	onNewEvents(redactionOf(first, at(6)))
+	metadata := globalCache.LoadRooms(ctx, roomID)[roomID]
+	if _, ok := metadata.LatestEventsByType["m.room.message"]; ok {
+		t.Errorf("latest m.room.message still set after redacting every message: %+v", metadata.LatestEventsByType)
+	}
+}
@@ -0,0 +1,94 @@
+package caches
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Names of the caches which are tracked by CacheMetrics.
+const (
+	CacheGlobalRooms   = "global_rooms"   // GlobalCache room metadata
+	CacheGlobalState   = "global_state"   // room state loaded via the GlobalCache
+	CacheUserRooms     = "user_rooms"     // UserCache room data
+	CacheUserTimelines = "user_timelines" // timelines loaded via the UserCache
+	CacheUserCaches    = "user_caches"    // the set of UserCaches
+)
+
+// Outcomes of a cache lookup.
+const (
+	lookupHit        = "hit"         // the data was in memory
+	lookupMiss       = "miss"        // the data was not in memory and a default was returned
+	lookupDBFallback = "db_fallback" // the data is not held in memory and was loaded from the database
+)
+
+// CacheMetrics records lookup outcomes and in-memory sizes for the GlobalCache and UserCaches.
+// A nil *CacheMetrics is valid and records nothing, which is the case when Prometheus is disabled.
+type CacheMetrics struct {
+	lookups *prometheus.CounterVec
+	entries *prometheus.GaugeVec
+}
+
+func NewCacheMetrics() *CacheMetrics {
+	m := &CacheMetrics{
+		lookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "api",
+			Name:      "cache_lookups",
+			Help:      "Number of cache lookups, labelled by cache and whether they were a hit, miss or had to go to the database.",
+		}, []string{"cache", "result"}),
+		entries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "api",
+			Name:      "cache_entries",
+			Help:      "Number of entries held in memory, labelled by cache.",
+		}, []string{"cache"}),
+	}
+	prometheus.MustRegister(m.lookups)
+	prometheus.MustRegister(m.entries)
+	return m
+}
+
+func (m *CacheMetrics) Teardown() {
+	if m == nil {
+		return
+	}
+	prometheus.Unregister(m.lookups)
+	prometheus.Unregister(m.entries)
+}
+
+// Hit records n lookups which were served from memory.
+func (m *CacheMetrics) Hit(cache string, n int) {
+	m.record(cache, lookupHit, n)
+}
+
+// Miss records n lookups which were not in memory and had a default returned.
+func (m *CacheMetrics) Miss(cache string, n int) {
+	m.record(cache, lookupMiss, n)
+}
+
+// DBFallback records n lookups which needed to hit the database.
+func (m *CacheMetrics) DBFallback(cache string, n int) {
+	m.record(cache, lookupDBFallback, n)
+}
+
+// SetEntries sets the number of entries held in memory for this cache.
+func (m *CacheMetrics) SetEntries(cache string, n int) {
+	if m == nil {
+		return
+	}
+	m.entries.WithLabelValues(cache).Set(float64(n))
+}
+
+// AddEntries adjusts the number of entries held in memory for this cache by delta.
+func (m *CacheMetrics) AddEntries(cache string, delta int) {
+	if m == nil || delta == 0 {
+		return
+	}
+	m.entries.WithLabelValues(cache).Add(float64(delta))
+}
+
+func (m *CacheMetrics) record(cache, result string, n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.lookups.WithLabelValues(cache, result).Add(float64(n))
+}
@@ -0,0 +1,44 @@
+package caches_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCacheMetrics(t *testing.T) {
+	metrics := caches.NewCacheMetrics()
+	defer metrics.Teardown()
+	gc := caches.NewGlobalCache(nil)
+	gc.Startup(map[string]internal.RoomMetadata{
+		"!a": {RoomID: "!a", LastMessageTimestamp: 123},
+		"!b": {RoomID: "!b", LastMessageTimestamp: 456},
+	})
+	gc.SetMetrics(metrics)
+	gc.LoadRooms(context.Background(), "!a", "!b", "!unknown")
+
+	uc := caches.NewUserCache("@alice:localhost", gc, nil, nil, nil)
+	uc.LoadRooms("!a", "!b")
+
+	const metricsText = `
+# HELP sliding_sync_api_cache_entries Number of entries held in memory, labelled by cache.
+# TYPE sliding_sync_api_cache_entries gauge
+sliding_sync_api_cache_entries{cache="global_rooms"} 2
+# HELP sliding_sync_api_cache_lookups Number of cache lookups, labelled by cache and whether they were a hit, miss or had to go to the database.
+# TYPE sliding_sync_api_cache_lookups counter
+sliding_sync_api_cache_lookups{cache="global_rooms",result="hit"} 2
+sliding_sync_api_cache_lookups{cache="global_rooms",result="miss"} 1
+sliding_sync_api_cache_lookups{cache="user_rooms",result="miss"} 2
+`
+	if err := testutil.GatherAndCompare(
+		prometheus.DefaultGatherer, strings.NewReader(metricsText),
+		"sliding_sync_api_cache_entries", "sliding_sync_api_cache_lookups",
+	); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,41 @@
+package caches
+
+import (
+	"context"
+	"sync"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// EventPreview loads a room's message preview as of an edit or redaction at most once, however many
+// connections are sent the event. It is attached to edits and redactions by the GlobalCache, as they
+// may change an older message so the preview has to be reloaded. Safe for concurrent use.
+type EventPreview struct {
+	load    func(ctx context.Context) *internal.MessagePreview
+	mu      sync.Mutex
+	loaded  bool
+	preview *internal.MessagePreview
+}
+
+func newEventPreview(load func(ctx context.Context) *internal.MessagePreview) *EventPreview {
+	return &EventPreview{
+		load: load,
+	}
+}
+
+// Load returns the room's message preview as of the event, or nil if the room has no messages which
+// can be previewed or it could not be loaded.
+func (p *EventPreview) Load(ctx context.Context) *internal.MessagePreview {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.loaded {
+		return p.preview
+	}
+	preview := p.load(ctx)
+	if ctx.Err() != nil {
+		return nil // the client went away, let the next connection try again
+	}
+	p.preview = preview
+	p.loaded = true
+	return preview
+}
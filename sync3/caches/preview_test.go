@@ -0,0 +1,33 @@
+package caches
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// Test that the preview is loaded once, unless the first load was cancelled.
+func TestEventPreview(t *testing.T) {
+	loads := 0
+	p := newEventPreview(func(ctx context.Context) *internal.MessagePreview {
+		loads++
+		if ctx.Err() != nil {
+			return nil
+		}
+		return &internal.MessagePreview{EventID: "$a"}
+	})
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := p.Load(cancelled); got != nil {
+		t.Errorf("cancelled Load: got %+v want nil", got)
+	}
+	for i := 0; i < 2; i++ {
+		if got := p.Load(context.Background()); got == nil || got.EventID != "$a" {
+			t.Errorf("Load: got %+v want $a", got)
+		}
+	}
+	if loads != 2 {
+		t.Errorf("got %d loads want 2", loads)
+	}
+}
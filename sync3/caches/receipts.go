@@ -0,0 +1,105 @@
+package caches
+
+import (
+	"sync"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// The maximum number of rooms whose read receipts are held in memory. Past this, an arbitrary room
+// is forgotten when another is loaded.
+const maxReceiptCacheRooms = 1000
+
+type receiptKey struct {
+	userID   string
+	threadID string
+}
+
+type roomReceipts struct {
+	mu       sync.Mutex
+	loaded   bool
+	receipts map[receiptKey]internal.Receipt
+}
+
+// receiptCache holds the public, unthreaded read receipts for rooms, so working out who has read
+// which events doesn't need a database query for every live receipt. Rooms are loaded from the
+// database the first time they are needed, then kept up-to-date by OnReceipt.
+type receiptCache struct {
+	load func(roomID string) ([]internal.Receipt, error)
+	// mu guards rooms. Each room has its own lock, which is held whilst it is loaded.
+	mu    sync.Mutex
+	rooms map[string]*roomReceipts
+}
+
+func newReceiptCache(load func(roomID string) ([]internal.Receipt, error)) *receiptCache {
+	return &receiptCache{
+		load:  load,
+		rooms: make(map[string]*roomReceipts),
+	}
+}
+
+// Load returns the room's public unthreaded read receipts, loading them from the database if they
+// are not in memory. The returned slice belongs to the caller.
+func (c *receiptCache) Load(roomID string) ([]internal.Receipt, error) {
+	c.mu.Lock()
+	room := c.rooms[roomID]
+	if room == nil {
+		if len(c.rooms) >= maxReceiptCacheRooms {
+			for evictRoomID := range c.rooms {
+				delete(c.rooms, evictRoomID)
+				break
+			}
+		}
+		room = &roomReceipts{}
+		c.rooms[roomID] = room
+	}
+	c.mu.Unlock()
+
+	// holding the room's lock whilst loading means OnReceipt waits for the load to finish, so it
+	// can't be overwritten by receipts which are older than those sent to OnReceipt.
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if !room.loaded {
+		receipts, err := c.load(roomID)
+		if err != nil {
+			return nil, err
+		}
+		room.receipts = make(map[receiptKey]internal.Receipt, len(receipts))
+		for _, r := range receipts {
+			room.receipts[receiptKey{r.UserID, r.ThreadID}] = r
+		}
+		room.loaded = true
+	}
+	result := make([]internal.Receipt, 0, len(room.receipts))
+	for _, r := range room.receipts {
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// OnReceipt updates the room's receipts if they are in memory. Receipts for rooms which are not in
+// memory are ignored, as they are in the database by the time OnReceipt is called.
+func (c *receiptCache) OnReceipt(receipt internal.Receipt) {
+	if receipt.IsPrivate || (receipt.ThreadID != "" && receipt.ThreadID != "main") {
+		return
+	}
+	c.mu.Lock()
+	room := c.rooms[receipt.RoomID]
+	c.mu.Unlock()
+	if room == nil {
+		return
+	}
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if !room.loaded {
+		return // the load failed, the next Load will try again
+	}
+	room.receipts[receiptKey{receipt.UserID, receipt.ThreadID}] = receipt
+}
+
+// Forget removes the room from memory, so its receipts are reloaded from the database when next needed.
+func (c *receiptCache) Forget(roomID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.rooms, roomID)
+}
@@ -0,0 +1,97 @@
+package caches
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func sortedReceiptEvents(receipts []internal.Receipt) []string {
+	var result []string
+	for _, r := range receipts {
+		result = append(result, r.UserID+"="+r.EventID)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func assertReceiptEvents(t *testing.T, msg string, got []internal.Receipt, want ...string) {
+	t.Helper()
+	g := sortedReceiptEvents(got)
+	if fmt.Sprint(g) != fmt.Sprint(want) {
+		t.Errorf("%s: got %v want %v", msg, g, want)
+	}
+}
+
+// Test that
+// - rooms are loaded once, then kept up-to-date by OnReceipt
+// - private and threaded receipts are ignored
+// - receipts for rooms which aren't loaded are ignored, and forgotten rooms are reloaded
+// - failed loads are retried
+func TestReceiptCache(t *testing.T) {
+	roomID := "!a"
+	loads := 0
+	var loadErr error
+	inDB := []internal.Receipt{{RoomID: roomID, UserID: "@alice", EventID: "$1"}}
+	cache := newReceiptCache(func(r string) ([]internal.Receipt, error) {
+		if r != roomID {
+			t.Fatalf("loaded %s want %s", r, roomID)
+		}
+		loads++
+		return inDB, loadErr
+	})
+
+	// not loaded yet so this is ignored
+	cache.OnReceipt(internal.Receipt{RoomID: roomID, UserID: "@bob", EventID: "$1"})
+
+	got, err := cache.Load(roomID)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	assertReceiptEvents(t, "first load", got, "@alice=$1")
+
+	cache.OnReceipt(internal.Receipt{RoomID: roomID, UserID: "@alice", EventID: "$2"})
+	cache.OnReceipt(internal.Receipt{RoomID: roomID, UserID: "@bob", EventID: "$2"})
+	cache.OnReceipt(internal.Receipt{RoomID: roomID, UserID: "@charlie", EventID: "$2", IsPrivate: true})
+	cache.OnReceipt(internal.Receipt{RoomID: roomID, UserID: "@doris", EventID: "$2", ThreadID: "$thread"})
+	got, err = cache.Load(roomID)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	assertReceiptEvents(t, "after receipts", got, "@alice=$2", "@bob=$2")
+	if loads != 1 {
+		t.Errorf("got %d loads want 1", loads)
+	}
+
+	cache.Forget(roomID)
+	loadErr = fmt.Errorf("boom")
+	if _, err = cache.Load(roomID); err == nil {
+		t.Fatalf("Load: want error, got none")
+	}
+	cache.OnReceipt(internal.Receipt{RoomID: roomID, UserID: "@alice", EventID: "$3"})
+	loadErr = nil
+	got, err = cache.Load(roomID)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	assertReceiptEvents(t, "after reloading", got, "@alice=$1")
+	if loads != 3 {
+		t.Errorf("got %d loads want 3", loads)
+	}
+}
+
+func TestReceiptCacheEvictsRooms(t *testing.T) {
+	cache := newReceiptCache(func(roomID string) ([]internal.Receipt, error) {
+		return nil, nil
+	})
+	for i := 0; i < maxReceiptCacheRooms+10; i++ {
+		if _, err := cache.Load(fmt.Sprintf("!%d", i)); err != nil {
+			t.Fatalf("Load: %s", err)
+		}
+	}
+	if len(cache.rooms) != maxReceiptCacheRooms {
+		t.Errorf("got %d rooms want %d", len(cache.rooms), maxReceiptCacheRooms)
+	}
+}
@@ -0,0 +1,163 @@
+package caches
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// Fields of internal.RoomMetadata checked when reconciling, used as metric labels.
+const (
+	FieldJoinCount       = "join_count"
+	FieldInviteCount     = "invite_count"
+	FieldHeroes          = "heroes"
+	FieldEncrypted       = "encrypted"
+	FieldChildSpaceRooms = "child_space_rooms"
+	FieldName            = "name"
+	FieldAvatar          = "avatar"
+	FieldCanonicalAlias  = "canonical_alias"
+)
+
+// RoomIDsAfter returns up to limit room IDs in the cache which sort after the given room ID, in order.
+// Pass the last room ID returned to get the next batch; an empty batch means the end was reached.
+func (c *GlobalCache) RoomIDsAfter(after string, limit int) []string {
+	var roomIDs []string
+	c.roomIDToMetadata.forEach(func(roomID string, _ *internal.RoomMetadata) {
+		if roomID > after {
+			roomIDs = append(roomIDs, roomID)
+		}
+	})
+	sort.Strings(roomIDs)
+	if len(roomIDs) > limit {
+		roomIDs = roomIDs[:limit]
+	}
+	return roomIDs
+}
+
+// ReconcileRoom recalculates the metadata for this room from the database and repairs the cached
+// metadata if it has drifted, e.g. due to missed or duplicated events. Returns the fields which
+// were repaired. Rooms which have changed since the cache last processed an event are skipped,
+// as the database may be ahead of the cache; they will be reconciled another time.
+func (c *GlobalCache) ReconcileRoom(ctx context.Context, roomID string) (repaired []string, err error) {
+	shard := c.roomIDToMetadata.shard(roomID)
+	shard.mu.RLock()
+	cached, ok := shard.rooms[roomID]
+	if !ok {
+		shard.mu.RUnlock()
+		return nil, nil
+	}
+	fresh := cached.DeepCopy()
+	seenNID := c.latestNID.Load()
+	shard.mu.RUnlock()
+
+	if err = c.store.ResetMetadataState(fresh); err != nil {
+		return nil, err
+	}
+	joins, invites, _, err := c.store.FetchMemberships(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch memberships: %w", err)
+	}
+	// read this last: if the room has no events past seenNID, then neither did the reads above.
+	latestNIDInRoom, err := c.store.LatestEventNIDInRoom(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch latest NID: %w", err)
+	}
+	if latestNIDInRoom > seenNID {
+		return nil, nil
+	}
+	members := make(map[string]struct{}, len(joins)+len(invites))
+	for _, userID := range append(joins, invites...) {
+		members[userID] = struct{}{}
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	cached, ok = shard.rooms[roomID]
+	if !ok || latestNIDInCachedRoom(cached) > seenNID {
+		// purged, or an event arrived while we were reading the database
+		return nil, nil
+	}
+	repaired = metadataDiscrepancies(cached, fresh, members)
+	for _, field := range repaired {
+		logger.Warn().Str("room_id", roomID).Str("field", field).Msg("ReconcileRoom: repairing drifted metadata")
+		repairMetadataField(cached, fresh, field)
+	}
+	return repaired, nil
+}
+
+func latestNIDInCachedRoom(m *internal.RoomMetadata) (nid int64) {
+	for _, ev := range m.LatestEventsByType {
+		if ev.NID > nid {
+			nid = ev.NID
+		}
+	}
+	return nid
+}
+
+// metadataDiscrepancies returns the fields which differ between the cached and freshly calculated
+// metadata. members is the set of joined and invited users. Heroes are chosen differently when
+// calculated incrementally, so they are only considered to have drifted if a cached hero is no longer
+// a member, or there are fewer cached heroes than there should be.
+func metadataDiscrepancies(cached, fresh *internal.RoomMetadata, members map[string]struct{}) (fields []string) {
+	if cached.JoinCount != fresh.JoinCount {
+		fields = append(fields, FieldJoinCount)
+	}
+	if cached.InviteCount != fresh.InviteCount {
+		fields = append(fields, FieldInviteCount)
+	}
+	heroesDrifted := len(cached.Heroes) < len(fresh.Heroes)
+	for _, h := range cached.Heroes {
+		if _, ok := members[h.ID]; !ok {
+			heroesDrifted = true
+		}
+	}
+	if heroesDrifted {
+		fields = append(fields, FieldHeroes)
+	}
+	if cached.Encrypted != fresh.Encrypted {
+		fields = append(fields, FieldEncrypted)
+	}
+	if len(cached.ChildSpaceRooms) != len(fresh.ChildSpaceRooms) {
+		fields = append(fields, FieldChildSpaceRooms)
+	} else {
+		for roomID := range fresh.ChildSpaceRooms {
+			if _, ok := cached.ChildSpaceRooms[roomID]; !ok {
+				fields = append(fields, FieldChildSpaceRooms)
+				break
+			}
+		}
+	}
+	if cached.NameEvent != fresh.NameEvent {
+		fields = append(fields, FieldName)
+	}
+	if cached.AvatarEvent != fresh.AvatarEvent {
+		fields = append(fields, FieldAvatar)
+	}
+	if cached.CanonicalAlias != fresh.CanonicalAlias {
+		fields = append(fields, FieldCanonicalAlias)
+	}
+	return fields
+}
+
+func repairMetadataField(cached, fresh *internal.RoomMetadata, field string) {
+	switch field {
+	case FieldJoinCount:
+		cached.JoinCount = fresh.JoinCount
+	case FieldInviteCount:
+		cached.InviteCount = fresh.InviteCount
+	case FieldHeroes:
+		cached.Heroes = fresh.Heroes
+	case FieldEncrypted:
+		cached.Encrypted = fresh.Encrypted
+	case FieldChildSpaceRooms:
+		cached.ChildSpaceRooms = fresh.ChildSpaceRooms
+	case FieldName:
+		cached.NameEvent = fresh.NameEvent
+	case FieldAvatar:
+		cached.AvatarEvent = fresh.AvatarEvent
+	case FieldCanonicalAlias:
+		cached.CanonicalAlias = fresh.CanonicalAlias
+	}
+}
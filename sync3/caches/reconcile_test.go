@@ -0,0 +1,80 @@
+package caches
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func TestMetadataDiscrepancies(t *testing.T) {
+	alice := internal.Hero{ID: "@alice:localhost", Name: "Alice"}
+	bob := internal.Hero{ID: "@bob:localhost", Name: "Bob"}
+	charlie := internal.Hero{ID: "@charlie:localhost", Name: "Charlie"}
+	members := map[string]struct{}{
+		alice.ID:   {},
+		bob.ID:     {},
+		charlie.ID: {},
+	}
+	newMetadata := func(heroes ...internal.Hero) *internal.RoomMetadata {
+		m := internal.NewRoomMetadata("!a:localhost")
+		m.JoinCount = 3
+		m.NameEvent = "Room"
+		m.Heroes = heroes
+		m.ChildSpaceRooms["!child:localhost"] = struct{}{}
+		return m
+	}
+	testCases := []struct {
+		name   string
+		cached *internal.RoomMetadata
+		fresh  *internal.RoomMetadata
+		want   []string
+	}{
+		{
+			name:   "no drift",
+			cached: newMetadata(alice, bob),
+			fresh:  newMetadata(alice, bob),
+		},
+		{
+			name:   "heroes chosen differently is not drift",
+			cached: newMetadata(alice, bob),
+			fresh:  newMetadata(charlie, bob),
+		},
+		{
+			name:   "hero is no longer a member",
+			cached: newMetadata(alice, internal.Hero{ID: "@eve:localhost"}),
+			fresh:  newMetadata(alice, bob),
+			want:   []string{FieldHeroes},
+		},
+		{
+			name:   "too few heroes",
+			cached: newMetadata(alice),
+			fresh:  newMetadata(alice, bob),
+			want:   []string{FieldHeroes},
+		},
+		{
+			name: "join count, name and space children",
+			cached: func() *internal.RoomMetadata {
+				m := newMetadata(alice, bob)
+				m.JoinCount = 4
+				m.NameEvent = "Old room"
+				m.ChildSpaceRooms = map[string]struct{}{"!other:localhost": {}}
+				return m
+			}(),
+			fresh: newMetadata(alice, bob),
+			want:  []string{FieldJoinCount, FieldChildSpaceRooms, FieldName},
+		},
+	}
+	for _, tc := range testCases {
+		got := metadataDiscrepancies(tc.cached, tc.fresh, members)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+		for _, field := range got {
+			repairMetadataField(tc.cached, tc.fresh, field)
+		}
+		if got := metadataDiscrepancies(tc.cached, tc.fresh, members); len(got) > 0 {
+			t.Errorf("%s: still drifted after repair: %v", tc.name, got)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package caches
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// numRoomShards is the number of independently locked shards room metadata is split into.
+const numRoomShards = 64
+
+// roomShard holds the metadata for a subset of rooms, guarded by its own lock.
+type roomShard struct {
+	mu    sync.RWMutex
+	rooms map[string]*internal.RoomMetadata
+}
+
+// roomShards is a map of room ID to metadata which is split into shards, so that updates to one
+// room only block readers and writers of rooms in the same shard.
+type roomShards [numRoomShards]*roomShard
+
+func newRoomShards() *roomShards {
+	var s roomShards
+	for i := range s {
+		s[i] = &roomShard{
+			rooms: make(map[string]*internal.RoomMetadata),
+		}
+	}
+	return &s
+}
+
+// shard returns the shard holding this room. The caller must lock it before accessing rooms.
+func (s *roomShards) shard(roomID string) *roomShard {
+	h := fnv.New32a()
+	h.Write([]byte(roomID))
+	return s[h.Sum32()%numRoomShards]
+}
+
+// len returns the total number of rooms. Shards are locked in turn, so this is not atomic.
+func (s *roomShards) len() int {
+	n := 0
+	for _, shard := range s {
+		shard.mu.RLock()
+		n += len(shard.rooms)
+		shard.mu.RUnlock()
+	}
+	return n
+}
+
+// forEach calls fn for every room, holding a read lock on the room's shard. Shards are locked in
+// turn, so rooms may change between calls to fn. fn must not modify the metadata.
+func (s *roomShards) forEach(fn func(roomID string, metadata *internal.RoomMetadata)) {
+	for _, shard := range s {
+		shard.mu.RLock()
+		for roomID, metadata := range shard.rooms {
+			fn(roomID, metadata)
+		}
+		shard.mu.RUnlock()
+	}
+}
@@ -0,0 +1,45 @@
+package caches
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func TestRoomShards(t *testing.T) {
+	s := newRoomShards()
+	const numRooms = 1000
+	var wg sync.WaitGroup
+	for i := 0; i < numRooms; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			roomID := fmt.Sprintf("!%d:localhost", i)
+			shard := s.shard(roomID)
+			shard.mu.Lock()
+			shard.rooms[roomID] = internal.NewRoomMetadata(roomID)
+			shard.mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	if got := s.len(); got != numRooms {
+		t.Fatalf("len: got %d want %d", got, numRooms)
+	}
+	seen := make(map[string]bool)
+	usedShards := make(map[*roomShard]bool)
+	s.forEach(func(roomID string, metadata *internal.RoomMetadata) {
+		if metadata.RoomID != roomID {
+			t.Errorf("forEach: room %s has metadata for %s", roomID, metadata.RoomID)
+		}
+		seen[roomID] = true
+		usedShards[s.shard(roomID)] = true
+	})
+	if len(seen) != numRooms {
+		t.Fatalf("forEach: saw %d rooms, want %d", len(seen), numRooms)
+	}
+	if len(usedShards) < numRoomShards/2 {
+		t.Errorf("rooms were only spread over %d shards", len(usedShards))
+	}
+}
@@ -0,0 +1,80 @@
+package caches
+
+import (
+	"unsafe"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// Rough per-entry overheads used when estimating the size of cached data. These do not need to
+// be accurate: they exist so that the memory budget scales with the number of rooms and users.
+const (
+	mapEntryOverhead   = 48
+	eventMetadataSize  = int64(unsafe.Sizeof(internal.EventMetadata{})) + mapEntryOverhead
+	roomMetadataSize   = int64(unsafe.Sizeof(internal.RoomMetadata{})) + mapEntryOverhead
+	userRoomDataSize   = int64(unsafe.Sizeof(UserRoomData{})) + mapEntryOverhead
+	heroSize           = int64(unsafe.Sizeof(internal.Hero{}))
+	stringPtrSize      = int64(unsafe.Sizeof(""))
+	spaceOrTagOverhead = mapEntryOverhead + 8
+)
+
+func estimateRoomMetadataSize(m *internal.RoomMetadata) int64 {
+	size := roomMetadataSize + int64(len(m.RoomID)+len(m.NameEvent)+len(m.AvatarEvent)+len(m.CanonicalAlias)+len(m.TypingEvent)+len(m.PinnedEvent))
+	for _, h := range m.Heroes {
+		size += heroSize + int64(len(h.ID)+len(h.Name)+len(h.Avatar))
+	}
+	for evType := range m.LatestEventsByType {
+		size += eventMetadataSize + int64(len(evType))
+	}
+	for roomID := range m.ChildSpaceRooms {
+		size += spaceOrTagOverhead + int64(len(roomID))
+	}
+	for _, s := range []*string{m.PredecessorRoomID, m.UpgradedRoomID, m.RoomType} {
+		if s != nil {
+			size += stringPtrSize + int64(len(*s))
+		}
+	}
+	return size
+}
+
+func estimateUserRoomDataSize(roomID string, u *UserRoomData) int64 {
+	size := userRoomDataSize + int64(len(roomID)+len(u.ComputedName)+len(u.CanonicalisedName)+len(u.ResolvedAvatarURL))
+	for spaceID := range u.Spaces {
+		size += spaceOrTagOverhead + int64(len(spaceID))
+	}
+	for tag := range u.Tags {
+		size += spaceOrTagOverhead + int64(len(tag))
+	}
+	if u.Invite != nil {
+		for _, ev := range u.Invite.InviteState {
+			size += int64(len(ev))
+		}
+	}
+	if u.Knock != nil {
+		for _, ev := range u.Knock.InviteState {
+			size += int64(len(ev))
+		}
+	}
+	return size
+}
+
+// EstimateSize returns an estimate of the number of bytes used by the global cache.
+func (c *GlobalCache) EstimateSize() int64 {
+	var size int64
+	c.roomIDToMetadata.forEach(func(_ string, m *internal.RoomMetadata) {
+		size += estimateRoomMetadataSize(m)
+	})
+	return size
+}
+
+// EstimateSize returns an estimate of the number of bytes used by this user cache.
+func (c *UserCache) EstimateSize() int64 {
+	c.roomToDataMu.RLock()
+	defer c.roomToDataMu.RUnlock()
+	var size int64
+	for roomID, urd := range c.roomToData {
+		urd := urd
+		size += estimateUserRoomDataSize(roomID, &urd)
+	}
+	return size
+}
@@ -0,0 +1,36 @@
+package caches
+
+import (
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func TestEstimateRoomMetadataSizeGrows(t *testing.T) {
+	m := internal.NewRoomMetadata("!a:localhost")
+	empty := estimateRoomMetadataSize(m)
+	if empty <= 0 {
+		t.Fatalf("empty room metadata has size %d, want > 0", empty)
+	}
+	m.NameEvent = "A room name"
+	m.Heroes = []internal.Hero{{ID: "@alice:localhost", Name: "Alice"}}
+	m.LatestEventsByType["m.room.message"] = internal.EventMetadata{NID: 1, Timestamp: 2}
+	if got := estimateRoomMetadataSize(m); got <= empty {
+		t.Fatalf("room metadata size did not grow: got %d, empty was %d", got, empty)
+	}
+}
+
+func TestUserCacheEstimateSize(t *testing.T) {
+	uc := NewUserCache("@alice:localhost", nil, nil, nil, nil)
+	if got := uc.EstimateSize(); got != 0 {
+		t.Fatalf("empty user cache has size %d, want 0", got)
+	}
+	urd := NewUserRoomData()
+	urd.Tags["m.favourite"] = 0.5
+	uc.roomToData["!a:localhost"] = urd
+	uc.roomToData["!b:localhost"] = NewUserRoomData()
+	one := estimateUserRoomDataSize("!b:localhost", &UserRoomData{})
+	if got := uc.EstimateSize(); got <= 2*one {
+		t.Fatalf("user cache with 2 rooms and a tag has size %d, want > %d", got, 2*one)
+	}
+}
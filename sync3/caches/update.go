@@ -38,6 +38,26 @@ func (u *InviteUpdate) Type() string {
 	return fmt.Sprintf("InviteUpdate[%s]", u.RoomID())
 }
 
+// KnockUpdate corresponds to a key-value pair from a v2 sync's `knock` section.
+type KnockUpdate struct {
+	RoomUpdate
+	KnockData InviteData
+}
+
+func (u *KnockUpdate) Type() string {
+	return fmt.Sprintf("KnockUpdate[%s]", u.RoomID())
+}
+
+// RoomPurgedUpdate is sent when a room has been purged from the proxy. The room must be removed from
+// lists and room subscriptions, as it will never receive another update.
+type RoomPurgedUpdate struct {
+	RoomUpdate
+}
+
+func (u *RoomPurgedUpdate) Type() string {
+	return fmt.Sprintf("RoomPurgedUpdate[%s]", u.RoomID())
+}
+
 // TypingEdu corresponds to a typing EDU in the `ephemeral` section of a joined room's v2 sync resposne.
 type TypingUpdate struct {
 	RoomUpdate
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
 
 	"github.com/getsentry/sentry-go"
@@ -41,13 +42,18 @@ type JoinChecker interface {
 type UserRoomData struct {
 	IsDM              bool
 	IsInvite          bool
+	IsKnock           bool
 	HasLeft           bool
 	NotificationCount int
 	HighlightCount    int
 	Invite            *InviteData
+	// Knock is the knock_state for rooms we have knocked on, which is processed in the same way as
+	// invite_state.
+	Knock *InviteData
 
-	// TODO: should CanonicalisedName really be in RoomConMetadata? It's only set in SetRoom AFAICS
-	CanonicalisedName string // stripped leading symbols like #, all in lower case
+	// TODO: should ComputedName/CanonicalisedName really be in RoomConMetadata? They're only set in SetRoom AFAICS
+	ComputedName      string // the room name according to the spec room name algorithm
+	CanonicalisedName string // ComputedName with leading symbols like # stripped, all in lower case
 	// Set of spaces this room is a part of, from the perspective of this user. This is NOT global room data
 	// as the set of spaces may be different for different users.
 
@@ -97,42 +103,45 @@ func NewInviteData(ctx context.Context, userID, roomID string, inviteState []jso
 		InviteState: inviteState,
 	}
 	for _, ev := range inviteState {
-		j := gjson.ParseBytes(ev)
+		j := internal.ParseEvent(ev)
 
-		switch j.Get("type").Str {
+		switch j.Type {
 		case "m.room.member":
-			target := j.Get("state_key").Str
+			var target string
+			if j.StateKey != nil {
+				target = *j.StateKey
+			}
 			if userID == target {
 				// this is our invite event; grab the timestamp
-				ts := j.Get("origin_server_ts").Int()
-				id.LastMessageTimestamp = uint64(ts)
+				id.LastMessageTimestamp = j.Timestamp
 				id.InviteEvent = &EventData{
 					Event:         ev,
 					RoomID:        roomID,
 					EventType:     "m.room.member",
 					StateKey:      &target,
-					Content:       j.Get("content"),
-					Timestamp:     uint64(ts),
+					Content:       j.Content,
+					Timestamp:     j.Timestamp,
+					Membership:    j.Membership(),
 					AlwaysProcess: true,
 				}
-				id.IsDM = j.Get("content.is_direct").Bool()
-			} else if target == j.Get("sender").Str {
+				id.IsDM = j.Content.Get("is_direct").Bool()
+			} else if target == j.Sender {
 				id.Heroes = append(id.Heroes, internal.Hero{
 					ID:     target,
-					Name:   j.Get("content.displayname").Str,
-					Avatar: j.Get("content.avatar_url").Str,
+					Name:   j.Content.Get("displayname").Str,
+					Avatar: j.Content.Get("avatar_url").Str,
 				})
 			}
 		case "m.room.name":
-			id.NameEvent = j.Get("content.name").Str
+			id.NameEvent = j.Content.Get("name").Str
 		case "m.room.avatar":
-			id.AvatarEvent = j.Get("content.url").Str
+			id.AvatarEvent = j.Content.Get("url").Str
 		case "m.room.canonical_alias":
-			id.CanonicalAlias = j.Get("content.alias").Str
+			id.CanonicalAlias = j.Content.Get("alias").Str
 		case "m.room.encryption":
 			id.Encrypted = true
 		case "m.room.create":
-			id.RoomType = j.Get("content.type").Str
+			id.RoomType = j.Content.Get("type").Str
 		}
 	}
 	if id.InviteEvent == nil {
@@ -152,6 +161,22 @@ func NewInviteData(ctx context.Context, userID, roomID string, inviteState []jso
 	return &id
 }
 
+// RequiredState returns the stripped state events in the invite_state which match the required
+// state map, so invite previews can use the same required_state as joined rooms.
+func (i *InviteData) RequiredState(rsm *internal.RequiredStateMap) []json.RawMessage {
+	requiredState := make([]json.RawMessage, 0, len(i.InviteState))
+	for _, ev := range i.InviteState {
+		j := internal.ParseEvent(ev)
+		if j.StateKey == nil {
+			continue
+		}
+		if rsm.Include(j.Type, *j.StateKey) {
+			requiredState = append(requiredState, ev)
+		}
+	}
+	return requiredState
+}
+
 func (i *InviteData) RoomMetadata() *internal.RoomMetadata {
 	var roomType *string
 	if i.RoomType != "" {
@@ -181,8 +206,11 @@ type UserCacheListener interface {
 
 // Subset of store functions used by the user cache
 type UserCacheStore interface {
-	LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string]*state.LatestEvents, error)
+	LatestEventsInRooms(ctx context.Context, userID string, roomIDs []string, to int64, limit int, filter internal.EventTypeFilter) (map[string]*state.LatestEvents, error)
 	GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch string)
+	LeaveNIDs(ctx context.Context, userID string, roomIDs []string) (map[string]int64, error)
+	BundledAggregations(ctx context.Context, userID string, events []json.RawMessage) (map[string]json.RawMessage, error)
+	PollResults(ctx context.Context, userID string, events []json.RawMessage) (map[string]json.RawMessage, error)
 }
 
 // Tracks data specific to a given user. Specifically, this is the map of room ID to UserRoomData.
@@ -322,15 +350,19 @@ func (c *UserCache) OnRegistered(ctx context.Context) error {
 // Only events with NID <= loadPos are returned.
 // Events from senders ignored by this user are dropped.
 // Returns nil on error.
-func (c *UserCache) LazyLoadTimelines(ctx context.Context, loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+func (c *UserCache) LazyLoadTimelines(ctx context.Context, loadPos int64, roomIDs []string, maxTimelineEvents int, filter internal.EventTypeFilter) map[string]state.LatestEvents {
 	_, span := internal.StartSpan(ctx, "LazyLoadTimelines")
 	defer span.End()
 	if c.LazyLoadTimelinesOverride != nil {
 		return c.LazyLoadTimelinesOverride(loadPos, roomIDs, maxTimelineEvents)
 	}
 	result := make(map[string]state.LatestEvents)
-	roomIDToLatestEvents, err := c.store.LatestEventsInRooms(c.UserID, roomIDs, loadPos, maxTimelineEvents)
+	c.globalCache.Metrics().DBFallback(CacheUserTimelines, len(roomIDs))
+	roomIDToLatestEvents, err := c.store.LatestEventsInRooms(ctx, c.UserID, roomIDs, loadPos, maxTimelineEvents, filter)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil // the client went away, the caller will abort the request
+		}
 		logger.Err(err).Strs("rooms", roomIDs).Msg("failed to get LatestEventsInRooms")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return nil
@@ -350,8 +382,10 @@ func (c *UserCache) LoadRoomData(roomID string) UserRoomData {
 	defer c.roomToDataMu.RUnlock()
 	data, ok := c.roomToData[roomID]
 	if !ok {
+		c.globalCache.Metrics().Miss(CacheUserRooms, 1)
 		return NewUserRoomData()
 	}
+	c.globalCache.Metrics().Hit(CacheUserRooms, 1)
 	return data
 }
 
@@ -360,13 +394,17 @@ func (c *UserCache) LoadRooms(roomIDs ...string) map[string]UserRoomData {
 	result := make(map[string]UserRoomData, len(roomIDs))
 	c.roomToDataMu.RLock()
 	defer c.roomToDataMu.RUnlock()
+	misses := 0
 	for _, roomID := range roomIDs {
 		data, ok := c.roomToData[roomID]
 		if !ok {
 			data = NewUserRoomData()
+			misses++
 		}
 		result[roomID] = data
 	}
+	c.globalCache.Metrics().Hit(CacheUserRooms, len(roomIDs)-misses)
+	c.globalCache.Metrics().Miss(CacheUserRooms, misses)
 	return result
 }
 
@@ -427,6 +465,19 @@ func (c *UserCache) Invites() map[string]UserRoomData {
 	return invites
 }
 
+func (c *UserCache) Knocks() map[string]UserRoomData {
+	c.roomToDataMu.Lock()
+	defer c.roomToDataMu.Unlock()
+	knocks := make(map[string]UserRoomData)
+	for roomID, urd := range c.roomToData {
+		if !urd.IsKnock || urd.Knock == nil {
+			continue
+		}
+		knocks[roomID] = urd
+	}
+	return knocks
+}
+
 // AttemptToFetchPrevBatch tries to find a prev_batch value for the given event. This may not always succeed.
 func (c *UserCache) AttemptToFetchPrevBatch(ctx context.Context, roomID string, firstTimelineEvent *EventData) (prevBatch string) {
 	_, span := internal.StartSpan(ctx, "AttemptToFetchPrevBatch")
@@ -434,6 +485,24 @@ func (c *UserCache) AttemptToFetchPrevBatch(ctx context.Context, roomID string,
 	return c.store.GetClosestPrevBatch(roomID, firstTimelineEvent.NID)
 }
 
+// LeavePositions returns the NID of this user's leave event in each of the given rooms they have
+// left, for loading the state of the room as of that event. See state.Storage.LeaveNIDs for rooms
+// where the leave event was not recorded.
+func (c *UserCache) LeavePositions(ctx context.Context, roomIDs []string) map[string]int64 {
+	_, span := internal.StartSpan(ctx, "LeavePositions")
+	defer span.End()
+	leaveNIDs, err := c.store.LeaveNIDs(ctx, c.UserID, roomIDs)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil // the client went away, the caller will abort the request
+		}
+		logger.Err(err).Str("user", c.UserID).Strs("rooms", roomIDs).Msg("failed to load leave positions")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return nil
+	}
+	return leaveNIDs
+}
+
 // AnnotateWithTransactionIDs should be called just prior to returning events to the client. This
 // will modify the events to insert the correct transaction IDs if needed. This is required because
 // events are globally scoped, so if Alice sends a message, Bob might receive it first on his v2 loop
@@ -449,10 +518,14 @@ func (c *UserCache) AnnotateWithTransactionIDs(ctx context.Context, userID strin
 	})
 	for roomID, events := range roomIDToEvents {
 		for i, evJSON := range events {
-			ev := gjson.ParseBytes(evJSON)
-			evID := ev.Get("event_id").Str
-			sender := ev.Get("sender").Str
-			if sender != userID {
+			ev := internal.ParseEvent(evJSON)
+			if ev.Unsigned.Get("transaction_id").Exists() {
+				// events stored by older versions may include the sender's txn ID, which may
+				// not be for this device.
+				events[i] = internal.StripTransactionID(evJSON)
+			}
+			evID := ev.ID
+			if ev.Sender != userID {
 				// don't ask for txn IDs for events which weren't sent by us.
 				// If we do, we'll needlessly hit the database, increasing latencies when
 				// catching up from the live buffer.
@@ -492,6 +565,79 @@ func (c *UserCache) AnnotateWithTransactionIDs(ctx context.Context, userID strin
 	return roomIDToEvents
 }
 
+// AnnotateWithRelations bundles the aggregations of each event's relations into its
+// unsigned.m.relations, e.g reaction counts, the latest edit and thread summaries, and the results
+// of polls into the unsigned data of poll start events, so clients don't need to fetch them
+// separately. Failures are logged and leave the events untouched.
+//
+// Any m.relations the homeserver bundled are kept, as they were when the proxy first saw the event,
+// for the relation types the proxy has no aggregations of.
+//
+// Only initial room timelines are annotated. Live events are sent as they arrive, as they are new
+// and so have no relations yet; the client sees their relations as they arrive as live events.
+func (c *UserCache) AnnotateWithRelations(ctx context.Context, userID string, roomIDToEvents map[string][]json.RawMessage) map[string][]json.RawMessage {
+	_, span := internal.StartSpan(ctx, "AnnotateWithRelations")
+	defer span.End()
+	var events []json.RawMessage
+	for _, roomEvents := range roomIDToEvents {
+		events = append(events, roomEvents...)
+	}
+	if len(events) == 0 {
+		return roomIDToEvents
+	}
+	annotations := []struct {
+		path string
+		load func(ctx context.Context, userID string, events []json.RawMessage) (map[string]json.RawMessage, error)
+		// merge sets each key of the loaded object separately, keeping the event's other keys
+		merge bool
+	}{
+		{path: `unsigned.m\.relations`, load: c.store.BundledAggregations, merge: true},
+		{path: "unsigned." + escapePath(state.PollResultsKey), load: c.store.PollResults},
+	}
+	for _, annotation := range annotations {
+		eventIDToValue, err := annotation.load(ctx, userID, events)
+		if err != nil {
+			logger.Err(err).Str("user", c.UserID).Str("path", annotation.path).Msg("AnnotateWithRelations: failed to load annotations")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			continue
+		}
+		if len(eventIDToValue) == 0 {
+			continue
+		}
+		for _, roomEvents := range roomIDToEvents {
+			for i, ev := range roomEvents {
+				value, ok := eventIDToValue[gjson.GetBytes(ev, "event_id").Str]
+				if !ok {
+					continue
+				}
+				var newJSON []byte
+				var err error
+				if annotation.merge {
+					newJSON = ev
+					gjson.ParseBytes(value).ForEach(func(key, v gjson.Result) bool {
+						newJSON, err = sjson.SetRawBytes(newJSON, annotation.path+"."+escapePath(key.Str), []byte(v.Raw))
+						return err == nil
+					})
+				} else {
+					newJSON, err = sjson.SetRawBytes(ev, annotation.path, value)
+				}
+				if err != nil {
+					logger.Err(err).Str("user", c.UserID).Msg("AnnotateWithRelations: sjson failed")
+					internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+					continue
+				}
+				roomEvents[i] = newJSON
+			}
+		}
+	}
+	return roomIDToEvents
+}
+
+// escapePath escapes the dots in a key, so it can be used as part of a gjson/sjson path.
+func escapePath(key string) string {
+	return strings.ReplaceAll(key, ".", `\.`)
+}
+
 // =================================================
 // Listener functions called by v2 pollers are below
 // =================================================
@@ -600,6 +746,13 @@ func (c *UserCache) OnNewEvent(ctx context.Context, eventData *EventData) {
 			urd.HighlightCount = 0
 		}
 	}
+	// likewise for the IsKnock field when the knock is accepted
+	if urd.IsKnock && eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID {
+		urd.IsKnock = eventData.Content.Get("membership").Str == "knock"
+		if !urd.IsKnock {
+			urd.Knock = nil
+		}
+	}
 	if eventData.EventType == "m.space.child" && eventData.StateKey != nil {
 		// the children for a space we are a part of have changed. Find the room that was affected and update our cache value.
 		childRoomID := *eventData.StateKey
@@ -647,26 +800,58 @@ func (c *UserCache) OnInvite(ctx context.Context, roomID string, inviteStateEven
 	c.emitOnRoomUpdate(ctx, up)
 }
 
+func (c *UserCache) OnKnock(ctx context.Context, roomID string, knockStateEvents []json.RawMessage) {
+	knockData := NewInviteData(ctx, c.UserID, roomID, knockStateEvents)
+	if knockData == nil {
+		return // malformed knock
+	}
+
+	urd := c.LoadRoomData(roomID)
+	urd.IsKnock = true
+	urd.HasLeft = false
+	urd.Knock = knockData
+	c.roomToDataMu.Lock()
+	c.roomToData[roomID] = urd
+	c.roomToDataMu.Unlock()
+
+	up := &KnockUpdate{
+		RoomUpdate: &roomUpdateCache{
+			roomID: roomID,
+			// do NOT pull from the global cache, for the same reasons as invites
+			globalRoomData: knockData.RoomMetadata(),
+			userRoomData:   &urd,
+		},
+		KnockData: *knockData,
+	}
+	c.emitOnRoomUpdate(ctx, up)
+}
+
 func (c *UserCache) OnLeftRoom(ctx context.Context, roomID string, leaveEvent json.RawMessage) {
 	urd := c.LoadRoomData(roomID)
-	wasInvite := urd.IsInvite
+	wasInviteOrKnock := urd.IsInvite || urd.IsKnock
 	urd.IsInvite = false
+	urd.IsKnock = false
 	urd.HasLeft = true
 	urd.Invite = nil
+	urd.Knock = nil
 	urd.HighlightCount = 0
+	urd.NotificationCount = 0
 	c.roomToDataMu.Lock()
 	c.roomToData[roomID] = urd
 	c.roomToDataMu.Unlock()
 
-	ev := gjson.ParseBytes(leaveEvent)
-	stateKey := ev.Get("state_key").Str
-	sender := ev.Get("sender").Str
-	evType := ev.Get("type").Str
+	ev := internal.ParseEvent(leaveEvent)
+	var stateKey string
+	if ev.StateKey != nil {
+		stateKey = *ev.StateKey
+	}
+	sender := ev.Sender
+	evType := ev.Type
 
 	// If the event in question is a kick, we should AlwaysProcess this to make sure the client
 	// knows about the "leave"
 	isKick := false
-	if evType == "m.room.member" && ev.Get("content.membership").Str == "leave" && stateKey != sender {
+	if evType == "m.room.member" && ev.Membership() == "leave" && stateKey != sender {
 		isKick = true
 	}
 
@@ -679,16 +864,61 @@ func (c *UserCache) OnLeftRoom(ctx context.Context, roomID string, leaveEvent js
 			userRoomData:   &urd,
 		},
 		EventData: &EventData{
-			Event:     leaveEvent,
-			RoomID:    roomID,
-			EventType: evType,
-			StateKey:  &stateKey,
-			Content:   ev.Get("content"),
-			Timestamp: ev.Get("origin_server_ts").Uint(),
-			Sender:    sender,
-			// if this is an invite rejection/a kick we need to make sure we tell the client, and not
-			// skip it because of the lack of a NID (this event may not be in the events table)
-			AlwaysProcess: wasInvite || isKick,
+			Event:      leaveEvent,
+			RoomID:     roomID,
+			EventType:  evType,
+			StateKey:   &stateKey,
+			Content:    ev.Content,
+			Timestamp:  ev.Timestamp,
+			Sender:     sender,
+			Membership: ev.Membership(),
+			// if this is an invite rejection/a rescinded knock/a kick we need to make sure we tell the
+			// client, and not skip it because of the lack of a NID (this event may not be in the events table)
+			AlwaysProcess: wasInviteOrKnock || isKick,
+		},
+	}
+	c.emitOnRoomUpdate(ctx, up)
+}
+
+// OnPurgeRoom forgets the room and tells connections to remove it, as if the user had left it.
+func (c *UserCache) OnPurgeRoom(ctx context.Context, roomID string) {
+	urd := c.LoadRoomData(roomID)
+	urd.IsInvite = false
+	urd.IsKnock = false
+	urd.HasLeft = true
+	urd.Invite = nil
+	urd.Knock = nil
+	urd.HighlightCount = 0
+	urd.NotificationCount = 0
+	c.roomToDataMu.Lock()
+	delete(c.roomToData, roomID)
+	c.roomToDataMu.Unlock()
+
+	up := &RoomPurgedUpdate{
+		RoomUpdate: &roomUpdateCache{
+			roomID: roomID,
+			// the room is no longer in the global cache
+			globalRoomData: internal.NewRoomMetadata(roomID),
+			userRoomData:   &urd,
+		},
+	}
+	c.emitOnRoomUpdate(ctx, up)
+}
+
+// OnStateRewind tells connections to resend the room in full, as its state has changed in a way
+// which cannot be expressed as new events. The global cache must already have been reloaded.
+func (c *UserCache) OnStateRewind(ctx context.Context, roomID string) {
+	roomUpdate := c.newRoomUpdate(ctx, roomID)
+	metadata := roomUpdate.GlobalRoomMetadata()
+	up := &RoomEventUpdate{
+		RoomUpdate: roomUpdate,
+		EventData: &EventData{
+			RoomID:      roomID,
+			JoinCount:   metadata.JoinCount,
+			InviteCount: metadata.InviteCount,
+			// there is no event, so there is no NID to compare against load positions
+			AlwaysProcess: true,
+			ForceInitial:  true,
 		},
 	}
 	c.emitOnRoomUpdate(ctx, up)
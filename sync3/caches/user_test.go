@@ -7,6 +7,7 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
@@ -97,6 +98,32 @@ func TestAnnotateWithTransactionIDs(t *testing.T) {
 	}
 }
 
+func TestAnnotateWithTransactionIDsStripsStoredTransactionIDs(t *testing.T) {
+	userID := "@alice:localhost"
+	fetcher := &txnIDFetcher{
+		data: map[string]string{"$mine": "my-txn"},
+	}
+	uc := caches.NewUserCache(userID, nil, nil, fetcher, &joinChecker{})
+	got := uc.AnnotateWithTransactionIDs(context.Background(), userID, "DEVICE", map[string][]json.RawMessage{
+		"!a": {
+			// sent by another device, stored with that device's txn ID
+			json.RawMessage(`{"event_id":"$other","type":"x","sender":"@alice:localhost","unsigned":{"transaction_id":"other-txn"}}`),
+			json.RawMessage(`{"event_id":"$mine","type":"x","sender":"@alice:localhost","unsigned":{"transaction_id":"stale"}}`),
+			json.RawMessage(`{"event_id":"$bob","type":"x","sender":"@bob:localhost","unsigned":{"age":1,"transaction_id":"bob-txn"}}`),
+		},
+	})
+	want := map[string][]json.RawMessage{
+		"!a": {
+			json.RawMessage(`{"event_id":"$other","type":"x","sender":"@alice:localhost"}`),
+			json.RawMessage(`{"event_id":"$mine","type":"x","sender":"@alice:localhost","unsigned":{"transaction_id":"my-txn"}}`),
+			json.RawMessage(`{"event_id":"$bob","type":"x","sender":"@bob:localhost","unsigned":{"age":1}}`),
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", js(got), js(want))
+	}
+}
+
 func js(in interface{}) string {
 	b, _ := json.Marshal(in)
 	return string(b)
@@ -129,3 +156,181 @@ func convertIDTxnToEventStub(sender string, roomToEventIDs map[string][][2]strin
 	}
 	return result
 }
+
+func TestInviteDataRequiredState(t *testing.T) {
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	roomID := "!invite:localhost"
+	inviteEvent := json.RawMessage(fmt.Sprintf(`{"type":"m.room.member","state_key":"%s","sender":"%s","content":{"membership":"invite"},"origin_server_ts":123}`, alice, bob))
+	bobMember := json.RawMessage(fmt.Sprintf(`{"type":"m.room.member","state_key":"%s","sender":"%s","content":{"membership":"join"}}`, bob, bob))
+	name := json.RawMessage(fmt.Sprintf(`{"type":"m.room.name","state_key":"","sender":"%s","content":{"name":"Invite"}}`, bob))
+	avatar := json.RawMessage(fmt.Sprintf(`{"type":"m.room.avatar","state_key":"","sender":"%s","content":{"url":"mxc://a/b"}}`, bob))
+	topic := json.RawMessage(fmt.Sprintf(`{"type":"m.room.topic","state_key":"","sender":"%s","content":{"topic":"hello"}}`, bob))
+	joinRules := json.RawMessage(fmt.Sprintf(`{"type":"m.room.join_rules","state_key":"","sender":"%s","content":{"join_rule":"knock"}}`, bob))
+	invite := caches.NewInviteData(context.Background(), alice, roomID, []json.RawMessage{
+		inviteEvent, bobMember, name, avatar, topic, joinRules,
+	})
+	if invite == nil {
+		t.Fatalf("NewInviteData returned nil")
+	}
+	testCases := []struct {
+		name string
+		rsm  *internal.RequiredStateMap
+		want []json.RawMessage
+	}{
+		{
+			name: "all state",
+			rsm:  internal.NewRequiredStateMap(nil, nil, nil, true, false),
+			want: []json.RawMessage{inviteEvent, bobMember, name, avatar, topic, joinRules},
+		},
+		{
+			name: "specific types",
+			rsm: internal.NewRequiredStateMap(nil, nil, map[string][]string{
+				"m.room.topic":      {""},
+				"m.room.join_rules": {""},
+				"m.room.member":     {alice},
+			}, false, false),
+			want: []json.RawMessage{inviteEvent, topic, joinRules},
+		},
+		{
+			name: "nothing",
+			rsm:  internal.NewRequiredStateMap(nil, nil, nil, false, false),
+			want: []json.RawMessage{},
+		},
+	}
+	for _, tc := range testCases {
+		got := invite.RequiredState(tc.rsm)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %s want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+type aggregationsStore struct {
+	caches.UserCacheStore
+	eventIDToRelations   map[string]json.RawMessage
+	eventIDToPollResults map[string]json.RawMessage
+}
+
+func (s *aggregationsStore) BundledAggregations(ctx context.Context, userID string, events []json.RawMessage) (map[string]json.RawMessage, error) {
+	return s.eventIDToRelations, nil
+}
+
+func (s *aggregationsStore) PollResults(ctx context.Context, userID string, events []json.RawMessage) (map[string]json.RawMessage, error) {
+	return s.eventIDToPollResults, nil
+}
+
+func TestAnnotateWithRelations(t *testing.T) {
+	userID := "@alice:localhost"
+	store := &aggregationsStore{
+		eventIDToRelations: map[string]json.RawMessage{
+			"$foo": json.RawMessage(`{"m.annotation":{"chunk":[{"type":"m.reaction","key":"👍","count":1}]}}`),
+			"$baz": json.RawMessage(`{"m.annotation":{"chunk":[{"type":"m.reaction","key":"👍","count":2}]}}`),
+		},
+	}
+	uc := caches.NewUserCache(userID, nil, store, nil, &joinChecker{})
+	got := uc.AnnotateWithRelations(context.Background(), userID, map[string][]json.RawMessage{
+		"!a": {
+			json.RawMessage(`{"event_id":"$foo","type":"x","sender":"@alice:localhost","unsigned":{"age":1}}`),
+			json.RawMessage(`{"event_id":"$bar","type":"x","sender":"@alice:localhost"}`),
+			// relations bundled by the homeserver are kept unless the proxy has its own
+			json.RawMessage(`{"event_id":"$baz","type":"x","sender":"@alice:localhost","unsigned":{"m.relations":{"m.annotation":{"chunk":[]},"m.thread":{"count":1}}}}`),
+			json.RawMessage(`{"event_id":"$qux","type":"x","sender":"@alice:localhost","unsigned":{"m.relations":{"m.thread":{"count":1}}}}`),
+		},
+	})
+	want := map[string][]json.RawMessage{
+		"!a": {
+			json.RawMessage(`{"event_id":"$foo","type":"x","sender":"@alice:localhost","unsigned":{"age":1,"m.relations":{"m.annotation":{"chunk":[{"type":"m.reaction","key":"👍","count":1}]}}}}`),
+			json.RawMessage(`{"event_id":"$bar","type":"x","sender":"@alice:localhost"}`),
+			json.RawMessage(`{"event_id":"$baz","type":"x","sender":"@alice:localhost","unsigned":{"m.relations":{"m.annotation":{"chunk":[{"type":"m.reaction","key":"👍","count":2}]},"m.thread":{"count":1}}}}`),
+			json.RawMessage(`{"event_id":"$qux","type":"x","sender":"@alice:localhost","unsigned":{"m.relations":{"m.thread":{"count":1}}}}`),
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", js(got), js(want))
+	}
+}
+
+func TestAnnotateWithPollResults(t *testing.T) {
+	userID := "@alice:localhost"
+	store := &aggregationsStore{
+		eventIDToPollResults: map[string]json.RawMessage{
+			"$poll": json.RawMessage(`{"answers":{"a":1,"b":0},"total_voters":1,"ended":false}`),
+		},
+	}
+	uc := caches.NewUserCache(userID, nil, store, nil, &joinChecker{})
+	got := uc.AnnotateWithRelations(context.Background(), userID, map[string][]json.RawMessage{
+		"!a": {json.RawMessage(`{"event_id":"$poll","type":"m.poll.start","sender":"@alice:localhost"}`)},
+	})
+	want := map[string][]json.RawMessage{
+		"!a": {json.RawMessage(`{"event_id":"$poll","type":"m.poll.start","sender":"@alice:localhost","unsigned":{"org.matrix.sliding_sync.poll_results":{"answers":{"a":1,"b":0},"total_voters":1,"ended":false}}}`)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", js(got), js(want))
+	}
+}
+
+type roomUpdateCollector struct {
+	updates []caches.RoomUpdate
+}
+
+func (c *roomUpdateCollector) OnRoomUpdate(ctx context.Context, up caches.RoomUpdate) {
+	c.updates = append(c.updates, up)
+}
+func (c *roomUpdateCollector) OnUpdate(ctx context.Context, up caches.Update) {}
+
+func TestUserCacheKnocks(t *testing.T) {
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	roomID := "!knock:localhost"
+	knockEvent := json.RawMessage(fmt.Sprintf(`{"type":"m.room.member","state_key":"%s","sender":"%s","content":{"membership":"knock"},"origin_server_ts":123}`, alice, alice))
+	name := json.RawMessage(fmt.Sprintf(`{"type":"m.room.name","state_key":"","sender":"%s","content":{"name":"Knock"}}`, bob))
+	uc := caches.NewUserCache(alice, caches.NewGlobalCache(nil), nil, &txnIDFetcher{}, &joinChecker{})
+	var collector roomUpdateCollector
+	uc.Subsribe(&collector)
+
+	uc.OnKnock(context.Background(), roomID, []json.RawMessage{name, knockEvent})
+	if len(collector.updates) != 1 {
+		t.Fatalf("got %d updates, want 1", len(collector.updates))
+	}
+	up, ok := collector.updates[0].(*caches.KnockUpdate)
+	if !ok {
+		t.Fatalf("got update %T, want *caches.KnockUpdate", collector.updates[0])
+	}
+	if up.GlobalRoomMetadata().NameEvent != "Knock" || up.GlobalRoomMetadata().LastMessageTimestamp != 123 {
+		t.Errorf("got metadata %+v, want it from the knock_state", up.GlobalRoomMetadata())
+	}
+	knocks := uc.Knocks()
+	if urd, ok := knocks[roomID]; !ok || !urd.IsKnock || !reflect.DeepEqual(urd.Knock.InviteState, []json.RawMessage{name, knockEvent}) {
+		t.Fatalf("got knocks %+v, want %s with its knock_state", knocks, roomID)
+	}
+	if len(uc.Invites()) != 0 {
+		t.Errorf("knock was returned as an invite")
+	}
+
+	// the knock is accepted
+	stateKey := alice
+	uc.OnNewEvent(context.Background(), &caches.EventData{
+		RoomID:    roomID,
+		EventType: "m.room.member",
+		StateKey:  &stateKey,
+		Content:   internal.ParseEvent(json.RawMessage(`{"content":{"membership":"join"}}`)).Content,
+	})
+	if urd := uc.LoadRoomData(roomID); urd.IsKnock || urd.Knock != nil {
+		t.Errorf("room is still a knock after joining: %+v", urd)
+	}
+	if len(uc.Knocks()) != 0 {
+		t.Errorf("got knocks %v after joining, want none", uc.Knocks())
+	}
+
+	// a knock which is rescinded is always sent to connections, as the leave isn't in the timeline
+	uc.OnKnock(context.Background(), roomID, []json.RawMessage{name, knockEvent})
+	collector.updates = nil
+	uc.OnLeftRoom(context.Background(), roomID, json.RawMessage(fmt.Sprintf(`{"type":"m.room.member","state_key":"%s","sender":"%s","content":{"membership":"leave"}}`, alice, alice)))
+	if urd := uc.LoadRoomData(roomID); urd.IsKnock || urd.Knock != nil || !urd.HasLeft {
+		t.Errorf("got %+v after rescinding the knock, want a left room", urd)
+	}
+	if len(collector.updates) != 1 || !collector.updates[0].(*caches.RoomEventUpdate).EventData.AlwaysProcess {
+		t.Errorf("got updates %v, want one which is always processed", collector.updates)
+	}
+}
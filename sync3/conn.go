@@ -2,6 +2,7 @@ package sync3
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"runtime/debug"
 	"sync"
@@ -16,6 +17,20 @@ import (
 // /sync?pos=5 then /sync?pos=5 over and over. Likewise /sync without a ?pos=.
 var SpamProtectionInterval = 10 * time.Millisecond
 
+type clientCtxKey struct{}
+
+// ClientContext returns the context of the client's HTTP request, which is only cancelled when the
+// client goes away. The context given to ConnHandler.OnIncomingRequest is also cancelled when the
+// client sends another request on the same connection, which should interrupt waiting for live
+// updates but not loading data for a response: that response is buffered and sent to the client
+// before the response to the newer request.
+func ClientContext(ctx context.Context) context.Context {
+	if clientCtx, ok := ctx.Value(clientCtxKey{}).(context.Context); ok {
+		return clientCtx
+	}
+	return ctx
+}
+
 type ConnID struct {
 	UserID   string
 	DeviceID string
@@ -59,6 +74,10 @@ type Conn struct {
 	serverResponses []Response
 	lastPos         int64
 
+	// true if the client went away part way through a request being processed. The handler may have
+	// updated its state for a response the client will never see, so the connection can't be used.
+	aborted bool
+
 	// ensure only 1 incoming request is handled per connection
 	mu                         *sync.Mutex
 	cancelOutstandingRequest   func()
@@ -142,7 +161,8 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 	}
 	c.cancelOutstandingRequestMu.Unlock()
 	c.mu.Lock()
-	ctx, cancel := context.WithCancel(ctx)
+	clientCtx := ctx
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, clientCtxKey{}, clientCtx))
 
 	c.cancelOutstandingRequestMu.Lock()
 	c.cancelOutstandingRequest = cancel
@@ -152,6 +172,11 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 	defer c.mu.Unlock()
 	span.End()
 
+	if c.aborted {
+		logger.Trace().Int64("pos", req.pos).Msg("conn was aborted")
+		return nil, internal.ExpiredSessionError()
+	}
+
 	isFirstRequest := req.pos == 0
 	isRetransmit := !isFirstRequest && c.lastClientRequest.pos == req.pos
 	isSameRequest := !isFirstRequest && c.lastClientRequest.Same(req)
@@ -229,6 +254,15 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 				StatusCode: 500,
 				Err:        err,
 			}
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				herr.StatusCode = 400
+				// Only give up on the connection if the client went away. If the request was cancelled
+				// because the client sent another one, the handler only stopped waiting for live updates
+				// so its state is still consistent.
+				if clientCtx.Err() != nil {
+					c.aborted = true
+				}
+			}
 		}
 		return nil, herr
 	}
@@ -3,6 +3,7 @@ package sync3
 import (
 	"context"
 	"errors"
+	"fmt"
 	"strconv"
 	"sync"
 	"testing"
@@ -396,3 +397,73 @@ func assertNoError(t *testing.T, err *internal.HandlerError) {
 		t.Fatalf("got error: %v", err)
 	}
 }
+
+// Test that if the client goes away part way through a request, the connection cannot be used again
+// as the handler may have updated its state for a response the client never received.
+func TestConnAbortedRequestExpiresConn(t *testing.T) {
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, init bool) (*Response, error) {
+		if err := ClientContext(ctx).Err(); err != nil {
+			return nil, fmt.Errorf("request cancelled whilst loading room data: %w", err)
+		}
+		return &Response{}, nil
+	}})
+	resp, herr := c.OnIncomingRequest(context.Background(), &Request{}, time.Now())
+	if herr != nil {
+		t.Fatalf("expected no error, got %+v", herr)
+	}
+	clientCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, herr = c.OnIncomingRequest(clientCtx, &Request{pos: resp.PosInt()}, time.Now())
+	if herr == nil || herr.StatusCode != 400 {
+		t.Fatalf("expected status 400 for cancelled request, got %+v", herr)
+	}
+	// retrying the request must not return a response built on top of the cancelled one
+	_, herr = c.OnIncomingRequest(context.Background(), &Request{pos: resp.PosInt()}, time.Now())
+	if herr == nil || herr.ErrCode != "M_UNKNOWN_POS" {
+		t.Fatalf("expected M_UNKNOWN_POS after cancelled request, got %+v", herr)
+	}
+}
+
+// Test that a request which is cancelled because the client sent another request on the same
+// connection does not expire the connection.
+func TestConnSupersededRequestKeepsConn(t *testing.T) {
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	waiting := make(chan struct{})
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, init bool) (*Response, error) {
+		if req.TimeoutMSecs() > 1000 {
+			// block as if waiting for live updates until the next request cancels us
+			close(waiting)
+			<-ctx.Done()
+			if ClientContext(ctx).Err() != nil {
+				t.Errorf("client context was cancelled when the request was superseded")
+			}
+			return nil, ctx.Err()
+		}
+		return &Response{}, nil
+	}})
+	resp, herr := c.OnIncomingRequest(context.Background(), &Request{}, time.Now())
+	assertNoError(t, herr)
+
+	first := &Request{pos: resp.PosInt()}
+	first.SetTimeoutMSecs(10000)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, herr := c.OnIncomingRequest(context.Background(), first, time.Now())
+		if herr == nil {
+			t.Errorf("expected superseded request to fail")
+		}
+	}()
+	<-waiting
+	second := &Request{pos: resp.PosInt(), TxnID: "new"}
+	second.SetTimeoutMSecs(1)
+	_, herr = c.OnIncomingRequest(context.Background(), second, time.Now())
+	assertNoError(t, herr)
+	wg.Wait()
+}
@@ -94,6 +94,20 @@ func (m *ConnMap) updateMetrics(numConns int) {
 	m.numConns.Set(float64(numConns))
 }
 
+// Len returns the number of active connections.
+func (m *ConnMap) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.connIDToConn)
+}
+
+// HasConns returns true if the user has any connections on any device.
+func (m *ConnMap) HasConns(userID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.userIDToConn[userID]) > 0
+}
+
 // Conns return all connections for this user|device
 func (m *ConnMap) Conns(userID, deviceID string) []*Conn {
 	connIDs := m.connIDsForDevice(userID, deviceID)
@@ -162,7 +176,8 @@ func (m *ConnMap) CreateConn(cid ConnID, cancel context.CancelFunc, newConnHandl
 	return conn
 }
 
-func (m *ConnMap) CloseConnsForDevice(userID, deviceID string) {
+// CloseConnsForDevice closes all conns for the given user|device. Returns the number of conns closed.
+func (m *ConnMap) CloseConnsForDevice(userID, deviceID string) (closed int) {
 	logger.Trace().Str("user", userID).Str("device", deviceID).Msg("closing connections due to CloseConn()")
 	// gather open connections for this user|device
 	connIDs := m.connIDsForDevice(userID, deviceID)
@@ -171,8 +186,11 @@ func (m *ConnMap) CloseConnsForDevice(userID, deviceID string) {
 		if err != nil {
 			logger.Err(err).Str("cid", cid.String()).Msg("CloseConnsForDevice: cid did not exist in ttlcache")
 			internal.GetSentryHubFromContextOrDefault(context.Background()).CaptureException(err)
+			continue
 		}
+		closed++
 	}
+	return closed
 }
 
 func (m *ConnMap) connIDsForDevice(userID, deviceID string) []ConnID {
@@ -3,19 +3,13 @@ package sync3
 import (
 	"context"
 	"encoding/json"
-	"os"
 	"sync"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
-	"github.com/rs/zerolog"
-	"github.com/tidwall/gjson"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger("dispatcher")
 
 const DispatcherAllUsers = "-"
 
@@ -97,24 +91,27 @@ func (d *Dispatcher) ReceiverForUser(userID string) Receiver {
 
 func (d *Dispatcher) newEventData(event json.RawMessage, roomID string, latestPos int64) *caches.EventData {
 	// parse the event to pull out fields we care about
-	var stateKey *string
-	ev := gjson.ParseBytes(event)
-	if sk := ev.Get("state_key"); sk.Exists() {
-		stateKey = &sk.Str
-	}
-	eventType := ev.Get("type").Str
-
-	return &caches.EventData{
+	ev := internal.ParseEvent(event)
+	ed := &caches.EventData{
 		Event:         event,
 		RoomID:        roomID,
-		EventType:     eventType,
-		StateKey:      stateKey,
-		Content:       ev.Get("content"),
+		EventType:     ev.Type,
+		StateKey:      ev.StateKey,
+		Content:       ev.Content,
 		NID:           latestPos,
-		Timestamp:     ev.Get("origin_server_ts").Uint(),
-		Sender:        ev.Get("sender").Str,
-		TransactionID: ev.Get("unsigned.transaction_id").Str,
+		Timestamp:     ev.Timestamp,
+		Sender:        ev.Sender,
+		TransactionID: ev.TransactionID(),
+	}
+	if ev.StateKey == nil {
+		ed.ReplacedEventID = ev.ReplacedEventID()
+		ed.RedactedEventID = ev.RedactedEventID()
+	}
+	if ev.Type == "m.room.member" {
+		ed.Membership = ev.Membership()
+		ed.MembershipChange = ev.IsMembershipChange()
 	}
+	return ed
 }
 
 // Called by v2 pollers when we receive an initial state block. Very similar to OnNewEvents but
@@ -137,8 +134,7 @@ func (d *Dispatcher) OnNewInitialRoomState(ctx context.Context, roomID string, s
 		ed := d.newEventData(event, roomID, 0)
 		eventDatas[i] = ed
 		if ed.EventType == "m.room.member" && ed.StateKey != nil {
-			membership := ed.Content.Get("membership").Str
-			switch membership {
+			switch ed.Membership {
 			case "invite":
 				invited = append(invited, *ed.StateKey)
 			case "join":
@@ -169,8 +165,24 @@ func (d *Dispatcher) OnNewInitialRoomState(ctx context.Context, roomID string, s
 
 func (d *Dispatcher) OnNewEvent(
 	ctx context.Context, roomID string, event json.RawMessage, nid int64,
+) {
+	d.onNewEvent(ctx, roomID, event, nid, false)
+}
+
+// OnNewEventAfterGap is like OnNewEvent, but tells every user in the room to resend it from scratch
+// as there may be events missing before this one. Connections which already sent earlier events
+// would otherwise show a timeline with a hole in it.
+func (d *Dispatcher) OnNewEventAfterGap(
+	ctx context.Context, roomID string, event json.RawMessage, nid int64,
+) {
+	d.onNewEvent(ctx, roomID, event, nid, true)
+}
+
+func (d *Dispatcher) onNewEvent(
+	ctx context.Context, roomID string, event json.RawMessage, nid int64, afterGap bool,
 ) {
 	ed := d.newEventData(event, roomID, nid)
+	ed.ForceInitial = afterGap
 
 	// update the tracker
 	targetUser := ""
@@ -179,7 +191,7 @@ func (d *Dispatcher) OnNewEvent(
 	leaveAfterJoinOrInvite := false
 	if ed.EventType == "m.room.member" && ed.StateKey != nil {
 		targetUser = *ed.StateKey
-		membership = ed.Content.Get("membership").Str
+		membership = ed.Membership
 		switch membership {
 		case "invite":
 			// we only do this to track invite counts correctly.
@@ -278,17 +290,19 @@ func (d *Dispatcher) notifyListeners(ctx context.Context, ed *caches.EventData,
 		listener.OnNewEvent(ctx, ed)
 	}
 
-	// per-user listeners
+	// per-user listeners. Listeners treat the event data as read-only, so it is shared between them
+	// rather than allocating a copy per user. It can't be pooled and reused, as listeners may queue it
+	// to be processed later.
 	for _, userID := range userIDs {
 		l := d.userToReceiver[userID]
 		if l != nil {
-			edd := *ed
-			if targetUser == userID {
-				if shouldForceInitial {
-					edd.ForceInitial = true
-				}
+			if targetUser == userID && shouldForceInitial && !ed.ForceInitial {
+				edd := *ed
+				edd.ForceInitial = true
+				l.OnNewEvent(ctx, &edd)
+				continue
 			}
-			l.OnNewEvent(ctx, &edd)
+			l.OnNewEvent(ctx, ed)
 		}
 	}
 }
@@ -297,3 +311,7 @@ func (d *Dispatcher) OnInvalidateRoom(roomID string, joins, invites []string) {
 	// Reset the joined room tracker.
 	d.jrt.ReloadMembershipsForRoom(roomID, joins, invites)
 }
+
+func (d *Dispatcher) OnPurgeRoom(roomID string) {
+	d.jrt.RemoveRoom(roomID)
+}
@@ -0,0 +1,78 @@
+package sync3
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+type recordingReceiver struct {
+	events []*caches.EventData
+}
+
+func (r *recordingReceiver) OnNewEvent(ctx context.Context, event *caches.EventData) {
+	r.events = append(r.events, event)
+}
+func (r *recordingReceiver) OnReceipt(ctx context.Context, receipt internal.Receipt) {}
+func (r *recordingReceiver) OnEphemeralEvent(ctx context.Context, roomID string, ephEvent json.RawMessage) {
+}
+func (r *recordingReceiver) OnRegistered(ctx context.Context) error { return nil }
+
+func TestDispatcherForcesInitialAfterGap(t *testing.T) {
+	ctx := context.Background()
+	roomID := "!gappy:localhost"
+	d := NewDispatcher()
+	d.Startup(map[string][]string{
+		roomID: {"@alice:localhost", "@bob:localhost"},
+	})
+	alice := &recordingReceiver{}
+	bob := &recordingReceiver{}
+	d.Register(ctx, "@alice:localhost", alice)
+	d.Register(ctx, "@bob:localhost", bob)
+
+	d.OnNewEvent(ctx, roomID, json.RawMessage(`{"event_id":"$a","type":"m.room.message","sender":"@alice:localhost","content":{}}`), 1)
+	d.OnNewEventAfterGap(ctx, roomID, json.RawMessage(`{"event_id":"$b","type":"m.room.message","sender":"@alice:localhost","content":{}}`), 5)
+
+	for name, r := range map[string]*recordingReceiver{"alice": alice, "bob": bob} {
+		if len(r.events) != 2 {
+			t.Fatalf("%s: got %d events, want 2", name, len(r.events))
+		}
+		if r.events[0].ForceInitial {
+			t.Errorf("%s: event before the gap had ForceInitial set", name)
+		}
+		if !r.events[1].ForceInitial {
+			t.Errorf("%s: event after the gap did not have ForceInitial set", name)
+		}
+	}
+}
+
+func TestDispatcherForcesInitialForJoiningUserOnly(t *testing.T) {
+	ctx := context.Background()
+	roomID := "!join:localhost"
+	d := NewDispatcher()
+	d.Startup(map[string][]string{
+		roomID: {"@alice:localhost"},
+	})
+	alice := &recordingReceiver{}
+	bob := &recordingReceiver{}
+	d.Register(ctx, "@alice:localhost", alice)
+	d.Register(ctx, "@bob:localhost", bob)
+
+	d.OnNewEvent(ctx, roomID, json.RawMessage(`{"event_id":"$a","type":"m.room.member","state_key":"@bob:localhost","sender":"@bob:localhost","content":{"membership":"join"}}`), 1)
+
+	if len(alice.events) != 1 || len(bob.events) != 1 {
+		t.Fatalf("got %d events for alice and %d for bob, want 1 each", len(alice.events), len(bob.events))
+	}
+	if alice.events[0].ForceInitial {
+		t.Errorf("alice: join of another user had ForceInitial set")
+	}
+	if !bob.events[0].ForceInitial {
+		t.Errorf("bob: own join did not have ForceInitial set")
+	}
+	if bob.events[0].Membership != "join" || !bob.events[0].MembershipChange {
+		t.Errorf("bob: membership not parsed: %+v", bob.events[0])
+	}
+}
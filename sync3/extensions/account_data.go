@@ -3,15 +3,25 @@ package extensions
 import (
 	"context"
 	"encoding/json"
+	"hash/fnv"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
+// MaxGlobalAccountDataBytes caps the size of the global account data in a single response, so that
+// users who have accumulated thousands of global account data events do not receive all of them in
+// their initial response. The remaining events are sent in subsequent responses.
+const MaxGlobalAccountDataBytes = 256 * 1024
+
 // Client created request params
 type AccountDataRequest struct {
 	Core
+	// global account data which has been loaded but not yet sent to the client
+	pendingGlobal []state.AccountData
+	// room_id -> account data type -> checksum of the content the client has been sent
+	deliveredRooms map[string]map[string]uint64
 }
 
 func (r *AccountDataRequest) Name() string {
@@ -20,8 +30,11 @@ func (r *AccountDataRequest) Name() string {
 
 // Server response
 type AccountDataResponse struct {
-	Global []json.RawMessage            `json:"global,omitempty"`
-	Rooms  map[string][]json.RawMessage `json:"rooms,omitempty"`
+	Global []json.RawMessage `json:"global,omitempty"`
+	// GlobalRemaining is the number of global account data events which did not fit into this
+	// response and will be sent in subsequent responses.
+	GlobalRemaining int                          `json:"global_remaining,omitempty"`
+	Rooms           map[string][]json.RawMessage `json:"rooms,omitempty"`
 	// which rooms have had account data loaded from the DB in this response
 	loadedRooms map[string]bool
 }
@@ -41,15 +54,61 @@ func accountEventsAsJSON(events []state.AccountData) []json.RawMessage {
 	return j
 }
 
+// chunkAccountData splits off as many events from the front of accountData as fit into maxBytes.
+// At least one event is always returned so large events cannot stall the client.
+func chunkAccountData(accountData []state.AccountData, maxBytes int) (chunk, remaining []state.AccountData) {
+	size := 0
+	for i := range accountData {
+		size += len(accountData[i].Data)
+		if i > 0 && size > maxBytes {
+			return accountData[:i], accountData[i:]
+		}
+	}
+	return accountData, nil
+}
+
+func accountDataChecksum(ad state.AccountData) uint64 {
+	h := fnv.New64a()
+	h.Write(ad.Data)
+	return h.Sum64()
+}
+
+// undeliveredRoomAccountData returns the room account data which the client has not already been
+// sent on this connection, and remembers it as delivered. This stops the same room account data
+// being resent every time a room re-enters the window.
+func (r *AccountDataRequest) undeliveredRoomAccountData(accountData []state.AccountData) []state.AccountData {
+	if r.deliveredRooms == nil {
+		r.deliveredRooms = make(map[string]map[string]uint64)
+	}
+	undelivered := make([]state.AccountData, 0, len(accountData))
+	for _, ad := range accountData {
+		checksum := accountDataChecksum(ad)
+		delivered := r.deliveredRooms[ad.RoomID]
+		if prev, ok := delivered[ad.Type]; ok && prev == checksum {
+			continue
+		}
+		if delivered == nil {
+			delivered = make(map[string]uint64)
+			r.deliveredRooms[ad.RoomID] = delivered
+		}
+		delivered[ad.Type] = checksum
+		undelivered = append(undelivered, ad)
+	}
+	return undelivered
+}
+
 func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
 	var globalMsgs []json.RawMessage
 	roomToMsgs := map[string][]json.RawMessage{}
 	switch update := up.(type) {
 	case *caches.AccountDataUpdate:
 		globalMsgs = accountEventsAsJSON(update.AccountData)
+		r.dropPendingGlobal(update.AccountData)
 	case *caches.RoomAccountDataUpdate:
 		if r.RoomInScope(update.RoomID(), extCtx) {
-			roomToMsgs[update.RoomID()] = accountEventsAsJSON(update.AccountData)
+			if undelivered := r.undeliveredRoomAccountData(update.AccountData); len(undelivered) > 0 {
+				roomToMsgs[update.RoomID()] = accountEventsAsJSON(undelivered)
+			}
 		}
 	case caches.RoomUpdate:
 		if !r.RoomInScope(update.RoomID(), extCtx) {
@@ -64,14 +123,18 @@ func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extC
 				// for the same room, we could send dupe room account data if we didn't do this check.
 				return
 			}
-			roomAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID, update.RoomID())
+			roomAccountData, err := extCtx.Store.AccountDatas(ctx, extCtx.UserID, update.RoomID())
 			if err != nil {
 				logger.Err(err).Str("user", extCtx.UserID).Str("room", update.RoomID()).Msg("failed to fetch room account data")
 				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 			} else {
+				roomAccountData = r.undeliveredRoomAccountData(roomAccountData)
 				if len(roomAccountData) > 0 { // else we can end up with `null` not `[]`
 					roomToMsgs[update.RoomID()] = accountEventsAsJSON(roomAccountData)
 				}
+				if res.AccountData != nil {
+					res.AccountData.loadedRooms[update.RoomID()] = true
+				}
 			}
 		}
 	}
@@ -100,36 +163,70 @@ func (r *AccountDataRequest) ProcessInitial(ctx context.Context, res *Response,
 			i++
 		}
 	}
+	roomIDs = roomIDs[:i]
 	extRes := &AccountDataResponse{
 		Rooms:       make(map[string][]json.RawMessage),
 		loadedRooms: make(map[string]bool),
 	}
-	// room account data needs to be sent every time the user scrolls the list to get new room IDs
-	// TODO: remember which rooms the client has been told about
+	if extCtx.IsInitial {
+		r.deliveredRooms = nil
+	}
+	// room account data is loaded every time the user scrolls the list to get new room IDs, but
+	// only account data the client hasn't been sent on this connection is returned.
 	if len(roomIDs) > 0 {
-		roomsAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID, roomIDs...)
+		roomsAccountData, err := extCtx.Store.AccountDatas(ctx, extCtx.UserID, roomIDs...)
 		if err != nil {
 			logger.Err(err).Str("user", extCtx.UserID).Strs("rooms", roomIDs).Msg("failed to fetch room account data")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		} else {
 			extRes.Rooms = make(map[string][]json.RawMessage)
-			for _, ad := range roomsAccountData {
+			for _, roomID := range roomIDs {
+				extRes.loadedRooms[roomID] = true
+			}
+			for _, ad := range r.undeliveredRoomAccountData(roomsAccountData) {
 				extRes.Rooms[ad.RoomID] = append(extRes.Rooms[ad.RoomID], ad.Data)
-				extRes.loadedRooms[ad.RoomID] = true
 			}
 		}
 	}
-	// global account data is only sent on the first connection, then we live stream
+	// global account data is only loaded on the first connection, then we live stream. If there is
+	// too much of it to send in one response, the rest is sent on subsequent requests.
 	if extCtx.IsInitial {
-		globalAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID)
+		globalAccountData, err := extCtx.Store.AccountDatas(ctx, extCtx.UserID)
 		if err != nil {
 			logger.Err(err).Str("user", extCtx.UserID).Msg("failed to fetch global account data")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			r.pendingGlobal = nil
 		} else {
-			extRes.Global = accountEventsAsJSON(globalAccountData)
+			r.pendingGlobal = globalAccountData
 		}
 	}
+	if len(r.pendingGlobal) > 0 {
+		var chunk []state.AccountData
+		chunk, r.pendingGlobal = chunkAccountData(r.pendingGlobal, MaxGlobalAccountDataBytes)
+		extRes.Global = accountEventsAsJSON(chunk)
+		extRes.GlobalRemaining = len(r.pendingGlobal)
+	}
 	if len(extRes.Rooms) > 0 || len(extRes.Global) > 0 {
 		res.AccountData = extRes
 	}
 }
+
+// dropPendingGlobal removes pending global account data which has been superseded by live updates,
+// so an older value is not sent after a newer one.
+func (r *AccountDataRequest) dropPendingGlobal(updated []state.AccountData) {
+	if len(r.pendingGlobal) == 0 {
+		return
+	}
+	updatedTypes := make(map[string]struct{}, len(updated))
+	for _, ad := range updated {
+		updatedTypes[ad.Type] = struct{}{}
+	}
+	pending := make([]state.AccountData, 0, len(r.pendingGlobal))
+	for _, ad := range r.pendingGlobal {
+		if _, superseded := updatedTypes[ad.Type]; superseded {
+			continue
+		}
+		pending = append(pending, ad)
+	}
+	r.pendingGlobal = pending
+}
@@ -112,3 +112,130 @@ func TestLiveAccountDataAggregation(t *testing.T) {
 		t.Fatalf("got  %+v\nwant %+v", res.AccountData.Global, wantGlobalAccountData)
 	}
 }
+
+func TestChunkAccountData(t *testing.T) {
+	ad := func(size int) state.AccountData {
+		return state.AccountData{Data: make([]byte, size)}
+	}
+	testCases := []struct {
+		name          string
+		sizes         []int
+		maxBytes      int
+		wantChunk     int
+		wantRemaining int
+	}{
+		{name: "empty", sizes: nil, maxBytes: 10, wantChunk: 0, wantRemaining: 0},
+		{name: "fits", sizes: []int{3, 3, 4}, maxBytes: 10, wantChunk: 3, wantRemaining: 0},
+		{name: "splits", sizes: []int{3, 3, 5, 1}, maxBytes: 10, wantChunk: 2, wantRemaining: 2},
+		{name: "oversized first event is still sent", sizes: []int{20, 1}, maxBytes: 10, wantChunk: 1, wantRemaining: 1},
+	}
+	for _, tc := range testCases {
+		var accountData []state.AccountData
+		for _, size := range tc.sizes {
+			accountData = append(accountData, ad(size))
+		}
+		chunk, remaining := chunkAccountData(accountData, tc.maxBytes)
+		if len(chunk) != tc.wantChunk || len(remaining) != tc.wantRemaining {
+			t.Errorf("%s: got %d chunked %d remaining, want %d chunked %d remaining", tc.name, len(chunk), len(remaining), tc.wantChunk, tc.wantRemaining)
+		}
+	}
+}
+
+// Test that global account data which did not fit into the initial response is sent on
+// subsequent requests, and that live updates supersede pending events of the same type.
+func TestPendingGlobalAccountData(t *testing.T) {
+	boolTrue := true
+	ext := &AccountDataRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Lists:   []string{"*"},
+			Rooms:   []string{"*"},
+		},
+	}
+	big := make([]byte, MaxGlobalAccountDataBytes)
+	copy(big, `{"type":"a"}`)
+	ext.pendingGlobal = []state.AccountData{
+		{Type: "a", Data: big},
+		{Type: "b", Data: []byte(`{"type":"b"}`)},
+		{Type: "c", Data: []byte(`{"type":"c"}`)},
+	}
+	extCtx := Context{}
+
+	var res Response
+	ext.ProcessInitial(ctx, &res, extCtx)
+	if res.AccountData == nil || len(res.AccountData.Global) != 1 || res.AccountData.GlobalRemaining != 2 {
+		t.Fatalf("first response: got %+v want 1 global event with 2 remaining", res.AccountData)
+	}
+	if !res.HasData(false) {
+		t.Fatalf("first response: HasData returned false")
+	}
+
+	// a live update for b supersedes the pending b
+	res = Response{}
+	globalB := &caches.AccountDataUpdate{
+		AccountData: []state.AccountData{{Type: "b", Data: []byte(`{"type":"b","new":true}`)}},
+	}
+	ext.AppendLive(ctx, &res, extCtx, globalB)
+	wantGlobal := []json.RawMessage{globalB.AccountData[0].Data}
+	if !reflect.DeepEqual(res.AccountData.Global, wantGlobal) {
+		t.Fatalf("live update: got %s want %s", res.AccountData.Global, wantGlobal)
+	}
+
+	res = Response{}
+	ext.ProcessInitial(ctx, &res, extCtx)
+	wantGlobal = []json.RawMessage{[]byte(`{"type":"c"}`)}
+	if res.AccountData == nil || !reflect.DeepEqual(res.AccountData.Global, wantGlobal) || res.AccountData.GlobalRemaining != 0 {
+		t.Fatalf("second response: got %+v want global %s with none remaining", res.AccountData, wantGlobal)
+	}
+
+	res = Response{}
+	ext.ProcessInitial(ctx, &res, extCtx)
+	if res.AccountData != nil {
+		t.Fatalf("third response: got %+v want no account data", res.AccountData)
+	}
+}
+
+// Test that room account data which the client already has is not sent again.
+func TestRoomAccountDataNotResent(t *testing.T) {
+	boolTrue := true
+	ext := &AccountDataRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Rooms:   []string{"*"},
+		},
+	}
+	extCtx := Context{
+		AllSubscribedRooms: []string{roomA},
+	}
+	update := func(content string) *caches.RoomAccountDataUpdate {
+		return &caches.RoomAccountDataUpdate{
+			RoomUpdate: &dummyRoomUpdate{
+				roomID: roomA,
+			},
+			AccountData: []state.AccountData{
+				{
+					RoomID: roomA,
+					Type:   "m.tag",
+					Data:   []byte(content),
+				},
+			},
+		}
+	}
+	testCases := []struct {
+		content  string
+		wantSent bool
+	}{
+		{content: `{"tags":{}}`, wantSent: true},
+		{content: `{"tags":{}}`, wantSent: false},
+		{content: `{"tags":{"m.favourite":{}}}`, wantSent: true},
+		{content: `{"tags":{}}`, wantSent: true},
+	}
+	for i, tc := range testCases {
+		var res Response
+		ext.AppendLive(ctx, &res, extCtx, update(tc.content))
+		gotSent := res.AccountData != nil && len(res.AccountData.Rooms[roomA]) > 0
+		if gotSent != tc.wantSent {
+			t.Errorf("update %d: got sent=%v want %v", i, gotSent, tc.wantSent)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package extensions
+
+import (
+	"context"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// Client created request params
+type AnnotationsRequest struct {
+	Core
+}
+
+func (r *AnnotationsRequest) Name() string {
+	return "AnnotationsRequest"
+}
+
+// Server response
+type AnnotationsResponse struct {
+	// room_id -> event_id -> annotation counts. Counts for an event replace any previously sent
+	// counts for that event. An empty list means the event no longer has any annotations.
+	Rooms map[string]map[string][]state.AnnotationCount `json:"rooms,omitempty"`
+}
+
+func (r *AnnotationsResponse) HasData(isInitial bool) bool {
+	if isInitial {
+		return true
+	}
+	return len(r.Rooms) > 0
+}
+
+// TracksTimelineEvents returns true if this extension needs to know which timeline events have been
+// sent to the client in previous responses.
+func (r *AnnotationsRequest) TracksTimelineEvents() bool {
+	return ExtensionEnabled(r)
+}
+
+func (r *AnnotationsRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+	update, ok := up.(*caches.RoomEventUpdate)
+	if !ok || !r.RoomInScope(update.RoomID(), extCtx) {
+		return
+	}
+	roomID := update.RoomID()
+	var eventIDs []string
+	if update.EventData.RedactedEventID != "" {
+		// Redacted annotations no longer say what they annotated, so refresh every event the client
+		// knows about in this room.
+		if extCtx.SentTimelineEventIDs != nil {
+			eventIDs = extCtx.SentTimelineEventIDs(roomID)
+		}
+		eventIDs = append(eventIDs, extCtx.RoomIDToTimeline[roomID]...)
+	} else {
+		relatesTo := gjson.GetBytes(update.EventData.Event, `content.m\.relates_to`)
+		if relatesTo.Get("rel_type").Str != "m.annotation" {
+			return
+		}
+		// only send counts for events the client has been sent
+		target := relatesTo.Get("event_id").Str
+		if !timelineEventSent(roomID, target, extCtx) {
+			return
+		}
+		eventIDs = []string{target}
+	}
+	if len(eventIDs) == 0 {
+		return
+	}
+	// the counts are loaded once for every connection sent this update
+	var counts map[string][]state.AnnotationCount
+	var err error
+	if update.EventData.Annotations != nil {
+		counts, err = update.EventData.Annotations.Counts(ctx, extCtx.UserID, eventIDs)
+	} else {
+		counts, err = extCtx.Store.AnnotationCounts(ctx, extCtx.UserID, eventIDs)
+	}
+	if err != nil {
+		logger.Err(err).Str("user", extCtx.UserID).Str("room", roomID).Msg("failed to load annotation counts")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if res.Annotations == nil {
+		res.Annotations = &AnnotationsResponse{}
+	}
+	if res.Annotations.Rooms == nil {
+		res.Annotations.Rooms = make(map[string]map[string][]state.AnnotationCount)
+	}
+	if res.Annotations.Rooms[roomID] == nil {
+		res.Annotations.Rooms[roomID] = make(map[string][]state.AnnotationCount)
+	}
+	for _, eventID := range eventIDs {
+		eventCounts := counts[eventID]
+		if eventCounts == nil {
+			eventCounts = []state.AnnotationCount{} // the client must remove any counts it has
+		}
+		res.Annotations.Rooms[roomID][eventID] = eventCounts
+	}
+}
+
+func (r *AnnotationsRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	// grab the counts for all timeline events in the rooms we're going to return in one go
+	var eventIDs []string
+	eventIDToRoomID := make(map[string]string)
+	for roomID, timeline := range extCtx.RoomIDToTimeline {
+		if !r.RoomInScope(roomID, extCtx) {
+			continue
+		}
+		for _, eventID := range timeline {
+			eventIDs = append(eventIDs, eventID)
+			eventIDToRoomID[eventID] = roomID
+		}
+	}
+	if len(eventIDs) == 0 {
+		return
+	}
+	counts, err := extCtx.Store.AnnotationCounts(ctx, extCtx.UserID, eventIDs)
+	if err != nil {
+		logger.Err(err).Str("user", extCtx.UserID).Msg("failed to load annotation counts")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if len(counts) == 0 {
+		return
+	}
+	rooms := make(map[string]map[string][]state.AnnotationCount)
+	for eventID, eventCounts := range counts {
+		roomID := eventIDToRoomID[eventID]
+		if rooms[roomID] == nil {
+			rooms[roomID] = make(map[string][]state.AnnotationCount)
+		}
+		rooms[roomID][eventID] = eventCounts
+	}
+	res.Annotations = &AnnotationsResponse{
+		Rooms: rooms,
+	}
+}
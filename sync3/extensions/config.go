@@ -0,0 +1,80 @@
+package extensions
+
+import (
+	"fmt"
+)
+
+// The names of the extensions in requests. These must match up in order/type to Request.fields().
+var extensionNames = []string{"to_device", "e2ee", "account_data", "typing", "receipts", "annotations"}
+
+// emptyFields returns a new, unconfigured request for every extension, in the order of Request.fields().
+func emptyFields() []GenericRequest {
+	return []GenericRequest{
+		&ToDeviceRequest{}, &E2EERequest{}, &AccountDataRequest{}, &TypingRequest{}, &ReceiptsRequest{}, &AnnotationsRequest{},
+	}
+}
+
+// Config is the server-wide configuration of extensions. Extensions are referred to by their names
+// in requests e.g "receipts".
+type Config struct {
+	// DefaultEnabled are the extensions which are enabled for clients which do not set `enabled`,
+	// including clients which do not mention the extension at all. Clients can still disable them.
+	DefaultEnabled []string
+	// Disabled are the extensions which are never enabled, whatever clients ask for.
+	Disabled []string
+}
+
+// Validate returns an error if the config refers to unknown extensions, or if an extension is both
+// enabled by default and disabled.
+func (c Config) Validate() error {
+	for _, name := range append(append([]string{}, c.DefaultEnabled...), c.Disabled...) {
+		if !contains(extensionNames, name) {
+			return fmt.Errorf("unknown extension %q, must be one of %v", name, extensionNames)
+		}
+	}
+	for _, name := range c.DefaultEnabled {
+		if contains(c.Disabled, name) {
+			return fmt.Errorf("extension %q cannot be both enabled by default and disabled", name)
+		}
+	}
+	return nil
+}
+
+// Apply enforces the config on the combined request of a connection. This is idempotent, and should
+// be called after applying each new request so clients cannot enable disabled extensions.
+func (c Config) Apply(r *Request) {
+	if len(c.DefaultEnabled) == 0 && len(c.Disabled) == 0 {
+		return
+	}
+	fields := r.fields()
+	empty := emptyFields()
+	for i, name := range extensionNames {
+		if contains(c.Disabled, name) {
+			if !isNil(fields[i]) {
+				fields[i].setEnabled(false)
+			}
+			continue
+		}
+		if !contains(c.DefaultEnabled, name) {
+			continue
+		}
+		if isNil(fields[i]) {
+			// the client hasn't mentioned this extension, so start with the defaults
+			fields[i] = empty[i]
+			fields[i].InterpretAsInitial()
+		}
+		if fields[i].IsEnabled() == nil {
+			fields[i].setEnabled(true)
+		}
+	}
+	r.setFields(fields)
+}
+
+func contains(items []string, item string) bool {
+	for _, it := range items {
+		if it == item {
+			return true
+		}
+	}
+	return false
+}
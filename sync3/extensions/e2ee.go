@@ -15,6 +15,8 @@ type E2EEFetcher interface {
 // Client created request params
 type E2EERequest struct {
 	Core
+	// the OTK counts last sent on this connection, so we only send them again when they change
+	lastOTKCounts map[string]int
 }
 
 func (r *E2EERequest) Name() string {
@@ -66,8 +68,9 @@ func (r *E2EERequest) ProcessInitial(ctx context.Context, res *Response, extCtx
 		extRes.FallbackKeyTypes = &dd.FallbackKeyTypes
 		hasUpdates = true
 	}
-	if dd.OTKCounts != nil && (dd.OTKCountChanged() || extCtx.IsInitial) {
+	if dd.OTKCounts != nil && (extCtx.IsInitial || !otkCountsEqual(r.lastOTKCounts, dd.OTKCounts)) {
 		extRes.OTKCounts = dd.OTKCounts
+		r.lastOTKCounts = dd.OTKCounts
 		hasUpdates = true
 	}
 	if dd.DeviceListChanged == nil {
@@ -89,3 +92,16 @@ func (r *E2EERequest) ProcessInitial(ctx context.Context, res *Response, extCtx
 	// doesn't need aggregation as we just replace from the db
 	res.E2EE = extRes
 }
+
+func otkCountsEqual(a, b map[string]int) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+	for algo, count := range a {
+		otherCount, ok := b[algo]
+		if !ok || otherCount != count {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package extensions
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+type dummyE2EEFetcher struct {
+	dd *internal.DeviceData
+}
+
+func (f *dummyE2EEFetcher) DeviceData(context context.Context, userID, deviceID string, isInitial bool) *internal.DeviceData {
+	return f.dd
+}
+
+func TestE2EEOnlySendsOTKCountsWhenChanged(t *testing.T) {
+	fetcher := &dummyE2EEFetcher{
+		dd: &internal.DeviceData{
+			DeviceKeyData: internal.DeviceKeyData{
+				OTKCounts: map[string]int{"signed_curve25519": 50},
+			},
+		},
+	}
+	req := &E2EERequest{Core: Core{Enabled: &boolTrue}}
+	extCtx := Context{
+		Handler:   &Handler{E2EEFetcher: fetcher},
+		IsInitial: true,
+		UserID:    "@alice:localhost",
+		DeviceID:  "DEVICE",
+	}
+	testCases := []struct {
+		name      string
+		isInitial bool
+		otkCounts map[string]int
+		want      map[string]int
+	}{
+		{
+			name:      "initial requests always include OTK counts",
+			isInitial: true,
+			otkCounts: map[string]int{"signed_curve25519": 50},
+			want:      map[string]int{"signed_curve25519": 50},
+		},
+		{
+			name:      "unchanged OTK counts are not sent",
+			otkCounts: map[string]int{"signed_curve25519": 50},
+		},
+		{
+			name:      "changed OTK counts are sent",
+			otkCounts: map[string]int{"signed_curve25519": 49},
+			want:      map[string]int{"signed_curve25519": 49},
+		},
+		{
+			name:      "new algorithms are sent",
+			otkCounts: map[string]int{"signed_curve25519": 49, "other": 1},
+			want:      map[string]int{"signed_curve25519": 49, "other": 1},
+		},
+		{
+			name:      "unchanged OTK counts are not sent again",
+			otkCounts: map[string]int{"signed_curve25519": 49, "other": 1},
+		},
+		{
+			name:      "initial requests include OTK counts even when unchanged",
+			isInitial: true,
+			otkCounts: map[string]int{"signed_curve25519": 49, "other": 1},
+			want:      map[string]int{"signed_curve25519": 49, "other": 1},
+		},
+	}
+	for _, tc := range testCases {
+		fetcher.dd.OTKCounts = tc.otkCounts
+		extCtx.IsInitial = tc.isInitial
+		var res Response
+		req.ProcessInitial(ctx, &res, extCtx)
+		var got map[string]int
+		if res.E2EE != nil {
+			got = res.E2EE.OTKCounts
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got OTK counts %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -3,19 +3,15 @@ package extensions
 
 import (
 	"context"
-	"os"
+	"fmt"
 	"reflect"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
-	"github.com/rs/zerolog"
 )
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger("extensions")
 
 type GenericRequest interface {
 	// Name provides a name to identify the kind of request. At present, it's only
@@ -45,6 +41,8 @@ type GenericRequest interface {
 	// Process a live event, /aggregating/ the response in *Response. This function can be called
 	// multiple times per sync loop as the conn buffer is consumed.
 	AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update)
+	// setEnabled overwrites the value of the `enabled` JSON key, see Config.
+	setEnabled(enabled bool)
 }
 
 type GenericResponse interface {
@@ -73,6 +71,10 @@ func (r *Core) IsEnabled() *bool {
 	return r.Enabled
 }
 
+func (r *Core) setEnabled(enabled bool) {
+	r.Enabled = &enabled
+}
+
 func (r *Core) OnlyLists() []string {
 	return r.Lists
 }
@@ -165,11 +167,12 @@ type Request struct {
 	AccountData *AccountDataRequest `json:"account_data"`
 	Typing      *TypingRequest      `json:"typing"`
 	Receipts    *ReceiptsRequest    `json:"receipts"`
+	Annotations *AnnotationsRequest `json:"annotations"`
 }
 
 func (r *Request) fields() []GenericRequest {
 	return []GenericRequest{
-		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts,
+		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts, r.Annotations,
 	}
 }
 
@@ -180,6 +183,55 @@ func (r *Request) setFields(fields []GenericRequest) {
 	r.AccountData = fields[2].(*AccountDataRequest)
 	r.Typing = fields[3].(*TypingRequest)
 	r.Receipts = fields[4].(*ReceiptsRequest)
+	r.Annotations = fields[5].(*AnnotationsRequest)
+}
+
+// ScopeError is returned when the lists or rooms an extension applies to are malformed.
+type ScopeError struct {
+	// Field is the path to the malformed value within 'extensions' e.g receipts.lists[1]
+	Field  string
+	Reason string
+}
+
+func (e *ScopeError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Reason)
+}
+
+// ValidateScopes checks the lists and rooms of every extension in the request, returning a
+// *ScopeError for the first which is malformed.
+func (r *Request) ValidateScopes() error {
+	for i, ext := range r.fields() {
+		if isNil(ext) {
+			continue
+		}
+		if err := validateScope(extensionNames[i]+".lists", ext.OnlyLists()); err != nil {
+			return err
+		}
+		if err := validateScope(extensionNames[i]+".rooms", ext.OnlyRooms()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateScope rejects empty entries, duplicate entries and wildcards alongside other entries, as
+// it is unclear what the client intended.
+func validateScope(field string, scope []string) error {
+	seen := make(map[string]int, len(scope))
+	for i, entry := range scope {
+		entryField := fmt.Sprintf("%s[%d]", field, i)
+		if entry == "" {
+			return &ScopeError{Field: entryField, Reason: "must not be empty"}
+		}
+		if entry == "*" && len(scope) > 1 {
+			return &ScopeError{Field: entryField, Reason: `"*" cannot be combined with other entries`}
+		}
+		if j, ok := seen[entry]; ok {
+			return &ScopeError{Field: entryField, Reason: fmt.Sprintf("is a duplicate of %s[%d]", field, j)}
+		}
+		seen[entry] = i
+	}
+	return nil
 }
 
 func (r Request) EnabledExtensions() (exts []GenericRequest) {
@@ -242,6 +294,16 @@ func (r *Request) InterpretAsInitial() {
 	if r.Receipts != nil {
 		r.Receipts.InterpretAsInitial()
 	}
+	if r.Annotations != nil {
+		r.Annotations.InterpretAsInitial()
+	}
+}
+
+// TracksTimelineEvents returns true if any extension needs to know which timeline events have been
+// sent to the client in previous responses, see Context.SentTimelineEvent.
+func (r *Request) TracksTimelineEvents() bool {
+	return (r.Receipts != nil && r.Receipts.TracksTimelineEvents()) ||
+		(r.Annotations != nil && r.Annotations.TracksTimelineEvents())
 }
 
 // Response represents the top-level `extensions` key in the JSON response.
@@ -253,11 +315,12 @@ type Response struct {
 	AccountData *AccountDataResponse `json:"account_data,omitempty"`
 	Typing      *TypingResponse      `json:"typing,omitempty"`
 	Receipts    *ReceiptsResponse    `json:"receipts,omitempty"`
+	Annotations *AnnotationsResponse `json:"annotations,omitempty"`
 }
 
 func (r Response) fields() []GenericResponse {
 	return []GenericResponse{
-		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts,
+		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts, r.Annotations,
 	}
 }
 
@@ -301,17 +364,41 @@ type Context struct {
 	AllLists []string
 	// AllSubscribedRooms is the slice of room IDs provided to the Room Subscription API.
 	AllSubscribedRooms []string
+	// SentTimelineEvent returns true if the event was recently sent to the client in the room's
+	// timeline in a previous response. May be nil.
+	SentTimelineEvent func(roomID, eventID string) bool
+	// SentTimelineEventIDs returns the event IDs recently sent to the client in this room's
+	// timeline in previous responses, oldest first. May be nil.
+	SentTimelineEventIDs func(roomID string) []string
+}
+
+// timelineEventSent returns true if the client has been sent this event in the room's timeline,
+// either in this response or a previous one.
+func timelineEventSent(roomID, eventID string, extCtx Context) bool {
+	for _, id := range extCtx.RoomIDToTimeline[roomID] {
+		if id == eventID {
+			return true
+		}
+	}
+	return extCtx.SentTimelineEvent != nil && extCtx.SentTimelineEvent(roomID, eventID)
 }
 
 type HandlerInterface interface {
 	Handle(ctx context.Context, req Request, extCtx Context) (res Response)
 	HandleLiveUpdate(ctx context.Context, update caches.Update, req Request, res *Response, extCtx Context)
+	// ApplyConfig enforces the server-wide extension config on the combined request of a connection.
+	ApplyConfig(req *Request)
 }
 
 type Handler struct {
 	Store       *state.Storage
 	E2EEFetcher E2EEFetcher
 	GlobalCache *caches.GlobalCache
+	Config      Config
+}
+
+func (h *Handler) ApplyConfig(req *Request) {
+	h.Config.Apply(req)
 }
 
 func (h *Handler) HandleLiveUpdate(ctx context.Context, update caches.Update, req Request, res *Response, extCtx Context) {
@@ -216,3 +216,86 @@ func TestExtension_ApplyDelta(t *testing.T) {
 		}
 	}
 }
+
+func TestConfigValidate(t *testing.T) {
+	testCases := []struct {
+		cfg     Config
+		wantErr bool
+	}{
+		{cfg: Config{}},
+		{cfg: Config{DefaultEnabled: []string{"typing", "receipts"}, Disabled: []string{"account_data"}}},
+		{cfg: Config{DefaultEnabled: []string{"typo"}}, wantErr: true},
+		{cfg: Config{Disabled: []string{"Receipts"}}, wantErr: true},
+		{cfg: Config{DefaultEnabled: []string{"typing"}, Disabled: []string{"typing"}}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		err := tc.cfg.Validate()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%+v: got error %v want error %v", tc.cfg, err, tc.wantErr)
+		}
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	cfg := Config{
+		DefaultEnabled: []string{"typing", "account_data", "e2ee"},
+		Disabled:       []string{"receipts"},
+	}
+	req := Request{
+		// the client didn't say whether typing is enabled
+		Typing: &TypingRequest{Core: Core{Lists: []string{"a"}}},
+		// the client explicitly disabled account data
+		AccountData: &AccountDataRequest{Core: Core{Enabled: &boolFalse}},
+		// the client tried to enable receipts
+		Receipts: &ReceiptsRequest{Core: Core{Enabled: &boolTrue}},
+	}
+	cfg.Apply(&req)
+	// apply again, which should not change anything
+	cfg.Apply(&req)
+
+	if !ExtensionEnabled(req.Typing) || !reflect.DeepEqual(req.Typing.Lists, []string{"a"}) {
+		t.Errorf("typing: got %+v want enabled by default and lists unchanged", req.Typing)
+	}
+	if ExtensionEnabled(req.AccountData) {
+		t.Errorf("account_data: got enabled, want the client to be able to disable it")
+	}
+	if req.E2EE == nil || !ExtensionEnabled(req.E2EE) {
+		t.Fatalf("e2ee: got %+v want enabled by default when not mentioned", req.E2EE)
+	}
+	if !reflect.DeepEqual(req.E2EE.Lists, []string{"*"}) || !reflect.DeepEqual(req.E2EE.Rooms, []string{"*"}) {
+		t.Errorf("e2ee: got lists %v rooms %v, want initial defaults", req.E2EE.Lists, req.E2EE.Rooms)
+	}
+	if ExtensionEnabled(req.Receipts) {
+		t.Errorf("receipts: got enabled, want disabled by config")
+	}
+	if req.ToDevice != nil {
+		t.Errorf("to_device: got %+v want not configured", req.ToDevice)
+	}
+	var names []string
+	for _, ext := range req.EnabledExtensions() {
+		names = append(names, ext.Name())
+	}
+	if want := []string{"E2EERequest", "TypingRequest"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got enabled extensions %v want %v", names, want)
+	}
+}
+
+func TestRequestTracksTimelineEvents(t *testing.T) {
+	boolTrue := true
+	testCases := []struct {
+		name string
+		req  Request
+		want bool
+	}{
+		{name: "no extensions", req: Request{}},
+		{name: "plain receipts", req: Request{Receipts: &ReceiptsRequest{Core: Core{Enabled: &boolTrue}}}},
+		{name: "aggregated receipts", req: Request{Receipts: &ReceiptsRequest{Aggregate: &boolTrue}}, want: true},
+		{name: "disabled annotations", req: Request{Annotations: &AnnotationsRequest{}}},
+		{name: "annotations", req: Request{Annotations: &AnnotationsRequest{Core: Core{Enabled: &boolTrue}}}, want: true},
+	}
+	for _, tc := range testCases {
+		if got := tc.req.TracksTimelineEvents(); got != tc.want {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -12,23 +12,98 @@ import (
 // Client created request params
 type ReceiptsRequest struct {
 	Core
+	// OnlyTimelineEvents omits live receipts from other users for events which the client has
+	// not been sent in a room timeline. The user's own receipts are always included.
+	OnlyTimelineEvents *bool `json:"only_timeline_events,omitempty"`
+	// Aggregate replaces other users' receipts with "seen by" counts for each timeline event.
+	// The user's own receipts are still returned in full.
+	Aggregate *bool `json:"aggregate,omitempty"`
 }
 
 func (r *ReceiptsRequest) Name() string {
 	return "ReceiptsRequest"
 }
 
+func (r *ReceiptsRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*ReceiptsRequest)
+	if next.OnlyTimelineEvents != nil {
+		r.OnlyTimelineEvents = next.OnlyTimelineEvents
+	}
+	if next.Aggregate != nil {
+		r.Aggregate = next.Aggregate
+	}
+}
+
+func (r *ReceiptsRequest) ShouldOnlyIncludeTimelineEvents() bool {
+	return r.OnlyTimelineEvents != nil && *r.OnlyTimelineEvents
+}
+
+func (r *ReceiptsRequest) ShouldAggregate() bool {
+	return r.Aggregate != nil && *r.Aggregate
+}
+
+// TracksTimelineEvents returns true if this extension needs to know which timeline events have been
+// sent to the client in previous responses.
+func (r *ReceiptsRequest) TracksTimelineEvents() bool {
+	return r.ShouldOnlyIncludeTimelineEvents() || r.ShouldAggregate()
+}
+
+// seenByCounts returns the number of users whose read receipt is at or after each event in the
+// timeline, which is ordered oldest first. Private receipts, threaded receipts and the syncing
+// user's own receipts are not counted. Events nobody has seen are omitted.
+func seenByCounts(timeline []string, receipts []internal.Receipt, ownUserID string) map[string]int {
+	eventIndex := make(map[string]int, len(timeline))
+	for i, eventID := range timeline {
+		eventIndex[eventID] = i
+	}
+	// user_id -> index of the latest event they have read
+	userIndex := make(map[string]int)
+	for _, receipt := range receipts {
+		if receipt.IsPrivate || receipt.UserID == ownUserID || (receipt.ThreadID != "" && receipt.ThreadID != "main") {
+			continue
+		}
+		i, ok := eventIndex[receipt.EventID]
+		if !ok {
+			continue
+		}
+		if prev, exists := userIndex[receipt.UserID]; !exists || i > prev {
+			userIndex[receipt.UserID] = i
+		}
+	}
+	if len(userIndex) == 0 {
+		return nil
+	}
+	// readersAt[i] is the number of users whose latest read event is timeline[i]
+	readersAt := make([]int, len(timeline))
+	for _, i := range userIndex {
+		readersAt[i]++
+	}
+	counts := make(map[string]int)
+	seenBy := 0
+	for i := len(timeline) - 1; i >= 0; i-- {
+		seenBy += readersAt[i]
+		if seenBy > 0 {
+			counts[timeline[i]] = seenBy
+		}
+	}
+	return counts
+}
+
 // Server response
 type ReceiptsResponse struct {
 	// room_id -> m.receipt ephemeral event
 	Rooms map[string]json.RawMessage `json:"rooms,omitempty"`
+	// room_id -> event_id -> number of other users who have read up to or past this event. Only set
+	// when aggregating. Counts for a room replace any previously sent counts for that room.
+	SeenBy map[string]map[string]int `json:"seen_by,omitempty"`
 }
 
 func (r *ReceiptsResponse) HasData(isInitial bool) bool {
 	if isInitial {
 		return true
 	}
-	return len(r.Rooms) > 0
+	return len(r.Rooms) > 0 || len(r.SeenBy) > 0
 }
 
 func (r *ReceiptsRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
@@ -37,6 +112,13 @@ func (r *ReceiptsRequest) AppendLive(ctx context.Context, res *Response, extCtx
 		if !r.RoomInScope(update.RoomID(), extCtx) {
 			break
 		}
+		if r.ShouldOnlyIncludeTimelineEvents() && update.Receipt.UserID != extCtx.UserID && !timelineEventSent(update.RoomID(), update.Receipt.EventID, extCtx) {
+			break
+		}
+		if r.ShouldAggregate() && update.Receipt.UserID != extCtx.UserID {
+			r.appendLiveSeenBy(ctx, res, extCtx, update.RoomID())
+			break
+		}
 
 		// a live receipt event happened, send this back
 		if res.Receipts == nil {
@@ -83,11 +165,48 @@ func (r *ReceiptsRequest) AppendLive(ctx context.Context, res *Response, extCtx
 	}
 }
 
+// appendLiveSeenBy recalculates the "seen by" counts for all timeline events in this room which the
+// client knows about.
+func (r *ReceiptsRequest) appendLiveSeenBy(ctx context.Context, res *Response, extCtx Context, roomID string) {
+	var timeline []string
+	if extCtx.SentTimelineEventIDs != nil {
+		timeline = extCtx.SentTimelineEventIDs(roomID)
+	}
+	for _, eventID := range extCtx.RoomIDToTimeline[roomID] {
+		if extCtx.SentTimelineEvent == nil || !extCtx.SentTimelineEvent(roomID, eventID) {
+			timeline = append(timeline, eventID)
+		}
+	}
+	if len(timeline) == 0 {
+		return
+	}
+	// this runs for every live receipt on every aggregating connection in the room, so use the
+	// in-memory receipts rather than querying the database each time
+	receipts, err := extCtx.GlobalCache.LoadReadReceipts(roomID)
+	if err != nil {
+		logger.Err(err).Str("user", extCtx.UserID).Str("room", roomID).Msg("failed to LoadReadReceipts")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	counts := seenByCounts(timeline, receipts, extCtx.UserID)
+	if counts == nil {
+		return
+	}
+	if res.Receipts == nil {
+		res.Receipts = &ReceiptsResponse{}
+	}
+	if res.Receipts.SeenBy == nil {
+		res.Receipts.SeenBy = make(map[string]map[string]int)
+	}
+	res.Receipts.SeenBy[roomID] = counts
+}
+
 func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
 	// grab receipts for all timelines for all the rooms we're going to return
 	rooms := make(map[string]json.RawMessage)
 	interestedRoomIDs := make([]string, 0, len(extCtx.RoomIDToTimeline))
 	otherReceipts := make(map[string][]internal.Receipt)
+	seenBy := make(map[string]map[string]int)
 	for roomID, timeline := range extCtx.RoomIDToTimeline {
 		if !r.RoomInScope(roomID, extCtx) {
 			continue
@@ -98,7 +217,13 @@ func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, ext
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 			continue
 		}
-		otherReceipts[roomID] = receipts
+		if r.ShouldAggregate() {
+			if counts := seenByCounts(timeline, receipts, extCtx.UserID); counts != nil {
+				seenBy[roomID] = counts
+			}
+		} else {
+			otherReceipts[roomID] = receipts
+		}
 		interestedRoomIDs = append(interestedRoomIDs, roomID)
 	}
 	// single shot query to pull out our own receipts for these rooms to always include our own receipts
@@ -121,9 +246,12 @@ func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, ext
 		rooms[roomID], _ = state.PackReceiptsIntoEDU(receipts)
 	}
 
-	if len(rooms) > 0 {
+	if len(rooms) > 0 || len(seenBy) > 0 {
 		res.Receipts = &ReceiptsResponse{
 			Rooms: rooms,
 		}
+		if len(seenBy) > 0 {
+			res.Receipts.SeenBy = seenBy
+		}
 	}
 }
@@ -78,3 +78,88 @@ func TestLiveReceiptsAggregation(t *testing.T) {
 		t.Fatalf("got  %+v\nwant %+v", res.Receipts.Rooms, want)
 	}
 }
+
+// Test that only_timeline_events drops live receipts for events the client hasn't been sent,
+// except for the user's own receipts.
+func TestLiveReceiptsOnlyTimelineEvents(t *testing.T) {
+	boolTrue := true
+	alice := "@alice:here"
+	ext := &ReceiptsRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Lists:   []string{"*"},
+			Rooms:   []string{"*"},
+		},
+		OnlyTimelineEvents: &boolTrue,
+	}
+	extCtx := Context{
+		UserID:             alice,
+		AllSubscribedRooms: []string{roomA},
+		RoomIDToTimeline: map[string][]string{
+			roomA: {"$new"},
+		},
+		SentTimelineEvent: func(roomID, eventID string) bool {
+			return roomID == roomA && eventID == "$old"
+		},
+	}
+	receipt := func(eventID, userID string) *caches.ReceiptUpdate {
+		return &caches.ReceiptUpdate{
+			Receipt: internal.Receipt{
+				RoomID:  roomA,
+				EventID: eventID,
+				UserID:  userID,
+				TS:      12345,
+			},
+			RoomUpdate: &dummyRoomUpdate{
+				roomID: roomA,
+			},
+		}
+	}
+	inThisResponse := receipt("$new", "@someone:here")
+	inPrevResponse := receipt("$old", "@someone2:here")
+	ancient := receipt("$ancient", "@someone3:here")
+	own := receipt("$ancient", alice)
+
+	var res Response
+	for _, up := range []*caches.ReceiptUpdate{inThisResponse, inPrevResponse, ancient, own} {
+		ext.AppendLive(ctx, &res, extCtx, up)
+	}
+	if res.Receipts == nil {
+		t.Fatalf("receipts response is empty")
+	}
+	eduA, err := state.PackReceiptsIntoEDU([]internal.Receipt{inThisResponse.Receipt, inPrevResponse.Receipt, own.Receipt})
+	assertNoError(t, err)
+	want := map[string]json.RawMessage{
+		roomA: eduA,
+	}
+	if !reflect.DeepEqual(res.Receipts.Rooms, want) {
+		t.Fatalf("got  %s\nwant %s", res.Receipts.Rooms[roomA], want[roomA])
+	}
+}
+
+func TestSeenByCounts(t *testing.T) {
+	alice := "@alice:localhost"
+	timeline := []string{"$a", "$b", "$c", "$d"}
+	receipts := []internal.Receipt{
+		{EventID: "$a", UserID: "@bob:localhost"},
+		{EventID: "$c", UserID: "@bob:localhost"}, // later receipt wins
+		{EventID: "$b", UserID: "@charlie:localhost"},
+		{EventID: "$d", UserID: alice},                                 // own receipt is not counted
+		{EventID: "$d", UserID: "@doris:localhost", IsPrivate: true},   // private receipts are not counted
+		{EventID: "$d", UserID: "@eve:localhost", ThreadID: "$thread"}, // threaded receipts are not counted
+		{EventID: "$unknown", UserID: "@frank:localhost"},              // not in the timeline
+		{EventID: "$a", UserID: "@gerald:localhost", ThreadID: "main"},
+	}
+	got := seenByCounts(timeline, receipts, alice)
+	want := map[string]int{
+		"$a": 3,
+		"$b": 2,
+		"$c": 1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	if got := seenByCounts(timeline, nil, alice); got != nil {
+		t.Fatalf("got %v want nil", got)
+	}
+}
@@ -5,25 +5,28 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
-	"sync"
 
 	"github.com/matrix-org/sliding-sync/internal"
 
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
-// used to remember since positions to warn when they are not incremented. This can happen
-// when the response is genuinely lost, but then we would expect the Conn cache to pick it up based
-// on resending the `?pos=`, so it could mean they really aren't incrementing it and it's a client bug,
-// which is bad because it can result in duplicate to-device events which breaks the encryption state machine
-var deviceIDToSinceDebugOnly = map[string]int64{}
-var mapMu = &sync.Mutex{}
+// MaxToDeviceLimit caps the number of to-device messages in a response, whatever limit the client
+// asks for, so that a device which returns after a long absence does not stall its connection with
+// a single enormous response. The remaining messages are sent in later responses as the client
+// advances its since token.
+const MaxToDeviceLimit = 1000
 
 // Client created request params
 type ToDeviceRequest struct {
 	Core
 	Limit int    `json:"limit"` // max number of to-device messages per response
 	Since string `json:"since"` // since token
+
+	// the device's unacked position, cached for the lifetime of the connection so it isn't
+	// queried on every request. Other connections for the device may have moved it on since.
+	lastSentPos       int64
+	lastSentPosLoaded bool
 }
 
 func (r *ToDeviceRequest) Name() string {
@@ -61,10 +64,13 @@ func (r *ToDeviceRequest) AppendLive(ctx context.Context, res *Response, extCtx
 }
 
 func (r *ToDeviceRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
-	if r.Limit == 0 {
+	l := logger.With().Str("user", extCtx.UserID).Str("device", extCtx.DeviceID).Logger()
+	if r.Limit <= 0 {
 		r.Limit = 100 // default to 100
+	} else if r.Limit > MaxToDeviceLimit {
+		l.Debug().Int("limit", r.Limit).Msg("capping to-device limit")
+		r.Limit = MaxToDeviceLimit
 	}
-	l := logger.With().Str("user", extCtx.UserID).Str("device", extCtx.DeviceID).Logger()
 	var from int64
 	var err error
 	if r.Since != "" {
@@ -75,6 +81,31 @@ func (r *ToDeviceRequest) ProcessInitial(ctx context.Context, res *Response, ext
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 			return
 		}
+	}
+	// The to-device stream has its own position per device, independent of the connection's pos,
+	// which is persisted so delivery survives connections expiring and the proxy restarting. It is
+	// the highest position ever sent to the device. The cached position can only be behind, so
+	// reload it if the client is ahead of it.
+	if !r.lastSentPosLoaded || from > r.lastSentPos {
+		r.lastSentPos, err = extCtx.Store.ToDeviceTable.UnackedPosition(extCtx.UserID, extCtx.DeviceID)
+		if err != nil {
+			l.Err(err).Msg("cannot query unacked position")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			return
+		}
+		r.lastSentPosLoaded = true
+	}
+	lastSentPos := r.lastSentPos
+	internal.Logf(ctx, "to_device", "since=%v limit=%v last_sent=%v", r.Since, r.Limit, lastSentPos)
+	if from > lastSentPos {
+		// The client is acknowledging messages we never sent it, e.g a since token from another
+		// deployment. Never delete messages the device hasn't been sent, as losing them breaks E2EE.
+		l.Warn().Int64("last_sent", lastSentPos).Int64("recv", from).Msg(
+			"Client acknowledged to-device messages which were never sent, ignoring",
+		)
+		from = lastSentPos
+	}
+	if r.Since != "" {
 		// the client is confirming messages up to `from` so delete everything up to and including it.
 		if err = extCtx.Store.ToDeviceTable.DeleteMessagesUpToAndIncluding(extCtx.UserID, extCtx.DeviceID, from); err != nil {
 			l.Err(err).Str("since", r.Since).Msg("failed to delete to-device messages up to this value")
@@ -82,12 +113,12 @@ func (r *ToDeviceRequest) ProcessInitial(ctx context.Context, res *Response, ext
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		}
 	}
-	mapMu.Lock()
-	lastSentPos := deviceIDToSinceDebugOnly[extCtx.DeviceID]
-	internal.Logf(ctx, "to_device", "since=%v limit=%v last_sent=%v", r.Since, r.Limit, lastSentPos)
-	mapMu.Unlock()
 	if from < lastSentPos {
-		// we told the client about a newer position, but yet they are using an older position, yell loudly
+		// We told the client about a newer position, but yet they are using an older position, yell loudly.
+		// This can happen when the response is genuinely lost, but then we would expect the Conn cache
+		// to pick it up based on resending the `?pos=`, so it could mean they really aren't incrementing
+		// it and it's a client bug, which is bad because it can result in duplicate to-device events
+		// which breaks the encryption state machine.
 		l.Warn().Int64("last_sent", lastSentPos).Int64("recv", from).Bool("initial", extCtx.IsInitial).Msg(
 			"Client did not increment since token: possibly sending back duplicate to-device events!",
 		)
@@ -100,16 +131,20 @@ func (r *ToDeviceRequest) ProcessInitial(ctx context.Context, res *Response, ext
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return
 	}
-	err = extCtx.Store.ToDeviceTable.SetUnackedPosition(extCtx.UserID, extCtx.DeviceID, upTo)
-	if err != nil {
-		l.Err(err).Msg("cannot set unacked position")
-		// TODO add context to sentry
-		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
-		return
+	if len(msgs) == 0 {
+		// there is nothing after `from`, so keep the token where it was rather than resetting it
+		upTo = lastSentPos
+	}
+	if upTo > lastSentPos {
+		err = extCtx.Store.ToDeviceTable.SetUnackedPosition(extCtx.UserID, extCtx.DeviceID, upTo)
+		if err != nil {
+			l.Err(err).Msg("cannot set unacked position")
+			// TODO add context to sentry
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			return
+		}
+		r.lastSentPos = upTo
 	}
-	mapMu.Lock()
-	deviceIDToSinceDebugOnly[extCtx.DeviceID] = upTo
-	mapMu.Unlock()
 	// we don't need to aggregate here as we're pulling from the DB and not relying on in-memory structs
 	res.ToDevice = &ToDeviceResponse{
 		NextBatch: fmt.Sprintf("%d", upTo),
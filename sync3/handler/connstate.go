@@ -3,6 +3,9 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"runtime"
+	"sync"
 	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
@@ -13,6 +16,13 @@ import (
 	"github.com/tidwall/gjson"
 )
 
+var (
+	// The number of rooms loaded together when building initial room data.
+	initialRoomDataChunkSize = 50
+	// The max number of chunks of initial room data loaded concurrently for a request.
+	maxInitialRoomDataWorkers = runtime.GOMAXPROCS(0)
+)
+
 type JoinChecker interface {
 	IsUserJoined(userID, roomID string) bool
 }
@@ -50,8 +60,14 @@ type ConnState struct {
 	userCache   *caches.UserCache
 	userCacheID int
 	lazyCache   *LazyCache
+	// the initial room data already sent on this connection
+	deliveredRooms *DeliveredRooms
+	// the recent timeline events sent on this connection
+	sentTimelineEvents *SentTimelineEvents
 
 	joinChecker JoinChecker
+	// the maximum number of room subscriptions on this connection, 0 means no limit
+	maxRoomSubscriptions int
 
 	extensionsHandler   extensions.HandlerInterface
 	setupHistogramVec   *prometheus.HistogramVec
@@ -75,9 +91,12 @@ func NewConnState(
 		extensionsHandler:   ex,
 		joinChecker:         joinChecker,
 		lazyCache:           NewLazyCache(),
+		deliveredRooms:      NewDeliveredRooms(),
+		sentTimelineEvents:  NewSentTimelineEvents(),
 		setupHistogramVec:   setupHistVec,
 		processHistogramVec: histVec,
 	}
+	cs.lists.RoomIDsWithNameLike = globalCache.RoomNameSearch()
 	cs.live = &connStateLive{
 		ConnState: cs,
 		updates:   make(chan caches.Update, maxPendingEventUpdates),
@@ -107,24 +126,41 @@ func NewConnState(
 //   - load() bases its current state based on the latest position, which includes processing of these N events.
 //   - post load() we read N events, processing them a 2nd time.
 func (s *ConnState) load(ctx context.Context, req *sync3.Request) error {
-	initialLoadPosition, joinedRooms, joinTimings, loadPositions, err := s.globalCache.LoadJoinedRooms(ctx, s.userID)
+	initialLoadPosition, rooms, loadPositions, err := LoadRoomConnMetadata(ctx, s.globalCache, s.userCache, s.userID, req.Lists)
 	if err != nil {
 		return err
 	}
 	for roomID, pos := range loadPositions {
 		s.loadPositions[roomID] = pos
 	}
-	rooms := make([]sync3.RoomConnMetadata, len(joinedRooms))
+	for _, r := range rooms {
+		s.lists.SetRoom(r)
+	}
+	s.anchorLoadPosition = initialLoadPosition
+	return nil
+}
+
+// LoadRoomConnMetadata loads the metadata for every room the user is joined or invited to, ready to
+// be sorted into the given lists. Returns the position the rooms were loaded at, and the position
+// each joined room was last updated at.
+func LoadRoomConnMetadata(ctx context.Context, globalCache *caches.GlobalCache, userCache *caches.UserCache, userID string, lists map[string]sync3.RequestList) (
+	initialLoadPosition int64, rooms []sync3.RoomConnMetadata, loadPositions map[string]int64, err error,
+) {
+	initialLoadPosition, joinedRooms, joinTimings, loadPositions, err := globalCache.LoadJoinedRooms(ctx, userID)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	rooms = make([]sync3.RoomConnMetadata, len(joinedRooms))
 	i := 0
 	for _, metadata := range joinedRooms {
-		metadata.RemoveHero(s.userID)
-		urd := s.userCache.LoadRoomData(metadata.RoomID)
+		metadata.RemoveHero(userID)
+		urd := userCache.LoadRoomData(metadata.RoomID)
 		timing, ok := joinTimings[metadata.RoomID]
 		internal.AssertWithContext(ctx, "LoadJoinedRooms returned room with timing info", ok)
 		urd.JoinTiming = timing
 
-		interestedEventTimestampsByList := make(map[string]uint64, len(req.Lists))
-		for listKey, listReq := range req.Lists {
+		interestedEventTimestampsByList := make(map[string]uint64, len(lists))
+		for listKey, listReq := range lists {
 			interestingActivityTs := metadata.LastMessageTimestamp
 			if len(listReq.BumpEventTypes) > 0 {
 				// Use the global cache to find the timestamp of the latest interesting
@@ -149,11 +185,11 @@ func (s *ConnState) load(ctx context.Context, req *sync3.Request) error {
 		}
 		i++
 	}
-	invites := s.userCache.Invites()
+	invites := userCache.Invites()
 	for _, urd := range invites {
 		metadata := urd.Invite.RoomMetadata()
-		inviteTimestampsByList := make(map[string]uint64, len(req.Lists))
-		for listKey, _ := range req.Lists {
+		inviteTimestampsByList := make(map[string]uint64, len(lists))
+		for listKey, _ := range lists {
 			inviteTimestampsByList[listKey] = metadata.LastMessageTimestamp
 		}
 		rooms = append(rooms, sync3.RoomConnMetadata{
@@ -162,26 +198,39 @@ func (s *ConnState) load(ctx context.Context, req *sync3.Request) error {
 			LastInterestedEventTimestamps: inviteTimestampsByList,
 		})
 	}
-
-	for _, r := range rooms {
-		s.lists.SetRoom(r)
+	knocks := userCache.Knocks()
+	for _, urd := range knocks {
+		metadata := urd.Knock.RoomMetadata()
+		knockTimestampsByList := make(map[string]uint64, len(lists))
+		for listKey, _ := range lists {
+			knockTimestampsByList[listKey] = metadata.LastMessageTimestamp
+		}
+		rooms = append(rooms, sync3.RoomConnMetadata{
+			RoomMetadata:                  *metadata,
+			UserRoomData:                  urd,
+			LastInterestedEventTimestamps: knockTimestampsByList,
+		})
 	}
-	s.anchorLoadPosition = initialLoadPosition
-	return nil
+
+	return initialLoadPosition, rooms, loadPositions, nil
 }
 
 // OnIncomingRequest is guaranteed to be called sequentially (it's protected by a mutex in conn.go)
 func (s *ConnState) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req *sync3.Request, isInitial bool, start time.Time) (*sync3.Response, error) {
 	if s.anchorLoadPosition <= 0 {
-		// load() needs no ctx so drop it
-		_, region := internal.StartSpan(ctx, "load")
-		err := s.load(ctx, req)
+		loadCtx := sync3.ClientContext(ctx)
+		_, region := internal.StartSpan(loadCtx, "load")
+		err := s.load(loadCtx, req)
+		region.End()
 		if err != nil {
+			if loadCtx.Err() != nil {
+				// the client went away whilst we were loading, so there is no one to send a response to.
+				return nil, fmt.Errorf("failed to load initial data: %w", loadCtx.Err())
+			}
 			// in practice this means DB hit failures. If we try again later maybe it'll work, and we will because
 			// anchorLoadPosition is unset.
 			logger.Err(err).Str("conn", cid.String()).Msg("failed to load initial data")
 		}
-		region.End()
 	}
 	setupTime := time.Since(start)
 	s.trackSetupDuration(ctx, setupTime, isInitial)
@@ -193,9 +242,14 @@ func (s *ConnState) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req
 // additional locking mechanisms.
 func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request, isInitial bool) (*sync3.Response, error) {
 	start := time.Now()
+	// room subscriptions are sticky, so check the limit against all of the connection's subscriptions
+	if err := s.muxedReq.ValidateRoomSubscriptionLimitAfter(req, s.maxRoomSubscriptions); err != nil {
+		return nil, roomSubscriptionLimitError(err.(*sync3.RoomSubscriptionLimitError))
+	}
 	// ApplyDelta works fine if s.muxedReq is nil
 	var delta *sync3.RequestDelta
 	s.muxedReq, delta = s.muxedReq.ApplyDelta(req)
+	s.extensionsHandler.ApplyConfig(&s.muxedReq.Extensions)
 	internal.Logf(reqCtx, "connstate", "new subs=%v unsubs=%v num_lists=%v", len(delta.Subs), len(delta.Unsubs), len(delta.Lists))
 	for key, l := range delta.Lists {
 		listData := ""
@@ -209,34 +263,51 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 		internal.Logf(reqCtx, "connstate", "room sub[%v] %v", roomID, sub)
 	}
 
+	// Loading room data is only cancelled if the client goes away, not if it sends another request on
+	// this connection, as the response we build here is still sent to the client.
+	loadCtx := sync3.ClientContext(reqCtx)
+
 	// work out which rooms we'll return data for and add their relevant subscriptions to the builder
 	// for it to mix together
 	builder := NewRoomsBuilder()
 	// works out which rooms are subscribed to but doesn't pull room data
-	s.buildRoomSubscriptions(reqCtx, builder, delta.Subs, delta.Unsubs)
+	s.buildRoomSubscriptions(loadCtx, builder, delta.Subs, delta.Unsubs)
 	// works out how rooms get moved about but doesn't pull room data
-	respLists := s.buildListSubscriptions(reqCtx, builder, delta.Lists)
+	respLists := s.buildListSubscriptions(loadCtx, builder, delta.Lists)
+
+	// make sure rooms are built with every subscription which applies to them, not just the one
+	// which caused them to be included
+	s.addEffectiveSubscriptions(loadCtx, builder)
 
 	// pull room data and set changes on the response
 	response := &sync3.Response{
-		Rooms: s.buildRooms(reqCtx, builder.BuildSubscriptions()), // pull room data
+		Rooms: s.buildRooms(loadCtx, builder.BuildSubscriptions()), // pull room data
 		Lists: respLists,
 	}
 
 	// Handle extensions AFTER processing lists as extensions may need to know which rooms the client
 	// is being notified about (e.g. for room account data)
-	extCtx, region := internal.StartSpan(reqCtx, "extensions")
+	extCtx, region := internal.StartSpan(loadCtx, "extensions")
 	response.Extensions = s.extensionsHandler.Handle(extCtx, s.muxedReq.Extensions, extensions.Context{
-		UserID:             s.userID,
-		DeviceID:           s.deviceID,
-		RoomIDToTimeline:   response.RoomIDsToTimelineEventIDs(),
-		IsInitial:          isInitial,
-		RoomIDsToLists:     s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists),
-		AllSubscribedRooms: internal.Keys(s.roomSubscriptions),
-		AllLists:           s.muxedReq.ListKeys(),
+		UserID:               s.userID,
+		DeviceID:             s.deviceID,
+		RoomIDToTimeline:     response.RoomIDsToTimelineEventIDs(),
+		IsInitial:            isInitial,
+		RoomIDsToLists:       s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists),
+		SentTimelineEvent:    s.sentTimelineEvents.Sent,
+		SentTimelineEventIDs: s.sentTimelineEvents.EventIDs,
+		AllSubscribedRooms:   internal.Keys(s.roomSubscriptions),
+		AllLists:             s.muxedReq.ListKeys(),
 	})
 	region.End()
 
+	// If the client went away whilst we were loading room data, the database queries will have been
+	// cancelled so the response may be missing data. Don't return it: the caller will make the client
+	// start a new connection.
+	if err := loadCtx.Err(); err != nil {
+		return nil, fmt.Errorf("request cancelled whilst loading room data: %w", err)
+	}
+
 	if response.ListOps() > 0 || len(response.Rooms) > 0 || response.Extensions.HasData(isInitial) {
 		// we're going to immediately return, so track how long this took. We don't do this for long
 		// polling requests as high numbers mean nothing. We need to check if we will block as otherwise
@@ -255,13 +326,27 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 	for listKey := range response.Lists {
 		l := response.Lists[listKey]
 		l.Count = s.lists.Count(listKey)
+		if reqList := s.muxedReq.Lists[listKey]; reqList.ShouldIncludeSummary() {
+			unreadRooms, highlightRooms := s.lists.Get(listKey).Summary()
+			l.UnreadCount = &unreadRooms
+			l.HighlightCount = &highlightRooms
+		}
 		response.Lists[listKey] = l
 	}
+	s.replaceOpsWithRoomIDs(delta.Lists, response)
 
 	// Add membership events for users sending typing notifications. We do this after live update
 	// and initial room loading code so we LL room members in all cases.
 	if response.Extensions.Typing != nil && response.Extensions.Typing.HasData(isInitial) {
-		s.lazyLoadTypingMembers(reqCtx, response)
+		// the response is returned even if the client has gone away by now (e.g it's buffered for a
+		// retransmit), so don't let the request context cancel these loads
+		s.lazyLoadTypingMembers(internal.DetachContext(reqCtx), response)
+	}
+
+	// don't resend room data the client already has, e.g when scrolling back to a room
+	s.deliveredRooms.Apply(response.Rooms)
+	if s.muxedReq.Extensions.TracksTimelineEvents() {
+		s.sentTimelineEvents.Apply(response.RoomIDsToTimelineEventIDs())
 	}
 	return response, nil
 }
@@ -272,7 +357,12 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 	roomList, overwritten := s.lists.AssignList(ctx, listKey, nextReqList.Filters, nextReqList.Sort, sync3.DoNotOverwrite)
 
 	if nextReqList.ShouldGetAllRooms() {
-		if overwritten || prevReqList.FiltersChanged(nextReqList) {
+		// The list is materialised once and then kept up to date incrementally by live updates, so
+		// we only need to rebuild it when it is new or the filters change.
+		if !overwritten && prevReqList.FiltersChanged(nextReqList) {
+			roomList, overwritten = s.lists.AssignList(ctx, listKey, nextReqList.Filters, nextReqList.Sort, sync3.Overwrite)
+		}
+		if overwritten {
 			// this is either a new list or the filters changed, so we need to splat all the rooms to the client.
 			subID := builder.AddSubscription(nextReqList.RoomSubscription)
 			allRoomIDs := roomList.RoomIDs()
@@ -289,6 +379,8 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 				},
 			}
 		}
+		// the client already has every room in this list, ranges are ignored
+		return sync3.ResponseList{}
 	}
 
 	// TODO: list deltas
@@ -309,7 +401,56 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 
 	sortChanged := prevReqList.SortOrderChanged(nextReqList)
 	filtersChanged := prevReqList.FiltersChanged(nextReqList)
-	if sortChanged || filtersChanged {
+	roomSubChanged := prevReqList != nil && (prevReqList.TimelineLimitChanged(nextReqList) ||
+		prevReqList.RoomSubscription.RequiredStateChanged(nextReqList.RoomSubscription))
+	// rooms the client already has the data for, when only the sort order has changed
+	var alreadyVisible map[string]struct{}
+	// rooms which have come into the window, when only the filters have changed
+	var newlyVisible []string
+	if filtersChanged && prevReqList != nil && !roomSubChanged && len(addedRanges) == 0 && len(removedRanges) == 0 {
+		// The filters have changed but the ranges have not. Most of the list is usually unchanged
+		// e.g when adding a not_room_type, so send DELETE/INSERT ops for the difference between the
+		// old and new windows rather than INVALIDATEing and re-SYNCing everything.
+		logger.Trace().Interface("range", prevRange).Msg("diffing windows because filters have changed")
+		before := sync3.SnapshotListWindows(prevRange, roomList)
+		roomList, _ = s.lists.AssignList(ctx, listKey, nextReqList.Filters, nextReqList.Sort, sync3.Overwrite)
+		if err := roomList.Sort(nextReqList.Sort); err != nil {
+			logger.Err(err).Str("key", listKey).Msg("cannot sort list")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		}
+		after := sync3.SnapshotListWindows(prevRange, roomList)
+		responseOperations = append(responseOperations, sync3.CalculateListDiffOps(before, after)...)
+		wasVisible := make(map[string]struct{})
+		for _, roomIDs := range before.RoomIDs {
+			for _, roomID := range roomIDs {
+				wasVisible[roomID] = struct{}{}
+			}
+		}
+		for _, roomIDs := range after.RoomIDs {
+			for _, roomID := range roomIDs {
+				if _, visible := wasVisible[roomID]; !visible {
+					newlyVisible = append(newlyVisible, roomID)
+				}
+			}
+		}
+	} else if sortChanged && !filtersChanged && prevReqList != nil && !roomSubChanged {
+		// Only the order has changed: the rooms in the list are the same, so rather than INVALIDATEing
+		// everything we re-SYNC the ranges in the new order, which overwrites what the client has.
+		// Removed ranges are still INVALIDATEd, and only rooms which were not previously visible
+		// need their data sending.
+		logger.Trace().Interface("range", prevRange).Msg("re-SYNCing because sort order has changed")
+		alreadyVisible = make(map[string]struct{})
+		for _, ss := range prevRange.SliceInto(roomList) {
+			for _, roomID := range ss.(*sync3.SortableRooms).RoomIDs() {
+				alreadyVisible[roomID] = struct{}{}
+			}
+		}
+		if err := roomList.Sort(nextReqList.Sort); err != nil {
+			logger.Err(err).Str("key", listKey).Msg("cannot sort list")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		}
+		addedRanges = nextReqList.Ranges
+	} else if sortChanged || filtersChanged {
 		// the sort/filter operations have changed, invalidate everything (if there were previous syncs), re-sort and re-SYNC
 		if prevReqList != nil {
 			// there were previous syncs for this list, INVALIDATE the lot
@@ -358,6 +499,9 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 
 	// inform the builder about this list
 	subID := builder.AddSubscription(nextReqList.RoomSubscription)
+	if len(newlyVisible) > 0 {
+		builder.AddRoomsToSubscription(ctx, subID, newlyVisible)
+	}
 
 	// send full room data for these ranges
 	for i := range addedRanges {
@@ -369,7 +513,17 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 		sortableRooms := subslice[0].(*sync3.SortableRooms)
 		roomIDs := sortableRooms.RoomIDs()
 		// the builder will populate this with the right room data
-		builder.AddRoomsToSubscription(ctx, subID, roomIDs)
+		if alreadyVisible != nil {
+			newRoomIDs := make([]string, 0, len(roomIDs))
+			for _, roomID := range roomIDs {
+				if _, visible := alreadyVisible[roomID]; !visible {
+					newRoomIDs = append(newRoomIDs, roomID)
+				}
+			}
+			builder.AddRoomsToSubscription(ctx, subID, newRoomIDs)
+		} else {
+			builder.AddRoomsToSubscription(ctx, subID, roomIDs)
+		}
 
 		responseOperations = append(responseOperations, &sync3.ResponseOpRange{
 			Operation: sync3.OpSync,
@@ -423,6 +577,29 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 	}
 }
 
+// replaceOpsWithRoomIDs sends the complete ordered list of room IDs instead of operations for lists
+// with room_ids_only, when they have changed or have just been requested in this mode. As the ops
+// are replaced at the end of the request, they are still used to work out if the lists changed.
+func (s *ConnState) replaceOpsWithRoomIDs(listDeltas map[string]sync3.RequestListDelta, response *sync3.Response) {
+	for listKey, reqList := range s.muxedReq.Lists {
+		if !reqList.ShouldReturnRoomIDs() {
+			continue
+		}
+		resList, ok := response.Lists[listKey]
+		if !ok {
+			continue
+		}
+		listDelta := listDeltas[listKey]
+		newlyRequested := listDelta.Prev == nil || !listDelta.Prev.ShouldReturnRoomIDs()
+		if len(resList.Ops) == 0 && !newlyRequested {
+			continue
+		}
+		resList.Ops = nil
+		resList.RoomIDs = s.lists.VisibleRoomIDsByRange(listKey, reqList)
+		response.Lists[listKey] = resList
+	}
+}
+
 func (s *ConnState) buildListSubscriptions(ctx context.Context, builder *RoomsBuilder, listDeltas map[string]sync3.RequestListDelta) map[string]sync3.ResponseList {
 	ctx, span := internal.StartSpan(ctx, "buildListSubscriptions")
 	defer span.End()
@@ -465,6 +642,32 @@ func (s *ConnState) buildRoomSubscriptions(ctx context.Context, builder *RoomsBu
 	}
 }
 
+// addEffectiveSubscriptions adds the direct room subscription and the subscriptions of all lists
+// which a room is visible in for every room already in the builder. The builder combines these via
+// RoomSubscription.Combine, so a room which enters a list with a small timeline_limit is not sent
+// with less data than its room subscription or another list asks for.
+func (s *ConnState) addEffectiveSubscriptions(ctx context.Context, builder *RoomsBuilder) {
+	roomIDs := builder.RoomIDs()
+	if len(roomIDs) == 0 {
+		return
+	}
+	listSubIDs := make(map[string]int)
+	for _, roomID := range roomIDs {
+		if sub, ok := s.roomSubscriptions[roomID]; ok {
+			subID := builder.AddSubscription(sub)
+			builder.AddRoomsToSubscription(ctx, subID, []string{roomID})
+		}
+		for _, listKey := range s.lists.ListsByVisibleRoomID(s.muxedReq.Lists, roomID) {
+			subID, ok := listSubIDs[listKey]
+			if !ok {
+				subID = builder.AddSubscription(s.muxedReq.Lists[listKey].RoomSubscription)
+				listSubIDs[listKey] = subID
+			}
+			builder.AddRoomsToSubscription(ctx, subID, []string{roomID})
+		}
+	}
+}
+
 func (s *ConnState) buildRooms(ctx context.Context, builtSubs []BuiltSubscription) map[string]sync3.Room {
 	ctx, span := internal.StartSpan(ctx, "buildRooms")
 	defer span.End()
@@ -481,22 +684,12 @@ func (s *ConnState) buildRooms(ctx context.Context, builtSubs []BuiltSubscriptio
 			var oldRoomIDs []string
 			for _, currRoomID := range bs.RoomIDs { // <- the list of subs we definitely are including
 				// append old rooms if we are joined to them
-				currRoom := s.lists.ReadOnlyRoom(currRoomID)
-				var prevRoomID *string
-				if currRoom != nil {
-					prevRoomID = currRoom.PredecessorRoomID
-				}
-				for prevRoomID != nil { // <- the chain of old rooms
+				for _, prevRoomID := range sync3.PredecessorChain(s.lists, currRoomID) {
 					// if not joined, bail
-					if !s.joinChecker.IsUserJoined(s.userID, *prevRoomID) {
+					if !s.joinChecker.IsUserJoined(s.userID, prevRoomID) {
 						break
 					}
-					oldRoomIDs = append(oldRoomIDs, *prevRoomID)
-					// keep checking
-					prevRoom := s.lists.ReadOnlyRoom(*prevRoomID)
-					if prevRoom != nil {
-						prevRoomID = prevRoom.PredecessorRoomID
-					}
+					oldRoomIDs = append(oldRoomIDs, prevRoomID)
 				}
 			}
 
@@ -555,7 +748,101 @@ func (s *ConnState) lazyLoadTypingMembers(ctx context.Context, response *sync3.R
 func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSubscription, bumpEventTypes []string, roomIDs ...string) map[string]sync3.Room {
 	ctx, span := internal.StartSpan(ctx, "getInitialRoomData")
 	defer span.End()
+	rsm := roomSub.RequiredStateMap(s.userID)
+	internal.Logf(ctx, "connstate", "getInitialRoomData for %d rooms, RequiredStateMap: %#v", len(roomIDs), rsm)
+
+	// Large windows are split into chunks which are loaded concurrently. The chunks only read
+	// connection state: anything they change is applied afterwards, on this goroutine.
+	var chunks []initialRoomData
+	if len(roomIDs) <= initialRoomDataChunkSize {
+		chunks = []initialRoomData{s.loadInitialRoomData(ctx, roomSub, rsm, bumpEventTypes, roomIDs)}
+	} else {
+		chunks = s.loadInitialRoomDataConcurrently(ctx, roomSub, rsm, bumpEventTypes, roomIDs)
+	}
 
+	rooms := make(map[string]sync3.Room, len(roomIDs))
+	for _, chunk := range chunks {
+		for roomID, loadPos := range chunk.loadPositions {
+			// remember what we just loaded so if we see these events down the live stream we know to ignore them.
+			// This means that requesting a direct room subscription causes the connection to jump ahead to whatever
+			// is in the database at the time of the call, rather than gradually converging by consuming live data.
+			// This is fine, so long as we jump ahead on a per-room basis. We need to make sure (ideally) that the
+			// room state is also pinned to the load position here, else you could see weird things in individual
+			// responses such as an updated room.name without the associated m.room.name event (though this will
+			// come through on the next request -> it converges to the right state so it isn't critical).
+			s.loadPositions[roomID] = loadPos
+		}
+		if rsm.IsLazyLoading() {
+			for roomID, userIDs := range chunk.roomToUsersInTimeline {
+				s.lazyCache.Add(roomID, userIDs...)
+			}
+		}
+		for roomID, room := range chunk.rooms {
+			rooms[roomID] = room
+		}
+	}
+	return rooms
+}
+
+// initialRoomData is the result of loading the initial data for some rooms.
+type initialRoomData struct {
+	rooms                 map[string]sync3.Room
+	loadPositions         map[string]int64
+	roomToUsersInTimeline map[string][]string
+}
+
+// loadInitialRoomDataConcurrently splits the rooms into chunks and loads them using up to
+// maxInitialRoomDataWorkers goroutines. If the context is cancelled, chunks which have not
+// started yet are skipped.
+func (s *ConnState) loadInitialRoomDataConcurrently(ctx context.Context, roomSub sync3.RoomSubscription, rsm *internal.RequiredStateMap, bumpEventTypes []string, roomIDs []string) []initialRoomData {
+	var chunkedRoomIDs [][]string
+	for i := 0; i < len(roomIDs); i += initialRoomDataChunkSize {
+		end := i + initialRoomDataChunkSize
+		if end > len(roomIDs) {
+			end = len(roomIDs)
+		}
+		chunkedRoomIDs = append(chunkedRoomIDs, roomIDs[i:end])
+	}
+	chunks := make([]initialRoomData, len(chunkedRoomIDs))
+	var wg sync.WaitGroup
+	var panicMu sync.Mutex
+	var panicked interface{}
+	workers := make(chan struct{}, maxInitialRoomDataWorkers)
+schedule:
+	for i := range chunkedRoomIDs {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			break schedule
+		case workers <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() {
+				<-workers
+				// re-panic on the request goroutine, so it is handled like any other panic
+				if r := recover(); r != nil {
+					panicMu.Lock()
+					panicked = r
+					panicMu.Unlock()
+				}
+			}()
+			chunks[i] = s.loadInitialRoomData(ctx, roomSub, rsm, bumpEventTypes, chunkedRoomIDs[i])
+		}(i)
+	}
+	wg.Wait()
+	if panicked != nil {
+		panic(panicked)
+	}
+	return chunks
+}
+
+// loadInitialRoomData loads the initial data for these rooms. It must not modify the ConnState, as
+// it may be called concurrently.
+func (s *ConnState) loadInitialRoomData(ctx context.Context, roomSub sync3.RoomSubscription, rsm *internal.RequiredStateMap, bumpEventTypes []string, roomIDs []string) initialRoomData {
 	// 0. Load room metadata and timelines.
 	// We want to grab the user room data and the room metadata for each room ID. We use the globally
 	// highest NID we've seen to act as an anchor for the request. This anchor does not guarantee that
@@ -565,11 +852,12 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	// response to this call to assign new load positions for each room.
 	roomMetadatas := s.globalCache.LoadRooms(ctx, roomIDs...)
 	userRoomDatas := s.userCache.LoadRooms(roomIDs...)
-	timelines := s.userCache.LazyLoadTimelines(ctx, s.anchorLoadPosition, roomIDs, int(roomSub.TimelineLimit))
+	timelines := s.userCache.LazyLoadTimelines(ctx, s.anchorLoadPosition, roomIDs, int(roomSub.TimelineLimit), roomSub.TimelineFilter())
 
 	// 1. Prepare lazy loading data structures, txn IDs.
 	roomToUsersInTimeline := make(map[string][]string, len(timelines))
 	roomToTimeline := make(map[string][]json.RawMessage)
+	loadPositions := make(map[string]int64, len(timelines))
 	for roomID, latestEvents := range timelines {
 		senders := make(map[string]struct{})
 		for _, ev := range latestEvents.Timeline {
@@ -577,33 +865,22 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 		}
 		roomToUsersInTimeline[roomID] = internal.Keys(senders)
 		roomToTimeline[roomID] = latestEvents.Timeline
-		// remember what we just loaded so if we see these events down the live stream we know to ignore them.
-		// This means that requesting a direct room subscription causes the connection to jump ahead to whatever
-		// is in the database at the time of the call, rather than gradually converging by consuming live data.
-		// This is fine, so long as we jump ahead on a per-room basis. We need to make sure (ideally) that the
-		// room state is also pinned to the load position here, else you could see weird things in individual
-		// responses such as an updated room.name without the associated m.room.name event (though this will
-		// come through on the next request -> it converges to the right state so it isn't critical).
-		s.loadPositions[roomID] = latestEvents.LatestNID
+		loadPositions[roomID] = latestEvents.LatestNID
 	}
 	roomToTimeline = s.userCache.AnnotateWithTransactionIDs(ctx, s.userID, s.deviceID, roomToTimeline)
+	roomToTimeline = s.userCache.AnnotateWithRelations(ctx, s.userID, roomToTimeline)
 
 	// 2. Load required state events.
-	rsm := roomSub.RequiredStateMap(s.userID)
-	if rsm.IsLazyLoading() {
-		for roomID, userIDs := range roomToUsersInTimeline {
-			s.lazyCache.Add(roomID, userIDs...)
-		}
-	}
-
-	internal.Logf(ctx, "connstate", "getInitialRoomData for %d rooms, RequiredStateMap: %#v", len(roomIDs), rsm)
-
-	// Filter out rooms we are only invited to, as we don't need to fetch the state
-	// since we'll be using the invite_state only.
+	// Filter out rooms we are only invited to or have knocked on, as we don't need to fetch the state
+	// since we'll be using the invite_state or knock_state only.
+	// Rooms we have left are loaded separately, as we want the state as of our leave event.
 	loadRoomIDs := make([]string, 0, len(roomIDs))
+	var leftRoomIDs []string
 	for _, roomID := range roomIDs {
 		userRoomData, ok := userRoomDatas[roomID]
-		if !ok || !userRoomData.IsInvite {
+		if ok && userRoomData.HasLeft {
+			leftRoomIDs = append(leftRoomIDs, roomID)
+		} else if !ok || !(userRoomData.IsInvite || userRoomData.IsKnock) {
 			loadRoomIDs = append(loadRoomIDs, roomID)
 		}
 	}
@@ -611,10 +888,28 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	// by reusing the same global load position anchor here, we can be sure that the state returned here
 	// matches the timeline we loaded earlier - the race conditions happen around pubsub updates and not
 	// the events table itself, so whatever position is picked based on this anchor is immutable.
-	roomIDToState := s.globalCache.LoadRoomState(ctx, loadRoomIDs, s.anchorLoadPosition, rsm, roomToUsersInTimeline)
+	roomToLoadPos := make(map[string]int64, len(loadRoomIDs)+len(leftRoomIDs))
+	for _, roomID := range loadRoomIDs {
+		roomToLoadPos[roomID] = s.anchorLoadPosition
+	}
+	if len(leftRoomIDs) > 0 {
+		// Other members may have changed the room since we left, which we must not see. If we don't
+		// know where we left, even from our membership events, we return no state rather than the
+		// current state.
+		for roomID, leaveNID := range s.userCache.LeavePositions(ctx, leftRoomIDs) {
+			roomToLoadPos[roomID] = leaveNID
+		}
+	}
+	// load every room's state together, rather than a round trip per position
+	roomIDToState := s.globalCache.LoadRoomStateAtPositions(ctx, roomToLoadPos, rsm, roomToUsersInTimeline)
 	if roomIDToState == nil { // e.g no required_state
 		roomIDToState = make(map[string][]json.RawMessage)
 	}
+	// previews use the same positions as the state, so invites never have one
+	var roomIDToPreview map[string]*internal.MessagePreview
+	if roomSub.IncludePreview() {
+		roomIDToPreview = s.globalCache.LoadMessagePreviews(ctx, roomToLoadPos)
+	}
 
 	// 3. Build sync3.Room structs to return to clients.
 	rooms := make(map[string]sync3.Room, len(roomIDs))
@@ -624,18 +919,26 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 			userRoomData = caches.NewUserRoomData()
 		}
 		metadata := roomMetadatas[roomID]
-		var inviteState []json.RawMessage
+		var inviteState, knockState []json.RawMessage
 		// handle invites specially as we do not want to leak additional data beyond the invite_state and if
 		// we happen to have this room in the global cache we will do.
 		// Furthermore, rooms the proxy have been invited to for the first time ever will not be in the global cache yet,
 		// which will cause errors below when we try calling functions on a nil metadata.
+		// Knocks are handled in the same way using the knock_state.
 		if userRoomData.IsInvite {
 			metadata = userRoomData.Invite.RoomMetadata()
 			inviteState = userRoomData.Invite.InviteState
+		} else if userRoomData.IsKnock {
+			metadata = userRoomData.Knock.RoomMetadata()
+			knockState = userRoomData.Knock.InviteState
 		}
 		metadata.RemoveHero(s.userID)
 		var requiredState []json.RawMessage
-		if !userRoomData.IsInvite {
+		if userRoomData.IsInvite {
+			requiredState = userRoomData.Invite.RequiredState(rsm)
+		} else if userRoomData.IsKnock {
+			requiredState = userRoomData.Knock.RequiredState(rsm)
+		} else {
 			requiredState = roomIDToState[roomID]
 			if requiredState == nil {
 				requiredState = make([]json.RawMessage, 0)
@@ -672,21 +975,24 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 			}
 		}
 
-		roomName, calculated := internal.CalculateRoomName(metadata, 5) // TODO: customisable?
+		roomName, calculated := internal.CalculateRoomName(metadata, internal.MaxHeroNamesInRoomName)
 		room := sync3.Room{
 			Name:              roomName,
+			ComputedName:      roomName,
 			AvatarChange:      sync3.NewAvatarChange(internal.CalculateAvatar(metadata, userRoomData.IsDM)),
 			NotificationCount: int64(userRoomData.NotificationCount),
 			HighlightCount:    int64(userRoomData.HighlightCount),
 			Timeline:          roomToTimeline[roomID],
 			RequiredState:     requiredState,
 			InviteState:       inviteState,
+			KnockState:        knockState,
 			Initial:           true,
 			IsDM:              userRoomData.IsDM,
 			JoinedCount:       metadata.JoinCount,
 			InvitedCount:      &metadata.InviteCount,
 			PrevBatch:         timelines[roomID].PrevBatch,
 			Timestamp:         maxTs,
+			Preview:           roomIDToPreview[roomID],
 		}
 		if roomSub.IncludeHeroes() && calculated {
 			room.Heroes = metadata.Heroes
@@ -694,7 +1000,11 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 		rooms[roomID] = room
 	}
 
-	return rooms
+	return initialRoomData{
+		rooms:                 rooms,
+		loadPositions:         loadPositions,
+		roomToUsersInTimeline: roomToUsersInTimeline,
+	}
 }
 
 func (s *ConnState) trackSetupDuration(ctx context.Context, dur time.Duration, isInitial bool) {
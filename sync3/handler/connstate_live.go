@@ -25,6 +25,17 @@ type connStateLive struct {
 	// saying the client is dead and clean up the conn.
 	updates    chan caches.Update
 	bufferFull bool
+
+	// The windows of each list before the first live update modified them, keyed on list key.
+	// Populated lazily during liveUpdate and used to replace the ops generated for each individual
+	// update with a minimal diff.
+	listWindows map[string]listWindowsBefore
+}
+
+type listWindowsBefore struct {
+	windows sync3.ListWindows
+	// the number of ops in the response list before any live updates were processed
+	numOps int
 }
 
 // Called when there is an update from the user cache. This callback fires when the server gets a new event and determines this connection MAY be
@@ -58,6 +69,11 @@ func (s *connStateLive) liveUpdate(
 		req.SetTimeoutMSecs(100)
 	}
 	startBufferSize := len(s.updates)
+	// Updates taken off the queue must make it into the response, so process them with a context which
+	// isn't cancelled when the client goes away.
+	updateCtx := internal.DetachContext(ctx)
+	s.listWindows = make(map[string]listWindowsBefore)
+	defer s.consolidateListOps(response)
 	// block until we get a new event, with appropriate timeout
 	startTime := time.Now()
 	hasLiveStreamed := false
@@ -82,12 +98,12 @@ func (s *connStateLive) liveUpdate(
 			internal.Logf(ctx, "liveUpdate", "timed out after %v", timeLeftToWait)
 			return
 		case update := <-s.updates:
-			s.processUpdate(ctx, update, response, ex)
+			s.processUpdate(updateCtx, update, response, ex)
 			numProcessedUpdates++
 			// if there's more updates and we don't have lots stacked up already, go ahead and process another
 			for len(s.updates) > 0 && numProcessedUpdates < 100 {
 				update = <-s.updates
-				s.processUpdate(ctx, update, response, ex)
+				s.processUpdate(updateCtx, update, response, ex)
 				numProcessedUpdates++
 			}
 		}
@@ -101,7 +117,7 @@ func (s *connStateLive) liveUpdate(
 	if !hasLiveStreamed && !isInitial && numQueuedUpdates > 0 {
 		for i := 0; i < numQueuedUpdates; i++ {
 			update := <-s.updates
-			s.processUpdate(ctx, update, response, ex)
+			s.processUpdate(updateCtx, update, response, ex)
 		}
 		log.Debug().Int("num_queued", numQueuedUpdates).Msg("liveUpdate: caught up")
 		internal.Logf(ctx, "connstate", "liveUpdate caught up %d updates", numQueuedUpdates)
@@ -110,8 +126,24 @@ func (s *connStateLive) liveUpdate(
 	log.Trace().Bool("live_streamed", hasLiveStreamed).Msg("liveUpdate: returning")
 
 	internal.SetConnBufferInfo(ctx, startBufferSize, len(s.updates), cap(s.updates))
+}
 
-	// TODO: op consolidation
+// consolidateListOps replaces the ops generated by each live update with the minimal set of ops
+// needed to move the client from the windows before the updates to the windows now. This stops a
+// room which is bumped several times, or several rooms which move at once, from generating long
+// DELETE/INSERT sequences.
+func (s *connStateLive) consolidateListOps(response *sync3.Response) {
+	for listKey, before := range s.listWindows {
+		resList, ok := response.Lists[listKey]
+		if !ok || len(resList.Ops) == before.numOps {
+			continue
+		}
+		after := sync3.SnapshotListWindows(before.windows.Ranges, s.lists.Get(listKey))
+		ops := sync3.CalculateListDiffOps(before.windows, after)
+		resList.Ops = append(resList.Ops[:before.numOps:before.numOps], ops...)
+		response.Lists[listKey] = resList
+	}
+	s.listWindows = nil
 }
 
 func (s *connStateLive) processUpdate(ctx context.Context, update caches.Update, response *sync3.Response, ex extensions.Request) {
@@ -120,13 +152,15 @@ func (s *connStateLive) processUpdate(ctx context.Context, update caches.Update,
 	// pass event to extensions AFTER processing
 	roomIDsToLists := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
 	s.extensionsHandler.HandleLiveUpdate(ctx, update, ex, &response.Extensions, extensions.Context{
-		IsInitial:          false,
-		RoomIDToTimeline:   response.RoomIDsToTimelineEventIDs(),
-		UserID:             s.userID,
-		DeviceID:           s.deviceID,
-		RoomIDsToLists:     roomIDsToLists,
-		AllSubscribedRooms: internal.Keys(s.roomSubscriptions),
-		AllLists:           s.muxedReq.ListKeys(),
+		IsInitial:            false,
+		RoomIDToTimeline:     response.RoomIDsToTimelineEventIDs(),
+		UserID:               s.userID,
+		DeviceID:             s.deviceID,
+		RoomIDsToLists:       roomIDsToLists,
+		SentTimelineEvent:    s.sentTimelineEvents.Sent,
+		SentTimelineEventIDs: s.sentTimelineEvents.EventIDs,
+		AllSubscribedRooms:   internal.Keys(s.roomSubscriptions),
+		AllLists:             s.muxedReq.ListKeys(),
 	})
 }
 
@@ -157,6 +191,11 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 				Msg("ignoring event update")
 			return false
 		}
+
+		// the room contents are resent from scratch, so send them even if they match what was delivered
+		if roomEventUpdate.EventData.ForceInitial {
+			s.deliveredRooms.Forget(roomEventUpdate.RoomID())
+		}
 	}
 
 	// for initial rooms e.g a room comes into the window or a subscription now exists
@@ -174,16 +213,29 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 		list := s.lists.Get(listKey)
 		reqList := s.muxedReq.Lists[listKey]
 		resList := response.Lists[listKey]
+		if _, exists := s.listWindows[listKey]; !exists && s.listWindows != nil && !reqList.ShouldGetAllRooms() {
+			s.listWindows[listKey] = listWindowsBefore{
+				windows: sync3.SnapshotListWindows(reqList.Ranges, list),
+				numOps:  len(resList.Ops),
+			}
+		}
 		updates := s.processLiveUpdateForList(ctx, builder, up, listDelta.Op, &reqList, list, &resList)
 		if updates {
 			hasUpdates = true
 		}
 		response.Lists[listKey] = resList
 	}
+	if purged, ok := up.(*caches.RoomPurgedUpdate); ok {
+		// now the lists have dropped the room, forget it entirely
+		s.lists.RemoveRoom(purged.RoomID())
+		delete(s.loadPositions, purged.RoomID())
+		s.deliveredRooms.Forget(purged.RoomID())
+	}
 
 	// add in initial rooms FIRST as we replace whatever is in the rooms key for these rooms.
 	// If we do it after appending live updates then we can lose updates because we replace what
 	// we accumulated.
+	s.addEffectiveSubscriptions(ctx, builder)
 	rooms := s.buildRooms(ctx, builder.BuildSubscriptions())
 	for roomID, room := range rooms {
 		response.Rooms[roomID] = room
@@ -221,7 +273,11 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 		r.HighlightCount = int64(userRoomData.HighlightCount)
 		r.NotificationCount = int64(userRoomData.NotificationCount)
 		if roomEventUpdate != nil && roomEventUpdate.EventData.Event != nil {
-			r.NumLive++
+			// events filtered out by timeline_types / timeline_not_types still advance the load position
+			inTimeline := s.timelineFilter(roomEventUpdate.RoomID()).Matches(roomEventUpdate.EventData.EventType)
+			if inTimeline {
+				r.NumLive++
+			}
 			advancedPastEvent := false
 			if !roomEventUpdate.EventData.AlwaysProcess {
 				if roomEventUpdate.EventData.NID <= s.loadPositions[roomEventUpdate.RoomID()] {
@@ -235,7 +291,8 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			// - next request bumps a room from outside to inside the window
 			// - the initial:true room from BuildSubscriptions contains the latest live events in the timeline as it's pulled from the DB
 			// - we then process the live events in turn which adds them again.
-			if !advancedPastEvent {
+			if !advancedPastEvent && inTimeline {
+				// live events aren't annotated with relations, see UserCache.AnnotateWithRelations
 				roomIDtoTimeline := s.userCache.AnnotateWithTransactionIDs(ctx, s.userID, s.deviceID, map[string][]json.RawMessage{
 					roomEventUpdate.RoomID(): {roomEventUpdate.EventData.Event},
 				})
@@ -260,6 +317,9 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 					span.End()
 				}
 			}
+			if !advancedPastEvent && s.shouldIncludePreview(roomEventUpdate.RoomID()) {
+				s.updatePreview(ctx, &r, roomEventUpdate.EventData)
+			}
 		}
 		response.Rooms[roomUpdate.RoomID()] = r
 	}
@@ -273,9 +333,10 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			if delta.RoomNameChanged {
 				metadata := roomUpdate.GlobalRoomMetadata()
 				metadata.RemoveHero(s.userID)
-				roomName, calculated := internal.CalculateRoomName(metadata, 5) // TODO: customisable?
+				roomName, calculated := internal.CalculateRoomName(metadata, internal.MaxHeroNamesInRoomName)
 
 				thisRoom.Name = roomName
+				thisRoom.ComputedName = roomName
 
 				if calculated && s.shouldIncludeHeroes(roomUpdate.RoomID()) {
 					thisRoom.Heroes = metadata.Heroes
@@ -313,8 +374,18 @@ func (s *connStateLive) processUpdatesForSubscriptions(ctx context.Context, buil
 	if !ok {
 		return false
 	}
-	// if we have an existing confirmed subscription for this room, then there's nothing to do.
-	if _, exists := s.roomSubscriptions[rup.RoomID()]; exists {
+	if _, purged := up.(*caches.RoomPurgedUpdate); purged {
+		// the room no longer exists, so there is nothing left to send for the subscription
+		delete(s.roomSubscriptions, rup.RoomID())
+		return false
+	}
+	// if we have an existing confirmed subscription for this room, then there's nothing to do,
+	// unless the room contents need to be resent.
+	if sub, exists := s.roomSubscriptions[rup.RoomID()]; exists {
+		if reu, ok := up.(*caches.RoomEventUpdate); ok && reu.EventData.ForceInitial {
+			subID := builder.AddSubscription(sub)
+			builder.AddRoomsToSubscription(ctx, subID, []string{rup.RoomID()})
+		}
 		return true // this room exists as a subscription so we'll handle it correctly
 	}
 	// did the client ask to subscribe to this room?
@@ -339,7 +410,27 @@ func (s *connStateLive) processGlobalUpdates(ctx context.Context, builder *Rooms
 	rup, isRoomUpdate := up.(caches.RoomUpdate)
 	if isRoomUpdate {
 		updateTimestamp := rup.GlobalRoomMetadata().LastMessageTimestamp
+		// Edits don't bump the room: they change an existing message rather than adding one.
+		isEdit := isRoomEventUpdate && roomEventUpdate.EventData.ReplacedEventID != ""
+		// Redactions don't bump the room either, but the redacted event may have been what last
+		// bumped it, so fall back to the latest remaining event of the bump types.
+		isRedaction := isRoomEventUpdate && roomEventUpdate.EventData.RedactedEventID != ""
 		for listKey, list := range s.muxedReq.Lists {
+			if isEdit {
+				break
+			}
+			if isRedaction && len(list.BumpEventTypes) > 0 {
+				var ts uint64
+				for _, eventType := range list.BumpEventTypes {
+					if evMeta := rup.GlobalRoomMetadata().LatestEventsByType[eventType]; evMeta.Timestamp > ts {
+						ts = evMeta.Timestamp
+					}
+				}
+				if ts > 0 {
+					bumpTimestampInList[listKey] = ts
+				}
+				continue
+			}
 			if len(list.BumpEventTypes) == 0 {
 				// If this list hasn't provided BumpEventTypes, bump the room list for all room updates.
 				bumpTimestampInList[listKey] = updateTimestamp
@@ -458,14 +549,65 @@ func (s *connStateLive) resort(
 	return ops, hasUpdates
 }
 
+// timelineFilter returns the timeline filter for the given roomID, combined across the lists and
+// direct subscription it is in.
+func (s *connStateLive) timelineFilter(roomID string) internal.EventTypeFilter {
+	var filters []internal.EventTypeFilter
+	if sub, ok := s.roomSubscriptions[roomID]; ok {
+		filters = append(filters, sub.TimelineFilter())
+	}
+	for _, listKey := range s.lists.ListsByVisibleRoomID(s.muxedReq.Lists, roomID) {
+		filters = append(filters, s.muxedReq.Lists[listKey].TimelineFilter())
+	}
+	if len(filters) == 0 {
+		return internal.EventTypeFilter{}
+	}
+	filter := filters[0]
+	for _, f := range filters[1:] {
+		filter = filter.Union(f)
+	}
+	return filter
+}
+
+// updatePreview sets the preview of the room if this event changes its latest message. New messages
+// are previewed directly, whereas edits and redactions may change an older message so the preview
+// is reloaded, once for all connections. If a redaction removes the last message in the room, the
+// preview is left as it was.
+func (s *connStateLive) updatePreview(ctx context.Context, r *sync3.Room, ed *caches.EventData) {
+	switch {
+	case ed.ReplacedEventID != "" || ed.RedactedEventID != "":
+		if ed.Preview == nil {
+			return // no GlobalCache saw this event, so there is nothing to reload the preview with
+		}
+		if preview := ed.Preview.Load(ctx); preview != nil {
+			r.Preview = preview
+		}
+	case internal.IsMessagePreviewEventType(ed.EventType):
+		r.Preview = internal.NewMessagePreview(ed.Event, nil)
+	}
+}
+
+// shouldIncludePreview returns whether the given roomID is in a list or direct
+// subscription which should return message previews.
+func (s *connStateLive) shouldIncludePreview(roomID string) bool {
+	if s.roomSubscriptions[roomID].IncludePreview() {
+		return true
+	}
+	for _, listKey := range s.lists.ListsByVisibleRoomID(s.muxedReq.Lists, roomID) {
+		if s.muxedReq.Lists[listKey].IncludePreview() {
+			return true
+		}
+	}
+	return false
+}
+
 // shouldIncludeHeroes returns whether the given roomID is in a list or direct
 // subscription which should return heroes.
 func (s *connStateLive) shouldIncludeHeroes(roomID string) bool {
 	if s.roomSubscriptions[roomID].IncludeHeroes() {
 		return true
 	}
-	roomIDsToLists := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
-	for _, listKey := range roomIDsToLists[roomID] {
+	for _, listKey := range s.lists.ListsByVisibleRoomID(s.muxedReq.Lists, roomID) {
 		// check if this list should include heroes
 		if !s.muxedReq.Lists[listKey].IncludeHeroes() {
 			continue
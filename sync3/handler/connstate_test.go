@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,6 +17,7 @@ import (
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
 	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/matrix-org/sliding-sync/testutils/m"
 )
 
 type joinChecker struct{}
@@ -33,12 +35,23 @@ func (h *NopExtensionHandler) Handle(ctx context.Context, req extensions.Request
 func (h *NopExtensionHandler) HandleLiveUpdate(ctx context.Context, update caches.Update, req extensions.Request, res *extensions.Response, extCtx extensions.Context) {
 }
 
+func (h *NopExtensionHandler) ApplyConfig(req *extensions.Request) {}
+
 type NopUserCacheStore struct{}
 
 func (s *NopUserCacheStore) GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch string) {
 	return
 }
-func (s *NopUserCacheStore) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string]*state.LatestEvents, error) {
+func (s *NopUserCacheStore) LeaveNIDs(ctx context.Context, userID string, roomIDs []string) (map[string]int64, error) {
+	return nil, nil
+}
+func (s *NopUserCacheStore) BundledAggregations(ctx context.Context, userID string, events []json.RawMessage) (map[string]json.RawMessage, error) {
+	return nil, nil
+}
+func (s *NopUserCacheStore) PollResults(ctx context.Context, userID string, events []json.RawMessage) (map[string]json.RawMessage, error) {
+	return nil, nil
+}
+func (s *NopUserCacheStore) LatestEventsInRooms(ctx context.Context, userID string, roomIDs []string, to int64, limit int, filter internal.EventTypeFilter) (map[string]*state.LatestEvents, error) {
 	return nil, nil
 }
 
@@ -701,6 +714,35 @@ func TestConnStateRoomSubscriptions(t *testing.T) {
 			},
 		},
 	})
+
+	// the subscription limit includes the subscriptions made by earlier requests
+	cs.maxRoomSubscriptions = 1
+	_, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit: 20,
+			},
+		},
+	}, false, time.Now())
+	herr, ok := err.(*internal.HandlerError)
+	if !ok || herr.StatusCode != 400 {
+		t.Fatalf("OnIncomingRequest over the subscription limit: got error %v want a 400", err)
+	}
+	if _, subscribed := cs.muxedReq.RoomSubscriptions[roomA.RoomID]; subscribed {
+		t.Fatalf("rejected room subscription was applied")
+	}
+	// but swapping a subscription is fine
+	_, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit: 20,
+			},
+		},
+		UnsubscribeRooms: []string{roomC.RoomID},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
 }
 
 func checkResponse(t *testing.T, checkRoomIDsOnly bool, got, want *sync3.Response) {
@@ -806,3 +848,468 @@ func serialise(t *testing.T, thing interface{}) string {
 func intPtr(val int) *int {
 	return &val
 }
+
+func TestConnStateInitialRoomDataInChunks(t *testing.T) {
+	defer func(chunkSize, workers int) {
+		initialRoomDataChunkSize = chunkSize
+		maxInitialRoomDataWorkers = workers
+	}(initialRoomDataChunkSize, maxInitialRoomDataWorkers)
+	initialRoomDataChunkSize = 2
+	maxInitialRoomDataWorkers = 2
+
+	userID := "@TestConnStateInitialRoomDataInChunks_alice:localhost"
+	globalCache := caches.NewGlobalCache(nil)
+	roomMetadatas := make(map[string]internal.RoomMetadata)
+	var roomIDs []string
+	for i := 0; i < 7; i++ {
+		roomID := fmt.Sprintf("!%d:localhost", i)
+		roomIDs = append(roomIDs, roomID)
+		roomMetadatas[roomID] = newRoomMetadata(roomID, spec.Timestamp(1632131678061+i))
+	}
+	globalCache.Startup(roomMetadatas)
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+		result := make(map[string]state.LatestEvents)
+		for _, roomID := range roomIDs {
+			result[roomID] = state.LatestEvents{
+				Timeline:  []json.RawMessage{testutils.NewEvent(t, "m.room.message", userID, map[string]interface{}{"body": roomID})},
+				LatestNID: int64(len(roomID)),
+			}
+		}
+		return result
+	}
+	cs := NewConnState(userID, "yep", userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+
+	rooms := cs.getInitialRoomData(context.Background(), sync3.RoomSubscription{TimelineLimit: 1}, nil, roomIDs...)
+	if len(rooms) != len(roomIDs) {
+		t.Fatalf("got %d rooms, want %d", len(rooms), len(roomIDs))
+	}
+	for _, roomID := range roomIDs {
+		room := rooms[roomID]
+		if len(room.Timeline) != 1 || !strings.Contains(string(room.Timeline[0]), roomID) {
+			t.Errorf("room %s has wrong timeline: %v", roomID, room.Timeline)
+		}
+		if room.Name != "Room "+roomID {
+			t.Errorf("room %s has wrong name: %s", roomID, room.Name)
+		}
+		if cs.loadPositions[roomID] != int64(len(roomID)) {
+			t.Errorf("room %s has load position %d, want %d", roomID, cs.loadPositions[roomID], len(roomID))
+		}
+	}
+
+	// no more chunks are loaded once the request is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rooms = cs.getInitialRoomData(ctx, sync3.RoomSubscription{TimelineLimit: 1}, nil, roomIDs...)
+	if len(rooms) != 0 {
+		t.Fatalf("got %d rooms for a cancelled request, want 0", len(rooms))
+	}
+}
+
+// Test that lists with room_ids_only get the full ordered list of room IDs instead of ops, and only
+// when the list changes.
+func TestConnStateRoomIDsOnly(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateRoomIDsOnly_alice:localhost"
+	deviceID := "yep"
+	timestampNow := spec.Timestamp(1632131678061).Time()
+	// initial sort order B, C, A
+	roomA := newRoomMetadata("!a:localhost", spec.AsTimestamp(timestampNow.Add(-8*time.Second)))
+	roomB := newRoomMetadata("!b:localhost", spec.AsTimestamp(timestampNow))
+	roomC := newRoomMetadata("!c:localhost", spec.AsTimestamp(timestampNow.Add(-4*time.Second)))
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+		roomC.RoomID: roomC,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+		roomC.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+				roomC.RoomID: &roomC,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 123, Timestamp: 123},
+				roomB.RoomID: {NID: 456, Timestamp: 456},
+				roomC.RoomID: {NID: 780, Timestamp: 789},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+
+	roomIDsOnly := true
+	request := func() *sync3.Response {
+		t.Helper()
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort:        []string{sync3.SortByRecency},
+				Ranges:      sync3.SliceRanges([][2]int64{{0, 1}, {2, 9}}),
+				RoomIDsOnly: &roomIDsOnly,
+			}},
+		}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+	checkList := func(res *sync3.Response, wantRoomIDs [][]string) {
+		t.Helper()
+		list := res.Lists["a"]
+		if len(list.Ops) != 0 {
+			t.Errorf("got %d ops, want none", len(list.Ops))
+		}
+		if list.Count != 3 {
+			t.Errorf("got count %d, want 3", list.Count)
+		}
+		if !reflect.DeepEqual(list.RoomIDs, wantRoomIDs) {
+			t.Errorf("got room IDs %v, want %v", list.RoomIDs, wantRoomIDs)
+		}
+	}
+
+	res := request()
+	checkList(res, [][]string{{roomB.RoomID, roomC.RoomID}, {roomA.RoomID}})
+	if len(res.Rooms) != 3 {
+		t.Errorf("got %d rooms, want 3", len(res.Rooms))
+	}
+
+	// bump A to the top
+	newEvent := testutils.NewEvent(t, "unimportant", "me", struct{}{}, testutils.WithTimestamp(timestampNow.Add(1*time.Second)))
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, newEvent, 1)
+	checkList(request(), [][]string{{roomA.RoomID, roomB.RoomID}, {roomC.RoomID}})
+
+	// another message doesn't change the order, so no room IDs are sent
+	newEvent = testutils.NewEvent(t, "unimportant", "me", struct{}{}, testutils.WithTimestamp(timestampNow.Add(2*time.Second)))
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, newEvent, 2)
+	checkList(request(), nil)
+}
+
+// Test that changing only the sort order re-SYNCs the window without INVALIDATEing it, and only
+// sends the data of rooms which were not already visible.
+func TestConnStateSortChange(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateSortChange_alice:localhost"
+	deviceID := "yep"
+	timestampNow := spec.Timestamp(1632131678061).Time()
+	// recency order B, C, A, D. Name order A, B, C, D.
+	roomA := newRoomMetadata("!a:localhost", spec.AsTimestamp(timestampNow.Add(-8*time.Second)))
+	roomB := newRoomMetadata("!b:localhost", spec.AsTimestamp(timestampNow))
+	roomC := newRoomMetadata("!c:localhost", spec.AsTimestamp(timestampNow.Add(-4*time.Second)))
+	roomD := newRoomMetadata("!d:localhost", spec.AsTimestamp(timestampNow.Add(-12*time.Second)))
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+		roomC.RoomID: roomC,
+		roomD.RoomID: roomD,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+		roomC.RoomID: {userID},
+		roomD.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+				roomC.RoomID: &roomC,
+				roomD.RoomID: &roomD,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 123, Timestamp: 123},
+				roomB.RoomID: {NID: 456, Timestamp: 456},
+				roomC.RoomID: {NID: 780, Timestamp: 789},
+				roomD.RoomID: {NID: 800, Timestamp: 800},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+
+	request := func(sort []string) *sync3.Response {
+		t.Helper()
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort:   sort,
+				Ranges: sync3.SliceRanges([][2]int64{{0, 1}}),
+			}},
+		}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+
+	res := request([]string{sync3.SortByRecency})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(4), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 1, []string{roomB.RoomID, roomC.RoomID}),
+	)), m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		roomB.RoomID: {},
+		roomC.RoomID: {},
+	}))
+
+	res = request([]string{sync3.SortByName})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(4), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 1, []string{roomA.RoomID, roomB.RoomID}),
+	)), m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		roomA.RoomID: {},
+	}))
+}
+
+// Test that changing the filters sends DELETE/INSERT ops for the difference rather than
+// INVALIDATEing and re-SYNCing the window.
+func TestConnStateFilterChange(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateFilterChange_alice:localhost"
+	deviceID := "yep"
+	timestampNow := spec.Timestamp(1632131678061).Time()
+	// recency order B, C, A. C is a space.
+	roomA := newRoomMetadata("!a:localhost", spec.AsTimestamp(timestampNow.Add(-8*time.Second)))
+	roomB := newRoomMetadata("!b:localhost", spec.AsTimestamp(timestampNow))
+	roomC := newRoomMetadata("!c:localhost", spec.AsTimestamp(timestampNow.Add(-4*time.Second)))
+	spaceType := "m.space"
+	roomC.RoomType = &spaceType
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+		roomC.RoomID: roomC,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+		roomC.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+				roomC.RoomID: &roomC,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 123, Timestamp: 123},
+				roomB.RoomID: {NID: 456, Timestamp: 456},
+				roomC.RoomID: {NID: 780, Timestamp: 789},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+
+	request := func(filters *sync3.RequestFilters) *sync3.Response {
+		t.Helper()
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort:    []string{sync3.SortByRecency},
+				Ranges:  sync3.SliceRanges([][2]int64{{0, 9}}),
+				Filters: filters,
+			}},
+		}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+
+	res := request(&sync3.RequestFilters{})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(3), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 2, []string{roomB.RoomID, roomC.RoomID, roomA.RoomID}),
+	)))
+
+	// exclude spaces
+	res = request(&sync3.RequestFilters{
+		NotRoomTypes: []*string{&spaceType},
+	})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(2), m.MatchV3Ops(
+		m.MatchV3DeleteOp(1),
+	)), m.MatchRoomSubscriptionsStrict(nil))
+
+	// include spaces again: the space comes back into the window with its data
+	res = request(&sync3.RequestFilters{})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(3), m.MatchV3Ops(
+		m.MatchV3InsertOp(1, roomC.RoomID),
+	)), m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		roomC.RoomID: {},
+	}))
+}
+
+// Test that a room which comes into a list window is sent with the combination of every
+// subscription which applies to it, not just the subscription of the list it entered.
+func TestConnStateEffectiveRoomSubscription(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateEffectiveRoomSubscription_alice:localhost"
+	deviceID := "yep"
+	timestampNow := spec.Timestamp(1632131678061).Time()
+	// recency order A, B
+	roomA := newRoomMetadata("!a:localhost", spec.AsTimestamp(timestampNow))
+	roomB := newRoomMetadata("!b:localhost", spec.AsTimestamp(timestampNow.Add(-4*time.Second)))
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 123, Timestamp: 123},
+				roomB.RoomID: {NID: 456, Timestamp: 456},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	timelineLimits := make(map[string]int)
+	userCache.LazyLoadTimelinesOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+		for _, roomID := range roomIDs {
+			timelineLimits[roomID] = maxTimelineEvents
+		}
+		return mockLazyRoomOverride(loadPos, roomIDs, maxTimelineEvents)
+	}
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+
+	request := func(ranges sync3.SliceRanges) *sync3.Response {
+		t.Helper()
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Ranges: ranges,
+				Sort:   []string{sync3.SortByRecency},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 1,
+				},
+			}},
+			RoomSubscriptions: map[string]sync3.RoomSubscription{
+				roomB.RoomID: {TimelineLimit: 10},
+			},
+		}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+
+	res := request(sync3.SliceRanges{{0, 0}})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		roomA.RoomID: {},
+		roomB.RoomID: {},
+	}))
+	if timelineLimits[roomA.RoomID] != 1 || timelineLimits[roomB.RoomID] != 10 {
+		t.Fatalf("initial timeline limits got %v want A=1 B=10", timelineLimits)
+	}
+
+	// room B enters the list window: it must still use its larger room subscription timeline_limit
+	timelineLimits = make(map[string]int)
+	res = request(sync3.SliceRanges{{0, 1}})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Ops(
+		m.MatchV3SyncOp(1, 1, []string{roomB.RoomID}),
+	)), m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		roomB.RoomID: {},
+	}))
+	if timelineLimits[roomB.RoomID] != 10 {
+		t.Fatalf("room B entering the list got timeline_limit %d want 10", timelineLimits[roomB.RoomID])
+	}
+}
+
+// Test that lists which get all rooms are only sent in full when they are new or their filters
+// change, and that changing the filters rebuilds the list.
+func TestConnStateGetAllRooms(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateGetAllRooms_alice:localhost"
+	deviceID := "yep"
+	timestampNow := spec.Timestamp(1632131678061).Time()
+	roomA := newRoomMetadata("!a:localhost", spec.AsTimestamp(timestampNow))
+	roomB := newRoomMetadata("!b:localhost", spec.AsTimestamp(timestampNow.Add(-4*time.Second)))
+	roomC := newRoomMetadata("!c:localhost", spec.AsTimestamp(timestampNow.Add(-8*time.Second)))
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+		roomC.RoomID: roomC,
+	})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{
+		roomA.RoomID: {userID},
+		roomB.RoomID: {userID},
+		roomC.RoomID: {userID},
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				roomA.RoomID: &roomA,
+				roomB.RoomID: &roomB,
+				roomC.RoomID: &roomC,
+			}, map[string]internal.EventMetadata{
+				roomA.RoomID: {NID: 123, Timestamp: 123},
+				roomB.RoomID: {NID: 456, Timestamp: 456},
+				roomC.RoomID: {NID: 780, Timestamp: 789},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+
+	boolTrue := true
+	request := func(filters *sync3.RequestFilters) *sync3.Response {
+		t.Helper()
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				SlowGetAllRooms: &boolTrue,
+				Ranges:          sync3.SliceRanges{{0, 0}}, // ignored
+				Filters:         filters,
+			}},
+		}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+
+	res := request(nil)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(3), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 2, []string{roomA.RoomID, roomB.RoomID, roomC.RoomID}),
+	)), m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		roomA.RoomID: {},
+		roomB.RoomID: {},
+		roomC.RoomID: {},
+	}))
+
+	// nothing has changed, so nothing is sent
+	res = request(nil)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(3), m.MatchV3Ops()), m.MatchRoomSubscriptionsStrict(nil))
+
+	// changing the filters rebuilds the list
+	res = request(&sync3.RequestFilters{RoomNameFilter: "!b"})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 0, []string{roomB.RoomID}),
+	)))
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"encoding/json"
+	"hash/fnv"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// DeliveredRooms remembers the initial room data sent to a connection, so that when a room
+// re-enters the window (e.g the client scrolls back to it) the same data isn't sent again.
+// Only the expensive parts of the room are tracked: the required state, timeline and invite state.
+// Cheap fields like the room name and counts are always sent.
+type DeliveredRooms struct {
+	// room_id -> checksum of the room data the client has
+	checksums map[string]uint64
+}
+
+func NewDeliveredRooms() *DeliveredRooms {
+	return &DeliveredRooms{
+		checksums: make(map[string]uint64),
+	}
+}
+
+// Apply updates the rooms in this response, which is about to be sent to the client. Initial rooms
+// which exactly match what the client already has are sent as non-initial rooms without any events.
+// Rooms with new events invalidate what was delivered before, as the client now has those too.
+func (d *DeliveredRooms) Apply(rooms map[string]sync3.Room) {
+	for roomID, room := range rooms {
+		if !room.Initial {
+			if len(room.Timeline) > 0 || len(room.RequiredState) > 0 {
+				delete(d.checksums, roomID)
+			}
+			continue
+		}
+		checksum := roomDataChecksum(room)
+		if prev, ok := d.checksums[roomID]; !ok || prev != checksum {
+			d.checksums[roomID] = checksum
+			continue
+		}
+		room.Initial = false
+		room.RequiredState = nil
+		room.Timeline = nil
+		room.InviteState = nil
+		room.KnockState = nil
+		room.PrevBatch = ""
+		rooms[roomID] = room
+	}
+}
+
+// Forget makes the next initial data for this room be sent in full, even if the client already has
+// it. Used when the room contents must be resent from scratch e.g after a gap or state reset, as the
+// client throws away what it has for the room.
+func (d *DeliveredRooms) Forget(roomID string) {
+	delete(d.checksums, roomID)
+}
+
+func roomDataChecksum(room sync3.Room) uint64 {
+	h := fnv.New64a()
+	for _, events := range [][]json.RawMessage{room.RequiredState, room.Timeline, room.InviteState, room.KnockState} {
+		for _, ev := range events {
+			h.Write(ev)
+			h.Write([]byte{0})
+		}
+		// separate the sections so events can't move between them unnoticed
+		h.Write([]byte{1})
+	}
+	h.Write([]byte(room.PrevBatch))
+	return h.Sum64()
+}
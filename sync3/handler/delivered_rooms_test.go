@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+func TestDeliveredRooms(t *testing.T) {
+	d := NewDeliveredRooms()
+	roomID := "!a:localhost"
+	initialRoom := func() sync3.Room {
+		return sync3.Room{
+			Name:          "Room A",
+			Initial:       true,
+			RequiredState: []json.RawMessage{json.RawMessage(`{"type":"m.room.create"}`)},
+			Timeline:      []json.RawMessage{json.RawMessage(`{"event_id":"$1"}`)},
+			PrevBatch:     "prev",
+		}
+	}
+
+	rooms := map[string]sync3.Room{roomID: initialRoom()}
+	d.Apply(rooms)
+	if got := rooms[roomID]; !got.Initial || len(got.Timeline) != 1 {
+		t.Fatalf("first delivery was modified: %+v", got)
+	}
+
+	// the room re-enters the window without changing
+	rooms = map[string]sync3.Room{roomID: initialRoom()}
+	d.Apply(rooms)
+	got := rooms[roomID]
+	if got.Initial || got.Timeline != nil || got.RequiredState != nil || got.PrevBatch != "" {
+		t.Fatalf("unchanged room was resent: %+v", got)
+	}
+	if got.Name != "Room A" {
+		t.Fatalf("room name was not sent: %+v", got)
+	}
+
+	// a new event arrives live, so the client no longer has exactly what was delivered
+	rooms = map[string]sync3.Room{roomID: {Timeline: []json.RawMessage{json.RawMessage(`{"event_id":"$2"}`)}}}
+	d.Apply(rooms)
+	rooms = map[string]sync3.Room{roomID: initialRoom()}
+	d.Apply(rooms)
+	if got := rooms[roomID]; !got.Initial || len(got.Timeline) != 1 {
+		t.Fatalf("room was not resent after a live event: %+v", got)
+	}
+
+	// different data is resent
+	changed := initialRoom()
+	changed.Timeline = append(changed.Timeline, json.RawMessage(`{"event_id":"$3"}`))
+	rooms = map[string]sync3.Room{roomID: changed}
+	d.Apply(rooms)
+	if got := rooms[roomID]; !got.Initial || len(got.Timeline) != 2 {
+		t.Fatalf("changed room was not resent: %+v", got)
+	}
+
+	// the room is forced to be resent from scratch, so the same data is sent again
+	d.Forget(roomID)
+	rooms = map[string]sync3.Room{roomID: changed}
+	d.Apply(rooms)
+	if got := rooms[roomID]; !got.Initial || len(got.Timeline) != 2 {
+		t.Fatalf("forgotten room was not resent: %+v", got)
+	}
+}
@@ -183,6 +183,23 @@ func (p *EnsurePoller) OnExpiredToken(payload *pubsub.V2ExpiredToken) {
 	// by signalling via the expired flag.
 }
 
+// Forget removes any record of completed pollers for this device, or all of the user's devices if
+// deviceID is empty, so the next call to EnsurePolling will ask the pollers to start polling again.
+// Used when pollers have been stopped out-of-band. Pollers which are still performing their initial
+// sync are left alone.
+func (p *EnsurePoller) Forget(userID, deviceID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for pid, pending := range p.pendingPolls {
+		if pid.UserID != userID || (deviceID != "" && pid.DeviceID != deviceID) {
+			continue
+		}
+		if pending.done {
+			delete(p.pendingPolls, pid)
+		}
+	}
+}
+
 func (p *EnsurePoller) Teardown() {
 	p.notifier.Close()
 	if p.numPendingEnsurePolling != nil {
@@ -194,6 +194,55 @@ func TestEnsurePollerDoesntCacheFailures(t *testing.T) {
 	}
 }
 
+// check that forgetting a device causes the next EnsurePolling call to ask the pollers again
+func TestEnsurePollerForget(t *testing.T) {
+	n := &mockNotifier{ch: make(chan pubsub.Payload, 100)}
+	ctx := context.Background()
+	alice := sync2.PollerID{UserID: "@alice:localhost", DeviceID: "DEVICE"}
+	alice2 := sync2.PollerID{UserID: "@alice:localhost", DeviceID: "DEVICE2"}
+	bob := sync2.PollerID{UserID: "@bob:localhost", DeviceID: "DEVICE"}
+	ep := NewEnsurePoller(n, false)
+	for _, pid := range []sync2.PollerID{alice, alice2, bob} {
+		ep.OnInitialSyncComplete(&pubsub.V2InitialSyncComplete{
+			UserID:   pid.UserID,
+			DeviceID: pid.DeviceID,
+			Success:  true,
+		})
+	}
+
+	ep.Forget(alice.UserID, alice.DeviceID)
+	// alice2 and bob should be untouched
+	ep.EnsurePolling(ctx, alice2, "tokenHash")
+	ep.EnsurePolling(ctx, bob, "tokenHash")
+	n.MustHaveNoSentPayloads(t)
+
+	// forgetting all of alice's devices should make both devices poll again
+	ep.Forget(alice.UserID, "")
+	for _, pid := range []sync2.PollerID{alice, alice2} {
+		finished := make(chan bool) // dummy
+		go func() {
+			_ = ep.EnsurePolling(ctx, pid, "tokenHash")
+			close(finished)
+		}()
+		p := n.WaitForNextPayload(t, time.Second)
+		pp, ok := p.(*pubsub.V3EnsurePolling)
+		if !ok {
+			t.Fatalf("unexpected payload: %+v", p)
+		}
+		assertVal(t, pp.DeviceID, pid.DeviceID)
+		ep.OnInitialSyncComplete(&pubsub.V2InitialSyncComplete{
+			UserID:   pid.UserID,
+			DeviceID: pid.DeviceID,
+			Success:  true,
+		})
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
+			t.Fatalf("EnsurePolling didn't unblock after response was sent")
+		}
+	}
+}
+
 func assertVal(t *testing.T, got, want interface{}) {
 	t.Helper()
 	if !reflect.DeepEqual(got, want) {
@@ -1,16 +1,19 @@
 package handler
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
-	"os"
 	"reflect"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -34,10 +37,7 @@ import (
 
 const DefaultSessionID = "default"
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger("conn")
 
 // This is a net.http Handler for sync v3. It is responsible for pairing requests to Conns and to
 // ensure that the sync v2 poller is running for this client.
@@ -49,16 +49,37 @@ type SyncLiveHandler struct {
 	EnsurePoller *EnsurePoller
 	ConnMap      *sync3.ConnMap
 	Extensions   *extensions.Handler
+	v3Pub        pubsub.Notifier
+	pings        *pings
+	heartbeat    *heartbeat
 
 	// inserts are done by v2 poll loops, selects are done by v3 request threads
 	// but the v3 requests touch non-overlapping keys, which is a good use case for sync.Map
 	// > (2) when multiple goroutines read, write, and overwrite entries for disjoint sets of keys.
 	userCaches *sync.Map // map[user_id]*UserCache
 	Dispatcher *sync3.Dispatcher
+	// tracks when users last made a request, for evicting idle user caches
+	userCacheActivity *userCacheActivity
+	// closed on Teardown to stop background goroutines
+	shutdownCh chan struct{}
 
 	GlobalCache            *caches.GlobalCache
+	cacheMetrics           *caches.CacheMetrics
 	maxPendingEventUpdates int
 	maxTransactionIDDelay  time.Duration
+	typingCoalescer        *TypingCoalescer
+	// EnableV2Compat serves sync v2 GET requests from the proxy's database, see serveV2Compat.
+	EnableV2Compat bool
+	// wakes up sync v2 requests when there is new data for their user
+	v2CompatWaiters *v2CompatWaiters
+	// ListLimits bounds the ranges of each list in a request. Requests exceeding them are rejected.
+	ListLimits sync3.ListLimits
+	// MaxRoomSubscriptions bounds the number of room subscriptions on a connection. 0 means no limit.
+	MaxRoomSubscriptions int
+	// Introspector, if set, identifies access tokens with the OIDC provider the homeserver delegates
+	// auth to (MSC3861) instead of /whoami, and re-checks them on every request. These tokens expire
+	// and are refreshed, so conns survive their device's token expiring.
+	Introspector *sync2.TokenIntrospector
 
 	setupHistVec *prometheus.HistogramVec
 	histVec      *prometheus.HistogramVec
@@ -68,6 +89,17 @@ type SyncLiveHandler struct {
 	// TODO: could make this a CounterVec labelled by reason, to track expiry due
 	//       to update buffer filling, expiry due to inactivity, etc.
 	destroyedConns prometheus.Counter
+	// userCacheEvictions is the number of user caches evicted, labelled by reason.
+	userCacheEvictions *prometheus.CounterVec
+	// cacheSizeBytes is the estimated size of the caches, labelled by cache (global or user).
+	// Only updated when a memory budget is set.
+	cacheSizeBytes *prometheus.GaugeVec
+	// metadataRepairs is the number of drifted room metadata fields repaired, labelled by field.
+	metadataRepairs *prometheus.CounterVec
+	// gappyTimelines is the number of limited timelines which caused rooms to be resent.
+	gappyTimelines prometheus.Counter
+	// startupProgress is the progress of each startup phase from 0 to 1, labelled by phase.
+	startupProgress *prometheus.GaugeVec
 }
 
 func NewSync3Handler(
@@ -82,11 +114,17 @@ func NewSync3Handler(
 		V2Store:                storev2,
 		ConnMap:                sync3.NewConnMap(enablePrometheus, 30*time.Minute),
 		userCaches:             &sync.Map{},
+		userCacheActivity:      newUserCacheActivity(),
+		shutdownCh:             make(chan struct{}),
 		Dispatcher:             sync3.NewDispatcher(),
 		GlobalCache:            caches.NewGlobalCache(store),
 		maxPendingEventUpdates: maxPendingEventUpdates,
 		maxTransactionIDDelay:  maxTransactionIDDelay,
+		pings:                  newPings(),
+		heartbeat:              newHeartbeat(consumerStallTimeout),
+		v2CompatWaiters:        newV2CompatWaiters(),
 	}
+	sh.typingCoalescer = NewTypingCoalescer(typingCoalesceWindow, sh.publishTyping, sh.flushTyping)
 	sh.Extensions = &extensions.Handler{
 		Store:       store,
 		E2EEFetcher: sh,
@@ -96,30 +134,116 @@ func NewSync3Handler(
 	if enablePrometheus {
 		sh.addPrometheusMetrics()
 		pub = pubsub.NewPromNotifier(pub, "api")
+		sh.cacheMetrics = caches.NewCacheMetrics()
+		sh.GlobalCache.SetMetrics(sh.cacheMetrics)
 	}
 
 	// set up pubsub mechanism to start from this point
 	sh.EnsurePoller = NewEnsurePoller(pub, enablePrometheus)
-	sh.V2Sub = pubsub.NewV2Sub(sub, sh)
+	sh.v3Pub = pub
+	sh.V2Sub = pubsub.NewV2Sub(sh.heartbeat.wrapListener(sub), sh)
 
 	return sh, nil
 }
 
 func (h *SyncLiveHandler) Startup(storeSnapshot *state.StartupSnapshot) error {
-	if err := h.Dispatcher.Startup(storeSnapshot.AllJoinedMembers); err != nil {
-		return fmt.Errorf("failed to load sync3.Dispatcher: %s", err)
-	}
+	defer h.StartupPhase("load_caches")()
 	h.Dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, h.GlobalCache)
-	if err := h.GlobalCache.Startup(storeSnapshot.GlobalMetadata); err != nil {
-		return fmt.Errorf("failed to populate global cache: %s", err)
+	// the dispatcher and global cache are independent, so populate them at the same time
+	var dispatcherErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dispatcherErr = h.Dispatcher.Startup(storeSnapshot.AllJoinedMembers)
+	}()
+	globalCacheErr := h.GlobalCache.Startup(storeSnapshot.GlobalMetadata)
+	wg.Wait()
+	if dispatcherErr != nil {
+		return fmt.Errorf("failed to load sync3.Dispatcher: %s", dispatcherErr)
 	}
+	if globalCacheErr != nil {
+		return fmt.Errorf("failed to populate global cache: %s", globalCacheErr)
+	}
+	h.GlobalCache.SetLatestNID(storeSnapshot.LatestNID)
 	return nil
 }
 
+// PersistMetadataSnapshots periodically saves the GlobalCache's room metadata to the database, which
+// speeds up loading it on the next startup. Blocks until Teardown.
+func (h *SyncLiveHandler) PersistMetadataSnapshots(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			start := time.Now()
+			snapshot := h.GlobalCache.MetadataSnapshot()
+			if err := h.Storage.MetadataSnapshotTable.Upsert(snapshot); err != nil {
+				logger.Err(err).Msg("failed to persist metadata snapshot")
+				sentry.CaptureException(err)
+				continue
+			}
+			logger.Debug().Int("rooms", len(snapshot.Rooms)).Int64("nid", snapshot.LatestNID).
+				Dur("duration", time.Since(start)).Msg("persisted metadata snapshot")
+		case <-h.shutdownCh:
+			return
+		}
+	}
+}
+
+// ReconcileMetadata checks roomsPerMinute rooms in the GlobalCache against the database every minute,
+// cycling through all rooms, and repairs any metadata which has drifted. Blocks until Teardown.
+func (h *SyncLiveHandler) ReconcileMetadata(roomsPerMinute int) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	var cursor string
+	for {
+		select {
+		case <-ticker.C:
+			roomIDs := h.GlobalCache.RoomIDsAfter(cursor, roomsPerMinute)
+			if len(roomIDs) == 0 {
+				// start again from the beginning next time
+				cursor = ""
+				continue
+			}
+			cursor = roomIDs[len(roomIDs)-1]
+			h.reconcileRooms(roomIDs)
+		case <-h.shutdownCh:
+			return
+		}
+	}
+}
+
+func (h *SyncLiveHandler) reconcileRooms(roomIDs []string) {
+	ctx, task := internal.StartTask(context.Background(), "ReconcileMetadata")
+	defer task.End()
+	numRepaired := 0
+	for _, roomID := range roomIDs {
+		repaired, err := h.GlobalCache.ReconcileRoom(ctx, roomID)
+		if err != nil {
+			logger.Err(err).Str("room_id", roomID).Msg("failed to reconcile room metadata")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			continue
+		}
+		if len(repaired) > 0 {
+			numRepaired++
+		}
+		if h.metadataRepairs != nil {
+			for _, field := range repaired {
+				h.metadataRepairs.WithLabelValues(field).Inc()
+			}
+		}
+	}
+	logger.Debug().Int("rooms", len(roomIDs)).Int("repaired", numRepaired).Msg("reconciled room metadata")
+}
+
 // Listen starts all consumers
 func (h *SyncLiveHandler) Listen() {
+	h.heartbeat.setRunning(true)
 	go func() {
 		defer internal.ReportPanicsToSentry()
+		defer h.heartbeat.setRunning(false)
 		err := h.V2Sub.Listen()
 		if err != nil {
 			logger.Err(err).Msg("Failed to listen for v2 messages")
@@ -130,6 +254,7 @@ func (h *SyncLiveHandler) Listen() {
 
 // used in tests to close postgres connections
 func (h *SyncLiveHandler) Teardown() {
+	close(h.shutdownCh)
 	// tear down DB conns
 	h.Storage.Teardown()
 	h.V2Sub.Teardown()
@@ -147,6 +272,22 @@ func (h *SyncLiveHandler) Teardown() {
 	if h.destroyedConns != nil {
 		prometheus.Unregister(h.destroyedConns)
 	}
+	if h.userCacheEvictions != nil {
+		prometheus.Unregister(h.userCacheEvictions)
+	}
+	if h.cacheSizeBytes != nil {
+		prometheus.Unregister(h.cacheSizeBytes)
+	}
+	if h.metadataRepairs != nil {
+		prometheus.Unregister(h.metadataRepairs)
+	}
+	if h.gappyTimelines != nil {
+		prometheus.Unregister(h.gappyTimelines)
+	}
+	if h.startupProgress != nil {
+		prometheus.Unregister(h.startupProgress)
+	}
+	h.cacheMetrics.Teardown()
 }
 
 func (h *SyncLiveHandler) addPrometheusMetrics() {
@@ -180,15 +321,54 @@ func (h *SyncLiveHandler) addPrometheusMetrics() {
 	prometheus.MustRegister(h.setupHistVec)
 	prometheus.MustRegister(h.histVec)
 	prometheus.MustRegister(h.slowReqs)
+	h.userCacheEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "user_cache_evictions",
+		Help:      "Number of user caches evicted, labelled by reason (idle, capacity or memory).",
+	}, []string{"reason"})
+	h.cacheSizeBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "cache_size_bytes",
+		Help:      "Estimated size of the in-memory caches in bytes, labelled by cache (global or user).",
+	}, []string{"cache"})
+	h.metadataRepairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "metadata_repairs",
+		Help:      "Number of drifted room metadata fields repaired by reconciling with the database, labelled by field.",
+	}, []string{"field"})
+	h.gappyTimelines = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "gappy_timelines",
+		Help:      "Number of limited timelines with a gap before them, which cause the room to be resent with initial: true.",
+	})
+	h.startupProgress = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "startup_progress",
+		Help:      "Progress of each phase of startup from 0 to 1, labelled by phase.",
+	}, []string{"phase"})
 	prometheus.MustRegister(h.destroyedConns)
+	prometheus.MustRegister(h.userCacheEvictions)
+	prometheus.MustRegister(h.cacheSizeBytes)
+	prometheus.MustRegister(h.metadataRepairs)
+	prometheus.MustRegister(h.gappyTimelines)
+	prometheus.MustRegister(h.startupProgress)
 }
 
 func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if req.Method != "POST" {
+	var err error
+	if req.Method == "GET" && h.EnableV2Compat {
+		err = h.serveV2Compat(w, req)
+	} else if req.Method != "POST" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
+	} else {
+		err = h.serve(w, req)
 	}
-	err := h.serve(w, req)
 	if err != nil {
 		herr, ok := err.(*internal.HandlerError)
 		if !ok {
@@ -224,19 +404,33 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 	var requestBody sync3.Request
 	if req.ContentLength != 0 {
 		defer req.Body.Close()
-		if err := json.NewDecoder(req.Body).Decode(&requestBody); err != nil {
-			log.Warn().Err(err).Msg("failed to read/decode request body")
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to read request body")
 			return &internal.HandlerError{
 				StatusCode: 400,
 				Err:        err,
 			}
 		}
-		if err := requestBody.Validate(); err != nil {
+		parsed, err := sync3.ParseRequest(body)
+		if err != nil {
+			var validationErr *sync3.ValidationError
+			if errors.As(err, &validationErr) {
+				return invalidRequestError(validationErr)
+			}
+			log.Warn().Err(err).Msg("failed to decode request body")
 			return &internal.HandlerError{
 				StatusCode: 400,
 				Err:        err,
 			}
 		}
+		requestBody = *parsed
+		if unknownFields := sync3.UnknownRequestFields(body); len(unknownFields) > 0 {
+			hlog.FromRequest(req).Debug().Strs("fields", unknownFields).Msg("ignoring unknown request fields")
+		}
+	}
+	if strings.HasSuffix(req.URL.Path, "/org.matrix.simplified_msc3575/sync") {
+		requestBody.Simplified = true
 	}
 	if requestBody.ConnID != "" {
 		req = req.WithContext(internal.SetAttributeOnContext(req.Context(), internal.OTLPTagConnID, requestBody.ConnID))
@@ -248,13 +442,11 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		c.Str("txn_id", requestBody.TxnID)
 		return c
 	})
-	for listKey, l := range requestBody.Lists {
-		if l.Ranges != nil && !l.Ranges.Valid() {
-			return &internal.HandlerError{
-				StatusCode: 400,
-				Err:        fmt.Errorf("list[%v] invalid ranges %v", listKey, l.Ranges),
-			}
-		}
+	if err := requestBody.ValidateListLimits(h.ListLimits); err != nil {
+		return listLimitError(err.(*sync3.ListLimitError))
+	}
+	if err := requestBody.ValidateRoomSubscriptionLimit(h.MaxRoomSubscriptions); err != nil {
+		return roomSubscriptionLimitError(err.(*sync3.RoomSubscriptionLimitError))
 	}
 
 	logErrorOrWarning := func(msg string, herr *internal.HandlerError) {
@@ -299,6 +491,9 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		logErrorOrWarning("failed to OnIncomingRequest", herr)
 		return herr
 	}
+	if requestBody.Simplified {
+		resp = resp.Simplified()
+	}
 	// for logging
 	var numToDeviceEvents int
 	if resp.Extensions.ToDevice != nil {
@@ -318,9 +513,20 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		numChangedDevices, numLeftDevices, requestBody.ConnID, len(requestBody.Lists), len(requestBody.RoomSubscriptions), len(requestBody.UnsubscribeRooms),
 	)
 
+	buf := responseBuffers.Get().(*bytes.Buffer)
+	defer putResponseBuffer(buf)
+	if err := json.NewEncoder(buf).Encode(resp); err != nil {
+		herr = &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+		logErrorOrWarning("failed to JSON-encode result", herr)
+		return herr
+	}
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
 	w.WriteHeader(200)
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
+	if _, err := w.Write(buf.Bytes()); err != nil {
 		herr = &internal.HandlerError{
 			StatusCode: 500,
 			Err:        err,
@@ -335,20 +541,36 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 			herr.StatusCode = 499
 		}
 
-		logErrorOrWarning("failed to JSON-encode result", herr)
+		logErrorOrWarning("failed to write result", herr)
 		return herr
 	}
 	return nil
 }
 
-// setupConnection associates this request with an existing connection or makes a new connection.
-// It also sets a v2 sync poll loop going if one didn't exist already for this user.
-// When this function returns, the connection is alive and active.
-func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.CancelFunc, syncReq *sync3.Request, containsPos bool) (*http.Request, *sync3.Conn, *internal.HandlerError) {
-	ctx, task := internal.StartTask(req.Context(), "setupConnection")
-	req = req.WithContext(ctx)
-	defer task.End()
-	var conn *sync3.Conn
+// responseBuffers holds buffers to JSON-encode responses into. Responses are often large, so
+// reusing buffers between requests saves a lot of allocations. Buffers must not be used after
+// they are put back, so the response must be fully written first.
+var responseBuffers = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// Buffers which grew beyond this size are not reused, so a single huge response (e.g an initial
+// sync for a large account) doesn't keep that much memory allocated.
+const maxPooledResponseBufferSize = 1 << 20 // 1MB
+
+func putResponseBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledResponseBufferSize {
+		return
+	}
+	buf.Reset()
+	responseBuffers.Put(buf)
+}
+
+// identifyRequest works out which user and device the access token in this request belongs to, asking
+// the homeserver if we have not seen the token before.
+func (h *SyncLiveHandler) identifyRequest(req *http.Request) (*http.Request, *sync2.Token, *internal.HandlerError) {
 	// Extract an access token
 	accessToken, err := internal.ExtractAccessToken(req)
 	if err != nil || accessToken == "" {
@@ -359,6 +581,15 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 		}
 	}
 
+	// Check the token is still valid. Without an introspection endpoint we rely on the poller
+	// seeing a 401 instead.
+	if h.Introspector != nil {
+		if _, _, herr := h.introspect(req.Context(), accessToken); herr != nil {
+			hlog.FromRequest(req).Warn().Err(herr).Msg("access token failed introspection")
+			return req, nil, herr
+		}
+	}
+
 	// Try to lookup a record of this token
 	var token *sync2.Token
 	token, err = h.V2Store.TokensTable.Token(accessToken)
@@ -380,20 +611,37 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	}
 	req = req.WithContext(internal.SetAttributeOnContext(req.Context(), internal.OTLPTagUserID, token.UserID))
 	req = req.WithContext(internal.SetAttributeOnContext(req.Context(), internal.OTLPTagDeviceID, token.DeviceID))
-	log := hlog.FromRequest(req).With().
-		Str("user", token.UserID).
-		Str("device", token.DeviceID).
-		Str("conn", syncReq.ConnID).
-		Logger()
 	req = req.WithContext(internal.AssociateUserIDWithRequest(req.Context(), token.UserID, token.DeviceID))
 	internal.Logf(req.Context(), "setupConnection", "identified access token as user=%s device=%s", token.UserID, token.DeviceID)
 
+	h.userCacheActivity.touch(token.UserID, time.Now())
+
 	// Record the fact that we've recieved a request from this token
 	err = h.V2Store.TokensTable.MaybeUpdateLastSeen(token, time.Now())
 	if err != nil {
 		// Not fatal---log and continue.
-		log.Warn().Err(err).Msg("Unable to update last seen timestamp")
+		hlog.FromRequest(req).Warn().Err(err).Str("user", token.UserID).Str("device", token.DeviceID).Msg("Unable to update last seen timestamp")
 	}
+	return req, token, nil
+}
+
+// setupConnection associates this request with an existing connection or makes a new connection.
+// It also sets a v2 sync poll loop going if one didn't exist already for this user.
+// When this function returns, the connection is alive and active.
+func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.CancelFunc, syncReq *sync3.Request, containsPos bool) (*http.Request, *sync3.Conn, *internal.HandlerError) {
+	ctx, task := internal.StartTask(req.Context(), "setupConnection")
+	req = req.WithContext(ctx)
+	defer task.End()
+	var conn *sync3.Conn
+	req, token, herr := h.identifyRequest(req)
+	if herr != nil {
+		return req, nil, herr
+	}
+	log := hlog.FromRequest(req).With().
+		Str("user", token.UserID).
+		Str("device", token.DeviceID).
+		Str("conn", syncReq.ConnID).
+		Logger()
 
 	connID := sync3.ConnID{
 		UserID:   token.UserID,
@@ -404,6 +652,20 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	if containsPos {
 		// Lookup the connection
 		conn = h.ConnMap.Conn(connID)
+		if conn != nil {
+			// The conn can outlive the access token it was made with if the client refreshed its
+			// token, so the poller may have stopped when the old token expired. Restart it with
+			// this token, which is for the same device. This is a no-op if the poller is running.
+			pid := sync2.PollerID{UserID: token.UserID, DeviceID: token.DeviceID}
+			if expiredToken := h.EnsurePoller.EnsurePolling(req.Context(), pid, token.AccessTokenHash); expiredToken {
+				log.Error().Msg("EnsurePolling failed for existing conn, returning 401")
+				return req, nil, &internal.HandlerError{
+					StatusCode: http.StatusUnauthorized,
+					ErrCode:    "M_UNKNOWN_TOKEN",
+					Err:        fmt.Errorf("EnsurePolling failed: access token invalid or invalidated"),
+				}
+			}
+		}
 		if conn != nil {
 			conn.SetCancelCallback(cancel)
 			log.Trace().Str("conn", conn.ConnID.String()).Msg("reusing conn")
@@ -454,13 +716,41 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	// to check for an existing connection though, as it's possible for the client to call /sync
 	// twice for a new connection.
 	conn = h.ConnMap.CreateConn(connID, cancel, func() sync3.ConnHandler {
-		return NewConnState(token.UserID, token.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher, h.setupHistVec, h.histVec, h.maxPendingEventUpdates, h.maxTransactionIDDelay)
+		cs := NewConnState(token.UserID, token.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher, h.setupHistVec, h.histVec, h.maxPendingEventUpdates, h.maxTransactionIDDelay)
+		cs.maxRoomSubscriptions = h.MaxRoomSubscriptions
+		return cs
 	})
 	log.Info().Msg("created new connection")
 	return req, conn, nil
 }
 
+// introspect asks the OIDC provider who owns the access token. Results are cached by the Introspector.
+func (h *SyncLiveHandler) introspect(ctx context.Context, accessToken string) (userID, deviceID string, herr *internal.HandlerError) {
+	userID, deviceID, err := h.Introspector.Introspect(ctx, accessToken)
+	if err != nil {
+		if err == sync2.HTTP401 {
+			return "", "", &internal.HandlerError{
+				StatusCode: 401,
+				Err:        fmt.Errorf("token introspection: token is not active"),
+				ErrCode:    "M_UNKNOWN_TOKEN",
+			}
+		}
+		return "", "", &internal.HandlerError{
+			StatusCode: http.StatusBadGateway,
+			Err:        err,
+		}
+	}
+	return userID, deviceID, nil
+}
+
 func (h *SyncLiveHandler) identifyUnknownAccessToken(ctx context.Context, accessToken string, logger *zerolog.Logger) (*sync2.Token, *internal.HandlerError) {
+	if h.Introspector != nil {
+		userID, deviceID, herr := h.introspect(ctx, accessToken)
+		if herr != nil {
+			return nil, herr
+		}
+		return h.insertAccessToken(accessToken, userID, deviceID, logger)
+	}
 	// We don't recognise the given accessToken. Ask the homeserver who owns it.
 	userID, deviceID, err := h.V2.WhoAmI(ctx, accessToken)
 	if err != nil {
@@ -477,9 +767,15 @@ func (h *SyncLiveHandler) identifyUnknownAccessToken(ctx context.Context, access
 			Err:        err,
 		}
 	}
+	return h.insertAccessToken(accessToken, userID, deviceID, logger)
+}
 
+// insertAccessToken stores a newly identified access token. If the device already has a poller, the
+// client has refreshed its token, so the poller is told to switch to the new one.
+func (h *SyncLiveHandler) insertAccessToken(accessToken, userID, deviceID string, logger *zerolog.Logger) (*sync2.Token, *internal.HandlerError) {
 	var token *sync2.Token
-	err = sqlutil.WithTransaction(h.V2Store.DB, func(txn *sqlx.Tx) error {
+	err := sqlutil.WithTransaction(h.V2Store.DB, func(txn *sqlx.Tx) error {
+		var err error
 		// Create a brand-new row for this token.
 		token, err = h.V2Store.TokensTable.Insert(txn, accessToken, userID, deviceID, time.Now())
 		if err != nil {
@@ -500,6 +796,13 @@ func (h *SyncLiveHandler) identifyUnknownAccessToken(ctx context.Context, access
 		return nil, &internal.HandlerError{StatusCode: 500, Err: err}
 	}
 
+	if err = h.v3Pub.Notify(pubsub.ChanV3, &pubsub.V3TokenRefreshed{
+		UserID:          userID,
+		DeviceID:        deviceID,
+		AccessTokenHash: token.AccessTokenHash,
+	}); err != nil {
+		logger.Warn().Err(err).Str("user", userID).Str("device", deviceID).Msg("failed to notify pollers of new access token")
+	}
 	return token, nil
 }
 
@@ -526,64 +829,133 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 	// bail if we already have a cache
 	c, ok := h.userCaches.Load(userID)
 	if ok {
+		h.cacheMetrics.Hit(caches.CacheUserCaches, 1)
 		return c.(*caches.UserCache), nil
 	}
-	uc := caches.NewUserCache(userID, h.GlobalCache, h.Storage, h, h.Dispatcher)
-	// select all non-zero highlight or notif counts and set them, as this is less costly than looping every room/user pair
-	err := h.Storage.UnreadTable.SelectAllNonZeroCountsForUser(userID, func(roomID string, highlightCount, notificationCount int) {
-		uc.OnUnreadCounts(context.Background(), roomID, &highlightCount, &notificationCount)
-	})
+	h.cacheMetrics.DBFallback(caches.CacheUserCaches, 1)
+	uc, err := LoadUserCache(userID, h.GlobalCache, h.Storage, h, h.Dispatcher)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load unread counts: %s", err)
+		return nil, err
 	}
-	// select the DM account data event and set DM room status
-	directEvent, err := h.Storage.AccountData(userID, sync2.AccountDataGlobalRoom, []string{"m.direct"})
-	if err != nil {
-		return nil, fmt.Errorf("failed to load direct message status for rooms: %s", err)
+
+	// use LoadOrStore here else we can race as 2 brand new /sync conns can both get to this point
+	// at the same time
+	actualUC, loaded := h.userCaches.LoadOrStore(userID, uc)
+	uc = actualUC.(*caches.UserCache)
+	if !loaded { // we actually inserted the cache, so register with the dispatcher.
+		if err := h.Dispatcher.Register(context.Background(), userID, uc); err != nil {
+			h.Dispatcher.Unregister(userID)
+			h.userCaches.Delete(userID)
+			return nil, fmt.Errorf("failed to register user cache with dispatcher: %s", err)
+		}
+		h.cacheMetrics.AddEntries(caches.CacheUserCaches, 1)
+	}
+
+	return uc, nil
+}
+
+// The max number of LoadUserCache queries which run at the same time, across all users. Each load
+// runs its queries in parallel, so without this a burst of new users would take a database
+// connection per query.
+var userCacheLoadQueries = make(chan struct{}, runtime.GOMAXPROCS(0))
+
+// LoadUserCache creates a caches.UserCache for this user and populates it with their unread counts,
+// DM rooms, ignored users, room tags and outstanding invites and knocks from the database. The cache is not
+// registered with the Dispatcher, so it will not see any updates.
+func LoadUserCache(userID string, globalCache *caches.GlobalCache, store *state.Storage, txnIDs caches.TransactionIDFetcher, joinChecker caches.JoinChecker) (*caches.UserCache, error) {
+	uc := caches.NewUserCache(userID, globalCache, store, txnIDs, joinChecker)
+	// these tables are independent, so load them at the same time and then apply them in order
+	type unreadCounts struct {
+		roomID                            string
+		highlightCount, notificationCount int
+	}
+	var (
+		wg                       sync.WaitGroup
+		unreads                  []unreadCounts
+		directEvent, ignoreEvent []state.AccountData
+		tagEvents                []state.AccountData
+		invites, knocks          map[string][]json.RawMessage
+		errs                     [6]error
+	)
+	load := func(i int, query func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			userCacheLoadQueries <- struct{}{}
+			defer func() { <-userCacheLoadQueries }()
+			errs[i] = query()
+		}()
+	}
+	load(0, func() error {
+		// select all non-zero highlight or notif counts, as this is less costly than looping every room/user pair
+		return store.UnreadTable.SelectAllNonZeroCountsForUser(userID, func(roomID string, highlightCount, notificationCount int) {
+			unreads = append(unreads, unreadCounts{roomID, highlightCount, notificationCount})
+		})
+	})
+	load(1, func() (err error) {
+		// select the DM account data event to set DM room status
+		directEvent, err = store.AccountData(userID, sync2.AccountDataGlobalRoom, []string{"m.direct"})
+		return
+	})
+	load(2, func() (err error) {
+		// select the ignored users account data event to set the ignored user list
+		ignoreEvent, err = store.AccountData(userID, sync2.AccountDataGlobalRoom, []string{"m.ignored_user_list"})
+		return
+	})
+	load(3, func() (err error) {
+		// select all room tag account data
+		tagEvents, err = store.RoomAccountDatasWithType(userID, "m.tag")
+		return
+	})
+	load(4, func() (err error) {
+		// select outstanding invites
+		invites, err = store.InvitesTable.SelectAllInvitesForUser(userID)
+		return
+	})
+	load(5, func() (err error) {
+		// select outstanding knocks
+		knocks, err = store.KnocksTable.SelectAllKnocksForUser(userID)
+		return
+	})
+	wg.Wait()
+
+	if errs[0] != nil {
+		return nil, fmt.Errorf("failed to load unread counts: %s", errs[0])
+	}
+	for _, u := range unreads {
+		highlightCount, notificationCount := u.highlightCount, u.notificationCount
+		uc.OnUnreadCounts(context.Background(), u.roomID, &highlightCount, &notificationCount)
+	}
+	if errs[1] != nil {
+		return nil, fmt.Errorf("failed to load direct message status for rooms: %s", errs[1])
 	}
 	if len(directEvent) == 1 {
 		uc.OnAccountData(context.Background(), []state.AccountData{directEvent[0]})
 	}
-
-	// select the ignored users account data event and set ignored user list
-	ignoreEvent, err := h.Storage.AccountData(userID, sync2.AccountDataGlobalRoom, []string{"m.ignored_user_list"})
-	if err != nil {
-		return nil, fmt.Errorf("failed to load ignored user list for user %s: %w", userID, err)
+	if errs[2] != nil {
+		return nil, fmt.Errorf("failed to load ignored user list for user %s: %w", userID, errs[2])
 	}
 	if len(ignoreEvent) == 1 {
 		uc.OnAccountData(context.Background(), []state.AccountData{ignoreEvent[0]})
 	}
-
-	// select all room tag account data and set it
-	tagEvents, err := h.Storage.RoomAccountDatasWithType(userID, "m.tag")
-	if err != nil {
-		return nil, fmt.Errorf("failed to load room tags %s", err)
+	if errs[3] != nil {
+		return nil, fmt.Errorf("failed to load room tags %s", errs[3])
 	}
 	if len(tagEvents) > 0 {
 		uc.OnAccountData(context.Background(), tagEvents)
 	}
-
-	// select outstanding invites
-	invites, err := h.Storage.InvitesTable.SelectAllInvitesForUser(userID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load outstanding invites for user: %s", err)
+	if errs[4] != nil {
+		return nil, fmt.Errorf("failed to load outstanding invites for user: %s", errs[4])
 	}
 	for roomID, inviteState := range invites {
 		uc.OnInvite(context.Background(), roomID, inviteState)
 	}
-
-	// use LoadOrStore here else we can race as 2 brand new /sync conns can both get to this point
-	// at the same time
-	actualUC, loaded := h.userCaches.LoadOrStore(userID, uc)
-	uc = actualUC.(*caches.UserCache)
-	if !loaded { // we actually inserted the cache, so register with the dispatcher.
-		if err = h.Dispatcher.Register(context.Background(), userID, uc); err != nil {
-			h.Dispatcher.Unregister(userID)
-			h.userCaches.Delete(userID)
-			return nil, fmt.Errorf("failed to register user cache with dispatcher: %s", err)
-		}
+	if errs[5] != nil {
+		return nil, fmt.Errorf("failed to load outstanding knocks for user: %s", errs[5])
+	}
+	for roomID, knockState := range knocks {
+		uc.OnKnock(context.Background(), roomID, knockState)
 	}
-
 	return uc, nil
 }
 
@@ -663,8 +1035,18 @@ func (h *SyncLiveHandler) Accumulate(p *pubsub.V2Accumulate) {
 	internal.Logf(ctx, "room", fmt.Sprintf("%s: %d events", p.RoomID, len(events)))
 	// we have new events, notify active connections
 	for i := range events {
+		// Resend the room once the last event has been cached, so that the fresh timeline and
+		// prev_batch include the whole batch.
+		if p.Gappy && i == len(events)-1 {
+			h.Dispatcher.OnNewEventAfterGap(ctx, p.RoomID, events[i], p.EventNIDs[i])
+			continue
+		}
 		h.Dispatcher.OnNewEvent(ctx, p.RoomID, events[i], p.EventNIDs[i])
 	}
+	h.v2CompatWaiters.notifyRoom(p.RoomID, events, h.Dispatcher.IsUserJoined)
+	if p.Gappy && h.gappyTimelines != nil {
+		h.gappyTimelines.Inc()
+	}
 }
 
 // OnTransactionID is called from the v2 poller, implements V2DataReceiver.
@@ -690,6 +1072,7 @@ func (h *SyncLiveHandler) Initialise(p *pubsub.V2Initialise) {
 	}
 	// we have new state, notify caches
 	h.Dispatcher.OnNewInitialRoomState(ctx, p.RoomID, state)
+	h.v2CompatWaiters.notifyRoom(p.RoomID, state, h.Dispatcher.IsUserJoined)
 }
 
 func (h *SyncLiveHandler) OnUnreadCounts(p *pubsub.V2UnreadCounts) {
@@ -708,6 +1091,7 @@ func (h *SyncLiveHandler) OnDeviceData(p *pubsub.V2DeviceData) {
 	defer task.End()
 	internal.Logf(ctx, "device_data", fmt.Sprintf("%v users to notify", len(p.UserIDToDeviceIDs)))
 	for userID, deviceIDs := range p.UserIDToDeviceIDs {
+		h.v2CompatWaiters.notify(userID)
 		for _, deviceID := range deviceIDs {
 			conns := h.ConnMap.Conns(userID, deviceID)
 			for _, conn := range conns {
@@ -720,6 +1104,7 @@ func (h *SyncLiveHandler) OnDeviceData(p *pubsub.V2DeviceData) {
 func (h *SyncLiveHandler) OnDeviceMessages(p *pubsub.V2DeviceMessages) {
 	ctx, task := internal.StartTask(context.Background(), "OnDeviceMessages")
 	defer task.End()
+	h.v2CompatWaiters.notify(p.UserID)
 	conns := h.ConnMap.Conns(p.UserID, p.DeviceID)
 	for _, conn := range conns {
 		conn.OnUpdate(ctx, caches.DeviceEventsUpdate{})
@@ -730,6 +1115,7 @@ func (h *SyncLiveHandler) OnDeviceMessages(p *pubsub.V2DeviceMessages) {
 func (h *SyncLiveHandler) OnInvite(p *pubsub.V2InviteRoom) {
 	ctx, task := internal.StartTask(context.Background(), "OnInvite")
 	defer task.End()
+	h.v2CompatWaiters.notify(p.UserID)
 	userCache, ok := h.userCaches.Load(p.UserID)
 	if !ok {
 		return
@@ -743,9 +1129,26 @@ func (h *SyncLiveHandler) OnInvite(p *pubsub.V2InviteRoom) {
 	userCache.(*caches.UserCache).OnInvite(ctx, p.RoomID, inviteState)
 }
 
+func (h *SyncLiveHandler) OnKnock(p *pubsub.V2KnockRoom) {
+	ctx, task := internal.StartTask(context.Background(), "OnKnock")
+	defer task.End()
+	userCache, ok := h.userCaches.Load(p.UserID)
+	if !ok {
+		return
+	}
+	knockState, err := h.Storage.KnocksTable.SelectKnockState(p.UserID, p.RoomID)
+	if err != nil {
+		logger.Err(err).Str("user", p.UserID).Str("room", p.RoomID).Msg("failed to get knock state")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	userCache.(*caches.UserCache).OnKnock(ctx, p.RoomID, knockState)
+}
+
 func (h *SyncLiveHandler) OnLeftRoom(p *pubsub.V2LeaveRoom) {
 	ctx, task := internal.StartTask(context.Background(), "OnLeftRoom")
 	defer task.End()
+	h.v2CompatWaiters.notify(p.UserID)
 	userCache, ok := h.userCaches.Load(p.UserID)
 	if !ok {
 		return
@@ -786,20 +1189,40 @@ func (h *SyncLiveHandler) OnReceipt(p *pubsub.V2Receipt) {
 }
 
 func (h *SyncLiveHandler) OnTyping(p *pubsub.V2Typing) {
+	h.typingCoalescer.OnTyping(p.RoomID, p.EphemeralEvent)
+}
+
+func (h *SyncLiveHandler) OnTypingFlush(p *pubsub.V2TypingFlush) {
+	h.typingCoalescer.CloseWindow(p.RoomID)
+}
+
+// flushTyping is called by the typing coalescer's timers when a room's window ends. The window is
+// closed via the V2 stream, so the coalesced notification is published on the consumer goroutine.
+func (h *SyncLiveHandler) flushTyping(roomID string) {
+	if err := h.v3Pub.Notify(pubsub.ChanV2, &pubsub.V2TypingFlush{RoomID: roomID}); err != nil {
+		// the payload is reported as dropped, and OnDroppedPayloads closes the window
+		logger.Err(err).Str("room_id", roomID).Msg("failed to flush typing notifications")
+	}
+}
+
+// publishTyping wakes up the connections in the room with the latest typing notification. Called by
+// the typing coalescer.
+func (h *SyncLiveHandler) publishTyping(roomID string, ephEvent json.RawMessage) {
 	ctx, task := internal.StartTask(context.Background(), "OnTyping")
 	defer task.End()
-	rooms := h.GlobalCache.LoadRooms(ctx, p.RoomID)
-	if rooms[p.RoomID] != nil {
-		if reflect.DeepEqual(p.EphemeralEvent, rooms[p.RoomID].TypingEvent) {
+	rooms := h.GlobalCache.LoadRooms(ctx, roomID)
+	if rooms[roomID] != nil {
+		if reflect.DeepEqual(ephEvent, rooms[roomID].TypingEvent) {
 			return // it's a duplicate, which happens when 2+ users are in the same room
 		}
 	}
-	h.Dispatcher.OnEphemeralEvent(ctx, p.RoomID, p.EphemeralEvent)
+	h.Dispatcher.OnEphemeralEvent(ctx, roomID, ephEvent)
 }
 
 func (h *SyncLiveHandler) OnAccountData(p *pubsub.V2AccountData) {
 	ctx, task := internal.StartTask(context.Background(), "OnAccountData")
 	defer task.End()
+	h.v2CompatWaiters.notify(p.UserID)
 	userCache, ok := h.userCaches.Load(p.UserID)
 	if !ok {
 		return
@@ -815,6 +1238,12 @@ func (h *SyncLiveHandler) OnAccountData(p *pubsub.V2AccountData) {
 
 func (h *SyncLiveHandler) OnExpiredToken(p *pubsub.V2ExpiredToken) {
 	h.EnsurePoller.OnExpiredToken(p)
+	if h.Introspector != nil || p.SoftLogout {
+		// The access token expired but the client is expected to refresh it, so keep the conns:
+		// the client can carry on with a new token for this device without a full resync.
+		// Devices which can't get a new token can't use their conns, so they will be reaped.
+		return
+	}
 	h.ConnMap.CloseConnsForDevice(p.UserID, p.DeviceID)
 }
 
@@ -857,23 +1286,180 @@ func (h *SyncLiveHandler) OnInvalidateRoom(p *pubsub.V2InvalidateRoom) {
 	// 2. Reload the joined-room tracker.
 	h.Dispatcher.OnInvalidateRoom(p.RoomID, joins, invites)
 
-	// 3. Destroy involved users' caches.
+	// 3. Destroy involved users' caches and connections.
+	unregistered, destroyed := h.destroyUserCachesAndConns(involvedUsers)
+	// invalidations are rare and dangerous if we get it wrong, so log information about it.
+	logger.Info().
+		Str("room_id", p.RoomID).Int("joins", len(joins)).Int("invites", len(invites)).Int("leaves", len(leaves)).
+		Int("del_user_caches", len(unregistered)).Int("conns_destroyed", destroyed).Msg("OnInvalidateRoom")
+}
+
+// OnDroppedPayloads is called when payloads from the pollers have been lost, so the caches are
+// missing whatever they contained. The rooms they were about are reloaded as if they had been
+// invalidated, and the users they were about have their caches and connections destroyed, so that
+// clients resync from the database rather than silently missing updates.
+func (h *SyncLiveHandler) OnDroppedPayloads(p *pubsub.DroppedPayloads) {
+	logger.Error().Int("count", p.Count).Strs("types", p.Types).Int("rooms", len(p.RoomIDs)).Int("users", len(p.UserIDs)).
+		Msg("OnDroppedPayloads: payloads from the pollers were lost, resyncing affected rooms and users")
+	for _, roomID := range p.RoomIDs {
+		h.OnInvalidateRoom(&pubsub.V2InvalidateRoom{RoomID: roomID})
+		// the lost payload may have been the end of the room's typing window
+		h.typingCoalescer.CloseWindow(roomID)
+	}
+	if len(p.UserIDs) > 0 {
+		h.destroyUserCachesAndConns(p.UserIDs)
+	}
+}
+
+// OnStateRewind reloads the room from the database and resends it in full to the connections of
+// joined and invited users. Unlike OnInvalidateRoom, caches and connections are kept.
+func (h *SyncLiveHandler) OnStateRewind(p *pubsub.V2StateRewind) {
+	ctx, task := internal.StartTask(context.Background(), "OnStateRewind")
+	defer task.End()
+
+	h.GlobalCache.OnInvalidateRoom(ctx, p.RoomID)
+
+	joins, invites, _, err := h.Storage.FetchMemberships(p.RoomID)
+	if err != nil {
+		logger.Err(err).Str("room_id", p.RoomID).Msg("OnStateRewind: failed to fetch members")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	h.Dispatcher.OnInvalidateRoom(p.RoomID, joins, invites)
+
+	notified := 0
+	for _, userID := range append(joins, invites...) {
+		userCache, ok := h.userCaches.Load(userID)
+		if !ok {
+			continue
+		}
+		userCache.(*caches.UserCache).OnStateRewind(ctx, p.RoomID)
+		notified++
+	}
+	logger.Info().
+		Str("room_id", p.RoomID).Int("joins", len(joins)).Int("invites", len(invites)).
+		Int("user_caches", notified).Msg("OnStateRewind")
+}
+
+func (h *SyncLiveHandler) OnPurgeRoom(p *pubsub.V2PurgeRoom) {
+	ctx, task := internal.StartTask(context.Background(), "OnPurgeRoom")
+	defer task.End()
+
+	h.GlobalCache.OnPurgeRoom(ctx, p.RoomID)
+	h.Dispatcher.OnPurgeRoom(p.RoomID)
+	// Conns may have the room in their lists or room subscriptions, so tell them to remove it,
+	// which clients see as the room being deleted from their lists, as if they had left it.
+	notified := 0
+	for _, userID := range p.UserIDs {
+		userCache, ok := h.userCaches.Load(userID)
+		if !ok {
+			continue
+		}
+		userCache.(*caches.UserCache).OnPurgeRoom(ctx, p.RoomID)
+		notified++
+	}
+	logger.Info().
+		Str("room_id", p.RoomID).Int("users", len(p.UserIDs)).
+		Int("user_caches", notified).Msg("OnPurgeRoom")
+}
+
+func (h *SyncLiveHandler) OnEraseUser(p *pubsub.V2EraseUser) {
+	ctx, task := internal.StartTask(context.Background(), "OnEraseUser")
+	defer task.End()
+
+	// Reload heroes, whose names and avatars come from membership events.
+	for _, roomID := range p.RoomIDs {
+		h.GlobalCache.OnInvalidateRoom(ctx, roomID)
+	}
+	// The user is most likely deactivated, so there is no harm in making their clients resync.
+	// Other users' conns are left alone: they will see the stripped membership events the next
+	// time the events are loaded from the database.
+	unregistered, destroyed := h.destroyUserCachesAndConns([]string{p.UserID})
+	logger.Info().
+		Str("user", p.UserID).Int("rooms", len(p.RoomIDs)).
+		Int("del_user_caches", len(unregistered)).Int("conns_destroyed", destroyed).Msg("OnEraseUser")
+}
+
+// destroyUserCachesAndConns destroys the caches and connections of the given users, returning the
+// users who had a cache and the number of conns destroyed.
+func (h *SyncLiveHandler) destroyUserCachesAndConns(userIDs []string) (unregistered []string, destroyed int) {
 	// We filter to only those users which had a userCache registered to receive updates.
-	unregistered := h.Dispatcher.UnregisterBulk(involvedUsers)
+	unregistered = h.Dispatcher.UnregisterBulk(userIDs)
 	for _, userID := range unregistered {
 		h.userCaches.Delete(userID)
 	}
+	h.userCacheActivity.forget(userIDs)
+	h.cacheMetrics.AddEntries(caches.CacheUserCaches, -len(unregistered))
 
-	// 4. Destroy involved users' connections.
 	// Since creating a conn creates a user cache, it is safe to loop over
-	destroyed := h.ConnMap.CloseConnsForUsers(unregistered)
+	destroyed = h.ConnMap.CloseConnsForUsers(unregistered)
 	if h.destroyedConns != nil {
 		h.destroyedConns.Add(float64(destroyed))
 	}
-	// invalidations are rare and dangerous if we get it wrong, so log information about it.
-	logger.Info().
-		Str("room_id", p.RoomID).Int("joins", len(joins)).Int("invites", len(invites)).Int("leaves", len(leaves)).
-		Int("del_user_caches", len(unregistered)).Int("conns_destroyed", destroyed).Msg("OnInvalidateRoom")
+	return unregistered, destroyed
+}
+
+// EvictConns destroys all connections for the given user's device, or all of the user's devices
+// if deviceID is empty. Clients will receive M_UNKNOWN_POS on their next request. If forgetPollers
+// is set, the next new connection for the device(s) will ask the pollers to start polling again,
+// which should be set if the pollers have been stopped. Returns the number of conns destroyed.
+func (h *SyncLiveHandler) EvictConns(userID, deviceID string, forgetPollers bool) int {
+	var destroyed int
+	if deviceID == "" {
+		destroyed = h.ConnMap.CloseConnsForUsers([]string{userID})
+	} else {
+		destroyed = h.ConnMap.CloseConnsForDevice(userID, deviceID)
+	}
+	if forgetPollers {
+		h.EnsurePoller.Forget(userID, deviceID)
+	}
+	if h.destroyedConns != nil {
+		h.destroyedConns.Add(float64(destroyed))
+	}
+	logger.Info().Str("user", userID).Str("device", deviceID).Int("conns_destroyed", destroyed).Msg("evicted conns")
+	return destroyed
+}
+
+// listLimitError returns a 400 which tells the client which list exceeded which limit.
+func listLimitError(err *sync3.ListLimitError) *internal.HandlerError {
+	return &internal.HandlerError{
+		StatusCode: 400,
+		Err:        err,
+		ErrCode:    "M_INVALID_PARAM",
+		Fields: map[string]interface{}{
+			"list_key": err.ListKey,
+			"limit":    err.Limit,
+			"max":      err.Max,
+			"got":      err.Got,
+		},
+	}
+}
+
+// invalidRequestError returns a 400 which tells the client which field of the request is invalid.
+func invalidRequestError(err *sync3.ValidationError) *internal.HandlerError {
+	return &internal.HandlerError{
+		StatusCode: 400,
+		Err:        err,
+		ErrCode:    "M_INVALID_PARAM",
+		Fields: map[string]interface{}{
+			"field": err.Field,
+		},
+	}
+}
+
+// roomSubscriptionLimitError returns a 400 which tells the client which room subscriptions were
+// over the limit, so it can retry with fewer.
+func roomSubscriptionLimitError(err *sync3.RoomSubscriptionLimitError) *internal.HandlerError {
+	return &internal.HandlerError{
+		StatusCode: 400,
+		Err:        err,
+		ErrCode:    "M_INVALID_PARAM",
+		Fields: map[string]interface{}{
+			"limit":                       sync3.LimitMaxRoomSubscriptions,
+			"max":                         err.Max,
+			"rejected_room_subscriptions": err.Rejected,
+		},
+	}
 }
 
 func parseIntFromQuery(u *url.URL, param string) (result int64, err *internal.HandlerError) {
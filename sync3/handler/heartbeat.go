@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/pubsub"
+)
+
+// consumerStallTimeout is how long the V2 consumer goroutine can spend on a single payload before it
+// is considered wedged. Payloads are processed one at a time, so a busy consumer still makes progress
+// well within this.
+const consumerStallTimeout = 2 * time.Minute
+
+// heartbeat tracks whether the V2 consumer goroutine, which feeds the dispatcher, is still running.
+// The consumer updates it before and after every payload, so it is only stale if the consumer has
+// exited or is stuck processing a single payload.
+type heartbeat struct {
+	mu        *sync.Mutex
+	running   bool
+	busy      bool
+	lastBeat  time.Time
+	stallTime time.Duration
+}
+
+func newHeartbeat(stallTime time.Duration) *heartbeat {
+	return &heartbeat{
+		mu:        &sync.Mutex{},
+		stallTime: stallTime,
+	}
+}
+
+func (b *heartbeat) setRunning(running bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.running = running
+	b.lastBeat = time.Now()
+}
+
+func (b *heartbeat) beat(busy bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.busy = busy
+	b.lastBeat = time.Now()
+}
+
+func (b *heartbeat) check() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.running {
+		return fmt.Errorf("consumer goroutine is not running")
+	}
+	if b.busy && time.Since(b.lastBeat) > b.stallTime {
+		return fmt.Errorf("consumer goroutine has been processing a payload since %s", b.lastBeat.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// wrapListener returns a listener which beats before and after calling fn for each payload.
+func (b *heartbeat) wrapListener(l pubsub.Listener) pubsub.Listener {
+	return &heartbeatListener{
+		Listener:  l,
+		heartbeat: b,
+	}
+}
+
+type heartbeatListener struct {
+	pubsub.Listener
+	heartbeat *heartbeat
+}
+
+func (l *heartbeatListener) Listen(chanName string, fn func(p pubsub.Payload)) error {
+	return l.Listener.Listen(chanName, func(p pubsub.Payload) {
+		l.heartbeat.beat(true)
+		defer l.heartbeat.beat(false)
+		fn(p)
+	})
+}
+
+// Alive returns an error if the V2 consumer goroutine which feeds the dispatcher has exited or is
+// wedged on a single payload. Unlike Ping, it does not wait behind queued payloads, so a consumer
+// which is busy but making progress is alive.
+func (h *SyncLiveHandler) Alive(ctx context.Context) error {
+	return h.heartbeat.check()
+}
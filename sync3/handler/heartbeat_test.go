@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/pubsub"
+)
+
+func TestHeartbeat(t *testing.T) {
+	b := newHeartbeat(50 * time.Millisecond)
+	if err := b.check(); err == nil {
+		t.Fatalf("check returned no error before the consumer started")
+	}
+	ps := pubsub.NewPubSub(1)
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	b.setRunning(true)
+	go func() {
+		defer b.setRunning(false)
+		b.wrapListener(ps).Listen(pubsub.ChanV2, func(p pubsub.Payload) {
+			if _, ok := p.(*pubsub.V2Pong); ok {
+				close(started)
+				<-unblock
+			}
+		})
+	}()
+
+	// an idle consumer is alive, however long it has been idle
+	time.Sleep(100 * time.Millisecond)
+	if err := b.check(); err != nil {
+		t.Fatalf("check returned error for an idle consumer: %s", err)
+	}
+
+	// a consumer stuck on a payload is not
+	if err := ps.Notify(pubsub.ChanV2, &pubsub.V2Pong{ID: 1}); err != nil {
+		t.Fatalf("Notify: %s", err)
+	}
+	<-started
+	if err := b.check(); err != nil {
+		t.Fatalf("check returned error as soon as a payload started: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := b.check(); err == nil {
+		t.Fatalf("check returned no error for a stuck consumer")
+	}
+	close(unblock)
+	time.Sleep(10 * time.Millisecond)
+	if err := b.check(); err != nil {
+		t.Fatalf("check returned error once the payload finished: %s", err)
+	}
+
+	// a consumer which has exited is not
+	ps.Close()
+	time.Sleep(10 * time.Millisecond)
+	if err := b.check(); err == nil {
+		t.Fatalf("check returned no error after the consumer exited")
+	}
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/sliding-sync/pubsub"
+)
+
+// pings tracks V3Ping payloads which are waiting for a V2Pong.
+type pings struct {
+	mu      *sync.Mutex
+	nextID  int64
+	waiting map[int64]chan struct{}
+}
+
+func newPings() *pings {
+	return &pings{
+		mu:      &sync.Mutex{},
+		waiting: make(map[int64]chan struct{}),
+	}
+}
+
+func (p *pings) add() (int64, chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextID++
+	ch := make(chan struct{})
+	p.waiting[p.nextID] = ch
+	return p.nextID, ch
+}
+
+func (p *pings) remove(id int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.waiting, id)
+}
+
+func (p *pings) done(id int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch, ok := p.waiting[id]
+	if !ok {
+		return // the caller gave up waiting
+	}
+	delete(p.waiting, id)
+	close(ch)
+}
+
+// Ping sends a V3Ping to the pollers and blocks until the matching V2Pong has been processed by
+// the V2 consumer goroutine, or the context is cancelled. A successful ping means both pubsub
+// channels are flowing and neither consumer is wedged.
+func (h *SyncLiveHandler) Ping(ctx context.Context) error {
+	id, ch := h.pings.add()
+	defer h.pings.remove(id)
+	if err := h.v3Pub.Notify(pubsub.ChanV3, &pubsub.V3Ping{ID: id}); err != nil {
+		return fmt.Errorf("failed to send ping: %w", err)
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for pong: %w", ctx.Err())
+	}
+}
+
+func (h *SyncLiveHandler) OnPong(p *pubsub.V2Pong) {
+	h.pings.done(p.ID)
+}
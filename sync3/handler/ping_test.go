@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/pubsub"
+)
+
+func TestPing(t *testing.T) {
+	n := &mockNotifier{ch: make(chan pubsub.Payload, 100)}
+	h := &SyncLiveHandler{
+		v3Pub: n,
+		pings: newPings(),
+	}
+	// echo pings back as pongs, like handler2 does
+	go func() {
+		for p := range n.ch {
+			h.OnPong(&pubsub.V2Pong{ID: p.(*pubsub.V3Ping).ID})
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		if err := h.Ping(ctx); err != nil {
+			t.Fatalf("Ping returned error: %s", err)
+		}
+	}
+	close(n.ch)
+}
+
+func TestPingTimesOut(t *testing.T) {
+	n := &mockNotifier{ch: make(chan pubsub.Payload, 100)}
+	h := &SyncLiveHandler{
+		v3Pub: n,
+		pings: newPings(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := h.Ping(ctx); err == nil {
+		t.Fatalf("Ping returned no error when nothing replied")
+	}
+	// a late pong should be ignored
+	p := n.WaitForNextPayload(t, time.Second)
+	h.OnPong(&pubsub.V2Pong{ID: p.(*pubsub.V3Ping).ID})
+	if len(h.pings.waiting) != 0 {
+		t.Fatalf("pings still waiting: %v", h.pings.waiting)
+	}
+}
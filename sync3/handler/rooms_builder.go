@@ -49,6 +49,22 @@ func (rb *RoomsBuilder) IncludesRoom(roomID string) bool {
 	return false
 }
 
+// RoomIDs returns the unique room IDs which have been added to any subscription in this builder.
+func (rb *RoomsBuilder) RoomIDs() []string {
+	seen := make(map[string]struct{})
+	var roomIDs []string
+	for _, rids := range rb.subToRooms {
+		for _, roomID := range rids {
+			if _, exists := seen[roomID]; exists {
+				continue
+			}
+			seen[roomID] = struct{}{}
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	return roomIDs
+}
+
 // Add a room subscription to the builder, e.g from a list or room subscription. This should NOT
 // be a combined subscription.
 func (rb *RoomsBuilder) AddSubscription(rs sync3.RoomSubscription) (id int) {
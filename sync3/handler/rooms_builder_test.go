@@ -163,7 +163,7 @@ func TestRoomsBuilder(t *testing.T) {
 				},
 				{
 					RoomSubscription: sync3.RoomSubscription{
-						RequiredState: [][2]string{{"m.room.name", ""}, {"m.room.name", ""}, {"m.room.topic", ""}},
+						RequiredState: [][2]string{{"m.room.name", ""}, {"m.room.topic", ""}},
 						TimelineLimit: 1,
 					},
 					RoomIDs: []string{"!b", "!c"},
@@ -0,0 +1,49 @@
+package handler
+
+// The number of most recent timeline event IDs remembered per room by SentTimelineEvents.
+const maxSentTimelineEventsPerRoom = 50
+
+// SentTimelineEvents remembers the most recent timeline event IDs sent to a connection in each
+// room, so extensions can tell whether the client has an event, e.g to drop receipts for events
+// the client has never seen. Older events are forgotten, so this may report false negatives for
+// events far back in the timeline.
+type SentTimelineEvents struct {
+	// room_id -> event IDs, oldest first
+	rooms map[string][]string
+}
+
+func NewSentTimelineEvents() *SentTimelineEvents {
+	return &SentTimelineEvents{
+		rooms: make(map[string][]string),
+	}
+}
+
+// Apply remembers the timeline events in this response, which is about to be sent to the client.
+func (s *SentTimelineEvents) Apply(roomIDToTimeline map[string][]string) {
+	for roomID, eventIDs := range roomIDToTimeline {
+		if len(eventIDs) == 0 {
+			continue
+		}
+		sent := append(s.rooms[roomID], eventIDs...)
+		if len(sent) > maxSentTimelineEventsPerRoom {
+			// copy so the backing array doesn't keep growing
+			sent = append([]string(nil), sent[len(sent)-maxSentTimelineEventsPerRoom:]...)
+		}
+		s.rooms[roomID] = sent
+	}
+}
+
+// Sent returns true if the event was recently sent to the client in this room's timeline.
+func (s *SentTimelineEvents) Sent(roomID, eventID string) bool {
+	for _, sentEventID := range s.rooms[roomID] {
+		if sentEventID == eventID {
+			return true
+		}
+	}
+	return false
+}
+
+// EventIDs returns the event IDs recently sent to the client in this room's timeline, oldest first.
+func (s *SentTimelineEvents) EventIDs(roomID string) []string {
+	return append([]string(nil), s.rooms[roomID]...)
+}
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSentTimelineEvents(t *testing.T) {
+	s := NewSentTimelineEvents()
+	roomA := "!a:localhost"
+	roomB := "!b:localhost"
+	s.Apply(map[string][]string{
+		roomA: {"$1", "$2"},
+		roomB: {},
+	})
+	if !s.Sent(roomA, "$1") || !s.Sent(roomA, "$2") {
+		t.Fatalf("events in room A were not remembered")
+	}
+	if s.Sent(roomB, "$1") {
+		t.Fatalf("event from room A was remembered in room B")
+	}
+	if s.Sent(roomA, "$3") {
+		t.Fatalf("unsent event was remembered")
+	}
+
+	// older events are forgotten once the room has too many
+	var eventIDs []string
+	for i := 0; i < maxSentTimelineEventsPerRoom; i++ {
+		eventIDs = append(eventIDs, fmt.Sprintf("$new%d", i))
+	}
+	s.Apply(map[string][]string{roomA: eventIDs})
+	if s.Sent(roomA, "$1") {
+		t.Fatalf("old event was not forgotten")
+	}
+	if !s.Sent(roomA, eventIDs[0]) || !s.Sent(roomA, eventIDs[len(eventIDs)-1]) {
+		t.Fatalf("new events were not remembered")
+	}
+	if len(s.rooms[roomA]) != maxSentTimelineEventsPerRoom {
+		t.Fatalf("got %d events for room A, want %d", len(s.rooms[roomA]), maxSentTimelineEventsPerRoom)
+	}
+}
@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"time"
+)
+
+// StartupPhase marks the start of a phase of startup, e.g loading the global snapshot, and returns
+// a function to call when it completes. Startup can take minutes for large deployments, so the
+// duration of each phase is logged, and the progress of each phase is exposed as a gauge.
+func (h *SyncLiveHandler) StartupPhase(phase string) (end func()) {
+	start := time.Now()
+	logger.Info().Str("phase", phase).Msg("startup phase started")
+	h.setStartupProgress(phase, 0)
+	return func() {
+		h.setStartupProgress(phase, 1)
+		logger.Info().Str("phase", phase).Dur("duration", time.Since(start)).Msg("startup phase finished")
+	}
+}
+
+// setStartupProgress sets the progress of a startup phase, from 0 to 1.
+func (h *SyncLiveHandler) setStartupProgress(phase string, progress float64) {
+	if h.startupProgress == nil {
+		return
+	}
+	h.startupProgress.WithLabelValues(phase).Set(progress)
+}
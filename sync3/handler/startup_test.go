@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStartupPhase(t *testing.T) {
+	h := &SyncLiveHandler{
+		startupProgress: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "startup_progress"}, []string{"phase"}),
+	}
+	end := h.StartupPhase("global_snapshot")
+	if got := testutil.ToFloat64(h.startupProgress.WithLabelValues("global_snapshot")); got != 0 {
+		t.Errorf("progress of a running phase: got %v want 0", got)
+	}
+	h.setStartupProgress("global_snapshot", 0.5)
+	if got := testutil.ToFloat64(h.startupProgress.WithLabelValues("global_snapshot")); got != 0.5 {
+		t.Errorf("progress after setStartupProgress: got %v want 0.5", got)
+	}
+	end()
+	if got := testutil.ToFloat64(h.startupProgress.WithLabelValues("global_snapshot")); got != 1 {
+		t.Errorf("progress of a finished phase: got %v want 1", got)
+	}
+
+	// phases can be tracked without metrics enabled
+	(&SyncLiveHandler{}).StartupPhase("load_caches")()
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// The window in which typing notifications for a room are coalesced.
+const typingCoalesceWindow = 250 * time.Millisecond
+
+// TypingCoalescer limits how often typing notifications are fanned out to connections in a room.
+// Each typing EDU wakes every connection in the room, so in large rooms with many typists a burst of
+// EDUs causes a storm of responses. The first notification for a room is published immediately, then
+// any which arrive within the window are coalesced and only the latest is published when the window ends.
+//
+// The coalescer never publishes from its timers. When a window ends it calls flush, which must arrange
+// for CloseWindow to be called on the goroutine which calls OnTyping, so notifications are published
+// in order with the rest of the V2 stream.
+type TypingCoalescer struct {
+	window  time.Duration
+	publish func(roomID string, ephEvent json.RawMessage)
+	flush   func(roomID string)
+	// afterFunc schedules the end of a window. Replaced in tests.
+	afterFunc func(d time.Duration, f func())
+	// mu guards the rooms map. It is never held when publishing.
+	mu sync.Mutex
+	// room_id -> latest typing EDU received in the current window, or nil if there isn't one. Rooms
+	// are only present whilst their window is open.
+	rooms map[string]json.RawMessage
+}
+
+func NewTypingCoalescer(window time.Duration, publish func(roomID string, ephEvent json.RawMessage), flush func(roomID string)) *TypingCoalescer {
+	return &TypingCoalescer{
+		window:  window,
+		publish: publish,
+		flush:   flush,
+		afterFunc: func(d time.Duration, f func()) {
+			time.AfterFunc(d, f)
+		},
+		rooms: make(map[string]json.RawMessage),
+	}
+}
+
+func (c *TypingCoalescer) OnTyping(roomID string, ephEvent json.RawMessage) {
+	if c.window <= 0 {
+		c.publish(roomID, ephEvent)
+		return
+	}
+	c.mu.Lock()
+	_, windowOpen := c.rooms[roomID]
+	// replace whatever was waiting if the window is open, only the latest typing state matters
+	if windowOpen {
+		c.rooms[roomID] = ephEvent
+	} else {
+		c.rooms[roomID] = nil
+	}
+	c.mu.Unlock()
+	if windowOpen {
+		return
+	}
+	c.publish(roomID, ephEvent)
+	c.afterFunc(c.window, func() { c.flush(roomID) })
+}
+
+// CloseWindow ends the room's window, publishing the latest typing notification received in it.
+// A no-op if the room has no open window.
+func (c *TypingCoalescer) CloseWindow(roomID string) {
+	c.mu.Lock()
+	ephEvent, windowOpen := c.rooms[roomID]
+	if ephEvent == nil {
+		delete(c.rooms, roomID)
+	} else {
+		// open a new window, in case the burst continues
+		c.rooms[roomID] = nil
+	}
+	c.mu.Unlock()
+	if !windowOpen || ephEvent == nil {
+		return
+	}
+	c.publish(roomID, ephEvent)
+	c.afterFunc(c.window, func() { c.flush(roomID) })
+}
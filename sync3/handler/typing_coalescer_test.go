@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type typingPublish struct {
+	roomID   string
+	ephEvent string
+}
+
+// Test that
+// - the first typing notification for a room is published immediately
+// - notifications within the window are coalesced into the latest one
+// - rooms are coalesced independently
+// - the coalescer only flushes from its timers, and publishes when the window is closed
+func TestTypingCoalescer(t *testing.T) {
+	const room1 = "!room1"
+	const room2 = "!room2"
+	window := 50 * time.Millisecond
+	var published []typingPublish
+	var flushed []string
+	c := NewTypingCoalescer(window, func(roomID string, ephEvent json.RawMessage) {
+		published = append(published, typingPublish{roomID, string(ephEvent)})
+	}, func(roomID string) {
+		flushed = append(flushed, roomID)
+	})
+	// timers fire when the test says so
+	var timers []func()
+	c.afterFunc = func(d time.Duration, f func()) {
+		if d != window {
+			t.Fatalf("timer scheduled for %v want %v", d, window)
+		}
+		timers = append(timers, f)
+	}
+	fireTimers := func() {
+		fire := timers
+		timers = nil
+		for _, f := range fire {
+			f()
+		}
+	}
+	// the handler closes windows when the flush comes back through the V2 stream
+	closeFlushed := func() {
+		rooms := flushed
+		flushed = nil
+		for _, roomID := range rooms {
+			c.CloseWindow(roomID)
+		}
+	}
+	assertPublished := func(msg string, want []typingPublish) {
+		t.Helper()
+		if len(published) != len(want) {
+			t.Fatalf("%s: got %v want %v", msg, published, want)
+		}
+		for i := range want {
+			if published[i] != want[i] {
+				t.Fatalf("%s: got %v want %v", msg, published, want)
+			}
+		}
+	}
+
+	c.OnTyping(room1, json.RawMessage(`1`))
+	c.OnTyping(room1, json.RawMessage(`2`))
+	c.OnTyping(room1, json.RawMessage(`3`))
+	c.OnTyping(room2, json.RawMessage(`a`))
+	assertPublished("immediately", []typingPublish{{room1, `1`}, {room2, `a`}})
+
+	// the timers only flush, they never publish
+	fireTimers()
+	if len(flushed) != 2 {
+		t.Fatalf("got flushes %v want both rooms", flushed)
+	}
+	assertPublished("after timers fire", []typingPublish{{room1, `1`}, {room2, `a`}})
+
+	closeFlushed()
+	assertPublished("after one window", []typingPublish{{room1, `1`}, {room2, `a`}, {room1, `3`}})
+
+	// nothing else arrived, so the window closes without publishing again
+	fireTimers()
+	closeFlushed()
+	assertPublished("after two windows", []typingPublish{{room1, `1`}, {room2, `a`}, {room1, `3`}})
+	if len(timers) != 0 {
+		t.Fatalf("got %d timers scheduled after the windows closed, want 0", len(timers))
+	}
+
+	// the window has closed, so the next notification is published immediately
+	c.OnTyping(room1, json.RawMessage(`4`))
+	assertPublished("after windows close", []typingPublish{{room1, `1`}, {room2, `a`}, {room1, `3`}, {room1, `4`}})
+
+	// closing a window which isn't open does nothing
+	c.CloseWindow(room2)
+	assertPublished("after closing a closed window", []typingPublish{{room1, `1`}, {room2, `a`}, {room1, `3`}, {room1, `4`}})
+}
+
+func TestTypingCoalescerDisabled(t *testing.T) {
+	var published []string
+	c := NewTypingCoalescer(0, func(roomID string, ephEvent json.RawMessage) {
+		published = append(published, string(ephEvent))
+	}, func(roomID string) {
+		t.Fatalf("flushed %s with coalescing disabled", roomID)
+	})
+	c.OnTyping("!room", json.RawMessage(`1`))
+	c.OnTyping("!room", json.RawMessage(`2`))
+	if len(published) != 2 {
+		t.Fatalf("got %v want both notifications published", published)
+	}
+}
@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// Reasons for evicting a UserCache, used as metric labels.
+const (
+	evictReasonIdle     = "idle"
+	evictReasonCapacity = "capacity"
+	evictReasonMemory   = "memory"
+)
+
+// userCacheActivity records when each user last made a request, so that the UserCaches of
+// inactive users can be evicted.
+type userCacheActivity struct {
+	mu       *sync.Mutex
+	lastUsed map[string]time.Time
+}
+
+func newUserCacheActivity() *userCacheActivity {
+	return &userCacheActivity{
+		mu:       &sync.Mutex{},
+		lastUsed: make(map[string]time.Time),
+	}
+}
+
+func (a *userCacheActivity) touch(userID string, t time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastUsed[userID] = t
+}
+
+func (a *userCacheActivity) forget(userIDs []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, userID := range userIDs {
+		delete(a.lastUsed, userID)
+	}
+}
+
+// evictionCandidates returns the users whose caches should be evicted, least recently used first.
+// Users for whom hasConns returns true are never returned, but still count towards maxCaches.
+//   - idle users have not made a request since now - ttl. Disabled if ttl is 0.
+//   - overCapacity users are the least recently used users which need to be evicted to bring the
+//     number of tracked users down to maxCaches. Disabled if maxCaches is 0.
+func (a *userCacheActivity) evictionCandidates(now time.Time, ttl time.Duration, maxCaches int, hasConns func(userID string) bool) (idle, overCapacity []string) {
+	evictable := a.leastRecentlyUsed()
+	numRemaining := len(evictable)
+	for _, u := range evictable {
+		isIdle := ttl > 0 && now.Sub(u.lastUsed) > ttl
+		isOverCapacity := maxCaches > 0 && numRemaining > maxCaches
+		if !isIdle && !isOverCapacity {
+			// everyone after this is more recently used, so won't be idle either
+			break
+		}
+		if hasConns(u.userID) {
+			continue
+		}
+		if isIdle {
+			idle = append(idle, u.userID)
+		} else {
+			overCapacity = append(overCapacity, u.userID)
+		}
+		numRemaining--
+	}
+	return idle, overCapacity
+}
+
+// overBudgetCandidates returns the least recently used users whose caches need to be evicted to
+// bring usedBytes down to budgetBytes, according to sizeOf. Users for whom hasConns returns true
+// are never returned. If evicting every other user is not enough, they are all returned.
+func (a *userCacheActivity) overBudgetCandidates(budgetBytes, usedBytes int64, hasConns func(userID string) bool, sizeOf func(userID string) int64) (overBudget []string) {
+	if budgetBytes <= 0 || usedBytes <= budgetBytes {
+		return nil
+	}
+	for _, u := range a.leastRecentlyUsed() {
+		if usedBytes <= budgetBytes {
+			break
+		}
+		if hasConns(u.userID) {
+			continue
+		}
+		overBudget = append(overBudget, u.userID)
+		usedBytes -= sizeOf(u.userID)
+	}
+	return overBudget
+}
+
+type userLastUsed struct {
+	userID   string
+	lastUsed time.Time
+}
+
+func (a *userCacheActivity) leastRecentlyUsed() []userLastUsed {
+	a.mu.Lock()
+	users := make([]userLastUsed, 0, len(a.lastUsed))
+	for userID, lastUsed := range a.lastUsed {
+		users = append(users, userLastUsed{userID, lastUsed})
+	}
+	a.mu.Unlock()
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].lastUsed.Before(users[j].lastUsed)
+	})
+	return users
+}
+
+// EvictUserCaches periodically destroys the UserCaches of users without any connections who have
+// not made a request for ttl. If there are more than maxCaches UserCaches, the least recently used
+// caches of users without connections are also destroyed, as they are if the estimated size of all
+// caches exceeds memoryBudgetBytes. A ttl, maxCaches or memoryBudgetBytes of 0 disables that policy.
+// Evicted caches are rebuilt from the database when the user next syncs. Blocks until Teardown.
+func (h *SyncLiveHandler) EvictUserCaches(ttl time.Duration, maxCaches int, memoryBudgetBytes int64) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.evictUserCaches(time.Now(), ttl, maxCaches, memoryBudgetBytes)
+		case <-h.shutdownCh:
+			return
+		}
+	}
+}
+
+func (h *SyncLiveHandler) evictUserCaches(now time.Time, ttl time.Duration, maxCaches int, memoryBudgetBytes int64) {
+	idle, overCapacity := h.userCacheActivity.evictionCandidates(now, ttl, maxCaches, h.ConnMap.HasConns)
+	// A user may have made a new connection since we checked, in which case their conns are
+	// destroyed as well. The client will resync and rebuild the cache.
+	idleEvicted, idleDestroyed := h.destroyUserCachesAndConns(idle)
+	capacityEvicted, capacityDestroyed := h.destroyUserCachesAndConns(overCapacity)
+
+	// The memory budget is checked after the other policies, as they may have freed enough.
+	var memoryEvicted []string
+	var memoryDestroyed int
+	if memoryBudgetBytes > 0 {
+		globalSize, userSize := h.estimateCacheSizes()
+		overBudget := h.userCacheActivity.overBudgetCandidates(
+			memoryBudgetBytes, globalSize+userSize, h.ConnMap.HasConns, h.estimateUserCacheSize,
+		)
+		if len(overBudget) > 0 {
+			logger.Warn().Int64("budget_bytes", memoryBudgetBytes).Int64("global_bytes", globalSize).
+				Int64("user_bytes", userSize).Int("evicting", len(overBudget)).Msg("caches over memory budget")
+		}
+		memoryEvicted, memoryDestroyed = h.destroyUserCachesAndConns(overBudget)
+	}
+
+	if len(idleEvicted) == 0 && len(capacityEvicted) == 0 && len(memoryEvicted) == 0 {
+		return
+	}
+	if h.userCacheEvictions != nil {
+		h.userCacheEvictions.WithLabelValues(evictReasonIdle).Add(float64(len(idleEvicted)))
+		h.userCacheEvictions.WithLabelValues(evictReasonCapacity).Add(float64(len(capacityEvicted)))
+		h.userCacheEvictions.WithLabelValues(evictReasonMemory).Add(float64(len(memoryEvicted)))
+	}
+	logger.Info().
+		Int("idle", len(idleEvicted)).Int("over_capacity", len(capacityEvicted)).Int("over_budget", len(memoryEvicted)).
+		Int("conns_destroyed", idleDestroyed+capacityDestroyed+memoryDestroyed).Msg("evicted user caches")
+}
+
+// estimateCacheSizes returns the estimated size in bytes of the global cache and all user caches,
+// and reports them to prometheus.
+func (h *SyncLiveHandler) estimateCacheSizes() (globalSize, userSize int64) {
+	globalSize = h.GlobalCache.EstimateSize()
+	h.userCaches.Range(func(_, uc any) bool {
+		userSize += uc.(*caches.UserCache).EstimateSize()
+		return true
+	})
+	if h.cacheSizeBytes != nil {
+		h.cacheSizeBytes.WithLabelValues("global").Set(float64(globalSize))
+		h.cacheSizeBytes.WithLabelValues("user").Set(float64(userSize))
+	}
+	return globalSize, userSize
+}
+
+func (h *SyncLiveHandler) estimateUserCacheSize(userID string) int64 {
+	uc, ok := h.userCaches.Load(userID)
+	if !ok {
+		return 0
+	}
+	return uc.(*caches.UserCache).EstimateSize()
+}
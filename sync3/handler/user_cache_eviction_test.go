@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUserCacheEvictionCandidates(t *testing.T) {
+	now := time.Now()
+	noConns := func(userID string) bool { return false }
+	// alice is the least recently used, eve the most.
+	newActivity := func() *userCacheActivity {
+		a := newUserCacheActivity()
+		a.touch("@alice:localhost", now.Add(-72*time.Hour))
+		a.touch("@bob:localhost", now.Add(-48*time.Hour))
+		a.touch("@charlie:localhost", now.Add(-2*time.Hour))
+		a.touch("@doris:localhost", now.Add(-time.Hour))
+		a.touch("@eve:localhost", now)
+		return a
+	}
+	testCases := []struct {
+		name             string
+		ttl              time.Duration
+		maxCaches        int
+		hasConns         func(userID string) bool
+		wantIdle         []string
+		wantOverCapacity []string
+	}{
+		{
+			name:     "disabled",
+			hasConns: noConns,
+		},
+		{
+			name:     "ttl",
+			ttl:      24 * time.Hour,
+			hasConns: noConns,
+			wantIdle: []string{"@alice:localhost", "@bob:localhost"},
+		},
+		{
+			name:             "max caches",
+			maxCaches:        2,
+			hasConns:         noConns,
+			wantOverCapacity: []string{"@alice:localhost", "@bob:localhost", "@charlie:localhost"},
+		},
+		{
+			name:             "ttl and max caches",
+			ttl:              24 * time.Hour,
+			maxCaches:        2,
+			hasConns:         noConns,
+			wantIdle:         []string{"@alice:localhost", "@bob:localhost"},
+			wantOverCapacity: []string{"@charlie:localhost"},
+		},
+		{
+			name:      "users with conns are not evicted but count towards max caches",
+			ttl:       24 * time.Hour,
+			maxCaches: 2,
+			hasConns: func(userID string) bool {
+				return userID == "@alice:localhost" || userID == "@charlie:localhost"
+			},
+			wantIdle:         []string{"@bob:localhost"},
+			wantOverCapacity: []string{"@doris:localhost", "@eve:localhost"},
+		},
+	}
+	for _, tc := range testCases {
+		idle, overCapacity := newActivity().evictionCandidates(now, tc.ttl, tc.maxCaches, tc.hasConns)
+		if !reflect.DeepEqual(idle, tc.wantIdle) {
+			t.Errorf("%s: got idle %v want %v", tc.name, idle, tc.wantIdle)
+		}
+		if !reflect.DeepEqual(overCapacity, tc.wantOverCapacity) {
+			t.Errorf("%s: got over capacity %v want %v", tc.name, overCapacity, tc.wantOverCapacity)
+		}
+	}
+}
+
+func TestUserCacheActivityForget(t *testing.T) {
+	now := time.Now()
+	a := newUserCacheActivity()
+	a.touch("@alice:localhost", now.Add(-48*time.Hour))
+	a.forget([]string{"@alice:localhost"})
+	idle, _ := a.evictionCandidates(now, time.Hour, 0, func(userID string) bool { return false })
+	if len(idle) != 0 {
+		t.Fatalf("got idle users %v after forgetting them", idle)
+	}
+}
+
+func TestUserCacheOverBudgetCandidates(t *testing.T) {
+	now := time.Now()
+	a := newUserCacheActivity()
+	a.touch("@alice:localhost", now.Add(-3*time.Hour))
+	a.touch("@bob:localhost", now.Add(-2*time.Hour))
+	a.touch("@charlie:localhost", now.Add(-time.Hour))
+	sizes := map[string]int64{
+		"@alice:localhost":   100,
+		"@bob:localhost":     200,
+		"@charlie:localhost": 300,
+	}
+	sizeOf := func(userID string) int64 { return sizes[userID] }
+	noConns := func(userID string) bool { return false }
+	testCases := []struct {
+		name     string
+		budget   int64
+		used     int64
+		hasConns func(userID string) bool
+		want     []string
+	}{
+		{
+			name:     "disabled",
+			used:     1000,
+			hasConns: noConns,
+		},
+		{
+			name:     "under budget",
+			budget:   1000,
+			used:     1000,
+			hasConns: noConns,
+		},
+		{
+			name:     "evicts least recently used until under budget",
+			budget:   800,
+			used:     1000,
+			hasConns: noConns,
+			want:     []string{"@alice:localhost", "@bob:localhost"},
+		},
+		{
+			name:   "users with conns are not evicted",
+			budget: 800,
+			used:   1000,
+			hasConns: func(userID string) bool {
+				return userID == "@alice:localhost"
+			},
+			want: []string{"@bob:localhost"},
+		},
+		{
+			name:     "evicts everyone if the budget cannot be met",
+			budget:   100,
+			used:     1000,
+			hasConns: noConns,
+			want:     []string{"@alice:localhost", "@bob:localhost", "@charlie:localhost"},
+		},
+	}
+	for _, tc := range testCases {
+		got := a.overBudgetCandidates(tc.budget, tc.used, tc.hasConns, sizeOf)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The number of user caches to warm at the same time. Each one makes several database queries.
+const warmUserCacheWorkers = 4
+
+// WarmUserCaches builds UserCaches for the users of the numDevices most recently seen devices, so
+// their first request after a restart does not have to load everything from the database. Users
+// are warmed by a few workers, most recently seen first. Stops early on Teardown.
+func (h *SyncLiveHandler) WarmUserCaches(numDevices int) {
+	defer h.StartupPhase("warm_user_caches")()
+	start := time.Now()
+	userIDs, err := h.V2Store.TokensTable.RecentlyActiveUsers(numDevices)
+	if err != nil {
+		logger.Err(err).Msg("WarmUserCaches: failed to select recently active users")
+		return
+	}
+	userIDCh := make(chan string)
+	var warmed, done atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(warmUserCacheWorkers)
+	for i := 0; i < warmUserCacheWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for userID := range userIDCh {
+				if _, err := h.userCache(userID); err != nil {
+					logger.Warn().Err(err).Str("user", userID).Msg("WarmUserCaches: failed to load user cache")
+				} else {
+					// track the cache so that it can be evicted if the user does not come back
+					h.userCacheActivity.touch(userID, time.Now())
+					warmed.Add(1)
+				}
+				h.setStartupProgress("warm_user_caches", float64(done.Add(1))/float64(len(userIDs)))
+			}
+		}()
+	}
+send:
+	for _, userID := range userIDs {
+		select {
+		case <-h.shutdownCh:
+			break send
+		case userIDCh <- userID:
+		}
+	}
+	close(userIDCh)
+	wg.Wait()
+	logger.Info().Int64("users", warmed.Load()).Dur("duration", time.Since(start)).Msg("warmed user caches")
+}
@@ -0,0 +1,403 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/rs/zerolog/hlog"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	v2CompatTimelineLimit = 10
+	v2CompatToDeviceLimit = 100
+	v2CompatMaxTimeout    = 60 * time.Second
+)
+
+// v2CompatSince is the since token handed out by the sync v2 compatibility endpoint. It combines
+// the event NID position with the to-device, account data and invite positions, as
+// "<event nid>_<to-device position>_<account data position>_<invite position>".
+type v2CompatSince struct {
+	EventPos       int64
+	ToDevicePos    int64
+	AccountDataPos int64
+	InvitePos      int64
+}
+
+func (s v2CompatSince) String() string {
+	return fmt.Sprintf("%d_%d_%d_%d", s.EventPos, s.ToDevicePos, s.AccountDataPos, s.InvitePos)
+}
+
+// parseV2CompatSince parses a since token. Tokens we did not hand out, e.g from the homeserver a
+// client used before it was pointed at the proxy, are treated as an initial sync. Tokens from older
+// versions of the proxy lack the account data and invite positions, so all account data and
+// invites are sent again.
+func parseV2CompatSince(since string) (result v2CompatSince, ok bool) {
+	parts := strings.Split(since, "_")
+	if len(parts) != 2 && len(parts) != 4 {
+		return result, false
+	}
+	positions := []*int64{&result.EventPos, &result.ToDevicePos, &result.AccountDataPos, &result.InvitePos}
+	for i, part := range parts {
+		pos, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || pos < 0 {
+			return v2CompatSince{}, false
+		}
+		*positions[i] = pos
+	}
+	return result, true
+}
+
+// v2CompatWaiters wakes up sync v2 requests which are waiting for new data for their user.
+type v2CompatWaiters struct {
+	mu      *sync.Mutex
+	waiting map[string]map[chan struct{}]struct{}
+}
+
+func newV2CompatWaiters() *v2CompatWaiters {
+	return &v2CompatWaiters{
+		mu:      &sync.Mutex{},
+		waiting: make(map[string]map[chan struct{}]struct{}),
+	}
+}
+
+// add returns a channel which is closed when there may be new data for this user. It must be
+// called before checking for new data, so that data arriving meanwhile is not missed.
+func (w *v2CompatWaiters) add(userID string) chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ch := make(chan struct{})
+	if w.waiting[userID] == nil {
+		w.waiting[userID] = make(map[chan struct{}]struct{})
+	}
+	w.waiting[userID][ch] = struct{}{}
+	return ch
+}
+
+func (w *v2CompatWaiters) remove(userID string, ch chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.waiting[userID], ch)
+	if len(w.waiting[userID]) == 0 {
+		delete(w.waiting, userID)
+	}
+}
+
+// notify wakes up all requests waiting for these users.
+func (w *v2CompatWaiters) notify(userIDs ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, userID := range userIDs {
+		for ch := range w.waiting[userID] {
+			close(ch)
+		}
+		delete(w.waiting, userID)
+	}
+}
+
+// notifyRoom wakes up all requests waiting for users who are joined to the room, or who are the
+// target of one of the membership events.
+func (w *v2CompatWaiters) notifyRoom(roomID string, events []json.RawMessage, isUserJoined func(userID, roomID string) bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.waiting) == 0 {
+		return
+	}
+	targets := make(map[string]struct{})
+	for _, ev := range events {
+		parsed := gjson.ParseBytes(ev)
+		if parsed.Get("type").Str == "m.room.member" {
+			targets[parsed.Get("state_key").Str] = struct{}{}
+		}
+	}
+	for userID, chans := range w.waiting {
+		if _, isTarget := targets[userID]; !isTarget && !isUserJoined(userID, roomID) {
+			continue
+		}
+		for ch := range chans {
+			close(ch)
+		}
+		delete(w.waiting, userID)
+	}
+}
+
+// serveV2Compat serves GET /sync for legacy clients pointed at the proxy, using the proxy's database
+// rather than the homeserver. It is a best-effort subset of sync v2: filters are ignored, and
+// ephemeral events are not sent.
+func (h *SyncLiveHandler) serveV2Compat(w http.ResponseWriter, req *http.Request) error {
+	req, token, herr := h.identifyRequest(req)
+	if herr != nil {
+		return herr
+	}
+	log := hlog.FromRequest(req).With().Str("user", token.UserID).Str("device", token.DeviceID).Logger()
+	// make sure the poller is running so the database stays up to date for this user
+	pid := sync2.PollerID{UserID: token.UserID, DeviceID: token.DeviceID}
+	if expiredToken := h.EnsurePoller.EnsurePolling(req.Context(), pid, token.AccessTokenHash); expiredToken {
+		return &internal.HandlerError{
+			StatusCode: http.StatusUnauthorized,
+			ErrCode:    "M_UNKNOWN_TOKEN",
+			Err:        fmt.Errorf("EnsurePolling failed: access token invalid or invalidated"),
+		}
+	}
+
+	since, isIncremental := parseV2CompatSince(req.URL.Query().Get("since"))
+	timeoutMSecs, herr := parseIntFromQuery(req.URL, "timeout")
+	if herr != nil {
+		return herr
+	}
+	timeout := time.Duration(timeoutMSecs) * time.Millisecond
+	if timeout > v2CompatMaxTimeout {
+		timeout = v2CompatMaxTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var resp *sync2.SyncResponse
+	for {
+		// wait for new data from the V2 consumer rather than polling the database
+		newData := h.v2CompatWaiters.add(token.UserID)
+		var hasData bool
+		var err error
+		resp, hasData, err = h.v2CompatResponse(req.Context(), token.UserID, token.DeviceID, since, isIncremental)
+		if err != nil {
+			h.v2CompatWaiters.remove(token.UserID, newData)
+			log.Err(err).Msg("failed to build sync v2 response")
+			internal.GetSentryHubFromContextOrDefault(req.Context()).CaptureException(err)
+			return &internal.HandlerError{
+				StatusCode: 500,
+				Err:        err,
+			}
+		}
+		if hasData || !isIncremental {
+			h.v2CompatWaiters.remove(token.UserID, newData)
+			break
+		}
+		select {
+		case <-req.Context().Done():
+			h.v2CompatWaiters.remove(token.UserID, newData)
+			return nil // client went away
+		case <-timer.C:
+			h.v2CompatWaiters.remove(token.UserID, newData)
+		case <-newData:
+			continue
+		}
+		break
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Warn().Err(err).Msg("failed to JSON-encode sync v2 response")
+	}
+	return nil
+}
+
+// v2CompatResponse builds a sync v2 response for this device since the given position. hasData is
+// false if there is nothing new to tell the client.
+func (h *SyncLiveHandler) v2CompatResponse(ctx context.Context, userID, deviceID string, since v2CompatSince, isIncremental bool) (resp *sync2.SyncResponse, hasData bool, err error) {
+	if !isIncremental {
+		since = v2CompatSince{}
+	}
+	latestPos, err := h.Storage.LatestEventNID()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to load latest event NID: %s", err)
+	}
+	resp = &sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join:   make(map[string]sync2.SyncV2JoinResponse),
+			Invite: make(map[string]sync2.SyncV2InviteResponse),
+			Leave:  make(map[string]sync2.SyncV2LeaveResponse),
+		},
+	}
+
+	// rooms
+	if latestPos > since.EventPos {
+		if err = h.v2CompatRooms(ctx, resp, userID, since.EventPos, latestPos, isIncremental); err != nil {
+			return nil, false, err
+		}
+	} else {
+		latestPos = since.EventPos
+	}
+
+	// invites and account data
+	invites, invitePos, err := h.Storage.InvitesTable.SelectInvitesForUserSince(userID, since.InvitePos)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to load invites: %s", err)
+	}
+	for roomID, inviteState := range invites {
+		resp.Rooms.Invite[roomID] = sync2.SyncV2InviteResponse{
+			InviteState: sync2.EventsResponse{Events: inviteState},
+		}
+	}
+	accountDataPos, err := h.v2CompatAccountData(ctx, resp, userID, since.AccountDataPos)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// to-device messages: using a since token acknowledges the messages sent with it
+	lastSentPos, err := h.Storage.ToDeviceTable.UnackedPosition(userID, deviceID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to load unacked to-device position: %s", err)
+	}
+	toDeviceFrom := since.ToDevicePos
+	if toDeviceFrom > lastSentPos {
+		// The client is acknowledging messages we never sent it, e.g a since token from another
+		// deployment. Never delete messages the device hasn't been sent, as losing them breaks E2EE.
+		logger.Warn().Str("user", userID).Str("device", deviceID).Int64("last_sent", lastSentPos).Int64("recv", toDeviceFrom).Msg(
+			"v2 compat: client acknowledged to-device messages which were never sent, ignoring",
+		)
+		toDeviceFrom = lastSentPos
+	}
+	if isIncremental {
+		err = h.Storage.ToDeviceTable.DeleteMessagesUpToAndIncluding(userID, deviceID, toDeviceFrom)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to delete acknowledged to-device messages: %s", err)
+		}
+	}
+	msgs, toDevicePos, err := h.Storage.ToDeviceTable.Messages(userID, deviceID, toDeviceFrom, v2CompatToDeviceLimit)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to load to-device messages: %s", err)
+	}
+	if toDevicePos > lastSentPos {
+		if err = h.Storage.ToDeviceTable.SetUnackedPosition(userID, deviceID, toDevicePos); err != nil {
+			return nil, false, fmt.Errorf("failed to set unacked to-device position: %s", err)
+		}
+	}
+	resp.ToDevice.Events = msgs
+
+	// E2EE data
+	if dd := h.DeviceData(ctx, userID, deviceID, !isIncremental); dd != nil {
+		resp.DeviceListsOTKCount = dd.OTKCounts
+		resp.DeviceUnusedFallbackKeyTypes = dd.FallbackKeyTypes
+		resp.DeviceLists.Changed = dd.DeviceListChanged
+		resp.DeviceLists.Left = dd.DeviceListLeft
+	}
+
+	resp.NextBatch = v2CompatSince{
+		EventPos:       latestPos,
+		ToDevicePos:    toDevicePos,
+		AccountDataPos: accountDataPos,
+		InvitePos:      invitePos,
+	}.String()
+	hasData = len(resp.Rooms.Join) > 0 || len(resp.Rooms.Leave) > 0 || len(resp.Rooms.Invite) > 0 ||
+		len(resp.AccountData.Events) > 0 || len(resp.ToDevice.Events) > 0 ||
+		len(resp.DeviceLists.Changed) > 0 || len(resp.DeviceLists.Left) > 0
+	return resp, hasData, nil
+}
+
+// v2CompatAccountData adds the account data updated after `since` to the response, and returns the
+// position of the latest account data. Room account data is only sent for joined rooms.
+func (h *SyncLiveHandler) v2CompatAccountData(ctx context.Context, resp *sync2.SyncResponse, userID string, since int64) (int64, error) {
+	accountData, err := h.Storage.AccountDatasSince(ctx, userID, since)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load account data: %s", err)
+	}
+	latestPos := since
+	for _, ad := range accountData {
+		if ad.ID > latestPos {
+			latestPos = ad.ID
+		}
+		if ad.RoomID == state.AccountDataGlobalRoom {
+			resp.AccountData.Events = append(resp.AccountData.Events, ad.Data)
+			continue
+		}
+		room, exists := resp.Rooms.Join[ad.RoomID]
+		if !exists && !h.Dispatcher.IsUserJoined(userID, ad.RoomID) {
+			continue
+		}
+		room.AccountData.Events = append(room.AccountData.Events, ad.Data)
+		resp.Rooms.Join[ad.RoomID] = room
+	}
+	return latestPos, nil
+}
+
+// v2CompatRooms adds the joined and left rooms with events after `from` up to and including `to`
+// to the response.
+func (h *SyncLiveHandler) v2CompatRooms(ctx context.Context, resp *sync2.SyncResponse, userID string, from, to int64, isIncremental bool) error {
+	timelines, err := h.Storage.TimelinesBetween(ctx, userID, from, to, v2CompatTimelineLimit)
+	if err != nil {
+		return fmt.Errorf("failed to load timelines: %s", err)
+	}
+	joinTimings, err := h.Storage.JoinedRoomsAfterPosition(ctx, userID, to)
+	if err != nil {
+		return fmt.Errorf("failed to load joined rooms: %s", err)
+	}
+	unreadCounts := make(map[string][2]int)
+	err = h.Storage.UnreadTable.SelectAllNonZeroCountsForUser(userID, func(roomID string, highlightCount, notificationCount int) {
+		unreadCounts[roomID] = [2]int{highlightCount, notificationCount}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load unread counts: %s", err)
+	}
+
+	if !isIncremental {
+		// initial syncs include every joined room, even those without any timeline events
+		for roomID := range joinTimings {
+			if _, exists := timelines[roomID]; !exists {
+				timelines[roomID] = &state.LatestEvents{}
+			}
+		}
+	}
+
+	// clients need the state for rooms they don't know about yet, or where they may have missed
+	// state changes in the gap before the timeline. Like sync v2, this is the state at the start of
+	// the timeline, so the state events in the timeline are not also in the state block.
+	needStateRoomToPos := make(map[string]int64)
+	for roomID, timeline := range timelines {
+		joinTiming, isJoined := joinTimings[roomID]
+		if !isJoined {
+			if !isIncremental {
+				continue // left rooms are not included in initial syncs
+			}
+			var leave sync2.SyncV2LeaveResponse
+			leave.Timeline.Events = timeline.Timeline
+			leave.Timeline.Limited = timeline.Limited
+			leave.Timeline.PrevBatch = timeline.PrevBatch
+			resp.Rooms.Leave[roomID] = leave
+			continue
+		}
+		counts := unreadCounts[roomID]
+		resp.Rooms.Join[roomID] = sync2.SyncV2JoinResponse{
+			Timeline: sync2.TimelineResponse{
+				Events:    timeline.Timeline,
+				Limited:   timeline.Limited,
+				PrevBatch: timeline.PrevBatch,
+			},
+			UnreadNotifications: sync2.UnreadNotifications{
+				HighlightCount:    &counts[0],
+				NotificationCount: &counts[1],
+			},
+		}
+		if !isIncremental || timeline.Limited || joinTiming.NID > from {
+			statePos := to
+			if len(timeline.Timeline) > 0 {
+				statePos = timeline.EarliestNID - 1
+			}
+			needStateRoomToPos[roomID] = statePos
+		}
+	}
+	if len(needStateRoomToPos) > 0 {
+		roomToState, err := h.Storage.RoomStateAfterEventPositions(ctx, needStateRoomToPos, nil)
+		if err != nil {
+			return fmt.Errorf("failed to load room state: %s", err)
+		}
+		for roomID, stateEvents := range roomToState {
+			room := resp.Rooms.Join[roomID]
+			room.State.Events = make([]json.RawMessage, len(stateEvents))
+			for i := range stateEvents {
+				room.State.Events[i] = stateEvents[i].JSON
+			}
+			resp.Rooms.Join[roomID] = room
+		}
+	}
+	return nil
+}
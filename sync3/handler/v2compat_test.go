@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseV2CompatSince(t *testing.T) {
+	testCases := []struct {
+		since   string
+		want    v2CompatSince
+		wantOK  bool
+		wantStr string
+	}{
+		{since: "", wantOK: false},
+		{since: "s72594_4483_1934", wantOK: false},
+		{since: "12", wantOK: false},
+		{since: "12_abc", wantOK: false},
+		{since: "-1_5", wantOK: false},
+		{since: "1_2_3", wantOK: false},
+		{since: "1_2_3_-4", wantOK: false},
+		{since: "0_0_0_0", want: v2CompatSince{}, wantOK: true},
+		{since: "1234_56_78_9", want: v2CompatSince{EventPos: 1234, ToDevicePos: 56, AccountDataPos: 78, InvitePos: 9}, wantOK: true},
+		// tokens from older versions lack the account data and invite positions
+		{since: "1234_56", want: v2CompatSince{EventPos: 1234, ToDevicePos: 56}, wantOK: true, wantStr: "1234_56_0_0"},
+	}
+	for _, tc := range testCases {
+		got, ok := parseV2CompatSince(tc.since)
+		if ok != tc.wantOK || got != tc.want {
+			t.Errorf("parseV2CompatSince(%q): got %+v,%v want %+v,%v", tc.since, got, ok, tc.want, tc.wantOK)
+		}
+		wantStr := tc.wantStr
+		if wantStr == "" {
+			wantStr = tc.since
+		}
+		if ok && got.String() != wantStr {
+			t.Errorf("v2CompatSince.String(): got %q want %q", got.String(), wantStr)
+		}
+	}
+}
+
+func TestV2CompatWaiters(t *testing.T) {
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	roomID := "!a:localhost"
+	isClosed := func(ch chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+	w := newV2CompatWaiters()
+
+	aliceCh := w.add(alice)
+	bobCh := w.add(bob)
+	w.notify(alice)
+	if !isClosed(aliceCh) || isClosed(bobCh) {
+		t.Fatalf("notify(alice): got alice=%v bob=%v, want only alice woken", isClosed(aliceCh), isClosed(bobCh))
+	}
+
+	// only users joined to the room are woken by its events
+	aliceCh = w.add(alice)
+	isUserJoined := func(userID, _ string) bool { return userID == alice }
+	w.notifyRoom(roomID, []json.RawMessage{json.RawMessage(`{"type":"m.room.message","sender":"@alice:localhost"}`)}, isUserJoined)
+	if !isClosed(aliceCh) || isClosed(bobCh) {
+		t.Fatalf("notifyRoom: got alice=%v bob=%v, want only alice woken", isClosed(aliceCh), isClosed(bobCh))
+	}
+
+	// as well as the targets of membership events, e.g a user who just left
+	w.notifyRoom(roomID, []json.RawMessage{json.RawMessage(`{"type":"m.room.member","state_key":"@bob:localhost","content":{"membership":"leave"}}`)}, isUserJoined)
+	if !isClosed(bobCh) {
+		t.Fatalf("notifyRoom: bob was not woken by the membership event for them")
+	}
+
+	// removed waiters are not woken
+	aliceCh = w.add(alice)
+	w.remove(alice, aliceCh)
+	w.notify(alice)
+	if isClosed(aliceCh) {
+		t.Fatalf("removed waiter was woken")
+	}
+	if len(w.waiting) != 0 {
+		t.Fatalf("got %d users waiting, want 0", len(w.waiting))
+	}
+}
@@ -2,7 +2,6 @@ package sync3
 
 import (
 	"context"
-	"strings"
 
 	"github.com/matrix-org/sliding-sync/internal"
 )
@@ -47,6 +46,10 @@ type RoomDelta struct {
 type InternalRequestLists struct {
 	allRooms map[string]*RoomConnMetadata
 	lists    map[string]*FilteredSortableRooms
+	// RoomIDsWithNameLike, if set, returns the rooms in roomIDs whose stored name or canonical alias
+	// contains the substring. It is used to filter new lists by room name using the database rather
+	// than calculating every room name. May be nil.
+	RoomIDsWithNameLike func(roomIDs []string, substring string) ([]string, error)
 }
 
 func NewInternalRequestLists() *InternalRequestLists {
@@ -68,23 +71,6 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 		delta.InviteCountChanged = !existing.SameInviteCount(&r.RoomMetadata)
 		delta.JoinCountChanged = !existing.SameJoinCount(&r.RoomMetadata)
 		delta.RoomNameChanged = !existing.SameRoomName(&r.RoomMetadata)
-		if delta.RoomNameChanged {
-			// update the canonical name to allow room name sorting to continue to work
-			roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5)
-			r.CanonicalisedName = strings.ToLower(
-				strings.Trim(roomName, "#!():_@"),
-			)
-		} else {
-			// XXX: during TestConnectionTimeoutNotReset there is some situation where
-			//      r.CanonicalisedName is the empty string. Looking at the SetRoom
-			//      call in connstate_live.go, this is because the UserRoomMetadata on
-			//      the RoomUpdate has an empty CanonicalisedName. Either
-			//        a) that is expected, in which case we should _always_ write to
-			//           r.CanonicalisedName here; or
-			//        b) that is not expected, in which case... erm, I don't know what
-			//           to conclude.
-			r.CanonicalisedName = existing.CanonicalisedName
-		}
 		delta.RoomAvatarChanged = !existing.SameRoomAvatar(&r)
 		if delta.RoomAvatarChanged {
 			r.ResolvedAvatarURL = internal.CalculateAvatar(&r.RoomMetadata, r.IsDM)
@@ -109,15 +95,15 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 			}
 		}
 	} else {
-		// set the canonical name to allow room name sorting to work
-		roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5)
-		r.CanonicalisedName = strings.ToLower(
-			strings.Trim(roomName, "#!():_@"),
-		)
 		r.ResolvedAvatarURL = internal.CalculateAvatar(&r.RoomMetadata, r.IsDM)
 		// We'll automatically use the LastInterestedEventTimestamps provided by the
 		// caller, so that recency sorts work.
 	}
+	// Always recalculate the name, as the UserRoomData on room updates does not carry it. This is
+	// the same name we send to clients in computed_name, so by_name sorts agree with the client.
+	r.ComputedName, _ = internal.CalculateRoomName(&r.RoomMetadata, internal.MaxHeroNamesInRoomName)
+	r.CanonicalisedName = CanonicaliseRoomName(r.ComputedName)
+
 	// filter.Include may call on this room ID in the RoomFinder, so make sure it finds it.
 	s.allRooms[r.RoomID] = &r
 
@@ -200,30 +186,92 @@ func (s *InternalRequestLists) ListsByVisibleRoomIDs(muxedReqLists map[string]Re
 	listsByRoomIDs := make(map[string][]string, len(muxedReqLists))
 	// Loop over each list, and mark each room in its sliding window as being visible in this list.
 	for listKey, reqList := range muxedReqLists {
-		sortedRooms := s.lists[listKey].SortableRooms
-		if sortedRooms == nil {
-			continue
-		}
-
-		// If we've requested all rooms, every room is visible in this list---we don't
-		// have to worry about extracting room IDs in the sliding windows' ranges.
-		if reqList.SlowGetAllRooms != nil && *reqList.SlowGetAllRooms {
-			for _, roomID := range sortedRooms.RoomIDs() {
-				listsByRoomIDs[roomID] = append(listsByRoomIDs[roomID], listKey)
-			}
-		} else {
-			subslices := reqList.Ranges.SliceInto(sortedRooms)
-			for _, subslice := range subslices {
-				sortedRooms = subslice.(*SortableRooms)
-				for _, roomID := range sortedRooms.RoomIDs() {
+		if reqList.ShouldGetAllRooms() {
+			// don't copy the entire list just to read it
+			if sortedRooms := s.lists[listKey].SortableRooms; sortedRooms != nil {
+				for _, roomID := range sortedRooms.roomIDs {
 					listsByRoomIDs[roomID] = append(listsByRoomIDs[roomID], listKey)
 				}
 			}
+			continue
+		}
+		for _, roomID := range s.VisibleRoomIDs(listKey, reqList) {
+			listsByRoomIDs[roomID] = append(listsByRoomIDs[roomID], listKey)
 		}
 	}
 	return listsByRoomIDs
 }
 
+// ListsByVisibleRoomID returns the names of all lists in which the given room ID is currently
+// visible, in no particular order. This is ListsByVisibleRoomIDs for a single room, but does not
+// walk every sliding window, so is cheap even for lists which get all rooms.
+func (s *InternalRequestLists) ListsByVisibleRoomID(muxedReqLists map[string]RequestList, roomID string) []string {
+	var listKeys []string
+	for listKey, reqList := range muxedReqLists {
+		list := s.lists[listKey]
+		if list == nil || list.SortableRooms == nil {
+			continue
+		}
+		index, ok := list.IndexOf(roomID)
+		if !ok {
+			continue
+		}
+		if reqList.ShouldGetAllRooms() {
+			listKeys = append(listKeys, listKey)
+			continue
+		}
+		if _, inside := reqList.Ranges.Inside(int64(index)); inside {
+			listKeys = append(listKeys, listKey)
+		}
+	}
+	return listKeys
+}
+
+// VisibleRoomIDsByRange returns the room IDs in each sliding window of this list, in list order.
+// There is one slice for each of the list's ranges, which is empty if the range is beyond the end
+// of the list. If all rooms are requested, there is a single slice containing every room.
+func (s *InternalRequestLists) VisibleRoomIDsByRange(listKey string, reqList RequestList) [][]string {
+	sortedRooms := s.lists[listKey].SortableRooms
+	if reqList.ShouldGetAllRooms() {
+		roomIDs := []string{}
+		if sortedRooms != nil {
+			roomIDs = append(roomIDs, sortedRooms.RoomIDs()...)
+		}
+		return [][]string{roomIDs}
+	}
+	byRange := make([][]string, len(reqList.Ranges))
+	for i, r := range reqList.Ranges {
+		byRange[i] = []string{}
+		if sortedRooms == nil || r[0] >= sortedRooms.Len() {
+			continue
+		}
+		end := r[1]
+		if end >= sortedRooms.Len() {
+			end = sortedRooms.Len() - 1
+		}
+		byRange[i] = append(byRange[i], sortedRooms.Subslice(r[0], end+1).(*SortableRooms).RoomIDs()...)
+	}
+	return byRange
+}
+
+// VisibleRoomIDs returns the room IDs in the sliding windows of this list, in list order.
+func (s *InternalRequestLists) VisibleRoomIDs(listKey string, reqList RequestList) []string {
+	sortedRooms := s.lists[listKey].SortableRooms
+	if sortedRooms == nil {
+		return nil
+	}
+	// If we've requested all rooms, every room is visible in this list---we don't
+	// have to worry about extracting room IDs in the sliding windows' ranges.
+	if reqList.ShouldGetAllRooms() {
+		return sortedRooms.RoomIDs()
+	}
+	var roomIDs []string
+	for _, subslice := range reqList.Ranges.SliceInto(sortedRooms) {
+		roomIDs = append(roomIDs, subslice.(*SortableRooms).RoomIDs()...)
+	}
+	return roomIDs
+}
+
 // Assign a new list at the given key. If Overwrite, any existing list is replaced. If DoNotOverwrite, the existing
 // list is returned if one exists, else a new list is created. Returns the list and true if the list was overwritten.
 func (s *InternalRequestLists) AssignList(ctx context.Context, listKey string, filters *RequestFilters, sort []string, shouldOverwrite OverwriteVal) (*FilteredSortableRooms, bool) {
@@ -240,7 +288,21 @@ func (s *InternalRequestLists) AssignList(ctx context.Context, listKey string, f
 		i++
 	}
 
-	roomList := NewFilteredSortableRooms(s, listKey, roomIDs, filters)
+	var nameMatches map[string]struct{}
+	if filters != nil && filters.RoomNameFilter != "" && s.RoomIDsWithNameLike != nil {
+		matches, err := s.RoomIDsWithNameLike(roomIDs, filters.RoomNameFilter)
+		if err != nil {
+			// fall back to filtering in memory
+			logger.Err(err).Str("list", listKey).Msg("failed to select rooms by name")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		} else {
+			nameMatches = make(map[string]struct{}, len(matches))
+			for _, roomID := range matches {
+				nameMatches[roomID] = struct{}{}
+			}
+		}
+	}
+	roomList := newFilteredSortableRooms(s, listKey, roomIDs, filters, nameMatches)
 	if sort != nil {
 		err := roomList.Sort(sort)
 		if err != nil {
@@ -0,0 +1,198 @@
+package sync3_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// The number of rooms the synthetic users in these benchmarks are joined to. Run with e.g
+// -bench 'ListSort/rooms=10000' to only measure one size.
+var benchRoomCounts = []int{10000, 25000, 50000}
+
+const benchListKey = "benchmark"
+
+// benchUser is a synthetic user with a realistic mix of rooms: some DMs, encrypted rooms, invites,
+// tagged rooms and rooms with unread notifications, all with distinct activity times.
+type benchUser struct {
+	lists   *sync3.InternalRequestLists
+	roomIDs []string
+	rng     *rand.Rand
+	// the timestamp of the most recent event in any room
+	latestTimestamp uint64
+}
+
+// newBenchUser creates a user with n rooms. The rooms are always the same for the same n, so that
+// results can be compared between runs.
+func newBenchUser(n int) *benchUser {
+	u := &benchUser{
+		lists:   sync3.NewInternalRequestLists(),
+		roomIDs: make([]string, n),
+		rng:     rand.New(rand.NewSource(int64(n))),
+	}
+	start := uint64(timestamp.UnixMilli())
+	for i := 0; i < n; i++ {
+		roomID := fmt.Sprintf("!%d:benchmark", i)
+		u.roomIDs[i] = roomID
+		ts := start + uint64(u.rng.Int63n(int64(n)*1000))
+		if ts > u.latestTimestamp {
+			u.latestTimestamp = ts
+		}
+		r := sync3.RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:               roomID,
+				JoinCount:            1 + u.rng.Intn(500),
+				Encrypted:            u.rng.Intn(2) == 0,
+				LastMessageTimestamp: ts,
+			},
+			UserRoomData: caches.UserRoomData{
+				IsDM:     u.rng.Intn(10) == 0,
+				IsInvite: u.rng.Intn(100) == 0,
+			},
+			LastInterestedEventTimestamps: map[string]uint64{},
+		}
+		if r.IsDM {
+			r.Heroes = []internal.Hero{{ID: fmt.Sprintf("@%d:benchmark", i), Name: fmt.Sprintf("User %d", u.rng.Intn(n))}}
+		} else {
+			r.NameEvent = fmt.Sprintf("Room %d", u.rng.Intn(n))
+		}
+		if u.rng.Intn(5) == 0 {
+			r.NotificationCount = 1 + u.rng.Intn(20)
+			if u.rng.Intn(5) == 0 {
+				r.HighlightCount = 1 + u.rng.Intn(r.NotificationCount)
+			}
+		}
+		switch u.rng.Intn(50) {
+		case 0:
+			r.Tags = map[string]float64{"m.favourite": u.rng.Float64()}
+		case 1:
+			r.Tags = map[string]float64{"m.lowpriority": u.rng.Float64()}
+		}
+		u.lists.SetRoom(r)
+	}
+	return u
+}
+
+// bumpRandomRoom sends a new event into a random room, making it the most recent room, and returns
+// the resulting changes to the user's lists.
+func (u *benchUser) bumpRandomRoom() (roomID string, delta sync3.RoomDelta) {
+	roomID = u.roomIDs[u.rng.Intn(len(u.roomIDs))]
+	r := *u.lists.ReadOnlyRoom(roomID)
+	u.latestTimestamp++
+	r.LastMessageTimestamp = u.latestTimestamp
+	r.LastInterestedEventTimestamps = map[string]uint64{benchListKey: u.latestTimestamp}
+	return roomID, u.lists.SetRoom(r)
+}
+
+// Measure sorting all of the user's rooms, as happens when a list is first requested or its sort
+// order changes.
+func BenchmarkListSort(b *testing.B) {
+	sorts := []struct {
+		name   string
+		sortBy []string
+	}{
+		{"by_recency", []string{sync3.SortByRecency}},
+		{"by_name", []string{sync3.SortByName}},
+		{"by_notification_level", []string{sync3.SortByNotificationLevel, sync3.SortByRecency}},
+	}
+	for _, n := range benchRoomCounts {
+		u := newBenchUser(n)
+		for _, sort := range sorts {
+			b.Run(fmt.Sprintf("rooms=%d/%s", n, sort.name), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					u.lists.AssignList(context.Background(), benchListKey, nil, sort.sortBy, sync3.Overwrite)
+				}
+			})
+		}
+	}
+}
+
+// Measure filtering all of the user's rooms, without sorting the rooms which match.
+func BenchmarkListFilter(b *testing.B) {
+	yes := true
+	filters := []struct {
+		name   string
+		filter *sync3.RequestFilters
+	}{
+		{"none", &sync3.RequestFilters{}},
+		{"is_dm", &sync3.RequestFilters{IsDM: &yes}},
+		{"is_encrypted", &sync3.RequestFilters{IsEncrypted: &yes}},
+		{"is_unread", &sync3.RequestFilters{IsUnread: &yes}},
+		{"room_name_like", &sync3.RequestFilters{RoomNameFilter: "room 12"}},
+		{"tags", &sync3.RequestFilters{Tags: []string{"m.favourite"}}},
+		{"not_tags", &sync3.RequestFilters{NotTags: []string{"m.lowpriority"}}},
+	}
+	for _, n := range benchRoomCounts {
+		u := newBenchUser(n)
+		for _, filter := range filters {
+			b.Run(fmt.Sprintf("rooms=%d/%s", n, filter.name), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					u.lists.AssignList(context.Background(), benchListKey, filter.filter, nil, sync3.Overwrite)
+				}
+			})
+		}
+	}
+}
+
+// Measure handling a batch of new events in random rooms for a list sorted by recency, the same way
+// the handler does: resorting the list and calculating the ops for every event, then replacing them
+// with a diff of the windows before and after the batch. Reports the cost of each batch.
+func BenchmarkListLiveUpdates(b *testing.B) {
+	for _, n := range benchRoomCounts {
+		for _, batchSize := range []int{1, 100} {
+			b.Run(fmt.Sprintf("rooms=%d/batch=%d", n, batchSize), func(b *testing.B) {
+				u := newBenchUser(n)
+				ctx := context.Background()
+				reqList := &sync3.RequestList{
+					Ranges: sync3.SliceRanges{{0, 19}, {100, 119}},
+					Sort:   []string{sync3.SortByRecency},
+				}
+				list, _ := u.lists.AssignList(ctx, benchListKey, nil, reqList.Sort, sync3.Overwrite)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					before := sync3.SnapshotListWindows(reqList.Ranges, list)
+					for j := 0; j < batchSize; j++ {
+						roomID, delta := u.bumpRandomRoom()
+						for _, listDelta := range delta.Lists {
+							sync3.CalculateListOps(ctx, reqList, list, roomID, listDelta.Op)
+						}
+					}
+					after := sync3.SnapshotListWindows(reqList.Ranges, list)
+					sync3.CalculateListDiffOps(before, after)
+				}
+			})
+		}
+	}
+}
+
+// Measure diffing the windows of a list, which in the worst case have no rooms in common.
+func BenchmarkListDiffOps(b *testing.B) {
+	for _, n := range benchRoomCounts {
+		u := newBenchUser(n)
+		ranges := sync3.SliceRanges{{0, 99}, {1000, 1099}}
+		list, _ := u.lists.AssignList(context.Background(), benchListKey, nil, []string{sync3.SortByRecency}, sync3.Overwrite)
+		recency := sync3.SnapshotListWindows(ranges, list)
+		list.Sort([]string{sync3.SortByName})
+		name := sync3.SnapshotListWindows(ranges, list)
+		b.Run(fmt.Sprintf("rooms=%d/resort", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				sync3.CalculateListDiffOps(recency, name)
+			}
+		})
+		b.Run(fmt.Sprintf("rooms=%d/unchanged", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				sync3.CalculateListDiffOps(recency, recency)
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ package sync3_test
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"sort"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -49,3 +51,141 @@ func addRooms(list *sync3.InternalRequestLists, n int) {
 		})
 	}
 }
+
+// Test that nameless DMs are sorted by the same name the client is sent in computed_name,
+// regardless of the order in which the rooms are added.
+func TestSortByComputedName(t *testing.T) {
+	dm := func(roomID, heroName string) sync3.RoomConnMetadata {
+		return sync3.RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:    roomID,
+				JoinCount: 2,
+				Heroes:    []internal.Hero{{ID: "@" + roomID[1:] + ":localhost", Name: heroName}},
+			},
+			UserRoomData: caches.UserRoomData{IsDM: true},
+		}
+	}
+	rooms := []sync3.RoomConnMetadata{
+		dm("!bob", "bob"),
+		dm("!Bob", "Bob"),
+		dm("!alice", "Alice"),
+		{RoomMetadata: internal.RoomMetadata{RoomID: "!named", NameEvent: "#Aardvark", JoinCount: 5}},
+	}
+	wantOrder := []string{"!named", "!alice", "!Bob", "!bob"}
+	for _, reverse := range []bool{false, true} {
+		list := sync3.NewInternalRequestLists()
+		for i := range rooms {
+			r := rooms[i]
+			if reverse {
+				r = rooms[len(rooms)-1-i]
+			}
+			list.SetRoom(r)
+		}
+		list.AssignList(context.Background(), "a", &sync3.RequestFilters{}, []string{sync3.SortByName}, sync3.Overwrite)
+		got := list.Get("a").RoomIDs()
+		if fmt.Sprint(got) != fmt.Sprint(wantOrder) {
+			t.Errorf("reverse=%v: got %v want %v", reverse, got, wantOrder)
+		}
+		if got := list.ReadOnlyRoom("!alice").ComputedName; got != "Alice" {
+			t.Errorf("reverse=%v: got ComputedName %q want %q", reverse, got, "Alice")
+		}
+	}
+}
+
+// Test that rooms move in and out of an is_unread list as their counts change.
+func TestIsUnreadFilter(t *testing.T) {
+	isUnread := true
+	list := sync3.NewInternalRequestLists()
+	read := sync3.RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{RoomID: "!read:localhost"},
+	}
+	unread := sync3.RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{RoomID: "!unread:localhost"},
+		UserRoomData: caches.UserRoomData{NotificationCount: 1},
+	}
+	list.SetRoom(read)
+	list.SetRoom(unread)
+	list.AssignList(context.Background(), "unread", &sync3.RequestFilters{IsUnread: &isUnread}, []string{sync3.SortByRecency}, sync3.Overwrite)
+	if got := list.Get("unread").RoomIDs(); fmt.Sprint(got) != fmt.Sprint([]string{"!unread:localhost"}) {
+		t.Fatalf("got %v want only the unread room", got)
+	}
+
+	// a highlight makes the read room unread
+	read.HighlightCount = 1
+	delta := list.SetRoom(read)
+	if len(delta.Lists) != 1 || delta.Lists[0].Op != sync3.ListOpAdd {
+		t.Errorf("highlighting a read room: got list deltas %+v want an add", delta.Lists)
+	}
+	// reading the unread room removes it
+	unread.NotificationCount = 0
+	delta = list.SetRoom(unread)
+	if len(delta.Lists) != 1 || delta.Lists[0].Op != sync3.ListOpDel {
+		t.Errorf("reading an unread room: got list deltas %+v want a delete", delta.Lists)
+	}
+}
+
+// Test that new lists use the database to filter rooms with a name or alias by room name, and
+// filter other rooms in memory.
+func TestRoomNameFilterUsesSearch(t *testing.T) {
+	list := sync3.NewInternalRequestLists()
+	for _, r := range []internal.RoomMetadata{
+		{RoomID: "!named:localhost", NameEvent: "Apple"},
+		{RoomID: "!alias:localhost", CanonicalAlias: "#pear:localhost"},
+		{RoomID: "!nomatch:localhost", NameEvent: "Apple Juice"},
+		{RoomID: "!heroes:localhost", Heroes: []internal.Hero{{ID: "@apple:localhost", Name: "Apple"}}},
+	} {
+		list.SetRoom(sync3.RoomConnMetadata{RoomMetadata: r})
+	}
+	var searched []string
+	list.RoomIDsWithNameLike = func(roomIDs []string, substring string) ([]string, error) {
+		searched = append(searched, substring)
+		// pretend the database has newer names than the cached metadata
+		return []string{"!named:localhost", "!alias:localhost"}, nil
+	}
+	list.AssignList(context.Background(), "a", &sync3.RequestFilters{RoomNameFilter: "apple"}, []string{sync3.SortByName}, sync3.Overwrite)
+	if !reflect.DeepEqual(searched, []string{"apple"}) {
+		t.Fatalf("got searches %v want [apple]", searched)
+	}
+	got := list.Get("a").RoomIDs()
+	sort.Strings(got)
+	want := []string{"!alias:localhost", "!heroes:localhost", "!named:localhost"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+
+	// without a search function, names and aliases are matched in memory
+	list.RoomIDsWithNameLike = nil
+	list.AssignList(context.Background(), "b", &sync3.RequestFilters{RoomNameFilter: "PEAR"}, []string{sync3.SortByName}, sync3.Overwrite)
+	if got := list.Get("b").RoomIDs(); !reflect.DeepEqual(got, []string{"!alias:localhost"}) {
+		t.Fatalf("got %v want only the room with a matching alias", got)
+	}
+}
+
+// Test that looking up the lists a single room is visible in agrees with ListsByVisibleRoomIDs.
+func TestListsByVisibleRoomID(t *testing.T) {
+	boolTrue := true
+	list := sync3.NewInternalRequestLists()
+	addRooms(list, 10)
+	ctx := context.Background()
+	list.AssignList(ctx, "all", &sync3.RequestFilters{}, []string{sync3.SortByRecency}, sync3.Overwrite)
+	list.AssignList(ctx, "top", &sync3.RequestFilters{}, []string{sync3.SortByRecency}, sync3.Overwrite)
+	list.AssignList(ctx, "dms", &sync3.RequestFilters{IsDM: &boolTrue}, []string{sync3.SortByRecency}, sync3.Overwrite)
+	reqLists := map[string]sync3.RequestList{
+		"all": {SlowGetAllRooms: &boolTrue},
+		"top": {Ranges: sync3.SliceRanges{{0, 2}, {8, 8}}},
+		"dms": {Ranges: sync3.SliceRanges{{0, 0}}},
+	}
+	byRoomIDs := list.ListsByVisibleRoomIDs(reqLists)
+	for _, roomID := range list.Get("all").RoomIDs() {
+		got := list.ListsByVisibleRoomID(reqLists, roomID)
+		want := byRoomIDs[roomID]
+		sort.Strings(got)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got lists %v want %v", roomID, got, want)
+		}
+	}
+	if got := list.ListsByVisibleRoomID(reqLists, "!unknown:localhost"); len(got) != 0 {
+		t.Errorf("unknown room: got lists %v want none", got)
+	}
+}
@@ -2,6 +2,8 @@ package sync3
 
 import (
 	"context"
+	"sort"
+
 	"github.com/matrix-org/sliding-sync/internal"
 )
 
@@ -140,3 +142,167 @@ func CalculateListOps(ctx context.Context, reqList *RequestList, list List, room
 	}
 	return
 }
+
+// ListWindows is a snapshot of the room IDs visible in each range of a list. Ranges are held in
+// ascending order, and RoomIDs[i] holds the rooms visible in Ranges[i].
+type ListWindows struct {
+	Ranges  SliceRanges
+	RoomIDs [][]string
+}
+
+// SnapshotListWindows returns the room IDs currently visible in each of the given ranges of the list.
+func SnapshotListWindows(ranges SliceRanges, list List) ListWindows {
+	sorted := make(SliceRanges, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i][0] < sorted[j][0]
+	})
+	w := ListWindows{
+		Ranges:  sorted,
+		RoomIDs: make([][]string, len(sorted)),
+	}
+	length := list.Len()
+	for i, r := range sorted {
+		for j := r[0]; j <= r[1] && j < length; j++ {
+			w.RoomIDs[i] = append(w.RoomIDs[i], list.Get(int(j)))
+		}
+	}
+	return w
+}
+
+func (w ListWindows) len() (n int) {
+	for _, roomIDs := range w.RoomIDs {
+		n += len(roomIDs)
+	}
+	return
+}
+
+// CalculateListDiffOps returns the minimal set of DELETE/INSERT operations which transform the
+// `before` windows into the `after` windows, as applied by a client. Both snapshots must have been
+// taken with the same ranges. Unlike CalculateListOps, which emits operations for every single room
+// update, this works on the net result of many updates so a room which moves several times results
+// in at most one DELETE/INSERT pair per range.
+//
+// Each range is diffed independently so DELETE/INSERT pairs never cross a range boundary. Rooms which
+// stay in the same relative order (the longest increasing subsequence of their old positions) are
+// left in place, and every other room is moved with a single DELETE/INSERT pair. When the list has
+// shrunk the ranges are processed from the end of the list backwards, and when it has grown they are
+// processed from the start, so that lone DELETEs and INSERTs only ever shift rooms in the range which
+// contains the end of the list.
+func CalculateListDiffOps(before, after ListWindows) (ops []ResponseOp) {
+	shrunk := after.len() < before.len()
+	for i := range before.Ranges {
+		if shrunk {
+			i = len(before.Ranges) - 1 - i
+		}
+		ops = append(ops, diffWindow(int(before.Ranges[i][0]), before.RoomIDs[i], after.RoomIDs[i])...)
+	}
+	return ops
+}
+
+// diffWindow calculates the operations to transform a single window, which begins at list index
+// `start`, from `before` to `after`.
+func diffWindow(start int, before, after []string) (ops []ResponseOp) {
+	afterSet := make(map[string]struct{}, len(after))
+	for _, roomID := range after {
+		afterSet[roomID] = struct{}{}
+	}
+	beforeIndexes := make(map[string]int, len(before))
+	var evictions []string // rooms leaving the window, which free up a slot for a new room
+	for i, roomID := range before {
+		beforeIndexes[roomID] = i
+		if _, exists := afterSet[roomID]; !exists {
+			evictions = append(evictions, roomID)
+		}
+	}
+	keep := stableRooms(after, beforeIndexes)
+
+	cur := make([]string, len(before))
+	copy(cur, before)
+	for j, roomID := range after {
+		if _, stable := keep[roomID]; stable {
+			continue
+		}
+		from := indexOf(cur, roomID)
+		if from == -1 && len(evictions) > 0 {
+			// a new room: replace one of the rooms leaving the window
+			from = indexOf(cur, evictions[0])
+			evictions = evictions[1:]
+		}
+		removed := ""
+		if from != -1 {
+			removed = cur[from]
+			cur = append(cur[:from], cur[from+1:]...)
+		}
+		// insert directly after the room which precedes it in the new window, which is either stable
+		// or has already been placed.
+		to := 0
+		if j > 0 {
+			to = indexOf(cur, after[j-1]) + 1
+		}
+		cur = append(cur[:to], append([]string{roomID}, cur[to:]...)...)
+		if from == to && removed == roomID {
+			continue // the room is already in the right place
+		}
+		if from != -1 {
+			ops = append(ops, &ResponseOpSingle{Operation: OpDelete, Index: intPtr(start + from)})
+		}
+		ops = append(ops, &ResponseOpSingle{Operation: OpInsert, Index: intPtr(start + to), RoomID: roomID})
+	}
+	// any rooms left over are no longer in the window and there is nothing to replace them with,
+	// which only happens when the list has shrunk.
+	for i := len(cur) - 1; i >= 0; i-- {
+		if _, exists := afterSet[cur[i]]; !exists {
+			ops = append(ops, &ResponseOpSingle{Operation: OpDelete, Index: intPtr(start + i)})
+		}
+	}
+	return ops
+}
+
+// stableRooms returns the largest set of rooms in `after` which were also in the window before and
+// which remain in the same relative order. These rooms do not need to be moved. This is the longest
+// increasing subsequence of the rooms' previous indexes.
+func stableRooms(after []string, beforeIndexes map[string]int) map[string]struct{} {
+	// tails[k] is the position in `after` of the smallest tail of an increasing subsequence of length k+1
+	var tails []int
+	prev := make([]int, len(after))
+	for j, roomID := range after {
+		prev[j] = -1
+		beforeIndex, exists := beforeIndexes[roomID]
+		if !exists {
+			continue
+		}
+		k := sort.Search(len(tails), func(k int) bool {
+			return beforeIndexes[after[tails[k]]] >= beforeIndex
+		})
+		if k > 0 {
+			prev[j] = tails[k-1]
+		}
+		if k == len(tails) {
+			tails = append(tails, j)
+		} else {
+			tails[k] = j
+		}
+	}
+	stable := make(map[string]struct{}, len(tails))
+	if len(tails) == 0 {
+		return stable
+	}
+	for j := tails[len(tails)-1]; j != -1; j = prev[j] {
+		stable[after[j]] = struct{}{}
+	}
+	return stable
+}
+
+func indexOf(roomIDs []string, roomID string) int {
+	for i := range roomIDs {
+		if roomIDs[i] == roomID {
+			return i
+		}
+	}
+	return -1
+}
+
+func intPtr(i int) *int {
+	return &i
+}
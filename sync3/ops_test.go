@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"math/rand"
+	"reflect"
 	"testing"
 
 	"github.com/matrix-org/sliding-sync/testutils"
@@ -746,6 +748,283 @@ func TestCalculateListOpsTortureMultipleWindowsMove(t *testing.T) {
 	}
 }
 
+func TestCalculateListDiffOps(t *testing.T) {
+	testCases := []struct {
+		name    string
+		before  []string
+		after   []string
+		ranges  SliceRanges
+		wantOps []ResponseOp
+	}{
+		{
+			name:    "no changes",
+			before:  []string{"a", "b", "c", "d"},
+			after:   []string{"a", "b", "c", "d"},
+			ranges:  SliceRanges{{0, 20}},
+			wantOps: nil,
+		},
+		{
+			name:   "single move to top",
+			before: []string{"a", "b", "c", "d"},
+			after:  []string{"d", "a", "b", "c"},
+			ranges: SliceRanges{{0, 20}},
+			wantOps: []ResponseOp{
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(3)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(0), RoomID: "d"},
+			},
+		},
+		{
+			name:   "top room moves to the bottom",
+			before: []string{"a", "b", "c", "d"},
+			after:  []string{"b", "c", "d", "a"},
+			ranges: SliceRanges{{0, 20}},
+			wantOps: []ResponseOp{
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(0)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(3), RoomID: "a"},
+			},
+		},
+		{
+			name:   "same room bumped repeatedly is a single move",
+			before: []string{"a", "b", "c", "d", "e"},
+			// e.g c -> top, then b -> top, then c -> top again
+			after:  []string{"c", "b", "a", "d", "e"},
+			ranges: SliceRanges{{0, 20}},
+			wantOps: []ResponseOp{
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(2)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(0), RoomID: "c"},
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(2)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(1), RoomID: "b"},
+			},
+		},
+		{
+			name:   "room enters window from outside",
+			before: []string{"a", "b", "c", "d", "e"},
+			after:  []string{"e", "a", "b", "c", "d"},
+			ranges: SliceRanges{{0, 2}},
+			wantOps: []ResponseOp{
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(2)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(0), RoomID: "e"},
+			},
+		},
+		{
+			name:   "move between windows is one move per window",
+			before: []string{"a", "b", "c", "d", "e", "f", "g", "h"},
+			after:  []string{"a", "h", "b", "c", "d", "e", "f", "g"},
+			ranges: SliceRanges{{5, 7}, {0, 2}},
+			wantOps: []ResponseOp{
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(2)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(1), RoomID: "h"},
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(7)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(5), RoomID: "e"},
+			},
+		},
+		{
+			name:   "list shrinks",
+			before: []string{"a", "b", "c"},
+			after:  []string{"a", "c"},
+			ranges: SliceRanges{{0, 20}},
+			wantOps: []ResponseOp{
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(1)},
+			},
+		},
+		{
+			name:   "list grows",
+			before: []string{"a", "b"},
+			after:  []string{"c", "a", "b"},
+			ranges: SliceRanges{{0, 20}},
+			wantOps: []ResponseOp{
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(0), RoomID: "c"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		before := SnapshotListWindows(tc.ranges, newStringList(tc.before))
+		after := SnapshotListWindows(tc.ranges, newStringList(tc.after))
+		gotOps := CalculateListDiffOps(before, after)
+		assertEqualOps(t, tc.name, gotOps, tc.wantOps)
+		assertClientApplies(t, tc.name, before, after, gotOps)
+	}
+}
+
+// Check that clients applying the ops end up with the right list, for random ranges and random
+// sequences of moves, additions and removals.
+func TestCalculateListDiffOpsTorture(t *testing.T) {
+	rand.Seed(39)
+	nextRoom := 0
+	newRoomID := func() string {
+		nextRoom++
+		return fmt.Sprintf("!%d", nextRoom)
+	}
+	for i := 0; i < 5000; i++ {
+		var before []string
+		for j := rand.Intn(30); j > 0; j-- {
+			before = append(before, newRoomID())
+		}
+		ranges := randomRanges(30)
+		after := append([]string{}, before...)
+		numChanges := 1 + rand.Intn(5)
+		for j := 0; j < numChanges; j++ {
+			switch {
+			case len(after) > 0 && rand.Intn(3) == 0: // remove a room
+				k := rand.Intn(len(after))
+				after = append(after[:k], after[k+1:]...)
+			case len(after) > 0 && rand.Intn(2) == 0: // move a room
+				after, _, _, _ = testutils.MoveRandomElement(after)
+			default: // add a room
+				k := rand.Intn(len(after) + 1)
+				after = append(after[:k], append([]string{newRoomID()}, after[k:]...)...)
+			}
+		}
+		name := fmt.Sprintf("%v %v -> %v", ranges, before, after)
+		beforeWindows := SnapshotListWindows(ranges, newStringList(before))
+		afterWindows := SnapshotListWindows(ranges, newStringList(after))
+		gotOps := CalculateListDiffOps(beforeWindows, afterWindows)
+		assertClientApplies(t, name, beforeWindows, afterWindows, gotOps)
+		if numChanges == 1 {
+			// a single change should never need more than one DELETE/INSERT per window
+			for _, op := range gotOps {
+				if op.Op() != OpInsert && op.Op() != OpDelete {
+					t.Fatalf("%s: unexpected op %+v", name, op)
+				}
+			}
+			if len(gotOps) > 2*len(ranges) {
+				t.Fatalf("%s: got %d ops for a single change: %s", name, len(gotOps), jsonOps(gotOps))
+			}
+		}
+	}
+}
+
+// randomRanges returns 1-3 random non-overlapping ranges within [0, max].
+func randomRanges(max int64) SliceRanges {
+	var ranges SliceRanges
+	start := int64(0)
+	for n := 1 + rand.Intn(3); n > 0 && start < max; n-- {
+		start += rand.Int63n(max / 3)
+		end := start + rand.Int63n(max/3)
+		ranges = append(ranges, [2]int64{start, end})
+		start = end + 1
+	}
+	rand.Shuffle(len(ranges), func(i, j int) {
+		ranges[i], ranges[j] = ranges[j], ranges[i]
+	})
+	return ranges
+}
+
+func assertClientApplies(t *testing.T, name string, before, after ListWindows, ops []ResponseOp) {
+	t.Helper()
+	client := newTestClientList(before)
+	client.apply(ops)
+	want := newTestClientList(after)
+	if !reflect.DeepEqual(client.roomIndexToRoomID, want.roomIndexToRoomID) {
+		t.Fatalf("%s: client list mismatch after applying %s\ngot  %v\nwant %v", name, jsonOps(ops), client.roomIndexToRoomID, want.roomIndexToRoomID)
+	}
+}
+
+func jsonOps(ops []ResponseOp) string {
+	b, _ := json.Marshal(ops)
+	return string(b)
+}
+
+// testClientList applies list operations in the same way as the reference client in client/sync.js
+type testClientList struct {
+	ranges            SliceRanges
+	roomIndexToRoomID map[int]string
+}
+
+func newTestClientList(w ListWindows) *testClientList {
+	c := &testClientList{
+		ranges:            w.Ranges,
+		roomIndexToRoomID: make(map[int]string),
+	}
+	for i, roomIDs := range w.RoomIDs {
+		for j, roomID := range roomIDs {
+			c.roomIndexToRoomID[int(w.Ranges[i][0])+j] = roomID
+		}
+	}
+	return c
+}
+
+func (c *testClientList) apply(ops []ResponseOp) {
+	gapIndex := -1
+	for _, op := range ops {
+		single := op.(*ResponseOpSingle)
+		switch single.Operation {
+		case OpDelete:
+			if gapIndex != -1 {
+				c.removeEntry(gapIndex)
+			}
+			gapIndex = *single.Index
+		case OpInsert:
+			index := *single.Index
+			if _, exists := c.roomIndexToRoomID[index]; exists {
+				if gapIndex < 0 {
+					c.addEntry(index)
+				} else if gapIndex > index {
+					c.shiftRight(gapIndex, index)
+				} else if gapIndex < index {
+					c.shiftLeft(index, gapIndex)
+				}
+			}
+			gapIndex = -1
+			c.roomIndexToRoomID[index] = single.RoomID
+		}
+	}
+	if gapIndex != -1 {
+		c.removeEntry(gapIndex)
+	}
+}
+
+func (c *testClientList) shiftRight(hi, low int) {
+	for i := hi; i > low; i-- {
+		if _, inside := c.ranges.Inside(int64(i)); inside {
+			c.set(i, c.roomIndexToRoomID[i-1])
+		}
+	}
+}
+
+func (c *testClientList) shiftLeft(hi, low int) {
+	for i := low; i < hi; i++ {
+		if _, inside := c.ranges.Inside(int64(i)); inside {
+			c.set(i, c.roomIndexToRoomID[i+1])
+		}
+	}
+}
+
+func (c *testClientList) set(i int, roomID string) {
+	if roomID == "" {
+		delete(c.roomIndexToRoomID, i)
+		return
+	}
+	c.roomIndexToRoomID[i] = roomID
+}
+
+func (c *testClientList) maxIndex() int {
+	max := -1
+	for i := range c.roomIndexToRoomID {
+		if i > max {
+			max = i
+		}
+	}
+	return max
+}
+
+func (c *testClientList) removeEntry(index int) {
+	max := c.maxIndex()
+	if max < 0 || index > max {
+		return
+	}
+	c.shiftLeft(max, index)
+	delete(c.roomIndexToRoomID, max)
+}
+
+func (c *testClientList) addEntry(index int) {
+	max := c.maxIndex()
+	if max < 0 || index > max {
+		return
+	}
+	c.shiftRight(max+1, index)
+}
+
 func assertSingleOp(t *testing.T, op ResponseOp, opName string, index int, optRoomID string) {
 	t.Helper()
 	singleOp, ok := op.(*ResponseOpSingle)
@@ -2,6 +2,7 @@ package sync3
 
 import (
 	"fmt"
+	"math"
 	"sort"
 )
 
@@ -41,6 +42,22 @@ func (r SliceRanges) Valid() bool {
 	return true
 }
 
+// Size returns the number of integers covered by all the ranges, counting overlapping integers
+// more than once. Saturates at math.MaxInt64 rather than overflowing.
+func (r SliceRanges) Size() (size int64) {
+	for _, sr := range r {
+		if sr[1] < sr[0] {
+			continue
+		}
+		n := sr[1] - sr[0] + 1
+		if n <= 0 || size > math.MaxInt64-n {
+			return math.MaxInt64
+		}
+		size += n
+	}
+	return size
+}
+
 // Inside returns true if i is inside the range
 func (r SliceRanges) Inside(i int64) ([2]int64, bool) {
 	for _, sr := range r {
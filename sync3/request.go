@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/matrix-org/sliding-sync/internal"
@@ -24,6 +25,12 @@ var (
 
 	DefaultTimelineLimit = int64(20)
 	DefaultTimeoutMSecs  = 10 * 1000 // 10s
+
+	// SimplifiedBumpEventTypes are the event types which bump a room's bump_stamp in simplified
+	// sliding sync, for lists which don't specify bump_event_types. From MSC4186.
+	SimplifiedBumpEventTypes = []string{
+		"m.room.create", "m.room.message", "m.room.encrypted", "m.sticker", "m.call.invite", "m.poll.start", "m.beacon_info",
+	}
 )
 
 type Request struct {
@@ -33,36 +40,220 @@ type Request struct {
 	RoomSubscriptions map[string]RoomSubscription `json:"room_subscriptions"`
 	UnsubscribeRooms  []string                    `json:"unsubscribe_rooms"`
 	Extensions        extensions.Request          `json:"extensions"`
+	// Simplified asks for MSC4186 (Simplified Sliding Sync) semantics. This is also set when the
+	// request is made to the simplified sliding sync endpoint. Lists and room subscriptions are not
+	// sticky: each request replaces them entirely, so lists and rooms which are not in the request are
+	// removed and unspecified list fields take their defaults. Responses are reshaped by Response.Simplified.
+	Simplified bool `json:"simplified,omitempty"`
 
 	// set via query params or inferred
 	pos          int64
 	timeoutMSecs int
 }
 
+// Validate checks the request is well-formed, returning a *ValidationError for the first invalid
+// field. Lists and room subscriptions are checked in key order, so the same request always returns
+// the same error.
 func (r *Request) Validate() error {
 	if len(r.ConnID) > 16 {
-		return fmt.Errorf("conn_id is too long: %d > 16", len(r.ConnID))
+		return &ValidationError{Field: "conn_id", Reason: fmt.Sprintf("is too long: %d > 16", len(r.ConnID))}
 	}
 	if len(r.TxnID) > 64 {
-		return fmt.Errorf("txn_id is too long: %d > 64", len(r.TxnID))
+		return &ValidationError{Field: "txn_id", Reason: fmt.Sprintf("is too long: %d > 64", len(r.TxnID))}
+	}
+	listKeys := r.ListKeys()
+	sort.Strings(listKeys)
+	for _, listKey := range listKeys {
+		if err := r.Lists[listKey].validate("lists." + listKey); err != nil {
+			return err
+		}
+	}
+	roomIDs := make([]string, 0, len(r.RoomSubscriptions))
+	for roomID := range r.RoomSubscriptions {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Strings(roomIDs)
+	for _, roomID := range roomIDs {
+		field := "room_subscriptions." + roomID
+		if !strings.HasPrefix(roomID, "!") {
+			return &ValidationError{Field: field, Reason: "is not a room ID"}
+		}
+		if err := r.RoomSubscriptions[roomID].validate(field); err != nil {
+			return err
+		}
+	}
+	for i, roomID := range r.UnsubscribeRooms {
+		if !strings.HasPrefix(roomID, "!") {
+			return &ValidationError{Field: fmt.Sprintf("unsubscribe_rooms[%d]", i), Reason: "is not a room ID"}
+		}
+	}
+	if err := r.Extensions.ValidateScopes(); err != nil {
+		scopeErr := err.(*extensions.ScopeError)
+		return &ValidationError{Field: "extensions." + scopeErr.Field, Reason: scopeErr.Reason}
 	}
 	return nil
 }
 
+// ListLimits bounds the ranges clients can request for each list, as large numbers of ranges or
+// very large windows are expensive to process. 0 means no limit.
+type ListLimits struct {
+	// MaxRanges is the max number of ranges in a single list.
+	MaxRanges int
+	// MaxWindowSize is the max number of rooms covered by all the ranges of a single list.
+	MaxWindowSize int64
+}
+
+const (
+	LimitMaxRanges            = "max_ranges"
+	LimitMaxWindowSize        = "max_window_size"
+	LimitMaxRoomSubscriptions = "max_room_subscriptions"
+)
+
+// ListLimitError is returned when a list exceeds one of the ListLimits.
+type ListLimitError struct {
+	ListKey string
+	// Limit is which limit was exceeded, one of LimitMaxRanges or LimitMaxWindowSize.
+	Limit string
+	Max   int64
+	Got   int64
+}
+
+func (e *ListLimitError) Error() string {
+	return fmt.Sprintf("list[%v] exceeds %s: %d > %d", e.ListKey, e.Limit, e.Got, e.Max)
+}
+
+// ValidateListLimits checks every list in the request against the limits, returning a
+// *ListLimitError for the first list which exceeds them.
+func (r *Request) ValidateListLimits(limits ListLimits) error {
+	for listKey, l := range r.Lists {
+		if limits.MaxRanges > 0 && len(l.Ranges) > limits.MaxRanges {
+			return &ListLimitError{
+				ListKey: listKey,
+				Limit:   LimitMaxRanges,
+				Max:     int64(limits.MaxRanges),
+				Got:     int64(len(l.Ranges)),
+			}
+		}
+		if limits.MaxWindowSize > 0 {
+			if size := l.Ranges.Size(); size > limits.MaxWindowSize {
+				return &ListLimitError{
+					ListKey: listKey,
+					Limit:   LimitMaxWindowSize,
+					Max:     limits.MaxWindowSize,
+					Got:     size,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// RoomSubscriptionLimitError is returned when a request subscribes to more rooms than allowed.
+type RoomSubscriptionLimitError struct {
+	Max int
+	// Count is the number of room subscriptions the request would have resulted in.
+	Count int
+	// Rejected are the room IDs over the limit. Subscriptions are accepted in room ID order, so
+	// these are the last room IDs in the request when sorted.
+	Rejected []string
+}
+
+func (e *RoomSubscriptionLimitError) Error() string {
+	return fmt.Sprintf("room_subscriptions exceeds %s: %d > %d", LimitMaxRoomSubscriptions, e.Count, e.Max)
+}
+
+// ValidateRoomSubscriptionLimit checks the number of room subscriptions in the request, returning a
+// *RoomSubscriptionLimitError if there are more than max. 0 means no limit.
+func (r *Request) ValidateRoomSubscriptionLimit(max int) error {
+	if max <= 0 || len(r.RoomSubscriptions) <= max {
+		return nil
+	}
+	roomIDs := make([]string, 0, len(r.RoomSubscriptions))
+	for roomID := range r.RoomSubscriptions {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Strings(roomIDs)
+	return &RoomSubscriptionLimitError{
+		Max:      max,
+		Count:    len(roomIDs),
+		Rejected: roomIDs[max:],
+	}
+}
+
+// ValidateRoomSubscriptionLimitAfter checks the number of room subscriptions there would be once
+// nextReq is applied on top of this request with ApplyDelta, as room subscriptions are sticky. Returns
+// a *RoomSubscriptionLimitError if there would be more than max, rejecting the rooms nextReq
+// subscribes to. 0 means no limit. The receiver may be nil for the first request on a connection.
+func (r *Request) ValidateRoomSubscriptionLimitAfter(nextReq *Request, max int) error {
+	if max <= 0 {
+		return nil
+	}
+	unsubs := make(set, len(nextReq.UnsubscribeRooms))
+	for _, roomID := range nextReq.UnsubscribeRooms {
+		unsubs[roomID] = struct{}{}
+	}
+	var roomIDs []string
+	for roomID := range nextReq.RoomSubscriptions {
+		if _, unsub := unsubs[roomID]; !unsub {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	numExisting := 0
+	// nothing is sticky in simplified sliding sync, so existing subscriptions are only kept if resent
+	if r != nil && !nextReq.Simplified {
+		for roomID := range r.RoomSubscriptions {
+			_, unsub := unsubs[roomID]
+			_, resub := nextReq.RoomSubscriptions[roomID]
+			if !unsub && !resub {
+				numExisting++
+			}
+		}
+	}
+	if numExisting+len(roomIDs) <= max {
+		return nil
+	}
+	sort.Strings(roomIDs)
+	numAccepted := max - numExisting
+	if numAccepted < 0 {
+		numAccepted = 0
+	}
+	return &RoomSubscriptionLimitError{
+		Max:      max,
+		Count:    numExisting + len(roomIDs),
+		Rejected: roomIDs[numAccepted:],
+	}
+}
+
 type RequestList struct {
 	RoomSubscription
-	Ranges          SliceRanges     `json:"ranges"`
-	Sort            []string        `json:"sort"`
-	Filters         *RequestFilters `json:"filters"`
-	SlowGetAllRooms *bool           `json:"slow_get_all_rooms,omitempty"`
-	Deleted         bool            `json:"deleted,omitempty"`
-	BumpEventTypes  []string        `json:"bump_event_types"`
+	Ranges  SliceRanges     `json:"ranges"`
+	Sort    []string        `json:"sort"`
+	Filters *RequestFilters `json:"filters"`
+	// SlowGetAllRooms returns every room matching the filters, ignoring ranges. Despite the name, the
+	// list is built once per connection and then updated incrementally, so it is cheap to keep open.
+	SlowGetAllRooms *bool `json:"slow_get_all_rooms,omitempty"`
+	// RoomIDsOnly makes the response for this list contain the complete ordered list of room IDs
+	// in each of its ranges whenever it changes, instead of operations to apply to the previous list.
+	RoomIDsOnly *bool `json:"room_ids_only,omitempty"`
+	// IncludeSummary adds the number of rooms in the list with notifications and highlights to the
+	// response, so clients can badge lists without fetching every room.
+	IncludeSummary *bool    `json:"include_summary,omitempty"`
+	Deleted        bool     `json:"deleted,omitempty"`
+	BumpEventTypes []string `json:"bump_event_types"`
 }
 
 func (rl *RequestList) ShouldGetAllRooms() bool {
 	return rl.SlowGetAllRooms != nil && *rl.SlowGetAllRooms
 }
 
+func (rl *RequestList) ShouldReturnRoomIDs() bool {
+	return rl.RoomIDsOnly != nil && *rl.RoomIDsOnly
+}
+
+func (rl *RequestList) ShouldIncludeSummary() bool {
+	return rl.IncludeSummary != nil && *rl.IncludeSummary
+}
+
 func (rl *RequestList) SortOrderChanged(next *RequestList) bool {
 	prevLen := 0
 	if rl != nil {
@@ -328,6 +519,7 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 	// conn ID isn't sticky, always use the nextReq value. This is only useful for logging,
 	// as the conn ID is used primarily in conn_map.go
 	result.ConnID = nextReq.ConnID
+	result.Simplified = nextReq.Simplified
 
 	listKeys := make(set)
 	for k := range nextReq.Lists {
@@ -341,6 +533,16 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 	for listKey := range listKeys {
 		existingList, existingOk := r.Lists[listKey]
 		nextList, nextOk := nextReq.Lists[listKey]
+		if nextReq.Simplified {
+			if !nextOk {
+				continue // lists which aren't in the request are removed
+			}
+			if len(nextList.BumpEventTypes) == 0 {
+				nextList.BumpEventTypes = SimplifiedBumpEventTypes
+			}
+			// the list is exactly as requested, nothing carries over from the previous request
+			existingOk = false
+		}
 		if !nextOk {
 			// copy over what they said before (sticky), no diffs to make
 			calculatedLists[listKey] = existingList
@@ -378,6 +580,14 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		if slowGetAllRooms == nil {
 			slowGetAllRooms = existingList.SlowGetAllRooms
 		}
+		roomIDsOnly := nextList.RoomIDsOnly
+		if roomIDsOnly == nil {
+			roomIDsOnly = existingList.RoomIDsOnly
+		}
+		includeSummary := nextList.IncludeSummary
+		if includeSummary == nil {
+			includeSummary = existingList.IncludeSummary
+		}
 		includeOldRooms := nextList.IncludeOldRooms
 		if includeOldRooms == nil {
 			includeOldRooms = existingList.IncludeOldRooms
@@ -410,6 +620,8 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 			Sort:            sort,
 			Filters:         filters,
 			SlowGetAllRooms: slowGetAllRooms,
+			RoomIDsOnly:     roomIDsOnly,
+			IncludeSummary:  includeSummary,
 			BumpEventTypes:  bumpEventTypes,
 		}
 	}
@@ -448,7 +660,16 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		// either updating an existing sub or is a new sub, we don't care which for now.
 		resultSubs[roomID] = val
 	}
-	for _, roomID := range nextReq.UnsubscribeRooms {
+	unsubscribeRooms := nextReq.UnsubscribeRooms
+	if nextReq.Simplified {
+		// rooms which aren't in the request are unsubscribed
+		for roomID := range r.RoomSubscriptions {
+			if _, ok := nextReq.RoomSubscriptions[roomID]; !ok {
+				unsubscribeRooms = append(unsubscribeRooms, roomID)
+			}
+		}
+	}
+	for _, roomID := range unsubscribeRooms {
 		_, ok := resultSubs[roomID]
 		if ok {
 			// if this request both subscribes and unsubscribes to the same room ID,
@@ -471,6 +692,8 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		}
 		delta.Subs = append(delta.Subs, roomID)
 	}
+	// process new subscriptions in a deterministic order
+	sort.Strings(delta.Subs)
 	result.RoomSubscriptions = resultSubs
 
 	return
@@ -490,25 +713,49 @@ type RequestFilters struct {
 	IsDM           *bool     `json:"is_dm"`
 	IsEncrypted    *bool     `json:"is_encrypted"`
 	IsInvite       *bool     `json:"is_invite"`
+	IsUnread       *bool     `json:"is_unread"`     // has a non-zero notification or highlight count
 	IsTombstoned   *bool     `json:"is_tombstoned"` // deprecated
 	RoomTypes      []*string `json:"room_types"`
 	NotRoomTypes   []*string `json:"not_room_types"`
 	RoomNameFilter string    `json:"room_name_like"`
 	Tags           []string  `json:"tags"`
 	NotTags        []string  `json:"not_tags"`
+	// CollapseUpgrades hides rooms which have been upgraded if the user has joined any of their
+	// successors, so each upgraded room only appears once. Defaults to true.
+	CollapseUpgrades *bool `json:"collapse_upgrades"`
 
 	// TODO options to control which events should be live-streamed e.g not_types, types from sync v2
 }
 
 func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
-	// we always exclude old rooms from lists, but may include them in the `rooms` section if they opt-in
-	if r.UpgradedRoomID != nil {
-		// should we exclude this room? If we have _joined_ the successor room then yes because
-		// this room must therefore be old, else no.
-		nextRoom := finder.ReadOnlyRoom(*r.UpgradedRoomID)
-		if nextRoom != nil && !nextRoom.HasLeft && !nextRoom.IsInvite {
-			return false
-		}
+	return rf.include(r, finder, nil)
+}
+
+// includeRoomName returns true if the room's name or canonical alias contains the room name filter,
+// ignoring case. If nameMatches is non-nil, it is the set of rooms whose stored name or alias
+// matches, which is used instead of checking rooms with an explicit name or alias in memory.
+func (rf *RequestFilters) includeRoomName(r *RoomConnMetadata, nameMatches map[string]struct{}) bool {
+	if rf.RoomNameFilter == "" {
+		return true
+	}
+	// invites and knocks are not in the rooms table, and rooms without a name or alias use their heroes
+	if nameMatches != nil && !r.IsInvite && !r.IsKnock && (r.NameEvent != "" || r.CanonicalAlias != "") {
+		_, ok := nameMatches[r.RoomID]
+		return ok
+	}
+	filter := strings.ToLower(rf.RoomNameFilter)
+	if r.CanonicalAlias != "" && strings.Contains(strings.ToLower(r.CanonicalAlias), filter) {
+		return true
+	}
+	roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, internal.MaxHeroNamesInRoomName)
+	return strings.Contains(strings.ToLower(roomName), filter)
+}
+
+func (rf *RequestFilters) include(r *RoomConnMetadata, finder RoomFinder, nameMatches map[string]struct{}) bool {
+	// by default we exclude old rooms from lists, but may include them in the `rooms` section if they
+	// opt-in. A room is old if we have _joined_ any room which replaced it.
+	if (rf.CollapseUpgrades == nil || *rf.CollapseUpgrades) && hasJoinedSuccessor(r, finder) {
+		return false
 	}
 	if rf.IsEncrypted != nil && *rf.IsEncrypted != r.Encrypted {
 		return false
@@ -522,8 +769,10 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
 	if rf.IsInvite != nil && *rf.IsInvite != r.IsInvite {
 		return false
 	}
-	roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5)
-	if rf.RoomNameFilter != "" && !strings.Contains(strings.ToLower(roomName), strings.ToLower(rf.RoomNameFilter)) {
+	if rf.IsUnread != nil && *rf.IsUnread != (r.NotificationCount > 0 || r.HighlightCount > 0) {
+		return false
+	}
+	if !rf.includeRoomName(r, nameMatches) {
 		return false
 	}
 	if len(rf.NotTags) > 0 {
@@ -570,6 +819,12 @@ type RoomSubscription struct {
 	TimelineLimit   int64             `json:"timeline_limit"`
 	IncludeOldRooms *RoomSubscription `json:"include_old_rooms"`
 	Heroes          *bool             `json:"include_heroes"`
+	// TimelineTypes restricts timelines to events of these types, and TimelineNotTypes excludes
+	// events of these types from timelines. timeline_limit counts matching events only.
+	TimelineTypes    []string `json:"timeline_types,omitempty"`
+	TimelineNotTypes []string `json:"timeline_not_types,omitempty"`
+	// Preview asks for a plaintext preview of the latest message in the room.
+	Preview *bool `json:"include_preview,omitempty"`
 }
 
 func (rs RoomSubscription) RequiredStateChanged(other RoomSubscription) bool {
@@ -597,12 +852,34 @@ func (rs RoomSubscription) IncludeHeroes() bool {
 	return rs.Heroes != nil && *rs.Heroes
 }
 
-// Combine this subcription with another, returning a union of both as a copy.
+func (rs RoomSubscription) IncludePreview() bool {
+	return rs.Preview != nil && *rs.Preview
+}
+
+// TimelineFilter returns the filter to apply to timeline events in this subscription.
+func (rs RoomSubscription) TimelineFilter() internal.EventTypeFilter {
+	return internal.EventTypeFilter{
+		Types:    rs.TimelineTypes,
+		NotTypes: rs.TimelineNotTypes,
+	}
+}
+
+// Combine this subscription with another, returning a union of both as a copy. This is used when
+// a room is covered by more than one subscription, e.g it is visible in several lists and/or has a
+// direct room subscription. The effective subscription is:
+//   - timeline_limit: the largest timeline_limit.
+//   - required_state: the union of both required_state tuples, without duplicates.
+//   - include_heroes: true if either subscription includes heroes.
+//   - include_preview: true if either subscription includes previews.
+//   - timeline_types / timeline_not_types: events matching either subscription's filter.
+//   - include_old_rooms: whichever is set, or the combination of both if both are set.
+//
+// Combining is commutative and idempotent, so the order subscriptions are combined in does not
+// change the result, and the result never asks for less than either input.
 func (rs RoomSubscription) Combine(other RoomSubscription) RoomSubscription {
 	return rs.combineRecursive(other, true)
 }
 
-// Combine this subcription with another, returning a union of both as a copy.
 func (rs RoomSubscription) combineRecursive(other RoomSubscription, checkOldRooms bool) RoomSubscription {
 	var result RoomSubscription
 	// choose max value
@@ -611,14 +888,35 @@ func (rs RoomSubscription) combineRecursive(other RoomSubscription, checkOldRoom
 	} else {
 		result.TimelineLimit = other.TimelineLimit
 	}
-	// combine together required_state fields, we'll union them later
-	result.RequiredState = append(rs.RequiredState, other.RequiredState...)
+	// union required_state into a new slice so we never write into either backing array
+	seen := make(map[[2]string]struct{}, len(rs.RequiredState)+len(other.RequiredState))
+	for _, tuples := range [][][2]string{rs.RequiredState, other.RequiredState} {
+		for _, tuple := range tuples {
+			if _, exists := seen[tuple]; exists {
+				continue
+			}
+			seen[tuple] = struct{}{}
+			result.RequiredState = append(result.RequiredState, tuple)
+		}
+	}
+	if rs.IncludeHeroes() || other.IncludeHeroes() {
+		heroes := true
+		result.Heroes = &heroes
+	}
+	if rs.IncludePreview() || other.IncludePreview() {
+		preview := true
+		result.Preview = &preview
+	}
+	timelineFilter := rs.TimelineFilter().Union(other.TimelineFilter())
+	result.TimelineTypes = timelineFilter.Types
+	result.TimelineNotTypes = timelineFilter.NotTypes
 
 	if checkOldRooms {
-		// set include_old_rooms if it is unset
 		if rs.IncludeOldRooms == nil {
 			result.IncludeOldRooms = other.IncludeOldRooms
-		} else if other.IncludeOldRooms != nil {
+		} else if other.IncludeOldRooms == nil {
+			result.IncludeOldRooms = rs.IncludeOldRooms
+		} else {
 			// 2 subs have include_old_rooms set, union them. Don't check them for old rooms though as that's silly
 			ior := rs.IncludeOldRooms.combineRecursive(*other.IncludeOldRooms, false)
 			result.IncludeOldRooms = &ior
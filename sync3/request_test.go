@@ -3,6 +3,7 @@ package sync3
 import (
 	"bytes"
 	"encoding/json"
+	"math"
 	"reflect"
 	"sort"
 	"testing"
@@ -192,6 +193,135 @@ func TestRoomSubscriptionUnion(t *testing.T) {
 	}
 }
 
+func TestRoomSubscriptionCombine(t *testing.T) {
+	boolTrue := true
+	testCases := []struct {
+		name string
+		a    RoomSubscription
+		b    RoomSubscription
+		want RoomSubscription
+	}{
+		{
+			name: "timeline_limit uses the max",
+			a:    RoomSubscription{TimelineLimit: 5},
+			b:    RoomSubscription{TimelineLimit: 20},
+			want: RoomSubscription{TimelineLimit: 20},
+		},
+		{
+			name: "required_state is a union without duplicates",
+			a:    RoomSubscription{RequiredState: [][2]string{{"m.room.name", ""}, {"m.room.topic", ""}}},
+			b:    RoomSubscription{RequiredState: [][2]string{{"m.room.topic", ""}, {"m.room.member", StateKeyMe}}},
+			want: RoomSubscription{RequiredState: [][2]string{{"m.room.name", ""}, {"m.room.topic", ""}, {"m.room.member", StateKeyMe}}},
+		},
+		{
+			name: "include_heroes is kept if either sets it",
+			a:    RoomSubscription{TimelineLimit: 1},
+			b:    RoomSubscription{Heroes: &boolTrue},
+			want: RoomSubscription{TimelineLimit: 1, Heroes: &boolTrue},
+		},
+		{
+			name: "include_preview is kept if either sets it",
+			a:    RoomSubscription{Preview: &boolTrue},
+			b:    RoomSubscription{TimelineLimit: 1},
+			want: RoomSubscription{TimelineLimit: 1, Preview: &boolTrue},
+		},
+		{
+			name: "include_old_rooms is kept if only the receiver sets it",
+			a:    RoomSubscription{IncludeOldRooms: &RoomSubscription{TimelineLimit: 2}},
+			b:    RoomSubscription{TimelineLimit: 1},
+			want: RoomSubscription{TimelineLimit: 1, IncludeOldRooms: &RoomSubscription{TimelineLimit: 2}},
+		},
+		{
+			name: "include_old_rooms is combined if both set it",
+			a: RoomSubscription{IncludeOldRooms: &RoomSubscription{
+				TimelineLimit: 2, RequiredState: [][2]string{{"m.room.create", ""}},
+			}},
+			b: RoomSubscription{IncludeOldRooms: &RoomSubscription{
+				TimelineLimit: 1, RequiredState: [][2]string{{"m.room.tombstone", ""}},
+			}},
+			want: RoomSubscription{IncludeOldRooms: &RoomSubscription{
+				TimelineLimit: 2, RequiredState: [][2]string{{"m.room.create", ""}, {"m.room.tombstone", ""}},
+			}},
+		},
+		{
+			name: "timeline_types are a union",
+			a:    RoomSubscription{TimelineTypes: []string{"m.room.message"}},
+			b:    RoomSubscription{TimelineTypes: []string{"m.room.encrypted", "m.room.message"}},
+			want: RoomSubscription{TimelineTypes: []string{"m.room.encrypted", "m.room.message"}},
+		},
+		{
+			name: "timeline_not_types are an intersection",
+			a:    RoomSubscription{TimelineNotTypes: []string{"m.reaction", "m.room.redaction"}},
+			b:    RoomSubscription{TimelineNotTypes: []string{"m.reaction"}},
+			want: RoomSubscription{TimelineNotTypes: []string{"m.reaction"}},
+		},
+		{
+			name: "timeline_not_types excludes what the other timeline_types allows",
+			a:    RoomSubscription{TimelineNotTypes: []string{"m.reaction", "m.room.message"}},
+			b:    RoomSubscription{TimelineTypes: []string{"m.room.message"}},
+			want: RoomSubscription{TimelineNotTypes: []string{"m.reaction"}},
+		},
+		{
+			name: "timeline filters are dropped if either subscription has none",
+			a:    RoomSubscription{TimelineTypes: []string{"m.room.message"}},
+			b:    RoomSubscription{TimelineLimit: 1},
+			want: RoomSubscription{TimelineLimit: 1},
+		},
+	}
+	for _, tc := range testCases {
+		got := tc.a.Combine(tc.b)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: a.Combine(b) got %+v want %+v", tc.name, got, tc.want)
+		}
+		// the order in which subscriptions are combined should not change what is sent
+		reverse := tc.b.Combine(tc.a)
+		if reverse.TimelineLimit != got.TimelineLimit || reverse.IncludeHeroes() != got.IncludeHeroes() || reverse.IncludePreview() != got.IncludePreview() ||
+			len(reverse.RequiredState) != len(got.RequiredState) || (reverse.IncludeOldRooms == nil) != (got.IncludeOldRooms == nil) {
+			t.Errorf("%s: b.Combine(a) got %+v want equivalent of %+v", tc.name, reverse, got)
+		}
+		// combining with itself changes nothing
+		if again := got.Combine(got); !reflect.DeepEqual(again, got) {
+			t.Errorf("%s: combining with itself got %+v want %+v", tc.name, again, got)
+		}
+	}
+}
+
+func TestRoomSubscriptionCombineDoesNotAlias(t *testing.T) {
+	requiredState := make([][2]string, 1, 4)
+	requiredState[0] = [2]string{"m.room.name", ""}
+	a := RoomSubscription{RequiredState: requiredState}
+	_ = a.Combine(RoomSubscription{RequiredState: [][2]string{{"m.room.topic", ""}}})
+	_ = a.Combine(RoomSubscription{RequiredState: [][2]string{{"m.room.avatar", ""}}})
+	if got := requiredState[:cap(requiredState)][1]; got != ([2]string{}) {
+		t.Fatalf("Combine wrote %v into the receiver's required_state backing array", got)
+	}
+}
+
+func TestRequiredStateMapIsExactly(t *testing.T) {
+	alice := "@alice:localhost"
+	testCases := []struct {
+		requiredState [][2]string
+		want          bool
+	}{
+		{requiredState: [][2]string{{"m.room.pinned_events", ""}}, want: true},
+		{requiredState: [][2]string{{"m.room.pinned_events", ""}, {"m.room.pinned_events", ""}}, want: true},
+		{requiredState: [][2]string{{"m.room.pinned_events", "foo"}}, want: false},
+		{requiredState: [][2]string{{"m.room.pinned_events", ""}, {"m.room.name", ""}}, want: false},
+		{requiredState: [][2]string{{"m.room.pinned_events", Wildcard}}, want: false},
+		{requiredState: [][2]string{{Wildcard, ""}}, want: false},
+		{requiredState: [][2]string{{Wildcard, Wildcard}}, want: false},
+		{requiredState: [][2]string{{"m.room.pinned_events", ""}, {"m.room.member", StateKeyLazy}}, want: false},
+		{requiredState: nil, want: false},
+	}
+	for _, tc := range testCases {
+		rs := RoomSubscription{RequiredState: tc.requiredState}
+		got := rs.RequiredStateMap(alice).IsExactly("m.room.pinned_events", "")
+		if got != tc.want {
+			t.Errorf("IsExactly for %v: got %v want %v", tc.requiredState, got, tc.want)
+		}
+	}
+}
+
 func TestRoomSubscriptionRequiredStateChanged(t *testing.T) {
 	a := RoomSubscription{
 		TimelineLimit: 5,
@@ -1131,3 +1261,223 @@ func jsonEqual(t *testing.T, name string, got, want interface{}) {
 func listPtr(l RequestList) *RequestList {
 	return &l
 }
+
+func TestRequestValidateListLimits(t *testing.T) {
+	limits := ListLimits{
+		MaxRanges:     2,
+		MaxWindowSize: 100,
+	}
+	testCases := []struct {
+		name      string
+		ranges    SliceRanges
+		wantLimit string
+		wantGot   int64
+	}{
+		{
+			name:   "within limits",
+			ranges: SliceRanges{{0, 49}, {60, 109}},
+		},
+		{
+			name:      "too many ranges",
+			ranges:    SliceRanges{{0, 1}, {2, 3}, {4, 5}},
+			wantLimit: LimitMaxRanges,
+			wantGot:   3,
+		},
+		{
+			name:      "window too large",
+			ranges:    SliceRanges{{0, 49}, {60, 110}},
+			wantLimit: LimitMaxWindowSize,
+			wantGot:   101,
+		},
+		{
+			name:      "window overflows",
+			ranges:    SliceRanges{{0, math.MaxInt64}},
+			wantLimit: LimitMaxWindowSize,
+			wantGot:   math.MaxInt64,
+		},
+	}
+	for _, tc := range testCases {
+		req := Request{
+			Lists: map[string]RequestList{
+				"a": {Ranges: tc.ranges},
+			},
+		}
+		err := req.ValidateListLimits(limits)
+		if tc.wantLimit == "" {
+			if err != nil {
+				t.Errorf("%s: got error %v want none", tc.name, err)
+			}
+			if err = req.ValidateListLimits(ListLimits{}); err != nil {
+				t.Errorf("%s: got error %v with no limits", tc.name, err)
+			}
+			continue
+		}
+		limitErr, ok := err.(*ListLimitError)
+		if !ok {
+			t.Fatalf("%s: got error %v want *ListLimitError", tc.name, err)
+		}
+		if limitErr.ListKey != "a" || limitErr.Limit != tc.wantLimit || limitErr.Got != tc.wantGot {
+			t.Errorf("%s: got %+v want limit %v got %v", tc.name, limitErr, tc.wantLimit, tc.wantGot)
+		}
+		if err = req.ValidateListLimits(ListLimits{}); err != nil {
+			t.Errorf("%s: got error %v with no limits", tc.name, err)
+		}
+	}
+}
+
+func TestRequestValidateRoomSubscriptionLimit(t *testing.T) {
+	req := Request{
+		RoomSubscriptions: map[string]RoomSubscription{
+			"!d:localhost": {},
+			"!b:localhost": {},
+			"!a:localhost": {},
+			"!c:localhost": {},
+		},
+	}
+	for _, max := range []int{0, 4, 5} {
+		if err := req.ValidateRoomSubscriptionLimit(max); err != nil {
+			t.Errorf("max=%d: got error %v want none", max, err)
+		}
+	}
+	err := req.ValidateRoomSubscriptionLimit(2)
+	limitErr, ok := err.(*RoomSubscriptionLimitError)
+	if !ok {
+		t.Fatalf("got error %v want *RoomSubscriptionLimitError", err)
+	}
+	if limitErr.Max != 2 {
+		t.Errorf("got max %d want 2", limitErr.Max)
+	}
+	if !reflect.DeepEqual(limitErr.Rejected, []string{"!c:localhost", "!d:localhost"}) {
+		t.Errorf("got rejected %v want [!c:localhost !d:localhost]", limitErr.Rejected)
+	}
+
+	// new subscriptions are processed in room ID order
+	_, delta := (*Request)(nil).ApplyDelta(&req)
+	if !reflect.DeepEqual(delta.Subs, []string{"!a:localhost", "!b:localhost", "!c:localhost", "!d:localhost"}) {
+		t.Errorf("got subs %v want them in room ID order", delta.Subs)
+	}
+}
+
+func TestRequestValidateRoomSubscriptionLimitAfter(t *testing.T) {
+	prev := &Request{
+		RoomSubscriptions: map[string]RoomSubscription{
+			"!a:localhost": {},
+			"!b:localhost": {},
+		},
+	}
+	testCases := []struct {
+		name         string
+		prev         *Request
+		next         Request
+		max          int
+		wantRejected []string
+	}{
+		{
+			name: "no limit",
+			prev: prev,
+			next: Request{RoomSubscriptions: map[string]RoomSubscription{"!c:localhost": {}, "!d:localhost": {}}},
+		},
+		{
+			name: "first request within the limit",
+			next: Request{RoomSubscriptions: map[string]RoomSubscription{"!c:localhost": {}, "!d:localhost": {}}},
+			max:  2,
+		},
+		{
+			name:         "sticky subscriptions count towards the limit",
+			prev:         prev,
+			next:         Request{RoomSubscriptions: map[string]RoomSubscription{"!d:localhost": {}, "!c:localhost": {}}},
+			max:          3,
+			wantRejected: []string{"!d:localhost"},
+		},
+		{
+			name: "unsubscribing makes room for new subscriptions",
+			prev: prev,
+			next: Request{
+				RoomSubscriptions: map[string]RoomSubscription{"!c:localhost": {}, "!d:localhost": {}},
+				UnsubscribeRooms:  []string{"!a:localhost", "!b:localhost"},
+			},
+			max: 2,
+		},
+		{
+			name: "simplified requests only count resent subscriptions",
+			prev: prev,
+			next: Request{
+				RoomSubscriptions: map[string]RoomSubscription{"!a:localhost": {}, "!c:localhost": {}},
+				Simplified:        true,
+			},
+			max: 2,
+		},
+		{
+			name: "updating an existing subscription does not count twice",
+			prev: prev,
+			next: Request{RoomSubscriptions: map[string]RoomSubscription{"!a:localhost": {TimelineLimit: 5}}},
+			max:  2,
+		},
+	}
+	for _, tc := range testCases {
+		err := tc.prev.ValidateRoomSubscriptionLimitAfter(&tc.next, tc.max)
+		if tc.wantRejected == nil {
+			if err != nil {
+				t.Errorf("%s: got error %v want none", tc.name, err)
+			}
+			continue
+		}
+		limitErr, ok := err.(*RoomSubscriptionLimitError)
+		if !ok {
+			t.Fatalf("%s: got error %v want *RoomSubscriptionLimitError", tc.name, err)
+		}
+		if !reflect.DeepEqual(limitErr.Rejected, tc.wantRejected) {
+			t.Errorf("%s: got rejected %v want %v", tc.name, limitErr.Rejected, tc.wantRejected)
+		}
+		if limitErr.Count != len(tc.prev.RoomSubscriptions)+len(tc.next.RoomSubscriptions) {
+			t.Errorf("%s: got count %d", tc.name, limitErr.Count)
+		}
+	}
+}
+
+// Test that nothing is sticky in simplified sliding sync requests.
+func TestRequestApplyDeltaSimplified(t *testing.T) {
+	prev := &Request{
+		Lists: map[string]RequestList{
+			"a": {
+				RoomSubscription: RoomSubscription{TimelineLimit: 5},
+				Ranges:           SliceRanges{{0, 10}},
+				Sort:             []string{SortByName},
+				BumpEventTypes:   []string{"m.room.message"},
+			},
+			"b": {Ranges: SliceRanges{{0, 10}}},
+		},
+		RoomSubscriptions: map[string]RoomSubscription{
+			"!a:localhost": {TimelineLimit: 1},
+			"!b:localhost": {TimelineLimit: 1},
+		},
+	}
+	got, delta := prev.ApplyDelta(&Request{
+		Lists: map[string]RequestList{
+			"a": {Ranges: SliceRanges{{0, 5}}},
+		},
+		RoomSubscriptions: map[string]RoomSubscription{
+			"!b:localhost": {TimelineLimit: 1},
+		},
+		Simplified: true,
+	})
+	want := map[string]RequestList{
+		"a": {
+			Ranges:         SliceRanges{{0, 5}},
+			Sort:           []string{SortByRecency},
+			BumpEventTypes: SimplifiedBumpEventTypes,
+		},
+	}
+	if !reflect.DeepEqual(got.Lists, want) {
+		t.Errorf("lists: got %+v want %+v", got.Lists, want)
+	}
+	if _, ok := delta.Lists["b"]; !ok || delta.Lists["b"].Curr != nil {
+		t.Errorf("list b was not removed: %+v", delta.Lists["b"])
+	}
+	if !reflect.DeepEqual(got.RoomSubscriptions, map[string]RoomSubscription{"!b:localhost": {TimelineLimit: 1}}) {
+		t.Errorf("room subscriptions: got %+v", got.RoomSubscriptions)
+	}
+	if !reflect.DeepEqual(delta.Unsubs, []string{"!a:localhost"}) || len(delta.Subs) != 0 {
+		t.Errorf("got subs %v unsubs %v want no subs and !a:localhost unsubscribed", delta.Subs, delta.Unsubs)
+	}
+}
@@ -2,6 +2,7 @@ package sync3
 
 import (
 	"encoding/json"
+	"fmt"
 	"strconv"
 
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
@@ -26,8 +27,57 @@ type Response struct {
 }
 
 type ResponseList struct {
-	Ops   []ResponseOp `json:"ops,omitempty"`
-	Count int          `json:"count"`
+	Ops []ResponseOp `json:"ops,omitempty"`
+	// RoomIDs is set instead of Ops for lists with room_ids_only. It has the complete ordered list of
+	// room IDs in each of the list's ranges, in the same order as the ranges in the request. It is
+	// omitted if the list has not changed, and ranges with no rooms in them are empty.
+	RoomIDs [][]string `json:"room_ids,omitempty"`
+	Count   int        `json:"count"`
+	// UnreadCount and HighlightCount are the number of rooms in the list with notifications and
+	// highlights respectively. Only set for lists with include_summary.
+	UnreadCount    *int `json:"unread_count,omitempty"`
+	HighlightCount *int `json:"highlight_count,omitempty"`
+}
+
+func (rl ResponseList) MarshalJSON() ([]byte, error) {
+	// RoomIDs is omitted when nil, but must be sent when the list has changed to have no ranges,
+	// otherwise clients would think the list is unchanged.
+	type responseList ResponseList
+	var roomIDs *[][]string
+	if rl.RoomIDs != nil {
+		roomIDs = &rl.RoomIDs
+	}
+	return json.Marshal(struct {
+		responseList
+		RoomIDs *[][]string `json:"room_ids,omitempty"`
+	}{responseList(rl), roomIDs})
+}
+
+// Simplified returns a copy of this response in the shape of MSC4186 (Simplified Sliding Sync): lists
+// only contain their counts, and rooms have a bump_stamp so clients can sort them. The bump_stamp is the
+// timestamp of the latest event in the room of one of the lists' bump_event_types, which default to
+// SimplifiedBumpEventTypes for simplified requests. This response is not modified, as it may be
+// retransmitted to the client.
+func (r *Response) Simplified() *Response {
+	simplified := *r
+	if r.Lists != nil {
+		simplified.Lists = make(map[string]ResponseList, len(r.Lists))
+		for listKey, list := range r.Lists {
+			simplified.Lists[listKey] = ResponseList{
+				Count:          list.Count,
+				UnreadCount:    list.UnreadCount,
+				HighlightCount: list.HighlightCount,
+			}
+		}
+	}
+	if r.Rooms != nil {
+		simplified.Rooms = make(map[string]Room, len(r.Rooms))
+		for roomID, room := range r.Rooms {
+			room.BumpStamp = room.Timestamp
+			simplified.Rooms[roomID] = room
+		}
+	}
+	return &simplified
 }
 
 func (r *Response) PosInt() int64 {
@@ -62,8 +112,11 @@ func (r *Response) UnmarshalJSON(b []byte) error {
 	temporary := struct {
 		Rooms map[string]Room `json:"rooms"`
 		Lists map[string]struct {
-			Ops   []json.RawMessage `json:"ops"`
-			Count int               `json:"count"`
+			Ops            []json.RawMessage `json:"ops"`
+			RoomIDs        [][]string        `json:"room_ids"`
+			Count          int               `json:"count"`
+			UnreadCount    *int              `json:"unread_count"`
+			HighlightCount *int              `json:"highlight_count"`
 		} `json:"lists"`
 		Extensions extensions.Response `json:"extensions"`
 
@@ -80,20 +133,32 @@ func (r *Response) UnmarshalJSON(b []byte) error {
 	r.Lists = make(map[string]ResponseList, len(temporary.Lists))
 
 	for listKey, l := range temporary.Lists {
+		if l.Count < 0 {
+			return fmt.Errorf("lists.%s.count must not be negative: %d", listKey, l.Count)
+		}
 		var list ResponseList
 		list.Count = l.Count
-		for _, op := range l.Ops {
+		list.RoomIDs = l.RoomIDs
+		list.UnreadCount = l.UnreadCount
+		list.HighlightCount = l.HighlightCount
+		for i, op := range l.Ops {
 			if gjson.GetBytes(op, "range").Exists() {
 				var oper ResponseOpRange
 				if err := json.Unmarshal(op, &oper); err != nil {
 					return err
 				}
+				if err := oper.validate(); err != nil {
+					return fmt.Errorf("lists.%s.ops[%d] %w", listKey, i, err)
+				}
 				list.Ops = append(list.Ops, &oper)
 			} else {
 				var oper ResponseOpSingle
 				if err := json.Unmarshal(op, &oper); err != nil {
 					return err
 				}
+				if err := oper.validate(); err != nil {
+					return fmt.Errorf("lists.%s.ops[%d] %w", listKey, i, err)
+				}
 				list.Ops = append(list.Ops, &oper)
 			}
 		}
@@ -125,6 +190,17 @@ func (r *ResponseOpRange) IncludedRoomIDs() []string {
 	return r.RoomIDs
 }
 
+// validate checks the op is one which has a range, and that the range is valid.
+func (r *ResponseOpRange) validate() error {
+	if r.Operation != OpSync && r.Operation != OpInvalidate {
+		return fmt.Errorf("has a range but op is %q", r.Operation)
+	}
+	if r.Range[0] < 0 || r.Range[1] < r.Range[0] {
+		return fmt.Errorf("has an invalid range: %v", r.Range)
+	}
+	return nil
+}
+
 type ResponseOpSingle struct {
 	Operation string `json:"op"`
 	Index     *int   `json:"index,omitempty"` // 0 is a valid value, hence *int
@@ -135,6 +211,20 @@ func (r *ResponseOpSingle) Op() string {
 	return r.Operation
 }
 
+// validate checks the op is one which has an index, and that it has the fields the op needs.
+func (r *ResponseOpSingle) validate() error {
+	if r.Operation != OpInsert && r.Operation != OpDelete {
+		return fmt.Errorf("has no range but op is %q", r.Operation)
+	}
+	if r.Index == nil || *r.Index < 0 {
+		return fmt.Errorf("%s needs a non-negative index", r.Operation)
+	}
+	if r.Operation == OpInsert && r.RoomID == "" {
+		return fmt.Errorf("%s needs a room_id", r.Operation)
+	}
+	return nil
+}
+
 func (r *ResponseOpSingle) IncludedRoomIDs() []string {
 	if r.Op() == OpDelete || r.RoomID == "" {
 		return nil // the room is being excluded
@@ -0,0 +1,128 @@
+package sync3
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestResponseSimplified(t *testing.T) {
+	index := 0
+	unreadCount := 2
+	res := &Response{
+		Lists: map[string]ResponseList{
+			"a": {
+				Count:       5,
+				UnreadCount: &unreadCount,
+				Ops: []ResponseOp{
+					&ResponseOpSingle{Operation: OpInsert, Index: &index, RoomID: "!a:localhost"},
+				},
+			},
+		},
+		Rooms: map[string]Room{
+			"!a:localhost": {Name: "A", Timestamp: 1234},
+		},
+		Pos: "5",
+	}
+	got := res.Simplified()
+	want := &Response{
+		Lists: map[string]ResponseList{
+			"a": {Count: 5, UnreadCount: &unreadCount},
+		},
+		Rooms: map[string]Room{
+			"!a:localhost": {Name: "A", Timestamp: 1234, BumpStamp: 1234},
+		},
+		Pos: "5",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Simplified: got %+v want %+v", got, want)
+	}
+	// the original response is untouched, as it may be retransmitted
+	if len(res.Lists["a"].Ops) != 1 {
+		t.Errorf("Simplified modified the list ops of the original response")
+	}
+	if res.Rooms["!a:localhost"].BumpStamp != 0 {
+		t.Errorf("Simplified modified the rooms of the original response")
+	}
+}
+
+func TestResponseListRoomIDs(t *testing.T) {
+	testCases := []struct {
+		name    string
+		roomIDs [][]string
+		want    string
+	}{
+		{name: "unchanged", roomIDs: nil, want: `{"count":0}`},
+		{name: "emptied", roomIDs: [][]string{}, want: `{"count":0,"room_ids":[]}`},
+		{name: "empty range", roomIDs: [][]string{{"!a:localhost"}, {}}, want: `{"count":0,"room_ids":[["!a:localhost"],[]]}`},
+	}
+	for _, tc := range testCases {
+		got, err := json.Marshal(ResponseList{RoomIDs: tc.roomIDs})
+		if err != nil {
+			t.Fatalf("%s: failed to marshal: %s", tc.name, err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s: got %s want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestResponseUnmarshalRejectsInvalidOps(t *testing.T) {
+	testCases := []struct {
+		name    string
+		ops     string
+		wantErr bool
+	}{
+		{name: "valid ops", ops: `[{"op":"SYNC","range":[0,1],"room_ids":["!a:localhost","!b:localhost"]},{"op":"DELETE","index":1},{"op":"INSERT","index":0,"room_id":"!c:localhost"},{"op":"INVALIDATE","range":[5,9]}]`},
+		{name: "unknown op", ops: `[{"op":"MOVE","index":1}]`, wantErr: true},
+		{name: "range op without a range", ops: `[{"op":"SYNC","room_ids":["!a:localhost"]}]`, wantErr: true},
+		{name: "single op with a range", ops: `[{"op":"INSERT","range":[0,1]}]`, wantErr: true},
+		{name: "backwards range", ops: `[{"op":"SYNC","range":[5,1]}]`, wantErr: true},
+		{name: "insert without a room", ops: `[{"op":"INSERT","index":0}]`, wantErr: true},
+		{name: "delete without an index", ops: `[{"op":"DELETE"}]`, wantErr: true},
+	}
+	for _, tc := range testCases {
+		var res Response
+		err := json.Unmarshal([]byte(`{"pos":"1","lists":{"a":{"count":10,"ops":`+tc.ops+`}}}`), &res)
+		if tc.wantErr && err == nil {
+			t.Errorf("%s: got no error", tc.name)
+		} else if !tc.wantErr && err != nil {
+			t.Errorf("%s: got error %v", tc.name, err)
+		}
+	}
+	var res Response
+	if err := json.Unmarshal([]byte(`{"pos":"1","lists":{"a":{"count":-1}}}`), &res); err == nil {
+		t.Errorf("negative count: got no error")
+	}
+}
+
+func FuzzResponseUnmarshal(f *testing.F) {
+	f.Add([]byte(`{"pos":"1","lists":{"a":{"count":2,"ops":[{"op":"SYNC","range":[0,1],"room_ids":["!a:localhost","!b:localhost"]}]}},"rooms":{"!a:localhost":{"name":"A","timeline":[{"event_id":"$a"}],"notification_count":1}}}`))
+	f.Add([]byte(`{"pos":"2","lists":{"a":{"count":2,"ops":[{"op":"DELETE","index":1},{"op":"INSERT","index":0,"room_id":"!b:localhost"}]}},"extensions":{"to_device":{"next_batch":"1"}}}`))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		var res Response
+		if err := json.Unmarshal(body, &res); err != nil {
+			return
+		}
+		for listKey, list := range res.Lists {
+			for i, op := range list.Ops {
+				if op == nil {
+					t.Fatalf("lists.%s.ops[%d] is nil", listKey, i)
+				}
+				op.IncludedRoomIDs()
+			}
+		}
+		res.ListOps()
+		res.RoomIDsToTimelineEventIDs()
+		res.Simplified()
+		// valid responses must survive a round trip
+		encoded, err := json.Marshal(&res)
+		if err != nil {
+			t.Fatalf("failed to marshal valid response: %s", err)
+		}
+		var again Response
+		if err := json.Unmarshal(encoded, &again); err != nil {
+			t.Fatalf("response is invalid after a round trip: %s\n%s", err, encoded)
+		}
+	})
+}
@@ -10,11 +10,13 @@ import (
 
 type Room struct {
 	Name              string            `json:"name,omitempty"`
+	ComputedName      string            `json:"computed_name,omitempty"`
 	AvatarChange      AvatarChange      `json:"avatar,omitempty"`
 	Heroes            []internal.Hero   `json:"heroes,omitempty"`
 	RequiredState     []json.RawMessage `json:"required_state,omitempty"`
 	Timeline          []json.RawMessage `json:"timeline,omitempty"`
 	InviteState       []json.RawMessage `json:"invite_state,omitempty"`
+	KnockState        []json.RawMessage `json:"knock_state,omitempty"`
 	NotificationCount int64             `json:"notification_count"`
 	HighlightCount    int64             `json:"highlight_count"`
 	Initial           bool              `json:"initial,omitempty"`
@@ -24,6 +26,9 @@ type Room struct {
 	PrevBatch         string            `json:"prev_batch,omitempty"`
 	NumLive           int               `json:"num_live,omitempty"`
 	Timestamp         uint64            `json:"timestamp,omitempty"`
+	BumpStamp         uint64            `json:"bump_stamp,omitempty"` // only set for simplified sliding sync
+	// only set if the room subscription includes previews
+	Preview *internal.MessagePreview `json:"preview,omitempty"`
 }
 
 // RoomConnMetadata represents a room as seen by one specific connection (hence one
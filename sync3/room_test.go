@@ -6,6 +6,9 @@ import (
 	"github.com/tidwall/gjson"
 	"reflect"
 	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
 func TestAvatarChangeMarshalling(t *testing.T) {
@@ -72,3 +75,31 @@ func TestAvatarChangeMarshalling(t *testing.T) {
 		})
 	}
 }
+
+func TestSameRoomAvatar(t *testing.T) {
+	alice := internal.Hero{ID: "@alice:localhost", Avatar: "mxc://alice"}
+	aliceNewAvatar := internal.Hero{ID: "@alice:localhost", Avatar: "mxc://alice2"}
+	room := func(avatar string, isDM bool, heroes ...internal.Hero) *RoomConnMetadata {
+		return &RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{AvatarEvent: avatar, Heroes: heroes},
+			UserRoomData: caches.UserRoomData{IsDM: isDM},
+		}
+	}
+	testCases := []struct {
+		name string
+		prev *RoomConnMetadata
+		next *RoomConnMetadata
+		want bool
+	}{
+		{name: "unchanged", prev: room("mxc://a", false), next: room("mxc://a", false), want: true},
+		{name: "room avatar changed", prev: room("mxc://a", false), next: room("mxc://b", false), want: false},
+		{name: "hero avatar changed outside DM", prev: room("", false, alice), next: room("", false, aliceNewAvatar), want: true},
+		{name: "DM hero unchanged", prev: room("", true, alice), next: room("", true, alice), want: true},
+		{name: "DM hero avatar changed", prev: room("", true, alice), next: room("", true, aliceNewAvatar), want: false},
+	}
+	for _, tc := range testCases {
+		if got := tc.prev.SameRoomAvatar(tc.next); got != tc.want {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
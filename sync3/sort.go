@@ -3,6 +3,7 @@ package sync3
 import (
 	"fmt"
 	"sort"
+	"strings"
 
 	"github.com/matrix-org/sliding-sync/internal"
 )
@@ -21,11 +22,15 @@ type SortableRooms struct {
 }
 
 func NewSortableRooms(finder RoomFinder, listKey string, rooms []string) *SortableRooms {
+	roomIDToIndex := make(map[string]int, len(rooms))
+	for i, roomID := range rooms {
+		roomIDToIndex[roomID] = i
+	}
 	return &SortableRooms{
 		roomIDs:       rooms,
 		finder:        finder,
 		listKey:       listKey,
-		roomIDToIndex: make(map[string]int),
+		roomIDToIndex: roomIDToIndex,
 	}
 }
 
@@ -128,18 +133,49 @@ func (s *SortableRooms) Sort(sortBy []string) error {
 
 // Comparator functions: -1 = false, +1 = true, 0 = match
 
+// Summary returns the number of rooms with notifications and the number of rooms with highlights.
+func (s *SortableRooms) Summary() (unreadRooms, highlightRooms int) {
+	for _, roomID := range s.roomIDs {
+		r := s.finder.ReadOnlyRoom(roomID)
+		if r == nil {
+			continue
+		}
+		if r.NotificationCount > 0 {
+			unreadRooms++
+		}
+		if r.HighlightCount > 0 {
+			highlightRooms++
+		}
+	}
+	return
+}
+
 func (s *SortableRooms) resolveRooms(i, j int) (ri, rj *RoomConnMetadata) {
 	ri = s.finder.ReadOnlyRoom(s.roomIDs[i])
 	rj = s.finder.ReadOnlyRoom(s.roomIDs[j])
 	return
 }
 
+// CanonicaliseRoomName returns the key used to sort rooms by name: the name with leading and
+// trailing symbols stripped, in lower case.
+func CanonicaliseRoomName(name string) string {
+	return strings.ToLower(strings.Trim(name, "#!():_@"))
+}
+
 func (s *SortableRooms) comparatorSortByName(i, j int) int {
 	ri, rj := s.resolveRooms(i, j)
-	if ri.CanonicalisedName == rj.CanonicalisedName {
+	if ri.CanonicalisedName != rj.CanonicalisedName {
+		if ri.CanonicalisedName < rj.CanonicalisedName {
+			return 1
+		}
+		return -1
+	}
+	// Names which only differ in case or symbols, e.g. "Alice" and "alice", would otherwise be
+	// ordered by whichever room was seen first, so fall back to the exact name.
+	if ri.ComputedName == rj.ComputedName {
 		return 0
 	}
-	if ri.CanonicalisedName < rj.CanonicalisedName {
+	if ri.ComputedName < rj.ComputedName {
 		return 1
 	}
 	return -1
@@ -221,13 +257,19 @@ type FilteredSortableRooms struct {
 }
 
 func NewFilteredSortableRooms(finder RoomFinder, listKey string, roomIDs []string, filter *RequestFilters) *FilteredSortableRooms {
+	return newFilteredSortableRooms(finder, listKey, roomIDs, filter, nil)
+}
+
+// newFilteredSortableRooms is NewFilteredSortableRooms where the rooms matching the room name
+// filter may have been looked up already. See RequestFilters.includeRoomName.
+func newFilteredSortableRooms(finder RoomFinder, listKey string, roomIDs []string, filter *RequestFilters, nameMatches map[string]struct{}) *FilteredSortableRooms {
 	var filteredRooms []string
 	if filter == nil {
 		filter = &RequestFilters{}
 	}
 	for _, roomID := range roomIDs {
 		r := finder.ReadOnlyRoom(roomID)
-		if filter.Include(r, finder) {
+		if filter.include(r, finder, nameMatches) {
 			filteredRooms = append(filteredRooms, roomID)
 		}
 	}
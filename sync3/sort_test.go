@@ -387,3 +387,28 @@ func TestSortByNotificationLevel(t *testing.T) {
 		t.Errorf("want: %v", wantRoomIDs)
 	}
 }
+
+func TestSortableRoomsSummary(t *testing.T) {
+	rooms := []*RoomConnMetadata{
+		{
+			RoomMetadata: internal.RoomMetadata{RoomID: "!highlight:localhost"},
+			UserRoomData: caches.UserRoomData{HighlightCount: 1, NotificationCount: 2},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{RoomID: "!notif:localhost"},
+			UserRoomData: caches.UserRoomData{NotificationCount: 5},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{RoomID: "!read:localhost"},
+		},
+	}
+	f := newFinder(rooms)
+	sr := NewSortableRooms(f, "my_list", f.roomIDs)
+	unreadRooms, highlightRooms := sr.Summary()
+	if unreadRooms != 2 {
+		t.Errorf("got %d unread rooms, want 2", unreadRooms)
+	}
+	if highlightRooms != 1 {
+		t.Errorf("got %d highlight rooms, want 1", highlightRooms)
+	}
+}
@@ -194,6 +194,17 @@ func (t *JoinedRoomsTracker) NumInvitedUsersForRoom(roomID string) int {
 	return len(t.roomIDToInvitedUsers[roomID])
 }
 
+// RemoveRoom forgets all joined and invited users for this room.
+func (t *JoinedRoomsTracker) RemoveRoom(roomID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for userID := range t.roomIDToJoinedUsers[roomID] {
+		delete(t.userIDToJoinedRooms[userID], roomID)
+	}
+	delete(t.roomIDToJoinedUsers, roomID)
+	delete(t.roomIDToInvitedUsers, roomID)
+}
+
 // ReloadMembershipsForRoom overwrites the JoinedRoomsTracker state for one room to the
 // given list of joined and invited users.
 func (t *JoinedRoomsTracker) ReloadMembershipsForRoom(roomID string, joined, invited []string) {
@@ -122,6 +122,27 @@ func TestTrackerReload(t *testing.T) {
 	assertInt(t, jrt.NumInvitedUsersForRoom(roomA), 1)
 }
 
+func TestTrackerRemoveRoom(t *testing.T) {
+	roomA := "!a"
+	roomB := "!b"
+	alice := "@alice"
+	bob := "@bob"
+	jrt := NewJoinedRoomsTracker()
+	jrt.Startup(map[string][]string{
+		roomA: {alice, bob},
+		roomB: {bob},
+	})
+	jrt.UsersInvitedToRoom([]string{"@chris"}, roomA)
+
+	jrt.RemoveRoom(roomA)
+	members, joinCount := jrt.JoinedUsersForRoom(roomA, nil)
+	assertEqualSlices(t, "roomA joined members", members, nil)
+	assertInt(t, joinCount, 0)
+	assertInt(t, jrt.NumInvitedUsersForRoom(roomA), 0)
+	assertEqualSlices(t, "alice's rooms", jrt.JoinedRoomsForUser(alice), nil)
+	assertEqualSlices(t, "bob's rooms", jrt.JoinedRoomsForUser(bob), []string{roomB})
+}
+
 func TestJoinedRoomsTracker_UserLeftRoom_ReturnValue(t *testing.T) {
 	alice := "@alice"
 	bob := "@bob"
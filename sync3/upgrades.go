@@ -0,0 +1,56 @@
+package sync3
+
+// MaxUpgradeChainLength bounds the number of upgrades followed from a room, so that a long
+// chain of tombstones cannot make a request do unbounded work.
+const MaxUpgradeChainLength = 50
+
+// SuccessorChain returns the rooms which replaced this room, from the direct successor to the most
+// recent, by following tombstones. The chain includes the first room unknown to the finder but
+// stops there, as its tombstone cannot be read. Rooms are never repeated, so cycles are safe.
+func SuccessorChain(finder RoomFinder, roomID string) []string {
+	return followUpgrades(finder, roomID, func(r *RoomConnMetadata) *string {
+		return r.UpgradedRoomID
+	})
+}
+
+// PredecessorChain returns the rooms which this room replaced, from the direct predecessor to the
+// oldest, by following the predecessors in create events. It has the same limits as SuccessorChain.
+func PredecessorChain(finder RoomFinder, roomID string) []string {
+	return followUpgrades(finder, roomID, func(r *RoomConnMetadata) *string {
+		return r.PredecessorRoomID
+	})
+}
+
+func followUpgrades(finder RoomFinder, roomID string, next func(r *RoomConnMetadata) *string) (chain []string) {
+	visited := map[string]struct{}{
+		roomID: {},
+	}
+	room := finder.ReadOnlyRoom(roomID)
+	for room != nil && len(chain) < MaxUpgradeChainLength {
+		nextRoomID := next(room)
+		if nextRoomID == nil {
+			break
+		}
+		if _, ok := visited[*nextRoomID]; ok {
+			break
+		}
+		visited[*nextRoomID] = struct{}{}
+		chain = append(chain, *nextRoomID)
+		room = finder.ReadOnlyRoom(*nextRoomID)
+	}
+	return chain
+}
+
+// hasJoinedSuccessor returns true if the user is joined to any room which replaced this room.
+func hasJoinedSuccessor(r *RoomConnMetadata, finder RoomFinder) bool {
+	if r.UpgradedRoomID == nil {
+		return false
+	}
+	for _, roomID := range SuccessorChain(finder, r.RoomID) {
+		successor := finder.ReadOnlyRoom(roomID)
+		if successor != nil && !successor.HasLeft && !successor.IsInvite && !successor.IsKnock {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package sync3
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+func upgradedRoom(roomID string, predecessor, successor string, hasLeft bool) *RoomConnMetadata {
+	r := &RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{RoomID: roomID},
+		UserRoomData: caches.UserRoomData{HasLeft: hasLeft},
+	}
+	if predecessor != "" {
+		r.PredecessorRoomID = &predecessor
+	}
+	if successor != "" {
+		r.UpgradedRoomID = &successor
+	}
+	return r
+}
+
+func TestUpgradeChains(t *testing.T) {
+	f := newFinder([]*RoomConnMetadata{
+		upgradedRoom("!a", "", "!b", true),
+		upgradedRoom("!b", "!a", "!c", true),
+		upgradedRoom("!c", "!b", "!unknown", false),
+		// a cycle
+		upgradedRoom("!x", "!y", "!y", false),
+		upgradedRoom("!y", "!x", "!x", false),
+	})
+	testCases := []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{name: "successors of the oldest room", got: SuccessorChain(f, "!a"), want: []string{"!b", "!c", "!unknown"}},
+		{name: "successors of a middle room", got: SuccessorChain(f, "!b"), want: []string{"!c", "!unknown"}},
+		{name: "predecessors of the newest room", got: PredecessorChain(f, "!c"), want: []string{"!b", "!a"}},
+		{name: "predecessors of the oldest room", got: PredecessorChain(f, "!a"), want: nil},
+		{name: "unknown room", got: SuccessorChain(f, "!unknown"), want: nil},
+		{name: "cycle", got: SuccessorChain(f, "!x"), want: []string{"!y"}},
+	}
+	for _, tc := range testCases {
+		if !reflect.DeepEqual(tc.got, tc.want) {
+			t.Errorf("%s: got %v want %v", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+func TestUpgradeChainIsBounded(t *testing.T) {
+	var rooms []*RoomConnMetadata
+	for i := 0; i < MaxUpgradeChainLength*2; i++ {
+		rooms = append(rooms, upgradedRoom(fmt.Sprintf("!%d", i), "", fmt.Sprintf("!%d", i+1), false))
+	}
+	if got := len(SuccessorChain(newFinder(rooms), "!0")); got != MaxUpgradeChainLength {
+		t.Errorf("got chain of length %d want %d", got, MaxUpgradeChainLength)
+	}
+}
+
+func TestFilterCollapseUpgrades(t *testing.T) {
+	// the user is joined to !a and !c, but left !b
+	rooms := []*RoomConnMetadata{
+		upgradedRoom("!a", "", "!b", false),
+		upgradedRoom("!b", "!a", "!c", true),
+		upgradedRoom("!c", "!b", "", false),
+		upgradedRoom("!invited-successor", "", "!invite", false),
+		{
+			RoomMetadata: internal.RoomMetadata{RoomID: "!invite"},
+			UserRoomData: caches.UserRoomData{IsInvite: true},
+		},
+	}
+	f := newFinder(rooms)
+	collapse := false
+	testCases := []struct {
+		name    string
+		filters RequestFilters
+		want    []string
+	}{
+		{
+			name:    "collapses by default",
+			filters: RequestFilters{},
+			want:    []string{"!c", "!invited-successor", "!invite"},
+		},
+		{
+			name:    "collapse disabled",
+			filters: RequestFilters{CollapseUpgrades: &collapse},
+			want:    []string{"!a", "!b", "!c", "!invited-successor", "!invite"},
+		},
+	}
+	for _, tc := range testCases {
+		var got []string
+		for _, r := range rooms {
+			if tc.filters.Include(r, f) {
+				got = append(got, r.RoomID)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
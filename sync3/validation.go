@@ -0,0 +1,218 @@
+package sync3
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// MaxRequiredStateEntries is the max number of [type, state_key] pairs in required_state.
+	MaxRequiredStateEntries = 100
+	// maxRequiredStateLength is the max length of event types and state keys in required_state,
+	// which is the longest the spec allows either to be.
+	maxRequiredStateLength = 255
+)
+
+// ValidationError is returned when a request is malformed. Field is the path to the invalid value
+// in the request JSON e.g lists.foo.ranges[1], so clients can tell what to fix.
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Reason)
+}
+
+// ParseRequest decodes and validates a request body. Values of the wrong type are returned as a
+// *ValidationError, as are the errors from Request.Validate.
+func ParseRequest(body []byte) (*Request, error) {
+	var req Request
+	if err := json.Unmarshal(body, &req); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return nil, &ValidationError{
+				Field:  typeErr.Field,
+				Reason: fmt.Sprintf("must be %s, not %s", typeErr.Type, typeErr.Value),
+			}
+		}
+		return nil, err
+	}
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (rl RequestList) validate(field string) error {
+	for i, r := range rl.Ranges {
+		rangeField := fmt.Sprintf("%s.ranges[%d]", field, i)
+		if r[0] < 0 {
+			return &ValidationError{Field: rangeField, Reason: "must not be negative"}
+		}
+		if r[1] < r[0] {
+			return &ValidationError{Field: rangeField, Reason: fmt.Sprintf("ends before it starts: %d < %d", r[1], r[0])}
+		}
+		for j := 0; j < i; j++ {
+			other := rl.Ranges[j]
+			if r[0] <= other[1] && other[0] <= r[1] {
+				return &ValidationError{Field: rangeField, Reason: fmt.Sprintf("overlaps ranges[%d]", j)}
+			}
+		}
+	}
+	for i, sortBy := range rl.Sort {
+		if !isKnownSortOrder(sortBy) {
+			return &ValidationError{
+				Field:  fmt.Sprintf("%s.sort[%d]", field, i),
+				Reason: fmt.Sprintf("is not a known sort order: %q, must be one of %v", sortBy, SortBy),
+			}
+		}
+	}
+	return rl.RoomSubscription.validate(field)
+}
+
+func (rs RoomSubscription) validate(field string) error {
+	if rs.TimelineLimit < 0 {
+		return &ValidationError{Field: field + ".timeline_limit", Reason: "must not be negative"}
+	}
+	if len(rs.RequiredState) > MaxRequiredStateEntries {
+		return &ValidationError{
+			Field:  field + ".required_state",
+			Reason: fmt.Sprintf("has too many entries: %d > %d", len(rs.RequiredState), MaxRequiredStateEntries),
+		}
+	}
+	for i, tuple := range rs.RequiredState {
+		for j, s := range tuple {
+			if len(s) > maxRequiredStateLength {
+				return &ValidationError{
+					Field:  fmt.Sprintf("%s.required_state[%d][%d]", field, i, j),
+					Reason: fmt.Sprintf("is too long: %d > %d", len(s), maxRequiredStateLength),
+				}
+			}
+		}
+	}
+	if rs.IncludeOldRooms != nil {
+		return rs.IncludeOldRooms.validate(field + ".include_old_rooms")
+	}
+	return nil
+}
+
+func isKnownSortOrder(sortBy string) bool {
+	for _, known := range SortBy {
+		if sortBy == known {
+			return true
+		}
+	}
+	return false
+}
+
+// UnknownRequestFields returns the paths of the fields in the request JSON which the proxy does not
+// understand, e.g lists.foo.not_a_field. These are not rejected, as clients may send fields from
+// newer revisions of the MSC, but they are worth logging as they are often typos.
+func UnknownRequestFields(body []byte) []string {
+	var unknown []string
+	findUnknownFields(gjson.ParseBytes(body), reflect.TypeOf(Request{}), "", &unknown)
+	sort.Strings(unknown)
+	return unknown
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// findUnknownFields walks the JSON value alongside the type it is decoded into, appending the
+// path of every object key which does not match a field of a struct.
+func findUnknownFields(value gjson.Result, t reflect.Type, path string, unknown *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return // decoded by hand, so we can't tell which fields it uses
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if !value.IsObject() {
+			return
+		}
+		fields := jsonFields(t)
+		value.ForEach(func(key, v gjson.Result) bool {
+			fieldPath := joinFieldPath(path, key.Str)
+			fieldType, ok := lookupJSONField(fields, key.Str)
+			if !ok {
+				*unknown = append(*unknown, fieldPath)
+				return true
+			}
+			findUnknownFields(v, fieldType, fieldPath, unknown)
+			return true
+		})
+	case reflect.Map:
+		if !value.IsObject() {
+			return
+		}
+		value.ForEach(func(key, v gjson.Result) bool {
+			findUnknownFields(v, t.Elem(), joinFieldPath(path, key.Str), unknown)
+			return true
+		})
+	case reflect.Slice, reflect.Array:
+		if !value.IsArray() {
+			return
+		}
+		for i, v := range value.Array() {
+			findUnknownFields(v, t.Elem(), fmt.Sprintf("%s[%d]", path, i), unknown)
+		}
+	}
+}
+
+// jsonFields returns the JSON key and type of every field of the struct, including the fields of
+// embedded structs e.g the RoomSubscription fields of a RequestList.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			embedded := f.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for key, fieldType := range jsonFields(embedded) {
+					fields[key] = fieldType
+				}
+				continue
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// lookupJSONField finds the field for the key, ignoring case like encoding/json does.
+func lookupJSONField(fields map[string]reflect.Type, key string) (reflect.Type, bool) {
+	if fieldType, ok := fields[key]; ok {
+		return fieldType, true
+	}
+	for name, fieldType := range fields {
+		if strings.EqualFold(name, key) {
+			return fieldType, true
+		}
+	}
+	return nil, false
+}
+
+func joinFieldPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,151 @@
+package sync3
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRequest(t *testing.T) {
+	longType := strings.Repeat("a", 256)
+	testCases := []struct {
+		name      string
+		body      string
+		wantField string // empty if the request is valid
+	}{
+		{
+			name: "valid",
+			body: `{"lists":{"a":{"ranges":[[0,9],[20,29]],"sort":["by_recency"],"required_state":[["m.room.name",""]]}},
+				"room_subscriptions":{"!a:localhost":{"timeline_limit":5}},"extensions":{"receipts":{"enabled":true,"lists":["*"]}}}`,
+		},
+		{
+			name:      "wrong type",
+			body:      `{"lists":{"a":{"timeline_limit":"5"}}}`,
+			wantField: "lists.a.timeline_limit",
+		},
+		{
+			name:      "conn_id too long",
+			body:      `{"conn_id":"12345678901234567"}`,
+			wantField: "conn_id",
+		},
+		{
+			name:      "negative range",
+			body:      `{"lists":{"a":{"ranges":[[-1,9]]}}}`,
+			wantField: "lists.a.ranges[0]",
+		},
+		{
+			name:      "backwards range",
+			body:      `{"lists":{"a":{"ranges":[[0,9],[20,10]]}}}`,
+			wantField: "lists.a.ranges[1]",
+		},
+		{
+			name:      "overlapping ranges",
+			body:      `{"lists":{"a":{"ranges":[[0,9],[20,29],[5,15]]}}}`,
+			wantField: "lists.a.ranges[2]",
+		},
+		{
+			name:      "unknown sort",
+			body:      `{"lists":{"a":{"sort":["by_recency","by_colour"]}}}`,
+			wantField: "lists.a.sort[1]",
+		},
+		{
+			name:      "lists are checked in key order",
+			body:      `{"lists":{"b":{"timeline_limit":-1},"a":{"timeline_limit":-1}}}`,
+			wantField: "lists.a.timeline_limit",
+		},
+		{
+			name:      "too much required_state",
+			body:      `{"room_subscriptions":{"!a:localhost":{"required_state":[` + strings.Repeat(`["a",""],`, MaxRequiredStateEntries) + `["b",""]]}}}`,
+			wantField: "room_subscriptions.!a:localhost.required_state",
+		},
+		{
+			name:      "required_state event type too long",
+			body:      `{"lists":{"a":{"include_old_rooms":{"required_state":[["` + longType + `",""]]}}}}`,
+			wantField: "lists.a.include_old_rooms.required_state[0][0]",
+		},
+		{
+			name:      "room subscription to an alias",
+			body:      `{"room_subscriptions":{"#a:localhost":{}}}`,
+			wantField: "room_subscriptions.#a:localhost",
+		},
+		{
+			name:      "wildcard with other lists",
+			body:      `{"extensions":{"receipts":{"lists":["a","*"]}}}`,
+			wantField: "extensions.receipts.lists[1]",
+		},
+		{
+			name:      "duplicate rooms",
+			body:      `{"extensions":{"typing":{"rooms":["!a:localhost","!b:localhost","!a:localhost"]}}}`,
+			wantField: "extensions.typing.rooms[2]",
+		},
+	}
+	for _, tc := range testCases {
+		req, err := ParseRequest([]byte(tc.body))
+		if tc.wantField == "" {
+			if err != nil {
+				t.Errorf("%s: got error %v want none", tc.name, err)
+			} else if req == nil {
+				t.Errorf("%s: got nil request", tc.name)
+			}
+			continue
+		}
+		validationErr, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("%s: got error %v want *ValidationError", tc.name, err)
+			continue
+		}
+		if validationErr.Field != tc.wantField {
+			t.Errorf("%s: got field %q want %q (%v)", tc.name, validationErr.Field, tc.wantField, err)
+		}
+	}
+}
+
+func TestUnknownRequestFields(t *testing.T) {
+	body := `{
+		"lists": {"a": {"ranges": [[0, 9]], "timeline_limt": 5, "filters": {"is_dm": true, "is_spaces": true}}},
+		"room_subscriptions": {"!a:localhost": {"required_state": [["m.room.name", ""]], "include_old_rooms": {"timeline_limit": 1, "bogus": 1}}},
+		"extensions": {"receipts": {"enabled": true, "lists": ["a"]}, "not_an_extension": {}},
+		"Conn_ID": "a",
+		"new_field": [1, 2]
+	}`
+	got := UnknownRequestFields([]byte(body))
+	want := []string{
+		"extensions.not_an_extension",
+		"lists.a.filters.is_spaces",
+		"lists.a.timeline_limt",
+		"new_field",
+		"room_subscriptions.!a:localhost.include_old_rooms.bogus",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func FuzzParseRequest(f *testing.F) {
+	f.Add([]byte(`{"lists":{"a":{"ranges":[[0,20]],"sort":["by_recency"],"timeline_limit":1,"required_state":[["*","*"]],"filters":{"is_dm":true}}}}`))
+	f.Add([]byte(`{"room_subscriptions":{"!a:localhost":{"include_old_rooms":{"timeline_limit":1}}},"unsubscribe_rooms":["!b:localhost"]}`))
+	f.Add([]byte(`{"extensions":{"to_device":{"enabled":true,"since":"5"},"receipts":{"lists":["*"],"rooms":["!a:localhost"]}}}`))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		UnknownRequestFields(body)
+		req, err := ParseRequest(body)
+		if err != nil {
+			return
+		}
+		// valid requests must have valid ranges, and be usable by the rest of the proxy
+		for listKey, list := range req.Lists {
+			if !list.Ranges.Valid() {
+				t.Fatalf("lists.%s: ParseRequest accepted invalid ranges %v", listKey, list.Ranges)
+			}
+		}
+		muxed, _ := (*Request)(nil).ApplyDelta(req)
+		// and must survive a round trip
+		encoded, err := json.Marshal(muxed)
+		if err != nil {
+			t.Fatalf("failed to marshal valid request: %s", err)
+		}
+		if _, err := ParseRequest(encoded); err != nil {
+			t.Fatalf("request is invalid after a round trip: %s\n%s", err, encoded)
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package syncv3_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/testutils/m"
+	"github.com/tidwall/gjson"
+)
+
+// The admin API of the proxy, which must have been started with SYNCV3_FAULT_INJECTION=1.
+var adminBaseURL = os.Getenv("SYNCV3_ADMIN_ADDR")
+
+// injectFaults replaces the faults the proxy is injecting, and stops injecting them when the test ends.
+func injectFaults(t *testing.T, faults internal.Faults) {
+	t.Helper()
+	if adminBaseURL == "" {
+		t.Skip("SYNCV3_ADMIN_ADDR must be set to inject faults")
+	}
+	put := func(faults internal.Faults) error {
+		body, _ := json.Marshal(faults)
+		req, err := http.NewRequest("PUT", adminBaseURL+"/_syncv3/admin/faults", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			resBody, _ := io.ReadAll(res.Body)
+			return fmt.Errorf("PUT /faults returned %s: %s", res.Status, resBody)
+		}
+		return nil
+	}
+	if err := put(faults); err != nil {
+		t.Fatalf("failed to inject faults: %s", err)
+	}
+	t.Cleanup(func() {
+		if err := put(internal.Faults{}); err != nil {
+			t.Errorf("failed to stop injecting faults: %s", err)
+		}
+	})
+}
+
+// Test that messages sent whilst the homeserver is unreachable are delivered once it is reachable again.
+func TestFaultPollerFailures(t *testing.T) {
+	alice := registerNewUser(t)
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{})
+	res := alice.SlidingSyncUntilMembership(t, "", roomID, alice, "join")
+
+	// the poller retries after 3s, so more failures would make SlidingSyncUntil time out
+	injectFaults(t, internal.Faults{FailPolls: 2, FailPollsUserID: alice.UserID})
+	eventID1 := sendMessage(t, alice, roomID, "sent whilst failing 1")
+	eventID2 := sendMessage(t, alice, roomID, "sent whilst failing 2")
+	res = alice.SlidingSyncUntilEventID(t, res.Pos, roomID, eventID2)
+
+	// both messages are delivered, in order
+	res = alice.SlidingSync(t, sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomID: {TimelineLimit: 2},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID, MatchRoomTimeline([]Event{
+		{ID: eventID1},
+		{ID: eventID2},
+	})))
+}
+
+// Test that if payloads from the pollers are lost, clients are told to resync rather than silently
+// missing events.
+func TestFaultDroppedPayloads(t *testing.T) {
+	alice := registerNewUser(t)
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{})
+	req := sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 10,
+				},
+			},
+		},
+	}
+	res := alice.SlidingSyncUntilMembership(t, "", roomID, alice, "join")
+
+	injectFaults(t, internal.Faults{DropPayloads: 1, DropPayloadsRoomID: roomID})
+	eventID1 := sendMessage(t, alice, roomID, "lost")
+	// the API finds out about the lost payload when it receives the next one
+	eventID2 := sendMessage(t, alice, roomID, "after the lost one")
+
+	pos := res.Pos
+	seenEventID1 := false
+	start := time.Now()
+	for {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("timed out waiting for the connection to expire")
+		}
+		httpRes := alice.DoSlidingSync(t, req, WithPos(pos))
+		body := client.ParseJSON(t, httpRes)
+		if httpRes.StatusCode == 400 {
+			if errcode := gjson.GetBytes(body, "errcode").Str; errcode != "M_UNKNOWN_POS" {
+				t.Fatalf("got %s want M_UNKNOWN_POS", body)
+			}
+			break
+		}
+		var liveRes sync3.Response
+		if err := json.Unmarshal(body, &liveRes); err != nil {
+			t.Fatalf("failed to unmarshal response: %s", err)
+		}
+		pos = liveRes.Pos
+		// the second message must never be sent without the first
+		for _, ev := range liveRes.Rooms[roomID].Timeline {
+			switch gjson.GetBytes(ev, "event_id").Str {
+			case eventID1:
+				seenEventID1 = true
+			case eventID2:
+				if !seenEventID1 {
+					t.Fatalf("got %s without %s rather than a resync", eventID2, eventID1)
+				}
+			}
+		}
+	}
+
+	// resyncing gets both messages
+	res = alice.SlidingSyncUntilEventID(t, "", roomID, eventID2)
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID, MatchRoomTimelineMostRecent(2, []Event{
+		{ID: eventID1},
+		{ID: eventID2},
+	})))
+}
+
+// Test that a slow database slows the proxy down without breaking it.
+func TestFaultDBLatency(t *testing.T) {
+	alice := registerNewUser(t)
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{})
+	res := alice.SlidingSyncUntilMembership(t, "", roomID, alice, "join")
+
+	injectFaults(t, internal.Faults{DBLatencyMS: 200})
+	var eventIDs []string
+	for i := 0; i < 3; i++ {
+		eventIDs = append(eventIDs, sendMessage(t, alice, roomID, fmt.Sprintf("slow %d", i)))
+	}
+	res = alice.SlidingSyncUntilEventID(t, res.Pos, roomID, eventIDs[2])
+
+	res = alice.SlidingSync(t, sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomID: {TimelineLimit: 3},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID, MatchRoomTimeline([]Event{
+		{ID: eventIDs[0]},
+		{ID: eventIDs[1]},
+		{ID: eventIDs[2]},
+	})))
+}
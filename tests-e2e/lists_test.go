@@ -730,7 +730,6 @@ func TestChangeSortOrder(t *testing.T) {
 	}
 
 	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(4), m.MatchV3Ops(
-		m.MatchV3InvalidateOp(0, 3),
 		m.MatchV3SyncOp(0, 3, []string{gotNameToIDs["Apple"], gotNameToIDs["Kiwi"], gotNameToIDs["Lemon"], gotNameToIDs["Orange"]}),
 	)))
 }
@@ -1313,7 +1312,6 @@ func TestRangeOutsideTotalRooms(t *testing.T) {
 			"a",
 			m.MatchV3Count(3),
 			m.MatchV3Ops(
-				m.MatchV3InvalidateOp(0, 1),
 				m.MatchV3SyncOp(0, 1, []string{room2, room1}),
 			),
 		),
@@ -1665,7 +1663,7 @@ func TestAvatarFieldInRoomResponse(t *testing.T) {
 		res = alice.SlidingSyncUntil(t, res.Pos, sync3.Request{
 			Extensions: extensions.Request{
 				AccountData: &extensions.AccountDataRequest{
-					extensions.Core{Enabled: &boolTrue},
+					Core: extensions.Core{Enabled: &boolTrue},
 				},
 			},
 		}, func(response *sync3.Response) error {
@@ -1698,7 +1696,7 @@ func TestAvatarFieldInRoomResponse(t *testing.T) {
 		res = alice.SlidingSyncUntil(t, res.Pos, sync3.Request{
 			Extensions: extensions.Request{
 				AccountData: &extensions.AccountDataRequest{
-					extensions.Core{Enabled: &boolTrue},
+					Core: extensions.Core{Enabled: &boolTrue},
 				},
 			},
 		}, func(response *sync3.Response) error {
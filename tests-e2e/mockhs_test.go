@@ -0,0 +1,161 @@
+package syncv3_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/matrix-org/sliding-sync/testutils/m"
+	"github.com/matrix-org/sliding-sync/testutils/mockhs"
+	"github.com/tidwall/gjson"
+)
+
+// The control API of the mock homeserver, which is set when the proxy is polling it rather than a
+// real homeserver. See run-tests.sh.
+var mockHomeserverURL = os.Getenv("SYNCV3_MOCKHS_ADDR")
+
+// registerMockUser adds a new account to the mock homeserver, skipping the test if the proxy is
+// polling a real homeserver.
+func registerMockUser(t *testing.T) (*CSAPI, *mockhs.Client) {
+	t.Helper()
+	if mockHomeserverURL == "" {
+		t.Skip("SYNCV3_MOCKHS_ADDR must be set to use the mock homeserver")
+	}
+	hs := &mockhs.Client{BaseURL: mockHomeserverURL}
+	localpart := fmt.Sprintf("mock-%d-%d", time.Now().Unix(), atomic.AddUint64(&userCounter, 1))
+	c := &CSAPI{
+		CSAPI: &client.CSAPI{
+			Client:      client.NewLoggedClient(t, "localhost", nil),
+			BaseURL:     mockHomeserverURL,
+			UserID:      "@" + localpart + ":localhost",
+			AccessToken: localpart + "_token",
+			DeviceID:    "DEVICE",
+		},
+		Localpart: localpart,
+		Domain:    "localhost",
+	}
+	if err := hs.AddAccount(mockhs.Account{UserID: c.UserID, DeviceID: c.DeviceID, AccessToken: c.AccessToken}); err != nil {
+		t.Fatalf("failed to add account to the mock homeserver: %s", err)
+	}
+	return c, hs
+}
+
+// mockJoinedRoom returns a sync v2 response where the user has just created a room.
+func mockJoinedRoom(t *testing.T, userID, roomID string, timeline ...json.RawMessage) sync2.SyncResponse {
+	events := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", userID, map[string]interface{}{"creator": userID}),
+		testutils.NewJoinEvent(t, userID),
+	}
+	return sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				roomID: {Timeline: sync2.TimelineResponse{Events: append(events, timeline...)}},
+			},
+		},
+	}
+}
+
+// Test that the proxy retries polls which are rate limited or fail with gateway errors.
+func TestMockHSPollerRetriesErrors(t *testing.T) {
+	alice, hs := registerMockUser(t)
+	roomID := fmt.Sprintf("!%s:localhost", alice.Localpart)
+	msg := testutils.NewMessageEvent(t, alice.UserID, "hello")
+	for _, e := range []mockhs.Error{
+		{StatusCode: 429, ErrCode: "M_LIMIT_EXCEEDED", RetryAfterMS: 100},
+		{StatusCode: 502},
+	} {
+		if err := hs.QueueError(alice.UserID, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := hs.QueueSync(alice.UserID, mockJoinedRoom(t, alice.UserID, roomID, msg)); err != nil {
+		t.Fatal(err)
+	}
+	// the poller waits between failed polls, so this takes a few seconds
+	alice.SlidingSyncUntilEventID(t, "", roomID, gjson.GetBytes(msg, "event_id").Str)
+	if n, err := hs.NumSyncs(alice.AccessToken); err != nil || n < 3 {
+		t.Errorf("NumSyncs: got %d %v want at least 3", n, err)
+	}
+}
+
+// Test that conns are closed when the homeserver says the access token is no longer valid.
+func TestMockHSExpiredToken(t *testing.T) {
+	alice, hs := registerMockUser(t)
+	roomID := fmt.Sprintf("!%s:localhost", alice.Localpart)
+	if err := hs.QueueSync(alice.UserID, mockJoinedRoom(t, alice.UserID, roomID)); err != nil {
+		t.Fatal(err)
+	}
+	req := sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomID: {TimelineLimit: 1},
+		},
+	}
+	res := alice.SlidingSync(t, req)
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID))
+
+	if err := hs.ExpireToken(alice.AccessToken, false); err != nil {
+		t.Fatal(err)
+	}
+	// let the poller see the 401 and tell the API
+	time.Sleep(time.Second)
+	httpRes := alice.DoSlidingSync(t, req, WithPos(res.Pos))
+	body, _ := io.ReadAll(httpRes.Body)
+	if httpRes.StatusCode != 401 {
+		t.Fatalf("got HTTP %d want 401: %s", httpRes.StatusCode, body)
+	}
+	var jsonError struct {
+		ErrCode string `json:"errcode"`
+	}
+	if err := json.Unmarshal(body, &jsonError); err != nil || jsonError.ErrCode != "M_UNKNOWN_TOKEN" {
+		t.Fatalf("got %s want M_UNKNOWN_TOKEN", body)
+	}
+}
+
+// Test that a client whose access token expires with soft_logout can refresh it and carry on with
+// the same conn.
+func TestMockHSSoftLogoutKeepsConn(t *testing.T) {
+	alice, hs := registerMockUser(t)
+	roomID := fmt.Sprintf("!%s:localhost", alice.Localpart)
+	if err := hs.QueueSync(alice.UserID, mockJoinedRoom(t, alice.UserID, roomID)); err != nil {
+		t.Fatal(err)
+	}
+	req := sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomID: {TimelineLimit: 1},
+		},
+	}
+	res := alice.SlidingSync(t, req)
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID))
+
+	if err := hs.ExpireToken(alice.AccessToken, true); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+
+	t.Log("Alice refreshes her token and carries on with the same conn.")
+	alice.AccessToken = alice.Localpart + "_refreshed_token"
+	if err := hs.AddAccount(mockhs.Account{UserID: alice.UserID, DeviceID: alice.DeviceID, AccessToken: alice.AccessToken}); err != nil {
+		t.Fatal(err)
+	}
+	res = alice.SlidingSync(t, req, WithPos(res.Pos))
+
+	msg := testutils.NewMessageEvent(t, alice.UserID, "after refresh")
+	if err := hs.QueueSync(alice.AccessToken, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				roomID: {Timeline: sync2.TimelineResponse{Events: []json.RawMessage{msg}}},
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	alice.SlidingSyncUntilEventID(t, res.Pos, roomID, gjson.GetBytes(msg, "event_id").Str)
+}
@@ -2,12 +2,31 @@
 export SYNCV3_BINDADDR=0.0.0.0:8844
 export SYNCV3_ADDR='http://localhost:8844'
 export SYNCV3_DEBUG=1
+# faults are injected via the admin API
+export SYNCV3_FAULT_INJECTION=1
+export SYNCV3_ADMIN_BINDADDR=127.0.0.1:8845
+export SYNCV3_ADMIN_ADDR='http://localhost:8845'
+
+# With SYNCV3_MOCKHS=1, poll a mock homeserver instead of $SYNCV3_SERVER. Only the tests which use
+# the mock homeserver run, the rest are skipped.
+MOCKHS_PID=""
+if [ "${SYNCV3_MOCKHS:-}" = "1" ]; then
+  (cd .. && go build ./cmd/syncv3-mockhs)
+  ../syncv3-mockhs -bind 127.0.0.1:8846 &>> "${E2E_TEST_SERVER_STDOUT:-/dev/stdout}" &
+  MOCKHS_PID=$!
+  trap "kill $MOCKHS_PID" EXIT
+  export SYNCV3_SERVER='http://localhost:8846'
+  export SYNCV3_MOCKHS_ADDR='http://localhost:8846'
+  until curl -s -o /dev/null "$SYNCV3_SERVER/_matrix/client/versions"; do
+    sleep 0.1
+  done
+fi
 
 # Run the binary and stop it afterwards.
 # Direct stderr into stdout, and optionally redirect both to a file.
 ../syncv3 &> "${E2E_TEST_SERVER_STDOUT:-/dev/stdout}" &
 SYNCV3_PID=$!
-trap "kill $SYNCV3_PID" EXIT
+trap "kill $SYNCV3_PID $MOCKHS_PID" EXIT
 
 # wait for the server to be listening, we want this endpoint to 404 instead of connrefused
 attempts=0
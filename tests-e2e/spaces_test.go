@@ -155,9 +155,8 @@ func TestSpacesFilter(t *testing.T) {
 
 	// now completely change the space filter and ensure we see the right rooms
 	doSpacesListRequest([]string{parentD}, &res.Pos,
-		m.MatchV3Count(2), m.MatchV3Ops(
-			m.MatchV3InvalidateOp(0, 1),
-			m.MatchV3SyncOp(0, 1, []string{roomF, roomE}, true),
+		m.MatchV3Count(2), m.MatchV3OpsApply(
+			[]string{roomC, roomB}, []string{roomF, roomE}, true,
 		),
 	)
 }
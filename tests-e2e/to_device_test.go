@@ -10,6 +10,7 @@ import (
 
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
+	"github.com/matrix-org/sliding-sync/testutils/m"
 )
 
 // Test that if you login to an account -> send a to-device message to this device -> initial proxy connection
@@ -123,8 +124,12 @@ func TestToDeviceDropStaleKeyRequestsStreamNoDelete(t *testing.T) {
 		},
 	})
 	msgs1, res := loopUntilToDeviceEvent(t, alice, nil, "", "m.room_key_request", bob.UserID)
-	if len(msgs1) != 1 {
-		t.Fatalf("got %v want 1 message", jsonify(msgs1))
+	if err := m.CheckToDevice(msgs1, []m.ToDeviceMessage{{
+		Type: "m.room_key_request", Sender: bob.UserID, Content: map[string]interface{}{
+			"request_id": "A", "action": "request", "requesting_device_id": "mydevice",
+		},
+	}}); err != nil {
+		t.Fatal(err)
 	}
 
 	// now send a cancellation: we should not delete the cancellation
@@ -139,14 +144,12 @@ func TestToDeviceDropStaleKeyRequestsStreamNoDelete(t *testing.T) {
 	})
 	time.Sleep(100 * time.Millisecond)
 	msgs2, _ := loopUntilToDeviceEvent(t, alice, res, res.Extensions.ToDevice.NextBatch, "m.room_key_request", bob.UserID)
-	if len(msgs2) != 1 {
-		t.Fatalf("got %v want 1 message", jsonify(msgs2))
-	}
-	if gjson.ParseBytes(msgs1[0]).Get("content.action").Str != "request" {
-		t.Errorf("first message was not action: request: %v", string(msgs1[0]))
-	}
-	if gjson.ParseBytes(msgs2[0]).Get("content.action").Str != "request_cancellation" {
-		t.Errorf("second message was not action: request_cancellation: %v", string(msgs2[0]))
+	if err := m.CheckToDevice(msgs2, []m.ToDeviceMessage{{
+		Type: "m.room_key_request", Sender: bob.UserID, Content: map[string]interface{}{
+			"request_id": "A", "action": "request_cancellation", "requesting_device_id": "mydevice",
+		},
+	}}); err != nil {
+		t.Error(err)
 	}
 }
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"sync"
 	"testing"
 	"time"
@@ -173,7 +174,6 @@ func TestOutstandingRequestsGetCancelled(t *testing.T) {
 			}},
 		})
 		m.MatchResponse(t, res2, m.MatchList("a", m.MatchV3Count(2), m.MatchV3Ops(
-			m.MatchV3InvalidateOp(0, 1),
 			m.MatchV3SyncOp(0, 1, []string{roomB, roomA}),
 		)))
 		if time.Since(startTime) > time.Second {
@@ -434,8 +434,8 @@ func TestTxnIDResponseBuffering(t *testing.T) {
 	})
 	// this response should be the one for A
 	m.MatchResponse(t, res, m.MatchTxnID("a"), m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
-		m.MatchV3InvalidateOp(0, 0),
-		m.MatchV3SyncOp(0, 0, []string{roomA}),
+		m.MatchV3DeleteOp(0),
+		m.MatchV3InsertOp(0, roomA),
 	)))
 
 	// poll again
@@ -443,8 +443,8 @@ func TestTxnIDResponseBuffering(t *testing.T) {
 
 	// now we get the response for B
 	m.MatchResponse(t, res, m.MatchTxnID("b"), m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
-		m.MatchV3InvalidateOp(0, 0),
-		m.MatchV3SyncOp(0, 0, []string{roomB}),
+		m.MatchV3DeleteOp(0),
+		m.MatchV3InsertOp(0, roomB),
 	)))
 }
 
@@ -707,3 +707,180 @@ func TestExpiredAccessTokenMultipleConns(t *testing.T) {
 		}
 	}
 }
+
+// Test that a client which refreshes its access token (MSC2918) after the old one expired can carry on
+// with its existing conn, rather than being forced to do a full resync.
+func TestRefreshedAccessTokenKeepsConn(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	alice := "@TestRefreshedAccessTokenKeepsConn_alice:localhost"
+	oldToken := "ALICE_BEARER_TOKEN_TestRefreshedAccessTokenKeepsConn_old"
+	newToken := "ALICE_BEARER_TOKEN_TestRefreshedAccessTokenKeepsConn_new"
+	roomID := "!TestRefreshedAccessTokenKeepsConn:localhost"
+	v2.addAccountWithDeviceID(alice, "DEVICE", oldToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: createRoomState(t, alice, time.Now()),
+			}),
+		},
+	})
+	req := sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomID: {TimelineLimit: 1},
+		},
+	}
+	res := v3.mustDoV3Request(t, oldToken, req)
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID))
+
+	t.Log("The old token expires, but the device is still logged in.")
+	v2.expireTokenSoftly(oldToken)
+
+	t.Log("Alice refreshes her token and carries on with the same conn.")
+	v2.addAccountWithDeviceID(alice, "DEVICE", newToken)
+	res = v3.mustDoV3RequestWithPos(t, newToken, res.Pos, req)
+
+	t.Log("The poller picks up new events using the refreshed token.")
+	msg := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"msgtype": "m.text", "body": "hello"})
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: []json.RawMessage{msg},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, newToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID, m.MatchRoomTimelineMostRecent(1, []json.RawMessage{msg})))
+}
+
+// Test that two connections for the same device, distinguished by conn_id, keep their own positions
+// and sticky request parameters.
+func TestMultipleConnsSameDeviceAreIndependent(t *testing.T) {
+	rig := NewTestRig(t)
+	defer rig.Finish()
+	roomA := "!TestMultipleConnsSameDeviceAreIndependent_a:localhost"
+	roomB := "!TestMultipleConnsSameDeviceAreIndependent_b:localhost"
+	rig.SetupV2RoomsForUser(t, alice, NoFlush, map[string]RoomDescriptor{
+		roomA: {},
+		roomB: {},
+	})
+	aliceToken := rig.Token(alice)
+	// order the rooms B, A
+	rig.FlushText(t, alice, roomA, "A")
+	rig.FlushText(t, alice, roomB, "B")
+
+	resA := rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{
+		ConnID: "main",
+		Lists: map[string]sync3.RequestList{
+			"a": {Ranges: sync3.SliceRanges{{0, 0}}},
+		},
+	})
+	m.MatchResponse(t, resA, m.MatchList("a", m.MatchV3Count(2), m.MatchV3Ops(m.MatchV3SyncOp(0, 0, []string{roomB}))))
+	resB := rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{
+		ConnID: "notifications",
+		Lists: map[string]sync3.RequestList{
+			"a": {Ranges: sync3.SliceRanges{{0, 1}}},
+		},
+	})
+	m.MatchResponse(t, resB, m.MatchList("a", m.MatchV3Count(2), m.MatchV3Ops(m.MatchV3SyncOp(0, 1, []string{roomB, roomA}))))
+
+	t.Log("Bumping room A moves it to the top of both connections' lists, using each connection's own ranges.")
+	rig.FlushText(t, alice, roomA, "bump A")
+	resA = rig.V3.mustDoV3RequestWithPos(t, aliceToken, resA.Pos, sync3.Request{ConnID: "main"})
+	m.MatchResponse(t, resA, m.MatchList("a", m.MatchV3Count(2), m.MatchV3Ops(
+		m.MatchV3DeleteOp(0), m.MatchV3InsertOp(0, roomA),
+	)))
+	resB = rig.V3.mustDoV3RequestWithPos(t, aliceToken, resB.Pos, sync3.Request{ConnID: "notifications"})
+	m.MatchResponse(t, resB, m.MatchList("a", m.MatchV3Count(2), m.MatchV3Ops(
+		m.MatchV3DeleteOp(1), m.MatchV3InsertOp(0, roomA),
+	)))
+
+	t.Log("Changing the ranges on one connection does not affect the other.")
+	resA = rig.V3.mustDoV3RequestWithPos(t, aliceToken, resA.Pos, sync3.Request{
+		ConnID: "main",
+		Lists: map[string]sync3.RequestList{
+			"a": {Ranges: sync3.SliceRanges{{0, 1}}},
+		},
+	})
+	m.MatchResponse(t, resA, m.MatchList("a", m.MatchV3Count(2), m.MatchV3Ops(m.MatchV3SyncOp(1, 1, []string{roomB}))))
+	rig.FlushText(t, alice, roomB, "bump B")
+	resB = rig.V3.mustDoV3RequestWithPos(t, aliceToken, resB.Pos, sync3.Request{ConnID: "notifications"})
+	m.MatchResponse(t, resB, m.MatchList("a", m.MatchV3Count(2), m.MatchV3Ops(
+		m.MatchV3DeleteOp(1), m.MatchV3InsertOp(0, roomB),
+	)))
+}
+
+// Test that a device with two valid access tokens keeps polling when one of them is invalidated,
+// and its conns keep working with the other.
+func TestConcurrentAccessTokensForDevice(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	alice := "@TestConcurrentAccessTokensForDevice_alice:localhost"
+	tokenA := "ALICE_BEARER_TOKEN_TestConcurrentAccessTokensForDevice_A"
+	tokenB := "ALICE_BEARER_TOKEN_TestConcurrentAccessTokensForDevice_B"
+	roomID := "!TestConcurrentAccessTokensForDevice:localhost"
+	v2.addAccountWithDeviceID(alice, "DEVICE", tokenA)
+	v2.addAccountWithDeviceID(alice, "DEVICE", tokenB)
+	var mu sync.Mutex
+	polledWith := make(map[string]bool)
+	v2.SetCheckRequest(func(token string, req *http.Request) {
+		mu.Lock()
+		polledWith[token] = true
+		mu.Unlock()
+	})
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: createRoomState(t, alice, time.Now()),
+			}),
+		},
+	})
+	req := sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomID: {TimelineLimit: 1},
+		},
+	}
+	res := v3.mustDoV3Request(t, tokenA, req)
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID))
+
+	t.Log("Alice uses her second token, which the device's poller switches to.")
+	v3.mustDoV3Request(t, tokenB, sync3.Request{ConnID: "B"})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		switched := polledWith[tokenB]
+		mu.Unlock()
+		if switched {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("poller did not switch to the second token")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Log("The second token is invalidated, but the first still works.")
+	v2.invalidateToken(tokenB)
+	msg := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"msgtype": "m.text", "body": "hello"})
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: []json.RawMessage{msg},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, tokenA, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID, m.MatchRoomTimelineMostRecent(1, []json.RawMessage{msg})))
+}
@@ -2,6 +2,7 @@ package syncv3
 
 import (
 	"encoding/json"
+	"fmt"
 	"testing"
 	"time"
 
@@ -194,6 +195,21 @@ func TestExtensionE2EE(t *testing.T) {
 		t.Fatalf("sync request did not return immediately with OTK counts")
 	}
 
+	// check that the same OTK counts are not sent again, even if the homeserver repeats them
+	v2.queueResponse(alice, sync2.SyncResponse{
+		DeviceListsOTKCount: otkCounts,
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: "!doesnt-matter3",
+				name:   "Poke 3",
+				events: createRoomState(t, alice, time.Now()),
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchNoE2EEExtension())
+
 	// check that if we lose a device list update and restart from nothing, we see the same update
 	v2.queueResponse(alice, sync2.SyncResponse{
 		DeviceLists: struct {
@@ -443,6 +459,113 @@ func TestExtensionToDevice(t *testing.T) {
 	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(0)), m.MatchToDeviceMessages(newToDeviceMsgs))
 }
 
+// Test that a device with a huge backlog of to-device messages gets them in chunks, even if it asks
+// for them all at once.
+func TestExtensionToDeviceChunked(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	alice := "@TestExtensionToDeviceChunked_alice:localhost"
+	aliceToken := "ALICE_BEARER_TOKEN_TestExtensionToDeviceChunked"
+	v2.addAccount(t, alice, aliceToken)
+	toDeviceMsgs := make([]json.RawMessage, extensions.MaxToDeviceLimit+5)
+	for i := range toDeviceMsgs {
+		toDeviceMsgs[i] = json.RawMessage(fmt.Sprintf(`{"sender":"alice","type":"something","content":{"foo":"%d"}}`, i))
+	}
+	v2.queueResponse(alice, sync2.SyncResponse{
+		ToDevice: sync2.EventsResponse{
+			Events: toDeviceMsgs,
+		},
+	})
+
+	t.Log("Alice asks for all her to-device messages, but only gets the first chunk.")
+	req := sync3.Request{
+		Extensions: extensions.Request{
+			ToDevice: &extensions.ToDeviceRequest{
+				Core:  extensions.Core{Enabled: &boolTrue},
+				Limit: 100000,
+			},
+		},
+	}
+	res := v3.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, res, m.MatchToDeviceMessages(toDeviceMsgs[:extensions.MaxToDeviceLimit]))
+
+	t.Log("Advancing the since token returns the rest.")
+	req.Extensions.ToDevice.Since = res.Extensions.ToDevice.NextBatch
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchToDeviceMessages(toDeviceMsgs[extensions.MaxToDeviceLimit:]))
+}
+
+// Test that dehydrated devices (MSC3814) work through the proxy. Dehydrated devices have client-chosen
+// device IDs, so two users can end up with the same device ID. Check that their to-device messages are
+// not mixed up, and that the account data used to store the dehydration key is passed through.
+func TestExtensionToDeviceDehydratedDevice(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	deviceID := "DEHYDRATED_TestExtensionToDeviceDehydratedDevice"
+	alice := "@TestExtensionToDeviceDehydratedDevice_alice:localhost"
+	aliceToken := "ALICE_BEARER_TOKEN_TestExtensionToDeviceDehydratedDevice"
+	bob := "@TestExtensionToDeviceDehydratedDevice_bob:localhost"
+	bobToken := "BOB_BEARER_TOKEN_TestExtensionToDeviceDehydratedDevice"
+	v2.addAccountWithDeviceID(alice, deviceID, aliceToken)
+	v2.addAccountWithDeviceID(bob, deviceID, bobToken)
+
+	aliceMsgs := []json.RawMessage{
+		json.RawMessage(`{"sender":"alice","type":"m.room.encrypted","content":{"foo":"alice1"}}`),
+		json.RawMessage(`{"sender":"alice","type":"m.room.encrypted","content":{"foo":"alice2"}}`),
+	}
+	bobMsgs := []json.RawMessage{
+		json.RawMessage(`{"sender":"bob","type":"m.room.encrypted","content":{"foo":"bob1"}}`),
+	}
+	dehydrationKey := testutils.NewAccountData(t, "org.matrix.msc3814", map[string]interface{}{
+		"encrypted": map[string]interface{}{"some_key_id": map[string]interface{}{"ciphertext": "secret"}},
+	})
+	v2.queueResponse(aliceToken, sync2.SyncResponse{
+		AccountData: sync2.EventsResponse{
+			Events: []json.RawMessage{dehydrationKey},
+		},
+		ToDevice: sync2.EventsResponse{
+			Events: aliceMsgs,
+		},
+	})
+	v2.queueResponse(bobToken, sync2.SyncResponse{
+		ToDevice: sync2.EventsResponse{
+			Events: bobMsgs,
+		},
+	})
+
+	req := sync3.Request{
+		Extensions: extensions.Request{
+			ToDevice: &extensions.ToDeviceRequest{
+				Core: extensions.Core{Enabled: &boolTrue},
+			},
+			AccountData: &extensions.AccountDataRequest{
+				Core: extensions.Core{Enabled: &boolTrue},
+			},
+		},
+	}
+	aliceRes := v3.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, aliceRes, m.MatchToDeviceMessages(aliceMsgs), m.MatchHasGlobalAccountData(dehydrationKey))
+	bobRes := v3.mustDoV3Request(t, bobToken, req)
+	m.MatchResponse(t, bobRes, m.MatchToDeviceMessages(bobMsgs), m.MatchNoGlobalAccountData())
+
+	t.Log("Bob acknowledging his messages does not affect Alice's.")
+	bobReq := req
+	bobReq.Extensions.ToDevice = &extensions.ToDeviceRequest{
+		Core:  extensions.Core{Enabled: &boolTrue},
+		Since: bobRes.Extensions.ToDevice.NextBatch,
+	}
+	bobRes = v3.mustDoV3RequestWithPos(t, bobToken, bobRes.Pos, bobReq)
+	m.MatchResponse(t, bobRes, m.MatchToDeviceMessages([]json.RawMessage{}))
+	aliceRes = v3.mustDoV3RequestWithPos(t, aliceToken, aliceRes.Pos, req)
+	m.MatchResponse(t, aliceRes, m.MatchToDeviceMessages(aliceMsgs))
+}
+
 // tests that the account data extension works:
 // 1- check global account data is sent on first connection
 // 2- check global account data updates are proxied through
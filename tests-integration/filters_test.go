@@ -300,6 +300,13 @@ func TestFiltersRoomName(t *testing.T) {
 			},
 		},
 	})
+	// remember the order the rooms were sent in, as the ops for the refined filter are relative to it
+	var before []string
+	if ops := res.Lists["a"].Ops; len(ops) == 1 {
+		if syncOp, ok := ops[0].(*sync3.ResponseOpRange); ok {
+			before = append(before, syncOp.RoomIDs...)
+		}
+	}
 	m.MatchResponse(t, res, m.MatchList("a",
 		m.MatchV3Count(5),
 		m.MatchV3Ops(
@@ -322,14 +329,12 @@ func TestFiltersRoomName(t *testing.T) {
 			},
 		},
 	})
+	// the list is mostly unchanged, so we should get DELETE ops rather than an INVALIDATE and SYNC
 	m.MatchResponse(t, res, m.MatchList("a",
 		m.MatchV3Count(2),
-		m.MatchV3Ops(
-			m.MatchV3InvalidateOp(0, 4),
-			m.MatchV3SyncOp(0, 1, []string{
-				ridApple, ridPineapple,
-			}, true),
-		),
+		m.MatchV3OpsApply(before, []string{
+			ridApple, ridPineapple,
+		}, true),
 	))
 }
 
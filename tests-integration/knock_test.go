@@ -0,0 +1,96 @@
+package syncv3
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/matrix-org/sliding-sync/testutils/m"
+)
+
+// Test that rooms the user has knocked on are returned with their knock_state, both for knocks
+// which were made before the first sliding sync request and those which arrive live, and that
+// they are remembered across restarts.
+func TestKnockState(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+
+	preSyncKnockRoomID := "!pre-knock:localhost"
+	postSyncKnockRoomID := "!post-knock:localhost"
+	makeKnockState := func(name string) []json.RawMessage {
+		return []json.RawMessage{
+			testutils.NewStateEvent(t, "m.room.create", "", bob, map[string]interface{}{"creator": bob}),
+			testutils.NewStateEvent(t, "m.room.join_rules", "", bob, map[string]interface{}{"join_rule": "knock"}),
+			testutils.NewStateEvent(t, "m.room.name", "", bob, map[string]interface{}{"name": name}),
+			testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{"membership": "knock"}, testutils.WithTimestamp(time.Now())),
+		}
+	}
+	knockState := makeKnockState("pre sync knock")
+
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Knock: map[string]sync2.SyncV2KnockResponse{
+				preSyncKnockRoomID: {
+					KnockState: sync2.EventsResponse{
+						Events: knockState,
+					},
+				},
+			},
+		},
+	})
+
+	req := sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 1,
+				},
+			},
+		},
+	}
+	res := v3.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 0, []string{preSyncKnockRoomID}),
+	)), m.MatchRoomSubscription(preSyncKnockRoomID,
+		m.MatchRoomName("pre sync knock"),
+		m.MatchRoomKnockState(knockState),
+		m.MatchRoomLacksInviteState(),
+	))
+
+	// live stream knock
+	knockState2 := makeKnockState("post sync knock")
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Knock: map[string]sync2.SyncV2KnockResponse{
+				postSyncKnockRoomID: {
+					KnockState: sync2.EventsResponse{
+						Events: knockState2,
+					},
+				},
+			},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(2)), m.MatchRoomSubscription(postSyncKnockRoomID,
+		m.MatchRoomName("post sync knock"),
+		m.MatchRoomKnockState(knockState2),
+	))
+
+	// the knocks are loaded from the database after a restart
+	v3.restart(t, v2, pqString)
+	res = v3.mustDoV3Request(t, aliceToken, req)
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(2)),
+		m.MatchRoomSubscription(preSyncKnockRoomID, m.MatchRoomKnockState(knockState)),
+		m.MatchRoomSubscription(postSyncKnockRoomID, m.MatchRoomKnockState(knockState2)),
+	)
+}
@@ -1,7 +1,9 @@
 package syncv3
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"strings"
 	"testing"
 	"time"
@@ -458,3 +460,128 @@ func testDeleteMSC4115Field(t *testing.T, fieldName string) {
 		},
 	}))
 }
+
+// Test that simplified sliding sync (MSC4186) responses have no list operations, and include the
+// rooms with their bump stamps instead.
+func TestListsSimplified(t *testing.T) {
+	rig := NewTestRig(t)
+	defer rig.Finish()
+	roomA := "!TestListsSimplified_a:localhost"
+	roomB := "!TestListsSimplified_b:localhost"
+	rig.SetupV2RoomsForUser(t, alice, NoFlush, map[string]RoomDescriptor{
+		roomA: {},
+		roomB: {},
+	})
+	aliceToken := rig.Token(alice)
+	hasBumpStamp := func(r sync3.Room) error {
+		if r.BumpStamp == 0 {
+			return fmt.Errorf("missing bump_stamp")
+		}
+		if r.BumpStamp != r.Timestamp {
+			return fmt.Errorf("bump_stamp %d != timestamp %d", r.BumpStamp, r.Timestamp)
+		}
+		return nil
+	}
+	res := rig.V3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Simplified: true,
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 20}},
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchNoV3Ops(), m.MatchLists(map[string][]m.ListMatcher{
+		"a": {
+			m.MatchV3Count(2),
+		},
+	}), m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		roomA: {hasBumpStamp},
+		roomB: {hasBumpStamp},
+	}))
+
+	// nothing is sticky, so the list is resent
+	rig.FlushText(t, alice, roomB, "bump B")
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
+		Simplified: true,
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 20}},
+			},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchNoV3Ops(), m.MatchLists(map[string][]m.ListMatcher{
+		"a": {
+			m.MatchV3Count(2),
+		},
+	}), m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		roomB: {hasBumpStamp},
+	}))
+
+	// leaving the list out of the request removes it
+	res = rig.V3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{
+		Simplified: true,
+	})
+	m.MatchResponse(t, res, m.MatchLists(map[string][]m.ListMatcher{}))
+}
+
+// Test that purging a room removes it from lists and room subscriptions on existing connections, in the
+// same way as leaving it, rather than expiring the connections.
+func TestPurgeRoomDeletesFromLists(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	keepRoomID := "!TestPurgeRoomDeletesFromLists_keep:localhost"
+	purgeRoomID := "!TestPurgeRoomDeletesFromLists_purge:localhost"
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: keepRoomID,
+				events: createRoomState(t, alice, time.Now()),
+			}, roomEvents{
+				roomID: purgeRoomID,
+				events: createRoomState(t, alice, time.Now().Add(-time.Hour)),
+			}),
+		},
+	})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				Sort:   []string{sync3.SortByRecency},
+			},
+		},
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			purgeRoomID: {TimelineLimit: 1},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(2), m.MatchV3Ops(
+		m.MatchV3SyncOp(0, 1, []string{keepRoomID, purgeRoomID}),
+	)), m.MatchRoomSubscription(purgeRoomID))
+
+	if _, err := v3.h2.PurgeRoom(context.Background(), purgeRoomID); err != nil {
+		t.Fatalf("PurgeRoom: %s", err)
+	}
+
+	// the connection is still valid, and the room is deleted from the list
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1), m.MatchV3Ops(
+		m.MatchV3DeleteOp(1),
+	)), m.MatchRoomSubscriptionsStrict(nil))
+
+	// later updates to other rooms are still sent on the same connection
+	msg := testutils.NewMessageEvent(t, alice, "still here")
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: keepRoomID,
+				events: []json.RawMessage{msg},
+			}),
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchList("a", m.MatchV3Count(1)), m.MatchRoomSubscription(keepRoomID, m.MatchRoomTimelineMostRecent(1, []json.RawMessage{msg})))
+}
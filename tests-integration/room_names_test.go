@@ -36,6 +36,7 @@ func TestRoomNames(t *testing.T) {
 			name:   "My Room Name",
 			events: append(createRoomState(t, alice, latestTimestamp), []json.RawMessage{
 				testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "My Room Name"}, testutils.WithTimestamp(latestTimestamp.Add(2*time.Second))),
+				testutils.NewStateEvent(t, "m.room.canonical_alias", "", alice, map[string]interface{}{"alias": "#my-alias:localhost"}, testutils.WithTimestamp(latestTimestamp.Add(2*time.Second))),
 			}...),
 		},
 		{
@@ -138,6 +139,8 @@ func TestRoomNames(t *testing.T) {
 	checkRoomNameFilter("room na", []roomEvents{allRooms[1]})
 	// multiple matches
 	checkRoomNameFilter("bob", []roomEvents{allRooms[0], allRooms[3]})
+	// canonical aliases match too, even when the room has a name
+	checkRoomNameFilter("MY-ALIAS", []roomEvents{allRooms[1]})
 }
 
 // Tests that rooms have their names updated when events come in
@@ -0,0 +1,227 @@
+package syncv3
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
+
+	syncv3 "github.com/matrix-org/sliding-sync"
+)
+
+func doV2CompatRequest(t *testing.T, v3 *testV3Server, token, since string) (gjson.Result, int) {
+	t.Helper()
+	url := v3.srv.URL + "/_matrix/client/v3/sync?timeout=100"
+	if since != "" {
+		url += "&since=" + since
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("failed to make NewRequest: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := v3.srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("failed to Do request: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %s", err)
+	}
+	if resp.StatusCode == 200 && !json.Valid(body) {
+		t.Fatalf("sync v2 response is not JSON: %s", string(body))
+	}
+	return gjson.ParseBytes(body), resp.StatusCode
+}
+
+// Test that legacy sync v2 clients can sync from the proxy's database when SYNCV3_V2_COMPAT is set.
+func TestV2CompatSync(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString, syncv3.Opts{EnableV2Compat: true})
+	defer v2.close()
+	defer v3.close()
+	alice := "@TestV2CompatSync_alice:localhost"
+	aliceToken := "ALICE_BEARER_TOKEN_TestV2CompatSync"
+	roomID := "!TestV2CompatSync:localhost"
+	nameEvent := testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "v2 compat"})
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				state:  createRoomState(t, alice, time.Now()),
+				events: []json.RawMessage{nameEvent},
+			}),
+		},
+	})
+
+	t.Log("Alice does an initial sync v2 and sees the room with its state before the timeline.")
+	res, code := doV2CompatRequest(t, v3, aliceToken, "")
+	if code != 200 {
+		t.Fatalf("initial sync returned %d: %s", code, res.Raw)
+	}
+	room := res.Get("rooms.join").Map()[roomID]
+	if !room.Exists() {
+		t.Fatalf("initial sync missing room %s: %s", roomID, res.Raw)
+	}
+	if !room.Get(`state.events.#(type=="m.room.create")`).Exists() {
+		t.Fatalf("initial sync missing create event: %s", room.Raw)
+	}
+	nameEventID := gjson.GetBytes(nameEvent, "event_id").Str
+	if !room.Get(`timeline.events.#(event_id=="` + nameEventID + `")`).Exists() {
+		t.Fatalf("initial sync timeline missing name event: %s", room.Raw)
+	}
+	if room.Get(`state.events.#(event_id=="` + nameEventID + `")`).Exists() {
+		t.Fatalf("initial sync state includes the name event from the timeline: %s", room.Raw)
+	}
+	since := res.Get("next_batch").Str
+	if since == "" {
+		t.Fatalf("initial sync missing next_batch: %s", res.Raw)
+	}
+
+	t.Log("A message and a to-device message arrive.")
+	msg := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"msgtype": "m.text", "body": "hello"})
+	toDeviceMsg := json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"bar"}}`)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: []json.RawMessage{msg},
+			}),
+		},
+		ToDevice: sync2.EventsResponse{
+			Events: []json.RawMessage{toDeviceMsg},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+
+	t.Log("Alice's incremental sync only contains the new data.")
+	res, code = doV2CompatRequest(t, v3, aliceToken, since)
+	if code != 200 {
+		t.Fatalf("incremental sync returned %d: %s", code, res.Raw)
+	}
+	room = res.Get("rooms.join").Map()[roomID]
+	timeline := room.Get("timeline.events")
+	if len(timeline.Array()) != 1 || timeline.Get("0.event_id").Str != gjson.GetBytes(msg, "event_id").Str {
+		t.Fatalf("incremental sync timeline: got %s want [%s]", timeline.Raw, string(msg))
+	}
+	if room.Get("state.events.#").Int() != 0 {
+		t.Fatalf("incremental sync unexpectedly included state: %s", res.Raw)
+	}
+	toDevice := res.Get("to_device.events")
+	if len(toDevice.Array()) != 1 || toDevice.Get("0.content.foo").Str != "bar" {
+		t.Fatalf("incremental sync to-device: got %s want [%s]", toDevice.Raw, string(toDeviceMsg))
+	}
+
+	t.Log("An invite and some account data arrive.")
+	bob := "@TestV2CompatSync_bob:localhost"
+	inviteRoomID := "!TestV2CompatSync_invite:localhost"
+	inviteState := createRoomState(t, bob, time.Now())
+	inviteState = append(inviteState, testutils.NewStateEvent(t, "m.room.member", alice, bob, map[string]interface{}{
+		"membership": "invite",
+	}))
+	v2.queueResponse(alice, sync2.SyncResponse{
+		AccountData: sync2.EventsResponse{
+			Events: []json.RawMessage{json.RawMessage(`{"type":"com.example.global","content":{"foo":"bar"}}`)},
+		},
+		Rooms: sync2.SyncRoomsResponse{
+			Invite: map[string]sync2.SyncV2InviteResponse{
+				inviteRoomID: {
+					InviteState: sync2.EventsResponse{
+						Events: inviteState,
+					},
+				},
+			},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+
+	t.Log("Alice's incremental sync contains the invite and account data.")
+	res, code = doV2CompatRequest(t, v3, aliceToken, res.Get("next_batch").Str)
+	if code != 200 {
+		t.Fatalf("incremental sync returned %d: %s", code, res.Raw)
+	}
+	if !res.Get("rooms.invite").Map()[inviteRoomID].Exists() {
+		t.Fatalf("incremental sync missing invite to %s: %s", inviteRoomID, res.Raw)
+	}
+	if !res.Get(`account_data.events.#(type=="com.example.global")`).Exists() {
+		t.Fatalf("incremental sync missing account data: %s", res.Raw)
+	}
+	if len(res.Get("rooms.join").Map()) != 0 {
+		t.Fatalf("incremental sync unexpectedly included joined rooms: %s", res.Raw)
+	}
+
+	t.Log("Syncing again with the new since token returns nothing after the timeout.")
+	res, code = doV2CompatRequest(t, v3, aliceToken, res.Get("next_batch").Str)
+	if code != 200 {
+		t.Fatalf("incremental sync returned %d: %s", code, res.Raw)
+	}
+	if len(res.Get("rooms.join").Map()) != 0 || len(res.Get("rooms.invite").Map()) != 0 ||
+		len(res.Get("account_data.events").Array()) != 0 || len(res.Get("to_device.events").Array()) != 0 {
+		t.Fatalf("expected an empty sync, got %s", res.Raw)
+	}
+}
+
+// Test that a since token with a to-device position beyond what was sent to the device, e.g from
+// another deployment, does not delete the device's unsent to-device messages.
+func TestV2CompatSyncIgnoresUnsentToDevicePositions(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString, syncv3.Opts{EnableV2Compat: true})
+	defer v2.close()
+	defer v3.close()
+	alice := "@TestV2CompatSyncIgnoresUnsentToDevicePositions_alice:localhost"
+	aliceToken := "ALICE_BEARER_TOKEN_TestV2CompatSyncIgnoresUnsentToDevicePositions"
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{})
+
+	res, code := doV2CompatRequest(t, v3, aliceToken, "")
+	if code != 200 {
+		t.Fatalf("initial sync returned %d: %s", code, res.Raw)
+	}
+	since := res.Get("next_batch").Str
+
+	toDeviceMsg := json.RawMessage(`{"sender":"alice","type":"something","content":{"foo":"bar"}}`)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		ToDevice: sync2.EventsResponse{
+			Events: []json.RawMessage{toDeviceMsg},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+
+	t.Log("Alice syncs with a since token which acknowledges far more to-device messages than she was sent.")
+	parts := strings.Split(since, "_")
+	parts[1] = "999999"
+	res, code = doV2CompatRequest(t, v3, aliceToken, strings.Join(parts, "_"))
+	if code != 200 {
+		t.Fatalf("incremental sync returned %d: %s", code, res.Raw)
+	}
+	toDevice := res.Get("to_device.events")
+	if len(toDevice.Array()) != 1 || toDevice.Get("0.content.foo").Str != "bar" {
+		t.Fatalf("incremental sync to-device: got %s want [%s]", toDevice.Raw, string(toDeviceMsg))
+	}
+}
+
+// Test that GET /sync is still rejected when SYNCV3_V2_COMPAT is not set.
+func TestV2CompatSyncDisabled(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	alice := "@TestV2CompatSyncDisabled_alice:localhost"
+	aliceToken := "ALICE_BEARER_TOKEN_TestV2CompatSyncDisabled"
+	v2.addAccount(t, alice, aliceToken)
+	res, code := doV2CompatRequest(t, v3, aliceToken, "")
+	if code != http.StatusMethodNotAllowed {
+		t.Fatalf("got %d want %d: %s", code, http.StatusMethodNotAllowed, res.Raw)
+	}
+}
@@ -65,6 +65,7 @@ type testV2Server struct {
 	waiting                 map[string]*sync.Cond // broadcasts when the server is about to read a blocking input
 	srv                     *httptest.Server
 	invalidations           map[string]func() // token -> callback
+	softLogouts             map[string]bool   // tokens which 401 with soft_logout: true
 	timeToWaitForV2Response time.Duration
 }
 
@@ -131,6 +132,15 @@ func (s *testV2Server) invalidateToken(token string) {
 	time.Sleep(100 * time.Millisecond)
 }
 
+// like invalidateToken, but the 401 response says the device is still logged in, as if the token
+// expired and the client is expected to refresh it.
+func (s *testV2Server) expireTokenSoftly(token string) {
+	s.mu.Lock()
+	s.softLogouts[token] = true
+	s.mu.Unlock()
+	s.invalidateToken(token)
+}
+
 func (s *testV2Server) userID(token string) string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -252,6 +262,7 @@ func runTestV2Server(t testutils.TestBenchInterface) *testV2Server {
 		queues:                  make(map[string]chan sync2.SyncResponse),
 		waiting:                 make(map[string]*sync.Cond),
 		invalidations:           make(map[string]func()),
+		softLogouts:             make(map[string]bool),
 		mu:                      &sync.Mutex{},
 		timeToWaitForV2Response: time.Second,
 	}
@@ -289,6 +300,9 @@ func runTestV2Server(t testutils.TestBenchInterface) *testV2Server {
 		if userID == "" {
 			w.WriteHeader(401)
 			server.mu.Lock()
+			if server.softLogouts[token] {
+				w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Access token has expired","soft_logout":true}`))
+			}
 			fn := server.invalidations[token]
 			if fn != nil {
 				fn()
@@ -410,6 +424,7 @@ func runTestServer(t testutils.TestBenchInterface, v2Server *testV2Server, postg
 		combinedOpts.DBConnMaxIdleTime = opt.DBConnMaxIdleTime
 		combinedOpts.DBMaxConns = opt.DBMaxConns
 		combinedOpts.MaxTransactionIDDelay = opt.MaxTransactionIDDelay
+		combinedOpts.EnableV2Compat = opt.EnableV2Compat
 		if opt.MaxPendingEventUpdates > 0 {
 			combinedOpts.MaxPendingEventUpdates = opt.MaxPendingEventUpdates
 			handler.BufferWaitTime = 5 * time.Millisecond
@@ -421,6 +436,7 @@ func runTestServer(t testutils.TestBenchInterface, v2Server *testV2Server, postg
 	r.Use(hlog.NewHandler(logger))
 	r.Handle("/_matrix/client/v3/sync", h3)
 	r.Handle("/_matrix/client/unstable/org.matrix.msc3575/sync", h3)
+	r.Handle("/_matrix/client/unstable/org.matrix.simplified_msc3575/sync", h3)
 	srv := httptest.NewServer(r)
 	if !testutils.Quiet {
 		t.Logf("v2 @ %s", v2Server.url())
@@ -9,6 +9,7 @@ import (
 	"sort"
 	"testing"
 
+	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/tidwall/gjson"
 )
@@ -164,6 +165,20 @@ func MatchRoomInviteState(events []json.RawMessage) RoomMatcher {
 	}
 }
 
+func MatchRoomKnockState(events []json.RawMessage) RoomMatcher {
+	return func(r sync3.Room) error {
+		if len(r.KnockState) != len(events) {
+			return fmt.Errorf("knock state length mismatch, got %d want %d", len(r.KnockState), len(events))
+		}
+		for i := range events {
+			if !bytes.Equal(r.KnockState[i], events[i]) {
+				return fmt.Errorf("knock state event %d mismatch, got %v want %v", i, string(r.KnockState[i]), string(events[i]))
+			}
+		}
+		return nil
+	}
+}
+
 func MatchRoomHasInviteState() RoomMatcher {
 	return func(r sync3.Room) error {
 		if len(r.InviteState) == 0 {
@@ -401,6 +416,75 @@ func MatchToDeviceMessages(wantMsgs []json.RawMessage) RespMatcher {
 	}
 }
 
+// ToDeviceMessage is a to-device message as checked by MatchToDevice.
+type ToDeviceMessage struct {
+	Type   string
+	Sender string
+	// Content is the expected content of the message. If nil, any content matches.
+	Content map[string]interface{}
+}
+
+// MatchToDevice builds a matcher which asserts that the to-device messages in a sync
+// response are exactly `wantMsgs`, in order.
+//
+// The match fails if:
+//   - there is no to_device extension in the sync response,
+//   - the number of messages differs from `wantMsgs`,
+//   - a message has a different type or sender to the corresponding `wantMsgs`, or a
+//     different content if the wanted content is set.
+func MatchToDevice(wantMsgs []ToDeviceMessage) RespMatcher {
+	return func(res *sync3.Response) error {
+		if res.Extensions.ToDevice == nil {
+			return fmt.Errorf("MatchToDevice: no to_device extension")
+		}
+		return CheckToDevice(res.Extensions.ToDevice.Events, wantMsgs)
+	}
+}
+
+// CheckToDevice is like MatchToDevice, but checks to-device messages which have already been
+// pulled out of sync responses, e.g when syncing until a message arrives.
+func CheckToDevice(gotMsgs []json.RawMessage, wantMsgs []ToDeviceMessage) error {
+	if len(gotMsgs) != len(wantMsgs) {
+		return fmt.Errorf("MatchToDevice: got %d messages, want %d: %s", len(gotMsgs), len(wantMsgs), gotMsgs)
+	}
+	for i, want := range wantMsgs {
+		got := gjson.ParseBytes(gotMsgs[i])
+		if got.Get("type").Str != want.Type || got.Get("sender").Str != want.Sender {
+			return fmt.Errorf("MatchToDevice[%d]: got type %s sender %s, want type %s sender %s",
+				i, got.Get("type").Str, got.Get("sender").Str, want.Type, want.Sender)
+		}
+		if want.Content == nil {
+			continue
+		}
+		var gotContent map[string]interface{}
+		if err := json.Unmarshal([]byte(got.Get("content").Raw), &gotContent); err != nil {
+			return fmt.Errorf("MatchToDevice[%d]: failed to unmarshal content: %s", i, err)
+		}
+		// round trip the wanted content so numbers etc are compared like for like
+		wantJSON, _ := json.Marshal(want.Content)
+		var wantContent map[string]interface{}
+		_ = json.Unmarshal(wantJSON, &wantContent)
+		if !reflect.DeepEqual(gotContent, wantContent) {
+			return fmt.Errorf("MatchToDevice[%d]: got content %s want %s", i, got.Get("content").Raw, wantJSON)
+		}
+	}
+	return nil
+}
+
+// MatchNoToDeviceMessages builds a matcher which asserts that a sync response has no
+// to-device messages.
+func MatchNoToDeviceMessages() RespMatcher {
+	return func(res *sync3.Response) error {
+		if res.Extensions.ToDevice == nil {
+			return nil
+		}
+		if len(res.Extensions.ToDevice.Events) > 0 {
+			return fmt.Errorf("MatchNoToDeviceMessages: got %d messages, but expected none", len(res.Extensions.ToDevice.Events))
+		}
+		return nil
+	}
+}
+
 func MatchV3SyncOp(start, end int64, roomIDs []string, anyOrder ...bool) OpMatcher {
 	allowAnyOrder := len(anyOrder) > 0 && anyOrder[0]
 	return func(op sync3.ResponseOp) error {
@@ -506,6 +590,55 @@ func MatchV3Ops(matchOps ...OpMatcher) ListMatcher {
 	}
 }
 
+// MatchV3OpsApply applies the DELETE/INSERT ops of the list to `before`, a list which starts at index 0,
+// and checks that the result is `wantAfter`. Useful when the exact ops are an implementation detail.
+func MatchV3OpsApply(before, wantAfter []string, anyOrder ...bool) ListMatcher {
+	allowAnyOrder := len(anyOrder) > 0 && anyOrder[0]
+	return func(res sync3.ResponseList) error {
+		got := append([]string{}, before...)
+		gapIndex := -1
+		for i, op := range res.Ops {
+			oper, ok := op.(*sync3.ResponseOpSingle)
+			if !ok || oper.Index == nil || *oper.Index < 0 || *oper.Index > len(got) {
+				return fmt.Errorf("MatchV3OpsApply: op[%d] cannot be applied to %v: %+v", i, got, op)
+			}
+			switch oper.Operation {
+			case sync3.OpDelete:
+				if gapIndex != -1 {
+					got = append(got[:gapIndex], got[gapIndex+1:]...)
+				}
+				if *oper.Index >= len(got) {
+					return fmt.Errorf("MatchV3OpsApply: op[%d] deletes index %d of %v", i, *oper.Index, got)
+				}
+				gapIndex = *oper.Index
+			case sync3.OpInsert:
+				if gapIndex != -1 {
+					got = append(got[:gapIndex], got[gapIndex+1:]...)
+					gapIndex = -1
+				}
+				if *oper.Index > len(got) {
+					return fmt.Errorf("MatchV3OpsApply: op[%d] inserts at index %d of %v", i, *oper.Index, got)
+				}
+				got = append(got[:*oper.Index], append([]string{oper.RoomID}, got[*oper.Index:]...)...)
+			default:
+				return fmt.Errorf("MatchV3OpsApply: op[%d] is %s, want DELETE or INSERT", i, oper.Operation)
+			}
+		}
+		if gapIndex != -1 {
+			got = append(got[:gapIndex], got[gapIndex+1:]...)
+		}
+		want := append([]string{}, wantAfter...)
+		if allowAnyOrder {
+			sort.Strings(got)
+			sort.Strings(want)
+		}
+		if !reflect.DeepEqual(got, want) {
+			return fmt.Errorf("MatchV3OpsApply: got %v want %v", got, want)
+		}
+		return nil
+	}
+}
+
 func MatchTyping(roomID string, wantUserIDs []string) RespMatcher {
 	return func(res *sync3.Response) error {
 		if res.Extensions.Typing == nil {
@@ -617,6 +750,47 @@ func MatchReceipts(roomID string, wantReceipts []Receipt) RespMatcher {
 	}
 }
 
+// MatchReceiptsSeenBy builds a matcher which asserts that the aggregated "seen by" counts
+// of a room in a sync response are exactly `wantCounts`, keyed by event ID. A nil or empty
+// `wantCounts` matches a room without counts.
+func MatchReceiptsSeenBy(roomID string, wantCounts map[string]int) RespMatcher {
+	return func(res *sync3.Response) error {
+		if res.Extensions.Receipts == nil {
+			return fmt.Errorf("MatchReceiptsSeenBy: no receipts extension")
+		}
+		gotCounts := res.Extensions.Receipts.SeenBy[roomID]
+		if len(gotCounts) == 0 && len(wantCounts) == 0 {
+			return nil
+		}
+		if !reflect.DeepEqual(gotCounts, wantCounts) {
+			return fmt.Errorf("MatchReceiptsSeenBy: room %s got %v want %v", roomID, gotCounts, wantCounts)
+		}
+		return nil
+	}
+}
+
+// MatchAnnotations builds a matcher which asserts that the annotations extension in a sync
+// response has the given annotation counts for an event. An empty `wantCounts` asserts that
+// the event was sent with no annotations, i.e the client should remove any it has.
+func MatchAnnotations(roomID, eventID string, wantCounts []state.AnnotationCount) RespMatcher {
+	return func(res *sync3.Response) error {
+		if res.Extensions.Annotations == nil {
+			return fmt.Errorf("MatchAnnotations: no annotations extension")
+		}
+		gotCounts, ok := res.Extensions.Annotations.Rooms[roomID][eventID]
+		if !ok {
+			return fmt.Errorf("MatchAnnotations: missing event %s in room %s: got %+v", eventID, roomID, res.Extensions.Annotations.Rooms)
+		}
+		if len(gotCounts) == 0 && len(wantCounts) == 0 {
+			return nil
+		}
+		if !reflect.DeepEqual(gotCounts, wantCounts) {
+			return fmt.Errorf("MatchAnnotations: event %s got %+v want %+v", eventID, gotCounts, wantCounts)
+		}
+		return nil
+	}
+}
+
 // MatchAccountData builds a matcher which asserts that the account data in a sync
 // response /exactly/ matches the given `globals` and `rooms`, up to ordering.
 //
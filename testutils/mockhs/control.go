@@ -0,0 +1,129 @@
+package mockhs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// controlPrefix is the path of the API used to control a server in another process.
+const controlPrefix = "/_mockhs"
+
+func (s *Server) controlAddAccount(w http.ResponseWriter, req *http.Request) {
+	var a Account
+	if err := json.NewDecoder(req.Body).Decode(&a); err != nil || a.UserID == "" || a.DeviceID == "" || a.AccessToken == "" {
+		writeJSON(w, 400, map[string]string{"error": "user_id, device_id and access_token are required"})
+		return
+	}
+	s.AddAccount(a)
+	writeJSON(w, 200, struct{}{})
+}
+
+func (s *Server) controlQueueSync(w http.ResponseWriter, req *http.Request) {
+	var res sync2.SyncResponse
+	if err := json.NewDecoder(req.Body).Decode(&res); err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	controlRespond(w, s.QueueSync(mux.Vars(req)["who"], res))
+}
+
+func (s *Server) controlQueueError(w http.ResponseWriter, req *http.Request) {
+	var e Error
+	if err := json.NewDecoder(req.Body).Decode(&e); err != nil {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	controlRespond(w, s.QueueError(mux.Vars(req)["who"], e))
+}
+
+func (s *Server) controlExpireToken(w http.ResponseWriter, req *http.Request) {
+	softLogout := req.URL.Query().Get("soft_logout") == "true"
+	controlRespond(w, s.ExpireToken(mux.Vars(req)["who"], softLogout))
+}
+
+func (s *Server) controlNumSyncs(w http.ResponseWriter, req *http.Request) {
+	n, err := s.NumSyncs(mux.Vars(req)["who"])
+	if err != nil {
+		controlRespond(w, err)
+		return
+	}
+	writeJSON(w, 200, map[string]int{"count": n})
+}
+
+func controlRespond(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeJSON(w, 404, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, 200, struct{}{})
+}
+
+// Client controls a mock homeserver running in another process, e.g one started with
+// cmd/syncv3-mockhs. Its methods are the same as the Server's.
+type Client struct {
+	BaseURL string
+	Client  http.Client
+}
+
+func (c *Client) AddAccount(a Account) error {
+	return c.do("POST", "/accounts", a, nil)
+}
+
+func (c *Client) QueueSync(userIDOrToken string, res sync2.SyncResponse) error {
+	return c.do("POST", "/devices/"+url.PathEscape(userIDOrToken)+"/sync", res, nil)
+}
+
+func (c *Client) QueueError(userIDOrToken string, e Error) error {
+	return c.do("POST", "/devices/"+url.PathEscape(userIDOrToken)+"/error", e, nil)
+}
+
+func (c *Client) ExpireToken(token string, softLogout bool) error {
+	return c.do("POST", fmt.Sprintf("/devices/%s/expire?soft_logout=%t", url.PathEscape(token), softLogout), nil, nil)
+}
+
+func (c *Client) NumSyncs(userIDOrToken string) (int, error) {
+	var res struct {
+		Count int `json:"count"`
+	}
+	err := c.do("GET", "/devices/"+url.PathEscape(userIDOrToken)+"/syncs", nil, &res)
+	return res.Count, err
+}
+
+func (c *Client) do(method, path string, reqBody, resBody interface{}) error {
+	var body io.Reader
+	if reqBody != nil {
+		b, err := json.Marshal(reqBody)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.BaseURL+controlPrefix+path, body)
+	if err != nil {
+		return err
+	}
+	res, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("%s %s returned %s: %s", method, path, res.Status, b)
+	}
+	if resBody != nil {
+		return json.Unmarshal(b, resBody)
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+// Package mockhs is a stand-in for the parts of a homeserver's client-server API which the proxy
+// talks to: /versions, /account/whoami and /sync. Tests queue the sync v2 responses and errors each
+// device should see, so the proxy can be run without Synapse, and error paths like rate limiting,
+// gateway errors and expired tokens can be provoked on demand.
+//
+// The server can be used in-process via its methods, or run as a separate process with
+// cmd/syncv3-mockhs and driven over HTTP with a Client.
+package mockhs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// DefaultMaxSyncTimeout is the longest a /sync request waits for a queued response.
+const DefaultMaxSyncTimeout = 5 * time.Second
+
+// Error is an error response to return from /sync instead of a sync response.
+type Error struct {
+	StatusCode int `json:"status_code"`
+	// ErrCode is the Matrix error code e.g M_LIMIT_EXCEEDED. If empty, the response has a plain text
+	// body like the errors from a reverse proxy in front of a homeserver.
+	ErrCode      string `json:"errcode,omitempty"`
+	Message      string `json:"error,omitempty"`
+	SoftLogout   bool   `json:"soft_logout,omitempty"`
+	RetryAfterMS int    `json:"retry_after_ms,omitempty"`
+}
+
+// Account is a device which can sync with the server.
+type Account struct {
+	UserID      string `json:"user_id"`
+	DeviceID    string `json:"device_id"`
+	AccessToken string `json:"access_token"`
+}
+
+type queued struct {
+	res *sync2.SyncResponse
+	err *Error
+}
+
+type device struct {
+	Account
+	expired    bool
+	softLogout bool
+	queue      []queued
+	wake       chan struct{} // closed when the queue or token changes
+	numSyncs   int
+	nextBatch  int
+}
+
+func (d *device) wakeUp() {
+	close(d.wake)
+	d.wake = make(chan struct{})
+}
+
+// Server is a mock homeserver. It is an http.Handler, so can be served with httptest.NewServer.
+type Server struct {
+	// MaxSyncTimeout caps the timeout of /sync requests, so tests don't wait for long polls to end
+	// when nothing is queued. Defaults to DefaultMaxSyncTimeout.
+	MaxSyncTimeout time.Duration
+
+	mu      sync.Mutex
+	devices map[string]*device // access token -> device
+	router  *mux.Router
+}
+
+// NewServer creates a mock homeserver with no accounts.
+func NewServer() *Server {
+	s := &Server{
+		MaxSyncTimeout: DefaultMaxSyncTimeout,
+		devices:        make(map[string]*device),
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/_matrix/client/versions", s.versions).Methods("GET")
+	r.HandleFunc("/_matrix/client/{version:r0|v3}/account/whoami", s.whoami).Methods("GET")
+	r.HandleFunc("/_matrix/client/{version:r0|v3}/sync", s.sync).Methods("GET")
+	control := r.PathPrefix(controlPrefix).Subrouter()
+	control.HandleFunc("/accounts", s.controlAddAccount).Methods("POST")
+	control.HandleFunc("/devices/{who}/sync", s.controlQueueSync).Methods("POST")
+	control.HandleFunc("/devices/{who}/error", s.controlQueueError).Methods("POST")
+	control.HandleFunc("/devices/{who}/expire", s.controlExpireToken).Methods("POST")
+	control.HandleFunc("/devices/{who}/syncs", s.controlNumSyncs).Methods("GET")
+	s.router = r
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.router.ServeHTTP(w, req)
+}
+
+// AddAccount lets the access token be used with the server. Adding a new token for an existing
+// device is how clients refresh their tokens.
+func (s *Server) AddAccount(a Account) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices[a.AccessToken] = &device{
+		Account: a,
+		wake:    make(chan struct{}),
+	}
+}
+
+// QueueSync queues a response for the next /sync request for the user or access token. Responses
+// are returned in order, and the next_batch token is set if it is empty.
+func (s *Server) QueueSync(userIDOrToken string, res sync2.SyncResponse) error {
+	return s.enqueue(userIDOrToken, queued{res: &res})
+}
+
+// QueueError makes the next /sync request for the user or access token fail.
+func (s *Server) QueueError(userIDOrToken string, e Error) error {
+	if e.StatusCode < 400 {
+		return fmt.Errorf("status code %d is not an error", e.StatusCode)
+	}
+	return s.enqueue(userIDOrToken, queued{err: &e})
+}
+
+// ExpireToken makes every request with the access token fail with a 401, including any /sync
+// request which is waiting for a response. If softLogout is true, the response says the device is
+// still logged in and the client should refresh its token.
+func (s *Server) ExpireToken(token string, softLogout bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.devices[token]
+	if d == nil {
+		return fmt.Errorf("unknown access token")
+	}
+	d.expired = true
+	d.softLogout = softLogout
+	d.wakeUp()
+	return nil
+}
+
+// NumSyncs returns the number of /sync requests made by the user or access token, including
+// requests which failed.
+func (s *Server) NumSyncs(userIDOrToken string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.findDevice(userIDOrToken)
+	if d == nil {
+		return 0, fmt.Errorf("no device for user or access token %s", userIDOrToken)
+	}
+	return d.numSyncs, nil
+}
+
+func (s *Server) enqueue(userIDOrToken string, q queued) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.findDevice(userIDOrToken)
+	if d == nil {
+		return fmt.Errorf("no device for user or access token %s", userIDOrToken)
+	}
+	d.queue = append(d.queue, q)
+	d.wakeUp()
+	return nil
+}
+
+// findDevice returns the device with the access token, or the user's device if they only have one
+// with an unexpired token. Must be called with s.mu held.
+func (s *Server) findDevice(userIDOrToken string) *device {
+	if d := s.devices[userIDOrToken]; d != nil {
+		return d
+	}
+	var found *device
+	for _, d := range s.devices {
+		if d.UserID == userIDOrToken && !d.expired {
+			if found != nil && found.DeviceID != d.DeviceID {
+				return nil // ambiguous: the caller has to pick a device by its token
+			}
+			found = d
+		}
+	}
+	return found
+}
+
+func (s *Server) versions(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, 200, map[string]interface{}{
+		"versions": []string{"v1.1", "v1.2", "v1.3", "v1.4", "v1.5", "v1.6", "v1.7", "v1.8"},
+	})
+}
+
+func (s *Server) whoami(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	d, e := s.authenticate(req)
+	s.mu.Unlock()
+	if e != nil {
+		writeError(w, e)
+		return
+	}
+	writeJSON(w, 200, map[string]string{
+		"user_id":   d.UserID,
+		"device_id": d.DeviceID,
+	})
+}
+
+func (s *Server) sync(w http.ResponseWriter, req *http.Request) {
+	timeout := time.Duration(0)
+	if ms, err := strconv.Atoi(req.URL.Query().Get("timeout")); err == nil && ms > 0 {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	if timeout > s.MaxSyncTimeout {
+		timeout = s.MaxSyncTimeout
+	}
+	deadline := time.After(timeout)
+
+	s.mu.Lock()
+	if d := s.devices[accessToken(req)]; d != nil {
+		d.numSyncs++
+	}
+	d, e := s.authenticate(req)
+	for e == nil && len(d.queue) == 0 {
+		wake := d.wake
+		s.mu.Unlock()
+		select {
+		case <-wake:
+		case <-deadline:
+			s.mu.Lock()
+			d.nextBatch++
+			res := sync2.SyncResponse{NextBatch: fmt.Sprintf("s%d", d.nextBatch)}
+			s.mu.Unlock()
+			writeJSON(w, 200, res)
+			return
+		case <-req.Context().Done():
+			return
+		}
+		s.mu.Lock()
+		d, e = s.authenticate(req)
+	}
+	if e != nil {
+		s.mu.Unlock()
+		writeError(w, e)
+		return
+	}
+	next := d.queue[0]
+	d.queue = d.queue[1:]
+	if next.err != nil {
+		s.mu.Unlock()
+		writeError(w, next.err)
+		return
+	}
+	d.nextBatch++
+	res := *next.res
+	if res.NextBatch == "" {
+		res.NextBatch = fmt.Sprintf("s%d", d.nextBatch)
+	}
+	s.mu.Unlock()
+	writeJSON(w, 200, res)
+}
+
+// authenticate returns the device for the request's access token, or the error to return if there
+// isn't one. Must be called with s.mu held.
+func (s *Server) authenticate(req *http.Request) (*device, *Error) {
+	d := s.devices[accessToken(req)]
+	if d == nil {
+		return nil, &Error{StatusCode: 401, ErrCode: "M_UNKNOWN_TOKEN", Message: "Unrecognised access token"}
+	}
+	if d.expired {
+		return nil, &Error{StatusCode: 401, ErrCode: "M_UNKNOWN_TOKEN", Message: "Access token has expired", SoftLogout: d.softLogout}
+	}
+	return d, nil
+}
+
+func accessToken(req *http.Request) string {
+	if token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "); token != "" {
+		return token
+	}
+	return req.URL.Query().Get("access_token")
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, e *Error) {
+	if e.RetryAfterMS > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa((e.RetryAfterMS+999)/1000))
+	}
+	if e.ErrCode == "" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(e.StatusCode)
+		w.Write([]byte(http.StatusText(e.StatusCode)))
+		return
+	}
+	writeJSON(w, e.StatusCode, struct {
+		ErrCode      string `json:"errcode"`
+		Message      string `json:"error,omitempty"`
+		SoftLogout   bool   `json:"soft_logout,omitempty"`
+		RetryAfterMS int    `json:"retry_after_ms,omitempty"`
+	}{e.ErrCode, e.Message, e.SoftLogout, e.RetryAfterMS})
+}
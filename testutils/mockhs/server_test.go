@@ -0,0 +1,167 @@
+package mockhs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+const (
+	alice      = "@alice:localhost"
+	aliceToken = "ALICE_BEARER_TOKEN"
+)
+
+func newTestServer(t *testing.T) (*Server, *sync2.HTTPClient) {
+	s := NewServer()
+	s.MaxSyncTimeout = 50 * time.Millisecond
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	s.AddAccount(Account{UserID: alice, DeviceID: "ALICE", AccessToken: aliceToken})
+	return s, sync2.NewHTTPClient(time.Second, time.Second, srv.URL)
+}
+
+func TestSync(t *testing.T) {
+	s, client := newTestServer(t)
+	ctx := context.Background()
+
+	userID, deviceID, err := client.WhoAmI(ctx, aliceToken)
+	if err != nil || userID != alice || deviceID != "ALICE" {
+		t.Fatalf("WhoAmI: got %s %s %v want %s ALICE", userID, deviceID, err, alice)
+	}
+	if _, _, err = client.WhoAmI(ctx, "UNKNOWN"); err != sync2.HTTP401 {
+		t.Fatalf("WhoAmI with unknown token: got %v want HTTP401", err)
+	}
+
+	want := sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				"!a:localhost": {Timeline: sync2.TimelineResponse{Events: []json.RawMessage{json.RawMessage(`{"event_id":"$a"}`)}}},
+			},
+		},
+	}
+	if err = s.QueueSync(alice, want); err != nil {
+		t.Fatalf("QueueSync: %s", err)
+	}
+	res, code, err := client.DoSyncV2(ctx, aliceToken, "", true, false)
+	if err != nil || code != 200 {
+		t.Fatalf("DoSyncV2: got %d %v", code, err)
+	}
+	if len(res.Rooms.Join["!a:localhost"].Timeline.Events) != 1 || res.NextBatch == "" {
+		t.Fatalf("DoSyncV2: got %+v want the queued response with a next_batch", res)
+	}
+
+	// with nothing queued, long polls time out with an empty response
+	res, code, err = client.DoSyncV2(ctx, aliceToken, res.NextBatch, false, false)
+	if err != nil || code != 200 || len(res.Rooms.Join) != 0 || res.NextBatch == "" {
+		t.Fatalf("DoSyncV2: got %d %v %+v want an empty response", code, err, res)
+	}
+	if n, _ := s.NumSyncs(aliceToken); n != 2 {
+		t.Errorf("NumSyncs: got %d want 2", n)
+	}
+}
+
+func TestSyncErrors(t *testing.T) {
+	s, client := newTestServer(t)
+	ctx := context.Background()
+	s.QueueError(alice, Error{StatusCode: 429, ErrCode: "M_LIMIT_EXCEEDED", RetryAfterMS: 500})
+	s.QueueError(alice, Error{StatusCode: 502})
+	s.QueueError(alice, Error{StatusCode: 403, ErrCode: "M_USER_DEACTIVATED"})
+	for _, wantCode := range []int{429, 502, 403} {
+		_, code, err := client.DoSyncV2(ctx, aliceToken, "", false, false)
+		if code != wantCode || err == nil {
+			t.Errorf("DoSyncV2: got %d %v want %d", code, err, wantCode)
+		}
+		if wantCode == 403 && !errors.Is(err, sync2.ErrUserDeactivated) {
+			t.Errorf("DoSyncV2: got %v want ErrUserDeactivated", err)
+		}
+	}
+	if err := s.QueueError(alice, Error{StatusCode: 200}); err == nil {
+		t.Errorf("QueueError: queued a 200")
+	}
+}
+
+func TestExpireToken(t *testing.T) {
+	for _, softLogout := range []bool{false, true} {
+		s, client := newTestServer(t)
+		s.MaxSyncTimeout = 5 * time.Second
+		ctx := context.Background()
+
+		// expiring the token ends any long poll which is waiting for a response
+		errCh := make(chan error, 1)
+		go func() {
+			_, code, err := client.DoSyncV2(ctx, aliceToken, "s1", false, false)
+			if code != 401 {
+				t.Errorf("DoSyncV2: got %d want 401", code)
+			}
+			errCh <- err
+		}()
+		for n := 0; n == 0; n, _ = s.NumSyncs(aliceToken) {
+			time.Sleep(time.Millisecond)
+		}
+		start := time.Now()
+		s.ExpireToken(aliceToken, softLogout)
+		err := <-errCh
+		if time.Since(start) > time.Second {
+			t.Errorf("long poll was not woken up when the token expired")
+		}
+		if errors.Is(err, sync2.ErrSoftLogout) != softLogout {
+			t.Errorf("soft_logout=%v: DoSyncV2 returned %v", softLogout, err)
+		}
+		if _, _, err = client.WhoAmI(ctx, aliceToken); err != sync2.HTTP401 {
+			t.Errorf("WhoAmI: got %v want HTTP401", err)
+		}
+
+		// refreshing the token lets the device carry on
+		s.AddAccount(Account{UserID: alice, DeviceID: "ALICE", AccessToken: "REFRESHED"})
+		if err = s.QueueSync(alice, sync2.SyncResponse{}); err != nil {
+			t.Errorf("QueueSync: %s", err)
+		}
+		if _, code, err := client.DoSyncV2(ctx, "REFRESHED", "s1", false, false); code != 200 {
+			t.Errorf("DoSyncV2 with refreshed token: got %d %v", code, err)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	s := NewServer()
+	s.MaxSyncTimeout = 50 * time.Millisecond
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	c := &Client{BaseURL: srv.URL}
+	syncClient := sync2.NewHTTPClient(time.Second, time.Second, srv.URL)
+	ctx := context.Background()
+
+	if err := c.AddAccount(Account{UserID: alice, DeviceID: "ALICE", AccessToken: aliceToken}); err != nil {
+		t.Fatalf("AddAccount: %s", err)
+	}
+	if err := c.QueueSync(alice, sync2.SyncResponse{NextBatch: "custom"}); err != nil {
+		t.Fatalf("QueueSync: %s", err)
+	}
+	if err := c.QueueError(aliceToken, Error{StatusCode: 502}); err != nil {
+		t.Fatalf("QueueError: %s", err)
+	}
+	if err := c.QueueSync("@unknown:localhost", sync2.SyncResponse{}); err == nil {
+		t.Fatalf("QueueSync: queued a response for an unknown user")
+	}
+	res, code, err := syncClient.DoSyncV2(ctx, aliceToken, "", false, false)
+	if code != 200 || res.NextBatch != "custom" {
+		t.Fatalf("DoSyncV2: got %d %v %+v want the queued response", code, err, res)
+	}
+	if _, code, _ = syncClient.DoSyncV2(ctx, aliceToken, "custom", false, false); code != 502 {
+		t.Fatalf("DoSyncV2: got %d want 502", code)
+	}
+	if err = c.ExpireToken(aliceToken, true); err != nil {
+		t.Fatalf("ExpireToken: %s", err)
+	}
+	if _, _, err = syncClient.DoSyncV2(ctx, aliceToken, "custom", false, false); !errors.Is(err, sync2.ErrSoftLogout) {
+		t.Fatalf("DoSyncV2: got %v want ErrSoftLogout", err)
+	}
+	if n, err := c.NumSyncs(aliceToken); n != 3 || err != nil {
+		t.Fatalf("NumSyncs: got %d %v want 3", n, err)
+	}
+}
@@ -0,0 +1,40 @@
+package slidingsync
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// NewTLSConfig returns the TLS config for RunSyncV3Server, or nil if TLS is not configured.
+//
+// With a certificate and key, they are reloaded when the files change on disk. With ACME domains,
+// certificates for those domains are obtained and renewed automatically from Let's Encrypt using
+// the TLS-ALPN-01 challenge, so the proxy must be reachable on port 443 for those domains. Issued
+// certificates are stored in acmeCacheDir.
+func NewTLSConfig(certFile, keyFile string, acmeDomains []string, acmeCacheDir, acmeEmail string) (*tls.Config, error) {
+	if len(acmeDomains) > 0 {
+		if certFile != "" || keyFile != "" {
+			return nil, fmt.Errorf("cannot use ACME with a TLS certificate and key")
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(acmeDomains...),
+			Cache:      autocert.DirCache(acmeCacheDir),
+			Email:      acmeEmail,
+		}
+		return manager.TLSConfig(), nil
+	}
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	reloader, err := internal.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+	}, nil
+}
@@ -2,6 +2,7 @@ package slidingsync
 
 import (
 	"context"
+	"crypto/tls"
 	"embed"
 	"encoding/json"
 	"errors"
@@ -22,19 +23,17 @@ import (
 	_ "github.com/matrix-org/sliding-sync/state/migrations"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/matrix-org/sliding-sync/sync2/handler2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/extensions"
 	"github.com/matrix-org/sliding-sync/sync3/handler"
 	"github.com/pressly/goose/v3"
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 )
 
 //go:embed state/migrations/*
 var EmbedMigrations embed.FS
 
-var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-	Out:        os.Stderr,
-	TimeFormat: "15:04:05",
-})
+var logger = internal.NewLogger("server")
 var Version string
 
 type Opts struct {
@@ -58,6 +57,70 @@ type Opts struct {
 	HTTPTimeout time.Duration
 	// HTTPLongTimeout is used for initial sync requests
 	HTTPLongTimeout time.Duration
+
+	// UserCacheTTL is how long a user without connections can go without making a request before their
+	// UserCache is evicted from memory. MaxUserCaches bounds the number of UserCaches held in memory,
+	// evicting the least recently used. CacheMemoryBudgetBytes bounds the estimated size of the global
+	// and user caches, evicting the least recently used UserCaches. 0 disables any of these policies.
+	UserCacheTTL           time.Duration
+	MaxUserCaches          int
+	CacheMemoryBudgetBytes int64
+	// WarmUserCacheDevices is the number of most recently seen devices whose users' UserCaches are
+	// built in the background at startup. Capped at MaxUserCaches. 0 disables.
+	WarmUserCacheDevices int
+	// MetadataSnapshotInterval is how often to persist room metadata to speed up startup. 0 disables.
+	MetadataSnapshotInterval time.Duration
+	// MetadataReconcileRoomsPerMin is how many rooms' metadata to check against the database each
+	// minute, repairing any drift. 0 disables.
+	MetadataReconcileRoomsPerMin int
+	// EraseDeactivatedUsers erases the profile data and receipts of users who appear to have been
+	// deactivated on the homeserver. If false, deactivations are only logged.
+	EraseDeactivatedUsers bool
+	// ToDeviceTTL is how long to keep to-device messages which were sent to their device but not
+	// acknowledged. Messages which were never sent are kept. 0 keeps them forever.
+	ToDeviceTTL time.Duration
+	// EventArchiveURL is an S3-compatible bucket, addressed path-style e.g
+	// https://s3.example.com/bucket/prefix, which old events are archived to. If set, archived events
+	// are loaded from it when needed. ArchiveEventsAfter is how old events must be before they are
+	// archived: 0 disables archiving.
+	EventArchiveURL             string
+	EventArchiveRegion          string
+	EventArchiveAccessKeyID     string
+	EventArchiveSecretAccessKey string
+	ArchiveEventsAfter          time.Duration
+	// EnableV2Compat serves GET /_matrix/client/v3/sync from the proxy's database, so legacy sync v2
+	// clients pointed at the proxy keep working.
+	EnableV2Compat bool
+	// MaxListRanges and MaxListWindowSize bound the number of ranges, and the number of rooms
+	// covered by those ranges, in each list of a request. 0 means no limit.
+	MaxListRanges     int
+	MaxListWindowSize int64
+	// MaxRoomSubscriptions bounds the number of room subscriptions on a connection. 0 means no limit.
+	MaxRoomSubscriptions int
+	// DefaultEnabledExtensions are enabled for clients which don't set `enabled` on them, and
+	// DisabledExtensions are never enabled. Extensions are named as in requests e.g "receipts".
+	DefaultEnabledExtensions []string
+	DisabledExtensions       []string
+
+	// TokenPepper is a secret used to hash access tokens before they are stored, of the form
+	// ID:SECRET. If empty, tokens are hashed without a pepper. PreviousTokenPeppers are still
+	// accepted when looking up tokens, see sync2.SetTokenPeppers.
+	TokenPepper          string
+	PreviousTokenPeppers []string
+
+	// TokenIntrospectionURL is the OAuth 2.0 token introspection endpoint of the OIDC provider the
+	// homeserver delegates auth to (MSC3861). If set, access tokens are identified with it rather
+	// than /whoami, using TokenIntrospectionClientID and TokenIntrospectionClientSecret to
+	// authenticate. ServerName is needed to make user IDs from introspected usernames.
+	TokenIntrospectionURL          string
+	TokenIntrospectionClientID     string
+	TokenIntrospectionClientSecret string
+	TokenIntrospectionCacheTTL     time.Duration
+	ServerName                     string
+
+	// PubsubRecordFile is a file to record every payload sent between the pollers and the API to,
+	// for replaying with syncv3-replay. Appended to if it exists. Empty disables recording.
+	PubsubRecordFile string
 }
 
 type server struct {
@@ -88,6 +151,10 @@ func allowCORS(next http.Handler) http.HandlerFunc {
 
 // Setup the proxy
 func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Handler, http.Handler) {
+	if err := sync2.SetTokenPeppers(opts.TokenPepper, opts.PreviousTokenPeppers); err != nil {
+		logger.Panic().Err(err).Msg("invalid token pepper")
+	}
+
 	// Setup shared DB and HTTP client
 	v2Client := sync2.NewHTTPClient(opts.HTTPTimeout, opts.HTTPLongTimeout, destHomeserver)
 
@@ -123,6 +190,27 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 	if err != nil {
 		logger.Panic().Err(err).Msg("failed to execute migrations")
 	}
+	// Queries will still work without these indexes, but will be slow at scale.
+	if missing, err := state.MissingIndexes(db); err != nil {
+		logger.Warn().Err(err).Msg("failed to check for missing database indexes")
+	} else if len(missing) > 0 {
+		logger.Warn().Strs("indexes", missing).Msg(
+			"database indexes are missing or invalid, queries may be slow. Invalid indexes can be rebuilt with REINDEX INDEX CONCURRENTLY",
+		)
+	}
+	if opts.EventArchiveURL != "" {
+		objects, err := internal.NewS3ObjectStore(
+			&http.Client{Timeout: opts.HTTPTimeout}, opts.EventArchiveURL, opts.EventArchiveRegion,
+			opts.EventArchiveAccessKeyID, opts.EventArchiveSecretAccessKey,
+		)
+		if err != nil {
+			logger.Panic().Err(err).Msg("failed to configure event archive")
+		}
+		store.SetEventArchive(objects)
+		if opts.ArchiveEventsAfter > 0 {
+			go store.ArchiveEvents(opts.ArchiveEventsAfter)
+		}
+	}
 
 	bufferSize := 50
 	deviceDataUpdateFrequency := time.Second
@@ -134,26 +222,84 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 		opts.MaxPendingEventUpdates = 2000
 	}
 	pubSub := pubsub.NewPubSub(bufferSize)
+	var v2Pub pubsub.Notifier = pubSub
+	var v2Sub pubsub.Listener = pubSub
+	var v3Pub pubsub.Notifier = pubSub
+	if opts.PubsubRecordFile != "" {
+		f, err := os.OpenFile(opts.PubsubRecordFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			logger.Panic().Err(err).Str("file", opts.PubsubRecordFile).Msg("failed to open pubsub recording")
+		}
+		logger.Warn().Str("file", opts.PubsubRecordFile).Msg("recording pubsub payloads, which include user and room IDs")
+		recorder := pubsub.NewRecorder(f)
+		v2Pub = recorder.WrapNotifier(v2Pub)
+		v3Pub = recorder.WrapNotifier(v3Pub)
+	}
+	if opts.AddPrometheusMetrics {
+		// track how far the API is behind the pollers
+		lagTracker := pubsub.NewLagTracker("api")
+		v2Pub = lagTracker.WrapNotifier(v2Pub)
+		v2Sub = lagTracker.WrapListener(v2Sub)
+	}
 
 	pMap := sync2.NewPollerMap(v2Client, opts.AddPrometheusMetrics)
 	// create v2 handler
-	h2, err := handler2.NewHandler(pMap, storev2, store, pubSub, pubSub, opts.AddPrometheusMetrics, deviceDataUpdateFrequency)
+	h2, err := handler2.NewHandler(pMap, storev2, store, v2Pub, pubSub, opts.AddPrometheusMetrics, deviceDataUpdateFrequency)
 	if err != nil {
 		panic(err)
 	}
+	h2.EraseDeactivatedUsers = opts.EraseDeactivatedUsers
+	h2.SetToDeviceTTL(opts.ToDeviceTTL)
 	pMap.SetCallbacks(h2)
 
 	// create v3 handler
-	h3, err := handler.NewSync3Handler(store, storev2, v2Client, secret, pubSub, pubSub, opts.AddPrometheusMetrics, opts.MaxPendingEventUpdates, opts.MaxTransactionIDDelay)
+	h3, err := handler.NewSync3Handler(store, storev2, v2Client, secret, v3Pub, v2Sub, opts.AddPrometheusMetrics, opts.MaxPendingEventUpdates, opts.MaxTransactionIDDelay)
 	if err != nil {
 		panic(err)
 	}
+	h3.EnableV2Compat = opts.EnableV2Compat
+	h3.ListLimits = sync3.ListLimits{
+		MaxRanges:     opts.MaxListRanges,
+		MaxWindowSize: opts.MaxListWindowSize,
+	}
+	h3.MaxRoomSubscriptions = opts.MaxRoomSubscriptions
+	h3.Extensions.Config = extensions.Config{
+		DefaultEnabled: opts.DefaultEnabledExtensions,
+		Disabled:       opts.DisabledExtensions,
+	}
+	if err := h3.Extensions.Config.Validate(); err != nil {
+		panic("invalid extension configuration: " + err.Error())
+	}
+	if opts.TokenIntrospectionURL != "" {
+		h3.Introspector = sync2.NewTokenIntrospector(
+			&http.Client{Timeout: opts.HTTPTimeout}, opts.TokenIntrospectionURL,
+			opts.TokenIntrospectionClientID, opts.TokenIntrospectionClientSecret, opts.ServerName,
+			opts.TokenIntrospectionCacheTTL,
+		)
+	}
+	endPhase := h3.StartupPhase("global_snapshot")
 	storeSnapshot, err := store.GlobalSnapshot()
 	if err != nil {
 		panic(err)
 	}
-	logger.Info().Msg("retrieved global snapshot from database")
+	endPhase()
 	h3.Startup(&storeSnapshot)
+	if opts.WarmUserCacheDevices > 0 {
+		warmDevices := opts.WarmUserCacheDevices
+		if opts.MaxUserCaches > 0 && warmDevices > opts.MaxUserCaches {
+			warmDevices = opts.MaxUserCaches
+		}
+		go h3.WarmUserCaches(warmDevices)
+	}
+	if opts.UserCacheTTL > 0 || opts.MaxUserCaches > 0 || opts.CacheMemoryBudgetBytes > 0 {
+		go h3.EvictUserCaches(opts.UserCacheTTL, opts.MaxUserCaches, opts.CacheMemoryBudgetBytes)
+	}
+	if opts.MetadataSnapshotInterval > 0 {
+		go h3.PersistMetadataSnapshots(opts.MetadataSnapshotInterval)
+	}
+	if opts.MetadataReconcileRoomsPerMin > 0 {
+		go h3.ReconcileMetadata(opts.MetadataReconcileRoomsPerMin)
+	}
 
 	// begin consuming from these positions
 	h2.Listen()
@@ -161,12 +307,33 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 	return h2, h3
 }
 
-// RunSyncV3Server is the main entry point to the server
-func RunSyncV3Server(h http.Handler, bindAddr, destV2Server, tlsCert, tlsKey string) {
+// RunSyncV3Server is the main entry point to the server. If health is non-nil, /health and /ready
+// endpoints are served. If wellKnown is non-nil, /.well-known/matrix/client is served. Dehydrated
+// device (MSC3814) requests are passed through to destV2Server. ipFilter decides which clients may
+// make sync and dehydrated device requests and what their real IP addresses are; if nil, all clients
+// are allowed and no proxies are trusted. If tlsConfig is non-nil, TLS is served using it, see
+// NewTLSConfig.
+func RunSyncV3Server(h http.Handler, health *HealthChecker, wellKnown *WellKnown, ipFilter *IPFilter, bindAddr, destV2Server string, tlsConfig *tls.Config) {
 	// HTTP path routing
 	r := mux.NewRouter()
-	r.Handle("/_matrix/client/v3/sync", allowCORS(h))
-	r.Handle("/_matrix/client/unstable/org.matrix.msc3575/sync", allowCORS(h))
+	// only sync requests are filtered: health probes and discovery must work from anywhere
+	syncHandler := allowCORS(ipFilter.Middleware(h))
+	r.Handle("/_matrix/client/v3/sync", syncHandler)
+	r.Handle("/_matrix/client/unstable/org.matrix.msc3575/sync", syncHandler)
+	r.Handle("/_matrix/client/unstable/org.matrix.simplified_msc3575/sync", syncHandler)
+	dehydratedDevices, dehydratedErr := NewDehydratedDeviceProxy(destV2Server)
+	if dehydratedErr != nil {
+		logger.Fatal().Err(dehydratedErr).Msg("failed to create dehydrated device proxy")
+	}
+	r.PathPrefix(DehydratedDevicePathPrefix).Handler(allowCORS(ipFilter.Middleware(dehydratedDevices)))
+	if health != nil {
+		r.HandleFunc("/health", health.ServeLiveness).Methods("GET")
+		r.HandleFunc("/ready", health.ServeReadiness).Methods("GET")
+	}
+	if wellKnown != nil {
+		// clients on other origins discover the proxy from here, so this needs CORS
+		r.Handle("/.well-known/matrix/client", allowCORS(wellKnown))
+	}
 
 	serverJSON, _ := json.Marshal(struct {
 		Server  string `json:"server"`
@@ -196,7 +363,8 @@ func RunSyncV3Server(h http.Handler, bindAddr, destV2Server, tlsCert, tlsKey str
 				})
 			},
 			hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
-				if r.Method == "OPTIONS" {
+				// don't spam the logs with CORS preflights or health probes
+				if r.Method == "OPTIONS" || r.URL.Path == "/health" || r.URL.Path == "/ready" {
 					return
 				}
 				entry := internal.DecorateLogger(r.Context(), hlog.FromRequest(r).Info())
@@ -224,9 +392,15 @@ func RunSyncV3Server(h http.Handler, bindAddr, destV2Server, tlsCert, tlsKey str
 		listener := unixSocketListener(bindAddr)
 		err = http.Serve(listener, srv)
 	} else {
-		if tlsCert != "" && tlsKey != "" {
+		if tlsConfig != nil {
 			logger.Info().Msgf("listening TLS on %s", bindAddr)
-			err = http.ListenAndServeTLS(bindAddr, tlsCert, tlsKey, srv)
+			httpServer := &http.Server{
+				Addr:      bindAddr,
+				Handler:   srv,
+				TLSConfig: tlsConfig,
+			}
+			// the certificate comes from the TLS config
+			err = httpServer.ListenAndServeTLS("", "")
 		} else {
 			logger.Info().Msgf("listening on %s", bindAddr)
 			err = http.ListenAndServe(bindAddr, srv)
@@ -0,0 +1,59 @@
+package slidingsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// WellKnown serves /.well-known/matrix/client advertising the proxy via org.matrix.msc3575.proxy,
+// for deployments where the proxy sits on the client-facing domain.
+type WellKnown struct {
+	body []byte
+}
+
+// NewWellKnown creates a WellKnown advertising the proxy at proxyURL. If homeserverURL is set, it is
+// advertised as m.homeserver, making a complete .well-known response. If not, only the
+// org.matrix.msc3575.proxy fragment is served, for merging into the domain's existing .well-known.
+func NewWellKnown(proxyURL, homeserverURL string) (*WellKnown, error) {
+	if err := validateWellKnownURL(proxyURL); err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %s", err)
+	}
+	type urlJSON struct {
+		URL string `json:"url,omitempty"`
+		// the spec uses base_url for m.homeserver
+		BaseURL string `json:"base_url,omitempty"`
+	}
+	wellKnown := map[string]urlJSON{
+		"org.matrix.msc3575.proxy": {URL: proxyURL},
+	}
+	if homeserverURL != "" {
+		if err := validateWellKnownURL(homeserverURL); err != nil {
+			return nil, fmt.Errorf("invalid homeserver URL: %s", err)
+		}
+		wellKnown["m.homeserver"] = urlJSON{BaseURL: homeserverURL}
+	}
+	body, err := json.Marshal(wellKnown)
+	if err != nil {
+		return nil, err
+	}
+	return &WellKnown{body: body}, nil
+}
+
+func validateWellKnownURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("%q is not an absolute http(s) URL", u)
+	}
+	return nil
+}
+
+func (wk *WellKnown) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(wk.body)
+}
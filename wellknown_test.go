@@ -0,0 +1,60 @@
+package slidingsync
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWellKnown(t *testing.T) {
+	testCases := []struct {
+		name          string
+		proxyURL      string
+		homeserverURL string
+		wantErr       bool
+		wantBody      string
+	}{
+		{
+			name:     "fragment",
+			proxyURL: "https://slidingsync.example.com",
+			wantBody: `{"org.matrix.msc3575.proxy":{"url":"https://slidingsync.example.com"}}`,
+		},
+		{
+			name:          "complete",
+			proxyURL:      "https://slidingsync.example.com",
+			homeserverURL: "https://matrix.example.com",
+			wantBody:      `{"m.homeserver":{"base_url":"https://matrix.example.com"},"org.matrix.msc3575.proxy":{"url":"https://slidingsync.example.com"}}`,
+		},
+		{
+			name:     "relative proxy URL",
+			proxyURL: "slidingsync.example.com",
+			wantErr:  true,
+		},
+		{
+			name:          "bad homeserver URL",
+			proxyURL:      "https://slidingsync.example.com",
+			homeserverURL: "ftp://matrix.example.com",
+			wantErr:       true,
+		},
+	}
+	for _, tc := range testCases {
+		wk, err := NewWellKnown(tc.proxyURL, tc.homeserverURL)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: NewWellKnown returned no error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: NewWellKnown returned error: %s", tc.name, err)
+			continue
+		}
+		w := httptest.NewRecorder()
+		wk.ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/matrix/client", nil))
+		if w.Code != 200 {
+			t.Errorf("%s: got status %d want 200", tc.name, w.Code)
+		}
+		if got := w.Body.String(); got != tc.wantBody {
+			t.Errorf("%s: got body %s want %s", tc.name, got, tc.wantBody)
+		}
+	}
+}